@@ -3,14 +3,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -22,6 +25,40 @@ type AnsibleConfig struct {
 	VenvConfig    VenvConfig // Virtualenv config that Ansible will be executed in
 	Cwd           string     // Path to change to when running Ansible commands
 	InventoryList []string   // Paths to all desired inventories
+	HomeDir       string     // HOME for Ansible commands, so that ~/.ansible is kept out of the real home (default: inherited)
+	GalaxyDir     string     // Directory galaxy requirements are installed into and searched by Ansible (default: none)
+
+	VendoredCollections string // Collections shipped with the artifact, searched before GalaxyDir (default: none)
+
+	Executor Executor // Runs the Ansible commands (default: the virtualenv of VenvConfig)
+}
+
+// env returns the environment additions shared by all Ansible commands.
+func (a AnsibleConfig) env() []string {
+	var env []string
+	if a.HomeDir != "" {
+		env = append(env,
+			"HOME="+a.HomeDir,
+			"ANSIBLE_LOCAL_TEMP="+filepath.Join(a.HomeDir, ".ansible", "tmp"),
+		)
+	}
+	// Searched before the default paths, playbook adjacent collections and roles are searched first regardless
+	var collectionsPath []string
+	if a.VendoredCollections != "" {
+		collectionsPath = append(collectionsPath, a.VendoredCollections)
+	}
+	if a.GalaxyDir != "" {
+		collectionsPath = append(collectionsPath, filepath.Join(a.GalaxyDir, "collections"))
+	}
+	if len(collectionsPath) > 0 {
+		collectionsPath = append(collectionsPath, "~/.ansible/collections", "/usr/share/ansible/collections")
+		env = append(env, "ANSIBLE_COLLECTIONS_PATH="+strings.Join(collectionsPath, ":"))
+	}
+	if a.GalaxyDir != "" {
+		env = append(env, "ANSIBLE_ROLES_PATH="+filepath.Join(a.GalaxyDir, "roles")+":~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles")
+	}
+
+	return env
 }
 
 // CreateAnsibleTargetsList generates and returns an array of possible targets
@@ -58,7 +95,7 @@ func CreateAnsibleTargetsList() ([]string, error) {
 }
 
 // FindInventoryForHost calls CreateAnsibleTargetsList to get a list of possible targets
-// and returns the inventory and target that was found in that inventory.
+// and returns the inventory and target that was found in that inventory for the given playbook.
 // It stops on the first target match meaning that it assumes that hosts are
 // defined by only 1 type of target like their eth0 ip address or hostname
 // If the host was not found, it returns an error.
@@ -67,7 +104,7 @@ func CreateAnsibleTargetsList() ([]string, error) {
 // relative to the path defined in ansibleCfg.Cwd.
 //
 // The given hostname should be the full name that appears in the Ansible inventories.
-func (a AnsibleConfig) FindInventoryForHost() (string, string, error) {
+func (a AnsibleConfig) FindInventoryForHost(playbook string) (string, string, error) {
 	targets, err := CreateAnsibleTargetsList()
 	if err != nil {
 		return "", "", errors.Wrap(err, "Failed to perform the CreateAnsibleTargetsList command")
@@ -77,22 +114,24 @@ func (a AnsibleConfig) FindInventoryForHost() (string, string, error) {
 		_, err := os.Stat(inv)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return "", "", errors.Wrapf(err, "unable to find inventory: %s", item)
+				return "", "", fatalError{errors.Wrapf(err, "unable to find inventory: %s", item)}
 			}
 
 			return "", "", err
 		}
 
 		vCmd := VenvCommand{
-			Config: a.VenvConfig,
-			Binary: "ansible-playbook",
-			Args:   []string{viper.GetString("ansible-playbook"), "-i", inv, "--list-hosts"},
-			Cwd:    a.Cwd,
+			Config:   a.VenvConfig,
+			Binary:   "ansible-playbook",
+			Args:     []string{playbook, "-i", inv, "--list-hosts"},
+			Cwd:      a.Cwd,
+			Env:      a.env(),
+			Executor: a.Executor,
 		}
 
 		venvCommandOutput := vCmd.Run()
 		if err != nil {
-			logrus.Debugln("Ansible inventory output:", venvCommandOutput.Stdout)
+			ansibleLog.Debugln("Ansible inventory output:", venvCommandOutput.Stdout)
 			return "", "", errors.Wrap(err, "unable to list hosts for "+item)
 		}
 
@@ -101,12 +140,12 @@ func (a AnsibleConfig) FindInventoryForHost() (string, string, error) {
 		for _, target := range targets {
 			for _, line := range strings.Split(cleanOutput, "\n") {
 				if target == line {
-					logrus.Debug("Found ", target, " in inventory ", inv)
+					ansibleLog.Debug("Found ", target, " in inventory ", inv)
 					return inv, target, nil
 				}
 			}
 
-			logrus.Debug("Did not find ", target, " in inventory ", inv)
+			ansibleLog.Debug("Did not find ", target, " in inventory ", inv)
 		}
 	}
 	return "", "", errors.New("Unable to find one of the target in any inventory")
@@ -124,6 +163,7 @@ type AnsibleNodeStatus struct {
 // AnsibleRunOutput is a collection of all of the information given by an Ansible run.
 type AnsibleRunOutput struct {
 	Stats         map[string]AnsibleNodeStatus `json:"stats"`
+	Plays         []ansibleJSONPlay            `json:"plays"`
 	CommandOutput VenvCommandRunOutput
 }
 
@@ -132,57 +172,180 @@ type AnsibleRunOutput struct {
 // All dirs are relative to the tarball root.
 type AnsiblePlaybookRunner struct {
 	AnsibleConfig   AnsibleConfig
-	PlaybookPath    string   // Path to the playbook to run
-	InventoryPath   string   // Path to the appropriate inventory
-	LimitExpr       string   // "limit" expression to be passed to Ansible (default: none)
-	LocalConnection bool     // Whether or not to use a local connection
-	Env             []string // Envvars to pass into the Ansible run
+	PlaybookPath    string                 // Path to the playbook to run
+	InventoryPath   string                 // Path to the appropriate inventory
+	LimitExpr       string                 // "limit" expression to be passed to Ansible (default: none)
+	Tags            []string               // Only run plays and tasks tagged with these values (default: all)
+	SkipTags        []string               // Skip plays and tasks tagged with these values (default: none)
+	CheckMode       bool                   // Run in check mode, reporting changes without making them
+	Diff            bool                   // Report the changes of file and template tasks as diffs
+	TaskTimeout     int                    // Seconds after which a single task is terminated (default: no timeout)
+	Timeout         time.Duration          // Timeout of the whole ansible-playbook run (default: venvCommandTimeout)
+	ExtraVars       map[string]interface{} // Variables passed with --extra-vars, with the highest precedence
+	LocalConnection bool                   // Whether or not to connect to this host rather than those of the inventory
+	Connection      string                 // Connection plugin for this host with LocalConnection (default: local)
+	RemoteUser      string                 // User to connect to the hosts as (default: that of the inventory)
+	SSHCommonArgs   string                 // Extra arguments of ssh, sftp and scp
+	Env             []string               // Additional envvars to pass into the Ansible run
+	Output          io.Writer              // Optional writer that receives the output while Ansible runs
+	Heartbeat       time.Duration          // Log the current task this often while the run is quiet (default: never)
+	OutputTimeout   time.Duration          // Kill the run once it has been quiet for this long (default: no limit)
+	Scope           string                 // Prefix of the transient systemd scope unit to run ansible-playbook in (default: none)
 }
 
-// Run executes the ansible-playbook command defined in the associated AnsiblePlaybookRunner.
-func (a AnsiblePlaybookRunner) Run() (AnsibleRunOutput, error) {
+// args returns the arguments of the ansible-playbook command.
+func (a AnsiblePlaybookRunner) args() ([]string, error) {
 	args := []string{a.PlaybookPath, "-i", a.InventoryPath}
 
 	if a.LimitExpr != "" {
 		args = append(args, "-l", a.LimitExpr)
 	}
 
+	if len(a.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(a.Tags, ","))
+	}
+
+	if len(a.SkipTags) > 0 {
+		args = append(args, "--skip-tags", strings.Join(a.SkipTags, ","))
+	}
+
+	if a.CheckMode {
+		args = append(args, "--check")
+	}
+
+	if a.Diff {
+		args = append(args, "--diff")
+	}
+
 	if a.LocalConnection {
-		args = append(args, "-c", "local")
+		connection := a.Connection
+		if connection == "" {
+			connection = "local"
+		}
+		args = append(args, "-c", connection)
 	}
 
-	if len(a.Env) == 0 {
-		if viper.GetBool("debug") {
-			a.Env = []string{
-				"ANSIBLE_STDOUT_CALLBACK=default",
-				"ANSIBLE_CALLBACK_WHITELIST=",
-			}
-		} else {
-			a.Env = []string{
-				"ANSIBLE_STDOUT_CALLBACK=json",
-				"ANSIBLE_CALLBACK_WHITELIST=",
-			}
+	if a.RemoteUser != "" {
+		args = append(args, "-u", a.RemoteUser)
+	}
+
+	if a.SSHCommonArgs != "" {
+		args = append(args, "--ssh-common-args", a.SSHCommonArgs)
+	}
+
+	if len(a.ExtraVars) > 0 {
+		extraVars, err := json.Marshal(a.ExtraVars)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to serialize extra vars")
 		}
+		args = append(args, "--extra-vars", string(extraVars))
+	}
+
+	return args, nil
+}
+
+// env returns the environment additions of the ansible-playbook command.
+func (a AnsiblePlaybookRunner) env() []string {
+	env := []string{
+		"ANSIBLE_STDOUT_CALLBACK=json",
+		"ANSIBLE_CALLBACK_WHITELIST=",
+	}
+	if viper.GetBool("debug") {
+		env[0] = "ANSIBLE_STDOUT_CALLBACK=default"
+	}
+	if a.TaskTimeout > 0 {
+		env = append(env, fmt.Sprintf("ANSIBLE_TASK_TIMEOUT=%d", a.TaskTimeout))
+	}
+	env = append(env, a.AnsibleConfig.env()...)
+
+	return append(env, a.Env...)
+}
+
+// command returns the ansible-playbook command, without what Run adds to follow its progress.
+func (a AnsiblePlaybookRunner) command() (VenvCommand, error) {
+	args, err := a.args()
+	if err != nil {
+		return VenvCommand{}, err
 	}
 
 	vCmd := VenvCommand{
-		Config: a.AnsibleConfig.VenvConfig,
-		Binary: "ansible-playbook",
-		Args:   args,
-		Cwd:    a.AnsibleConfig.Cwd,
-		Env:    a.Env,
+		Config:   a.AnsibleConfig.VenvConfig,
+		Binary:   "ansible-playbook",
+		Args:     args,
+		Cwd:      a.AnsibleConfig.Cwd,
+		Env:      a.env(),
+		Output:   a.Output,
+		Timeout:  a.Timeout,
+		Executor: a.AnsibleConfig.Executor,
+		Scope:    a.Scope,
 	}
 
 	if viper.GetBool("debug") {
 		vCmd.StreamOutput = true
 	}
 
+	return vCmd, nil
+}
+
+// playbookJSON returns the output of the json callback in stdout. ansible-runner runs ansible-playbook in a
+// terminal, so warnings it prints to stderr before the output end up in stdout as well.
+func playbookJSON(stdout string) string {
+	if strings.HasPrefix(strings.TrimSpace(stdout), "{") {
+		return stdout
+	}
+	if i := strings.Index(stdout, "\n{"); i >= 0 {
+		return stdout[i+1:]
+	}
+	return stdout
+}
+
+// Run executes the ansible-playbook command defined in the associated AnsiblePlaybookRunner.
+func (a AnsiblePlaybookRunner) Run() (AnsibleRunOutput, error) {
 	var ansibleOutput AnsibleRunOutput
+
+	vCmd, err := a.command()
+	if err != nil {
+		ansibleOutput.CommandOutput.Exitcode = -1
+		return ansibleOutput, err
+	}
+
+	stopWatching := func() error { return nil }
+	if a.Heartbeat > 0 || a.OutputTimeout > 0 {
+		if !vCmd.StreamOutput {
+			// The json callback prints nothing until the end, the default callback of debug mode prints every task
+			pluginDir, err := writeProgressPlugin()
+			if err != nil {
+				ansibleOutput.CommandOutput.Exitcode = -1
+				return ansibleOutput, err
+			}
+			defer os.RemoveAll(pluginDir)
+			pluginPath := pluginDir
+			if path := callbackPluginPath(a); path != "" {
+				pluginPath += ":" + path
+			}
+			vCmd.Env = append(vCmd.Env, "ANSIBLE_CALLBACK_PLUGINS="+pluginPath)
+		}
+
+		progress := newRunProgress(time.Now)
+		vCmd.Output = progress
+		if a.Output != nil {
+			vCmd.Output = io.MultiWriter(a.Output, progress)
+		}
+		ctx, cancel := context.WithCancel(runsContext())
+		defer cancel()
+		vCmd.Context = ctx
+		stopWatching = watchProgress(progress, a.Heartbeat, a.OutputTimeout, cancel)
+	}
+
 	ansibleOutput.CommandOutput = vCmd.Run()
+	if hung := stopWatching(); hung != nil {
+		ansibleOutput.CommandOutput.Error = hung
+		ansibleOutput.CommandOutput.Exitcode = timeoutExitCode
+	}
 
-	jsonErr := json.Unmarshal([]byte(ansibleOutput.CommandOutput.Stdout), &ansibleOutput)
+	jsonErr := json.Unmarshal([]byte(playbookJSON(ansibleOutput.CommandOutput.Stdout)), &ansibleOutput)
 	if ansibleOutput.CommandOutput.Error != nil && jsonErr != nil {
-		logrus.Debug("Could not parse JSON from run. Ansible stdout:\n", ansibleOutput.CommandOutput.Stdout, "Ansible stderr:\n", ansibleOutput.CommandOutput.Stderr)
+		ansibleLog.Debug("Could not parse JSON from run. Ansible stdout:\n", ansibleOutput.CommandOutput.Stdout, "Ansible stderr:\n", ansibleOutput.CommandOutput.Stderr)
 	}
 	if ansibleOutput.CommandOutput.Error != nil {
 		return ansibleOutput, errors.Wrap(ansibleOutput.CommandOutput.Error, "ansible run failed")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"regexp"
 	"testing"
@@ -29,3 +30,63 @@ func TestHostnameLookup(t *testing.T) {
 	}
 	assert.True(t, found, "one of the targets should be an ip address")
 }
+
+func TestAnsibleConfigEnv(t *testing.T) {
+	assert.Empty(t, AnsibleConfig{}.env(), "should inherit the environment without a home dir")
+
+	env := AnsibleConfig{HomeDir: "/tmp/puller-home"}.env()
+	assert.Contains(t, env, "HOME=/tmp/puller-home")
+	assert.Contains(t, env, "ANSIBLE_LOCAL_TEMP=/tmp/puller-home/.ansible/tmp")
+}
+
+func TestAnsiblePlaybookRunnerArgs(t *testing.T) {
+	args, err := AnsiblePlaybookRunner{
+		PlaybookPath:    "site.yml",
+		InventoryPath:   "inventories/production",
+		LimitExpr:       "host1",
+		Tags:            []string{"nginx", "tls"},
+		CheckMode:       true,
+		Diff:            true,
+		LocalConnection: true,
+		ExtraVars: map[string]interface{}{
+			runContextVar: runContextVars{RunID: "1234", Trigger: runTriggerSchedule, Schedule: defaultScheduleName},
+		},
+	}.args()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"site.yml", "-i", "inventories/production", "-l", "host1", "--tags", "nginx,tls", "--check", "--diff", "-c", "local", "--extra-vars"}, args[:12])
+
+	var extraVars map[string]map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(args[12]), &extraVars))
+	assert.Equal(t, "1234", extraVars["ansible_puller"]["run_id"])
+	assert.Equal(t, "schedule", extraVars["ansible_puller"]["trigger"])
+	assert.Equal(t, "default", extraVars["ansible_puller"]["schedule"])
+}
+
+func TestAnsiblePlaybookRunnerControllerArgs(t *testing.T) {
+	args, err := AnsiblePlaybookRunner{
+		PlaybookPath:  "site.yml",
+		InventoryPath: "inventories/edge",
+		LimitExpr:     "site1",
+		RemoteUser:    "ansible",
+		SSHCommonArgs: "-o UserKnownHostsFile=/etc/ansible-puller/known_hosts",
+	}.args()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"site.yml", "-i", "inventories/edge", "-l", "site1", "-u", "ansible",
+		"--ssh-common-args", "-o UserKnownHostsFile=/etc/ansible-puller/known_hosts"}, args)
+}
+
+func TestAnsibleTaskTimeoutEnv(t *testing.T) {
+	runner := AnsiblePlaybookRunner{TaskTimeout: 600}
+	assert.Contains(t, runner.env(), "ANSIBLE_TASK_TIMEOUT=600")
+	assert.NotContains(t, AnsiblePlaybookRunner{}.env(), "ANSIBLE_TASK_TIMEOUT=0")
+}
+
+func TestPlaybookJSON(t *testing.T) {
+	output := "{\n  \"stats\": {}\n}\n"
+	assert.Equal(t, output, playbookJSON(output))
+	// Warnings before the output, from ansible-runner's terminal
+	assert.Equal(t, "{\r\n  \"stats\": {}\r\n}\r\n", playbookJSON("[WARNING]: No inventory was parsed\r\n{\r\n  \"stats\": {}\r\n}\r\n"))
+	assert.Equal(t, "not json", playbookJSON("not json"))
+}
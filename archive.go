@@ -0,0 +1,90 @@
+// Functions for creating gzipped tarballs
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Create a tarball at dest containing the contents of the src directory
+func createTgz(src, dest string) error {
+	return createTgzOf(src, dest, nil)
+}
+
+// Create a tarball at dest containing the contents of the src directory that include accepts, by path relative to
+// src. Directories that aren't accepted are skipped with their contents.
+func createTgzOf(src, dest string, include func(relPath string) bool) error {
+	outFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to create destination file")
+	}
+	defer outFile.Close()
+
+	gzipWriter := gzip.NewWriter(outFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if include != nil && !include(filepath.ToSlash(relPath)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to add files to tarball")
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return errors.Wrap(err, "unable to finalize tarball")
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return errors.Wrap(err, "unable to finalize gzip stream")
+	}
+
+	return outFile.Close()
+}
@@ -0,0 +1,309 @@
+// Authentication of the HTTP API: TLS with optional client certificates, and a shared token sent as a bearer token
+// or used to sign requests
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// What an endpoint requires of requests, per http-auth
+const (
+	authNone  = "none"
+	authToken = "token" // Bearer token or HMAC signature with the token of http-auth-token-file
+	authCert  = "cert"  // Client certificate verified against http-tls-client-ca
+	authAny   = "any"   // Either a token or a client certificate
+)
+
+// Keys of http-auth setting the default of all endpoints reading, or changing, the puller
+const (
+	authClassRead      = "read"      // GET endpoints
+	authClassSensitive = "sensitive" // GET endpoints with what playbooks would write to the host, e.g. secrets in diffs
+	authClassControl   = "control"   // All other methods
+)
+
+// Endpoints of authClassSensitive
+var sensitiveEndpoints = map[string]bool{httpPathDrift: true}
+
+const (
+	hmacAuthScheme = "HMAC-SHA256"
+
+	// Signed requests are accepted for this long either side of their timestamp
+	maxHMACSkew = 5 * time.Minute
+
+	// Signed requests with larger bodies are refused, as the whole body is read to check the signature
+	maxHMACBodySize = 1024 * 1024
+)
+
+// httpAuth decides which requests to the API are authenticated.
+type httpAuth struct {
+	token    []byte            // Shared secret, nil if not set
+	certs    bool              // Whether client certificates are verified
+	policies map[string]string // By route path template, or authClassRead, authClassSensitive and authClassControl
+
+	signaturesMutex sync.Mutex
+	signatures      map[string]time.Time // Signatures accepted within maxHMACSkew, by when they expire
+}
+
+var (
+	apiAuth *httpAuth   // nil when authentication is not set up
+	apiTLS  *tls.Config // nil when serving plain HTTP
+)
+
+// setupHTTPAuth loads the TLS configuration and the token of the API and checks the http-auth policies.
+func setupHTTPAuth() error {
+	tlsConfig, err := httpTLSConfig()
+	if err != nil {
+		return err
+	}
+	apiTLS = tlsConfig
+
+	// Probes usually can't authenticate, so the health endpoints are open unless http-auth says otherwise
+	auth := &httpAuth{
+		certs:      tlsConfig != nil && tlsConfig.ClientCAs != nil,
+		policies:   map[string]string{authClassRead: authAny, authClassSensitive: authAny, authClassControl: authAny, httpPathHealthz: authNone, httpPathReadyz: authNone},
+		signatures: map[string]time.Time{},
+	}
+	if tokenFile := viper.GetString("http-auth-token-file"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to read http-auth-token-file")
+		}
+		auth.token = bytes.TrimSpace(token)
+		if len(auth.token) == 0 {
+			return errors.New("http-auth-token-file is empty")
+		}
+	}
+
+	policies := viper.GetStringMapString("http-auth")
+	if auth.token == nil && !auth.certs {
+		if len(policies) > 0 {
+			return errors.New("http-auth requires http-auth-token-file or http-tls-client-ca")
+		}
+		apiAuth = nil
+		return nil
+	}
+	for endpoint, policy := range policies {
+		switch policy {
+		case authNone, authAny:
+		case authToken:
+			if auth.token == nil {
+				return errors.Errorf("http-auth of %s requires http-auth-token-file", endpoint)
+			}
+		case authCert:
+			if !auth.certs {
+				return errors.Errorf("http-auth of %s requires http-tls-client-ca", endpoint)
+			}
+		default:
+			return errors.Errorf("invalid http-auth %q of %s, expected none, token, cert or any", policy, endpoint)
+		}
+		auth.policies[endpoint] = policy
+	}
+
+	apiAuth = auth
+	return nil
+}
+
+// httpTLSConfig returns the TLS configuration of the API, or nil if http-tls-cert is not set.
+func httpTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := viper.GetString("http-tls-cert"), viper.GetString("http-tls-key")
+	clientCA := viper.GetString("http-tls-client-ca")
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("http-tls-client-ca requires http-tls-cert and http-tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("http-tls-cert and http-tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load http-tls-cert")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read http-tls-client-ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in http-tls-client-ca")
+		}
+		config.ClientCAs = pool
+		// Whether a certificate is required is up to the policy of the endpoint
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// routeTemplate returns the path template of the route matched by r, "" if there is none.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return ""
+}
+
+// policy returns what the endpoint matched by r requires.
+func (a *httpAuth) policy(r *http.Request) string {
+	template := routeTemplate(r)
+	if policy, ok := a.policies[template]; ok {
+		return policy
+	}
+	if sensitiveEndpoints[template] {
+		return a.policies[authClassSensitive]
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return a.policies[authClassRead]
+	}
+	return a.policies[authClassControl]
+}
+
+// authenticate returns an error if r does not satisfy policy.
+func (a *httpAuth) authenticate(r *http.Request, policy string) error {
+	if policy == authNone {
+		return nil
+	}
+
+	if (policy == authCert || policy == authAny) && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return nil
+	}
+	if (policy == authToken || policy == authAny) && a.token != nil && r.Header.Get("Authorization") != "" {
+		return a.checkToken(r)
+	}
+
+	if policy == authCert {
+		return errors.New("client certificate required")
+	}
+	return errors.New("authentication required")
+}
+
+// checkToken verifies the Authorization header of r, a bearer token or an HMAC signature.
+func (a *httpAuth) checkToken(r *http.Request) error {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(credentials)), a.token) != 1 {
+			return errors.New("invalid token")
+		}
+		return nil
+
+	case strings.EqualFold(scheme, hmacAuthScheme):
+		timestamp, signature, _ := strings.Cut(strings.TrimSpace(credentials), ":")
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("invalid signature timestamp")
+		}
+		if skew := time.Since(time.Unix(seconds, 0)); skew > maxHMACSkew || skew < -maxHMACSkew {
+			return errors.New("signature expired")
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHMACBodySize+1))
+		if err != nil {
+			return errors.Wrap(err, "unable to read the signed body")
+		}
+		if len(body) > maxHMACBodySize {
+			return errors.Errorf("signed body is larger than %d bytes", maxHMACBodySize)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		expected := signRequest(a.token, r.Method, r.URL.RequestURI(), timestamp, body)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return errors.New("invalid signature")
+		}
+		return a.useSignature(signature, time.Unix(seconds, 0).Add(maxHMACSkew))
+	}
+
+	return errors.Errorf("unsupported authorization scheme %q", scheme)
+}
+
+// useSignature returns an error if signature was accepted before, so that a signed request can't be sent again
+// while its timestamp is valid. Signatures are remembered until they expire.
+func (a *httpAuth) useSignature(signature string, expires time.Time) error {
+	a.signaturesMutex.Lock()
+	defer a.signaturesMutex.Unlock()
+
+	now := time.Now()
+	for seen, seenExpires := range a.signatures {
+		if now.After(seenExpires) {
+			delete(a.signatures, seen)
+		}
+	}
+	if _, ok := a.signatures[signature]; ok {
+		return errors.New("signature already used")
+	}
+	a.signatures[signature] = expires
+	return nil
+}
+
+// signRequest returns the hex HMAC-SHA256 with token of a request, over its method, URI, timestamp in Unix
+// seconds and the SHA-256 of its body, each on a line.
+func signRequest(token []byte, method, uri, timestamp string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, token)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(bodySum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// refuseSensitive refuses requests to sensitive endpoints over the network while authentication is not set up, so
+// that they are only served on the unix socket.
+func refuseSensitive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isSocketRequest(r) && sensitiveEndpoints[routeTemplate(r)] {
+			httpLog.Warnf("Refused %s %s from %s: authentication is not set up", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "requires http-auth-token-file or http-tls-client-ca, or the unix socket", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middleware refuses requests that don't satisfy the policy of their endpoint.
+func (a *httpAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSocketRequest(r) {
+			// Whoever can connect to the socket has been let in by its permissions
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := a.authenticate(r, a.policy(r)); err != nil {
+			httpLog.Warnf("Refused %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			promAuthFailures.Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+appName+`"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
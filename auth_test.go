@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthToken = "s3cr3t"
+
+// withHTTPAuth sets up authentication with the given token and http-auth policies, returning a function restoring
+// the configuration.
+func withHTTPAuth(t *testing.T, token string, policies map[string]string) (func(), error) {
+	keys := []string{"http-auth-token-file", "http-auth", "http-tls-cert", "http-tls-key", "http-tls-client-ca"}
+	original := map[string]interface{}{}
+	for _, key := range keys {
+		original[key] = viper.Get(key)
+		viper.Set(key, "")
+	}
+	viper.Set("http-auth", policies)
+	originalAuth, originalTLS := apiAuth, apiTLS
+
+	if token != "" {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600))
+		viper.Set("http-auth-token-file", tokenFile)
+	}
+
+	return func() {
+		for _, key := range keys {
+			viper.Set(key, original[key])
+		}
+		apiAuth, apiTLS = originalAuth, originalTLS
+	}, setupHTTPAuth()
+}
+
+func serveAPI(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rr := httptest.NewRecorder()
+	NewServer(func() {}).Handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestSetupHTTPAuth(t *testing.T) {
+	restore, err := withHTTPAuth(t, "", map[string]string{})
+	assert.Nil(t, err)
+	assert.Nil(t, apiAuth)
+	restore()
+
+	restore, err = withHTTPAuth(t, "", map[string]string{"read": "token"})
+	assert.NotNil(t, err)
+	restore()
+
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{"/run": "cert"})
+	assert.Contains(t, err.Error(), "requires http-tls-client-ca")
+	restore()
+
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{"/run": "maybe"})
+	assert.Contains(t, err.Error(), "invalid http-auth")
+	restore()
+
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{"read": "token"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{authClassRead: authToken, authClassSensitive: authAny, authClassControl: authAny, httpPathHealthz: authNone, httpPathReadyz: authNone}, apiAuth.policies)
+	restore()
+
+	// Nothing but the probes is open once authentication is set up
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, authAny, apiAuth.policies[authClassRead])
+	restore()
+
+	restore, _ = withHTTPAuth(t, "", map[string]string{})
+	viper.Set("http-tls-client-ca", "ca.pem")
+	assert.NotNil(t, setupHTTPAuth())
+	restore()
+}
+
+func TestHTTPAuthBearerToken(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{})
+	defer restore()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("GET", httpPathStatus, "", nil).Code)
+	assert.Equal(t, http.StatusOK, serveAPI("GET", httpPathStatus, "", http.Header{"Authorization": {"Bearer " + testAuthToken}}).Code)
+	assert.Equal(t, http.StatusOK, serveAPI("GET", httpPathHealthz, "", nil).Code)
+
+	rr := serveAPI("POST", httpPathCachePurge, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "Bearer")
+
+	rr = serveAPI("POST", httpPathCachePurge, "", http.Header{"Authorization": {"Bearer wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = serveAPI("POST", httpPathCachePurge, "", http.Header{"Authorization": {"Bearer " + testAuthToken}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestHTTPAuthPerEndpoint(t *testing.T) {
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{"read": "token", "/metrics": "none", "/runs/{id}": "none"})
+	defer restore()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("GET", httpPathStatus, "", nil).Code)
+	assert.Equal(t, http.StatusOK, serveAPI("GET", "/metrics", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveAPI("GET", "/runs/unknown", "", nil).Code)
+}
+
+func TestHTTPAuthSensitive(t *testing.T) {
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+
+	// Only on the unix socket without authentication
+	restore, err := withHTTPAuth(t, "", map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, serveAPI("GET", httpPathDrift, "", nil).Code)
+	req := httptest.NewRequest("GET", httpPathDrift, nil)
+	req = req.WithContext(context.WithValue(req.Context(), socketRequestKey{}, true))
+	rr := httptest.NewRecorder()
+	NewServer(func() {}).Handler.ServeHTTP(rr, req)
+	assert.NotEqual(t, http.StatusForbidden, rr.Code)
+	restore()
+
+	// Authenticated even while reading is open
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{"read": "none"})
+	defer restore()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, serveAPI("GET", httpPathStatus, "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("GET", httpPathDrift, "", nil).Code)
+	assert.NotEqual(t, http.StatusUnauthorized, serveAPI("GET", httpPathDrift, "", http.Header{"Authorization": {"Bearer " + testAuthToken}}).Code)
+}
+
+func TestHTTPAuthHMAC(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{})
+	defer restore()
+	assert.Nil(t, err)
+
+	body := `{"unknown": true}`
+	signed := func(timestamp time.Time, body string) http.Header {
+		seconds := strconv.FormatInt(timestamp.Unix(), 10)
+		signature := signRequest([]byte(testAuthToken), "POST", httpPathRun, seconds, []byte(body))
+		return http.Header{"Authorization": {hmacAuthScheme + " " + seconds + ":" + signature}}
+	}
+
+	// Authenticated, and the handler still reads the body and refuses it
+	rr := serveAPI("POST", httpPathRun, body, signed(time.Now(), body))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = serveAPI("POST", httpPathRun, `{"check_mode": true}`, signed(time.Now(), body))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid signature")
+
+	rr = serveAPI("POST", httpPathRun, body, signed(time.Now().Add(-time.Hour), body))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "signature expired")
+
+	// Replayed
+	header := signed(time.Now().Add(-time.Minute), body)
+	assert.Equal(t, http.StatusBadRequest, serveAPI("POST", httpPathRun, body, header).Code)
+	rr = serveAPI("POST", httpPathRun, body, header)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "signature already used")
+
+	// Too large to be read whole
+	large := strings.Repeat(" ", maxHMACBodySize+1)
+	rr = serveAPI("POST", httpPathRun, large, signed(time.Now(), large))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "signed body is larger than")
+}
+
+func TestHTTPAuthClientCertificate(t *testing.T) {
+	auth := &httpAuth{certs: true, policies: map[string]string{authClassRead: authNone, authClassControl: authAny}}
+	req := httptest.NewRequest("POST", httpPathRun, nil)
+	assert.NotNil(t, auth.authenticate(req, authCert))
+	assert.NotNil(t, auth.authenticate(req, authAny))
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	assert.Nil(t, auth.authenticate(req, authCert))
+	assert.Nil(t, auth.authenticate(req, authAny))
+	assert.NotNil(t, auth.authenticate(req, authToken))
+}
+
+func TestClientAuthentication(t *testing.T) {
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{})
+	defer restore()
+	assert.Nil(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer "+testAuthToken, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"app_name": "ansible-puller"}`))
+	}))
+	defer server.Close()
+
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	viper.Set("http-tls-cert", certFile)
+	assert.True(t, strings.HasPrefix(defaultDaemonURL(), "https://"))
+
+	status, _, err := newDaemonClient(server.URL).status()
+	assert.Nil(t, err)
+	assert.Equal(t, "ansible-puller", status.AppName)
+
+	// Any other certificate is refused
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	_, _, err = newDaemonClient(other.URL).status()
+	assert.NotNil(t, err)
+}
+
+func TestClientCertificate(t *testing.T) {
+	restore, err := withHTTPAuth(t, "", map[string]string{})
+	defer restore()
+	assert.Nil(t, err)
+	defer func() {
+		viper.Set("http-client-cert", "")
+		viper.Set("http-client-key", "")
+	}()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"app_name": "ansible-puller"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	viper.Set("http-tls-cert", certFile)
+	_, _, err = newDaemonClient(server.URL).status()
+	assert.NotNil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	assert.Nil(t, ioutil.WriteFile(clientCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(clientKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	viper.Set("http-client-cert", clientCert)
+	viper.Set("http-client-key", clientKey)
+
+	status, _, err := newDaemonClient(server.URL).status()
+	assert.Nil(t, err)
+	assert.Equal(t, "ansible-puller", status.AppName)
+}
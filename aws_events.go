@@ -0,0 +1,179 @@
+// Publishing of lifecycle events to Amazon SNS and EventBridge
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/pkg/errors"
+)
+
+// Source of the events put on an EventBridge bus, names starting with "aws." are reserved
+const eventBridgeSource = "com.teslamotors.ansible-puller"
+
+// awsAPIClient sends signed requests to an AWS API, with credentials from the default chain.
+type awsAPIClient struct {
+	config   aws.Config
+	service  string // Signing name of the service
+	endpoint string // Defaults to the regional endpoint of the service
+	client   *http.Client
+}
+
+func newAWSAPIClient(config aws.Config, service string) awsAPIClient {
+	return awsAPIClient{
+		config:   config,
+		service:  service,
+		endpoint: fmt.Sprintf("https://%s.%s.%s/", service, config.Region, awsDNSSuffix(config.Region)),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// awsDNSSuffix returns the domain of the endpoints of the partition region is in.
+func awsDNSSuffix(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "amazonaws.com.cn"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "sc2s.sgov.gov"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "c2s.ic.gov"
+	}
+
+	return "amazonaws.com"
+}
+
+func (c awsAPIClient) post(contentType string, headers map[string]string, body []byte) ([]byte, error) {
+	ctx := context.TODO()
+	credentials, err := c.config.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to retrieve AWS credentials")
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), c.service, c.config.Region, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to sign request")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bad status code: %v: %s", resp.StatusCode, strings.TrimSpace(string(response)))
+	}
+
+	return response, nil
+}
+
+// snsSink publishes events to an SNS topic, as the JSON event format in the message.
+//
+// The event type is added as the "type" message attribute, so subscriptions can filter on it.
+type snsSink struct {
+	api      awsAPIClient
+	topicARN string
+}
+
+func (s snsSink) Send(event cloudEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode event")
+	}
+
+	form := url.Values{}
+	form.Set("Action", "Publish")
+	form.Set("Version", "2010-03-31")
+	form.Set("TopicArn", s.topicARN)
+	form.Set("Message", string(message))
+	form.Set("MessageAttributes.entry.1.Name", "type")
+	form.Set("MessageAttributes.entry.1.Value.DataType", "String")
+	form.Set("MessageAttributes.entry.1.Value.StringValue", event.Type)
+
+	_, err = s.api.post("application/x-www-form-urlencoded; charset=utf-8", nil, []byte(form.Encode()))
+	return err
+}
+
+// eventBridgeSink puts events on an EventBridge bus, with the event type as the detail type.
+type eventBridgeSink struct {
+	api     awsAPIClient
+	busName string
+}
+
+func (s eventBridgeSink) Send(event cloudEvent) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode event")
+	}
+
+	request, err := json.Marshal(map[string]interface{}{
+		"Entries": []map[string]interface{}{{
+			"EventBusName": s.busName,
+			"Source":       eventBridgeSource,
+			"DetailType":   event.Type,
+			"Detail":       string(detail),
+			"Time":         event.Time.Unix(),
+		}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode request")
+	}
+
+	headers := map[string]string{"X-Amz-Target": "AWSEvents.PutEvents"}
+	response, err := s.api.post("application/x-amz-json-1.1", headers, request)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		FailedEntryCount int
+		Entries          []struct {
+			ErrorCode    string
+			ErrorMessage string
+		}
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return errors.Wrap(err, "unable to parse response")
+	}
+	if result.FailedEntryCount > 0 && len(result.Entries) > 0 {
+		return errors.Errorf("event rejected: %s: %s", result.Entries[0].ErrorCode, result.Entries[0].ErrorMessage)
+	}
+
+	return nil
+}
+
+// regionFromARN returns the region of an ARN, or "" if it is not an ARN.
+func regionFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+
+	return parts[3]
+}
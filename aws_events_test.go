@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAWSAPIClient(t *testing.T, service, endpoint string) awsAPIClient {
+	config := aws.Config{
+		Region: "us-west-2",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}
+
+	api := newAWSAPIClient(config, service)
+	assert.Equal(t, "https://"+service+".us-west-2.amazonaws.com/", api.endpoint)
+	api.endpoint = endpoint
+	return api
+}
+
+func TestSNSSink(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+		assert.Contains(t, req.Header.Get("Authorization"), "/us-west-2/sns/aws4_request")
+		req.ParseForm()
+		form = req.PostForm
+	}))
+	defer server.Close()
+
+	sink := snsSink{api: testAWSAPIClient(t, "sns", server.URL), topicARN: "arn:aws:sns:us-west-2:123456789012:puller"}
+	event := newCloudEvent(eventRunFinished, runFinishedEvent{RunID: "1234", Success: true})
+	assert.Nil(t, sink.Send(event))
+
+	assert.Equal(t, "Publish", form.Get("Action"))
+	assert.Equal(t, "arn:aws:sns:us-west-2:123456789012:puller", form.Get("TopicArn"))
+	assert.Equal(t, eventRunFinished, form.Get("MessageAttributes.entry.1.Value.StringValue"))
+
+	var message cloudEvent
+	assert.Nil(t, json.Unmarshal([]byte(form.Get("Message")), &message))
+	assert.Equal(t, event.ID, message.ID)
+}
+
+func TestEventBridgeSink(t *testing.T) {
+	failed := false
+	var entry map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "AWSEvents.PutEvents", req.Header.Get("X-Amz-Target"))
+		assert.Contains(t, req.Header.Get("Authorization"), "/us-west-2/events/aws4_request")
+
+		body, _ := ioutil.ReadAll(req.Body)
+		var request struct{ Entries []map[string]interface{} }
+		assert.Nil(t, json.Unmarshal(body, &request))
+		entry = request.Entries[0]
+
+		if failed {
+			rw.Write([]byte(`{"FailedEntryCount": 1, "Entries": [{"ErrorCode": "AccessDenied", "ErrorMessage": "denied"}]}`))
+			return
+		}
+		rw.Write([]byte(`{"FailedEntryCount": 0, "Entries": [{"EventId": "1"}]}`))
+	}))
+	defer server.Close()
+
+	sink := eventBridgeSink{api: testAWSAPIClient(t, "events", server.URL), busName: "fleet"}
+	assert.Nil(t, sink.Send(newCloudEvent(eventRunStarted, runStartedEvent{RunID: "1234"})))
+	assert.Equal(t, "fleet", entry["EventBusName"])
+	assert.Equal(t, eventBridgeSource, entry["Source"])
+	assert.Equal(t, eventRunStarted, entry["DetailType"])
+
+	failed = true
+	assert.NotNil(t, sink.Send(newCloudEvent(eventRunStarted, runStartedEvent{RunID: "1234"})))
+}
+
+func TestRegionFromARN(t *testing.T) {
+	assert.Equal(t, "us-west-2", regionFromARN("arn:aws:sns:us-west-2:123456789012:puller"))
+	assert.Equal(t, "", regionFromARN("default"))
+}
+
+func TestAWSAPIClientEndpoint(t *testing.T) {
+	for region, endpoint := range map[string]string{
+		"us-west-2":      "https://sns.us-west-2.amazonaws.com/",
+		"us-gov-west-1":  "https://sns.us-gov-west-1.amazonaws.com/",
+		"cn-north-1":     "https://sns.cn-north-1.amazonaws.com.cn/",
+		"us-iso-east-1":  "https://sns.us-iso-east-1.c2s.ic.gov/",
+		"us-isob-east-1": "https://sns.us-isob-east-1.sc2s.sgov.gov/",
+	} {
+		assert.Equal(t, endpoint, newAWSAPIClient(aws.Config{Region: region}, "sns").endpoint, region)
+	}
+}
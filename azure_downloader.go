@@ -0,0 +1,164 @@
+// Helper methods for downloading a file from Azure Blob Storage
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/pkg/errors"
+)
+
+const (
+	azureBlobAPIVersion = "2020-04-08"
+	azureStorageScope   = "https://storage.azure.com/.default"
+)
+
+// azureBlobDownloader downloads azblob://account/container/blob URIs with the Blob service REST API.
+//
+// A SAS token in AZURE_STORAGE_SAS_TOKEN is used if set. Otherwise credentials come from the default chain of the
+// Azure SDK: a service principal in the environment, workload identity, the managed identity of the VM, or the Azure
+// CLI. Without any, requests are sent unauthenticated, which works for public containers.
+type azureBlobDownloader struct {
+	downloader
+	endpoint   string // Blob service URL with an %s for the account name
+	credential azcore.TokenCredential
+	sasToken   string
+	client     *http.Client
+}
+
+func newAzureBlobDownloader() azureBlobDownloader {
+	downloader := azureBlobDownloader{
+		endpoint: "https://%s.blob.core.windows.net",
+		sasToken: strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		client:   &http.Client{Timeout: downloadTimeout()},
+	}
+	if credential, err := azidentity.NewDefaultAzureCredential(nil); err != nil {
+		downloaderLog.Debugln("No Azure credentials found, sending unauthenticated requests: ", err)
+	} else {
+		downloader.credential = credential
+	}
+
+	return downloader
+}
+
+func (downloader azureBlobDownloader) blobURL(remotePath string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(remotePath, "azblob://"), "/", 3)
+	if !strings.HasPrefix(remotePath, "azblob://") || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", errors.Errorf("not a valid Azure Blob URI: %s", remotePath)
+	}
+
+	blobURL := fmt.Sprintf(downloader.endpoint, parts[0]) + "/" + parts[1] + "/" + parts[2]
+	if downloader.sasToken != "" {
+		blobURL += "?" + downloader.sasToken
+	}
+
+	return blobURL, nil
+}
+
+// authorize adds the access token of the credentials to req. Credentials that fail to provide one are an error,
+// rather than a request sent unauthenticated and refused.
+func (downloader azureBlobDownloader) authorize(req *http.Request) error {
+	if downloader.sasToken != "" || downloader.credential == nil {
+		return nil
+	}
+
+	token, err := downloader.credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{azureStorageScope}})
+	var failed *azidentity.AuthenticationFailedError
+	if errors.As(err, &failed) {
+		return errors.Wrap(err, "unable to get an Azure access token")
+	} else if err != nil {
+		downloaderLog.Debugln("No Azure credentials available, sending unauthenticated requests: ", err)
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	return nil
+}
+
+func (downloader azureBlobDownloader) request(method, remotePath string) (*http.Response, error) {
+	blobURL, err := downloader.blobURL(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, blobURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+	if err := downloader.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := downloader.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, statusCodeError{resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+func (downloader azureBlobDownloader) Download(remotePath, outputPath string) error {
+	resp, err := downloader.request("GET", remotePath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if _, err = io.Copy(outFile, resp.Body); err != nil {
+		return err
+	}
+
+	return outFile.Close()
+}
+
+// RemoteChecksum returns the Content-MD5 of the blob as hex, if it was set on upload.
+func (downloader azureBlobDownloader) RemoteChecksum(remotePath string) (string, error) {
+	resp, err := downloader.request("HEAD", remotePath)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	contentMD5 := resp.Header.Get("Content-MD5")
+	if contentMD5 == "" {
+		return "", nil
+	}
+
+	checksum, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decode blob md5")
+	}
+
+	return hex.EncodeToString(checksum), nil
+}
+
+// RemoteVersion returns the ETag of the blob, which changes whenever the blob is replaced.
+func (downloader azureBlobDownloader) RemoteVersion(remotePath string) (string, error) {
+	resp, err := downloader.request("HEAD", remotePath)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
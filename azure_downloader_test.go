@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureBlobDownloader(t *testing.T) {
+	etag := `"0x1"`
+	contentMD5 := ""
+	downloads := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Header.Get("Authorization") != "Bearer secret" || req.Header.Get("x-ms-version") == "":
+			rw.WriteHeader(http.StatusForbidden)
+		case req.URL.Path != "/account/container/dir/infra.tgz":
+			rw.WriteHeader(http.StatusNotFound)
+		default:
+			rw.Header().Set("ETag", etag)
+			if contentMD5 != "" {
+				rw.Header().Set("Content-MD5", contentMD5)
+			}
+			if req.Method == "GET" {
+				downloads++
+				rw.Write(testText)
+			}
+		}
+	}))
+	defer server.Close()
+
+	downloader := newAzureBlobDownloader()
+	downloader.endpoint = server.URL + "/%s"
+	downloader.credential = staticAzureCredential{token: "secret"}
+	downloader.sasToken = ""
+	remotePath := "azblob://account/container/dir/infra.tgz"
+	localPath := filepath.Join(t.TempDir(), "infra.tgz")
+
+	// Without Content-MD5, the ETag decides whether to download
+	assert.Nil(t, idempotentFileDownload(downloader, remotePath, localPath))
+	assert.Nil(t, idempotentFileDownload(downloader, remotePath, localPath))
+	assert.Equal(t, 1, downloads)
+
+	etag = `"0x2"`
+	assert.Nil(t, idempotentFileDownload(downloader, remotePath, localPath))
+	assert.Equal(t, 2, downloads)
+
+	content, err := ioutil.ReadFile(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, testText, content)
+
+	raw, _ := hex.DecodeString(testMD5)
+	contentMD5 = base64.StdEncoding.EncodeToString(raw)
+	checksum, err := downloader.RemoteChecksum(remotePath)
+	assert.Nil(t, err)
+	assert.Equal(t, testMD5, checksum)
+
+	_, err = downloader.RemoteChecksum("azblob://account/container")
+	assert.NotNil(t, err)
+
+	// Credentials that fail are reported rather than sending the request unauthenticated
+	downloader.credential = staticAzureCredential{err: &azidentity.AuthenticationFailedError{}}
+	_, err = downloader.RemoteVersion(remotePath)
+	assert.Contains(t, err.Error(), "unable to get an Azure access token")
+
+	// Without credentials available, requests are sent unauthenticated
+	downloader.credential = staticAzureCredential{err: errors.New("no credential in the chain is available")}
+	_, err = downloader.RemoteVersion(remotePath)
+	assert.Equal(t, statusCodeError{http.StatusForbidden}, err)
+}
+
+// staticAzureCredential returns token, or fails with err.
+type staticAzureCredential struct {
+	token string
+	err   error
+}
+
+func (c staticAzureCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: c.token, ExpiresOn: time.Now().Add(time.Hour)}, c.err
+}
@@ -0,0 +1,109 @@
+// Baking runs the playbook once while a machine image is built, then leaves nothing behind that belongs to the build
+// host
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// bake runs the bake playbook once, with the tags and extra vars of image builds, and then scrubs the state of the
+// build host so that hosts started from the image converge on their first run as if they never ran before.
+func bake() error {
+	extraVars := viper.GetStringMapString("bake-extra-vars")
+	if _, ok := extraVars[runContextVar]; ok {
+		return errors.Errorf("bake-extra-vars must not set %s, it is reserved for the run context", runContextVar)
+	}
+	scrubPaths := viper.GetStringSlice("bake-scrub-paths")
+	for _, pattern := range scrubPaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid bake-scrub-paths entry %q", pattern)
+		}
+	}
+
+	playbook := viper.GetString("bake-playbook")
+	if playbook == "" {
+		playbook = viper.GetString("ansible-playbook")
+	}
+
+	logrus.Infoln("Baking image with playbook ", playbook)
+	_, err := executeRun(runSpec{
+		Playbook:  playbook,
+		Tags:      viper.GetStringSlice("bake-tags"),
+		SkipTags:  viper.GetStringSlice("bake-skip-tags"),
+		ExtraVars: extraVars,
+		Trigger:   runTriggerBake,
+		NoReport:  true,
+	})
+	flushEvents()
+	if err != nil {
+		return errors.Wrap(err, "bake run failed")
+	}
+
+	if err := scrubBakedState(); err != nil {
+		return err
+	}
+	for _, pattern := range scrubPaths {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			logrus.Infoln("Removing ", path)
+			if err := os.RemoveAll(path); err != nil {
+				return errors.Wrapf(err, "unable to remove %s", path)
+			}
+		}
+	}
+
+	logrus.Infoln("Bake run succeeded, the image is ready")
+	return nil
+}
+
+// scrubBakedState removes everything from state-dir but the caches that spare the first run downloads, i.e. the run
+// history, the failure table and the state of the last run, which belong to the build host. The run lock is kept as
+// well, as another process may hold it. The state key is removed with them, so that every host started from the image
+// generates its own.
+func scrubBakedState() error {
+	entries, err := ioutil.ReadDir(stateDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to read state directory")
+	}
+
+	kept := map[string]bool{
+		filepath.Clean(artifactCacheDir()): true,
+		filepath.Clean(galaxyCacheDir()):   true,
+		filepath.Clean(gitCacheDir()):      true,
+		filepath.Clean(runLockPath()):      true,
+	}
+	for _, entry := range entries {
+		path := filepath.Join(stateDir(), entry.Name())
+		if kept[path] {
+			continue
+		}
+		logrus.Debugln("Removing ", path)
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "unable to scrub state directory")
+		}
+	}
+
+	return removeStateKey()
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "bake",
+		Description: "Run the playbook once for a machine image, then remove the state of the build host",
+		Run: func(args []string) error {
+			if len(args) > 0 {
+				return errors.New("bake takes no arguments")
+			}
+			return bake()
+		},
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrubBakedState(t *testing.T) {
+	dir := t.TempDir()
+	withSettings(t, map[string]interface{}{
+		"state-dir":          dir,
+		"artifact-cache-dir": "",
+		"galaxy-cache-dir":   "",
+		"git-cache-dir":      "",
+	})
+	for _, name := range []string{"artifacts", "galaxy", "git"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+	for _, name := range []string{stateFileName, runHistoryFileName, failureTableFileName} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, runLockFileName), nil, 0600))
+
+	assert.Nil(t, scrubBakedState())
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"artifacts", "galaxy", "git", runLockFileName}, names)
+
+	// Nothing to scrub on a build host that never ran
+	withSettings(t, map[string]interface{}{"state-dir": filepath.Join(dir, "missing")})
+	assert.Nil(t, scrubBakedState())
+}
+
+func TestBakeRejectsReservedExtraVars(t *testing.T) {
+	withSettings(t, map[string]interface{}{"bake-extra-vars": map[string]string{runContextVar: "x"}})
+	assert.EqualError(t, bake(), "bake-extra-vars must not set ansible_puller, it is reserved for the run context")
+
+	withSettings(t, map[string]interface{}{"bake-extra-vars": map[string]string{}, "bake-scrub-paths": []string{"/etc/["}})
+	assert.Error(t, bake())
+}
+
+func TestRunExtraVars(t *testing.T) {
+	context := runContextVars{RunID: "bake", Trigger: runTriggerBake}
+	extraVars := runExtraVars(runSpec{ExtraVars: map[string]string{"image_build": "true"}}, context)
+	assert.Equal(t, map[string]interface{}{"image_build": "true", runContextVar: context}, extraVars)
+}
+
+func TestScrubBakedStateRemovesStateKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys", "state.key")
+	withSettings(t, map[string]interface{}{
+		"state-dir":      filepath.Join(dir, "state"),
+		"state-key-file": keyFile,
+	})
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+	runsFile := filepath.Join(stateDir(), runHistoryFileName)
+	assert.Nil(t, updateState(func(state *PullerState) { state.LastArtifactChecksum = testMD5 }))
+	assert.Nil(t, writeStateFile(runsFile, []byte("[]")))
+	assert.FileExists(t, keyFile+stateFilesSuffix)
+
+	assert.Nil(t, scrubBakedState())
+	assert.NoFileExists(t, keyFile)
+	assert.NoFileExists(t, keyFile+stateFilesSuffix)
+
+	// Hosts started from the image don't report the scrubbed files as removed
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, PullerState{}, state)
+	_, err = readStateFile(runsFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, server.received())
+}
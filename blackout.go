@@ -0,0 +1,237 @@
+// Blackout windows during which the puller does not run Ansible, e.g. business hours
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// What happens to runs requested during a blackout window
+const (
+	blackoutModeQueue  = "queue"  // Wait until the window ends
+	blackoutModeReject = "reject" // Refuse or skip the run
+)
+
+const minutesPerDay = 24 * 60
+
+// Windows from the "blackout-windows" option
+var blackoutWindows []blackoutWindow
+
+// blackoutWindow is a period of the day, on some days of the week, in the configured time zone.
+type blackoutWindow struct {
+	spec  string
+	days  [7]bool // Indexed by time.Weekday, the day the window starts on
+	start int     // Minutes since midnight
+	end   int     // Minutes since midnight, up to minutesPerDay. Before start if the window spans midnight
+}
+
+// setupBlackoutWindows parses the "blackout-windows" and "blackout-mode" options.
+func setupBlackoutWindows() error {
+	mode := viper.GetString("blackout-mode")
+	if mode != blackoutModeQueue && mode != blackoutModeReject {
+		return errors.Errorf("invalid blackout-mode %q, expected %s or %s", mode, blackoutModeQueue, blackoutModeReject)
+	}
+
+	windows := []blackoutWindow{}
+	for _, spec := range viper.GetStringSlice("blackout-windows") {
+		window, err := parseBlackoutWindow(spec)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, window)
+	}
+
+	blackoutWindows = windows
+	return nil
+}
+
+// parseBlackoutWindow parses a window like "Mon-Fri 09:00-17:00", "Sat,Sun" or "22:00-06:00".
+//
+// Without days the window applies every day, without a time range it lasts the whole day.
+func parseBlackoutWindow(spec string) (blackoutWindow, error) {
+	window := blackoutWindow{spec: spec, end: minutesPerDay}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, errors.Errorf("invalid blackout window %q, expected [days] [HH:MM-HH:MM]", spec)
+	}
+
+	days, times := "", ""
+	if strings.Contains(fields[0], ":") {
+		if len(fields) == 2 {
+			return window, errors.Errorf("invalid blackout window %q, days come before the time range", spec)
+		}
+		times = fields[0]
+	} else {
+		days = fields[0]
+		if len(fields) == 2 {
+			times = fields[1]
+		}
+	}
+
+	if days == "" {
+		days = "sun-sat"
+	}
+	bits, err := parseCronField(strings.ToLower(days), 0, 6, cronWeekdayNames)
+	if err != nil {
+		return window, errors.Wrapf(err, "invalid days in blackout window %q", spec)
+	}
+	for day := range window.days {
+		window.days[day] = bits&(1<<uint(day)) != 0
+	}
+
+	if times != "" {
+		bounds := strings.Split(times, "-")
+		if len(bounds) != 2 {
+			return window, errors.Errorf("invalid time range in blackout window %q, expected HH:MM-HH:MM", spec)
+		}
+		if window.start, err = parseTimeOfDay(bounds[0]); err != nil {
+			return window, errors.Wrapf(err, "invalid blackout window %q", spec)
+		}
+		if window.end, err = parseTimeOfDay(bounds[1]); err != nil {
+			return window, errors.Wrapf(err, "invalid blackout window %q", spec)
+		}
+		if window.start == window.end || window.start == minutesPerDay {
+			return window, errors.Errorf("invalid time range in blackout window %q", spec)
+		}
+	}
+
+	return window, nil
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight, accepting 24:00 for the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || len(value) != 5 {
+		return 0, errors.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || hours == 24 && minutes != 0 {
+		return 0, errors.Errorf("invalid time %q, expected HH:MM", value)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// endAfter returns when the window ends if t lies within it, and false otherwise.
+func (w blackoutWindow) endAfter(t time.Time) (time.Time, bool) {
+	local := pullerTime(t)
+	minute := local.Hour()*60 + local.Minute()
+	endOn := func(day time.Time) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), 0, w.end, 0, 0, day.Location())
+	}
+
+	if w.start < w.end {
+		if w.days[local.Weekday()] && minute >= w.start && minute < w.end {
+			return endOn(local), true
+		}
+		return time.Time{}, false
+	}
+
+	// The window spans midnight
+	if w.days[local.Weekday()] && minute >= w.start {
+		return endOn(local.AddDate(0, 0, 1)), true
+	}
+	if w.days[local.AddDate(0, 0, -1).Weekday()] && minute < w.end {
+		return endOn(local), true
+	}
+	return time.Time{}, false
+}
+
+// blackoutUntil returns when the blackout in effect at now ends, following on from window to window, and false if
+// no window is in effect.
+func blackoutUntil(now time.Time) (time.Time, bool) {
+	end, active := now, false
+	// Bounded, as windows covering the whole week never end
+	for i := 0; i < 8*len(blackoutWindows); i++ {
+		extended := false
+		for _, window := range blackoutWindows {
+			if windowEnd, ok := window.endAfter(end); ok {
+				end, active, extended = windowEnd, true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+
+	return end, active
+}
+
+// blackoutEnd returns when the blackout in effect ends, the zero time if there is none.
+func blackoutEnd() time.Time {
+	end, active := blackoutUntil(schedulerClock.Now())
+	if !active {
+		return time.Time{}
+	}
+
+	return end
+}
+
+// blackoutSkipError skips or refuses a run because of a blackout window.
+type blackoutSkipError struct {
+	error
+}
+
+func (blackoutSkipError) Skipped() bool {
+	return true
+}
+
+func blackoutError(end time.Time) error {
+	return blackoutSkipError{errors.Errorf("in a blackout window until %s", pullerTime(end).Format(time.RFC3339))}
+}
+
+// blackoutEndless reports whether the blackout that lasts until end goes on, as the windows follow on from each
+// other forever, e.g. when they cover the whole week.
+func blackoutEndless(end time.Time) bool {
+	for _, window := range blackoutWindows {
+		if _, ok := window.endAfter(end); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlackout returns an error if runs must currently be refused because of a blackout window.
+func checkBlackout() error {
+	end, active := blackoutUntil(schedulerClock.Now())
+	if !active || viper.GetString("blackout-mode") != blackoutModeReject {
+		return nil
+	}
+
+	return blackoutError(end)
+}
+
+// awaitBlackout waits for the blackout window in effect to end, or returns an error in reject mode, if the blackout
+// never ends or once the puller shuts down.
+func awaitBlackout() error {
+	for {
+		end, active := blackoutUntil(schedulerClock.Now())
+		if !active {
+			return nil
+		}
+		if viper.GetString("blackout-mode") == blackoutModeReject {
+			return blackoutError(end)
+		}
+		if blackoutEndless(end) {
+			return blackoutSkipError{errors.New("in a blackout that never ends, the blackout windows cover the whole week")}
+		}
+
+		logrus.Infof("Run queued until the blackout window ends at %s", pullerTime(end).Format(time.RFC3339))
+		// Checked in intervals, as the monotonic clock of a timer stops while a host is suspended
+		for now := schedulerClock.Now(); now.Before(end); now = schedulerClock.Now() {
+			if shuttingDown() {
+				return errShuttingDown
+			}
+			wait := end.Sub(now)
+			if wait > schedulerCheckInterval {
+				wait = schedulerCheckInterval
+			}
+			sleep(schedulerClock, wait)
+		}
+	}
+}
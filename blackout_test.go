@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlackoutWindow(t *testing.T) {
+	window, err := parseBlackoutWindow("Mon-Fri 09:00-17:00")
+	assert.Nil(t, err)
+	assert.Equal(t, [7]bool{false, true, true, true, true, true, false}, window.days)
+	assert.Equal(t, 9*60, window.start)
+	assert.Equal(t, 17*60, window.end)
+
+	window, err = parseBlackoutWindow("sat,sun")
+	assert.Nil(t, err)
+	assert.Equal(t, [7]bool{true, false, false, false, false, false, true}, window.days)
+	assert.Equal(t, 0, window.start)
+	assert.Equal(t, minutesPerDay, window.end)
+
+	window, err = parseBlackoutWindow("22:00-06:00")
+	assert.Nil(t, err)
+	assert.Equal(t, [7]bool{true, true, true, true, true, true, true}, window.days)
+
+	for _, spec := range []string{"", "Mon 09:00", "09:00-17:00 Mon", "Mon 9:00-17:00", "Mon 09:00-25:00", "Mon 09:00-09:00", "Someday", "Mon Tue Wed"} {
+		_, err := parseBlackoutWindow(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestBlackoutUntil(t *testing.T) {
+	defer withPullerLocation(time.UTC)()
+	original := blackoutWindows
+	defer func() { blackoutWindows = original }()
+
+	blackoutWindows = nil
+	for _, spec := range []string{"Mon-Fri 09:00-17:00", "Fri 22:00-06:00", "Sat 06:00-24:00"} {
+		window, err := parseBlackoutWindow(spec)
+		assert.Nil(t, err)
+		blackoutWindows = append(blackoutWindows, window)
+	}
+
+	// Wednesday 2023-03-08
+	_, active := blackoutUntil(time.Date(2023, 3, 8, 8, 59, 0, 0, time.UTC))
+	assert.False(t, active)
+	end, active := blackoutUntil(time.Date(2023, 3, 8, 9, 0, 0, 0, time.UTC))
+	assert.True(t, active)
+	assert.Equal(t, time.Date(2023, 3, 8, 17, 0, 0, 0, time.UTC), end)
+	_, active = blackoutUntil(time.Date(2023, 3, 8, 17, 0, 0, 0, time.UTC))
+	assert.False(t, active)
+
+	// Friday night runs on into the Saturday window
+	end, active = blackoutUntil(time.Date(2023, 3, 10, 23, 0, 0, 0, time.UTC))
+	assert.True(t, active)
+	assert.Equal(t, time.Date(2023, 3, 12, 0, 0, 0, 0, time.UTC), end)
+	end, active = blackoutUntil(time.Date(2023, 3, 11, 3, 0, 0, 0, time.UTC))
+	assert.True(t, active)
+	assert.Equal(t, time.Date(2023, 3, 12, 0, 0, 0, 0, time.UTC), end)
+	_, active = blackoutUntil(time.Date(2023, 3, 12, 3, 0, 0, 0, time.UTC))
+	assert.False(t, active)
+}
+
+func TestCheckBlackout(t *testing.T) {
+	original := blackoutWindows
+	originalMode := viper.GetString("blackout-mode")
+	defer func() {
+		blackoutWindows = original
+		viper.Set("blackout-mode", originalMode)
+	}()
+
+	window, err := parseBlackoutWindow("Sun-Sat")
+	assert.Nil(t, err)
+	blackoutWindows = []blackoutWindow{window}
+
+	viper.Set("blackout-mode", blackoutModeQueue)
+	assert.Nil(t, checkBlackout(), "queued runs are not refused")
+	assert.False(t, blackoutEnd().IsZero())
+	// Rather than waiting forever
+	err = awaitBlackout()
+	assert.EqualError(t, err, "in a blackout that never ends, the blackout windows cover the whole week")
+	assert.True(t, runSkipped(err))
+
+	viper.Set("blackout-mode", blackoutModeReject)
+	assert.NotNil(t, checkBlackout())
+	assert.True(t, runSkipped(awaitBlackout()))
+}
+
+func TestLockRunAwaitsBlackout(t *testing.T) {
+	withShutdownState(t)
+	defer withPullerLocation(time.UTC)()
+	window, err := parseBlackoutWindow("09:00-17:00")
+	assert.Nil(t, err)
+	original := blackoutWindows
+	defer func() { blackoutWindows = original }()
+	blackoutWindows = []blackoutWindow{window}
+	withSettings(t, map[string]interface{}{"blackout-mode": blackoutModeQueue})
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	defer withSchedulerClock(clock)()
+
+	// Decommissions, compares and upgrades wait like the runs of the schedule
+	ran := make(chan time.Time, 1)
+	run := lockRun(func(*PipelineRun) error {
+		ran <- clock.Now()
+		return nil
+	})
+	done := make(chan error, 1)
+	clock.start(func() {
+		done <- run(&PipelineRun{Spec: runSpec{ID: "decommission", Trigger: runTriggerDecommission}, Logger: logrus.NewEntry(logrus.New())})
+	})
+	clock.settle(t)
+	clock.advance(t, 5*time.Hour)
+	assert.Nil(t, <-done)
+	assert.Equal(t, time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC), <-ran)
+}
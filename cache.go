@@ -0,0 +1,298 @@
+// Cache of recently used artifact versions, so going back to one of them does not download it again
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const artifactCacheExt = ".tgz"
+
+var artifacts = &artifactCache{}
+
+// artifactCache keeps the last artifact-cache-versions artifacts that were extracted for a run, within
+// artifact-cache-size, in artifactCacheDir. They are named by their MD5 and ordered by when they were last used.
+type artifactCache struct {
+	mutex sync.Mutex
+}
+
+// cachedArtifact is an artifact in the cache, as returned by the API.
+type cachedArtifact struct {
+	Version  string    `json:"version"` // MD5 of the artifact
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	path     string
+}
+
+func artifactCacheDir() string {
+	if dir := viper.GetString("artifact-cache-dir"); dir != "" {
+		return dir
+	}
+
+	return filepath.Join(stateDir(), "artifacts")
+}
+
+func (c *artifactCache) enabled() bool {
+	return viper.GetInt("artifact-cache-versions") > 0
+}
+
+// list returns the cached artifacts, most recently used first.
+func (c *artifactCache) list() ([]cachedArtifact, error) {
+	files, err := ioutil.ReadDir(artifactCacheDir())
+	if os.IsNotExist(err) {
+		return []cachedArtifact{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to list the artifact cache")
+	}
+
+	cached := []cachedArtifact{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), artifactCacheExt) {
+			continue
+		}
+		cached = append(cached, cachedArtifact{
+			Version:  strings.TrimSuffix(file.Name(), artifactCacheExt),
+			Size:     file.Size(),
+			LastUsed: file.ModTime(),
+			path:     filepath.Join(artifactCacheDir(), file.Name()),
+		})
+	}
+	sort.SliceStable(cached, func(i, j int) bool {
+		return cached[i].LastUsed.After(cached[j].LastUsed)
+	})
+
+	return cached, nil
+}
+
+// restore copies the artifact with the given MD5 to path, returning false if it is not cached.
+func (c *artifactCache) restore(version, path string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.enabled() || version == "" {
+		return false
+	}
+	cachedPath := filepath.Join(artifactCacheDir(), version+artifactCacheExt)
+	if _, err := os.Stat(cachedPath); err != nil {
+		return false
+	}
+
+	if err := copyFileAtomic(cachedPath, path); err != nil {
+		downloaderLog.Warnln("Unable to restore the artifact from the cache: ", err)
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(cachedPath, now, now)
+
+	return true
+}
+
+// store adds the artifact at path to the cache, or marks it as used if it already is, and prunes the cache.
+func (c *artifactCache) store(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.enabled() {
+		return nil
+	}
+	version, err := md5sum(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to checksum the artifact to cache")
+	}
+
+	cachedPath := filepath.Join(artifactCacheDir(), version+artifactCacheExt)
+	if _, err := os.Stat(cachedPath); err == nil {
+		now := time.Now()
+		os.Chtimes(cachedPath, now, now)
+	} else {
+		if err := os.MkdirAll(artifactCacheDir(), 0700); err != nil {
+			return errors.Wrap(err, "unable to create the artifact cache")
+		}
+		if err := copyFileAtomic(path, cachedPath); err != nil {
+			return errors.Wrap(err, "unable to cache the artifact")
+		}
+	}
+
+	_, err = c.pruneLocked()
+	return err
+}
+
+// prune removes the least recently used artifacts beyond artifact-cache-versions or artifact-cache-size.
+func (c *artifactCache) prune() ([]cachedArtifact, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pruneLocked()
+}
+
+func (c *artifactCache) pruneLocked() ([]cachedArtifact, error) {
+	cached, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	maxVersions := viper.GetInt("artifact-cache-versions")
+	maxBytes := int64(viper.GetInt("artifact-cache-size")) * 1024 * 1024
+	var size int64
+	removed := []cachedArtifact{}
+	for i, artifact := range cached {
+		if i < maxVersions && (maxBytes <= 0 || size+artifact.Size <= maxBytes) {
+			size += artifact.Size
+			continue
+		}
+		if err := os.Remove(artifact.path); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrapf(err, "unable to remove cached artifact %s", artifact.Version)
+		}
+		downloaderLog.Debugf("Removed artifact %s from the cache", artifact.Version)
+		removed = append(removed, artifact)
+	}
+
+	promArtifactCacheBytes.Set(float64(size))
+	return removed, nil
+}
+
+// shrink removes the least recently used artifacts until at least excess bytes are freed, or the cache is empty,
+// and returns the bytes freed.
+func (c *artifactCache) shrink(excess int64) (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, err := c.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var freed, size int64
+	for i := len(cached) - 1; i >= 0; i-- {
+		artifact := cached[i]
+		if freed >= excess {
+			size += artifact.Size
+			continue
+		}
+		if err := os.Remove(artifact.path); err != nil && !os.IsNotExist(err) {
+			return freed, errors.Wrapf(err, "unable to remove cached artifact %s", artifact.Version)
+		}
+		downloaderLog.Debugf("Removed artifact %s from the cache", artifact.Version)
+		freed += artifact.Size
+	}
+
+	promArtifactCacheBytes.Set(float64(size))
+	return freed, nil
+}
+
+// purge removes all cached artifacts.
+func (c *artifactCache) purge() ([]cachedArtifact, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []cachedArtifact{}
+	for _, artifact := range cached {
+		if err := os.Remove(artifact.path); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrapf(err, "unable to remove cached artifact %s", artifact.Version)
+		}
+		removed = append(removed, artifact)
+	}
+
+	promArtifactCacheBytes.Set(0)
+	return removed, nil
+}
+
+// copyFileAtomic copies src to dst, which is replaced only once the copy is complete.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpFile := dst + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	return os.Rename(tmpFile, dst)
+}
+
+// checkFreeDisk returns a lowResourceError if less than min-free-disk megabytes are free where runs extract the
+// artifact or where the artifact cache is kept.
+func checkFreeDisk() error {
+	minFree := uint64(viper.GetInt("min-free-disk")) * 1024 * 1024
+	if minFree == 0 {
+		return nil
+	}
+
+	for _, dir := range []string{os.TempDir(), artifactCacheDir()} {
+		// The cache is only created by the first run
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			return errors.Wrapf(err, "unable to check the free disk space in %s", dir)
+		}
+		if free < minFree {
+			return lowResourceError{resourceDisk, errors.Errorf("only %d MB free in %s, below min-free-disk of %d MB. "+
+				"POST %s to free the artifact cache", free/1024/1024, dir, minFree/1024/1024, httpPathCachePurge)}
+		}
+	}
+
+	return nil
+}
+
+// HandlerCachePurge removes all cached artifacts, and responds with what was removed.
+func HandlerCachePurge(w http.ResponseWriter, r *http.Request) {
+	removed, err := artifacts.purge()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var freed int64
+	for _, artifact := range removed {
+		freed += artifact.Size
+	}
+	downloaderLog.Infof("Purged %d artifacts from the cache, freeing %d bytes", len(removed), freed)
+
+	data, err := json.Marshal(map[string]interface{}{
+		"removed":     removed,
+		"freed_bytes": freed,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
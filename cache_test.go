@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withArtifactCache points the artifact cache to a new directory, returning a function restoring the configuration.
+func withArtifactCache(t *testing.T, versions, sizeMB int) func() {
+	originalDir := viper.Get("artifact-cache-dir")
+	originalVersions := viper.Get("artifact-cache-versions")
+	originalSize := viper.Get("artifact-cache-size")
+	viper.Set("artifact-cache-dir", t.TempDir())
+	viper.Set("artifact-cache-versions", versions)
+	viper.Set("artifact-cache-size", sizeMB)
+
+	return func() {
+		viper.Set("artifact-cache-dir", originalDir)
+		viper.Set("artifact-cache-versions", originalVersions)
+		viper.Set("artifact-cache-size", originalSize)
+	}
+}
+
+// storeAged writes content to a file, caches it and marks it as used age ago.
+func storeAged(t *testing.T, content []byte, age time.Duration) string {
+	path := filepath.Join(t.TempDir(), "artifact.tgz")
+	assert.Nil(t, ioutil.WriteFile(path, content, 0644))
+	assert.Nil(t, artifacts.store(path))
+
+	version, err := md5sum(path)
+	assert.Nil(t, err)
+	used := time.Now().Add(-age)
+	assert.Nil(t, os.Chtimes(filepath.Join(artifactCacheDir(), version+artifactCacheExt), used, used))
+	return version
+}
+
+func cachedVersions(t *testing.T) []string {
+	cached, err := artifacts.list()
+	assert.Nil(t, err)
+
+	versions := []string{}
+	for _, artifact := range cached {
+		versions = append(versions, artifact.Version)
+	}
+	return versions
+}
+
+func TestArtifactCacheStoreAndRestore(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+
+	version := storeAged(t, testText, 0)
+	assert.Equal(t, testMD5, version)
+
+	restored := filepath.Join(t.TempDir(), "restored.tgz")
+	assert.True(t, artifacts.restore(testMD5, restored))
+	content, err := ioutil.ReadFile(restored)
+	assert.Nil(t, err)
+	assert.Equal(t, testText, content)
+
+	assert.False(t, artifacts.restore("0123456789abcdef0123456789abcdef", restored))
+	assert.False(t, artifacts.restore("", restored))
+}
+
+func TestArtifactCachePrunesLeastRecentlyUsed(t *testing.T) {
+	defer withArtifactCache(t, 2, 0)()
+
+	first := storeAged(t, []byte("first"), 3*time.Hour)
+	second := storeAged(t, []byte("second"), 2*time.Hour)
+	assert.Equal(t, []string{second, first}, cachedVersions(t))
+
+	// Using the first version again keeps it over the second
+	assert.True(t, artifacts.restore(first, filepath.Join(t.TempDir(), "restored.tgz")))
+	third := storeAged(t, []byte("third"), time.Hour)
+	assert.Equal(t, []string{first, third}, cachedVersions(t))
+}
+
+func TestArtifactCachePrunesBySize(t *testing.T) {
+	defer withArtifactCache(t, 3, 1)()
+
+	storeAged(t, make([]byte, 600*1024), time.Hour)
+	newer := storeAged(t, append(make([]byte, 600*1024), 1), 0)
+	assert.Equal(t, []string{newer}, cachedVersions(t))
+}
+
+func TestArtifactCacheDisabled(t *testing.T) {
+	defer withArtifactCache(t, 0, 0)()
+
+	path := filepath.Join(t.TempDir(), "artifact.tgz")
+	assert.Nil(t, ioutil.WriteFile(path, testText, 0644))
+	assert.Nil(t, artifacts.store(path))
+	assert.Empty(t, cachedVersions(t))
+	assert.False(t, artifacts.restore(testMD5, filepath.Join(t.TempDir(), "restored.tgz")))
+}
+
+func TestIdempotentFileDownloadFromCache(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	storeAged(t, testText, 0)
+
+	d := &staticDownloader{checksum: testMD5}
+	path := filepath.Join(t.TempDir(), "current.tgz")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old"), 0644))
+	assert.Nil(t, idempotentFileDownload(d, "remote", path))
+	assert.Equal(t, 0, d.downloads)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, testText, content)
+}
+
+func TestHandlerCachePurge(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	storeAged(t, []byte("first"), time.Hour)
+	storeAged(t, []byte("second"), 0)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerCachePurge).ServeHTTP(rr, httptest.NewRequest("POST", httpPathCachePurge, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Removed    []cachedArtifact `json:"removed"`
+		FreedBytes int64            `json:"freed_bytes"`
+	}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Removed, 2)
+	assert.Equal(t, int64(len("first")+len("second")), response.FreedBytes)
+	assert.Empty(t, cachedVersions(t))
+}
+
+func TestCheckFreeDisk(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	original := viper.Get("min-free-disk")
+	defer viper.Set("min-free-disk", original)
+
+	viper.Set("min-free-disk", 0)
+	assert.Nil(t, checkFreeDisk())
+
+	viper.Set("min-free-disk", 1)
+	assert.Nil(t, checkFreeDisk())
+
+	// More than any disk has
+	viper.Set("min-free-disk", 1<<40)
+	err := checkFreeDisk()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "below min-free-disk")
+}
@@ -0,0 +1,293 @@
+// Change management integration: attaching run results to Jira or ServiceNow change records and
+// enforcing approved change windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Layout of date fields returned by the ServiceNow table API, always in UTC
+const serviceNowTimeLayout = "2006-01-02 15:04:05"
+
+// Change manager for the configured provider, nil if change management is not configured
+var changeManagement *changeManager
+
+// changeManager records runs on change tickets, so runs are traceable to changes in ITIL-bound organizations.
+type changeManager struct {
+	provider      string // jira or servicenow
+	apiURL        string
+	ticket        string // Jira issue key or ServiceNow change number runs are attached to
+	create        bool   // Create a ticket for every run if ticket is empty
+	project       string // Jira project key created tickets are filed in
+	requireWindow bool   // Refuse to run outside the approved window of ticket, ServiceNow only
+	user          string // User for basic authentication, a bearer token is used if empty
+	token         string
+	client        *http.Client
+}
+
+// serviceNowChange holds the fields of a ServiceNow change_request used by the puller.
+type serviceNowChange struct {
+	SysID     string `json:"sys_id"`
+	Number    string `json:"number"`
+	Approval  string `json:"approval"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+// setupChangeManagement creates the change manager from the configuration.
+func setupChangeManagement() error {
+	provider := viper.GetString("change-provider")
+	if provider == "" {
+		return nil
+	}
+	if provider != "jira" && provider != "servicenow" {
+		return errors.Errorf("invalid change-provider %q, expected jira or servicenow", provider)
+	}
+
+	manager := &changeManager{
+		provider:      provider,
+		apiURL:        strings.TrimSuffix(viper.GetString("change-api-url"), "/"),
+		ticket:        viper.GetString("change-ticket"),
+		create:        viper.GetBool("change-create"),
+		project:       viper.GetString("change-jira-project"),
+		requireWindow: viper.GetBool("change-require-window"),
+		user:          viper.GetString("change-user"),
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if manager.apiURL == "" {
+		return errors.New("change-provider requires change-api-url")
+	}
+	if manager.ticket == "" && !manager.create {
+		return errors.New("change-provider requires change-ticket or change-create")
+	}
+	if manager.create && provider == "jira" && manager.project == "" {
+		return errors.New("change-create with jira requires change-jira-project")
+	}
+	if manager.requireWindow && (provider != "servicenow" || manager.ticket == "") {
+		return errors.New("change-require-window requires the servicenow provider and change-ticket")
+	}
+
+	token, err := ioutil.ReadFile(viper.GetString("change-token-file"))
+	if err != nil {
+		return errors.Wrap(err, "unable to read change-token-file")
+	}
+	manager.token = strings.TrimSpace(string(token))
+
+	changeManagement = manager
+	return nil
+}
+
+// call sends a JSON request to the API of the provider and decodes the JSON response into out, if given.
+func (m changeManager) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, m.apiURL+path, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if m.user != "" {
+		req.SetBasicAuth(m.user, m.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "unable to parse response")
+}
+
+// serviceNowChange looks up a change_request by its number.
+func (m changeManager) serviceNowChange(number string) (serviceNowChange, error) {
+	query := url.Values{}
+	query.Set("sysparm_query", "number="+number)
+	query.Set("sysparm_fields", "sys_id,number,approval,start_date,end_date")
+	query.Set("sysparm_limit", "1")
+
+	var response struct {
+		Result []serviceNowChange `json:"result"`
+	}
+	if err := m.call("GET", "/api/now/table/change_request?"+query.Encode(), nil, &response); err != nil {
+		return serviceNowChange{}, err
+	}
+	if len(response.Result) == 0 {
+		return serviceNowChange{}, errors.Errorf("change %s not found", number)
+	}
+
+	return response.Result[0], nil
+}
+
+// checkWindow returns an error unless ticket is approved and now lies within its planned window.
+func (m changeManager) checkWindow(now time.Time) error {
+	change, err := m.serviceNowChange(m.ticket)
+	if err != nil {
+		return err
+	}
+
+	if change.Approval != "approved" {
+		return errors.Errorf("change %s is not approved (approval: %s)", change.Number, change.Approval)
+	}
+
+	start, err := time.ParseInLocation(serviceNowTimeLayout, change.StartDate, time.UTC)
+	if err != nil {
+		return errors.Errorf("change %s has no valid planned start date", change.Number)
+	}
+	end, err := time.ParseInLocation(serviceNowTimeLayout, change.EndDate, time.UTC)
+	if err != nil {
+		return errors.Errorf("change %s has no valid planned end date", change.Number)
+	}
+
+	if now.Before(start) || now.After(end) {
+		return errors.Errorf("outside of the window of change %s (%s to %s)", change.Number,
+			pullerTime(start).Format(time.RFC3339), pullerTime(end).Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// open returns the ticket a run is recorded on, creating one if no ticket is configured.
+func (m changeManager) open(runID, playbook string) (string, error) {
+	if m.ticket != "" {
+		return m.ticket, nil
+	}
+
+	summary := fmt.Sprintf("%s run of %s on %s", appName, playbook, hostname)
+	description := fmt.Sprintf("Automated run %s of %s on %s", runID, playbook, hostname)
+
+	if m.provider == "jira" {
+		var created struct {
+			Key string `json:"key"`
+		}
+		err := m.call("POST", "/rest/api/2/issue", map[string]interface{}{
+			"fields": map[string]interface{}{
+				"project":     map[string]string{"key": m.project},
+				"issuetype":   map[string]string{"name": "Task"},
+				"summary":     summary,
+				"description": description,
+			},
+		}, &created)
+		return created.Key, err
+	}
+
+	var created struct {
+		Result serviceNowChange `json:"result"`
+	}
+	err := m.call("POST", "/api/now/table/change_request", map[string]string{
+		"type":              "standard",
+		"short_description": summary,
+		"description":       description,
+	}, &created)
+	return created.Result.Number, err
+}
+
+// attach adds note to ticket, as a comment in Jira and a work note in ServiceNow.
+func (m changeManager) attach(ticket, note string) error {
+	if m.provider == "jira" {
+		return m.call("POST", "/rest/api/2/issue/"+url.PathEscape(ticket)+"/comment", map[string]string{"body": note}, nil)
+	}
+
+	change, err := m.serviceNowChange(ticket)
+	if err != nil {
+		return err
+	}
+	return m.call("PATCH", "/api/now/table/change_request/"+change.SysID, map[string]string{"work_notes": note}, nil)
+}
+
+// runNote describes the result of a run for a change ticket.
+func runNote(finished runFinishedEvent) string {
+	result := "succeeded"
+	if !finished.Success {
+		result = "failed"
+	}
+
+	note := fmt.Sprintf("%s run %s of %s on %s %s after %.0fs (exit code %d)", appName, finished.RunID,
+		finished.Playbook, hostname, result, finished.DurationSeconds, finished.ExitCode)
+	if finished.Summary != nil {
+		s := finished.Summary
+		note += fmt.Sprintf("\nok=%d changed=%d unreachable=%d failed=%d skipped=%d",
+			s.Ok, s.Changed, s.Unreachable, s.Failures, s.Skipped)
+	}
+	if finished.Error != "" {
+		note += "\nError: " + finished.Error
+	}
+
+	return note
+}
+
+// changeWindowError refuses a run outside of the change window, which is skipped rather than failed.
+type changeWindowError struct {
+	error
+}
+
+func (changeWindowError) Skipped() bool {
+	return true
+}
+
+// checkChangeWindow returns an error if runs must currently be refused because of the change window.
+func checkChangeWindow() error {
+	if changeManagement == nil || !changeManagement.requireWindow {
+		return nil
+	}
+
+	return changeManagement.checkWindow(time.Now())
+}
+
+// openChangeTicket returns the ticket to record a run on, or "" if there is none, logging failures.
+func openChangeTicket(runID, playbook string) string {
+	if changeManagement == nil {
+		return ""
+	}
+
+	ticket, err := changeManagement.open(runID, playbook)
+	if err != nil {
+		logrus.Warnln("Unable to create a change ticket: ", err)
+		return ""
+	}
+
+	return ticket
+}
+
+// attachRunToChangeTicket records the result of a run on ticket, logging failures.
+func attachRunToChangeTicket(ticket string, finished runFinishedEvent) {
+	if changeManagement == nil || ticket == "" {
+		return
+	}
+
+	if err := changeManagement.attach(ticket, runNote(finished)); err != nil {
+		logrus.Warnf("Unable to attach the run to change %s: %v", ticket, err)
+	}
+}
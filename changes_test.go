@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serviceNowTestServer(t *testing.T, change serviceNowChange, notes *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "puller", user)
+		assert.Equal(t, "secret", pass)
+
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/api/now/table/change_request":
+			assert.Equal(t, "number="+change.Number, req.URL.Query().Get("sysparm_query"))
+			json.NewEncoder(rw).Encode(map[string]interface{}{"result": []serviceNowChange{change}})
+		case req.Method == "PATCH" && req.URL.Path == "/api/now/table/change_request/"+change.SysID:
+			var body map[string]string
+			json.NewDecoder(req.Body).Decode(&body)
+			*notes = append(*notes, body["work_notes"])
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL)
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestChangeWindow(t *testing.T) {
+	change := serviceNowChange{
+		SysID:     "abc",
+		Number:    "CHG0001",
+		Approval:  "approved",
+		StartDate: "2024-05-01 20:00:00",
+		EndDate:   "2024-05-01 22:00:00",
+	}
+	server := serviceNowTestServer(t, change, nil)
+	defer server.Close()
+
+	manager := changeManager{
+		provider:      "servicenow",
+		apiURL:        server.URL,
+		ticket:        "CHG0001",
+		requireWindow: true,
+		user:          "puller",
+		token:         "secret",
+		client:        server.Client(),
+	}
+
+	assert.Nil(t, manager.checkWindow(time.Date(2024, 5, 1, 21, 0, 0, 0, time.UTC)))
+	assert.NotNil(t, manager.checkWindow(time.Date(2024, 5, 1, 19, 59, 0, 0, time.UTC)))
+	assert.NotNil(t, manager.checkWindow(time.Date(2024, 5, 1, 22, 1, 0, 0, time.UTC)))
+}
+
+func TestChangeWindowNotApproved(t *testing.T) {
+	server := serviceNowTestServer(t, serviceNowChange{
+		SysID:     "abc",
+		Number:    "CHG0001",
+		Approval:  "requested",
+		StartDate: "2024-05-01 20:00:00",
+		EndDate:   "2024-05-01 22:00:00",
+	}, nil)
+	defer server.Close()
+
+	manager := changeManager{provider: "servicenow", apiURL: server.URL, ticket: "CHG0001", user: "puller", token: "secret", client: server.Client()}
+
+	err := manager.checkWindow(time.Date(2024, 5, 1, 21, 0, 0, 0, time.UTC))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not approved")
+}
+
+func TestChangeAttachServiceNow(t *testing.T) {
+	var notes []string
+	server := serviceNowTestServer(t, serviceNowChange{SysID: "abc", Number: "CHG0001"}, &notes)
+	defer server.Close()
+
+	manager := changeManager{provider: "servicenow", apiURL: server.URL, ticket: "CHG0001", user: "puller", token: "secret", client: server.Client()}
+
+	assert.Nil(t, manager.attach("CHG0001", "run succeeded"))
+	assert.Equal(t, []string{"run succeeded"}, notes)
+}
+
+func TestChangeCreateAndAttachJira(t *testing.T) {
+	var requests []string
+	var comment map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+		requests = append(requests, fmt.Sprintf("%s %s", req.Method, req.URL.Path))
+
+		switch req.URL.Path {
+		case "/rest/api/2/issue":
+			var body map[string]map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			assert.Equal(t, map[string]interface{}{"key": "OPS"}, body["fields"]["project"])
+			rw.WriteHeader(http.StatusCreated)
+			fmt.Fprint(rw, `{"id": "10001", "key": "OPS-42"}`)
+		case "/rest/api/2/issue/OPS-42/comment":
+			json.NewDecoder(req.Body).Decode(&comment)
+			rw.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	manager := changeManager{provider: "jira", apiURL: server.URL, create: true, project: "OPS", token: "secret", client: server.Client()}
+
+	ticket, err := manager.open("1234", "site.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, "OPS-42", ticket)
+
+	assert.Nil(t, manager.attach(ticket, "run failed"))
+	assert.Equal(t, []string{"POST /rest/api/2/issue", "POST /rest/api/2/issue/OPS-42/comment"}, requests)
+	assert.Equal(t, "run failed", comment["body"])
+}
+
+func TestRunNote(t *testing.T) {
+	note := runNote(runFinishedEvent{
+		RunID:           "1234",
+		Playbook:        "site.yml",
+		Success:         false,
+		Error:           "exit status 2",
+		ExitCode:        2,
+		DurationSeconds: 61,
+		Summary:         &AnsibleNodeStatus{Ok: 5, Changed: 1, Failures: 1},
+	})
+
+	assert.Contains(t, note, "run 1234 of site.yml")
+	assert.Contains(t, note, "failed after 61s (exit code 2)")
+	assert.Contains(t, note, "ok=5 changed=1 unreachable=0 failed=1 skipped=0")
+	assert.Contains(t, note, "Error: exit status 2")
+}
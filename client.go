@@ -0,0 +1,349 @@
+// Client for the API of a running daemon, used by the CLI subcommands
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorBold   = "\033[1m"
+)
+
+// daemonStatus mirrors the response of the status endpoint.
+type daemonStatus struct {
+	AppName               string  `json:"app_name"`
+	Hostname              string  `json:"hostname"`
+	AnsibleDisabled       bool    `json:"ansible_disabled"`
+	AnsibleRunning        bool    `json:"ansible_running"`
+	AnsibleLastRunSuccess bool    `json:"ansible_last_run_success"`
+	LastRunOutcome        string  `json:"last_run_outcome"`
+	DisableReason         string  `json:"disable_reason"`
+	DisabledUntil         *string `json:"disabled_until"`
+	LastRunTime           *string `json:"last_run_time"`
+	NextRunTime           *string `json:"next_run_time"`
+	ArtifactChecksum      string  `json:"artifact_checksum"`
+	ConsecutiveFailures   int     `json:"consecutive_failures"`
+	VerificationError     string  `json:"verification_error"`
+	ConnectivityError     string  `json:"connectivity_error"`
+	Version               string  `json:"version"`
+}
+
+// daemonClient talks to the API of the daemon running on this host.
+type daemonClient struct {
+	baseURL string
+	token   string // Sent as bearer token if set, from http-auth-token-file
+	client  http.Client
+}
+
+// defaultDaemonURL derives the URL of the local daemon from http-socket, or else http-listen-string.
+func defaultDaemonURL() string {
+	if socketPath := viper.GetString("http-socket"); socketPath != "" {
+		return unixURLScheme + socketPath
+	}
+
+	scheme := "http://"
+	if viper.GetString("http-tls-cert") != "" {
+		scheme = "https://"
+	}
+
+	host, port, err := net.SplitHostPort(viper.GetString("http-listen-string"))
+	if err != nil {
+		return scheme + viper.GetString("http-listen-string")
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// unixURLScheme prefixes the path of a unix socket the daemon is reached on, e.g. unix:///run/ansible-puller.sock
+const unixURLScheme = "unix://"
+
+func newDaemonClient(baseURL string) *daemonClient {
+	c := &daemonClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client: http.Client{
+			Timeout: 10 * time.Second,
+			// The endpoints of the web UI redirect to its pages, which are of no use here
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+
+	if strings.HasPrefix(baseURL, unixURLScheme) {
+		// Requests on the socket need no credentials
+		socketPath := strings.TrimPrefix(baseURL, unixURLScheme)
+		c.baseURL = "http://unix"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return c
+	}
+
+	// Same host and configuration as the daemon, so its credentials are at hand
+	if tokenFile := viper.GetString("http-auth-token-file"); tokenFile != "" {
+		if token, err := ioutil.ReadFile(tokenFile); err == nil {
+			c.token = strings.TrimSpace(string(token))
+		}
+	}
+	if certFile := viper.GetString("http-tls-cert"); certFile != "" {
+		if tlsConfig, err := pinnedTLSConfig(certFile); err == nil {
+			if clientCert := viper.GetString("http-client-cert"); clientCert != "" {
+				cert, err := tls.LoadX509KeyPair(clientCert, viper.GetString("http-client-key"))
+				if err != nil {
+					logrus.Warnln("Unable to load http-client-cert, not presenting a client certificate: ", err)
+				} else {
+					tlsConfig.Certificates = []tls.Certificate{cert}
+				}
+			}
+			c.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+	}
+
+	return c
+}
+
+// pinnedTLSConfig trusts the daemon's own certificate only. It is checked as is rather than by name, as the daemon
+// is reached on an address its certificate does not necessarily name, e.g. 127.0.0.1.
+func pinnedTLSConfig(certFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no certificate found in %s", certFile)
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+				return errors.New("the daemon's certificate is not http-tls-cert")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// do sends req to the daemon with its credentials and returns the response body.
+func (c *daemonClient) do(req *http.Request) ([]byte, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to reach the daemon, is it running?")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read response from the daemon")
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("daemon returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// get fetches path from the daemon and returns the response body.
+func (c *daemonClient) get(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// post sends body as JSON to path on the daemon and returns the response body.
+func (c *daemonClient) post(path string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req)
+}
+
+// postForm sends form to path on the daemon, as the web UI does, and returns the response body.
+func (c *daemonClient) postForm(path string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return c.do(req)
+}
+
+func (c *daemonClient) status() (daemonStatus, []byte, error) {
+	var status daemonStatus
+
+	body, err := c.get(httpPathStatus)
+	if err != nil {
+		return status, nil, err
+	}
+
+	if err := json.Unmarshal(body, &status); err != nil {
+		return status, nil, errors.Wrap(err, "unable to parse status")
+	}
+
+	return status, body, nil
+}
+
+// colorizer wraps text in ANSI colors, or returns it as is when colors are disabled.
+type colorizer bool
+
+func (c colorizer) paint(color, text string) string {
+	if !c {
+		return text
+	}
+
+	return color + text + colorReset
+}
+
+// useColor reports whether stdout is a terminal and colors weren't disabled via NO_COLOR.
+func useColor() colorizer {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func formatStatusTime(t *string) string {
+	if t == nil {
+		return "never"
+	}
+
+	parsed, err := time.Parse(time.RFC3339, *t)
+	if err != nil {
+		return *t
+	}
+
+	return pullerTime(parsed).Format("2006-01-02 15:04:05 MST")
+}
+
+// writeStatus renders a compact human readable summary of the daemon status.
+func writeStatus(w io.Writer, status daemonStatus, c colorizer) {
+	fmt.Fprintf(w, "%s on %s (version %s)\n", c.paint(colorBold, status.AppName), status.Hostname, status.Version)
+
+	state := c.paint(colorGreen, "enabled")
+	if status.AnsibleDisabled {
+		state = c.paint(colorRed, "disabled")
+		if status.DisableReason != "" {
+			state += " (" + status.DisableReason + ")"
+		}
+		if status.DisabledUntil != nil {
+			state += " until " + formatStatusTime(status.DisabledUntil)
+		}
+	}
+	activity := "idle"
+	if status.AnsibleRunning {
+		activity = c.paint(colorYellow, "running")
+	}
+	fmt.Fprintf(w, "  State:     %s, %s\n", state, activity)
+
+	result := c.paint(colorGreen, "succeeded")
+	if !status.AnsibleLastRunSuccess {
+		result = c.paint(colorRed, "failed")
+		if status.LastRunOutcome == runOutcomeTimeout {
+			result = c.paint(colorRed, "timed out")
+		}
+		if status.ConnectivityError != "" {
+			result = c.paint(colorRed, "unreachable") + " (" + status.ConnectivityError + ")"
+		}
+	}
+	fmt.Fprintf(w, "  Last run:  %s at %s\n", result, formatStatusTime(status.LastRunTime))
+	fmt.Fprintf(w, "  Next run:  %s\n", formatStatusTime(status.NextRunTime))
+
+	artifact := status.ArtifactChecksum
+	if artifact == "" {
+		artifact = "unknown"
+	}
+	if status.VerificationError != "" {
+		artifact += " " + c.paint(colorRed, "(verification failed: "+status.VerificationError+")")
+	}
+	fmt.Fprintf(w, "  Artifact:  %s\n", artifact)
+
+	failures := fmt.Sprintf("%d consecutive", status.ConsecutiveFailures)
+	if status.ConsecutiveFailures > 0 {
+		failures = c.paint(colorRed, failures)
+	}
+	fmt.Fprintf(w, "  Failures:  %s\n", failures)
+}
+
+var (
+	statusFlags = pflag.NewFlagSet("status", pflag.ContinueOnError)
+	statusJSON  = statusFlags.Bool("json", false, "Print the raw JSON status for use in scripts")
+	statusURL   = statusFlags.String("url", "", "URL of the daemon to query. Derived from http-socket or http-listen-string by default")
+)
+
+func runStatusCommand(args []string) error {
+	url := *statusURL
+	if url == "" {
+		url = defaultDaemonURL()
+	}
+
+	status, body, err := newDaemonClient(url).status()
+	if err != nil {
+		return err
+	}
+
+	if *statusJSON {
+		_, err := fmt.Println(string(body))
+		return err
+	}
+
+	writeStatus(os.Stdout, status, useColor())
+	return nil
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "status",
+		Usage:       "[--json] [--url URL]",
+		Description: "Show the status of the running daemon",
+		Flags:       statusFlags,
+		Run:         runStatusCommand,
+	})
+}
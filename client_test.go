@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDaemonURL(t *testing.T) {
+	original := viper.GetString("http-listen-string")
+	defer viper.Set("http-listen-string", original)
+
+	viper.Set("http-listen-string", "0.0.0.0:31836")
+	assert.Equal(t, "http://127.0.0.1:31836", defaultDaemonURL())
+
+	viper.Set("http-listen-string", "10.1.2.3:8080")
+	assert.Equal(t, "http://10.1.2.3:8080", defaultDaemonURL())
+}
+
+func TestClientStatus(t *testing.T) {
+	originalLocation := pullerLocation
+	pullerLocation = time.UTC
+	defer func() { pullerLocation = originalLocation }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, httpPathStatus, r.URL.Path)
+		w.Write([]byte(`{"app_name": "ansible-puller", "hostname": "host01", "ansible_disabled": true,
+			"disable_reason": "maintenance", "ansible_last_run_success": false, "consecutive_failures": 2,
+			"last_run_time": "2026-10-15T06:00:00Z", "next_run_time": null, "version": "abc123"}`))
+	}))
+	defer server.Close()
+
+	status, _, err := newDaemonClient(server.URL).status()
+	assert.Nil(t, err)
+	assert.True(t, status.AnsibleDisabled)
+	assert.Equal(t, 2, status.ConsecutiveFailures)
+
+	var out bytes.Buffer
+	writeStatus(&out, status, false)
+	assert.Contains(t, out.String(), "ansible-puller on host01 (version abc123)")
+	assert.Contains(t, out.String(), "State:     disabled (maintenance), idle")
+	assert.Contains(t, out.String(), "Last run:  failed at 2026-10-15 06:00:00 UTC")
+	assert.Contains(t, out.String(), "Next run:  never")
+	assert.Contains(t, out.String(), "Failures:  2 consecutive")
+}
+
+func TestWriteStatusTimedOut(t *testing.T) {
+	var out bytes.Buffer
+	writeStatus(&out, daemonStatus{LastRunOutcome: runOutcomeTimeout}, false)
+	assert.Contains(t, out.String(), "Last run:  timed out at never")
+}
+
+func TestClientStatusDaemonError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, _, err := newDaemonClient(server.URL).status()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "broken")
+}
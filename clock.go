@@ -0,0 +1,79 @@
+// Time source of schedules, which tests and the --time-warp debug option replace to fast-forward them
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// clock tells the time and waits for durations to pass on it.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Time source of the scheduler, the splay at startup, blackout windows, change freezes and retries of runs
+var schedulerClock clock = systemClock{}
+
+// sleep waits for d to pass on c.
+func sleep(c clock, d time.Duration) {
+	<-c.After(d)
+}
+
+// systemClock is the clock of the host.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// warpedClock runs factor times as fast as the clock of the host, starting from the time it was created at.
+//
+// Its times keep a monotonic reading that advances as fast as their wall clock, so the scheduler doesn't take the
+// warp for a clock jump.
+type warpedClock struct {
+	start  time.Time
+	factor float64
+}
+
+func newWarpedClock(factor float64) warpedClock {
+	return warpedClock{start: time.Now(), factor: factor}
+}
+
+func (c warpedClock) Now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.start)) * c.factor))
+}
+
+func (c warpedClock) After(d time.Duration) <-chan time.Time {
+	ticks := make(chan time.Time, 1)
+	time.AfterFunc(time.Duration(float64(d)/c.factor), func() { ticks <- c.Now() })
+	return ticks
+}
+
+// setupTimeWarp replaces the time source of schedules with one running "time-warp" times as fast, which is only
+// allowed in debug mode.
+func setupTimeWarp() error {
+	factor := viper.GetFloat64("time-warp")
+	if factor == 1 {
+		schedulerClock = systemClock{}
+		return nil
+	}
+	if factor <= 0 {
+		return errors.New("time-warp must be positive")
+	}
+	if !viper.GetBool("debug") {
+		return errors.New("time-warp is only allowed in debug mode")
+	}
+
+	logrus.Warnf("Time warp: schedules, blackout windows, change freezes and retries run %g times as fast as the wall clock", factor)
+	schedulerClock = newWarpedClock(factor)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	running int // Goroutines started on the clock that didn't return yet
+}
+
+type fakeWaiter struct {
+	at    time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ticks := make(chan time.Time, 1)
+	if d <= 0 {
+		ticks <- c.now
+		return ticks
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ticks: ticks})
+	return ticks
+}
+
+// start runs f in a goroutine the clock keeps track of, so that advance can wait for it to wait again or return.
+func (c *fakeClock) start(f func()) {
+	c.mutex.Lock()
+	c.running++
+	c.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			c.running--
+			c.mutex.Unlock()
+		}()
+		f()
+	}()
+}
+
+// settle blocks until every goroutine started on the clock waits on it or returned.
+func (c *fakeClock) settle(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mutex.Lock()
+		settled := len(c.waiters) >= c.running
+		c.mutex.Unlock()
+		if settled {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("goroutines started on the fake clock neither wait on it nor return")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// advance moves the clock forward by d, one wait at a time. After each wait ends, it settles, so that the goroutines
+// started on the clock see every tick in between as they would in real time.
+func (c *fakeClock) advance(t *testing.T, d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		c.mutex.Lock()
+		next := -1
+		for i, waiter := range c.waiters {
+			if !waiter.at.After(end) && (next < 0 || waiter.at.Before(c.waiters[next].at)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			c.now = end
+			c.mutex.Unlock()
+			return
+		}
+		waiter := c.waiters[next]
+		c.waiters = append(c.waiters[:next], c.waiters[next+1:]...)
+		c.now = waiter.at
+		c.mutex.Unlock()
+
+		waiter.ticks <- waiter.at
+		c.settle(t)
+	}
+}
+
+func TestSchedulerRunFastForwarded(t *testing.T) {
+	originalNextRunTime := nextRunTime
+	defer func() {
+		nextRunTime = originalNextRunTime
+		delete(playbookNextRuns, "fast-forwarded")
+	}()
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	var runs int32
+	s := newScheduler(time.Hour, 0, func() { atomic.AddInt32(&runs, 1) })
+	s.name = "fast-forwarded"
+	s.clock = clock
+	clock.start(s.run)
+	defer s.stop()
+
+	clock.settle(t)
+	clock.advance(t, 59*time.Minute)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runs))
+
+	clock.advance(t, time.Minute)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+
+	// A day passes in no time
+	clock.advance(t, 24*time.Hour)
+	assert.Equal(t, int32(25), atomic.LoadInt32(&runs))
+	assert.Equal(t, time.Date(2020, 1, 2, 14, 0, 0, 0, time.UTC), s.nextRun)
+}
+
+func TestAwaitBlackoutFastForwarded(t *testing.T) {
+	defer withPullerLocation(time.UTC)()
+	window, err := parseBlackoutWindow("09:00-17:00")
+	assert.Nil(t, err)
+	original := blackoutWindows
+	defer func() { blackoutWindows = original }()
+	blackoutWindows = []blackoutWindow{window}
+	withSettings(t, map[string]interface{}{"blackout-mode": blackoutModeQueue})
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	defer withSchedulerClock(clock)()
+
+	done := make(chan error, 1)
+	clock.start(func() { done <- awaitBlackout() })
+	clock.settle(t)
+	clock.advance(t, 4*time.Hour)
+	select {
+	case <-done:
+		t.Fatal("returned before the blackout window ended")
+	default:
+	}
+
+	clock.advance(t, time.Hour)
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	default:
+		t.Fatal("still waiting after the blackout window ended")
+	}
+}
+
+// withSchedulerClock replaces the time source of schedules until the returned function is called.
+func withSchedulerClock(c clock) func() {
+	original := schedulerClock
+	schedulerClock = c
+	return func() { schedulerClock = original }
+}
+
+func TestWarpedClock(t *testing.T) {
+	clock := newWarpedClock(3600)
+	start := clock.Now()
+
+	select {
+	case <-clock.After(time.Hour):
+	case <-time.After(5 * time.Second):
+		t.Fatal("an hour didn't pass within a second of real time")
+	}
+	now := clock.Now()
+	assert.True(t, now.Sub(start) >= time.Hour)
+	// Wall clock and monotonic time advance together, so no clock jump is seen
+	assert.InDelta(t, float64(now.Sub(start)), float64(now.Round(0).Sub(start.Round(0))), float64(time.Millisecond))
+}
+
+func TestSetupTimeWarp(t *testing.T) {
+	defer withSchedulerClock(schedulerClock)()
+
+	withSettings(t, map[string]interface{}{"time-warp": 60, "debug": false})
+	assert.EqualError(t, setupTimeWarp(), "time-warp is only allowed in debug mode")
+
+	withSettings(t, map[string]interface{}{"debug": true})
+	assert.Nil(t, setupTimeWarp())
+	assert.IsType(t, warpedClock{}, schedulerClock)
+
+	withSettings(t, map[string]interface{}{"time-warp": 0})
+	assert.EqualError(t, setupTimeWarp(), "time-warp must be positive")
+
+	withSettings(t, map[string]interface{}{"time-warp": 1})
+	assert.Nil(t, setupTimeWarp())
+	assert.Equal(t, systemClock{}, schedulerClock)
+}
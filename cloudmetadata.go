@@ -0,0 +1,275 @@
+// Metadata of the cloud instance the puller runs on, from the metadata server of EC2, GCE or Azure
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Cloud providers whose instance metadata can be read
+const (
+	cloudAWS   = "aws"
+	cloudGCP   = "gcp"
+	cloudAzure = "azure"
+)
+
+// Metadata endpoints of the cloud providers, replaced in tests
+var (
+	awsMetadataURL   = "http://169.254.169.254/latest"
+	gcpMetadataURL   = "http://metadata.google.internal/computeMetadata/v1"
+	azureMetadataURL = "http://169.254.169.254/metadata"
+)
+
+var defaultCloudMetadataVars = []string{"provider", "instance_id", "instance_type", "region", "zone", "tags"}
+
+// checkCloudProvider returns an error if the option named key isn't empty or one of the cloud providers.
+func checkCloudProvider(key string) error {
+	switch provider := viper.GetString(key); provider {
+	case "", cloudAWS, cloudGCP, cloudAzure:
+		return nil
+	default:
+		return errors.Errorf("invalid %s %q, expected aws, gcp or azure", key, provider)
+	}
+}
+
+// setupCloudMetadata validates the provider whose metadata is passed to playbooks.
+func setupCloudMetadata() error {
+	return checkCloudProvider("cloud-metadata")
+}
+
+var cloudMetadataCache = struct {
+	sync.Mutex
+	byProvider map[string]map[string]interface{}
+}{byProvider: map[string]map[string]interface{}{}}
+
+// cloudMetadata returns the metadata of the instance from provider, or nil if provider is empty or its metadata
+// server can't be reached. It is fetched until it was read once, as the instance doesn't change while the puller
+// runs.
+func cloudMetadata(provider string) map[string]interface{} {
+	if provider == "" {
+		return nil
+	}
+
+	cloudMetadataCache.Lock()
+	defer cloudMetadataCache.Unlock()
+	if metadata, ok := cloudMetadataCache.byProvider[provider]; ok {
+		return metadata
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	var metadata map[string]interface{}
+	var err error
+	switch provider {
+	case cloudAWS:
+		metadata, err = awsInstanceMetadata(client)
+	case cloudGCP:
+		metadata, err = gcpInstanceMetadata(client)
+	case cloudAzure:
+		metadata, err = azureInstanceMetadata(client)
+	}
+	if err != nil {
+		logrus.Warnf("Unable to get the %s instance metadata: %v", provider, err)
+		return nil
+	}
+
+	metadata["provider"] = provider
+	cloudMetadataCache.byProvider[provider] = metadata
+	return metadata
+}
+
+// runCloudMetadata returns the values of cloud-metadata-vars from the metadata of the cloud-metadata provider,
+// passed to playbooks in the run context.
+func runCloudMetadata() map[string]interface{} {
+	metadata := cloudMetadata(viper.GetString("cloud-metadata"))
+	if metadata == nil {
+		return nil
+	}
+
+	selected := map[string]interface{}{}
+	for _, name := range viper.GetStringSlice("cloud-metadata-vars") {
+		if value, ok := metadata[name]; ok {
+			selected[name] = value
+		}
+	}
+	return selected
+}
+
+// getMetadata decodes the JSON response of a metadata endpoint into v.
+func getMetadata(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("bad status code: %v", resp.StatusCode)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "unable to parse the instance metadata")
+}
+
+// awsMetadataGet returns the body and status code of an IMDSv2 request.
+func awsMetadataGet(client *http.Client, method, url string, header http.Header) (string, int, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), resp.StatusCode, err
+}
+
+// awsInstanceMetadata reads the instance identity document and the instance tags with IMDSv2. Tags are only
+// available if the instance allows tags in its metadata.
+func awsInstanceMetadata(client *http.Client) (map[string]interface{}, error) {
+	token, status, err := awsMetadataGet(client, "PUT", awsMetadataURL+"/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"}})
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, errors.Errorf("bad status code of the metadata token: %v", status)
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+
+	req, err := http.NewRequest("GET", awsMetadataURL+"/dynamic/instance-identity/document", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	var document struct {
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		AccountID        string `json:"accountId"`
+	}
+	if err := getMetadata(client, req, &document); err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	keys, status, err := awsMetadataGet(client, "GET", awsMetadataURL+"/meta-data/tags/instance", header)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusOK {
+		for _, key := range strings.Fields(keys) {
+			value, status, err := awsMetadataGet(client, "GET", awsMetadataURL+"/meta-data/tags/instance/"+key, header)
+			if err != nil {
+				return nil, err
+			}
+			if status != http.StatusOK {
+				return nil, errors.Errorf("bad status code of tag %s: %v", key, status)
+			}
+			tags[key] = value
+		}
+	}
+
+	return map[string]interface{}{
+		"instance_id":   document.InstanceID,
+		"instance_type": document.InstanceType,
+		"region":        document.Region,
+		"zone":          document.AvailabilityZone,
+		"account":       document.AccountID,
+		"tags":          tags,
+	}, nil
+}
+
+// gcpInstanceMetadata reads the metadata of the GCE instance. GCE doesn't serve the labels of instances, their
+// custom metadata attributes starting with cloud-metadata-gcp-prefix are taken as their tags, without it. Other
+// attributes are left out: they hold e.g. ssh-keys, startup-script and kube-env, which must not end up in the
+// extra vars of runs and the run history.
+func gcpInstanceMetadata(client *http.Client) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", gcpMetadataURL+"/instance/?recursive=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var instance struct {
+		ID          json.Number       `json:"id"`
+		Name        string            `json:"name"`
+		MachineType string            `json:"machineType"` // projects/<number>/machineTypes/<type>
+		Zone        string            `json:"zone"`        // projects/<number>/zones/<zone>
+		Attributes  map[string]string `json:"attributes"`
+	}
+	if err := getMetadata(client, req, &instance); err != nil {
+		return nil, err
+	}
+
+	zone := path.Base(instance.Zone)
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	tags := map[string]string{}
+	if prefix := viper.GetString("cloud-metadata-gcp-prefix"); prefix != "" {
+		for name, value := range instance.Attributes {
+			if strings.HasPrefix(name, prefix) {
+				tags[strings.TrimPrefix(name, prefix)] = value
+			}
+		}
+	}
+	return map[string]interface{}{
+		"instance_id":   instance.ID.String(),
+		"instance_name": instance.Name,
+		"instance_type": path.Base(instance.MachineType),
+		"region":        region,
+		"zone":          zone,
+		"tags":          tags,
+	}, nil
+}
+
+// azureInstanceMetadata reads the compute metadata of the Azure VM.
+func azureInstanceMetadata(client *http.Client) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", azureMetadataURL+"/instance/compute?api-version=2021-02-01", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	var compute struct {
+		VMID           string `json:"vmId"`
+		Name           string `json:"name"`
+		VMSize         string `json:"vmSize"`
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+		SubscriptionID string `json:"subscriptionId"`
+		TagsList       []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"tagsList"`
+	}
+	if err := getMetadata(client, req, &compute); err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for _, tag := range compute.TagsList {
+		tags[tag.Name] = tag.Value
+	}
+	return map[string]interface{}{
+		"instance_id":   compute.VMID,
+		"instance_name": compute.Name,
+		"instance_type": compute.VMSize,
+		"region":        compute.Location,
+		"zone":          compute.Zone,
+		"account":       compute.SubscriptionID,
+		"tags":          tags,
+	}, nil
+}
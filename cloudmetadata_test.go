@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// awsMetadataServer serves the instance identity document and, if tagsAllowed, the instance tags with IMDSv2.
+func awsMetadataServer(t *testing.T, tagsAllowed bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/latest/api/token" {
+			assert.Equal(t, "PUT", req.Method)
+			assert.Equal(t, "60", req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			rw.Write([]byte("imds-token"))
+			return
+		}
+		if req.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case req.URL.Path == "/latest/dynamic/instance-identity/document":
+			json.NewEncoder(rw).Encode(map[string]string{
+				"instanceId":       "i-0123456789",
+				"instanceType":     "m5.large",
+				"region":           "eu-west-1",
+				"availabilityZone": "eu-west-1a",
+				"accountId":        "123456789012",
+			})
+		case req.URL.Path == "/latest/meta-data/tags/instance" && tagsAllowed:
+			rw.Write([]byte("Name\nenv"))
+		case req.URL.Path == "/latest/meta-data/tags/instance/Name" && tagsAllowed:
+			rw.Write([]byte("web1"))
+		case req.URL.Path == "/latest/meta-data/tags/instance/env" && tagsAllowed:
+			rw.Write([]byte("production"))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	originalURL := awsMetadataURL
+	awsMetadataURL = server.URL + "/latest"
+	t.Cleanup(func() { awsMetadataURL = originalURL })
+	return server
+}
+
+func TestAWSInstanceMetadata(t *testing.T) {
+	server := awsMetadataServer(t, true)
+
+	metadata, err := awsInstanceMetadata(server.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"instance_id":   "i-0123456789",
+		"instance_type": "m5.large",
+		"region":        "eu-west-1",
+		"zone":          "eu-west-1a",
+		"account":       "123456789012",
+		"tags":          map[string]string{"Name": "web1", "env": "production"},
+	}, metadata)
+}
+
+func TestAWSInstanceMetadataWithoutTags(t *testing.T) {
+	server := awsMetadataServer(t, false)
+
+	metadata, err := awsInstanceMetadata(server.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, "i-0123456789", metadata["instance_id"])
+	assert.Equal(t, map[string]string{}, metadata["tags"])
+}
+
+func TestGCPInstanceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Google", req.Header.Get("Metadata-Flavor"))
+		assert.Equal(t, "/computeMetadata/v1/instance/", req.URL.Path)
+		rw.Write([]byte(`{"id": 4520031799277581759, "name": "web1", "machineType": "projects/123/machineTypes/n1-standard-1",
+			"zone": "projects/123/zones/us-central1-a", "attributes": {"ansible-env": "production", "ssh-keys": "root:ssh-ed25519 AAAA", "startup-script": "#!/bin/sh"}}`))
+	}))
+	defer server.Close()
+	originalURL := gcpMetadataURL
+	gcpMetadataURL = server.URL + "/computeMetadata/v1"
+	defer func() { gcpMetadataURL = originalURL }()
+
+	withSettings(t, map[string]interface{}{"cloud-metadata-gcp-prefix": "ansible-"})
+
+	metadata, err := gcpInstanceMetadata(server.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"instance_id":   "4520031799277581759",
+		"instance_name": "web1",
+		"instance_type": "n1-standard-1",
+		"region":        "us-central1",
+		"zone":          "us-central1-a",
+		"tags":          map[string]string{"env": "production"},
+	}, metadata)
+
+	// No attributes are passed without a prefix
+	withSettings(t, map[string]interface{}{"cloud-metadata-gcp-prefix": ""})
+	metadata, err = gcpInstanceMetadata(server.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{}, metadata["tags"])
+}
+
+func TestAzureInstanceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata") != "true" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Write([]byte(`{"vmId": "02aab8a4", "name": "web1", "vmSize": "Standard_D2s_v3", "location": "westeurope", "zone": "1",
+			"subscriptionId": "8d10da13", "tagsList": [{"name": "env", "value": "production"}]}`))
+	}))
+	defer server.Close()
+	originalURL := azureMetadataURL
+	azureMetadataURL = server.URL + "/metadata"
+	defer func() { azureMetadataURL = originalURL }()
+
+	metadata, err := azureInstanceMetadata(server.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, "02aab8a4", metadata["instance_id"])
+	assert.Equal(t, "westeurope", metadata["region"])
+	assert.Equal(t, "Standard_D2s_v3", metadata["instance_type"])
+	assert.Equal(t, map[string]string{"env": "production"}, metadata["tags"])
+}
+
+func TestRunCloudMetadata(t *testing.T) {
+	awsMetadataServer(t, true)
+	defer func() {
+		cloudMetadataCache.Lock()
+		delete(cloudMetadataCache.byProvider, cloudAWS)
+		cloudMetadataCache.Unlock()
+	}()
+
+	assert.Nil(t, runCloudMetadata())
+	data, err := json.Marshal(runContextVars{})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), `"cloud"`)
+
+	viper.Set("cloud-metadata", cloudAWS)
+	viper.Set("cloud-metadata-vars", []string{"provider", "region", "tags", "unknown"})
+	defer func() {
+		viper.Set("cloud-metadata", "")
+		viper.Set("cloud-metadata-vars", defaultCloudMetadataVars)
+	}()
+	assert.Nil(t, setupCloudMetadata())
+
+	assert.Equal(t, map[string]interface{}{
+		"provider": "aws",
+		"region":   "eu-west-1",
+		"tags":     map[string]string{"Name": "web1", "env": "production"},
+	}, runCloudMetadata())
+
+	viper.Set("cloud-metadata", "openstack")
+	assert.NotNil(t, setupCloudMetadata())
+}
@@ -0,0 +1,66 @@
+// Subcommands that can be run instead of the daemon
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// subcommand is an operation invoked as `ansible-puller [flags] <name> [args]`.
+type subcommand struct {
+	Name        string                    // Name used to invoke the subcommand
+	Usage       string                    // Arguments accepted by the subcommand
+	Description string                    // One-line description for the help output
+	Flags       *pflag.FlagSet            // Flags specific to the subcommand, if any
+	Operations  []string                  // Values accepted as the first argument, if it is restricted
+	Run         func(args []string) error // Called with the arguments following the name and its flags
+}
+
+var subcommands = map[string]subcommand{}
+
+func registerSubcommand(cmd subcommand) {
+	subcommands[cmd.Name] = cmd
+}
+
+// subcommandNames returns the names of all registered subcommands in a stable order.
+func subcommandNames() []string {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func printSubcommandUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", appName)
+	for _, name := range subcommandNames() {
+		cmd := subcommands[name]
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", cmd.Name+" "+cmd.Usage, cmd.Description)
+	}
+}
+
+// runSubcommand dispatches args[0] to the matching registered subcommand.
+func runSubcommand(args []string) error {
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		printSubcommandUsage()
+		return errors.Errorf("unknown command: %s", args[0])
+	}
+
+	args = args[1:]
+	if cmd.Flags != nil {
+		if err := cmd.Flags.Parse(args); err != nil {
+			return err
+		}
+		args = cmd.Flags.Args()
+	}
+
+	return cmd.Run(args)
+}
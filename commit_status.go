@@ -0,0 +1,216 @@
+// Reporting of run results as commit statuses on GitHub or GitLab
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Commit states, named as on GitHub
+const (
+	commitStatePending = "pending"
+	commitStateSuccess = "success"
+	commitStateFailure = "failure"
+)
+
+// Reporter for the commit applied from git-url, nil if commit status reporting is not configured
+var commitStatus *commitStatusReporter
+
+// commitStatusReporter posts the state of runs as commit statuses, so the repository shows which commits
+// hosts have converged to. Pointing api-url at a proxy allows aggregating the statuses of many hosts.
+type commitStatusReporter struct {
+	provider string // github or gitlab
+	apiURL   string
+	repo     string // owner/repo on GitHub, the project path on GitLab
+	token    string
+	context  string // Name of the status, one per host by default
+	client   *http.Client
+}
+
+// repoPathFromURL returns the owner/repo path of an HTTPS or SSH git URL.
+func repoPathFromURL(gitURL string) string {
+	path := gitURL
+	if parsed, err := url.Parse(gitURL); err == nil && parsed.Host != "" {
+		path = parsed.Path
+	} else if i := strings.Index(gitURL, ":"); i >= 0 {
+		// scp-like syntax: git@host:owner/repo.git
+		path = gitURL[i+1:]
+	}
+
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
+// setupCommitStatus creates the commit status reporter from the configuration.
+func setupCommitStatus() error {
+	provider := viper.GetString("git-status-provider")
+	if provider == "" {
+		return nil
+	}
+
+	apiURL := viper.GetString("git-status-api-url")
+	switch provider {
+	case "github":
+		if apiURL == "" {
+			apiURL = "https://api.github.com"
+		}
+	case "gitlab":
+		if apiURL == "" {
+			apiURL = "https://gitlab.com"
+		}
+	default:
+		return errors.Errorf("invalid git-status-provider %q, expected github or gitlab", provider)
+	}
+
+	if viper.GetString("git-url") == "" {
+		return errors.New("git-status-provider requires git-url")
+	}
+
+	repo := viper.GetString("git-status-repo")
+	if repo == "" {
+		repo = repoPathFromURL(viper.GetString("git-url"))
+	}
+
+	token, err := ioutil.ReadFile(viper.GetString("git-status-token-file"))
+	if err != nil {
+		return errors.Wrap(err, "unable to read git-status-token-file")
+	}
+
+	statusContext := viper.GetString("git-status-context")
+	if statusContext == "" {
+		statusContext = fmt.Sprintf("%s/%s", appName, hostname)
+	}
+
+	commitStatus = &commitStatusReporter{
+		provider: provider,
+		apiURL:   strings.TrimSuffix(apiURL, "/"),
+		repo:     repo,
+		token:    strings.TrimSpace(string(token)),
+		context:  statusContext,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	return nil
+}
+
+func (r commitStatusReporter) request(sha, state, description string) (*http.Request, error) {
+	if r.provider == "gitlab" {
+		if state == commitStateFailure {
+			state = "failed"
+		}
+		form := url.Values{}
+		form.Set("state", state)
+		form.Set("name", r.context)
+		form.Set("description", description)
+
+		statusURL := fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", r.apiURL, url.PathEscape(r.repo), sha)
+		req, err := http.NewRequest("POST", statusURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("PRIVATE-TOKEN", r.token)
+		return req, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"state":       state,
+		"context":     r.context,
+		"description": description,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/repos/%s/statuses/%s", r.apiURL, r.repo, sha), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+r.token)
+	return req, nil
+}
+
+// report sets the status of commit sha.
+func (r commitStatusReporter) report(sha, state, description string) error {
+	req, err := r.request(sha, state, description)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	logrus.Debugf("Reported %s for commit %s", state, sha)
+	return nil
+}
+
+// reportCommitStatus reports state for the commit that was pulled from git-url, logging failures.
+func reportCommitStatus(sha, state, description string) {
+	if commitStatus == nil || sha == "" {
+		return
+	}
+
+	if err := commitStatus.report(sha, state, description); err != nil {
+		logrus.Warnf("Unable to report commit status for %s: %v", sha, err)
+	}
+}
+
+// appliedGitCommit returns the commit last pulled from git-url, or "" if the git source is not used.
+func appliedGitCommit() string {
+	downloader, _, err := artifactDownloader()
+	if err != nil {
+		return ""
+	}
+	git, ok := downloader.(gitDownloader)
+	if !ok {
+		return ""
+	}
+
+	commit, err := git.git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		logrus.Warnln("Unable to determine the pulled commit: ", err)
+		return ""
+	}
+
+	return commit
+}
+
+// reportRunCommitStatus reports that the run of spec applies the commit pulled from git-url, and returns the
+// function that reports how the run went. Nothing is reported for check runs, which don't apply anything, nor for
+// bake runs.
+func reportRunCommitStatus(spec runSpec) func(err error) {
+	if commitStatus == nil || !spec.reported() {
+		return func(error) {}
+	}
+
+	commit := appliedGitCommit()
+	if spec.ReplayContext != nil {
+		commit = spec.ReplayContext.ArtifactCommit
+	}
+	reportCommitStatus(commit, commitStatePending, "Applying on "+hostname)
+	return func(err error) {
+		if err != nil {
+			reportCommitStatus(commit, commitStateFailure, "Failed on "+hostname)
+			return
+		}
+		reportCommitStatus(commit, commitStateSuccess, "Applied on "+hostname)
+	}
+}
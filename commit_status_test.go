@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoPathFromURL(t *testing.T) {
+	assert.Equal(t, "example/infra", repoPathFromURL("https://github.com/example/infra.git"))
+	assert.Equal(t, "example/infra", repoPathFromURL("git@github.com:example/infra.git"))
+	assert.Equal(t, "group/sub/infra", repoPathFromURL("ssh://git@gitlab.com/group/sub/infra"))
+}
+
+func TestCommitStatusGitHub(t *testing.T) {
+	var path, auth string
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		auth = req.Header.Get("Authorization")
+		json.NewDecoder(req.Body).Decode(&body)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	reporter := commitStatusReporter{
+		provider: "github",
+		apiURL:   server.URL,
+		repo:     "example/infra",
+		token:    "secret",
+		context:  "ansible-puller/host1",
+		client:   server.Client(),
+	}
+	assert.Nil(t, reporter.report("abc123", commitStateFailure, "Failed on host1"))
+
+	assert.Equal(t, "/repos/example/infra/statuses/abc123", path)
+	assert.Equal(t, "token secret", auth)
+	assert.Equal(t, map[string]string{
+		"state":       "failure",
+		"context":     "ansible-puller/host1",
+		"description": "Failed on host1",
+	}, body)
+}
+
+func TestCommitStatusGitLab(t *testing.T) {
+	var path, token, state, name string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.EscapedPath()
+		token = req.Header.Get("PRIVATE-TOKEN")
+		req.ParseForm()
+		state = req.PostForm.Get("state")
+		name = req.PostForm.Get("name")
+	}))
+	defer server.Close()
+
+	reporter := commitStatusReporter{
+		provider: "gitlab",
+		apiURL:   server.URL,
+		repo:     "group/infra",
+		token:    "secret",
+		context:  "ansible-puller/host1",
+		client:   server.Client(),
+	}
+	assert.Nil(t, reporter.report("abc123", commitStateFailure, "Failed on host1"))
+
+	assert.Equal(t, "/api/v4/projects/group%2Finfra/statuses/abc123", path)
+	assert.Equal(t, "secret", token)
+	assert.Equal(t, "failed", state)
+	assert.Equal(t, "ansible-puller/host1", name)
+}
+
+func TestReportRunCommitStatus(t *testing.T) {
+	var states []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		states = append(states, body["state"])
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	original := commitStatus
+	commitStatus = &commitStatusReporter{provider: "github", apiURL: server.URL, repo: "example/infra", client: server.Client()}
+	defer func() { commitStatus = original }()
+	replayed := &runContextVars{ArtifactCommit: "abc123"}
+
+	reportRunCommitStatus(runSpec{ReplayContext: replayed})(nil)
+	assert.Equal(t, []string{commitStatePending, commitStateSuccess}, states)
+
+	// Check runs change nothing, no commit was applied
+	states = nil
+	reportRunCommitStatus(runSpec{ReplayContext: replayed, CheckMode: true})(nil)
+	assert.Empty(t, states)
+	// Bake runs converge an image, not a host
+	reportRunCommitStatus(runSpec{ReplayContext: replayed, NoReport: true})(nil)
+	assert.Empty(t, states)
+}
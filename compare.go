@@ -0,0 +1,263 @@
+// Comparison of a new artifact version against the applied one, before the scheduled apply picks it up
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Copy of the last artifact that was successfully applied, in the state directory
+const appliedArtifactFileName = "applied-artifact.tgz"
+
+// Comparison states
+const (
+	comparisonRunning   = "running"
+	comparisonCompleted = "completed"
+	comparisonFailed    = "failed"
+)
+
+// artifactComparison is the progress and result of a comparison, as returned by the API.
+type artifactComparison struct {
+	Status         string           `json:"status"`
+	AppliedVersion string           `json:"applied_version"` // MD5 of the applied artifact, empty if none was kept yet
+	NewVersion     string           `json:"new_version"`     // MD5 of the pulled artifact
+	AppliedRunID   string           `json:"applied_run_id,omitempty"`
+	NewRunID       string           `json:"new_run_id,omitempty"`
+	WouldChange    []string         `json:"would_change"` // Tasks the new version would change on this host
+	Differences    []taskDifference `json:"differences"`  // Results that differ from the check run of the applied version
+	NewRunExitCode *int             `json:"new_run_exit_code"`
+	StartTime      time.Time        `json:"start_time"`
+	EndTime        *time.Time       `json:"end_time"`
+	Error          string           `json:"error,omitempty"`
+}
+
+var (
+	comparisonMutex sync.Mutex
+	lastComparison  *artifactComparison // The running or last finished comparison
+)
+
+func appliedArtifactPath() string {
+	return filepath.Join(stateDir(), appliedArtifactFileName)
+}
+
+// saveAppliedArtifact keeps a copy of the artifact at path, which was just applied, to compare new versions against.
+func saveAppliedArtifact(path string) error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(appliedArtifactPath(), data, 0600)
+}
+
+// getComparison returns a copy of the running or last finished comparison, nil if there was none.
+func getComparison() *artifactComparison {
+	comparisonMutex.Lock()
+	defer comparisonMutex.Unlock()
+
+	if lastComparison == nil {
+		return nil
+	}
+	comparison := *lastComparison
+	return &comparison
+}
+
+// updateComparison applies fn to the running comparison.
+func updateComparison(fn func(comparison *artifactComparison)) {
+	comparisonMutex.Lock()
+	defer comparisonMutex.Unlock()
+
+	fn(lastComparison)
+}
+
+// startComparison starts a comparison in the background, failing if one is running.
+func startComparison() (*artifactComparison, error) {
+	comparisonMutex.Lock()
+	defer comparisonMutex.Unlock()
+
+	if lastComparison != nil && lastComparison.Status == comparisonRunning {
+		return nil, errors.New("a comparison is already running")
+	}
+
+	lastComparison = &artifactComparison{
+		Status:      comparisonRunning,
+		WouldChange: []string{},
+		Differences: []taskDifference{},
+		StartTime:   time.Now(),
+	}
+	comparison := *lastComparison
+
+	go runComparison()
+	return &comparison, nil
+}
+
+// runComparison runs the playbook of the new artifact in check mode, and that of the applied artifact to tell
+// which of its results are new.
+func runComparison() {
+	err := compareArtifacts()
+	updateComparison(func(comparison *artifactComparison) {
+		now := time.Now()
+		comparison.EndTime = &now
+		comparison.Status = comparisonCompleted
+		if err != nil {
+			comparison.Status = comparisonFailed
+			comparison.Error = err.Error()
+		}
+	})
+	if err != nil {
+		logrus.Errorln("Artifact comparison failed: ", err)
+	}
+}
+
+// checkAppliedArtifact runs the playbook of the applied artifact in check mode. It returns nil if no artifact was
+// applied since comparisons were introduced.
+func checkAppliedArtifact(playbook string) (*RunReport, error) {
+	data, err := ioutil.ReadFile(appliedArtifactPath())
+	if os.IsNotExist(err) {
+		logrus.Infoln("No applied artifact was kept, only checking the new artifact")
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to read the applied artifact")
+	}
+
+	// Run from a copy, as a run finishing meanwhile replaces the applied artifact
+	artifact, err := ioutil.TempFile("", appName+"-applied")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(artifact.Name())
+	_, err = artifact.Write(data)
+	artifact.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to copy the applied artifact")
+	}
+
+	appliedVersion, err := md5sum(artifact.Name())
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infoln("Checking the applied artifact ", appliedVersion)
+	runID := uuid.NewV4().String()
+	updateComparison(func(comparison *artifactComparison) {
+		comparison.AppliedVersion = appliedVersion
+		comparison.AppliedRunID = runID
+	})
+
+	report, err := executeRun(runSpec{
+		ID:        runID,
+		Playbook:  playbook,
+		CheckMode: true,
+		Trigger:   runTriggerCompare,
+		Artifact:  artifact.Name(),
+	})
+	if report == nil {
+		return nil, errors.Wrap(err, "check run of the applied artifact failed")
+	}
+
+	return report, nil
+}
+
+// compareArtifacts does the work of runComparison.
+func compareArtifacts() error {
+	playbook := viper.GetString("ansible-playbook")
+
+	applied, err := checkAppliedArtifact(playbook)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infoln("Checking the new artifact")
+	runID := uuid.NewV4().String()
+	updateComparison(func(comparison *artifactComparison) { comparison.NewRunID = runID })
+	candidate, err := executeRun(runSpec{ID: runID, Playbook: playbook, CheckMode: true, Trigger: runTriggerCompare})
+	if candidate == nil {
+		return errors.Wrap(err, "check run of the new artifact failed")
+	}
+	newVersion, _ := md5sum(localCacheFile)
+
+	wouldChange := []string{}
+	for _, task := range candidate.Tasks {
+		for _, status := range task.Hosts {
+			if status == "changed" {
+				wouldChange = append(wouldChange, task.Name)
+				break
+			}
+		}
+	}
+	differences := []taskDifference{}
+	if applied != nil {
+		differences = diffRunReports(*applied, *candidate)
+	}
+
+	updateComparison(func(comparison *artifactComparison) {
+		comparison.NewVersion = newVersion
+		comparison.WouldChange = wouldChange
+		comparison.Differences = differences
+		comparison.NewRunExitCode = &candidate.ExitCode
+	})
+	logrus.Infof("New artifact %s would change %d tasks, %d results differ from the applied artifact",
+		newVersion, len(wouldChange), len(differences))
+	return nil
+}
+
+// HandlerCompare starts a comparison of the new artifact with the applied one. Its progress can be polled with
+// HandlerComparison.
+func HandlerCompare(w http.ResponseWriter, r *http.Request) {
+	if ansibleDisabled {
+		http.Error(w, "ansible puller is disabled", http.StatusConflict)
+		return
+	}
+	if err := runQuotas.allow(runSourceCompare); err != nil {
+		httpQuotaExceeded(w, err)
+		return
+	}
+
+	comparison, err := startComparison()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	data, err := json.Marshal(comparison)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandlerComparison returns the running or last finished comparison.
+func HandlerComparison(w http.ResponseWriter, r *http.Request) {
+	comparison := getComparison()
+	if comparison == nil {
+		http.Error(w, "no comparison since the puller started", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(comparison)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAppliedArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ansible_puller_compare")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", filepath.Join(dir, "state"))
+	defer viper.Set("state-dir", originalStateDir)
+
+	report, err := checkAppliedArtifact("site.yml")
+	assert.Nil(t, err)
+	assert.Nil(t, report, "nothing is checked before an artifact was applied")
+
+	artifact := filepath.Join(dir, "artifact.tgz")
+	assert.Nil(t, ioutil.WriteFile(artifact, []byte("artifact"), 0600))
+	assert.Nil(t, saveAppliedArtifact(artifact))
+
+	data, err := ioutil.ReadFile(appliedArtifactPath())
+	assert.Nil(t, err)
+	assert.Equal(t, "artifact", string(data))
+}
+
+func TestRunSpecArtifactFile(t *testing.T) {
+	assert.Equal(t, localCacheFile, runSpec{}.artifactFile())
+	assert.Equal(t, "/tmp/applied.tgz", runSpec{Artifact: "/tmp/applied.tgz"}.artifactFile())
+}
+
+func TestCompareEndpoints(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = true
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	req, err := http.NewRequest("POST", httpPathCompare, nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerCompare).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	req, err = http.NewRequest("GET", httpPathCompare, nil)
+	assert.Nil(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HandlerComparison).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
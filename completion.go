@@ -0,0 +1,261 @@
+// Shell completion and man page generation from the flag and subcommand definitions
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// visibleFlags returns the non-hidden flags of a flag set in their sorted order.
+func visibleFlags(flags *pflag.FlagSet) []*pflag.Flag {
+	var result []*pflag.Flag
+	if flags == nil {
+		return result
+	}
+
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if !flag.Hidden {
+			result = append(result, flag)
+		}
+	})
+
+	return result
+}
+
+// flagTakesValue reports whether the flag needs a value, which booleans do not.
+func flagTakesValue(flag *pflag.Flag) bool {
+	return flag.NoOptDefVal == ""
+}
+
+func flagNames(flags []*pflag.Flag, valuesOnly bool) []string {
+	var names []string
+	for _, flag := range flags {
+		if !valuesOnly || flagTakesValue(flag) {
+			names = append(names, "--"+flag.Name)
+		}
+	}
+
+	return names
+}
+
+// completionFunctionName turns the program name into a valid shell function name.
+func completionFunctionName() string {
+	return "_" + strings.ReplaceAll(appName, "-", "_")
+}
+
+func writeBashCompletion(w io.Writer) {
+	globalFlags := visibleFlags(pflag.CommandLine)
+
+	fmt.Fprintf(w, "# bash completion for %s\n", appName)
+	fmt.Fprintf(w, "%s() {\n", completionFunctionName())
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd=\"\" i\n")
+	fmt.Fprintf(w, "    local value_flags=\" %s \"\n", strings.Join(flagNames(globalFlags, true), " "))
+	fmt.Fprintf(w, "    for ((i=1; i<COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(w, "        case \"${COMP_WORDS[i]}\" in\n")
+	fmt.Fprintf(w, "            -*=*) ;;\n")
+	fmt.Fprintf(w, "            -*) [[ \"$value_flags\" == *\" ${COMP_WORDS[i]} \"* ]] && ((i++)) ;;\n")
+	fmt.Fprintf(w, "            *) cmd=\"${COMP_WORDS[i]}\"; break ;;\n")
+	fmt.Fprintf(w, "        esac\n")
+	fmt.Fprintf(w, "    done\n")
+	fmt.Fprintf(w, "    if [[ -z \"$cmd\" && \"$value_flags\" == *\" $prev \"* ]]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=()\n")
+	fmt.Fprintf(w, "        return\n")
+	fmt.Fprintf(w, "    fi\n")
+	fmt.Fprintf(w, "    case \"$cmd\" in\n")
+	fmt.Fprintf(w, "        \"\") COMPREPLY=($(compgen -W \"%s %s\" -- \"$cur\")) ;;\n",
+		strings.Join(subcommandNames(), " "), strings.Join(flagNames(globalFlags, false), " "))
+	for _, name := range subcommandNames() {
+		cmd := subcommands[name]
+		words := append(flagNames(visibleFlags(cmd.Flags), false), cmd.Operations...)
+		if len(words) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", name, strings.Join(words, " "))
+	}
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -o default -F %s %s\n", completionFunctionName(), appName)
+}
+
+// zshEscape makes a description safe to use inside a single quoted _arguments spec.
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", "'\\''", "[", "(", "]", ")", ":", "\\:").Replace(s)
+}
+
+func zshFlagSpecs(flags []*pflag.Flag) []string {
+	var specs []string
+	for _, flag := range flags {
+		spec := fmt.Sprintf("'--%s[%s]", flag.Name, zshEscape(flag.Usage))
+		if flagTakesValue(flag) {
+			spec += fmt.Sprintf(":%s:", flag.Value.Type())
+		}
+		specs = append(specs, spec+"'")
+	}
+
+	return specs
+}
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef %s\n\n", appName)
+	fmt.Fprintf(w, "%s() {\n", completionFunctionName())
+	fmt.Fprintf(w, "    local -a commands\n")
+	fmt.Fprintf(w, "    commands=(\n")
+	for _, name := range subcommandNames() {
+		fmt.Fprintf(w, "        '%s:%s'\n", name, zshEscape(subcommands[name].Description))
+	}
+	fmt.Fprintf(w, "    )\n\n")
+	fmt.Fprintf(w, "    _arguments -C \\\n")
+	for _, spec := range zshFlagSpecs(visibleFlags(pflag.CommandLine)) {
+		fmt.Fprintf(w, "        %s \\\n", spec)
+	}
+	fmt.Fprintf(w, "        '1: :->command' \\\n")
+	fmt.Fprintf(w, "        '*:: :->args'\n\n")
+	fmt.Fprintf(w, "    case $state in\n")
+	fmt.Fprintf(w, "        command) _describe 'command' commands ;;\n")
+	fmt.Fprintf(w, "        args)\n")
+	fmt.Fprintf(w, "            case $words[1] in\n")
+	for _, name := range subcommandNames() {
+		cmd := subcommands[name]
+		specs := zshFlagSpecs(visibleFlags(cmd.Flags))
+		if len(cmd.Operations) > 0 {
+			specs = append(specs, fmt.Sprintf("'1:operation:(%s)'", strings.Join(cmd.Operations, " ")))
+		}
+		if len(specs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "                %s) _arguments %s ;;\n", name, strings.Join(specs, " "))
+	}
+	fmt.Fprintf(w, "            esac ;;\n")
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "%s \"$@\"\n", completionFunctionName())
+}
+
+// fishEscape makes a description safe to use inside a single quoted fish string.
+func fishEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s)
+}
+
+func writeFishFlagCompletions(w io.Writer, condition string, flags []*pflag.Flag) {
+	for _, flag := range flags {
+		required := ""
+		if flagTakesValue(flag) {
+			required = " -r"
+		}
+		fmt.Fprintf(w, "complete -c %s -n '%s' -l %s%s -d '%s'\n", appName, condition, flag.Name, required, fishEscape(flag.Usage))
+	}
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for %s\n", appName)
+	fmt.Fprintf(w, "complete -c %s -f\n", appName)
+	writeFishFlagCompletions(w, "__fish_use_subcommand", visibleFlags(pflag.CommandLine))
+	for _, name := range subcommandNames() {
+		cmd := subcommands[name]
+		fmt.Fprintf(w, "complete -c %s -n '__fish_use_subcommand' -a %s -d '%s'\n", appName, name, fishEscape(cmd.Description))
+
+		condition := "__fish_seen_subcommand_from " + name
+		writeFishFlagCompletions(w, condition, visibleFlags(cmd.Flags))
+		if len(cmd.Operations) > 0 {
+			fmt.Fprintf(w, "complete -c %s -n '%s' -a '%s'\n", appName, condition, strings.Join(cmd.Operations, " "))
+		}
+	}
+}
+
+// roffEscape escapes text for use in a man page.
+func roffEscape(s string) string {
+	s = strings.NewReplacer("\\", "\\e", "-", "\\-").Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = "\\&" + s
+	}
+
+	return s
+}
+
+func writeManFlags(w io.Writer, flags []*pflag.Flag) {
+	for _, flag := range flags {
+		fmt.Fprintf(w, ".TP\n")
+		if flagTakesValue(flag) {
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR \\fI%s\\fR\n", roffEscape(flag.Name), flag.Value.Type())
+		} else {
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR\n", roffEscape(flag.Name))
+		}
+		usage := flag.Usage
+		if flagTakesValue(flag) && flag.DefValue != "" && flag.DefValue != "[]" {
+			usage += fmt.Sprintf(" (default %s)", flag.DefValue)
+		}
+		fmt.Fprintf(w, "%s\n", roffEscape(usage))
+	}
+}
+
+func writeManPage(w io.Writer) {
+	version := Version
+	if version == "" {
+		version = "development"
+	}
+
+	fmt.Fprintf(w, ".TH %s 8 \"\" \"%s %s\" \"System Administration\"\n", strings.ToUpper(roffEscape(appName)), roffEscape(appName), roffEscape(version))
+	fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", roffEscape(appName), roffEscape(strings.ToLower(serviceDescription[:1])+serviceDescription[1:]))
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B %s\n[\\fIflags\\fR] [\\fIcommand\\fR [\\fIargs\\fR]]\n", roffEscape(appName))
+	fmt.Fprintf(w, ".SH DESCRIPTION\n")
+	fmt.Fprintf(w, "Without a command, %s runs as a daemon that periodically downloads an Ansible tarball and runs the configured playbook against the local host, ", roffEscape(appName))
+	fmt.Fprintf(w, "serving a control interface and Prometheus metrics over HTTP.\n")
+	fmt.Fprintf(w, "Every flag can also be set in the config file using its name as the key.\n")
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	writeManFlags(w, visibleFlags(pflag.CommandLine))
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	for _, name := range subcommandNames() {
+		cmd := subcommands[name]
+		fmt.Fprintf(w, ".TP\n\\fB%s\\fR %s\n%s\n", roffEscape(name), roffEscape(cmd.Usage), roffEscape(cmd.Description))
+		if flags := visibleFlags(cmd.Flags); len(flags) > 0 {
+			fmt.Fprintf(w, ".RS\n")
+			writeManFlags(w, flags)
+			fmt.Fprintf(w, ".RE\n")
+		}
+	}
+	fmt.Fprintf(w, ".SH FILES\n")
+	for _, path := range []string{"/etc/" + appName + "/" + appName + ".json", "$HOME/." + appName + "/" + appName + ".json", "./" + appName + ".json"} {
+		fmt.Fprintf(w, ".TP\n%s\n", roffEscape(path))
+	}
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "completion",
+		Usage:       "bash|zsh|fish",
+		Description: "Print a shell completion script",
+		Operations:  []string{"bash", "zsh", "fish"},
+		Run: func(args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("usage: %s completion bash|zsh|fish", appName)
+			}
+
+			switch args[0] {
+			case "bash":
+				writeBashCompletion(os.Stdout)
+			case "zsh":
+				writeZshCompletion(os.Stdout)
+			case "fish":
+				writeFishCompletion(os.Stdout)
+			default:
+				return fmt.Errorf("unsupported shell: %s", args[0])
+			}
+
+			return nil
+		},
+	})
+
+	registerSubcommand(subcommand{
+		Name:        "man",
+		Description: "Print the man page in roff format",
+		Run: func(args []string) error {
+			writeManPage(os.Stdout)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBashCompletion(t *testing.T) {
+	var out bytes.Buffer
+	writeBashCompletion(&out)
+
+	assert.Contains(t, out.String(), "complete -o default -F _ansible_puller ansible-puller")
+	assert.Contains(t, out.String(), "--http-url")
+	assert.Contains(t, out.String(), `state) COMPREPLY=($(compgen -W "export import" -- "$cur")) ;;`)
+	assert.Contains(t, out.String(), `status) COMPREPLY=($(compgen -W "--json --url" -- "$cur")) ;;`)
+}
+
+func TestZshCompletion(t *testing.T) {
+	var out bytes.Buffer
+	writeZshCompletion(&out)
+
+	assert.Contains(t, out.String(), "#compdef ansible-puller")
+	assert.Contains(t, out.String(), `'state:Snapshot or restore the puller'\''s local state'`)
+	assert.Contains(t, out.String(), "'--sleep[Number of minutes to sleep between runs]:int:'")
+}
+
+func TestFishCompletion(t *testing.T) {
+	var out bytes.Buffer
+	writeFishCompletion(&out)
+
+	assert.Contains(t, out.String(), "complete -c ansible-puller -n '__fish_use_subcommand' -a status -d 'Show the status of the running daemon'")
+	assert.Contains(t, out.String(), "complete -c ansible-puller -n '__fish_seen_subcommand_from status' -l json -d")
+	assert.Contains(t, out.String(), "-l sleep -r -d")
+}
+
+func TestManPage(t *testing.T) {
+	var out bytes.Buffer
+	writeManPage(&out)
+
+	assert.Contains(t, out.String(), ".TH ANSIBLE\\-PULLER 8")
+	assert.Contains(t, out.String(), "\\fB\\-\\-sleep\\fR \\fIint\\fR\nNumber of minutes to sleep between runs (default 30)\n")
+	assert.Contains(t, out.String(), "\\fBstate\\fR export|import <file>\n")
+}
+
+func TestRoffEscape(t *testing.T) {
+	assert.Equal(t, "\\&.hidden", roffEscape(".hidden"))
+	assert.Equal(t, "a\\-b \\e", roffEscape("a-b \\"))
+}
@@ -0,0 +1,94 @@
+// Hash of the effective configuration of the puller, so that hosts running stale or hand-edited configurations
+// stand out in a fleet
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var configHashes = struct {
+	sync.Mutex
+	effective string // Of the configuration the puller runs with
+	file      string // Of the config file as it was read, empty without one
+	fileStale string // Of the config file as last found changed, to warn about each change once
+}{}
+
+// effectiveConfigHash returns the SHA-256 of the effective configuration: the config file, flags and defaults.
+// Maps are printed sorted by key, so equal configurations hash the same.
+func effectiveConfigHash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v", viper.AllSettings())))
+	return hex.EncodeToString(sum[:])
+}
+
+// configFileHash returns the SHA-256 of the config file the puller read, empty if it read none or it can't be read.
+func configFileHash() string {
+	if viper.ConfigFileUsed() == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// setupConfigHash records the hashes of the configuration the puller starts with.
+func setupConfigHash() {
+	configHashes.Lock()
+	defer configHashes.Unlock()
+
+	configHashes.effective = effectiveConfigHash()
+	configHashes.file = configFileHash()
+	configHashes.fileStale = ""
+	promConfigInfo.Reset()
+	promConfigInfo.WithLabelValues(configHashes.effective).Set(1)
+	promConfigFileChanged.Set(0)
+	logrus.Debugf("Effective configuration hash: %s", configHashes.effective)
+}
+
+// configFileReloaded records the hash of the config file once it was reloaded.
+func configFileReloaded() {
+	configHashes.Lock()
+	defer configHashes.Unlock()
+
+	configHashes.file = configFileHash()
+	configHashes.fileStale = ""
+	promConfigFileChanged.Set(0)
+}
+
+// currentConfigHash returns the hash of the effective configuration, checked before every run. Changes of the
+// effective configuration are logged, and so are changes of the config file since it was read: they only apply
+// once the puller reloads it or restarts.
+func currentConfigHash() string {
+	configHashes.Lock()
+	defer configHashes.Unlock()
+
+	if effective := effectiveConfigHash(); effective != configHashes.effective {
+		logrus.Infof("Effective configuration changed from %s to %s", configHashes.effective, effective)
+		configHashes.effective = effective
+		promConfigInfo.Reset()
+		promConfigInfo.WithLabelValues(effective).Set(1)
+	}
+
+	if file := configFileHash(); file != configHashes.file {
+		promConfigFileChanged.Set(1)
+		if file != configHashes.fileStale {
+			logrus.Warnf("%s changed since the puller read it, reload or restart the puller to apply it", viper.ConfigFileUsed())
+			configHashes.fileStale = file
+		}
+	} else {
+		promConfigFileChanged.Set(0)
+		configHashes.fileStale = ""
+	}
+
+	return configHashes.effective
+}
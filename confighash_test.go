@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrentConfigHash(t *testing.T) {
+	originalFile, originalSleep := viper.ConfigFileUsed(), viper.Get("sleep")
+	t.Cleanup(func() {
+		viper.SetConfigFile(originalFile)
+		viper.Set("sleep", originalSleep)
+		setupConfigHash()
+	})
+	configFile := filepath.Join(t.TempDir(), "ansible-puller.json")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 30}`), 0600))
+	viper.SetConfigFile(configFile)
+	setupConfigHash()
+
+	started := currentConfigHash()
+	assert.Len(t, started, 64)
+	assert.Equal(t, started, effectiveConfigHash())
+	assert.Empty(t, configHashes.fileStale)
+
+	viper.Set("sleep", 45)
+	changed := currentConfigHash()
+	assert.NotEqual(t, started, changed)
+
+	// A hand-edited config file only applies once reloaded
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45}`), 0600))
+	assert.Equal(t, changed, currentConfigHash())
+	assert.Equal(t, configFileHash(), configHashes.fileStale)
+	assert.NotEqual(t, configHashes.file, configHashes.fileStale)
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 30}`), 0600))
+	currentConfigHash()
+	assert.Empty(t, configHashes.fileStale)
+}
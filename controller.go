@@ -0,0 +1,117 @@
+// Controller mode: running the pulled playbook against all the hosts it targets rather than only this host, e.g.
+// devices of a small edge site that can't run a puller of their own
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Hosts that failed or were unreachable in the last controller run, one per line like Ansible's retry files
+const failedHostsFileName = "failed-hosts.retry"
+
+func controllerMode() bool {
+	return viper.GetBool("ansible-controller")
+}
+
+func failedHostsPath() string {
+	return filepath.Join(stateDir(), failedHostsFileName)
+}
+
+// controllerInventory returns the first inventory of ansible-inventory, which the controller need not be part of.
+func (a AnsibleConfig) controllerInventory() (string, error) {
+	if len(a.InventoryList) == 0 {
+		return "", fatalError{errors.New("ansible-controller requires an ansible-inventory")}
+	}
+
+	inv := filepath.Join(a.Cwd, a.InventoryList[0])
+	if _, err := os.Stat(inv); err != nil {
+		return "", fatalError{errors.Wrapf(err, "unable to find inventory: %s", a.InventoryList[0])}
+	}
+
+	return inv, nil
+}
+
+// runLimit returns the limit expression of the run described by spec: target, or in controller mode all hosts or
+// those of ansible-controller-group, narrowed down to the failed hosts of the last controller run with RetryFailed
+// and intersected with spec.Limit.
+func runLimit(target string, spec runSpec) string {
+	var patterns []string
+	if spec.RetryFailed {
+		// Ansible only reads @ files at the start of a pattern, not after & or !
+		patterns = append(patterns, "@"+failedHostsPath())
+	}
+	if !controllerMode() {
+		patterns = append(patterns, target)
+	} else if group := viper.GetString("ansible-controller-group"); group != "" {
+		patterns = append(patterns, group)
+	}
+	if len(patterns) == 0 {
+		return spec.Limit
+	}
+
+	// Intersect, the limits only ever narrow the run down. Every term of spec.Limit is intersected on its own, as
+	// Ansible applies the terms of a union to the whole pattern.
+	for i := 1; i < len(patterns); i++ {
+		patterns[i] = "&" + patterns[i]
+	}
+	for _, term := range limitTerms(spec.Limit) {
+		if !strings.HasPrefix(term, "&") && !strings.HasPrefix(term, "!") {
+			term = "&" + term
+		}
+		patterns = append(patterns, term)
+	}
+	return strings.Join(patterns, ",")
+}
+
+// limitTermPattern matches the terms of a limit without commas, separated by colons but for those of ranges like
+// web[1:3].
+var limitTermPattern = regexp.MustCompile(`(?:[^\s:\[\]]|\[[^\]]*\])+`)
+
+// limitTerms splits limit into its terms the way Ansible does: at commas, or at colons if there are none.
+func limitTerms(limit string) []string {
+	var terms []string
+	if strings.Contains(limit, ",") {
+		terms = strings.Split(limit, ",")
+	} else {
+		terms = limitTermPattern.FindAllString(limit, -1)
+	}
+
+	var nonEmpty []string
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			nonEmpty = append(nonEmpty, term)
+		}
+	}
+	return nonEmpty
+}
+
+// saveFailedHosts records the hosts that failed or were unreachable in a controller run, for runs retrying them.
+// The file is removed when all hosts succeeded.
+func saveFailedHosts(report RunReport) error {
+	failed := report.failedHosts()
+	if len(failed) == 0 {
+		if err := os.Remove(failedHostsPath()); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "unable to remove the failed hosts")
+		}
+		return nil
+	}
+
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+	return writeFileAtomic(failedHostsPath(), []byte(strings.Join(failed, "\n")+"\n"), 0600)
+}
+
+// hasFailedHosts returns whether the last controller run left hosts to retry.
+func hasFailedHosts() bool {
+	data, err := ioutil.ReadFile(failedHostsPath())
+	return err == nil && strings.TrimSpace(string(data)) != ""
+}
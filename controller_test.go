@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withControllerMode sets ansible-controller and a new state directory, returning a function restoring both.
+func withControllerMode(t *testing.T, controller bool) func() {
+	originalController := viper.Get("ansible-controller")
+	originalStateDir := viper.Get("state-dir")
+	viper.Set("ansible-controller", controller)
+	viper.Set("state-dir", filepath.Join(t.TempDir(), "state"))
+
+	return func() {
+		viper.Set("ansible-controller", originalController)
+		viper.Set("state-dir", originalStateDir)
+	}
+}
+
+func TestRunLimit(t *testing.T) {
+	defer withControllerMode(t, false)()
+	assert.Equal(t, "web1", runLimit("web1", runSpec{}))
+	assert.Equal(t, "web1,&webservers", runLimit("web1", runSpec{Limit: "webservers"}))
+	assert.Equal(t, "web1,&webservers,&dbservers", runLimit("web1", runSpec{Limit: "webservers, dbservers"}))
+
+	viper.Set("ansible-controller", true)
+	assert.Equal(t, "", runLimit("", runSpec{}))
+	assert.Equal(t, "webservers", runLimit("", runSpec{Limit: "webservers"}))
+	assert.Equal(t, "@"+failedHostsPath()+",&webservers", runLimit("", runSpec{Limit: "webservers", RetryFailed: true}))
+
+	viper.Set("ansible-controller-group", "site1")
+	defer viper.Set("ansible-controller-group", "")
+	assert.Equal(t, "site1", runLimit("", runSpec{}))
+
+	// Every term of a union is intersected, so that none reaches hosts outside of the group
+	assert.Equal(t, "site1,&web,&db", runLimit("", runSpec{Limit: "web,db"}))
+	assert.Equal(t, "site1,&web,&db,!db2", runLimit("", runSpec{Limit: "web:&db:!db2"}))
+	assert.Equal(t, "site1,&web[1:3]", runLimit("", runSpec{Limit: "web[1:3]"}))
+	assert.Equal(t, "@"+failedHostsPath()+",&site1,&cameras", runLimit("", runSpec{Limit: "cameras", RetryFailed: true}))
+}
+
+func TestSaveFailedHosts(t *testing.T) {
+	defer withControllerMode(t, true)()
+	assert.False(t, hasFailedHosts())
+
+	report := RunReport{Hosts: map[string]AnsibleNodeStatus{
+		"web2": {Ok: 3, Failures: 1},
+		"web1": {Unreachable: 1},
+		"web3": {Ok: 4, Changed: 2},
+	}}
+	assert.Nil(t, saveFailedHosts(report))
+	assert.True(t, hasFailedHosts())
+	data, err := ioutil.ReadFile(failedHostsPath())
+	assert.Nil(t, err)
+	assert.Equal(t, "web1\nweb2\n", string(data))
+
+	assert.Equal(t, AnsibleNodeStatus{Ok: 7, Changed: 2, Failures: 1, Unreachable: 1}, report.totals())
+
+	// Once all hosts succeed, there is nothing left to retry
+	assert.Nil(t, saveFailedHosts(RunReport{Hosts: map[string]AnsibleNodeStatus{"web1": {Ok: 1}}}))
+	assert.False(t, hasFailedHosts())
+}
+
+func TestRunEndpointRetryFailed(t *testing.T) {
+	defer withControllerMode(t, false)()
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRun).ServeHTTP(rr, httptest.NewRequest("POST", "/run", strings.NewReader(`{"retry_failed": true}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	viper.Set("ansible-controller", true)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HandlerRun).ServeHTTP(rr, httptest.NewRequest("POST", "/run", strings.NewReader(`{"retry_failed": true}`)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
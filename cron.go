@@ -0,0 +1,214 @@
+// Cron expressions for scheduling runs at fixed times instead of every sleep period
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Cron schedule from the "schedule-cron" option, nil when runs are scheduled every sleep period
+var runCron *cronSchedule
+
+// Shorthands for common expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonthNames   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cronSchedule is a parsed five field cron expression: minute, hour, day of month, month and day of week.
+type cronSchedule struct {
+	expression string
+	minute     uint64 // Bit i is set if the field matches i
+	hour       uint64
+	dom        uint64
+	month      uint64
+	dow        uint64
+
+	// As in cron, a day matches either field if both are restricted
+	domRestricted bool
+	dowRestricted bool
+}
+
+// setupSchedule parses the "schedule-cron" option.
+func setupSchedule() error {
+	runCron = nil
+	expression := viper.GetString("schedule-cron")
+	if expression == "" {
+		return nil
+	}
+
+	schedule, err := parseCron(expression)
+	if err != nil {
+		return err
+	}
+	if schedule.next(time.Now()).IsZero() {
+		return errors.Errorf("cron expression %q never matches", expression)
+	}
+	runCron = schedule
+	return nil
+}
+
+// parseCron parses a cron expression like "30 2 * * Mon-Fri" or one of the @ shorthands like "@daily".
+func parseCron(expression string) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expression)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("invalid cron expression %q, expected 5 fields: minute hour day-of-month month day-of-week", expression)
+	}
+
+	schedule := &cronSchedule{expression: expression}
+	var err error
+	parsers := []struct {
+		bits  *uint64
+		min   int
+		max   int
+		names []string
+	}{
+		{&schedule.minute, 0, 59, nil},
+		{&schedule.hour, 0, 23, nil},
+		{&schedule.dom, 1, 31, nil},
+		{&schedule.month, 1, 12, cronMonthNames},
+		{&schedule.dow, 0, 7, cronWeekdayNames},
+	}
+	for i, parser := range parsers {
+		*parser.bits, err = parseCronField(fields[i], parser.min, parser.max, parser.names)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cron expression %q", expression)
+		}
+	}
+
+	// Both 0 and 7 are Sunday
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domRestricted = !strings.HasPrefix(fields[2], "*")
+	schedule.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps like "1,5-10,*/15" into a bit set.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step in %q", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = parseCronValue(bounds[0], min, names); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseCronValue(bounds[1], min, names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end in steps of 15
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, errors.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseCronValue parses a number or a name, where the first name stands for min.
+func parseCronValue(value string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return min + i, nil
+		}
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid value %q", value)
+	}
+	return number, nil
+}
+
+func (c *cronSchedule) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.expression
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+// next returns the first time after after that matches the schedule, in the configured time zone. It returns the
+// zero time if nothing matches within five years, e.g. for February 30th.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := pullerTime(after)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+		default:
+			return t
+		}
+
+		// Times skipped by a daylight saving transition may be normalized to before t
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+
+	return time.Time{}
+}
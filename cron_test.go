@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withPullerLocation(location *time.Location) func() {
+	original := pullerLocation
+	pullerLocation = location
+	return func() { pullerLocation = original }
+}
+
+func TestParseCron(t *testing.T) {
+	schedule, err := parseCron("*/15 2,4-5 * jan-mar Mon-Fri")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1|1<<15|1<<30|1<<45), schedule.minute)
+	assert.Equal(t, uint64(1<<2|1<<4|1<<5), schedule.hour)
+	assert.Equal(t, uint64(1<<1|1<<2|1<<3), schedule.month)
+	assert.Equal(t, uint64(0x3e), schedule.dow)
+	assert.False(t, schedule.domRestricted)
+	assert.True(t, schedule.dowRestricted)
+
+	schedule, err = parseCron("@daily")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), schedule.minute)
+
+	schedule, err = parseCron("0 0 * * 7")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1|1<<7), schedule.dow, "7 is Sunday as well")
+
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		_, err := parseCron(expression)
+		assert.NotNil(t, err, expression)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	defer withPullerLocation(time.UTC)()
+	from := time.Date(2023, 3, 10, 14, 7, 30, 0, time.UTC) // A Friday
+
+	for expression, expected := range map[string]time.Time{
+		"* * * * *":     time.Date(2023, 3, 10, 14, 8, 0, 0, time.UTC),
+		"30 2 * * *":    time.Date(2023, 3, 11, 2, 30, 0, 0, time.UTC),
+		"0 3 * * Mon":   time.Date(2023, 3, 13, 3, 0, 0, 0, time.UTC),
+		"0 0 1 * *":     time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":    time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 12 15 * Mon": time.Date(2023, 3, 13, 12, 0, 0, 0, time.UTC), // Either day field matches
+	} {
+		assert.Equal(t, expected, cronNextUTC(t, expression, from), expression)
+	}
+
+	schedule, err := parseCron("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, schedule.next(from).IsZero())
+}
+
+func TestCronNextInTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.Nil(t, err)
+	defer withPullerLocation(tokyo)()
+
+	from := time.Date(2023, 3, 10, 0, 0, 0, 0, time.UTC) // 09:00 in Tokyo
+	assert.Equal(t, time.Date(2023, 3, 10, 17, 30, 0, 0, time.UTC), cronNextUTC(t, "30 2 * * *", from))
+}
+
+func cronNextUTC(t *testing.T, expression string, from time.Time) time.Time {
+	schedule, err := parseCron(expression)
+	assert.Nil(t, err)
+	return schedule.next(from).UTC()
+}
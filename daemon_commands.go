@@ -0,0 +1,306 @@
+// Subcommands controlling the running daemon through its API: run, enable, disable and logs
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// How often the CLI polls the status of a run it waits for, and the output of runs it follows
+var (
+	runPollInterval  = 2 * time.Second
+	logsPollInterval = time.Second
+)
+
+// daemonURLFlag adds the --url flag of the subcommands talking to the daemon to flags.
+func daemonURLFlag(flags *pflag.FlagSet) *string {
+	return flags.String("url", "", "URL of the daemon. Derived from http-socket or http-listen-string by default")
+}
+
+// clientFor returns a client of the daemon at the URL of a --url flag, or the local daemon if it is not set.
+func clientFor(daemonURL string) *daemonClient {
+	if daemonURL == "" {
+		daemonURL = defaultDaemonURL()
+	}
+	return newDaemonClient(daemonURL)
+}
+
+var (
+	runFlags       = pflag.NewFlagSet("run", pflag.ContinueOnError)
+	runPlaybook    = runFlags.String("playbook", "", "Name of the configured playbook to run, the first one by default")
+	runTags        = runFlags.StringSlice("tags", nil, "Only run the tasks with these tags")
+	runSkipTags    = runFlags.StringSlice("skip-tags", nil, "Skip the tasks with these tags")
+	runLimitFlag   = runFlags.String("limit", "", "Limit the run to the hosts matching this pattern")
+	runCheck       = runFlags.Bool("check", false, "Only check what the run would change")
+	runRetryFailed = runFlags.Bool("retry-failed", false, "Only run for the hosts that failed the last run, in controller mode")
+	runWait        = runFlags.Bool("wait", false, "Wait for the run to finish and fail if it did")
+	runJSON        = runFlags.Bool("json", false, "Print the raw JSON response for use in scripts")
+	runURL         = daemonURLFlag(runFlags)
+)
+
+// writeRunRecord prints the outcome of a finished run.
+func writeRunRecord(w io.Writer, record runRecord, c colorizer) {
+	status := c.paint(colorGreen, record.Status)
+	if record.Status != runStatusSucceeded {
+		status = c.paint(colorRed, record.Status)
+	}
+	fmt.Fprintf(w, "Run %s %s\n", record.ID, status)
+
+	if record.ExitCode != nil {
+		fmt.Fprintf(w, "  Exit code: %d\n", *record.ExitCode)
+	}
+	fmt.Fprintf(w, "  Tasks:     %d changed, %d failed\n", record.ChangedTasks, record.FailedTasks)
+	if len(record.FailedHosts) > 0 {
+		fmt.Fprintf(w, "  Failed:    %s\n", strings.Join(record.FailedHosts, ", "))
+	}
+	if record.Error != "" {
+		fmt.Fprintf(w, "  Error:     %s\n", record.Error)
+	}
+}
+
+// waitForRun polls the status of a run until it finished.
+func waitForRun(client *daemonClient, statusPath string) (runRecord, []byte, error) {
+	for {
+		body, err := client.get(statusPath)
+		if err != nil {
+			return runRecord{}, nil, err
+		}
+		var record runRecord
+		if err := json.Unmarshal(body, &record); err != nil {
+			return runRecord{}, nil, errors.Wrap(err, "unable to parse run status")
+		}
+		if record.Status != runStatusQueued && record.Status != runStatusRunning {
+			return record, body, nil
+		}
+
+		time.Sleep(runPollInterval)
+	}
+}
+
+func runRunCommand(args []string) error {
+	client := clientFor(*runURL)
+	body, err := client.post(httpPathRun, runRequest{
+		Playbook:    *runPlaybook,
+		Tags:        *runTags,
+		SkipTags:    *runSkipTags,
+		Limit:       *runLimitFlag,
+		CheckMode:   *runCheck,
+		RetryFailed: *runRetryFailed,
+	})
+	if err != nil {
+		return err
+	}
+
+	var queued struct {
+		RunID     string `json:"run_id"`
+		StatusURL string `json:"status_url"`
+	}
+	if err := json.Unmarshal(body, &queued); err != nil {
+		return errors.Wrap(err, "unable to parse run response")
+	}
+
+	if !*runWait {
+		if *runJSON {
+			_, err := fmt.Println(string(body))
+			return err
+		}
+		fmt.Printf("Queued run %s\n", queued.RunID)
+		return nil
+	}
+
+	record, body, err := waitForRun(client, queued.StatusURL)
+	if err != nil {
+		return err
+	}
+	if *runJSON {
+		fmt.Println(string(body))
+	} else {
+		writeRunRecord(os.Stdout, record, useColor())
+	}
+	if record.Status != runStatusSucceeded {
+		return errors.Errorf("run %s %s", record.ID, record.Status)
+	}
+	return nil
+}
+
+var (
+	enableFlags       = pflag.NewFlagSet("enable", pflag.ContinueOnError)
+	enableJSON        = enableFlags.Bool("json", false, "Print the resulting JSON status for use in scripts")
+	enableURL         = daemonURLFlag(enableFlags)
+	disableFlags      = pflag.NewFlagSet("disable", pflag.ContinueOnError)
+	disableReasonFlag = disableFlags.String("reason", "", "Why the puller is disabled, shown in its status")
+	disableTTL        = disableFlags.Duration("ttl", 0, "Enable the puller again after this long, e.g. 2h. Stays disabled until enabled when 0")
+	disableJSON       = disableFlags.Bool("json", false, "Print the resulting JSON status for use in scripts")
+	disableURL        = daemonURLFlag(disableFlags)
+)
+
+// writeStateChange prints the status of the daemon after enabling or disabling it, as JSON or as message.
+func writeStateChange(client *daemonClient, asJSON bool, message string) error {
+	if !asJSON {
+		_, err := fmt.Println(message)
+		return err
+	}
+
+	_, body, err := client.status()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(body))
+	return err
+}
+
+func runEnableCommand(args []string) error {
+	client := clientFor(*enableURL)
+	if _, err := client.post(httpPathAnsibleEnable, nil); err != nil {
+		return err
+	}
+
+	return writeStateChange(client, *enableJSON, "Enabled, scheduled runs resume")
+}
+
+func runDisableCommand(args []string) error {
+	form := url.Values{}
+	if *disableReasonFlag != "" {
+		form.Set("disable-reason", *disableReasonFlag)
+	}
+	if *disableTTL > 0 {
+		form.Set("disable-ttl", disableTTL.String())
+	}
+	client := clientFor(*disableURL)
+	if _, err := client.postForm(httpPathAnsibleDisable, form); err != nil {
+		return err
+	}
+
+	message := "Disabled, no runs start until it is enabled again"
+	if *disableTTL > 0 {
+		message = fmt.Sprintf("Disabled, no runs start for %s or until it is enabled again", *disableTTL)
+	}
+	return writeStateChange(client, *disableJSON, message)
+}
+
+var (
+	logsFlags  = pflag.NewFlagSet("logs", pflag.ContinueOnError)
+	logsLines  = logsFlags.IntP("lines", "n", defaultRunTailLines, "Number of lines of output to print")
+	logsFollow = logsFlags.BoolP("follow", "f", false, "Keep printing the output of runs as it comes")
+	logsURL    = daemonURLFlag(logsFlags)
+)
+
+// tailLines fetches the last lines of output of the current or most recent run.
+func tailLines(client *daemonClient, lines int) ([]string, error) {
+	body, err := client.get(httpPathRunTail + "?lines=" + strconv.Itoa(lines))
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSuffix(string(body), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// unseenLines returns the lines at the end of current that follow on from previous, both being tails of the same
+// output. All of current is returned if it does not overlap previous, e.g. because a new run started.
+func unseenLines(previous, current []string) []string {
+	overlap := len(previous)
+	if len(current) < overlap {
+		overlap = len(current)
+	}
+
+	for ; overlap > 0; overlap-- {
+		matches := true
+		for i := 0; i < overlap; i++ {
+			if previous[len(previous)-overlap+i] != current[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return current[overlap:]
+		}
+	}
+	return current
+}
+
+func runLogsCommand(args []string) error {
+	if *logsLines < 0 {
+		return errors.New("--lines must not be negative")
+	}
+
+	// When following, as many lines as the daemon returns by default are compared between two polls, so nothing is
+	// missed unless a run prints more than that in between
+	fetch := *logsLines
+	if *logsFollow && fetch < defaultRunTailLines {
+		fetch = defaultRunTailLines
+	}
+
+	client := clientFor(*logsURL)
+	previous, err := tailLines(client, fetch)
+	if err != nil {
+		return err
+	}
+	start := len(previous) - *logsLines
+	if start < 0 {
+		start = 0
+	}
+	for _, line := range previous[start:] {
+		fmt.Println(line)
+	}
+	if !*logsFollow {
+		return nil
+	}
+
+	for {
+		time.Sleep(logsPollInterval)
+
+		current, err := tailLines(client, fetch)
+		if err != nil {
+			return err
+		}
+		for _, line := range unseenLines(previous, current) {
+			fmt.Println(line)
+		}
+		previous = current
+	}
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "run",
+		Usage:       "[--tags T] [--limit L] [--check] [--wait] [--json]",
+		Description: "Start a run of the daemon, optionally waiting for its outcome",
+		Flags:       runFlags,
+		Run:         runRunCommand,
+	})
+	registerSubcommand(subcommand{
+		Name:        "enable",
+		Usage:       "[--json]",
+		Description: "Let the daemon run again",
+		Flags:       enableFlags,
+		Run:         runEnableCommand,
+	})
+	registerSubcommand(subcommand{
+		Name:        "disable",
+		Usage:       "[--reason REASON] [--ttl DURATION] [--json]",
+		Description: "Stop the daemon from starting runs",
+		Flags:       disableFlags,
+		Run:         runDisableCommand,
+	})
+	registerSubcommand(subcommand{
+		Name:        "logs",
+		Usage:       "[-n LINES] [-f]",
+		Description: "Print the output of the current or last run of the daemon",
+		Flags:       logsFlags,
+		Run:         runLogsCommand,
+	})
+}
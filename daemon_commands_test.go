@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnseenLines(t *testing.T) {
+	assert.Equal(t, []string{"c", "d"}, unseenLines([]string{"a", "b"}, []string{"a", "b", "c", "d"}))
+	assert.Equal(t, []string{"d"}, unseenLines([]string{"a", "b", "c"}, []string{"b", "c", "d"}))
+	assert.Empty(t, unseenLines([]string{"a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{"x", "y"}, unseenLines([]string{"a", "b"}, []string{"x", "y"}))
+	assert.Equal(t, []string{"a"}, unseenLines(nil, []string{"a"}))
+}
+
+func TestRunCommandWait(t *testing.T) {
+	originalInterval := runPollInterval
+	runPollInterval = 0
+	defer func() { runPollInterval = originalInterval }()
+
+	polls := 0
+	var request runRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case httpPathRun:
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"run_id": "abc", "status": "queued", "status_url": "/runs/abc"}`))
+		case "/runs/abc":
+			polls++
+			if polls < 3 {
+				w.Write([]byte(`{"run_id": "abc", "status": "running"}`))
+				return
+			}
+			w.Write([]byte(`{"run_id": "abc", "status": "failed", "exit_code": 2, "changed_tasks": 1, "failed_tasks": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	assert.Nil(t, runFlags.Parse([]string{"--url", server.URL, "--tags", "web,db", "--check", "--wait", "--json"}))
+	defer runFlags.Parse([]string{"--url", "", "--tags", "", "--check=false", "--wait=false", "--json=false"})
+
+	err := runRunCommand(nil)
+	assert.EqualError(t, err, "run abc failed")
+	assert.Equal(t, []string{"web", "db"}, request.Tags)
+	assert.True(t, request.CheckMode)
+	assert.Equal(t, 3, polls)
+}
+
+func TestWriteRunRecord(t *testing.T) {
+	exitCode := 2
+	var out bytes.Buffer
+	writeRunRecord(&out, runRecord{ID: "abc", Status: runStatusFailed, ExitCode: &exitCode, FailedTasks: 1,
+		FailedHosts: []string{"web01"}}, false)
+
+	assert.Contains(t, out.String(), "Run abc failed")
+	assert.Contains(t, out.String(), "Exit code: 2")
+	assert.Contains(t, out.String(), "Tasks:     0 changed, 1 failed")
+	assert.Contains(t, out.String(), "Failed:    web01")
+}
+
+func TestDisableAndEnableCommands(t *testing.T) {
+	originalDisabled, originalReason := ansibleDisabled, disableReason
+	defer func() { ansibleDisabled, disableReason = originalDisabled, originalReason }()
+	ansibleDisabled = false
+	originalStateDir := viper.Get("state-dir")
+	defer viper.Set("state-dir", originalStateDir)
+	viper.Set("state-dir", t.TempDir())
+
+	server := httptest.NewServer(NewServer(func() {}).Handler)
+	defer server.Close()
+
+	assert.Nil(t, disableFlags.Parse([]string{"--url", server.URL, "--reason", "maintenance"}))
+	defer disableFlags.Parse([]string{"--url", "", "--reason", ""})
+	assert.Nil(t, runDisableCommand(nil))
+	assert.True(t, ansibleDisabled)
+	assert.Equal(t, "maintenance", disableReason)
+
+	assert.Nil(t, enableFlags.Parse([]string{"--url", server.URL}))
+	defer enableFlags.Parse([]string{"--url", ""})
+	assert.Nil(t, runEnableCommand(nil))
+	assert.False(t, ansibleDisabled)
+}
+
+func TestLogsCommand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, httpPathRunTail, r.URL.Path)
+		assert.Equal(t, "5", r.URL.Query().Get("lines"))
+		w.Write([]byte("TASK [a]\nok: [localhost]\n"))
+	}))
+	defer server.Close()
+
+	assert.Nil(t, logsFlags.Parse([]string{"--url", server.URL, "-n", "5"}))
+	defer logsFlags.Parse([]string{"--url", "", "-n", "200"})
+
+	lines, err := tailLines(clientFor(server.URL), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"TASK [a]", "ok: [localhost]"}, lines)
+	assert.Nil(t, runLogsCommand(nil))
+}
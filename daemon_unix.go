@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// daemonize starts a copy of the current process in a new session, detached from the terminal.
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "unable to find the path of the running executable")
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "unable to start daemon process")
+	}
+
+	fmt.Printf("%s started in the background with PID %d\n", appName, cmd.Process.Pid)
+	return nil
+}
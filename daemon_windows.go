@@ -0,0 +1,7 @@
+package main
+
+import "github.com/pkg/errors"
+
+func daemonize() error {
+	return errors.New("running in the background is not supported on Windows, use 'service install' instead")
+}
@@ -0,0 +1,111 @@
+// Decommissioning runs a teardown playbook once and then stops the puller for good
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// decommission runs the configured teardown playbook, disables any further runs and,
+// if configured, removes the puller's state but for the decommissioned flag.
+//
+// The puller is disabled before the teardown starts so that no scheduled run can re-apply
+// the configuration that is being torn down.
+func decommission() error {
+	disableReason = "host decommissioning"
+	ansibleDisable()
+
+	playbook := viper.GetString("decommission-playbook")
+	if playbook == "" {
+		playbook = viper.GetString("ansible-playbook")
+	}
+
+	logrus.Infoln("Decommissioning host with playbook ", playbook)
+	_, err := executeRun(runSpec{
+		Playbook: playbook,
+		Tags:     viper.GetStringSlice("decommission-tags"),
+		Trigger:  runTriggerDecommission,
+	})
+	if err != nil {
+		promDecommissioned.Set(-1)
+		logrus.Errorln("Decommission run failed: ", err)
+		return errors.Wrap(err, "decommission run failed")
+	}
+
+	return finishDecommission()
+}
+
+// finishDecommission records that the host has been decommissioned once the teardown succeeded, and reports it.
+func finishDecommission() error {
+	promDecommissioned.Set(1)
+	disableReason = "host decommissioned"
+	logrus.Infoln("Decommission run succeeded, further runs are disabled")
+	emitEvent(eventHostDecommissioned, pullerStateEvent{Reason: disableReason})
+	notify(notification{Event: notifyDecommissioned})
+
+	if viper.GetBool("decommission-purge-state") {
+		logrus.Infoln("Removing state directory ", stateDir())
+		if err := purgeStateDir(); err != nil {
+			return err
+		}
+	}
+
+	// Kept through the purge, so that the host doesn't apply its configuration again after a restart
+	return updateState(func(state *PullerState) {
+		state.Decommissioned = true
+	})
+}
+
+// purgeStateDir removes the contents of the state directory but the run lock and the PID file, which another process
+// may hold, and the state key that signed them.
+func purgeStateDir() error {
+	entries, err := ioutil.ReadDir(stateDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to list state directory")
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == runLockFileName || entry.Name() == pidFileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(stateDir(), entry.Name())); err != nil {
+			return errors.Wrap(err, "unable to remove state directory")
+		}
+	}
+	return removeStateKey()
+}
+
+// HandlerAnsibleDecommission starts decommissioning in the background, as the teardown may outlive the request.
+func HandlerAnsibleDecommission(w http.ResponseWriter, r *http.Request) {
+	go func() {
+		_ = decommission()
+	}()
+
+	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "decommission",
+		Description: "Run the teardown playbook once and disable further runs",
+		Run: func(args []string) error {
+			// A running daemon would go on scheduling runs during the teardown, it decommissions through its API
+			if err := acquirePidFile(); err != nil {
+				return errors.Wrap(err, "unable to decommission while the daemon runs")
+			}
+			defer releasePidFile()
+
+			defer flushEvents()
+			return decommission()
+		},
+	})
+}
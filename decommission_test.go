@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the types of the events sent to it.
+type recordingSink struct {
+	mutex sync.Mutex
+	types []string
+}
+
+func (s *recordingSink) Send(event cloudEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.types = append(s.types, event.Type)
+	return nil
+}
+
+func TestFinishDecommission(t *testing.T) {
+	defer withDisableState(t)()
+	withSettings(t, map[string]interface{}{"decommission-purge-state": true})
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"oncall": server.URL}})
+	sink := &recordingSink{}
+	originalSinks := eventSinks
+	eventSinks = []eventSink{sink}
+	defer func() { eventSinks = originalSinks }()
+
+	assert.Nil(t, updateState(func(state *PullerState) { state.LastArtifactChecksum = "abc" }))
+	assert.Nil(t, os.MkdirAll(filepath.Join(stateDir(), "history"), 0700))
+	assert.Nil(t, ioutil.WriteFile(runLockPath(), nil, 0600))
+	assert.Nil(t, ioutil.WriteFile(pidFilePath(), []byte("1\n"), 0644))
+
+	assert.Nil(t, finishDecommission())
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, notifyDecommissioned, received[0]["event"])
+	assert.Equal(t, []string{eventHostDecommissioned}, sink.types)
+
+	// Purged, but the host stays decommissioned after a restart, and other processes keep their lock and PID file
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, PullerState{Decommissioned: true}, state)
+	assert.NoDirExists(t, filepath.Join(stateDir(), "history"))
+	assert.FileExists(t, runLockPath())
+	assert.FileExists(t, pidFilePath())
+}
+
+func TestFinishDecommissionKeepsState(t *testing.T) {
+	defer withDisableState(t)()
+	withSettings(t, map[string]interface{}{"decommission-purge-state": false})
+	assert.Nil(t, updateState(func(state *PullerState) { state.LastArtifactChecksum = "abc" }))
+
+	assert.Nil(t, finishDecommission())
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.Decommissioned)
+	assert.Equal(t, "abc", state.LastArtifactChecksum)
+	assert.Equal(t, "host decommissioned", disableReason)
+}
+
+func TestFinishDecommissionRemovesStateKey(t *testing.T) {
+	defer withDisableState(t)()
+	keyFile := filepath.Join(t.TempDir(), "state.key")
+	withSettings(t, map[string]interface{}{"decommission-purge-state": true, "state-key-file": keyFile})
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+	runsFile := filepath.Join(stateDir(), runHistoryFileName)
+	assert.Nil(t, updateState(func(state *PullerState) { state.LastArtifactChecksum = "abc" }))
+	assert.Nil(t, writeStateFile(runsFile, []byte("[]")))
+	key, err := ioutil.ReadFile(keyFile)
+	assert.Nil(t, err)
+
+	assert.Nil(t, finishDecommission())
+	assert.Len(t, server.received(), 1)
+
+	// The decommissioned flag is signed with a new key, and the purged files aren't reported as removed
+	newKey, err := ioutil.ReadFile(keyFile)
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, newKey)
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, PullerState{Decommissioned: true}, state)
+	_, err = readStateFile(runsFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, server.received())
+}
+
+func TestDecommissionRefusedWhileDaemonRuns(t *testing.T) {
+	defer withDisableState(t)()
+	assert.Nil(t, ensureStateDir())
+	daemon, err := os.OpenFile(pidFilePath(), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer daemon.Close()
+	locked, err := tryLockFile(daemon)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	defer unlockFile(daemon)
+	reason := disableReason
+
+	err = runSubcommand([]string{"decommission"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to decommission while the daemon runs")
+	assert.Equal(t, reason, disableReason)
+}
+
+func TestDecommissionEndpointRequiresAuth(t *testing.T) {
+	restore, err := withHTTPAuth(t, "", map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, serveAPI("POST", httpPathAnsibleDecommission, "", nil).Code)
+	restore()
+
+	restore, err = withHTTPAuth(t, testAuthToken, map[string]string{})
+	defer restore()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("POST", httpPathAnsibleDecommission, "", nil).Code)
+}
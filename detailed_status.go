@@ -0,0 +1,176 @@
+// The detailed status of the daemon, grouped for monitoring and fleet dashboards
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// detailedStatus is the state of the daemon returned by GET /status. Unlike /ansible/status, its fields are grouped
+// by what they are about, and typed for consumers that decode it.
+type detailedStatus struct {
+	Hostname    string           `json:"hostname"`
+	Version     string           `json:"version"` // Of the puller
+	ConfigHash  string           `json:"config_hash"`
+	Artifact    artifactStatus   `json:"artifact"`
+	Control     controlStatus    `json:"control"`
+	LastRun     *runSummary      `json:"last_run"`      // null before the first run finished
+	InFlightRun *runSummary      `json:"in_flight_run"` // null unless a run is running
+	QueuedRuns  int              `json:"queued_runs"`
+	NextRunTime interface{}      `json:"next_run_time"`
+	Playbooks   []playbookStatus `json:"playbooks"`
+	Ansible     ansibleStatus    `json:"ansible"`
+	RunLock     runLockStatus    `json:"run_lock"`
+}
+
+// artifactStatus is the artifact, or bundle, the host was last configured from.
+type artifactStatus struct {
+	Checksum string       `json:"checksum"`         // MD5 of the artifact of the last run
+	Commit   string       `json:"commit,omitempty"` // Last pulled from git-url
+	Pin      *artifactPin `json:"pin"`              // null unless pinned
+}
+
+// controlStatus is whether the daemon runs the playbooks.
+type controlStatus struct {
+	Enabled        bool        `json:"enabled"`
+	Reason         string      `json:"reason,omitempty"` // Why it was disabled
+	Until          interface{} `json:"until"`            // When it enables itself again, null if never
+	Decommissioned bool        `json:"decommissioned"`
+}
+
+// runSummary is the gist of a record of the run history, see GET /runs/{id} for all of it.
+type runSummary struct {
+	ID                  string      `json:"run_id"`
+	Status              string      `json:"status"`
+	Playbook            string      `json:"playbook"`
+	Trigger             string      `json:"trigger"`
+	CheckMode           bool        `json:"check_mode"`
+	StartTime           interface{} `json:"start_time"`
+	EndTime             interface{} `json:"end_time"`
+	DurationSeconds     float64     `json:"duration_seconds"` // So far, for the in-flight run
+	ExitCode            *int        `json:"exit_code"`
+	ChangedTasks        int         `json:"changed_tasks"`
+	FailedTasks         int         `json:"failed_tasks"`
+	Error               string      `json:"error,omitempty"`
+	ErrorClass          string      `json:"error_class,omitempty"`
+	ConsecutiveFailures int         `json:"consecutive_failures,omitempty"` // Of the last run, including it
+}
+
+// ansibleStatus is what Ansible runs with.
+type ansibleStatus struct {
+	Executor       string `json:"executor"`
+	VenvPath       string `json:"venv_path,omitempty"`       // Of the current virtualenv, with the symlink of standbys resolved
+	PythonVersion  string `json:"python_version,omitempty"`  // Of the virtualenv, once built
+	AnsibleVersion string `json:"ansible_version,omitempty"` // ansible-core pinned by an upgrade
+	Image          string `json:"image,omitempty"`           // Of the container executor
+}
+
+func newRunSummary(record runRecord) *runSummary {
+	summary := &runSummary{
+		ID:           record.ID,
+		Status:       record.Status,
+		Playbook:     record.Playbook,
+		Trigger:      record.Trigger,
+		CheckMode:    record.CheckMode,
+		ExitCode:     record.ExitCode,
+		ChangedTasks: record.ChangedTasks,
+		FailedTasks:  record.FailedTasks,
+		Error:        record.Error,
+		ErrorClass:   record.ErrorClass,
+	}
+	if record.StartTime != nil {
+		summary.StartTime = statusTime(*record.StartTime)
+		end := time.Now()
+		if record.EndTime != nil {
+			end = *record.EndTime
+			summary.EndTime = statusTime(end)
+		}
+		summary.DurationSeconds = end.Sub(*record.StartTime).Seconds()
+	}
+	return summary
+}
+
+// currentAnsibleStatus returns what runs execute Ansible with, as far as it is known before the next run.
+func currentAnsibleStatus(state PullerState) ansibleStatus {
+	status := ansibleStatus{Executor: viper.GetString("executor"), AnsibleVersion: state.AnsibleVersion}
+	if status.Executor == executorContainer {
+		status.Image = viper.GetString("container-image")
+		return status
+	}
+	if viper.GetBool("venv-ephemeral") {
+		// Built for every run in its run directory
+		return status
+	}
+
+	path, _ := venvForRun(runSpec{})
+	status.VenvPath = venvDir(path)
+	var built venvFingerprint
+	if data, err := ioutil.ReadFile(filepath.Join(status.VenvPath, venvMarkerFileName)); err == nil && json.Unmarshal(data, &built) == nil {
+		status.PythonVersion = built.PythonVersion
+	}
+	return status
+}
+
+// currentDetailedStatus returns the status of the daemon.
+func currentDetailedStatus() detailedStatus {
+	state, err := loadState()
+	if err != nil {
+		httpLog.Warnln("Unable to load state for status: ", err)
+	}
+
+	status := detailedStatus{
+		Hostname:   hostname,
+		Version:    Version,
+		ConfigHash: currentConfigHash(),
+		Artifact: artifactStatus{
+			Checksum: state.LastArtifactChecksum,
+			Commit:   appliedGitCommit(),
+			Pin:      currentPin(),
+		},
+		Control: controlStatus{
+			Enabled:        !ansibleDisabled,
+			Reason:         disableReason,
+			Until:          statusTime(disabledUntil),
+			Decommissioned: state.Decommissioned,
+		},
+		NextRunTime: statusTime(earliestNextRun()),
+		Playbooks:   playbookStatuses(),
+		Ansible:     currentAnsibleStatus(state),
+		RunLock:     runsLock.status(),
+	}
+
+	// Newest first
+	for _, record := range runs.list() {
+		switch {
+		case record.Status == runStatusQueued:
+			status.QueuedRuns++
+		case record.Status == runStatusRunning && status.InFlightRun == nil:
+			status.InFlightRun = newRunSummary(record)
+		case record.EndTime != nil && status.LastRun == nil:
+			status.LastRun = newRunSummary(record)
+		}
+	}
+	if status.LastRun != nil && status.LastRun.Status == runStatusFailed {
+		status.LastRun.ConsecutiveFailures = state.ConsecutiveFailures
+	}
+
+	return status
+}
+
+// HandlerDetailedStatus returns the detailed status of the daemon.
+func HandlerDetailedStatus(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(currentDetailedStatus())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetailedStatus(t *testing.T) {
+	dir := t.TempDir()
+	venvPath := filepath.Join(dir, "venv")
+	withSettings(t, map[string]interface{}{
+		"state-dir":      filepath.Join(dir, "state"),
+		"state-key-file": "",
+		"executor":       executorVenv,
+		"venv-path":      venvPath,
+		"venv-ephemeral": false,
+	})
+	originalRuns := runs
+	runs = newRunRegistry(10)
+	defer func() { runs = originalRuns }()
+	originalDisabled, originalReason, originalNextRun := ansibleDisabled, disableReason, nextRunTime
+	defer func() {
+		ansibleDisabled, disableReason, nextRunTime = originalDisabled, originalReason, originalNextRun
+	}()
+
+	status := func() detailedStatus {
+		rr := serveAPI("GET", httpPathDetailedStatus, "", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		var received detailedStatus
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &received))
+		return received
+	}
+
+	// Before the first run
+	ansibleDisabled, disableReason, nextRunTime = false, "", time.Time{}
+	received := status()
+	assert.True(t, received.Control.Enabled)
+	assert.Nil(t, received.LastRun)
+	assert.Nil(t, received.InFlightRun)
+	assert.Nil(t, received.NextRunTime)
+	assert.Equal(t, executorVenv, received.Ansible.Executor)
+	assert.Equal(t, venvPath, received.Ansible.VenvPath)
+	assert.Empty(t, received.Ansible.PythonVersion)
+
+	// A failed run, one running and one queued, with a built virtualenv
+	assert.Nil(t, updateState(func(state *PullerState) {
+		state.LastArtifactChecksum = testMD5
+		state.ConsecutiveFailures = 2
+	}))
+	assert.Nil(t, os.MkdirAll(venvPath, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venvPath, venvMarkerFileName), []byte(`{"python_version":"Python 3.11.4"}`), 0644))
+	runs.started(runSpec{ID: "failed", Playbook: "site.yml", Trigger: "schedule"})
+	runs.finished("failed", runOutcome{Err: errors.New("boom"), ExitCode: 2})
+	runs.started(runSpec{ID: "running", Playbook: "site.yml", Trigger: "api"})
+	runs.queued(runSpec{ID: "queued", Playbook: "site.yml", Trigger: "api"})
+	ansibleDisabled, disableReason, nextRunTime = true, "maintenance", time.Now().Add(time.Hour)
+
+	received = status()
+	assert.Equal(t, testMD5, received.Artifact.Checksum)
+	assert.False(t, received.Control.Enabled)
+	assert.Equal(t, "maintenance", received.Control.Reason)
+	assert.NotNil(t, received.NextRunTime)
+	if assert.NotNil(t, received.LastRun) {
+		assert.Equal(t, "failed", received.LastRun.ID)
+		assert.Equal(t, runStatusFailed, received.LastRun.Status)
+		assert.Equal(t, "boom", received.LastRun.Error)
+		assert.Equal(t, 2, *received.LastRun.ExitCode)
+		assert.Equal(t, 2, received.LastRun.ConsecutiveFailures)
+		assert.NotNil(t, received.LastRun.EndTime)
+	}
+	if assert.NotNil(t, received.InFlightRun) {
+		assert.Equal(t, "running", received.InFlightRun.ID)
+		assert.Equal(t, "api", received.InFlightRun.Trigger)
+		assert.Nil(t, received.InFlightRun.EndTime)
+	}
+	assert.Equal(t, 1, received.QueuedRuns)
+	assert.Equal(t, "Python 3.11.4", received.Ansible.PythonVersion)
+}
@@ -0,0 +1,342 @@
+// Comparing this host with another one through their APIs: artifact versions, virtualenv packages and last runs
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// venvPackageList is the response of the venv packages endpoint.
+type venvPackageList struct {
+	VenvPath string   `json:"venv_path"`
+	Packages []string `json:"packages"` // As listed by pip freeze, sorted
+}
+
+// HandlerVenvPackages lists the packages installed in the virtualenv runs use.
+func HandlerVenvPackages(w http.ResponseWriter, r *http.Request) {
+	venvPath, _ := venvForRun(runSpec{})
+	if _, err := os.Stat(filepath.Join(venvPath, "bin", "python")); err != nil {
+		http.Error(w, fmt.Sprintf("virtualenv %s does not exist yet, it is created by the next run", venvPath), http.StatusNotFound)
+		return
+	}
+
+	packages, err := venvPackages(configuredVenv(venvPath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(venvPackageList{VenvPath: venvPath, Packages: packages})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// hostSnapshot is what a puller reports about its host, for comparison with another one.
+type hostSnapshot struct {
+	Status   daemonStatus
+	Packages map[string]string // Version by package name, nil if unavailable
+	Report   *RunReport        // Of the last run, nil if unavailable
+}
+
+// fetchHostSnapshot queries the puller behind client. Only its status is required: the packages and the last run
+// are left out with the reason, e.g. when no run completed yet.
+func fetchHostSnapshot(client *daemonClient) (hostSnapshot, []string, error) {
+	var snapshot hostSnapshot
+	var unavailable []string
+
+	status, _, err := client.status()
+	if err != nil {
+		return snapshot, nil, err
+	}
+	snapshot.Status = status
+
+	if body, err := client.get(httpPathVenvPackages); err != nil {
+		unavailable = append(unavailable, fmt.Sprintf("packages of %s: %s", status.Hostname, err))
+	} else {
+		var list venvPackageList
+		if err := json.Unmarshal(body, &list); err != nil {
+			return snapshot, nil, errors.Wrap(err, "unable to parse the packages")
+		}
+		snapshot.Packages = map[string]string{}
+		for _, requirement := range list.Packages {
+			name, version := splitRequirement(requirement)
+			snapshot.Packages[name] = version
+		}
+	}
+
+	if body, err := client.get(httpPathRunReport); err != nil {
+		unavailable = append(unavailable, fmt.Sprintf("last run of %s: %s", status.Hostname, err))
+	} else {
+		var report RunReport
+		if err := json.Unmarshal(body, &report); err != nil {
+			return snapshot, nil, errors.Wrap(err, "unable to parse the run report")
+		}
+		snapshot.Report = &report
+	}
+
+	return snapshot, unavailable, nil
+}
+
+// splitRequirement splits a line of pip freeze into the package name, normalized as pip compares names, and the version or reference it
+// is installed from.
+func splitRequirement(requirement string) (string, string) {
+	for _, separator := range []string{"==", " @ "} {
+		if parts := strings.SplitN(requirement, separator, 2); len(parts) == 2 {
+			return normalizePackageName(parts[0]), strings.TrimSpace(parts[1])
+		}
+	}
+	return normalizePackageName(requirement), ""
+}
+
+// valueDifference is a setting or result that differs between the local and the remote host.
+type valueDifference struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// packageDifference is a package installed in a different version, or on only one of the hosts.
+type packageDifference struct {
+	Name   string `json:"name"`
+	Local  string `json:"local"`  // Empty if not installed
+	Remote string `json:"remote"` // Empty if not installed
+}
+
+// hostDiff is how two hosts differ. Task differences have the local host as baseline and the remote one as candidate.
+type hostDiff struct {
+	LocalHost   string                     `json:"local_host"`
+	RemoteHost  string                     `json:"remote_host"`
+	Differences map[string]valueDifference `json:"differences"` // By what differs, e.g. artifact or last_run_recap
+	Packages    []packageDifference        `json:"packages"`
+	Tasks       []taskDifference           `json:"tasks"`
+	Unavailable []string                   `json:"unavailable,omitempty"` // What could not be compared, and why
+}
+
+// formatRecap returns the play recap summed over the hosts of a run.
+func formatRecap(report RunReport) string {
+	totals := report.totals()
+	return fmt.Sprintf("ok=%d changed=%d failed=%d skipped=%d unreachable=%d",
+		totals.Ok, totals.Changed, totals.Failures, totals.Skipped, totals.Unreachable)
+}
+
+// diffHosts compares the snapshots of two hosts.
+func diffHosts(local, remote hostSnapshot) hostDiff {
+	diff := hostDiff{
+		LocalHost:   local.Status.Hostname,
+		RemoteHost:  remote.Status.Hostname,
+		Differences: map[string]valueDifference{},
+		Packages:    []packageDifference{},
+		Tasks:       []taskDifference{},
+	}
+	compare := func(name, localValue, remoteValue string) {
+		if localValue != remoteValue {
+			diff.Differences[name] = valueDifference{Local: localValue, Remote: remoteValue}
+		}
+	}
+
+	compare("artifact", local.Status.ArtifactChecksum, remote.Status.ArtifactChecksum)
+	compare("puller_version", local.Status.Version, remote.Status.Version)
+	compare("last_run_outcome", local.Status.LastRunOutcome, remote.Status.LastRunOutcome)
+
+	if local.Packages != nil && remote.Packages != nil {
+		names := []string{}
+		for name := range local.Packages {
+			names = append(names, name)
+		}
+		for name := range remote.Packages {
+			if _, ok := local.Packages[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if local.Packages[name] != remote.Packages[name] {
+				diff.Packages = append(diff.Packages, packageDifference{Name: name, Local: local.Packages[name], Remote: remote.Packages[name]})
+			}
+		}
+	}
+
+	if local.Report != nil && remote.Report != nil {
+		compare("last_run_playbook", local.Report.Playbook, remote.Report.Playbook)
+		compare("last_run_recap", formatRecap(*local.Report), formatRecap(*remote.Report))
+		diff.Tasks = diffRunReports(*local.Report, sameHostReport(*remote.Report, *local.Report))
+	}
+
+	return diff
+}
+
+// sameHostReport returns report with its only host renamed to the only host of like, so that the runs of two
+// pullers on their own host compare task by task whatever their inventories name the host.
+func sameHostReport(report, like RunReport) RunReport {
+	if len(report.Hosts) != 1 || len(like.Hosts) != 1 {
+		return report
+	}
+	var from, to string
+	for host := range report.Hosts {
+		from = host
+	}
+	for host := range like.Hosts {
+		to = host
+	}
+	if from == to {
+		return report
+	}
+
+	renamed := report
+	renamed.Hosts = map[string]AnsibleNodeStatus{to: report.Hosts[from]}
+	renamed.Tasks = make([]TaskReport, len(report.Tasks))
+	for i, task := range report.Tasks {
+		if status, ok := task.Hosts[from]; ok {
+			task.Hosts = map[string]string{to: status}
+		}
+		renamed.Tasks[i] = task
+	}
+	return renamed
+}
+
+// writeHostDiff renders how two hosts differ.
+func writeHostDiff(w io.Writer, diff hostDiff, c colorizer) {
+	fmt.Fprintf(w, "%s %s (local) and %s (remote)\n", c.paint(colorBold, "Comparing"), diff.LocalHost, diff.RemoteHost)
+
+	if len(diff.Differences) == 0 && len(diff.Packages) == 0 && len(diff.Tasks) == 0 {
+		fmt.Fprintln(w, c.paint(colorGreen, "  No differences"))
+	}
+
+	names := make([]string, 0, len(diff.Differences))
+	for name := range diff.Differences {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		difference := diff.Differences[name]
+		fmt.Fprintf(w, "  %s:\n    local:  %s\n    remote: %s\n", strings.Replace(name, "_", " ", -1), valueOr(difference.Local, "none"), valueOr(difference.Remote, "none"))
+	}
+
+	if len(diff.Packages) > 0 {
+		fmt.Fprintf(w, "  Packages (%d differ):\n", len(diff.Packages))
+		for _, pkg := range diff.Packages {
+			fmt.Fprintf(w, "    %-30s %s -> %s\n", pkg.Name, valueOr(pkg.Local, "not installed"), valueOr(pkg.Remote, "not installed"))
+		}
+	}
+
+	if len(diff.Tasks) > 0 {
+		fmt.Fprintf(w, "  Tasks of the last run (%d differ):\n", len(diff.Tasks))
+		for _, task := range diff.Tasks {
+			fmt.Fprintf(w, "    %s: %s: %s -> %s\n", task.Play, task.Task, orNone(task.Baseline), orNone(task.Candidate))
+		}
+	}
+
+	for _, reason := range diff.Unavailable {
+		fmt.Fprintf(w, "  %s %s\n", c.paint(colorYellow, "Not compared:"), reason)
+	}
+}
+
+// valueOr returns value, or fallback if it is empty.
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// newRemoteClient returns a client of the puller of another host, which is only reached over https. It authenticates
+// with the token in tokenFile if set, never with that of the local daemon, and verifies the certificate of the host
+// against caFile, or the system CAs if empty.
+func newRemoteClient(remoteURL, caFile, tokenFile string) (*daemonClient, error) {
+	if !strings.HasPrefix(remoteURL, "https://") {
+		return nil, errors.Errorf("the puller of the other host must be reached over https, not %s", remoteURL)
+	}
+
+	client := newDaemonClient(remoteURL)
+	client.token = ""
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read --remote-token-file")
+		}
+		client.token = strings.TrimSpace(string(token))
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read --ca-cert")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	client.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return client, nil
+}
+
+var (
+	diffHostFlags = pflag.NewFlagSet("diff-host", pflag.ContinueOnError)
+	diffHostCA    = diffHostFlags.String("ca-cert", "", "CA certificates, PEM encoded, to verify the remote puller against. The system CAs by default")
+	diffHostToken = diffHostFlags.String("remote-token-file", "", "File with the token of the remote puller's API, if it requires one")
+	diffHostJSON  = diffHostFlags.Bool("json", false, "Print the differences as JSON for use in scripts")
+	diffHostURL   = daemonURLFlag(diffHostFlags)
+)
+
+func runDiffHostCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("diff-host takes the URL of the puller of the other host, e.g. https://web-2:31836")
+	}
+
+	remoteClient, err := newRemoteClient(args[0], *diffHostCA, *diffHostToken)
+	if err != nil {
+		return err
+	}
+	local, localUnavailable, err := fetchHostSnapshot(clientFor(*diffHostURL))
+	if err != nil {
+		return errors.Wrap(err, "unable to query the local puller")
+	}
+	remote, remoteUnavailable, err := fetchHostSnapshot(remoteClient)
+	if err != nil {
+		return errors.Wrapf(err, "unable to query the puller at %s", redact(args[0]))
+	}
+
+	diff := diffHosts(local, remote)
+	diff.Unavailable = append(localUnavailable, remoteUnavailable...)
+	if *diffHostJSON {
+		data, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	}
+
+	writeHostDiff(os.Stdout, diff, useColor())
+	return nil
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "diff-host",
+		Usage:       "[--ca-cert FILE] [--json] URL",
+		Description: "Compare artifact, packages and last run with the puller of another host",
+		Flags:       diffHostFlags,
+		Run:         runDiffHostCommand,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitRequirement(t *testing.T) {
+	name, version := splitRequirement("Jinja2==3.1.2")
+	assert.Equal(t, "jinja2", name)
+	assert.Equal(t, "3.1.2", version)
+
+	name, version = splitRequirement("my_collection @ file:///tmp/my_collection")
+	assert.Equal(t, "my-collection", name)
+	assert.Equal(t, "file:///tmp/my_collection", version)
+}
+
+func TestDiffHosts(t *testing.T) {
+	local := hostSnapshot{
+		Status:   daemonStatus{Hostname: "web-1", ArtifactChecksum: "aaa", Version: "v1", LastRunOutcome: runOutcomeSuccess},
+		Packages: map[string]string{"ansible-core": "2.15.0", "jmespath": "1.0.1", "pyyaml": "6.0"},
+		Report: &RunReport{
+			Playbook: "site.yml",
+			Hosts:    map[string]AnsibleNodeStatus{"localhost": {Ok: 2}},
+			Tasks: []TaskReport{
+				{Play: "web", Name: "nginx", Hosts: map[string]string{"localhost": "ok"}},
+				{Play: "web", Name: "config", Hosts: map[string]string{"localhost": "ok"}},
+			},
+		},
+	}
+	remote := hostSnapshot{
+		Status:   daemonStatus{Hostname: "web-2", ArtifactChecksum: "bbb", Version: "v1", LastRunOutcome: runOutcomeSuccess},
+		Packages: map[string]string{"ansible-core": "2.16.1", "pyyaml": "6.0", "requests": "2.31.0"},
+		Report: &RunReport{
+			Playbook: "site.yml",
+			Hosts:    map[string]AnsibleNodeStatus{"web-2": {Ok: 1, Changed: 1}},
+			Tasks: []TaskReport{
+				{Play: "web", Name: "nginx", Hosts: map[string]string{"web-2": "ok"}},
+				{Play: "web", Name: "config", Hosts: map[string]string{"web-2": "changed"}},
+			},
+		},
+	}
+
+	diff := diffHosts(local, remote)
+	assert.Equal(t, map[string]valueDifference{
+		"artifact":       {Local: "aaa", Remote: "bbb"},
+		"last_run_recap": {Local: "ok=2 changed=0 failed=0 skipped=0 unreachable=0", Remote: "ok=1 changed=1 failed=0 skipped=0 unreachable=0"},
+	}, diff.Differences)
+	assert.Equal(t, []packageDifference{
+		{Name: "ansible-core", Local: "2.15.0", Remote: "2.16.1"},
+		{Name: "jmespath", Local: "1.0.1"},
+		{Name: "requests", Remote: "2.31.0"},
+	}, diff.Packages)
+	// The hosts each run on compare with each other, whatever their inventories name them
+	assert.Equal(t, []taskDifference{{Play: "web", Task: "config", Host: "localhost", Baseline: "ok", Candidate: "changed"}}, diff.Tasks)
+
+	var out bytes.Buffer
+	writeHostDiff(&out, diff, false)
+	assert.Contains(t, out.String(), "Comparing web-1 (local) and web-2 (remote)")
+	assert.Contains(t, out.String(), "  artifact:\n    local:  aaa\n    remote: bbb\n")
+	assert.Contains(t, out.String(), "jmespath")
+	assert.Contains(t, out.String(), "1.0.1 -> not installed")
+	assert.Contains(t, out.String(), "    web: config: ok -> changed\n")
+
+	out.Reset()
+	writeHostDiff(&out, diffHosts(local, local), false)
+	assert.Contains(t, out.String(), "No differences")
+}
+
+func TestRunDiffHostCommand(t *testing.T) {
+	dir := t.TempDir()
+	localToken, remoteToken := filepath.Join(dir, "local-token"), filepath.Join(dir, "remote-token")
+	assert.Nil(t, ioutil.WriteFile(localToken, []byte("local-secret\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(remoteToken, []byte("remote-secret\n"), 0600))
+	withSettings(t, map[string]interface{}{"http-auth-token-file": localToken})
+
+	var remoteAuth string
+	handler := func(hostname, artifact string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if hostname == "web-2" {
+				remoteAuth = r.Header.Get("Authorization")
+			}
+			switch r.URL.Path {
+			case httpPathStatus:
+				json.NewEncoder(w).Encode(map[string]string{"hostname": hostname, "artifact_checksum": artifact})
+			case httpPathVenvPackages:
+				w.Write([]byte(`{"venv_path": "/venv", "packages": ["ansible-core==2.15.0"]}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}
+	}
+	local, remote := httptest.NewServer(handler("web-1", "aaa")), httptest.NewTLSServer(handler("web-2", "bbb"))
+	defer local.Close()
+	defer remote.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: remote.Certificate().Raw}), 0644))
+
+	assert.Nil(t, diffHostFlags.Parse([]string{"--url", local.URL, "--json", "--ca-cert", caFile, "--remote-token-file", remoteToken}))
+	defer diffHostFlags.Parse([]string{"--url", "", "--json=false", "--ca-cert", "", "--remote-token-file", ""})
+
+	stdout := os.Stdout
+	read, write, err := os.Pipe()
+	assert.Nil(t, err)
+	os.Stdout = write
+	err = runDiffHostCommand([]string{remote.URL})
+	os.Stdout = stdout
+	write.Close()
+	assert.Nil(t, err)
+	output, _ := ioutil.ReadAll(read)
+
+	var diff hostDiff
+	assert.Nil(t, json.Unmarshal(output, &diff))
+	assert.Equal(t, valueDifference{Local: "aaa", Remote: "bbb"}, diff.Differences["artifact"])
+	assert.Empty(t, diff.Packages)
+	assert.Len(t, diff.Unavailable, 2)
+	assert.True(t, strings.HasPrefix(diff.Unavailable[0], "last run of web-1: "))
+	// Only the token of the other puller is sent to it
+	assert.Equal(t, "Bearer remote-secret", remoteAuth)
+
+	assert.Nil(t, diffHostFlags.Parse([]string{"--remote-token-file", ""}))
+	client, err := newRemoteClient(remote.URL, caFile, "")
+	assert.Nil(t, err)
+	assert.Empty(t, client.token)
+	_, err = newRemoteClient(local.URL, "", "")
+	assert.EqualError(t, err, "the puller of the other host must be reached over https, not "+local.URL)
+
+	assert.EqualError(t, runDiffHostCommand(nil), "diff-host takes the URL of the puller of the other host, e.g. https://web-2:31836")
+}
+
+func TestHandlerVenvPackages(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+	dir := t.TempDir()
+	venv := filepath.Join(dir, "venv")
+	withSettings(t, map[string]interface{}{"state-dir": dir, "venv-path": venv})
+
+	req, _ := http.NewRequest("GET", httpPathVenvPackages, strings.NewReader(""))
+	rr := httptest.NewRecorder()
+	HandlerVenvPackages(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "python"), nil, 0755))
+	pip := "#!/bin/sh\nprintf 'pip==23.0\\nansible-core==2.15.0\\n'\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "pip"), []byte(pip), 0755))
+
+	rr = httptest.NewRecorder()
+	HandlerVenvPackages(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"venv_path": "`+venv+`", "packages": ["ansible-core==2.15.0", "pip==23.0"]}`, rr.Body.String())
+}
@@ -0,0 +1,137 @@
+// Disabling the puller on request: with a reason, optionally for a limited time, and kept across restarts
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Reason given when the puller enables itself again
+	disableExpiredReason = "disable expired"
+	// Reason given when --start-disabled=false enables a puller that was disabled before the restart
+	startEnabledReason = "started with start-disabled=false"
+)
+
+var (
+	disableMutex  sync.Mutex
+	disabledUntil time.Time   // When the puller enables itself again, zero if it stays disabled
+	disableTimer  *time.Timer // Enables the puller at disabledUntil
+)
+
+// disablePuller disables the puller for reason, enabling it again after ttl unless ttl is 0, and records it in the
+// state so it stays disabled across restarts.
+func disablePuller(reason string, ttl time.Duration) {
+	disableMutex.Lock()
+	defer disableMutex.Unlock()
+
+	var until time.Time
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+	}
+	setDisabled(reason, until)
+
+	if err := updateState(func(state *PullerState) {
+		state.Disabled = true
+		state.DisableReason = reason
+		state.DisabledUntil = until
+	}); err != nil {
+		logrus.Errorln("Unable to persist the disabled state, the puller is enabled again on restart: ", err)
+	}
+	emitEvent(eventPullerDisabled, pullerStateEvent{Reason: reason, Until: optionalTime(until)})
+	notify(notification{Event: notifyDisabled, Reason: reason, Until: optionalTime(until)})
+}
+
+// enablePuller enables the puller and clears the disabled state, reason saying why if it wasn't on request.
+func enablePuller(reason string) {
+	disableMutex.Lock()
+	defer disableMutex.Unlock()
+
+	enable(reason)
+}
+
+func enable(reason string) {
+	if disableTimer != nil {
+		disableTimer.Stop()
+		disableTimer = nil
+	}
+	disableReason = ""
+	disabledUntil = time.Time{}
+	promDisabledUntil.Set(0)
+	ansibleEnable()
+
+	if err := updateState(func(state *PullerState) {
+		state.Disabled = false
+		state.DisableReason = ""
+		state.DisabledUntil = time.Time{}
+	}); err != nil {
+		logrus.Errorln("Unable to persist the enabled state: ", err)
+	}
+	emitEvent(eventPullerEnabled, pullerStateEvent{Reason: reason})
+}
+
+// setDisabled disables the puller in memory until until, if set. Called with disableMutex held.
+func setDisabled(reason string, until time.Time) {
+	if disableTimer != nil {
+		disableTimer.Stop()
+		disableTimer = nil
+	}
+
+	disableReason = reason
+	disabledUntil = until
+	ansibleDisable()
+
+	if until.IsZero() {
+		promDisabledUntil.Set(0)
+		return
+	}
+	promDisabledUntil.Set(float64(until.Unix()))
+	disableTimer = time.AfterFunc(time.Until(until), func() {
+		disableMutex.Lock()
+		defer disableMutex.Unlock()
+
+		// Disabled again since, with a different expiry
+		if !disabledUntil.Equal(until) {
+			return
+		}
+		logrus.Infoln("Disable expired, enabling the puller again")
+		enable(disableExpiredReason)
+	})
+}
+
+// restoreDisabled disables the puller again if it was disabled before a restart, unless that has expired since.
+// A --start-disabled given on the command line takes precedence over the state.
+func restoreDisabled(state PullerState) {
+	if pflag.CommandLine.Changed("start-disabled") {
+		if !viper.GetBool("start-disabled") && state.Disabled {
+			enablePuller(startEnabledReason)
+		}
+		return
+	}
+	if !state.Disabled {
+		return
+	}
+
+	if !state.DisabledUntil.IsZero() && !state.DisabledUntil.After(time.Now()) {
+		enablePuller(disableExpiredReason)
+		return
+	}
+
+	disableMutex.Lock()
+	defer disableMutex.Unlock()
+	setDisabled(state.DisableReason, state.DisabledUntil)
+	logrus.Infof("Puller stays disabled since before the restart: %s", state.DisableReason)
+}
+
+// optionalTime returns nil for the zero time, for JSON fields left out when unset.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withDisableState sets a new state directory and restores the disabled state of the puller afterwards.
+func withDisableState(t *testing.T) func() {
+	originalStateDir := viper.Get("state-dir")
+	viper.Set("state-dir", t.TempDir())
+	originalDisabled, originalReason := ansibleDisabled, disableReason
+
+	return func() {
+		disableMutex.Lock()
+		if disableTimer != nil {
+			disableTimer.Stop()
+			disableTimer = nil
+		}
+		disabledUntil = time.Time{}
+		disableMutex.Unlock()
+
+		ansibleDisabled, disableReason = originalDisabled, originalReason
+		viper.Set("state-dir", originalStateDir)
+	}
+}
+
+func TestDisablePersists(t *testing.T) {
+	defer withDisableState(t)()
+
+	disablePuller("maintenance", time.Hour)
+	assert.True(t, ansibleDisabled)
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.Disabled)
+	assert.Equal(t, "maintenance", state.DisableReason)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), state.DisabledUntil, time.Minute)
+
+	// As after a restart
+	ansibleDisabled, disableReason, disabledUntil = false, "", time.Time{}
+	restoreDisabled(state)
+	assert.True(t, ansibleDisabled)
+	assert.Equal(t, "maintenance", disableReason)
+	assert.Equal(t, state.DisabledUntil, disabledUntil)
+
+	enablePuller("")
+	assert.False(t, ansibleDisabled)
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.False(t, state.Disabled)
+	assert.True(t, state.DisabledUntil.IsZero())
+}
+
+func TestDisableExpires(t *testing.T) {
+	defer withDisableState(t)()
+
+	disablePuller("short", 50*time.Millisecond)
+	assert.True(t, ansibleDisabled)
+	assert.Eventually(t, func() bool {
+		disableMutex.Lock()
+		defer disableMutex.Unlock()
+		return !ansibleDisabled
+	}, 5*time.Second, 10*time.Millisecond)
+
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.False(t, state.Disabled)
+
+	// Expired while the puller was down
+	restoreDisabled(PullerState{Disabled: true, DisableReason: "old", DisabledUntil: time.Now().Add(-time.Minute)})
+	assert.False(t, ansibleDisabled)
+}
+
+func TestDisableEndpointTTL(t *testing.T) {
+	defer withDisableState(t)()
+	ansibleDisabled = false
+
+	rr := serveAPI("POST", httpPathAnsibleDisable+"?disable-ttl=forever", "", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.False(t, ansibleDisabled)
+
+	rr = serveAPI("POST", httpPathAnsibleDisable+"?disable-reason=upgrade&disable-ttl=2h", "", nil)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.True(t, ansibleDisabled)
+	assert.Equal(t, "upgrade", disableReason)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), disabledUntil, time.Minute)
+}
+
+func TestRestoreDisabledStartDisabled(t *testing.T) {
+	defer withDisableState(t)()
+	flag := pflag.CommandLine.Lookup("start-disabled")
+	original := flag.Value.String()
+	defer func() {
+		flag.Value.Set(original)
+		flag.Changed = false
+	}()
+
+	disablePuller("maintenance", 0)
+	state, err := loadState()
+	assert.Nil(t, err)
+
+	// Enabled on request at the restart
+	assert.Nil(t, pflag.CommandLine.Set("start-disabled", "false"))
+	restoreDisabled(state)
+	assert.False(t, ansibleDisabled)
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.False(t, state.Disabled)
+
+	// Disabled on request whatever the state says
+	assert.Nil(t, pflag.CommandLine.Set("start-disabled", "true"))
+	ansibleDisable()
+	restoreDisabled(state)
+	assert.True(t, ansibleDisabled)
+}
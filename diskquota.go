@@ -0,0 +1,252 @@
+// Quota on the disk space the puller takes with its state, caches, virtualenv and logs, evicting what can be
+// rebuilt to stay within it, so that it never fills the filesystem it shares with the host
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Areas of the disk space taken by the puller, as labelled in promDiskUsage
+const (
+	diskAreaState      = "state"      // state-dir, without the areas below kept in it
+	diskAreaArtifacts  = "artifacts"  // artifact-cache-dir
+	diskAreaGalaxy     = "galaxy"     // galaxy-cache-dir
+	diskAreaWheelhouse = "wheelhouse" // venv-wheelhouse
+	diskAreaVenv       = "venv"       // venv-path
+	diskAreaLogs       = "logs"       // Log files of the puller in log-dir
+)
+
+var diskAreas = []string{diskAreaState, diskAreaArtifacts, diskAreaGalaxy, diskAreaWheelhouse, diskAreaVenv, diskAreaLogs}
+
+// Resource runs are skipped for while the puller takes more than disk-quota
+const resourceDiskQuota = "disk_quota"
+
+// Log files the puller writes into log-dir
+var pullerLogFiles = []string{appName + ".log", "ansible-run-output.log", "ansible-run-error.log"}
+
+// diskAreaDirs returns the directory of each area kept in a directory of its own.
+func diskAreaDirs() map[string]string {
+	return map[string]string{
+		diskAreaState:      stateDir(),
+		diskAreaArtifacts:  artifactCacheDir(),
+		diskAreaGalaxy:     galaxyCacheDir(),
+		diskAreaWheelhouse: viper.GetString("venv-wheelhouse"),
+		diskAreaVenv:       venvDir(viper.GetString("venv-path")),
+	}
+}
+
+// dirSize returns the size of the files under dir, skipping the directories in skip. Files that vanish or can't
+// be read while walking are not counted.
+func dirSize(dir string, skip map[string]bool) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && path != dir && skip[filepath.Clean(path)] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// diskUsage returns the bytes taken by each area, and records them in promDiskUsage. An area nested in another one,
+// like the artifact cache in state-dir by default, is only counted as itself.
+func diskUsage() map[string]int64 {
+	dirs := diskAreaDirs()
+	usage := map[string]int64{}
+	for area, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		skip := map[string]bool{}
+		for other, otherDir := range dirs {
+			if other != area && otherDir != "" {
+				skip[filepath.Clean(otherDir)] = true
+			}
+		}
+		usage[area] = dirSize(dir, skip)
+	}
+	for _, name := range pullerLogFiles {
+		if info, err := os.Stat(filepath.Join(viper.GetString("log-dir"), name)); err == nil {
+			usage[diskAreaLogs] += info.Size()
+		}
+	}
+
+	for _, area := range diskAreas {
+		promDiskUsage.WithLabelValues(area).Set(float64(usage[area]))
+	}
+	return usage
+}
+
+func totalDiskUsage(usage map[string]int64) int64 {
+	var total int64
+	for _, size := range usage {
+		total += size
+	}
+	return total
+}
+
+// diskEviction frees disk space by removing something runs can do without or rebuild, returning the bytes freed.
+type diskEviction struct {
+	name  string
+	evict func(excess int64) (int64, error)
+}
+
+// diskEvictions are tried in order until the puller is within disk-quota: the cheapest to do without first. The
+// state, the virtualenv and the log of the puller itself are never evicted.
+var diskEvictions = []diskEviction{
+	{"cached artifacts", func(excess int64) (int64, error) { return artifacts.shrink(excess) }},
+	{"ansible output logs", evictRunOutputLogs},
+	{"run history logs", evictRunHistoryLogs},
+	{"wheelhouse", func(int64) (int64, error) { return removeDirContents(viper.GetString("venv-wheelhouse")) }},
+	{"galaxy cache", evictGalaxyCache},
+}
+
+// enforceDiskQuota evicts until the puller takes no more than disk-quota, if set, and returns a lowResourceError if
+// it still takes more. Runs must hold the run lock, so that nothing is evicted from under a run.
+func enforceDiskQuota() error {
+	quota := int64(viper.GetInt("disk-quota")) * 1024 * 1024
+	usage := diskUsage()
+	if quota <= 0 {
+		return nil
+	}
+
+	total := totalDiskUsage(usage)
+	if total <= quota {
+		return nil
+	}
+	for _, eviction := range diskEvictions {
+		freed, err := eviction.evict(total - quota)
+		if err != nil {
+			logrus.Warnf("Unable to evict the %s to stay within disk-quota: %v", eviction.name, err)
+		}
+		if freed > 0 {
+			logrus.Infof("Evicted %d bytes of %s to stay within disk-quota", freed, eviction.name)
+			total = totalDiskUsage(diskUsage())
+		}
+		if total <= quota {
+			return nil
+		}
+	}
+
+	return diskQuotaError(total, quota)
+}
+
+// checkDiskQuota returns a lowResourceError if the puller would take more than disk-quota even after evicting all
+// it can, without evicting anything: runs evict once they hold the run lock.
+func checkDiskQuota() error {
+	quota := int64(viper.GetInt("disk-quota")) * 1024 * 1024
+	if quota <= 0 {
+		return nil
+	}
+
+	usage := diskUsage()
+	kept := totalDiskUsage(usage) - usage[diskAreaArtifacts] - usage[diskAreaWheelhouse] - runOutputLogsSize()
+	if !viper.GetBool("galaxy-offline") {
+		kept -= usage[diskAreaGalaxy]
+	}
+	if kept > quota {
+		return diskQuotaError(kept, quota)
+	}
+	return nil
+}
+
+func diskQuotaError(total, quota int64) error {
+	return lowResourceError{resourceDiskQuota, errors.Errorf("the puller takes %d MB of disk, above disk-quota of %d MB "+
+		"after evicting all it can", total/1024/1024, quota/1024/1024)}
+}
+
+// Log files in log-dir with the output of the last ansible-playbook run
+var runOutputLogFiles = pullerLogFiles[1:]
+
+func runOutputLogsSize() int64 {
+	var size int64
+	for _, name := range runOutputLogFiles {
+		if info, err := os.Stat(filepath.Join(viper.GetString("log-dir"), name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// evictRunOutputLogs empties the output of the last ansible-playbook run written into log-dir.
+func evictRunOutputLogs(int64) (int64, error) {
+	var freed int64
+	for _, name := range runOutputLogFiles {
+		path := filepath.Join(viper.GetString("log-dir"), name)
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		if err := os.Truncate(path, 0); err != nil {
+			return freed, err
+		}
+		freed += info.Size()
+	}
+
+	return freed, nil
+}
+
+// evictRunHistoryLogs drops the output lines kept in the run history, but those of the latest run.
+func evictRunHistoryLogs(int64) (int64, error) {
+	if runs.path == "" {
+		return 0, nil
+	}
+	before, err := os.Stat(runs.path)
+	if err != nil {
+		return 0, nil
+	}
+
+	runs.dropLogs()
+	after, err := os.Stat(runs.path)
+	if err != nil || after.Size() >= before.Size() {
+		return 0, nil
+	}
+	return before.Size() - after.Size(), nil
+}
+
+// evictGalaxyCache removes the installed collections and roles, unless galaxy-offline needs them.
+func evictGalaxyCache(int64) (int64, error) {
+	if viper.GetBool("galaxy-offline") {
+		return 0, nil
+	}
+	return removeDirContents(galaxyCacheDir())
+}
+
+// removeDirContents removes everything in dir, keeping dir itself, and returns the bytes freed.
+func removeDirContents(dir string) (int64, error) {
+	if dir == "" {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		size := dirSize(path, nil)
+		if err := os.RemoveAll(path); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+
+	return freed, nil
+}
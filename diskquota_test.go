@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withDiskAreas points every area of the disk quota to a new directory, the artifact cache in state-dir.
+func withDiskAreas(t *testing.T) {
+	keys := []string{"state-dir", "artifact-cache-dir", "artifact-cache-versions", "artifact-cache-size",
+		"galaxy-cache-dir", "venv-wheelhouse", "venv-path", "log-dir", "disk-quota"}
+	for _, key := range keys {
+		key, original := key, viper.Get(key)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+
+	viper.Set("state-dir", t.TempDir())
+	viper.Set("artifact-cache-dir", "")
+	viper.Set("artifact-cache-versions", 5)
+	viper.Set("artifact-cache-size", 0)
+	viper.Set("galaxy-cache-dir", "")
+	viper.Set("venv-wheelhouse", t.TempDir())
+	viper.Set("venv-path", t.TempDir())
+	viper.Set("log-dir", t.TempDir())
+}
+
+func writeKB(t *testing.T, path string, kB int) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Nil(t, ioutil.WriteFile(path, make([]byte, kB*1024), 0600))
+}
+
+func TestDiskUsage(t *testing.T) {
+	withDiskAreas(t)
+
+	writeKB(t, filepath.Join(stateDir(), "state.json"), 1)
+	storeAged(t, make([]byte, 2*1024), 0)
+	writeKB(t, filepath.Join(galaxyCacheDir(), "ansible_collections", "community", "MANIFEST.json"), 3)
+	writeKB(t, filepath.Join(viper.GetString("venv-wheelhouse"), "six.whl"), 4)
+	writeKB(t, filepath.Join(viper.GetString("venv-path"), "bin", "python"), 5)
+	writeKB(t, filepath.Join(viper.GetString("log-dir"), "ansible-run-output.log"), 6)
+	writeKB(t, filepath.Join(viper.GetString("log-dir"), "unrelated.log"), 7)
+
+	// The artifact cache and galaxy cache are not counted again in the state
+	assert.Equal(t, map[string]int64{
+		diskAreaState:      1024,
+		diskAreaArtifacts:  2 * 1024,
+		diskAreaGalaxy:     3 * 1024,
+		diskAreaWheelhouse: 4 * 1024,
+		diskAreaVenv:       5 * 1024,
+		diskAreaLogs:       6 * 1024,
+	}, diskUsage())
+}
+
+func TestEnforceDiskQuota(t *testing.T) {
+	withDiskAreas(t)
+
+	writeKB(t, filepath.Join(stateDir(), "state.json"), 100)
+	oldest := storeAged(t, make([]byte, 600*1024), 3*time.Hour)
+	older := storeAged(t, append(make([]byte, 600*1024), 1), 2*time.Hour)
+	newest := storeAged(t, append(make([]byte, 600*1024), 2), time.Hour)
+	wheel := filepath.Join(viper.GetString("venv-wheelhouse"), "six.whl")
+	writeKB(t, wheel, 600)
+	writeKB(t, filepath.Join(viper.GetString("venv-path"), "bin", "python"), 1200)
+
+	viper.Set("disk-quota", 0)
+	assert.Nil(t, enforceDiskQuota())
+	assert.ElementsMatch(t, []string{oldest, older, newest}, cachedVersions(t))
+
+	// The least recently used artifacts go first, only as many as needed
+	viper.Set("disk-quota", 3)
+	assert.Nil(t, enforceDiskQuota())
+	assert.Equal(t, []string{newest}, cachedVersions(t))
+
+	viper.Set("disk-quota", 2)
+	assert.Nil(t, enforceDiskQuota())
+	assert.Empty(t, cachedVersions(t))
+	assert.FileExists(t, wheel)
+
+	// The virtualenv is never evicted
+	viper.Set("disk-quota", 1)
+	var lowResource lowResourceError
+	err := enforceDiskQuota()
+	assert.True(t, errors.As(err, &lowResource))
+	assert.Equal(t, resourceDiskQuota, lowResource.resource)
+	assert.NoFileExists(t, wheel)
+	assert.DirExists(t, viper.GetString("venv-wheelhouse"))
+	assert.FileExists(t, filepath.Join(viper.GetString("venv-path"), "bin", "python"))
+
+	assert.True(t, errors.As(checkResources(), &lowResource))
+	assert.Contains(t, checkResources().Error(), "above disk-quota of 1 MB")
+}
+
+func TestEvictRunOutputLogs(t *testing.T) {
+	withDiskAreas(t)
+
+	output := filepath.Join(viper.GetString("log-dir"), "ansible-run-output.log")
+	pullerLog := filepath.Join(viper.GetString("log-dir"), appName+".log")
+	writeKB(t, output, 2)
+	writeKB(t, pullerLog, 1)
+
+	freed, err := evictRunOutputLogs(1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024), freed)
+	assert.Equal(t, int64(1024), diskUsage()[diskAreaLogs])
+}
+
+func TestCheckDiskQuota(t *testing.T) {
+	withDiskAreas(t)
+	original := viper.Get("galaxy-offline")
+	t.Cleanup(func() { viper.Set("galaxy-offline", original) })
+
+	storeAged(t, make([]byte, 600*1024), 0)
+	writeKB(t, filepath.Join(galaxyCacheDir(), "roles", "ntp", "tasks", "main.yml"), 600)
+	writeKB(t, filepath.Join(viper.GetString("venv-path"), "bin", "python"), 600)
+
+	// What can be evicted doesn't count against the quota until runs evict it
+	viper.Set("disk-quota", 1)
+	assert.Nil(t, checkDiskQuota())
+	assert.Len(t, cachedVersions(t), 1)
+
+	viper.Set("galaxy-offline", true)
+	var lowResource lowResourceError
+	assert.True(t, errors.As(checkDiskQuota(), &lowResource))
+	assert.Equal(t, resourceDiskQuota, lowResource.resource)
+}
@@ -0,0 +1,124 @@
+// Drift found by the check runs of noop mode: what applying the playbook would change on the host
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// driftReport lists the tasks the last check run of noop mode would have changed the host with, as returned by
+// the API.
+type driftReport struct {
+	RunID    string        `json:"run_id"`
+	Playbook string        `json:"playbook"`
+	Time     time.Time     `json:"time"`     // When the check run ended
+	Complete bool          `json:"complete"` // Whether the check run succeeded, a failed run may not have checked every task
+	Drifted  bool          `json:"drifted"`
+	Tasks    []driftedTask `json:"tasks"`
+}
+
+// driftedTask is a task that would change the host.
+type driftedTask struct {
+	Play   string                     `json:"play"`
+	Name   string                     `json:"name"`
+	Module string                     `json:"module,omitempty"`
+	Hosts  []string                   `json:"hosts"`
+	Diffs  map[string]json.RawMessage `json:"diffs,omitempty"` // Before and after per host, for modules with diff support
+}
+
+var (
+	driftMutex sync.Mutex
+	lastDrift  *driftReport
+)
+
+// newDriftReport builds the drift report of a check run from its report.
+func newDriftReport(report RunReport) driftReport {
+	drift := driftReport{
+		RunID:    report.RunID,
+		Playbook: report.Playbook,
+		Time:     report.EndTime,
+		Complete: report.Success,
+		Tasks:    []driftedTask{},
+	}
+
+	for _, task := range report.Tasks {
+		hosts := []string{}
+		for host, status := range task.Hosts {
+			if status == "changed" {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		sort.Strings(hosts)
+
+		drift.Tasks = append(drift.Tasks, driftedTask{
+			Play:   task.Play,
+			Name:   task.Name,
+			Module: task.Module,
+			Hosts:  hosts,
+			Diffs:  task.Diffs,
+		})
+	}
+	drift.Drifted = len(drift.Tasks) > 0
+
+	return drift
+}
+
+// recordDrift keeps the drift found by a check run of noop mode for the API and the metrics.
+func recordDrift(report RunReport) {
+	drift := newDriftReport(report)
+	if drift.Time.IsZero() {
+		drift.Time = time.Now()
+	}
+
+	driftMutex.Lock()
+	newlyDrifted := drift.Drifted && (lastDrift == nil || !lastDrift.Drifted)
+	lastDrift = &drift
+	driftMutex.Unlock()
+
+	if drift.Drifted {
+		promDrifted.Set(1)
+		logrus.WithField("run_id", drift.RunID).Warnf("Drift: %d tasks would change the host", len(drift.Tasks))
+		if newlyDrifted {
+			notify(notification{Event: notifyDriftDetected, RunID: drift.RunID, DriftedTasks: len(drift.Tasks)})
+		}
+	} else {
+		promDrifted.Set(0)
+		logrus.WithField("run_id", drift.RunID).Infoln("No drift: the host is as the playbook describes it")
+	}
+	promDriftedTasks.Set(float64(len(drift.Tasks)))
+}
+
+// getLastDrift returns the drift found by the last check run of noop mode, if any.
+func getLastDrift() *driftReport {
+	driftMutex.Lock()
+	defer driftMutex.Unlock()
+
+	return lastDrift
+}
+
+// HandlerDrift returns what the last check run of noop mode found would change on the host.
+func HandlerDrift(w http.ResponseWriter, r *http.Request) {
+	drift := getLastDrift()
+	if drift == nil {
+		http.Error(w, "no noop run has completed yet", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(drift)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestCheckRunOutput(t *testing.T) AnsibleRunOutput {
+	var output AnsibleRunOutput
+	assert.Nil(t, json.Unmarshal([]byte(`{"plays": [{"play": {"name": "Configure hosts"}, "tasks": [
+		{"task": {"name": "Install packages"}, "hosts": {
+			"web1": {"action": "apt", "changed": false, "diff": {}},
+			"web2": {"action": "apt", "changed": true, "diff": {}}}},
+		{"task": {"name": "Configure nginx"}, "hosts": {
+			"web2": {"action": "template", "changed": true,
+				"diff": [{"before": "worker_processes 1;\n", "after": "worker_processes 4;\n"}]},
+			"web1": {"action": "template", "changed": true,
+				"diff": [{"before": "worker_processes 2;\n", "after": "worker_processes 4;\n"}]}}},
+		{"task": {"name": "Start nginx"}, "hosts": {"web1": {"action": "service", "changed": false}}}
+	]}]}`), &output))
+
+	return output
+}
+
+func TestNewDriftReport(t *testing.T) {
+	report := newRunReport(loadTestCheckRunOutput(t))
+	report.RunID, report.Success = "check", true
+	assert.Nil(t, report.Tasks[0].Diffs)
+	assert.Len(t, report.Tasks[1].Diffs, 2)
+
+	drift := newDriftReport(report)
+	assert.Equal(t, "check", drift.RunID)
+	assert.True(t, drift.Complete)
+	assert.True(t, drift.Drifted)
+	assert.Len(t, drift.Tasks, 2)
+
+	assert.Equal(t, "Install packages", drift.Tasks[0].Name)
+	assert.Equal(t, []string{"web2"}, drift.Tasks[0].Hosts)
+	assert.Nil(t, drift.Tasks[0].Diffs)
+
+	assert.Equal(t, "template", drift.Tasks[1].Module)
+	assert.Equal(t, []string{"web1", "web2"}, drift.Tasks[1].Hosts)
+	var diffs []map[string]string
+	assert.Nil(t, json.Unmarshal(drift.Tasks[1].Diffs["web1"], &diffs))
+	assert.Equal(t, "worker_processes 2;\n", diffs[0]["before"])
+}
+
+func TestNewDriftReportWithoutChanges(t *testing.T) {
+	drift := newDriftReport(RunReport{Tasks: []TaskReport{{Name: "Start nginx", Hosts: map[string]string{"web1": "ok"}}}})
+	assert.False(t, drift.Drifted)
+	assert.Empty(t, drift.Tasks)
+}
+
+func TestHandlerDrift(t *testing.T) {
+	originalDrift := lastDrift
+	defer func() { lastDrift = originalDrift }()
+
+	lastDrift = nil
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerDrift).ServeHTTP(rr, httptest.NewRequest("GET", httpPathDrift, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	recordDrift(newRunReport(loadTestCheckRunOutput(t)))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HandlerDrift).ServeHTTP(rr, httptest.NewRequest("GET", httpPathDrift, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var drift driftReport
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &drift))
+	assert.True(t, drift.Drifted)
+	assert.False(t, drift.Complete)
+	assert.False(t, drift.Time.IsZero())
+	assert.Len(t, drift.Tasks, 2)
+}
@@ -0,0 +1,85 @@
+// Classification of the errors of failed runs into those worth running again soon and those only a change of the
+// configuration or the artifact fixes
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Classes of the errors of failed runs, as labelled in promRunErrorClasses
+const (
+	errorClassRetryable = "retryable" // Network failures and held locks, which usually go away by themselves
+	errorClassFatal     = "fatal"     // Bad configuration or an artifact that must not be applied
+	errorClassFailed    = "failed"    // Anything else, e.g. failed tasks
+)
+
+var errorClasses = []string{errorClassRetryable, errorClassFatal, errorClassFailed}
+
+// fatalError marks an error as one that running again won't fix until the configuration or the artifact changes.
+type fatalError struct {
+	error
+}
+
+func (fatalError) Fatal() bool {
+	return true
+}
+
+func (e fatalError) Unwrap() error {
+	return e.error
+}
+
+// errorClass returns the class of the error of a failed run, "" if it didn't fail.
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var fatal interface{ Fatal() bool }
+	if errors.As(err, &fatal) && fatal.Fatal() {
+		return errorClassFatal
+	}
+	if isTransient(err) {
+		return errorClassRetryable
+	}
+
+	return errorClassFailed
+}
+
+// runRetries schedules the runs of playbooks that failed with retryable errors again before their next scheduled
+// run, backing off exponentially while they keep failing.
+type runRetries struct {
+	mutex    sync.Mutex
+	failures map[string]int // Consecutive retryable failures by playbook
+	backoff  time.Duration  // Before the first retry, doubled for each further one
+}
+
+func newRunRetries() *runRetries {
+	return &runRetries{
+		failures: map[string]int{},
+		backoff:  time.Duration(viper.GetInt("run-retry-backoff")) * time.Minute,
+	}
+}
+
+// after returns how long to wait before running playbook again after a run that returned err, and false if it
+// shouldn't be retried. Retries that wouldn't happen before the next run, period after this one, are left to it.
+func (r *runRetries) after(playbook string, err error, period time.Duration) (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if errorClass(err) != errorClassRetryable || r.backoff <= 0 {
+		delete(r.failures, playbook)
+		return 0, false
+	}
+
+	wait := r.backoff << uint(r.failures[playbook])
+	r.failures[playbook]++
+	if wait <= 0 || wait >= period {
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, "", errorClass(nil))
+	assert.Equal(t, errorClassFailed, errorClass(errors.New("exit status 2")))
+	assert.Equal(t, errorClassRetryable, errorClass(errors.Wrap(transientError{errors.New("connection reset")}, "download failed")))
+	assert.Equal(t, errorClassFatal, errorClass(runStageError{stage: runStageDownload, err: errors.Wrap(fatalError{errors.New("bad signature")}, "artifact verification failed")}))
+}
+
+func TestRunRetries(t *testing.T) {
+	originalBackoff := viper.GetInt("run-retry-backoff")
+	viper.Set("run-retry-backoff", 5)
+	defer viper.Set("run-retry-backoff", originalBackoff)
+
+	retries := newRunRetries()
+	retryable := transientError{errors.New("connection refused")}
+	var waits []time.Duration
+	for {
+		wait, ok := retries.after("base", retryable, time.Hour)
+		if !ok {
+			break
+		}
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute}, waits)
+
+	// Other playbooks back off separately, and a run that didn't fail retryably starts over
+	wait, ok := retries.after("certs", retryable, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+	_, ok = retries.after("base", nil, time.Hour)
+	assert.False(t, ok)
+	wait, ok = retries.after("base", retryable, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+
+	_, ok = retries.after("base", fatalError{errors.New("artifact denied by policy")}, time.Hour)
+	assert.False(t, ok)
+}
@@ -0,0 +1,217 @@
+// Lifecycle events published as CloudEvents
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	eventTypePrefix         = "com.teslamotors.ansible-puller."
+	eventRunStarted         = eventTypePrefix + "run.started"
+	eventRunFinished        = eventTypePrefix + "run.finished"
+	eventRunSkipped         = eventTypePrefix + "run.skipped"
+	eventPullerDisabled     = eventTypePrefix + "disabled"
+	eventPullerEnabled      = eventTypePrefix + "enabled"
+	eventHostDecommissioned = eventTypePrefix + "decommissioned"
+	eventStateTampered      = eventTypePrefix + "state.tampered"
+
+	// How long to wait for outstanding events before exiting
+	eventFlushTimeout = 30 * time.Second
+)
+
+// cloudEvent is a CloudEvents 1.0 event, in the layout of the JSON event format.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// runStartedEvent is the data of a run.started event.
+type runStartedEvent struct {
+	RunID    string `json:"run_id"`
+	Playbook string `json:"playbook"`
+}
+
+// runFinishedEvent is the data of a run.finished event.
+type runFinishedEvent struct {
+	RunID           string             `json:"run_id"`
+	Playbook        string             `json:"playbook"`
+	Success         bool               `json:"success"`
+	Error           string             `json:"error,omitempty"`
+	ErrorClass      string             `json:"error_class,omitempty"` // retryable, fatal or failed
+	ExitCode        int                `json:"exit_code"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	Summary         *AnsibleNodeStatus `json:"summary,omitempty"` // Play recap for the host, once Ansible ran
+	Failure         *runFailure        `json:"failure,omitempty"`
+	ConfigHash      string             `json:"config_hash"` // SHA-256 of the effective configuration of the puller
+}
+
+// pullerStateEvent is the data of the enabled, disabled and decommissioned events.
+type pullerStateEvent struct {
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"` // When a disabled puller enables itself again
+}
+
+// eventSink delivers events to one destination.
+type eventSink interface {
+	Send(event cloudEvent) error
+}
+
+var (
+	eventSinks  []eventSink
+	eventsGroup sync.WaitGroup
+)
+
+// setupEvents creates the configured event sinks.
+func setupEvents() error {
+	mode := viper.GetString("events-webhook-mode")
+	if mode != "binary" && mode != "structured" {
+		return errors.Errorf("invalid events-webhook-mode %q, expected binary or structured", mode)
+	}
+
+	for _, url := range viper.GetStringSlice("events-webhook-urls") {
+		eventSinks = append(eventSinks, webhookSink{
+			url:        url,
+			structured: mode == "structured",
+			client:     &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	topicARN := viper.GetString("events-sns-topic-arn")
+	busName := viper.GetString("events-eventbridge-bus")
+	if topicARN == "" && busName == "" {
+		return nil
+	}
+
+	region := viper.GetString("events-aws-region")
+	if region == "" {
+		region = regionFromARN(topicARN)
+	}
+	awsConfig, err := loadAWSConfig(context.TODO(), region)
+	if err != nil {
+		return errors.Wrap(err, "unable to load AWS config for events")
+	}
+
+	if topicARN != "" {
+		eventSinks = append(eventSinks, snsSink{api: newAWSAPIClient(awsConfig, "sns"), topicARN: topicARN})
+	}
+	if busName != "" {
+		eventSinks = append(eventSinks, eventBridgeSink{api: newAWSAPIClient(awsConfig, "events"), busName: busName})
+	}
+
+	return nil
+}
+
+func newCloudEvent(eventType string, data interface{}) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.NewV4().String(),
+		Source:          fmt.Sprintf("/%s/%s", appName, hostname),
+		Type:            eventType,
+		Subject:         hostname,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// emitEvent sends an event to all sinks in the background. Failures are logged and otherwise ignored.
+func emitEvent(eventType string, data interface{}) {
+	if len(eventSinks) == 0 {
+		return
+	}
+
+	event := newCloudEvent(eventType, data)
+	for _, sink := range eventSinks {
+		eventsGroup.Add(1)
+		go func(sink eventSink) {
+			defer eventsGroup.Done()
+			if err := sink.Send(event); err != nil {
+				logrus.Warnf("Unable to send %s event: %v", eventType, err)
+			}
+		}(sink)
+	}
+}
+
+// flushEvents waits for events that are still being sent, for at most eventFlushTimeout.
+func flushEvents() {
+	done := make(chan struct{})
+	go func() {
+		eventsGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(eventFlushTimeout):
+		logrus.Warnln("Timed out sending events")
+	}
+}
+
+// webhookSink posts events with the CloudEvents HTTP protocol binding.
+//
+// In binary mode the attributes are sent as ce-* headers and the body is the event data, in structured
+// mode the body is the whole event.
+type webhookSink struct {
+	url        string
+	structured bool
+	client     *http.Client
+}
+
+func (s webhookSink) Send(event cloudEvent) error {
+	var body interface{} = event.Data
+	contentType := event.DataContentType
+	if s.structured {
+		body = event
+		contentType = "application/cloudevents+json; charset=UTF-8"
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode event")
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	if !s.structured {
+		req.Header.Set("ce-specversion", event.SpecVersion)
+		req.Header.Set("ce-id", event.ID)
+		req.Header.Set("ce-source", event.Source)
+		req.Header.Set("ce-type", event.Type)
+		req.Header.Set("ce-time", event.Time.Format(time.RFC3339Nano))
+		if event.Subject != "" {
+			req.Header.Set("ce-subject", event.Subject)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	return nil
+}
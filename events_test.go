@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSinkBinary(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		request = req
+		body, _ = ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	event := newCloudEvent(eventRunStarted, runStartedEvent{RunID: "1234", Playbook: "site.yml"})
+	sink := webhookSink{url: server.URL, client: server.Client()}
+	assert.Nil(t, sink.Send(event))
+
+	assert.Equal(t, "1.0", request.Header.Get("ce-specversion"))
+	assert.Equal(t, event.ID, request.Header.Get("ce-id"))
+	assert.Equal(t, eventRunStarted, request.Header.Get("ce-type"))
+	assert.Equal(t, event.Source, request.Header.Get("ce-source"))
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"run_id": "1234", "playbook": "site.yml"}`, string(body))
+}
+
+func TestWebhookSinkStructured(t *testing.T) {
+	var contentType string
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		contentType = req.Header.Get("Content-Type")
+		json.NewDecoder(req.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	event := newCloudEvent(eventPullerDisabled, pullerStateEvent{Reason: "maintenance"})
+	event.Time = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink := webhookSink{url: server.URL, structured: true, client: server.Client()}
+	assert.Nil(t, sink.Send(event))
+
+	assert.Equal(t, "application/cloudevents+json; charset=UTF-8", contentType)
+	assert.Equal(t, "1.0", received["specversion"])
+	assert.Equal(t, eventPullerDisabled, received["type"])
+	assert.Equal(t, "2020-01-01T00:00:00Z", received["time"])
+	assert.Equal(t, map[string]interface{}{"reason": "maintenance"}, received["data"])
+}
+
+func TestWebhookSinkFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sink := webhookSink{url: server.URL, client: server.Client()}
+	assert.NotNil(t, sink.Send(newCloudEvent(eventPullerEnabled, pullerStateEvent{})))
+}
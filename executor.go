@@ -0,0 +1,227 @@
+// Executors, which provide the Ansible that runs use: a virtualenv managed by the puller or a container image
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Executors, selected with executor
+const (
+	executorVenv      = "venv"
+	executorContainer = "container"
+)
+
+// When the image of the container executor is pulled, selected with container-pull
+const (
+	containerPullAlways  = "always"
+	containerPullMissing = "missing"
+	containerPullNever   = "never"
+)
+
+// Executor runs the Ansible commands of runs, like ansible-playbook and ansible-galaxy.
+type Executor interface {
+	// Prepare readies the commands to run the artifact extracted to runDir, tracing it as children of parent.
+	Prepare(runDir string, parent *span) error
+	// Command returns the process running c, which VenvCommand.Run starts and waits for.
+	Command(c VenvCommand) (*exec.Cmd, error)
+}
+
+// runExecutor returns the configured executor of the run described by spec, with vCfg as its virtualenv and
+// ansibleVersion pinned in it.
+func runExecutor(spec runSpec, vCfg VenvConfig, ansibleVersion string) (Executor, error) {
+	venv := venvExecutor{Config: vCfg, AnsibleVersion: ansibleVersion, Playbook: spec.Playbook}
+	switch viper.GetString("executor") {
+	case executorContainer:
+		if spec.VenvPath != "" {
+			return nil, errors.New("ansible-core upgrades are only checked with the venv executor, upgrade the image instead")
+		}
+		return newContainerExecutor(), nil
+	case executorRunner:
+		return newRunnerExecutor(venv, spec.ID), nil
+	default:
+		return venv, nil
+	}
+}
+
+// venvExecutor runs commands in the virtualenv of their configuration, into which Prepare installs the requirements
+// of the artifact.
+type venvExecutor struct {
+	Config         VenvConfig
+	AnsibleVersion string // ansible-core version installed over the requirements (default: as they require)
+	Playbook       string // Syntax checked in standby virtualenvs, relative to ansible-dir (default: none)
+}
+
+func (e venvExecutor) Prepare(runDir string, parent *span) error {
+	requirementsFile := filepath.Join(runDir, viper.GetString("venv-requirements-file"))
+	venvLog.Infoln("Ensuring virtualenv exists")
+	venvSpan := parent.child("venv.ensure")
+	var err error
+	if e.Config.Standby {
+		err = e.Config.EnsureStandby(requirementsFile, func(standby VenvConfig) error {
+			return e.validateStandby(standby, runDir)
+		})
+	} else {
+		err = e.Config.Ensure(requirementsFile)
+	}
+	venvSpan.end(err)
+	if err != nil {
+		return err
+	}
+	venvRebuilt = venvRebuilt || e.Config.ForceRebuild
+
+	venvLog.Infoln("Updating virtualenv")
+	venvSpan = parent.child("venv.update")
+	err = retryPolicyFromConfig().do(retryOperationVenvUpdate, func() error {
+		if err := e.Config.Update(requirementsFile); err != nil || e.AnsibleVersion == "" {
+			return err
+		}
+		// Pinned after the requirements, which may require another version
+		return e.Config.Install(ansibleCorePackage + "==" + e.AnsibleVersion)
+	})
+	venvSpan.end(err)
+	return err
+}
+
+// validateStandby checks that Ansible runs in the standby virtualenv, and that it can parse the playbook in the
+// artifact extracted to runDir, with the collections and roles installed by earlier runs.
+func (e venvExecutor) validateStandby(standby VenvConfig, runDir string) error {
+	checks := [][]string{{"ansible", "--version"}}
+	if e.Playbook != "" {
+		checks = append(checks, []string{"ansible-playbook", "--syntax-check", "-i", "localhost,", e.Playbook})
+	}
+
+	aCfg := AnsibleConfig{VenvConfig: standby, Cwd: filepath.Join(runDir, viper.GetString("ansible-dir")), GalaxyDir: galaxyCacheDir()}
+	for _, check := range checks {
+		output := VenvCommand{Config: standby, Binary: check[0], Args: check[1:], Cwd: aCfg.Cwd, Env: aCfg.env()}.Run()
+		if output.Error != nil {
+			return errors.Wrapf(output.Error, "%s failed: %s", strings.Join(check, " "), strings.TrimSpace(output.Stderr))
+		}
+	}
+
+	return nil
+}
+
+func (e venvExecutor) Command(c VenvCommand) (*exec.Cmd, error) {
+	env, err := c.environ()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(c.path(), c.Args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// containerExecutor runs commands in a container of an image that has Ansible installed, with docker, podman or
+// another runtime with the same command line. The image is expected to have the binaries in its $PATH.
+//
+// Paths are mounted into the container as they are on the host, so that those passed to the commands, like the run
+// directory, stay valid. Stopping the command stops the container, as the runtime passes the signal on to it.
+type containerExecutor struct {
+	Runtime string   // Command of the container runtime, e.g. docker or podman
+	Image   string   // Image the containers are started from
+	Pull    string   // When Image is pulled: always before a run, only if it is missing, or never
+	Volumes []string // Mounts, as host-path:container-path[:options]
+	RunArgs []string // Further arguments of the run command of the runtime, e.g. --network host
+}
+
+// newContainerExecutor returns the configured container executor. It mounts the temporary directory, where runs,
+// hostConnection returns the connection plugin playbooks reach this host with outside of controller mode: local,
+// unless Ansible runs in a container, which reaches the host with container-connection.
+func hostConnection() string {
+	if viper.GetString("executor") == executorContainer {
+		return viper.GetString("container-connection")
+	}
+	return "local"
+}
+
+// callback plugins and ssh-agent sockets are, and the other directories and files the commands are passed.
+func newContainerExecutor() containerExecutor {
+	dirs := []string{os.TempDir(), galaxyCacheDir()}
+	if homeDir := viper.GetString("ansible-home"); homeDir != "" {
+		dirs = append(dirs, homeDir)
+	}
+	var volumes []string
+	for _, dir := range dirs {
+		volumes = append(volumes, dir+":"+dir)
+	}
+	if knownHosts := viper.GetString("ansible-controller-known-hosts"); knownHosts != "" {
+		volumes = append(volumes, knownHosts+":"+knownHosts+":ro")
+	}
+
+	return containerExecutor{
+		Runtime: viper.GetString("container-runtime"),
+		Image:   viper.GetString("container-image"),
+		Pull:    viper.GetString("container-pull"),
+		Volumes: append(volumes, viper.GetStringSlice("container-volumes")...),
+		RunArgs: viper.GetStringSlice("container-run-args"),
+	}
+}
+
+func (e containerExecutor) Prepare(runDir string, parent *span) error {
+	// Created by the runtime otherwise, and owned by whoever it runs as
+	if err := os.MkdirAll(galaxyCacheDir(), 0755); err != nil {
+		return errors.Wrap(err, "unable to create galaxy cache directory")
+	}
+
+	pullSpan := parent.child("container.pull")
+	err := retryPolicyFromConfig().do(retryOperationDownload, e.pull)
+	pullSpan.end(err)
+	return err
+}
+
+// pull pulls the image, unless it is present and only pulled if missing.
+func (e containerExecutor) pull() error {
+	switch e.Pull {
+	case containerPullNever:
+		return nil
+	case containerPullMissing:
+		if exec.Command(e.Runtime, "image", "inspect", e.Image).Run() == nil {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(runsContext(), downloadTimeout())
+	defer cancel()
+	venvLog.Infoln("Pulling image ", e.Image)
+	cmd := exec.CommandContext(ctx, e.Runtime, "pull", e.Image)
+	cmd.Env = commandEnv()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := VenvCommandRunOutput{Error: err, Stderr: stderr.String()}
+		return errors.Wrapf(commandFailure(output), "unable to pull %s: %s", e.Image, strings.TrimSpace(output.Stderr))
+	}
+
+	return nil
+}
+
+func (e containerExecutor) Command(c VenvCommand) (*exec.Cmd, error) {
+	args := []string{"run", "--rm", "--init"}
+	for _, volume := range e.Volumes {
+		args = append(args, "--volume", volume)
+	}
+	if c.Cwd != "" {
+		args = append(args, "--workdir", c.Cwd)
+	}
+	env := append(localeEnv(), c.Env...)
+	for _, variable := range env {
+		// Only the names, the runtime takes the values from its environment so they don't show up in the process list
+		args = append(args, "--env", strings.SplitN(variable, "=", 2)[0])
+	}
+	args = append(args, e.RunArgs...)
+	args = append(append(args, e.Image, c.Binary), c.Args...)
+
+	cmd := exec.Command(e.Runtime, args...)
+	cmd.Env = commandEnv(c.Env...)
+	return cmd, nil
+}
@@ -0,0 +1,127 @@
+// The ansible-runner executor, which runs playbooks with ansible-runner in the virtualenv for the artifacts and job
+// events it keeps of them
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const executorRunner = "runner"
+
+// Arguments of ansible-playbook that don't run plays, whose commands are run as they are rather than by ansible-runner
+var runnerlessPlaybookArgs = map[string]bool{
+	"--list-hosts":   true,
+	"--list-tasks":   true,
+	"--list-tags":    true,
+	"--syntax-check": true,
+}
+
+// Characters that aren't kept in the idents of runner artifacts
+var runnerIdentPattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// runnerExecutor is the venv executor, except that ansible-playbook runs are started with ansible-runner, which is
+// installed into the virtualenv if the requirements don't have it. ansible-runner keeps the output, status and job
+// events of every run in the artifacts directory of its private data directory, DataDir, under an ident made of
+// Ident and the playbook.
+type runnerExecutor struct {
+	venvExecutor
+	DataDir         string
+	Ident           string // Prefix of the idents of the artifacts, e.g. the run ID (default: the current time)
+	RotateArtifacts int    // Number of artifact directories ansible-runner keeps
+}
+
+// runnerDataDir returns the private data directory of ansible-runner.
+func runnerDataDir() string {
+	if dir := viper.GetString("runner-data-dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(stateDir(), "runner")
+}
+
+// newRunnerExecutor returns the configured ansible-runner executor of the run with the ID runID, running in the
+// virtualenv of venv.
+func newRunnerExecutor(venv venvExecutor, runID string) runnerExecutor {
+	return runnerExecutor{
+		venvExecutor:    venv,
+		DataDir:         runnerDataDir(),
+		Ident:           runID,
+		RotateArtifacts: viper.GetInt("runner-rotate-artifacts"),
+	}
+}
+
+func (e runnerExecutor) Prepare(runDir string, parent *span) error {
+	if err := e.venvExecutor.Prepare(runDir, parent); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.DataDir, 0700); err != nil {
+		return errors.Wrap(err, "unable to create runner data directory")
+	}
+
+	if _, err := os.Stat(VenvCommand{Config: e.Config, Binary: "ansible-runner"}.path()); err == nil {
+		return nil
+	}
+	venvLog.Infoln("Installing ansible-runner")
+	runnerSpan := parent.child("venv.runner")
+	err := retryPolicyFromConfig().do(retryOperationVenvUpdate, func() error {
+		return e.Config.Install(viper.GetString("runner-package"))
+	})
+	runnerSpan.end(err)
+	return errors.Wrap(err, "unable to install ansible-runner")
+}
+
+func (e runnerExecutor) Command(c VenvCommand) (*exec.Cmd, error) {
+	if c.Binary != "ansible-playbook" || len(c.Args) == 0 || !runsPlays(c.Args) {
+		return e.venvExecutor.Command(c)
+	}
+
+	// The project is the directory the playbook runs in, which holds it and the inventories
+	playbook := c.Args[0]
+	args := []string{"run", e.DataDir, "--project-dir", c.Cwd, "--playbook", playbook, "--ident", e.ident(playbook), "--omit-env-files"}
+	if e.RotateArtifacts > 0 {
+		args = append(args, "--rotate-artifacts", fmt.Sprint(e.RotateArtifacts))
+	}
+	if len(c.Args) > 1 {
+		args = append(args, "--cmdline", shellQuote(c.Args[1:]))
+	}
+
+	return e.venvExecutor.Command(VenvCommand{Config: c.Config, Binary: "ansible-runner", Args: args, Env: c.Env})
+}
+
+// ident returns the ident of the artifacts of a run of playbook.
+func (e runnerExecutor) ident(playbook string) string {
+	prefix := e.Ident
+	if prefix == "" {
+		prefix = time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	name := strings.TrimSuffix(filepath.Base(playbook), filepath.Ext(playbook))
+	return runnerIdentPattern.ReplaceAllString(prefix+"-"+name, "_")
+}
+
+// runsPlays returns whether the ansible-playbook arguments args run the plays, rather than list or check them.
+func runsPlays(args []string) bool {
+	for _, arg := range args {
+		if runnerlessPlaybookArgs[arg] {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes args for a POSIX shell, or Python's shlex.split, which ansible-runner splits --cmdline with.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerExecutorCommand(t *testing.T) {
+	withSettings(t, map[string]interface{}{"child-locale": "C.UTF-8"})
+	executor := containerExecutor{
+		Runtime: "podman",
+		Image:   "registry.example.com/ansible:9",
+		Volumes: []string{"/tmp:/tmp"},
+		RunArgs: []string{"--network=host"},
+	}
+	cmd := VenvCommand{
+		Binary:   "ansible-playbook",
+		Args:     []string{"site.yml", "-i", "hosts"},
+		Cwd:      "/tmp/ansible-puller123",
+		Env:      []string{"VAULT_TOKEN=secret"},
+		Executor: executor,
+	}
+
+	process, err := cmd.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"podman", "run", "--rm", "--init", "--volume", "/tmp:/tmp", "--workdir", "/tmp/ansible-puller123",
+		"--env", "LANG", "--env", "LC_ALL", "--env", "VAULT_TOKEN", "--network=host",
+		"registry.example.com/ansible:9", "ansible-playbook", "site.yml", "-i", "hosts"}, process.Args)
+	assert.Equal(t, "/tmp/ansible-puller123", process.Dir)
+	// Values are passed in the environment of the runtime only
+	assert.Contains(t, process.Env, "VAULT_TOKEN=secret")
+	assert.NotContains(t, strings.Join(process.Args, " "), "secret")
+}
+
+func TestContainerExecutorPrepare(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake container runtime is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	runtimePath := filepath.Join(dir, "docker")
+	// No image is present
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n[ \"$1\" != image ]\n"
+	assert.Nil(t, ioutil.WriteFile(runtimePath, []byte(script), 0755))
+	withSettings(t, map[string]interface{}{"galaxy-cache-dir": filepath.Join(dir, "galaxy")})
+
+	readCalls := func() string {
+		called, _ := ioutil.ReadFile(calls)
+		assert.Nil(t, ioutil.WriteFile(calls, nil, 0644))
+		return string(called)
+	}
+	executor := containerExecutor{Runtime: runtimePath, Image: "ansible:9", Pull: containerPullMissing}
+	assert.Nil(t, executor.Prepare(dir, nil))
+	assert.Equal(t, "image inspect ansible:9\npull ansible:9\n", readCalls())
+	assert.DirExists(t, filepath.Join(dir, "galaxy"))
+
+	executor.Pull = containerPullAlways
+	assert.Nil(t, executor.Prepare(dir, nil))
+	assert.Equal(t, "pull ansible:9\n", readCalls())
+
+	executor.Pull = containerPullNever
+	assert.Nil(t, executor.Prepare(dir, nil))
+	assert.Equal(t, "", readCalls())
+}
+
+func TestRunExecutor(t *testing.T) {
+	withSettings(t, map[string]interface{}{"executor": executorVenv})
+	executor, err := runExecutor(runSpec{}, VenvConfig{Path: "/opt/venv"}, "2.16.3")
+	assert.Nil(t, err)
+	assert.Equal(t, venvExecutor{Config: VenvConfig{Path: "/opt/venv"}, AnsibleVersion: "2.16.3"}, executor)
+
+	withSettings(t, map[string]interface{}{"executor": executorContainer, "container-image": "ansible:9"})
+	executor, err = runExecutor(runSpec{}, VenvConfig{}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ansible:9", executor.(containerExecutor).Image)
+
+	_, err = runExecutor(runSpec{VenvPath: "/opt/venv-ansible-2.16.3"}, VenvConfig{}, "2.16.3")
+	assert.Error(t, err)
+
+	withSettings(t, map[string]interface{}{"executor": executorRunner, "runner-data-dir": "/srv/runner"})
+	executor, err = runExecutor(runSpec{ID: "run-1"}, VenvConfig{Path: "/opt/venv"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/venv", executor.(runnerExecutor).Config.Path)
+	assert.Equal(t, "/srv/runner", executor.(runnerExecutor).DataDir)
+	assert.Equal(t, "run-1", executor.(runnerExecutor).Ident)
+}
+
+func TestValidateExecutor(t *testing.T) {
+	problemsOf := func() []string {
+		var problems []string
+		for _, problem := range validateConfig() {
+			problems = append(problems, problem.Error())
+		}
+		return problems
+	}
+
+	withSettings(t, map[string]interface{}{"executor": executorContainer, "container-image": "", "container-pull": "sometimes"})
+	assert.Contains(t, problemsOf(), "container-image is required with the container executor")
+	assert.Contains(t, problemsOf(), `invalid container-pull "sometimes", expected always, missing or never`)
+
+	// The plays would run against the container
+	const localConnection = "the container executor requires ansible-controller or a container-connection other than local"
+	withSettings(t, map[string]interface{}{"ansible-controller": false, "container-connection": "local"})
+	assert.Contains(t, problemsOf(), localConnection)
+	withSettings(t, map[string]interface{}{"container-connection": "ssh"})
+	assert.NotContains(t, problemsOf(), localConnection)
+	assert.Equal(t, "ssh", hostConnection())
+	withSettings(t, map[string]interface{}{"ansible-controller": true, "container-connection": ""})
+	assert.NotContains(t, problemsOf(), localConnection)
+
+	withSettings(t, map[string]interface{}{"executor": "chroot"})
+	assert.Contains(t, problemsOf(), `invalid executor "chroot", expected venv, container or runner`)
+}
+
+func TestRunnerExecutorCommand(t *testing.T) {
+	executor := runnerExecutor{
+		venvExecutor:    venvExecutor{Config: VenvConfig{Path: "/opt/venv"}},
+		DataDir:         "/var/lib/ansible-puller/runner",
+		Ident:           "run-1",
+		RotateArtifacts: 5,
+	}
+	cmd := VenvCommand{
+		Config:   executor.Config,
+		Binary:   "ansible-playbook",
+		Args:     []string{"playbooks/site.yml", "-i", "hosts", "--extra-vars", `{"name":"it's"}`},
+		Cwd:      "/tmp/ansible-puller123",
+		Env:      []string{"ANSIBLE_STDOUT_CALLBACK=json"},
+		Executor: executor,
+	}
+
+	process, err := cmd.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/opt/venv/bin/ansible-runner", "run", "/var/lib/ansible-puller/runner",
+		"--project-dir", "/tmp/ansible-puller123", "--playbook", "playbooks/site.yml", "--ident", "run-1-site",
+		"--omit-env-files", "--rotate-artifacts", "5", "--cmdline", `'-i' 'hosts' '--extra-vars' '{"name":"it'"'"'s"}'`}, process.Args)
+	assert.Equal(t, "/tmp/ansible-puller123", process.Dir)
+	assert.Contains(t, process.Env, "ANSIBLE_STDOUT_CALLBACK=json")
+
+	// Commands that don't run plays run as they are
+	cmd.Args = []string{"site.yml", "-i", "hosts", "--list-hosts"}
+	process, err = cmd.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/opt/venv/bin/ansible-playbook", "site.yml", "-i", "hosts", "--list-hosts"}, process.Args)
+	cmd.Binary, cmd.Args = "ansible-galaxy", []string{"collection", "install"}
+	process, err = cmd.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/opt/venv/bin/ansible-galaxy", "collection", "install"}, process.Args)
+}
+
+func TestRunnerExecutorPrepare(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir := t.TempDir()
+	// Creates virtualenvs whose pip records how it was called
+	calls := filepath.Join(dir, "calls")
+	python := filepath.Join(dir, "python3")
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && echo Python 3.10.12 && exit\n" +
+		"mkdir -p \"$3/bin\" && touch \"$3/bin/python\" && printf '#!/bin/sh\\necho pip \"$@\" >> " + calls + "\\n' > \"$3/bin/pip\" && chmod +x \"$3/bin/pip\"\n"
+	assert.Nil(t, ioutil.WriteFile(python, []byte(script), 0755))
+	venv := filepath.Join(dir, "venv")
+	withSettings(t, map[string]interface{}{
+		"runner-package":         "ansible-runner==2.3.4",
+		"venv-requirements-file": "requirements.txt",
+	})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "requirements.txt"), []byte("ansible-core\n"), 0644))
+
+	executor := newRunnerExecutor(venvExecutor{Config: VenvConfig{Path: venv, Python: python}}, "run-1")
+	executor.DataDir = filepath.Join(dir, "runner")
+	assert.Nil(t, executor.Prepare(dir, nil))
+	assert.DirExists(t, executor.DataDir)
+	called, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Contains(t, string(called), "ansible-runner==2.3.4")
+
+	// Installed by the requirements
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "ansible-runner"), nil, 0755))
+	assert.Nil(t, ioutil.WriteFile(calls, nil, 0644))
+	assert.Nil(t, executor.Prepare(dir, nil))
+	called, err = ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(called), "ansible-runner")
+}
@@ -0,0 +1,84 @@
+// Exit codes of run-once mode, so that wrapper scripts and CI can tell why a run failed
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Exit codes of run-once mode. Above those of ansible-playbook, which the puller doesn't pass on.
+const (
+	exitRunSucceeded      = 0
+	exitRunFailed         = 1 // Failures not covered below, e.g. policy checks or a missing inventory
+	exitDownloadFailed    = 10
+	exitVenvFailed        = 11
+	exitPlaybookFailed    = 12
+	exitPlaybookUnreached = 13
+	exitRunTimedOut       = 14
+	exitPullerDisabled    = 15
+	exitRunInterrupted    = 16
+)
+
+// Stages of a run, as far as exit codes tell them apart
+const (
+	runStageDownload = "download"
+	runStageVenv     = "venv"
+	runStagePlaybook = "playbook"
+)
+
+// runStageError is the error of the stage of a run that failed.
+type runStageError struct {
+	stage    string
+	exitCode int // Of ansible-playbook, for the playbook stage
+	err      error
+}
+
+func (e runStageError) Error() string {
+	return e.err.Error()
+}
+
+func (e runStageError) Unwrap() error {
+	return e.err
+}
+
+// inRunStage returns err as the error of stage, or nil if err is nil.
+func inRunStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return runStageError{stage: stage, err: err}
+}
+
+// onceExitCode returns the exit code of run-once mode for a run that returned err. Timeouts take precedence over
+// the stage that timed out.
+func onceExitCode(err error) int {
+	if err == nil {
+		return exitRunSucceeded
+	}
+
+	switch runOutcomeOf(err) {
+	case runOutcomeTimeout:
+		return exitRunTimedOut
+	case runOutcomeUnreachable:
+		return exitPlaybookUnreached
+	case runOutcomeInterrupted:
+		return exitRunInterrupted
+	}
+
+	var stage runStageError
+	if !errors.As(err, &stage) {
+		return exitRunFailed
+	}
+	switch stage.stage {
+	case runStageDownload:
+		return exitDownloadFailed
+	case runStageVenv:
+		return exitVenvFailed
+	case runStagePlaybook:
+		if stage.exitCode == unreachableExitCode {
+			return exitPlaybookUnreached
+		}
+		return exitPlaybookFailed
+	}
+	return exitRunFailed
+}
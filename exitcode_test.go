@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnceExitCode(t *testing.T) {
+	failed := errors.New("failed")
+
+	assert.Equal(t, exitRunSucceeded, onceExitCode(nil))
+	assert.Nil(t, inRunStage(runStageVenv, nil))
+	assert.Equal(t, exitRunFailed, onceExitCode(failed))
+	assert.Equal(t, exitDownloadFailed, onceExitCode(inRunStage(runStageDownload, failed)))
+	assert.Equal(t, exitVenvFailed, onceExitCode(inRunStage(runStageVenv, errors.Wrap(failed, "pip install"))))
+	assert.Equal(t, exitPlaybookFailed, onceExitCode(runStageError{stage: runStagePlaybook, exitCode: 2, err: failed}))
+	assert.Equal(t, exitPlaybookUnreached, onceExitCode(runStageError{stage: runStagePlaybook, exitCode: unreachableExitCode, err: failed}))
+	assert.Equal(t, exitPlaybookUnreached, onceExitCode(unreachableError{cause: "ssh", hint: "use a local connection"}))
+	assert.Equal(t, exitRunFailed, onceExitCode(errors.Wrap(transientError{failed}, "galaxy")))
+
+	// Timeouts of any stage
+	timedOut := timeoutError{errors.New("Execution timed out after 2h0m0s")}
+	assert.Equal(t, exitRunTimedOut, onceExitCode(runStageError{stage: runStagePlaybook, exitCode: timeoutExitCode, err: timedOut}))
+	assert.Equal(t, exitRunTimedOut, onceExitCode(inRunStage(runStageDownload, timedOut)))
+
+	// Stages don't change what the error says or how it is classified
+	assert.Equal(t, "failed", inRunStage(runStageDownload, failed).Error())
+	assert.True(t, isTransient(inRunStage(runStageDownload, transientError{failed})))
+}
@@ -0,0 +1,259 @@
+// Fingerprints of run failures, so that the same failure on many hosts can be grouped centrally, and the table of
+// the distinct failures of this host
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Distinct fingerprints labelled in promRunFailures, later ones are counted as failureFingerprintOther
+	maxFailureFingerprintLabels = 50
+	failureFingerprintOther     = "other"
+
+	maxFailureMessageLength = 300
+
+	failureTableFileName = "failures.json"
+
+	// Distinct failures kept in the failure table, the least recently seen are dropped first
+	maxFailureRecords = 200
+)
+
+// runFailure describes why a run failed, independent of the host and of the details that vary between runs.
+type runFailure struct {
+	Fingerprint string `json:"fingerprint"`      // Hash of the task, module and message
+	Task        string `json:"task,omitempty"`   // Task that failed, empty if the run failed before Ansible did
+	Module      string `json:"module,omitempty"` // Module of the task that failed
+	Message     string `json:"message"`          // Normalized error message
+}
+
+// Details of error messages that vary between hosts and runs, replaced in this order
+var failureMessageReplacements = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`(/tmp|/var/tmp|\.ansible/tmp)/[^\s'":,]+`), "<tmp>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8,}\b`), "<hex>"},
+	{regexp.MustCompile(`\d+`), "<n>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+var failureLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+// normalizeFailureMessage removes what varies between hosts and runs from an error message: the host name, IDs,
+// temporary paths, addresses and numbers.
+func normalizeFailureMessage(message string) string {
+	if hostname != "" {
+		message = strings.Replace(message, hostname, "<host>", -1)
+	}
+	for _, replacement := range failureMessageReplacements {
+		message = replacement.pattern.ReplaceAllString(message, replacement.replacement)
+	}
+	message = strings.TrimSpace(message)
+
+	if runes := []rune(message); len(runes) > maxFailureMessageLength {
+		message = string(runes[:maxFailureMessageLength])
+	}
+	return message
+}
+
+// newRunFailure describes the failure of a run from its error and the report of Ansible, which is nil if the run
+// failed before Ansible ran. It returns nil for successful runs.
+//
+// The last task that failed is taken as the cause, as earlier failures may have been ignored.
+func newRunFailure(err error, report *RunReport) *runFailure {
+	if err == nil {
+		return nil
+	}
+
+	failure := &runFailure{Message: err.Error()}
+	if report != nil {
+		for i := len(report.Tasks) - 1; i >= 0; i-- {
+			task := report.Tasks[i]
+			if len(task.Messages) == 0 {
+				continue
+			}
+
+			hosts := make([]string, 0, len(task.Messages))
+			for host := range task.Messages {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			failure.Task, failure.Module, failure.Message = task.Name, task.Module, task.Messages[hosts[0]]
+			break
+		}
+	}
+
+	failure.Message = normalizeFailureMessage(failure.Message)
+	sum := sha256.Sum256([]byte(failure.Task + "\x00" + failure.Module + "\x00" + failure.Message))
+	failure.Fingerprint = hex.EncodeToString(sum[:])[:16]
+	return failure
+}
+
+// failureLabel returns the metric label of a fingerprint, limiting the number of distinct labels.
+func failureLabel(fingerprint string) string {
+	failureLabels.Lock()
+	defer failureLabels.Unlock()
+
+	if !failureLabels.seen[fingerprint] {
+		if len(failureLabels.seen) >= maxFailureFingerprintLabels {
+			return failureFingerprintOther
+		}
+		failureLabels.seen[fingerprint] = true
+	}
+
+	return fingerprint
+}
+
+// failureRecord counts the runs that failed with the same fingerprint, as returned by the API.
+type failureRecord struct {
+	runFailure
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+	LastRunID string    `json:"last_run_id"`
+}
+
+// failureTable keeps the distinct failures of the runs of this host.
+type failureTable struct {
+	mutex   sync.Mutex
+	path    string // File the records are persisted to, not persisted if empty
+	records map[string]*failureRecord
+}
+
+func newFailureTable() *failureTable {
+	return &failureTable{records: map[string]*failureRecord{}}
+}
+
+var failures = newFailureTable()
+
+// setupFailureTable loads the persisted failure table from the state directory.
+func setupFailureTable() {
+	table := newFailureTable()
+	table.path = filepath.Join(stateDir(), failureTableFileName)
+	if err := table.load(); err != nil {
+		logrus.Warnln("Starting with an empty failure table: ", err)
+	}
+
+	failures = table
+}
+
+func (f *failureTable) load() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	data, err := readStateFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to read failure table")
+	}
+
+	var records []*failureRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrap(err, "unable to parse failure table")
+	}
+	for _, record := range records {
+		f.records[record.Fingerprint] = record
+	}
+
+	return nil
+}
+
+// save persists the records. The caller must hold the mutex.
+func (f *failureTable) save() {
+	if f.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(f.listLocked())
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(f.path), 0700)
+	}
+	if err == nil {
+		err = writeStateFile(f.path, data)
+	}
+	if err != nil {
+		logrus.Warnln("Unable to persist failure table: ", err)
+	}
+}
+
+// record counts a failed run, dropping the least recently seen failure if the table is full.
+func (f *failureTable) record(runID string, failure *runFailure, now time.Time) {
+	if failure == nil {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	record, ok := f.records[failure.Fingerprint]
+	if !ok {
+		record = &failureRecord{runFailure: *failure, FirstSeen: now}
+		f.records[failure.Fingerprint] = record
+	}
+	record.LastSeen = now
+	record.Count++
+	record.LastRunID = runID
+
+	if len(f.records) > maxFailureRecords {
+		records := f.listLocked()
+		delete(f.records, records[len(records)-1].Fingerprint)
+	}
+
+	f.save()
+}
+
+// list returns copies of the records, most recently seen first.
+func (f *failureTable) list() []failureRecord {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.listLocked()
+}
+
+func (f *failureTable) listLocked() []failureRecord {
+	records := make([]failureRecord, 0, len(f.records))
+	for _, record := range f.records {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].LastSeen.Equal(records[j].LastSeen) {
+			return records[i].LastSeen.After(records[j].LastSeen)
+		}
+		return records[i].Fingerprint < records[j].Fingerprint
+	})
+
+	return records
+}
+
+// HandlerFailures returns the distinct failures of the runs of this host, most recently seen first.
+func HandlerFailures(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(failures.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
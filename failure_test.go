@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeFailureMessage(t *testing.T) {
+	originalHostname := hostname
+	hostname = "web1.example.com"
+	defer func() { hostname = originalHostname }()
+
+	assert.Equal(t,
+		"Failed to connect to <ip> from <host> after <n> attempts, see <tmp>",
+		normalizeFailureMessage("Failed to connect to 10.1.2.3:8080 from web1.example.com after 3 attempts,\n  see /tmp/ansible_xyz/out.log"),
+	)
+	assert.Equal(t,
+		"Run <uuid> failed on commit <hex>",
+		normalizeFailureMessage("Run 0b7e3c2a-9f1d-4c6e-8a5b-1234567890ab failed on commit deadbeef1234"),
+	)
+	assert.Len(t, []rune(normalizeFailureMessage(string(make([]rune, 1000)))), maxFailureMessageLength)
+}
+
+func TestNewRunFailure(t *testing.T) {
+	assert.Nil(t, newRunFailure(nil, nil))
+
+	// Failures before Ansible ran have no task
+	failure := newRunFailure(errors.New("unable to download artifact: 503"), nil)
+	assert.Equal(t, "", failure.Task)
+	assert.Equal(t, "unable to download artifact: <n>", failure.Message)
+	assert.Len(t, failure.Fingerprint, 16)
+
+	report := newRunReport(loadTestRunOutput(t))
+	failure = newRunFailure(errors.New("ansible-playbook exited with 2"), &report)
+	assert.Equal(t, "Start service", report.Tasks[2].Name)
+	assert.Equal(t, runFailure{
+		Fingerprint: failure.Fingerprint,
+		Task:        "Start service",
+		Module:      "service",
+		Message:     "Could not find the requested service puller: host",
+	}, *failure)
+}
+
+func TestNewRunFailureTakesLastFailedTask(t *testing.T) {
+	report := &RunReport{Tasks: []TaskReport{
+		{Name: "ignored", Module: "command", Messages: map[string]string{"web1": "ignored failure"}},
+		{Name: "fails", Module: "shell", Messages: map[string]string{"web2": "second", "web1": "first"}},
+		{Name: "after", Module: "debug"},
+	}}
+
+	failure := newRunFailure(errors.New("failed"), report)
+	assert.Equal(t, "fails", failure.Task)
+	assert.Equal(t, "shell", failure.Module)
+	assert.Equal(t, "first", failure.Message)
+}
+
+func TestRunFailureFingerprint(t *testing.T) {
+	failed := func(task, message string) *runFailure {
+		return newRunFailure(errors.New("failed"), &RunReport{Tasks: []TaskReport{
+			{Name: task, Module: "get_url", Messages: map[string]string{"localhost": message}},
+		}})
+	}
+
+	first := failed("Download", "Request to 10.0.0.1:443 failed after 30s, saved to /tmp/tmpa1b2c3")
+	second := failed("Download", "Request to 10.0.0.2:443 failed after 31s, saved to /tmp/tmpz9y8x7")
+	assert.Equal(t, first.Fingerprint, second.Fingerprint)
+	assert.NotEqual(t, first.Fingerprint, failed("Fetch", first.Message).Fingerprint)
+}
+
+func TestFailureLabel(t *testing.T) {
+	failureLabels.Lock()
+	originalSeen := failureLabels.seen
+	failureLabels.seen = map[string]bool{}
+	failureLabels.Unlock()
+	defer func() {
+		failureLabels.Lock()
+		failureLabels.seen = originalSeen
+		failureLabels.Unlock()
+	}()
+
+	for i := 0; i < maxFailureFingerprintLabels; i++ {
+		fingerprint := fmt.Sprintf("%016x", i)
+		assert.Equal(t, fingerprint, failureLabel(fingerprint))
+	}
+	assert.Equal(t, failureFingerprintOther, failureLabel("ffffffffffffffff"))
+	// Fingerprints already labelled keep their label
+	assert.Equal(t, fmt.Sprintf("%016x", 0), failureLabel(fmt.Sprintf("%016x", 0)))
+}
+
+func TestFailureTable(t *testing.T) {
+	table := newFailureTable()
+	table.path = filepath.Join(t.TempDir(), failureTableFileName)
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	download := &runFailure{Fingerprint: "aaaa", Message: "unable to download artifact"}
+	service := &runFailure{Fingerprint: "bbbb", Task: "Start service", Module: "service", Message: "not found"}
+
+	table.record("a", download, start)
+	table.record("b", service, start.Add(time.Hour))
+	table.record("c", download, start.Add(2*time.Hour))
+	table.record("d", nil, start.Add(3*time.Hour))
+
+	records := table.list()
+	assert.Len(t, records, 2)
+	assert.Equal(t, failureRecord{
+		runFailure: *download,
+		FirstSeen:  start,
+		LastSeen:   start.Add(2 * time.Hour),
+		Count:      2,
+		LastRunID:  "c",
+	}, records[0])
+	assert.Equal(t, "bbbb", records[1].Fingerprint)
+	assert.Equal(t, 1, records[1].Count)
+
+	loaded := newFailureTable()
+	loaded.path = table.path
+	assert.Nil(t, loaded.load())
+	assert.Equal(t, len(records), len(loaded.list()))
+	assert.True(t, loaded.list()[0].FirstSeen.Equal(start))
+}
+
+func TestFailureTableEviction(t *testing.T) {
+	table := newFailureTable()
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxFailureRecords; i++ {
+		table.record("run", &runFailure{Fingerprint: fmt.Sprintf("%016x", i)}, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	records := table.list()
+	assert.Len(t, records, maxFailureRecords)
+	assert.Equal(t, fmt.Sprintf("%016x", maxFailureRecords), records[0].Fingerprint)
+	assert.Equal(t, fmt.Sprintf("%016x", 1), records[len(records)-1].Fingerprint)
+}
+
+func TestHandlerFailures(t *testing.T) {
+	originalFailures := failures
+	failures = newFailureTable()
+	defer func() { failures = originalFailures }()
+	failures.record("a", &runFailure{Fingerprint: "aaaa", Message: "failed"}, time.Now())
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerFailures).ServeHTTP(rr, httptest.NewRequest("GET", httpPathFailures, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response, 1)
+	assert.Equal(t, "aaaa", response[0]["fingerprint"])
+	assert.Equal(t, float64(1), response[0]["count"])
+	assert.Equal(t, "a", response[0]["last_run_id"])
+}
@@ -0,0 +1,240 @@
+// Downloading the artifact ahead of time, to apply it later without contacting the artifact source
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+)
+
+// Fetch states
+const (
+	fetchRunning   = "running"
+	fetchCompleted = "completed"
+	fetchFailed    = "failed"
+)
+
+// artifactFetch is the progress and result of a fetch, as returned by the API.
+type artifactFetch struct {
+	Status    string     `json:"status"`
+	Version   string     `json:"version"` // MD5 of the fetched artifact
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var (
+	fetchMutex sync.Mutex
+	lastFetch  *artifactFetch // The running or last finished fetch
+)
+
+// fetchedArtifactFile is where a fetched artifact waits until it is applied.
+func fetchedArtifactFile() string {
+	return localCacheFile + ".fetched"
+}
+
+// getFetch returns a copy of the running or last finished fetch, nil if there was none.
+func getFetch() *artifactFetch {
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
+	if lastFetch == nil {
+		return nil
+	}
+	fetch := *lastFetch
+	return &fetch
+}
+
+// startFetch starts a fetch in the background, failing if one is running.
+func startFetch() (*artifactFetch, error) {
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
+	if lastFetch != nil && lastFetch.Status == fetchRunning {
+		return nil, errors.New("a fetch is already running")
+	}
+
+	lastFetch = &artifactFetch{Status: fetchRunning, StartTime: time.Now()}
+	fetch := *lastFetch
+
+	go runFetch()
+	return &fetch, nil
+}
+
+func runFetch() {
+	version, err := fetchArtifact()
+
+	fetchMutex.Lock()
+	now := time.Now()
+	lastFetch.EndTime = &now
+	lastFetch.Version = version
+	lastFetch.Status = fetchCompleted
+	if err != nil {
+		lastFetch.Status = fetchFailed
+		lastFetch.Error = err.Error()
+	}
+	fetchMutex.Unlock()
+
+	if err != nil {
+		downloaderLog.Errorln("Fetching the artifact failed: ", err)
+	}
+}
+
+// fetchArtifact downloads and verifies the configured remote artifact to fetchedArtifactFile, returning its MD5.
+func fetchArtifact() (string, error) {
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to fetch the artifact")
+	}
+
+	version, err := fetchArtifactTo(downloader, remotePath, fetchedArtifactFile())
+	if err != nil {
+		return "", err
+	}
+	downloaderLog.Infof("Fetched artifact %s, it is applied by the next POST %s", version, httpPathApply)
+	return version, nil
+}
+
+// fetchArtifactTo downloads the remote artifact to path if it changed, and verifies it as configured.
+func fetchArtifactTo(downloader downloader, remotePath, path string) (string, error) {
+	// Also keeps an apply from promoting the artifact halfway through
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	downloaderLog.Infof("Fetching artifact: %s", remotePath)
+	err := retryPolicyFromConfig().do(retryOperationDownload, func() error {
+		return idempotentFileDownload(downloader, remotePath, path)
+	})
+	if err != nil {
+		os.Remove(path)
+		return "", errors.Wrap(err, "unable to fetch the artifact")
+	}
+	if err := verifyArtifact(downloader, remotePath, path); err != nil {
+		return "", err
+	}
+
+	version, err := md5sum(path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to checksum the fetched artifact")
+	}
+	return version, nil
+}
+
+// applyFetchedArtifact makes the fetched artifact the local copy of the artifact and extracts it into runDir.
+func applyFetchedArtifact(runDir string, runSpan *span) error {
+	if _, err := os.Stat(fetchedArtifactFile()); err != nil {
+		return errors.Wrap(err, "no fetched artifact to apply")
+	}
+	if err := promoteStagedArtifact(fetchedArtifactFile(), localCacheFile); err != nil {
+		return errors.Wrap(err, "unable to use the fetched artifact")
+	}
+
+	return extractCachedArtifact(runDir, runSpan)
+}
+
+// HandlerFetch starts downloading and verifying the artifact without applying it. Its progress can be polled with
+// HandlerFetchStatus, and the artifact applied with HandlerApply.
+func HandlerFetch(w http.ResponseWriter, r *http.Request) {
+	fetch, err := startFetch()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	data, err := json.Marshal(fetch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandlerFetchStatus returns the running or last finished fetch.
+func HandlerFetchStatus(w http.ResponseWriter, r *http.Request) {
+	fetch := getFetch()
+	if fetch == nil {
+		http.Error(w, "no fetch since the puller started", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(fetch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerApply queues a run of the fetched artifact, which does not contact the artifact source.
+//
+// It responds like HandlerRun, and with the version of the artifact that is applied.
+func HandlerApply(w http.ResponseWriter, r *http.Request) {
+	if ansibleDisabled {
+		http.Error(w, "ansible puller is disabled", http.StatusConflict)
+		return
+	}
+	if err := checkChangeWindow(); err != nil {
+		http.Error(w, "refused by change management: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err := checkBlackout(); err != nil {
+		http.Error(w, "refused: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if fetch := getFetch(); fetch != nil && fetch.Status == fetchRunning {
+		http.Error(w, "a fetch is still running", http.StatusConflict)
+		return
+	}
+	version, err := md5sum(fetchedArtifactFile())
+	if os.IsNotExist(err) {
+		http.Error(w, "no fetched artifact to apply, POST "+httpPathFetch+" first", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pin := currentPin(); pin != nil && pin.Version != version {
+		http.Error(w, "pinned to artifact "+pin.Version+", unpin first", http.StatusConflict)
+		return
+	}
+	if err := runQuotas.allow(runSourceAPI); err != nil {
+		httpQuotaExceeded(w, err)
+		return
+	}
+
+	spec := runSpec{
+		ID:       uuid.NewV4().String(),
+		Playbook: viper.GetString("ansible-playbook"),
+		Trigger:  runTriggerApply,
+		Fetched:  true,
+	}
+	startRun(spec)
+
+	data, err := json.Marshal(map[string]string{
+		"run_id":     spec.ID,
+		"status":     runStatusQueued,
+		"status_url": strings.Replace(httpPathRunStatus, "{id}", spec.ID, 1),
+		"version":    version,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchArtifactTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifact.tgz.fetched")
+	d := &staticDownloader{checksum: testMD5}
+
+	version, err := fetchArtifactTo(d, "remote", path)
+	assert.Nil(t, err)
+	assert.Equal(t, testMD5, version)
+	assert.Equal(t, 1, d.downloads)
+
+	// Fetching an unchanged artifact again does not download it
+	version, err = fetchArtifactTo(d, "remote", path)
+	assert.Nil(t, err)
+	assert.Equal(t, testMD5, version)
+	assert.Equal(t, 1, d.downloads)
+}
+
+func TestFetchArtifactToRemovesInvalidDownload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifact.tgz.fetched")
+	d := &staticDownloader{checksum: "0123456789abcdef0123456789abcdef"}
+
+	_, err := fetchArtifactTo(d, "remote", path)
+	assert.NotNil(t, err)
+	assert.NoFileExists(t, path)
+}
+
+func TestApplyFetchedArtifact(t *testing.T) {
+	dir := t.TempDir()
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(dir, "artifact.tgz")
+	defer func() { localCacheFile = originalCacheFile }()
+	defer withArtifactCache(t, 3, 0)()
+
+	runDir := filepath.Join(dir, "run")
+	assert.NotNil(t, applyFetchedArtifact(runDir, nil), "nothing was fetched")
+
+	good, err := ioutil.ReadFile("testdata/good.tgz")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(fetchedArtifactFile(), good, 0644))
+	assert.Nil(t, applyFetchedArtifact(runDir, nil))
+	assert.NoFileExists(t, fetchedArtifactFile())
+	assert.FileExists(t, localCacheFile)
+
+	entries, err := ioutil.ReadDir(runDir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, entries)
+
+	// Applied artifacts are cached
+	version, err := md5sum(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{version}, cachedVersions(t))
+}
+
+func TestApplyEndpointWithoutFetch(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(t.TempDir(), "artifact.tgz")
+	defer func() { localCacheFile = originalCacheFile }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerApply).ServeHTTP(rr, httptest.NewRequest("POST", "/apply", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "no fetched artifact")
+	_, err := os.Stat(localCacheFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFetchStatusEndpoint(t *testing.T) {
+	originalFetch := lastFetch
+	defer func() { lastFetch = originalFetch }()
+
+	lastFetch = nil
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerFetchStatus).ServeHTTP(rr, httptest.NewRequest("GET", "/fetch", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	lastFetch = &artifactFetch{Status: fetchCompleted, Version: testMD5}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HandlerFetchStatus).ServeHTTP(rr, httptest.NewRequest("GET", "/fetch", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"version":"`+testMD5+`"`)
+}
@@ -0,0 +1,48 @@
+// File creation defaults for the puller and the processes it starts
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Mode of the run directory and of the directories extracted from the artifact
+var workDirMode os.FileMode = 0700
+
+// parseFileMode parses an octal permission string such as "0027".
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("invalid permissions %q, expected octal such as 0027", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// setupFileModes applies the configured umask and working directory permissions.
+//
+// The umask is set for the whole puller process, so it applies to extraction and is inherited by
+// the venv and Ansible processes.
+func setupFileModes() error {
+	mode, err := parseFileMode(viper.GetString("work-dir-mode"))
+	if err != nil {
+		return errors.Wrap(err, "work-dir-mode")
+	}
+	workDirMode = mode
+
+	if s := viper.GetString("umask"); s != "" {
+		mask, err := parseFileMode(s)
+		if err != nil {
+			return errors.Wrap(err, "umask")
+		}
+		if err := setUmask(mask); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFileMode(t *testing.T) {
+	mode, err := parseFileMode("0027")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0027), mode)
+
+	mode, err = parseFileMode("750")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), mode)
+
+	for _, invalid := range []string{"", "rwx", "0899", "01777"} {
+		_, err = parseFileMode(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
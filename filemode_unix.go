@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func setUmask(mask os.FileMode) error {
+	syscall.Umask(int(mask))
+	return nil
+}
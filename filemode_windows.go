@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func setUmask(mask os.FileMode) error {
+	return errors.New("umask is not supported on windows")
+}
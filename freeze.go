@@ -0,0 +1,444 @@
+// Change freezes during which scheduled runs are skipped, e.g. over the holidays, from dates in the config or an
+// iCalendar
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Copy of the last calendar fetched from freeze-calendar, used until it can be fetched again
+const freezeCalendarFileName = "freeze-calendar.ics"
+
+// Dates in freeze-dates, and those of iCalendar dates and times
+const (
+	freezeDateLayout       = "2006-01-02"
+	freezeYearlyDateLayout = "01-02"
+	icalDateLayout         = "20060102"
+	icalTimeLayout         = "20060102T150405"
+)
+
+// Dates from the "freeze-dates" option
+var freezeDates []freezeDate
+
+// freezePeriod is a change freeze, from Start until End.
+type freezePeriod struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+// freezeDate is a day or range of days of freeze-dates, every year if the year is left out.
+type freezeDate struct {
+	spec   string
+	start  time.Time // Only the date matters, and only month and day if yearly
+	end    time.Time // Last day of the freeze
+	yearly bool
+}
+
+// freezeCalendar holds the freezes of freeze-calendar, fetched again every freeze-calendar-refresh minutes.
+var freezeCalendar = struct {
+	sync.Mutex
+	periods []freezePeriod
+	fetched time.Time // When it was last fetched, also if that failed
+}{}
+
+// setupFreezes parses the "freeze-dates" option and checks the "freeze-calendar" source.
+func setupFreezes() error {
+	dates := []freezeDate{}
+	for _, spec := range viper.GetStringSlice("freeze-dates") {
+		date, err := parseFreezeDate(spec)
+		if err != nil {
+			return err
+		}
+		dates = append(dates, date)
+	}
+
+	source := viper.GetString("freeze-calendar")
+	if strings.Contains(source, "://") && !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return errors.Errorf("invalid freeze-calendar %q, expected a file or an http or https URL", source)
+	}
+
+	freezeDates = dates
+	freezeCalendar.Lock()
+	freezeCalendar.periods, freezeCalendar.fetched = nil, time.Time{}
+	freezeCalendar.Unlock()
+	return nil
+}
+
+// parseFreezeDate parses a freeze like "2026-12-24", "2026-12-20..2027-01-02", or "12-24" and "12-20..01-02" for one
+// every year.
+func parseFreezeDate(spec string) (freezeDate, error) {
+	date := freezeDate{spec: spec}
+	bounds := strings.Split(spec, "..")
+	if len(bounds) > 2 {
+		return date, errors.Errorf("invalid freeze date %q, expected a date or a range of dates", spec)
+	}
+
+	layout := freezeDateLayout
+	if len(bounds[0]) == len(freezeYearlyDateLayout) {
+		layout, date.yearly = freezeYearlyDateLayout, true
+	}
+	var err error
+	if date.start, err = time.Parse(layout, bounds[0]); err != nil {
+		return date, errors.Errorf("invalid freeze date %q, expected YYYY-MM-DD or MM-DD", spec)
+	}
+	date.end = date.start
+	if len(bounds) == 2 {
+		if date.end, err = time.Parse(layout, bounds[1]); err != nil {
+			return date, errors.Errorf("invalid end of freeze %q, expected the format of its start", spec)
+		}
+	}
+	if !date.yearly && date.end.Before(date.start) {
+		return date, errors.Errorf("invalid freeze %q, it ends before it starts", spec)
+	}
+
+	return date, nil
+}
+
+// periods returns the freezes of d around now, in the configured time zone.
+func (d freezeDate) periods(now time.Time) []freezePeriod {
+	day := func(date time.Time, year int) time.Time {
+		return time.Date(year, date.Month(), date.Day(), 0, 0, 0, 0, pullerLocation)
+	}
+	if !d.yearly {
+		return []freezePeriod{{Name: d.spec, Start: day(d.start, d.start.Year()), End: day(d.end, d.end.Year()).AddDate(0, 0, 1)}}
+	}
+
+	// Yearly freezes may span the new year
+	periods := []freezePeriod{}
+	for year := pullerTime(now).Year() - 1; year <= pullerTime(now).Year()+1; year++ {
+		endYear := year
+		if d.end.Before(d.start) {
+			endYear++
+		}
+		periods = append(periods, freezePeriod{Name: d.spec, Start: day(d.start, year), End: day(d.end, endYear).AddDate(0, 0, 1)})
+	}
+	return periods
+}
+
+// parseICalendar returns the events of an iCalendar as freezes. Events without an end last a day if they are all-day
+// events. Cancelled events are left out. Recurring events aren't expanded, so calendars with any are rejected rather
+// than missing their later occurrences.
+func parseICalendar(data []byte) ([]freezePeriod, error) {
+	// Long lines are folded, continuing on lines starting with whitespace
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 || strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff")) != "BEGIN:VCALENDAR" {
+		return nil, errors.New("not an iCalendar, expected BEGIN:VCALENDAR")
+	}
+
+	periods := []freezePeriod{}
+	var event *freezePeriod
+	allDay, cancelled, recurs := false, false, false
+	for _, line := range lines {
+		name, params, value := parseICalLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			event, allDay, cancelled, recurs = &freezePeriod{}, false, false, false
+		case event == nil:
+		case name == "END" && value == "VEVENT":
+			if recurs && !cancelled {
+				return nil, errors.Errorf("event %q recurs, which is not supported, list its occurrences as events instead", event.Name)
+			}
+			if event.End.IsZero() && allDay {
+				event.End = event.Start.AddDate(0, 0, 1)
+			}
+			if !event.Start.IsZero() && event.End.After(event.Start) && !cancelled {
+				periods = append(periods, *event)
+			}
+			event = nil
+		case name == "SUMMARY":
+			event.Name = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, " ").Replace(value)
+		case name == "STATUS":
+			cancelled = value == "CANCELLED"
+		case name == "RRULE" || name == "RDATE":
+			recurs = true
+		case name == "DTSTART" || name == "DTEND":
+			t, date, err := parseICalTime(params, value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s of event %q", name, event.Name)
+			}
+			if name == "DTSTART" {
+				event.Start, allDay = t, date
+			} else {
+				event.End = t
+			}
+		}
+	}
+
+	return periods, nil
+}
+
+// parseICalLine splits a content line like DTSTART;TZID=Europe/Berlin:20261224T090000 into its name, parameters and
+// value.
+func parseICalLine(line string) (string, map[string]string, string) {
+	line = strings.TrimRight(line, "\r")
+	quoted, colon := false, -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, ""
+	}
+
+	fields := strings.Split(line[:colon], ";")
+	params := map[string]string{}
+	for _, param := range fields[1:] {
+		if parts := strings.SplitN(param, "=", 2); len(parts) == 2 {
+			params[strings.ToUpper(parts[0])] = strings.Trim(parts[1], `"`)
+		}
+	}
+	return strings.ToUpper(fields[0]), params, line[colon+1:]
+}
+
+// parseICalTime parses an iCalendar date or time, reporting whether it is a date. Dates and floating times are in
+// the configured time zone.
+func parseICalTime(params map[string]string, value string) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(icalDateLayout) {
+		t, err := time.ParseInLocation(icalDateLayout, value, pullerLocation)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icalTimeLayout+"Z", value)
+		return t, false, err
+	}
+
+	location := pullerLocation
+	if tzid := params["TZID"]; tzid != "" {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			location = tz
+		} else {
+			logrus.Debugf("Unknown time zone %s in freeze-calendar, using the configured one", tzid)
+		}
+	}
+	t, err := time.ParseInLocation(icalTimeLayout, value, location)
+	return t, false, err
+}
+
+func freezeCalendarCachePath() string {
+	return filepath.Join(stateDir(), freezeCalendarFileName)
+}
+
+// fetchFreezeCalendar reads the calendar at source, a file or an http or https URL.
+func fetchFreezeCalendar(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// calendarFreezes returns the freezes of freeze-calendar, fetching it again once it is older than
+// freeze-calendar-refresh. While it can't be fetched, the last calendar fetched is used, also across restarts.
+func calendarFreezes() []freezePeriod {
+	source := viper.GetString("freeze-calendar")
+	if source == "" {
+		return nil
+	}
+
+	freezeCalendar.Lock()
+	defer freezeCalendar.Unlock()
+
+	refresh := time.Duration(viper.GetInt("freeze-calendar-refresh")) * time.Minute
+	if !freezeCalendar.fetched.IsZero() && time.Since(freezeCalendar.fetched) < refresh {
+		return freezeCalendar.periods
+	}
+	freezeCalendar.fetched = time.Now()
+
+	data, err := fetchFreezeCalendar(source)
+	var periods []freezePeriod
+	if err == nil {
+		periods, err = parseICalendar(data)
+	}
+	if err != nil {
+		logrus.Warnf("Unable to read freeze-calendar %s, using the last calendar read: %v", source, err)
+		if freezeCalendar.periods == nil {
+			if data, cacheErr := ioutil.ReadFile(freezeCalendarCachePath()); cacheErr == nil {
+				freezeCalendar.periods, _ = parseICalendar(data)
+			}
+		}
+		return freezeCalendar.periods
+	}
+
+	freezeCalendar.periods = periods
+	if err := ensureStateDir(); err == nil {
+		if err := ioutil.WriteFile(freezeCalendarCachePath(), data, 0644); err != nil {
+			logrus.Warnln("Unable to keep a copy of freeze-calendar: ", err)
+		}
+	}
+	return periods
+}
+
+// activeFreeze returns the change freeze in effect at now, nil if there is none. It ends when the last of the
+// freezes following on from each other ends.
+func activeFreeze(now time.Time) *freezePeriod {
+	periods := calendarFreezes()
+	for _, date := range freezeDates {
+		periods = append(periods, date.periods(now)...)
+	}
+
+	var active *freezePeriod
+	for i := range periods {
+		if !now.Before(periods[i].Start) && now.Before(periods[i].End) {
+			active = &periods[i]
+			break
+		}
+	}
+	if active == nil {
+		return nil
+	}
+
+	freeze := *active
+	for extended := true; extended; {
+		extended = false
+		for _, period := range periods {
+			if !freeze.End.Before(period.Start) && freeze.End.Before(period.End) {
+				freeze.End, extended = period.End, true
+			}
+		}
+	}
+	return &freeze
+}
+
+// checkFreeze returns an error if scheduled runs must be skipped because of a change freeze that was not
+// overridden.
+func checkFreeze() error {
+	now := schedulerClock.Now()
+	freeze := activeFreeze(now)
+	if freeze == nil {
+		return nil
+	}
+
+	state, err := loadState()
+	if err != nil {
+		logrus.Warnln("Unable to load the override of the change freeze from the state: ", err)
+	}
+	if now.Before(state.FreezeOverrideUntil) {
+		logrus.Infof("Change freeze %s overridden until %s: %s", freeze.Name, pullerTime(state.FreezeOverrideUntil).Format(time.RFC3339), state.FreezeOverrideReason)
+		return nil
+	}
+
+	return errors.Errorf("in change freeze %s until %s", freeze.Name, pullerTime(freeze.End).Format(time.RFC3339))
+}
+
+// freezeStatus returns the change freeze in effect and its override for the status endpoint, nil if there is none.
+func freezeStatus() interface{} {
+	now := schedulerClock.Now()
+	freeze := activeFreeze(now)
+	if freeze == nil {
+		return nil
+	}
+
+	state, _ := loadState()
+	status := map[string]interface{}{
+		"name":             freeze.Name,
+		"start":            statusTime(freeze.Start),
+		"end":              statusTime(freeze.End),
+		"overridden_until": nil,
+		"override_reason":  "",
+	}
+	if now.Before(state.FreezeOverrideUntil) {
+		status["overridden_until"] = statusTime(state.FreezeOverrideUntil)
+		status["override_reason"] = state.FreezeOverrideReason
+	}
+	return status
+}
+
+// freezeOverrideRequest is the body of POST /freeze/override.
+type freezeOverrideRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // Until the freeze in effect ends if empty
+}
+
+func writeFreezeStatus(w http.ResponseWriter) {
+	data, err := json.Marshal(map[string]interface{}{"change_freeze": freezeStatus()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerFreezeOverride lets scheduled runs happen during a change freeze, for a duration or until the freeze in
+// effect ends.
+func HandlerFreezeOverride(w http.ResponseWriter, r *http.Request) {
+	var request freezeOverrideRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid override request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, "duration must be a positive duration, e.g. 4h", http.StatusBadRequest)
+			return
+		}
+		until = schedulerClock.Now().Add(duration)
+	} else if freeze := activeFreeze(schedulerClock.Now()); freeze != nil {
+		until = freeze.End
+	} else {
+		http.Error(w, "no change freeze in effect, give the duration of the override", http.StatusConflict)
+		return
+	}
+
+	if err := updateState(func(state *PullerState) {
+		state.FreezeOverrideUntil = until
+		state.FreezeOverrideReason = request.Reason
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logrus.Infof("Change freezes overridden until %s: %s", pullerTime(until).Format(time.RFC3339), request.Reason)
+	writeFreezeStatus(w)
+}
+
+// HandlerFreezeOverrideRemove ends the override of HandlerFreezeOverride.
+func HandlerFreezeOverrideRemove(w http.ResponseWriter, r *http.Request) {
+	if err := updateState(func(state *PullerState) {
+		state.FreezeOverrideUntil = time.Time{}
+		state.FreezeOverrideReason = ""
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logrus.Infoln("Removed the override of change freezes")
+	writeFreezeStatus(w)
+}
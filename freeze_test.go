@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withFreezes configures freeze-dates and freeze-calendar, restoring the configuration after the test.
+func withFreezes(t *testing.T, dates []string, calendar string) {
+	// Set up again once the settings are restored, as cleanups run last first
+	t.Cleanup(func() { assert.Nil(t, setupFreezes()) })
+	for _, key := range []string{"freeze-dates", "freeze-calendar", "state-dir"} {
+		key, original := key, viper.Get(key)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+	viper.Set("freeze-dates", dates)
+	viper.Set("freeze-calendar", calendar)
+	viper.Set("state-dir", t.TempDir())
+	assert.Nil(t, setupFreezes())
+}
+
+func TestParseFreezeDate(t *testing.T) {
+	for _, spec := range []string{"2026-12-24", "2026-12-20..2027-01-02", "12-24", "12-20..01-02"} {
+		_, err := parseFreezeDate(spec)
+		assert.Nil(t, err, spec)
+	}
+	for _, spec := range []string{"", "24.12.", "2026-12-24..01-02", "2027-01-02..2026-12-20", "12-20..01-02..01-05"} {
+		_, err := parseFreezeDate(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestActiveFreeze(t *testing.T) {
+	withFreezes(t, []string{"12-20..12-31", "2027-01-01..2027-01-02", "07-04"}, "")
+	day := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, pullerLocation)
+	}
+
+	assert.Nil(t, activeFreeze(day(2026, time.December, 19, 23)))
+	assert.Nil(t, activeFreeze(day(2027, time.January, 3, 0)))
+
+	// Freezes following on from each other end with the last one
+	freeze := activeFreeze(day(2026, time.December, 20, 0))
+	assert.Equal(t, "12-20..12-31", freeze.Name)
+	assert.Equal(t, day(2027, time.January, 3, 0), freeze.End)
+
+	// Yearly
+	freeze = activeFreeze(day(2030, time.July, 4, 12))
+	assert.Equal(t, day(2030, time.July, 5, 0), freeze.End)
+}
+
+const testFreezeCalendar = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Christmas\\, freeze\r\nDTSTART;VALUE=DATE:20261224\r\nDTEND;VALUE=DATE:20261227\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Release\r\nDTSTART:20261201T080000Z\r\nDTEND:20261201T1\r\n 60000Z\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:New year\r\nDTSTART;VALUE=DATE:20270101\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Cancelled\r\nSTATUS:CANCELLED\r\nDTSTART;VALUE=DATE:20261101\r\nEND:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICalendar(t *testing.T) {
+	periods, err := parseICalendar([]byte(testFreezeCalendar))
+	assert.Nil(t, err)
+	assert.Equal(t, []freezePeriod{
+		{Name: "Christmas, freeze", Start: time.Date(2026, time.December, 24, 0, 0, 0, 0, pullerLocation), End: time.Date(2026, time.December, 27, 0, 0, 0, 0, pullerLocation)},
+		{Name: "Release", Start: time.Date(2026, time.December, 1, 8, 0, 0, 0, time.UTC), End: time.Date(2026, time.December, 1, 16, 0, 0, 0, time.UTC)},
+		{Name: "New year", Start: time.Date(2027, time.January, 1, 0, 0, 0, 0, pullerLocation), End: time.Date(2027, time.January, 2, 0, 0, 0, 0, pullerLocation)},
+	}, periods)
+
+	_, err = parseICalendar([]byte("<html></html>"))
+	assert.NotNil(t, err)
+
+	// Later occurrences of recurring events would be missed
+	recurring := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Quarter end\r\nDTSTART;VALUE=DATE:20260930\r\n" +
+		"RRULE:FREQ=MONTHLY;INTERVAL=3\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	_, err = parseICalendar([]byte(recurring))
+	assert.EqualError(t, err, `event "Quarter end" recurs, which is not supported, list its occurrences as events instead`)
+	_, err = parseICalendar([]byte(strings.Replace(recurring, "RRULE", "STATUS:CANCELLED\r\nRRULE", 1)))
+	assert.Nil(t, err)
+}
+
+func TestCalendarFreezes(t *testing.T) {
+	served := testFreezeCalendar
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(served))
+	}))
+	defer server.Close()
+	withFreezes(t, nil, server.URL)
+
+	christmas := time.Date(2026, time.December, 25, 12, 0, 0, 0, pullerLocation)
+	assert.Equal(t, "Christmas, freeze", activeFreeze(christmas).Name)
+	assert.FileExists(t, freezeCalendarCachePath())
+
+	// After a restart the copy is used while the calendar can't be fetched
+	served = ""
+	assert.Nil(t, setupFreezes())
+	assert.Equal(t, "Christmas, freeze", activeFreeze(christmas).Name)
+}
+
+func TestFreezeOverride(t *testing.T) {
+	withFreezes(t, []string{"01-01..12-31"}, "")
+	assert.Contains(t, checkFreeze().Error(), "in change freeze 01-01..12-31 until")
+
+	req, _ := http.NewRequest("POST", httpPathFreezeOverride, strings.NewReader(`{"reason": "security fix", "duration": "2h"}`))
+	rr := httptest.NewRecorder()
+	HandlerFreezeOverride(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"override_reason":"security fix"`)
+	assert.Nil(t, checkFreeze())
+
+	rr = httptest.NewRecorder()
+	HandlerFreezeOverrideRemove(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotNil(t, checkFreeze())
+
+	req, _ = http.NewRequest("POST", httpPathFreezeOverride, strings.NewReader(`{"duration": "-1h"}`))
+	rr = httptest.NewRecorder()
+	HandlerFreezeOverride(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Without a freeze in effect the override needs a duration
+	withFreezes(t, nil, filepath.Join(t.TempDir(), "missing.ics"))
+	req, _ = http.NewRequest("POST", httpPathFreezeOverride, strings.NewReader(""))
+	rr = httptest.NewRecorder()
+	HandlerFreezeOverride(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestSetupFreezesInvalidCalendar(t *testing.T) {
+	withFreezes(t, nil, "")
+	viper.Set("freeze-calendar", "s3://bucket/freezes.ics")
+	assert.NotNil(t, setupFreezes())
+
+	path := filepath.Join(t.TempDir(), "freezes.ics")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testFreezeCalendar), 0644))
+	viper.Set("freeze-calendar", path)
+	assert.Nil(t, setupFreezes())
+}
+
+func TestFreezeSkipsOnceRuns(t *testing.T) {
+	withFreezes(t, []string{"01-01..12-31"}, "")
+
+	// Runs of --once are as scheduled as those of the daemon
+	assert.Equal(t, errRunSkipped, ansibleRun(runTriggerOnce, playbooks[0]))
+}
@@ -0,0 +1,92 @@
+// Installation of the Ansible Galaxy collections and roles required by an artifact
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// File in the galaxy cache directory holding the SHA-256 of the requirements that were last installed
+const galaxyMarkerFileName = ".requirements.sha256"
+
+// Galaxy server used in offline mode, so that anything missing from the cache fails instead of being downloaded
+const galaxyOfflineServer = "https://offline.invalid"
+
+// galaxyCacheDir returns the directory collections and roles are installed into, so they are kept across runs.
+func galaxyCacheDir() string {
+	if dir := viper.GetString("galaxy-cache-dir"); dir != "" {
+		return dir
+	}
+
+	return filepath.Join(stateDir(), "galaxy")
+}
+
+// InstallGalaxyRequirements installs the collections and roles listed in requirementsFile into a.GalaxyDir with
+// ansible-galaxy from the virtualenv.
+//
+// Online, collections are upgraded to the newest versions the requirements allow, and roles are reinstalled when
+// the requirements changed. Offline, Galaxy is not contacted and requirements missing from the cache fail.
+func (a AnsibleConfig) InstallGalaxyRequirements(requirementsFile string, offline bool) error {
+	content, err := ioutil.ReadFile(requirementsFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to read galaxy requirements")
+	}
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	collectionsDir := filepath.Join(a.GalaxyDir, "collections")
+	rolesDir := filepath.Join(a.GalaxyDir, "roles")
+	for _, dir := range []string{collectionsDir, rolesDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "unable to create galaxy cache directory")
+		}
+	}
+
+	marker := filepath.Join(a.GalaxyDir, galaxyMarkerFileName)
+	installed, _ := ioutil.ReadFile(marker)
+	changed := strings.TrimSpace(string(installed)) != checksum
+
+	collectionArgs := []string{"collection", "install", "-r", requirementsFile, "-p", collectionsDir}
+	roleArgs := []string{"role", "install", "-r", requirementsFile, "-p", rolesDir}
+	env := a.env()
+	if offline {
+		collectionArgs = append(collectionArgs, "--offline")
+		env = append(env, "ANSIBLE_GALAXY_SERVER="+galaxyOfflineServer)
+	} else {
+		collectionArgs = append(collectionArgs, "--upgrade")
+		if changed {
+			// Installed roles are skipped otherwise, even if another version is required
+			roleArgs = append(roleArgs, "--force")
+		}
+	}
+
+	for _, args := range [][]string{collectionArgs, roleArgs} {
+		ansibleLog.Debugln("Running ansible-galaxy ", strings.Join(args, " "))
+		output := VenvCommand{
+			Config:   a.VenvConfig,
+			Binary:   "ansible-galaxy",
+			Args:     args,
+			Cwd:      a.Cwd,
+			Env:      env,
+			Executor: a.Executor,
+		}.Run()
+		if output.Error != nil {
+			ansibleLog.Debugln("ansible-galaxy output:", output.Stdout)
+			return errors.Wrapf(commandFailure(output), "unable to install galaxy %ss: %s", args[0], strings.TrimSpace(output.Stderr))
+		}
+	}
+
+	if changed && !offline {
+		return errors.Wrap(writeFileAtomic(marker, []byte(checksum+"\n"), 0644), "unable to record galaxy requirements")
+	}
+
+	return nil
+}
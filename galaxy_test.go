@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGalaxyCacheDir(t *testing.T) {
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", "/var/lib/puller")
+	defer viper.Set("state-dir", originalStateDir)
+
+	assert.Equal(t, "/var/lib/puller/galaxy", galaxyCacheDir())
+
+	viper.Set("galaxy-cache-dir", "/srv/galaxy")
+	defer viper.Set("galaxy-cache-dir", "")
+	assert.Equal(t, "/srv/galaxy", galaxyCacheDir())
+}
+
+func TestInstallGalaxyRequirements(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir, err := ioutil.TempDir("", "ansible_puller_galaxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Records the arguments of every call
+	calls := filepath.Join(dir, "calls")
+	venv := filepath.Join(dir, "venv")
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	script := "#!/bin/sh\necho \"$@ $ANSIBLE_GALAXY_SERVER\" >> " + calls + "\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "ansible-galaxy"), []byte(script), 0755))
+
+	requirements := filepath.Join(dir, "requirements.yml")
+	assert.Nil(t, ioutil.WriteFile(requirements, []byte("collections:\n  - community.general\n"), 0644))
+
+	cfg := AnsibleConfig{VenvConfig: VenvConfig{Path: venv}, Cwd: dir, GalaxyDir: filepath.Join(dir, "galaxy")}
+	readCalls := func() []string {
+		data, err := ioutil.ReadFile(calls)
+		assert.Nil(t, err)
+		os.Remove(calls)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	assert.Nil(t, cfg.InstallGalaxyRequirements(requirements, false))
+	installed := readCalls()
+	assert.Len(t, installed, 2)
+	assert.True(t, strings.HasPrefix(installed[0], "collection install -r "+requirements+" -p "+filepath.Join(dir, "galaxy", "collections")+" --upgrade"))
+	assert.Contains(t, installed[1], "role install")
+	assert.Contains(t, installed[1], "--force", "roles are reinstalled for new requirements")
+
+	assert.Nil(t, cfg.InstallGalaxyRequirements(requirements, false))
+	assert.NotContains(t, readCalls()[1], "--force", "unchanged requirements are not reinstalled")
+
+	assert.Nil(t, cfg.InstallGalaxyRequirements(requirements, true))
+	offline := readCalls()
+	assert.Contains(t, offline[0], "--offline")
+	assert.Contains(t, offline[1], galaxyOfflineServer)
+}
+
+func TestGalaxyEnv(t *testing.T) {
+	env := AnsibleConfig{GalaxyDir: "/var/lib/puller/galaxy"}.env()
+	assert.Contains(t, env, "ANSIBLE_COLLECTIONS_PATH=/var/lib/puller/galaxy/collections:~/.ansible/collections:/usr/share/ansible/collections")
+	assert.Contains(t, env, "ANSIBLE_ROLES_PATH=/var/lib/puller/galaxy/roles:~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles")
+
+	// Vendored collections come first, no roles are vendored with them
+	env = AnsibleConfig{VendoredCollections: "/tmp/run/collections"}.env()
+	assert.Contains(t, env, "ANSIBLE_COLLECTIONS_PATH=/tmp/run/collections:~/.ansible/collections:/usr/share/ansible/collections")
+	env = AnsibleConfig{VendoredCollections: "/tmp/run/collections", GalaxyDir: "/var/lib/puller/galaxy"}.env()
+	assert.Contains(t, env, "ANSIBLE_COLLECTIONS_PATH=/tmp/run/collections:/var/lib/puller/galaxy/collections:~/.ansible/collections:/usr/share/ansible/collections")
+}
@@ -0,0 +1,170 @@
+// Helper methods for downloading a file from Google Cloud Storage
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsAPIURL   = "https://storage.googleapis.com/storage/v1"
+	gcsReadOnly = "https://www.googleapis.com/auth/devstorage.read_only"
+)
+
+// gcsDownloader downloads gs://bucket/object URIs with the JSON API.
+//
+// Credentials come from Google's Application Default Credentials: the file GOOGLE_APPLICATION_CREDENTIALS names, e.g.
+// a service account key or a workload identity federation configuration, those of gcloud, or the metadata server of
+// GCE and GKE. Without any, requests are sent unauthenticated, which works for public objects.
+type gcsDownloader struct {
+	downloader
+	apiURL      string
+	credentials func() (oauth2.TokenSource, error) // Returns nil without credentials
+	client      *http.Client
+}
+
+func newGCSDownloader() gcsDownloader {
+	return gcsDownloader{
+		apiURL:      gcsAPIURL,
+		credentials: gcsDefaultCredentials,
+		client:      &http.Client{Timeout: downloadTimeout()},
+	}
+}
+
+// gcsDefaultCredentials returns the tokens of the Application Default Credentials, or nil if there are none.
+func gcsDefaultCredentials() (oauth2.TokenSource, error) {
+	credentials, err := google.FindDefaultCredentials(context.Background(), gcsReadOnly)
+	if err != nil {
+		if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+			return nil, errors.Wrap(err, "unable to load Google credentials")
+		}
+		downloaderLog.Debugln("No Google credentials found, sending unauthenticated requests: ", err)
+		return nil, nil
+	}
+
+	return credentials.TokenSource, nil
+}
+
+// authorize adds the access token of the credentials to req. Credentials that can't provide one are an error, rather
+// than a request sent unauthenticated and refused.
+func (downloader gcsDownloader) authorize(req *http.Request) error {
+	tokens, err := downloader.credentials()
+	if err != nil || tokens == nil {
+		return err
+	}
+
+	token, err := tokens.Token()
+	if err != nil {
+		return errors.Wrap(err, "unable to get a Google access token")
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+type gcsObject struct {
+	Generation string `json:"generation"`
+	MD5Hash    string `json:"md5Hash"`
+}
+
+func parseGCSURI(remotePath string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(remotePath, "gs://"), "/", 2)
+	if !strings.HasPrefix(remotePath, "gs://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("not a valid GCS URI: %s", remotePath)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (downloader gcsDownloader) get(remotePath, query string) (*http.Response, error) {
+	bucket, object, err := parseGCSURI(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	objectURL := fmt.Sprintf("%s/b/%s/o/%s%s", downloader.apiURL, url.PathEscape(bucket), url.PathEscape(object), query)
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	if err := downloader.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := downloader.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, statusCodeError{resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+func (downloader gcsDownloader) object(remotePath string) (gcsObject, error) {
+	var object gcsObject
+
+	resp, err := downloader.get(remotePath, "")
+	if err != nil {
+		return object, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&object)
+	return object, errors.Wrap(err, "unable to parse object metadata")
+}
+
+func (downloader gcsDownloader) Download(remotePath, outputPath string) error {
+	resp, err := downloader.get(remotePath, "?alt=media")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if _, err = io.Copy(outFile, resp.Body); err != nil {
+		return err
+	}
+
+	return outFile.Close()
+}
+
+// RemoteChecksum returns the MD5 GCS keeps for the object, as hex. Composite objects have none.
+func (downloader gcsDownloader) RemoteChecksum(remotePath string) (string, error) {
+	object, err := downloader.object(remotePath)
+	if err != nil || object.MD5Hash == "" {
+		return "", err
+	}
+
+	checksum, err := base64.StdEncoding.DecodeString(object.MD5Hash)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decode object md5")
+	}
+
+	return hex.EncodeToString(checksum), nil
+}
+
+// RemoteVersion returns the generation of the object, which changes whenever the object is replaced.
+func (downloader gcsDownloader) RemoteVersion(remotePath string) (string, error) {
+	object, err := downloader.object(remotePath)
+	return object.Generation, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// newTestGCSServer serves testText as gs://bucket/dir/infra.tgz and counts the media downloads.
+func newTestGCSServer(t *testing.T, md5Hash string, generation *string, downloads *int) gcsDownloader {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Header.Get("Authorization") != "Bearer secret":
+			rw.WriteHeader(http.StatusUnauthorized)
+		case req.URL.EscapedPath() != "/b/bucket/o/dir%2Finfra.tgz":
+			rw.WriteHeader(http.StatusNotFound)
+		case req.URL.Query().Get("alt") == "media":
+			*downloads++
+			rw.Write(testText)
+		default:
+			fmt.Fprintf(rw, `{"generation": %q, "md5Hash": %q}`, *generation, md5Hash)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	downloader := newGCSDownloader()
+	downloader.apiURL = server.URL
+	downloader.credentials = func() (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"}), nil
+	}
+	return downloader
+}
+
+func TestGCSDownloaderChecksum(t *testing.T) {
+	raw, _ := hex.DecodeString(testMD5)
+	generation := "1"
+	downloads := 0
+	downloader := newTestGCSServer(t, base64.StdEncoding.EncodeToString(raw), &generation, &downloads)
+	localPath := filepath.Join(t.TempDir(), "infra.tgz")
+
+	checksum, err := downloader.RemoteChecksum("gs://bucket/dir/infra.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, testMD5, checksum)
+
+	assert.Nil(t, idempotentFileDownload(downloader, "gs://bucket/dir/infra.tgz", localPath))
+	assert.Nil(t, idempotentFileDownload(downloader, "gs://bucket/dir/infra.tgz", localPath))
+	assert.Equal(t, 1, downloads)
+
+	content, err := ioutil.ReadFile(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, testText, content)
+}
+
+func TestGCSDownloaderGeneration(t *testing.T) {
+	generation := "1"
+	downloads := 0
+	downloader := newTestGCSServer(t, "", &generation, &downloads)
+	localPath := filepath.Join(t.TempDir(), "infra.tgz")
+
+	assert.Nil(t, idempotentFileDownload(downloader, "gs://bucket/dir/infra.tgz", localPath))
+	assert.Nil(t, idempotentFileDownload(downloader, "gs://bucket/dir/infra.tgz", localPath))
+	assert.Equal(t, 1, downloads)
+
+	generation = "2"
+	assert.Nil(t, idempotentFileDownload(downloader, "gs://bucket/dir/infra.tgz", localPath))
+	assert.Equal(t, 2, downloads)
+}
+
+// failingTokenSource is credentials that can't provide a token.
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("invalid_grant")
+}
+
+func TestGCSDownloaderCredentials(t *testing.T) {
+	generation := "1"
+	downloads := 0
+	downloader := newTestGCSServer(t, "", &generation, &downloads)
+
+	// Credentials that fail are reported rather than sending the request unauthenticated
+	downloader.credentials = func() (oauth2.TokenSource, error) { return failingTokenSource{}, nil }
+	_, err := downloader.RemoteVersion("gs://bucket/dir/infra.tgz")
+	assert.EqualError(t, err, "unable to get a Google access token: invalid_grant")
+
+	// Without credentials, requests are sent unauthenticated
+	downloader.credentials = func() (oauth2.TokenSource, error) { return nil, nil }
+	_, err = downloader.RemoteVersion("gs://bucket/dir/infra.tgz")
+	assert.Equal(t, statusCodeError{http.StatusUnauthorized}, err)
+}
+
+func TestParseGCSURI(t *testing.T) {
+	bucket, object, err := parseGCSURI("gs://bucket/dir/infra.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "dir/infra.tgz", object)
+
+	for _, invalid := range []string{"gs://bucket", "gs:///infra.tgz", "s3://bucket/infra.tgz"} {
+		_, _, err = parseGCSURI(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -0,0 +1,123 @@
+// Helper methods for building the Ansible tarball from a Git repository
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Abbreviated or full commit SHAs
+var commitSHAPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// gitDownloader fetches a branch, tag or commit into a local cache repository and archives it as a tarball,
+// so that repeated pulls only transfer the changes since the last fetch.
+type gitDownloader struct {
+	downloader
+	cacheDir string // Bare repository the remote is fetched into
+	ref      string // Branch, tag or commit SHA to check out, the remote HEAD if empty
+	sshKey   string // Deploy key used for SSH remotes, if any
+	depth    int    // History depth to fetch, 0 for the full history
+}
+
+func (downloader gitDownloader) git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", downloader.cacheDir}, args...)...)
+	cmd.Env = commandEnv("GIT_TERMINAL_PROMPT=0")
+	if downloader.sshKey != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes", downloader.sshKey))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", timeoutError{errors.Wrapf(err, "git %s timed out", args[0])}
+		}
+		return "", errors.Wrapf(err, "git %s: %s", args[0], strings.TrimSpace(toValidUTF8(stderr.String())))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Download fetches the configured ref of remotePath and writes it to outputPath as a gzipped tarball.
+func (downloader gitDownloader) Download(remotePath, outputPath string) error {
+	if _, err := os.Stat(filepath.Join(downloader.cacheDir, "HEAD")); os.IsNotExist(err) {
+		downloaderLog.Infof("Creating git cache repository: %s", downloader.cacheDir)
+		if err := os.MkdirAll(downloader.cacheDir, 0700); err != nil {
+			return errors.Wrap(err, "unable to create git cache directory")
+		}
+		if _, err := downloader.git("init", "--bare", "--quiet"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := downloader.git("config", "remote.origin.url", remotePath); err != nil {
+		return err
+	}
+
+	ref := downloader.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	fetchArgs := []string{"fetch", "--quiet", "--force", "--no-tags"}
+	if downloader.depth > 0 {
+		fetchArgs = append(fetchArgs, fmt.Sprintf("--depth=%d", downloader.depth))
+	}
+	if _, err := downloader.git(append(fetchArgs, "origin", ref)...); err != nil {
+		return err
+	}
+
+	commit, err := downloader.git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return err
+	}
+	downloaderLog.Infof("Archiving %s at %s", ref, commit)
+
+	_, err = downloader.git("archive", "--format=tar.gz", "--output", outputPath, commit)
+	return err
+}
+
+// resolve returns the commit the configured ref of remotePath points to, without fetching it. A commit SHA can't be
+// looked up without fetching, so it is returned as is once the remote answers.
+func (downloader gitDownloader) resolve(remotePath string) (string, error) {
+	ref := downloader.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	lookup := ref
+	if commitSHAPattern.MatchString(ref) {
+		lookup = "HEAD"
+	}
+
+	output, err := downloader.git("ls-remote", remotePath, lookup)
+	if err != nil {
+		return "", err
+	}
+	if lookup != ref {
+		return ref, nil
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", errors.Errorf("git-ref %s not found in git-url", ref)
+	}
+	return fields[0], nil
+}
+
+// RemoteChecksum returns no checksum, as commits are identified by a SHA rather than the MD5 of a tarball.
+//
+// Without a checksum every cycle calls Download, which only fetches what changed since the last cycle.
+func (downloader gitDownloader) RemoteChecksum(remotePath string) (string, error) {
+	return "", nil
+}
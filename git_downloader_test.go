@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gitCommit runs git in dir with a fixed identity, failing the test on errors.
+func gitCommit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(output))
+}
+
+func TestGitDownloader(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	remote := t.TempDir()
+	gitCommit(t, remote, "init", "--quiet")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "site.yml"), []byte("v1"), 0644))
+	gitCommit(t, remote, "add", "site.yml")
+	gitCommit(t, remote, "commit", "--quiet", "-m", "v1")
+
+	work := t.TempDir()
+	downloader := gitDownloader{cacheDir: filepath.Join(work, "cache"), depth: 1}
+	remoteURL := "file://" + remote
+	tarball := filepath.Join(work, "repo.tgz")
+
+	assert.Nil(t, downloader.Download(remoteURL, tarball))
+	assert.Nil(t, extractTgz(tarball, filepath.Join(work, "v1")))
+	content, err := ioutil.ReadFile(filepath.Join(work, "v1", "site.yml"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(content))
+
+	// Later pulls reuse the cache repository
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "site.yml"), []byte("v2"), 0644))
+	gitCommit(t, remote, "commit", "--quiet", "-am", "v2")
+
+	assert.Nil(t, downloader.Download(remoteURL, tarball))
+	assert.Nil(t, extractTgz(tarball, filepath.Join(work, "v2")))
+	content, err = ioutil.ReadFile(filepath.Join(work, "v2", "site.yml"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(content))
+
+	checksum, err := downloader.RemoteChecksum(remoteURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "", checksum)
+}
+
+func TestGitDownloaderResolve(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	remote := t.TempDir()
+	gitCommit(t, remote, "init", "--quiet")
+	gitCommit(t, remote, "commit", "--quiet", "--allow-empty", "-m", "v1")
+	head, err := exec.Command("git", "-C", remote, "rev-parse", "HEAD").Output()
+	assert.Nil(t, err)
+
+	downloader := gitDownloader{cacheDir: filepath.Join(t.TempDir(), "cache")}
+	commit, err := downloader.resolve("file://" + remote)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimSpace(string(head)), commit)
+
+	downloader.ref = "missing"
+	_, err = downloader.resolve("file://" + remote)
+	assert.Contains(t, err.Error(), "git-ref missing not found")
+
+	// Commits are only checked once fetched
+	downloader.ref = "0123456789abcdef"
+	commit, err = downloader.resolve("file://" + remote)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", commit)
+}
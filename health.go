@@ -0,0 +1,147 @@
+// Health and readiness of the puller, for the probes of systemd, Kubernetes and load balancers
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Checks of readiness
+const (
+	readyCheckArtifact = "artifact" // The last run downloaded or extracted its artifact
+	readyCheckVenv     = "venv"     // The last run got the virtualenv, or image, ready
+	readyCheckRunLock  = "run_lock" // No run holds the run lock for longer than health-lock-timeout
+	readyCheckShutdown = "shutdown" // The puller isn't shutting down
+)
+
+// readyCheck is the result of a check of readiness.
+type readyCheck struct {
+	Ready bool        `json:"ready"`
+	Error string      `json:"error,omitempty"`
+	Time  interface{} `json:"time"` // When it was checked last, null if it wasn't yet
+}
+
+var (
+	readinessMutex sync.Mutex
+	runReadiness   = map[string]readyCheck{} // Checks of the stages of runs, by the last run that got to them
+)
+
+// trackReadiness records whether the stages of the run that readiness is checked by succeeded. Stages the run didn't
+// get to keep the result of the last run that did.
+func trackReadiness(next RunFunc) RunFunc {
+	return func(run *PipelineRun) error {
+		err := next(run)
+
+		var stage runStageError
+		switch {
+		case err == nil:
+			setRunReadiness(readyCheckArtifact, nil)
+			setRunReadiness(readyCheckVenv, nil)
+		case !errors.As(err, &stage):
+		case stage.stage == runStageDownload:
+			setRunReadiness(readyCheckArtifact, err)
+		case stage.stage == runStageVenv:
+			setRunReadiness(readyCheckArtifact, nil)
+			setRunReadiness(readyCheckVenv, err)
+		default:
+			setRunReadiness(readyCheckArtifact, nil)
+			setRunReadiness(readyCheckVenv, nil)
+		}
+		return err
+	}
+}
+
+func setRunReadiness(check string, err error) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+
+	result := readyCheck{Ready: err == nil, Time: statusTime(time.Now())}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	runReadiness[check] = result
+}
+
+// healthLockTimeout returns how long a run may hold the run lock before the puller is considered wedged.
+func healthLockTimeout() time.Duration {
+	if minutes := viper.GetInt("health-lock-timeout"); minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 2 * time.Duration(viper.GetInt("ansible-timeout")) * time.Minute
+}
+
+// runLockWedged returns why the run lock is wedged, or nil if it isn't: a run holds it for longer than any run
+// should take, so runs waiting for it never start.
+func runLockWedged() error {
+	runsLock.stateMutex.Lock()
+	runID, since := runsLock.runID, runsLock.since
+	runsLock.stateMutex.Unlock()
+
+	if since.IsZero() {
+		return nil
+	}
+	if held := time.Since(since); held > healthLockTimeout() {
+		return errors.Errorf("run %s holds the run lock for %s", runID, held.Round(time.Second))
+	}
+	return nil
+}
+
+// readiness returns the checks of readiness, and whether all of them passed. Checks of the stages of runs pass until
+// a run got to them, so that a puller is ready before its first run.
+func readiness() (map[string]readyCheck, bool) {
+	checks := map[string]readyCheck{}
+	readinessMutex.Lock()
+	for _, check := range []string{readyCheckArtifact, readyCheckVenv} {
+		result, ok := runReadiness[check]
+		if !ok {
+			result = readyCheck{Ready: true}
+		}
+		checks[check] = result
+	}
+	readinessMutex.Unlock()
+
+	now := statusTime(time.Now())
+	checks[readyCheckRunLock] = readyCheck{Ready: true, Time: now}
+	if err := runLockWedged(); err != nil {
+		checks[readyCheckRunLock] = readyCheck{Error: err.Error(), Time: now}
+	}
+	checks[readyCheckShutdown] = readyCheck{Ready: !shuttingDown(), Time: now}
+
+	ready := true
+	for _, result := range checks {
+		ready = ready && result.Ready
+	}
+	return checks, ready
+}
+
+// HandlerHealthz answers whether the puller is alive, which it is if it answers at all.
+func HandlerHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// HandlerReadyz answers whether the puller is ready, with 503 Service Unavailable and the failed checks if it isn't.
+func HandlerReadyz(w http.ResponseWriter, r *http.Request) {
+	checks, ready := readiness()
+	status := "ready"
+	if !ready {
+		status = "not ready"
+	}
+	data, err := json.Marshal(map[string]interface{}{"status": status, "checks": checks})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
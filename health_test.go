@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	withShutdownState(t)
+	withSettings(t, map[string]interface{}{"health-lock-timeout": 0, "ansible-timeout": 60})
+	readinessMutex.Lock()
+	original := runReadiness
+	runReadiness = map[string]readyCheck{}
+	readinessMutex.Unlock()
+	defer func() { runReadiness = original }()
+
+	readyz := func() (int, map[string]readyCheck) {
+		rr := serveAPI("GET", httpPathReadyz, "", nil)
+		var body struct {
+			Checks map[string]readyCheck `json:"checks"`
+		}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return rr.Code, body.Checks
+	}
+
+	// Ready before the first run
+	code, checks := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, checks, 4)
+	assert.Nil(t, checks[readyCheckVenv].Time)
+
+	// The virtualenv failed, the artifact was downloaded
+	run := trackReadiness(func(*PipelineRun) error {
+		return inRunStage(runStageVenv, errors.New("pip failed"))
+	})
+	assert.NotNil(t, run(&PipelineRun{}))
+	code, checks = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, checks[readyCheckArtifact].Ready)
+	assert.Equal(t, readyCheck{Error: "pip failed", Time: checks[readyCheckVenv].Time}, checks[readyCheckVenv])
+
+	// Failures before the stages leave them as they were
+	assert.NotNil(t, trackReadiness(func(*PipelineRun) error { return errors.New("not enough disk space") })(&PipelineRun{}))
+	code, _ = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	assert.NotNil(t, trackReadiness(func(*PipelineRun) error {
+		return inRunStage(runStagePlaybook, errors.New("task failed"))
+	})(&PipelineRun{}))
+	code, _ = readyz()
+	assert.Equal(t, http.StatusOK, code)
+
+	// A run holding the lock for longer than twice ansible-timeout
+	release, err := runsLock.acquire("hung-run")
+	assert.Nil(t, err)
+	defer release()
+	assert.Nil(t, runLockWedged())
+	runsLock.stateMutex.Lock()
+	runsLock.since = time.Now().Add(-121 * time.Minute)
+	runsLock.stateMutex.Unlock()
+	assert.EqualError(t, runLockWedged(), "run hung-run holds the run lock for 2h1m0s")
+	code, checks = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, checks[readyCheckRunLock].Ready)
+
+	withSettings(t, map[string]interface{}{"health-lock-timeout": 180})
+	assert.Nil(t, runLockWedged())
+}
+
+func TestHealthzWithAuth(t *testing.T) {
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{"read": "token"})
+	assert.Nil(t, err)
+	defer restore()
+
+	rr := serveAPI("GET", httpPathHealthz, "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("GET", httpPathStatus, "", nil).Code)
+}
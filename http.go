@@ -5,12 +5,18 @@ package main
 import (
 	_ "embed"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 )
 
@@ -19,7 +25,32 @@ const (
 	httpPathAnsibleDisable      = "/ansible/disable"
 	httpPathAnsibleEnable       = "/ansible/enable"
 	httpPathAnsibleControl      = "/ansible/control"
+	httpPathAnsibleDecommission = "/ansible/decommission"
 	httpPathStatus              = "/ansible/status"
+	httpPathRunTail             = "/runs/current/tail"
+	httpPathRunReport           = "/runs/last/report"
+	httpPathRun                 = "/run"
+	httpPathRuns                = "/runs"
+	httpPathRunStatus           = "/runs/{id}"
+	httpPathRunReplay           = "/runs/{id}/replay"
+	httpPathVenvUpgrade         = "/venv/upgrade"
+	httpPathVenvReset           = "/venv/reset"
+	httpPathVenvDryRun          = "/venv/dry-run"
+	httpPathVenvPackages        = "/venv/packages"
+	httpPathCompare             = "/compare"
+	httpPathFetch               = "/fetch"
+	httpPathApply               = "/apply"
+	httpPathCachePurge          = "/cache/purge"
+	httpPathFailures            = "/failures"
+	httpPathDrift               = "/drift"
+	httpPathPin                 = "/pin"
+	httpPathFreezeOverride      = "/freeze/override"
+	httpPathReload              = "/reload"
+	httpPathHealthz             = "/healthz"
+	httpPathReadyz              = "/readyz"
+	httpPathDetailedStatus      = "/status"
+
+	defaultRunTailLines = 200
 )
 
 var (
@@ -41,9 +72,7 @@ func MakeRunOnceHandler(runOnce func()) func(http.ResponseWriter, *http.Request)
 }
 
 func HandlerAnsibleEnable(w http.ResponseWriter, r *http.Request) {
-	disableReason = ""
-
-	ansibleEnable()
+	enablePuller("")
 	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
 }
 
@@ -54,11 +83,16 @@ func HandlerAnsibleDisable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if val, ok := r.Form["disable-reason"]; ok {
-		disableReason = val[0]
+	var ttl time.Duration
+	if val := r.Form.Get("disable-ttl"); val != "" {
+		ttl, err = time.ParseDuration(val)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "disable-ttl must be a positive duration, e.g. 2h", http.StatusBadRequest)
+			return
+		}
 	}
 
-	ansibleDisable()
+	disablePuller(r.Form.Get("disable-reason"), ttl)
 	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
 }
 
@@ -92,13 +126,44 @@ func HandlerIndex(w http.ResponseWriter, r *http.Request) {
 	_ = t.Execute(w, data)
 }
 
+// statusTime formats a timestamp for the status endpoint, using null for unset times.
+func statusTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return pullerTime(t).Format(time.RFC3339)
+}
+
 func HandlerStatus(w http.ResponseWriter, r *http.Request) {
+	state, err := loadState()
+	if err != nil {
+		httpLog.Warnln("Unable to load state for status: ", err)
+	}
+
 	status := map[string]interface{}{
 		"app_name":                 appName,
 		"hostname":                 hostname,
 		"ansible_disabled":         ansibleDisabled,
 		"ansible_running":          ansibleRunning,
 		"ansible_last_run_success": ansibleLastRunSuccess,
+		"last_run_outcome":         state.LastRunOutcome,
+		"disable_reason":           disableReason,
+		"disabled_until":           statusTime(disabledUntil),
+		"last_run_time":            statusTime(state.LastRunTime),
+		"next_run_time":            statusTime(earliestNextRun()),
+		"blackout_until":           statusTime(blackoutEnd()),
+		"change_freeze":            freezeStatus(),
+		"artifact_checksum":        state.LastArtifactChecksum,
+		"consecutive_failures":     state.ConsecutiveFailures,
+		"config_hash":              currentConfigHash(),
+		"config_reload":            reloadStatus(),
+		"verification_error":       lastVerificationError(),
+		"connectivity_error":       lastConnectivityError(),
+		"run_lock":                 runsLock.status(),
+		"playbooks":                playbookStatuses(),
+		"rollout":                  getRollout(),
+		"pin":                      currentPin(),
 		"version":                  Version,
 	}
 
@@ -112,6 +177,162 @@ func HandlerStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// HandlerRunTail returns the last lines of output of the current or most recent run.
+//
+// The number of lines is given by the "lines" query parameter.
+func HandlerRunTail(w http.ResponseWriter, r *http.Request) {
+	lines := defaultRunTailLines
+	if val := r.URL.Query().Get("lines"); val != "" {
+		var err error
+		lines, err = strconv.Atoi(val)
+		if err != nil || lines < 0 {
+			http.Error(w, "lines must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range runOutputBuffer.Tail(lines) {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// HandlerRunReport returns the typed report of the last run that got as far as running Ansible.
+func HandlerRunReport(w http.ResponseWriter, r *http.Request) {
+	report := getLastRunReport()
+	if report == nil {
+		http.Error(w, "no run has completed yet", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// runRequest holds the optional overrides accepted by HandlerRun.
+type runRequest struct {
+	Playbook  string   `json:"playbook"` // Name of the configured playbook to run, the first one if empty
+	Tags      []string `json:"tags"`
+	SkipTags  []string `json:"skip_tags"`
+	Limit     string   `json:"limit"`
+	CheckMode bool     `json:"check_mode"`
+
+	// Only run for the hosts that failed the last run, in controller mode
+	RetryFailed bool `json:"retry_failed"`
+}
+
+// HandlerRun queues an immediate run of a configured playbook, with the overrides in the optional JSON body.
+//
+// It responds with the ID of the run, whose status can be polled at /runs/{id}.
+func HandlerRun(w http.ResponseWriter, r *http.Request) {
+	if ansibleDisabled {
+		http.Error(w, "ansible puller is disabled", http.StatusConflict)
+		return
+	}
+	if err := checkChangeWindow(); err != nil {
+		http.Error(w, "refused by change management: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err := checkBlackout(); err != nil {
+		http.Error(w, "refused: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	var request runRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid run request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	playbook, ok := findPlaybook(request.Playbook)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown playbook %q", request.Playbook), http.StatusBadRequest)
+		return
+	}
+	if request.RetryFailed && !controllerMode() {
+		http.Error(w, "retry_failed requires ansible-controller", http.StatusBadRequest)
+		return
+	}
+	if request.RetryFailed && !hasFailedHosts() {
+		http.Error(w, "no hosts failed the last run", http.StatusConflict)
+		return
+	}
+	var lowResource lowResourceError
+	if err := checkResources(); errors.As(err, &lowResource) {
+		skipForResources(runTriggerAPI, lowResource)
+		http.Error(w, "refused: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := runQuotas.allow(runSourceAPI); err != nil {
+		httpQuotaExceeded(w, err)
+		return
+	}
+
+	spec := playbook.spec(runTriggerAPI)
+	spec.ID = uuid.NewV4().String()
+	if request.Tags != nil {
+		spec.Tags = request.Tags
+	}
+	if request.SkipTags != nil {
+		spec.SkipTags = request.SkipTags
+	}
+	spec.Limit = request.Limit
+	spec.CheckMode = request.CheckMode
+	spec.RetryFailed = request.RetryFailed
+	startRun(spec)
+
+	data, err := json.Marshal(map[string]string{
+		"run_id":     spec.ID,
+		"status":     runStatusQueued,
+		"status_url": strings.Replace(httpPathRunStatus, "{id}", spec.ID, 1),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandlerRuns returns the run history, newest first. The output of runs is only included by HandlerRunStatus.
+func HandlerRuns(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(runs.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerRunStatus returns the status of one of the recent runs.
+func HandlerRunStatus(w http.ResponseWriter, r *http.Request) {
+	record := runs.get(mux.Vars(r)["id"])
+	if record == nil {
+		http.Error(w, "unknown run", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
 // NewServer creates a new http server
 //
 // runOnce is a function that we will be called when the adhocTrigger handler is invoked.
@@ -119,18 +340,54 @@ func NewServer(runOnce func()) *http.Server {
 	r := mux.NewRouter()
 
 	r.Handle("/metrics", promhttp.Handler())
+	r.HandleFunc(httpPathHealthz, HandlerHealthz).Methods("GET")
+	r.HandleFunc(httpPathReadyz, HandlerReadyz).Methods("GET")
 	r.HandleFunc("/", HandlerIndex).Methods("GET")
 	r.HandleFunc(httpPathAnsibleAdhocTrigger, MakeRunOnceHandler(runOnce)).Methods("POST")
 	r.HandleFunc(httpPathAnsibleDisable, HandlerAnsibleDisable).Methods("POST")
 	r.HandleFunc(httpPathAnsibleEnable, HandlerAnsibleEnable).Methods("POST")
 	r.HandleFunc(httpPathAnsibleControl, HandlerAnsibleControl).Methods("GET")
 	r.HandleFunc(httpPathStatus, HandlerStatus).Methods("GET")
+	r.HandleFunc(httpPathDetailedStatus, HandlerDetailedStatus).Methods("GET")
+	r.HandleFunc(httpPathRunTail, HandlerRunTail).Methods("GET")
+	r.HandleFunc(httpPathRunReport, HandlerRunReport).Methods("GET")
+	r.HandleFunc(httpPathRun, HandlerRun).Methods("POST")
+	r.HandleFunc(httpPathRuns, HandlerRuns).Methods("GET")
+	r.HandleFunc(httpPathRunStatus, HandlerRunStatus).Methods("GET")
+	r.HandleFunc(httpPathRunReplay, HandlerReplay).Methods("POST")
+	r.HandleFunc(httpPathVenvUpgrade, HandlerVenvUpgrade).Methods("POST")
+	r.HandleFunc(httpPathVenvUpgrade, HandlerVenvUpgradeStatus).Methods("GET")
+	r.HandleFunc(httpPathVenvReset, HandlerVenvReset).Methods("POST")
+	r.HandleFunc(httpPathVenvDryRun, HandlerVenvDryRun).Methods("POST")
+	r.HandleFunc(httpPathVenvDryRun, HandlerVenvDryRunStatus).Methods("GET")
+	r.HandleFunc(httpPathVenvPackages, HandlerVenvPackages).Methods("GET")
+	r.HandleFunc(httpPathCompare, HandlerCompare).Methods("POST")
+	r.HandleFunc(httpPathCompare, HandlerComparison).Methods("GET")
+	r.HandleFunc(httpPathFetch, HandlerFetch).Methods("POST")
+	r.HandleFunc(httpPathFetch, HandlerFetchStatus).Methods("GET")
+	r.HandleFunc(httpPathApply, HandlerApply).Methods("POST")
+	r.HandleFunc(httpPathCachePurge, HandlerCachePurge).Methods("POST")
+	r.HandleFunc(httpPathFailures, HandlerFailures).Methods("GET")
+	r.HandleFunc(httpPathDrift, HandlerDrift).Methods("GET")
+	r.HandleFunc(httpPathPin, HandlerPin).Methods("POST")
+	r.HandleFunc(httpPathPin, HandlerUnpin).Methods("DELETE")
+	r.HandleFunc(httpPathFreezeOverride, HandlerFreezeOverride).Methods("POST")
+	r.HandleFunc(httpPathFreezeOverride, HandlerFreezeOverrideRemove).Methods("DELETE")
+	r.HandleFunc(httpPathReload, HandlerReload).Methods("POST")
+	if apiAuth != nil {
+		// Served only to authenticated clients, as the teardown can't be undone
+		r.HandleFunc(httpPathAnsibleDecommission, HandlerAnsibleDecommission).Methods("POST")
+		r.Use(apiAuth.middleware)
+	} else {
+		r.Use(refuseSensitive)
+	}
 
 	srv := &http.Server{
 		Handler:      r,
 		Addr:         viper.GetString("http-listen-string"),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		TLSConfig:    apiTLS,
 	}
 
 	return srv
@@ -11,9 +11,22 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
+// statusCodeError is a response with an error status code.
+type statusCodeError struct {
+	code int
+}
+
+func (e statusCodeError) Error() string {
+	return fmt.Sprintf("bad status code: %v", e.code)
+}
+
+// HTTPStatusCode returns the status code, like the errors of the AWS SDK.
+func (e statusCodeError) HTTPStatusCode() int {
+	return e.code
+}
+
 type httpDownloader struct {
 	downloader
 	username string
@@ -28,7 +41,7 @@ func (downloader httpDownloader) Download(remotePath, outputPath string) error {
 	}
 
 	client := http.Client{
-		Timeout: 15 * time.Second,
+		Timeout: downloadTimeout(),
 	}
 
 	req, err := http.NewRequest("GET", remotePath, nil)
@@ -45,7 +58,7 @@ func (downloader httpDownloader) Download(remotePath, outputPath string) error {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+		return statusCodeError{resp.StatusCode}
 	}
 
 	// Persist to file in 32K chunks, instead of slurping
@@ -54,7 +67,7 @@ func (downloader httpDownloader) Download(remotePath, outputPath string) error {
 		return err
 	}
 	if err := outFile.Close(); err != nil {
-		logrus.Errorf("Failed to close file: %v", err)
+		downloaderLog.Errorf("Failed to close file: %v", err)
 	}
 
 	return nil
@@ -82,19 +95,19 @@ func (downloader httpDownloader) RemoteChecksum(remotePath string) (string, erro
 	}
 	// Ignore the checksum if it's not found, as assumed by the caller of this function.
 	if resp.StatusCode == http.StatusNotFound {
-		logrus.Debugf("MD5 sum not found at: %s", hashRemotePath)
+		downloaderLog.Debugf("MD5 sum not found at: %s", hashRemotePath)
 		return "", nil
 	}
 	// A non-2xx status code does not cause an error, so we handle it here. https://pkg.go.dev/net/http#Client.Do
 	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("bad status code: %v", resp.StatusCode)
+		return "", statusCodeError{resp.StatusCode}
 	}
 
-	logrus.Debugf("Found MD5 sum at: %s", hashRemotePath)
+	downloaderLog.Debugf("Found MD5 sum at: %s", hashRemotePath)
 	defer resp.Body.Close()
 	remoteChecksum, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		logrus.Debug("Error reading remote checksum")
+		downloaderLog.Debug("Error reading remote checksum")
 		return "", errors.Wrap(err, "failed to read remote md5sum")
 	}
 
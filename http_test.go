@@ -1,15 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestStatusEndpoint(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "ansible_puller_status")
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", stateDir)
+	defer viper.Set("state-dir", originalStateDir)
+
 	req, err := http.NewRequest("GET", "/ansible/status", nil)
 	assert.Nil(t, err)
 
@@ -28,8 +39,117 @@ func TestStatusEndpoint(t *testing.T) {
 					"ansible_last_run_success": true,
 					"ansible_running": false,
 					"app_name": "ansible-puller",
+					"artifact_checksum": "",
+					"blackout_until": null,
+					"change_freeze": null,
+					"config_hash": "%s",
+					"config_reload": null,
+					"connectivity_error": "",
+					"consecutive_failures": 0,
+					"disable_reason": "",
+					"disabled_until": null,
 					"hostname": "%s",
+					"last_run_outcome": "",
+					"last_run_time": null,
+					"next_run_time": null,
+					"pin": null,
+					"playbooks": [{"name": "default", "playbook": "site.yml", "next_run_time": null, "last_run_time": null}],
+					"rollout": null,
+					"run_lock": {"held": false, "run_id": "", "since": null, "waiting": 0},
+					"verification_error": "",
 					"version": ""
-				}`, host))
+				}`, effectiveConfigHash(), host))
 	assert.JSONEq(t, expected, rr.Body.String())
 }
+
+func TestRunTailEndpoint(t *testing.T) {
+	runOutputBuffer.Reset()
+	defer runOutputBuffer.Reset()
+	fmt.Fprint(runOutputBuffer, "TASK [first]\nok: [localhost]\nTASK [second]\n")
+
+	req, err := http.NewRequest("GET", "/runs/current/tail?lines=2", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRunTail).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok: [localhost]\nTASK [second]\n", rr.Body.String())
+}
+
+func TestRunTailEndpointBadLines(t *testing.T) {
+	req, err := http.NewRequest("GET", "/runs/current/tail?lines=lots", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRunTail).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestRunReportEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRunReport).ServeHTTP(rr, httptest.NewRequest("GET", "/runs/last/report", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	report := newRunReport(loadTestRunOutput(t))
+	report.RunID = "1234"
+	setLastRunReport(report)
+	defer func() { lastRunReport = nil }()
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HandlerRunReport).ServeHTTP(rr, httptest.NewRequest("GET", "/runs/last/report", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var received RunReport
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &received))
+	assert.Equal(t, "1234", received.RunID)
+	assert.Len(t, received.Tasks, 3)
+}
+
+func TestRunEndpointDisabled(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = true
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRun).ServeHTTP(rr, httptest.NewRequest("POST", "/run", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestRunEndpointBadRequest(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	for _, body := range []string{`{"tags": "not-a-list"}`, `{"unknown": true}`, `{`, `{"playbook": "unknown"}`} {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(HandlerRun).ServeHTTP(rr, httptest.NewRequest("POST", "/run", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestRunStatusEndpoint(t *testing.T) {
+	originalRuns := runs
+	runs = newRunRegistry(10)
+	defer func() { runs = originalRuns }()
+	handler := NewServer(func() {}).Handler
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/runs/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	runs.queued(runSpec{ID: "status-test", Playbook: "site.yml", Tags: []string{"web"}, CheckMode: true})
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/runs/status-test", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var received runRecord
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &received))
+	assert.Equal(t, "status-test", received.ID)
+	assert.Equal(t, runStatusQueued, received.Status)
+	assert.Equal(t, []string{"web"}, received.Tags)
+	assert.True(t, received.CheckMode)
+	assert.Nil(t, received.StartTime)
+}
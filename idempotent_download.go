@@ -4,10 +4,12 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 // Interface with logic to govern how to actually pull objects
@@ -16,6 +18,22 @@ type downloader interface {
 	RemoteChecksum(remotePath string) (string, error)
 }
 
+// downloadTimeout returns how long a single artifact download may take, from download-timeout.
+func downloadTimeout() time.Duration {
+	return time.Duration(viper.GetInt("download-timeout")) * time.Minute
+}
+
+// Optional interface for sources that identify object versions without an MD5, such as an ETag or generation.
+// It lets unchanged artifacts be skipped when no remote checksum is available.
+type versionedDownloader interface {
+	RemoteVersion(remotePath string) (string, error)
+}
+
+// The version of a downloaded file is kept next to it
+func versionFile(localPath string) string {
+	return localPath + ".version"
+}
+
 // Calculates the md5sum of a local file
 func md5sum(path string) (string, error) {
 	file, err := os.Open(path)
@@ -41,7 +59,7 @@ func validateMd5Sum(path, checksum string) error {
 	}
 
 	if newChecksum != checksum {
-		logrus.Debugf("Checksums for downloaded file do not match: '%s' != '%s'", newChecksum, checksum)
+		downloaderLog.Debugf("Checksums for downloaded file do not match: '%s' != '%s'", newChecksum, checksum)
 		return errors.New("checksum does not match expected value")
 	}
 
@@ -54,11 +72,11 @@ func validateMd5Sum(path, checksum string) error {
 // The MD5 checking may be an Artifactory-specific setup because it will look for the hash at "${url}.md5"
 // If the MD5 is not found, this will download the file
 func idempotentFileDownload(downloader downloader, remotePath, localPath string) error {
-	logrus.Debugf("Starting idempotent download of %s to %s", remotePath, localPath)
+	downloaderLog.Debugf("Starting idempotent download of %s to %s", remotePath, localPath)
 
 	currentChecksum, err := md5sum(localPath)
 	if os.IsNotExist(err) {
-		logrus.Infof("File '%s' does not exist yet so cannot validate for new checksum", localPath)
+		downloaderLog.Infof("File '%s' does not exist yet so cannot validate for new checksum", localPath)
 		currentChecksum = ""
 	} else if err != nil {
 		return errors.Wrap(err, "failed to calc local md5sum")
@@ -69,23 +87,54 @@ func idempotentFileDownload(downloader downloader, remotePath, localPath string)
 		return errors.Wrap(err, "failed to download md5sum")
 	}
 
+	remoteVersion := ""
+	versioned, ok := downloader.(versionedDownloader)
+	if remoteChecksum == "" && ok {
+		remoteVersion, err = versioned.RemoteVersion(remotePath)
+		if err != nil {
+			return errors.Wrap(err, "failed to get remote version")
+		}
+
+		currentVersion, _ := ioutil.ReadFile(versionFile(localPath))
+		if currentChecksum != "" && remoteVersion != "" && remoteVersion == string(currentVersion) {
+			downloaderLog.Debugf("Local and remote versions match (%s), skipping file download", remoteVersion)
+			promArtifactCacheHits.Inc()
+			return nil
+		}
+	}
+
 	if currentChecksum != "" && remoteChecksum != "" {
-		logrus.Debugf("Local checksum:  %s", currentChecksum)
-		logrus.Debugf("Remote checksum: %s", remoteChecksum)
+		downloaderLog.Debugf("Local checksum:  %s", currentChecksum)
+		downloaderLog.Debugf("Remote checksum: %s", remoteChecksum)
 		if remoteChecksum == currentChecksum {
-			logrus.Debug("Local and remote checksums match, skipping file download")
+			downloaderLog.Debug("Local and remote checksums match, skipping file download")
+			promArtifactCacheHits.Inc()
+			return nil
+		}
+	}
+
+	if artifacts.restore(remoteChecksum, localPath) {
+		os.Remove(versionFile(localPath))
+		if err = validateMd5Sum(localPath, remoteChecksum); err == nil {
+			downloaderLog.Infof("Using cached artifact %s instead of downloading %s", remoteChecksum, remotePath)
+			promArtifactCacheHits.Inc()
 			return nil
 		}
+		downloaderLog.Warnln("Cached artifact is corrupt, downloading it again: ", err)
 	}
+	promArtifactCacheMisses.Inc()
 
-	logrus.Infof("Downloading file: %s", remotePath)
+	downloaderLog.Infof("Downloading file: %s", remotePath)
+	os.Remove(versionFile(localPath))
+	downloadStart := time.Now()
 	err = downloader.Download(remotePath, localPath)
+	promDownloadDuration.Observe(time.Since(downloadStart).Seconds())
 	if err != nil {
 		return errors.Wrap(err, "failed to download")
 	}
 
 	if remoteChecksum != "" {
-		logrus.Infof("Validating checksum: %s", remotePath)
+		downloaderLog.Infof("Validating checksum: %s", remotePath)
 
 		err = validateMd5Sum(localPath, remoteChecksum)
 		if err != nil {
@@ -93,5 +142,11 @@ func idempotentFileDownload(downloader downloader, remotePath, localPath string)
 		}
 	}
 
+	if remoteVersion != "" {
+		if err = ioutil.WriteFile(versionFile(localPath), []byte(remoteVersion), 0600); err != nil {
+			downloaderLog.Warnln("Unable to record the version of the downloaded file: ", err)
+		}
+	}
+
 	return nil
 }
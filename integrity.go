@@ -0,0 +1,336 @@
+// Integrity of the local state files, which are signed with a key of the host so that changes made behind the
+// puller's back are detected
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// First line of a signed state file, followed by its signature and then its content
+	stateSignaturePrefix = "hmac-sha256 "
+	// Suffix of the file next to the state key that lists the signed state files that were written
+	stateFilesSuffix = ".files"
+	// Suffix a state file that failed verification is moved aside to
+	stateTamperedSuffix = ".tampered"
+	stateKeySize        = 32
+)
+
+var (
+	stateKeyMutex   sync.Mutex // Serializes the generation of the state key
+	stateFilesMutex sync.Mutex // Protects the list of signed state files
+)
+
+// stateTamperedEvent is the data of a state.tampered event.
+type stateTamperedEvent struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// signedStateFiles returns the state files that control whether and what the puller runs, which are signed when
+// state-key-file is set.
+func signedStateFiles() []string {
+	return []string{
+		stateFilePath(),
+		filepath.Join(stateDir(), runHistoryFileName),
+		filepath.Join(stateDir(), failureTableFileName),
+		appliedManifestPath(),
+	}
+}
+
+// stateKey returns the key state files are signed with, or nil if they aren't. The key is generated the first time,
+// and the state files that exist then are signed with it, as they were written before there was a key. The key is
+// only written once they are, so that a crash in between signs them again with the next key.
+func stateKey() ([]byte, error) {
+	path := viper.GetString("state-key-file")
+	if path == "" {
+		return nil, nil
+	}
+
+	stateKeyMutex.Lock()
+	defer stateKeyMutex.Unlock()
+
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) < stateKeySize {
+			return nil, errors.Errorf("state key %s is shorter than %d bytes", path, stateKeySize)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "unable to read state key")
+	}
+
+	key = make([]byte, stateKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "unable to generate state key")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create state key directory")
+	}
+
+	if err := signStateFiles(key); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(path, key, 0600); err != nil {
+		return nil, errors.Wrap(err, "unable to write state key")
+	}
+	logrus.Infoln("Generated the state key ", path)
+
+	return key, nil
+}
+
+// signStateFiles signs the state files that exist with key, whatever they were signed with before, and lists them as
+// written. The caller must hold stateFilesMutex, or be the generation of the key.
+func signStateFiles(key []byte) error {
+	var written []string
+	for _, file := range signedStateFiles() {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to sign %s", file)
+		}
+		// Signed with a key that was lost before it was written, or with the key of another host
+		if _, content, ok := splitSignedState(data); ok {
+			data = content
+		}
+		if err := writeFileAtomic(file, signState(key, data), 0600); err != nil {
+			return errors.Wrapf(err, "unable to sign %s", file)
+		}
+		written = append(written, filepath.Base(file))
+	}
+	return saveStateFiles(key, written)
+}
+
+// resignStateFiles signs the state files with the key of the host, for state files written on another host, which
+// would fail verification otherwise. Their content is trusted as it is.
+func resignStateFiles() error {
+	key, err := stateKey()
+	if err != nil || key == nil {
+		return err
+	}
+
+	stateFilesMutex.Lock()
+	defer stateFilesMutex.Unlock()
+	return signStateFiles(key)
+}
+
+// stateSignature returns the HMAC-SHA256 of data with key, hex encoded.
+func stateSignature(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signState returns data signed with key, as it is written to a state file.
+func signState(key, data []byte) []byte {
+	return append([]byte(stateSignaturePrefix+stateSignature(key, data)+"\n"), data...)
+}
+
+// splitSignedState returns the signature and the content of a signed state file, and whether it is signed.
+func splitSignedState(signed []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(signed, []byte(stateSignaturePrefix)) {
+		return "", nil, false
+	}
+	end := bytes.IndexByte(signed, '\n')
+	if end < 0 {
+		return "", nil, false
+	}
+	return string(signed[len(stateSignaturePrefix):end]), signed[end+1:], true
+}
+
+// verifyState returns the content of the signed state file, or why it can't be trusted.
+func verifyState(key, signed []byte) ([]byte, string) {
+	signature, data, ok := splitSignedState(signed)
+	if !ok {
+		return nil, "the signature is missing"
+	}
+	if !hmac.Equal([]byte(signature), []byte(stateSignature(key, data))) {
+		return nil, "the signature does not match"
+	}
+	return data, ""
+}
+
+// stateFilesPath returns the path of the list of signed state files, kept next to the key rather than in the state
+// directory: files removed from the state directory together with the list would otherwise go unnoticed.
+func stateFilesPath() string {
+	return viper.GetString("state-key-file") + stateFilesSuffix
+}
+
+// loadStateFiles returns the names of the signed state files that were written. A list that fails verification is
+// reported, and the list is started over from the signed state files that exist. The caller must hold
+// stateFilesMutex.
+func loadStateFiles(key []byte) map[string]bool {
+	files := map[string]bool{}
+	signed, err := ioutil.ReadFile(stateFilesPath())
+	if err == nil {
+		data, reason := verifyState(key, signed)
+		var names []string
+		if reason == "" && json.Unmarshal(data, &names) == nil {
+			for _, name := range names {
+				files[name] = true
+			}
+			return files
+		}
+		if reason == "" {
+			reason = "the file is corrupt"
+		}
+		stateTampered(stateFilesPath(), reason)
+	} else if !os.IsNotExist(err) {
+		logrus.Warnln("Unable to read the list of signed state files: ", err)
+	}
+
+	// Missing if the key was put in place rather than generated
+	for _, file := range signedStateFiles() {
+		if signed, err := ioutil.ReadFile(file); err == nil {
+			if _, reason := verifyState(key, signed); reason == "" {
+				files[filepath.Base(file)] = true
+			}
+		}
+	}
+	return files
+}
+
+// saveStateFiles writes the list of signed state files that were written. The caller must hold stateFilesMutex, or
+// be the generation of the key.
+func saveStateFiles(key []byte, names []string) error {
+	sort.Strings(names)
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(stateFilesPath(), signState(key, data), 0600), "unable to write the list of signed state files")
+}
+
+// updateStateFiles adds the state file at path to the list of signed state files that were written, or removes it.
+func updateStateFiles(key []byte, path string, written bool) error {
+	stateFilesMutex.Lock()
+	defer stateFilesMutex.Unlock()
+
+	files := loadStateFiles(key)
+	name := filepath.Base(path)
+	if files[name] == written {
+		if _, err := os.Stat(stateFilesPath()); err == nil {
+			return nil
+		}
+	}
+	files[name] = written
+
+	var names []string
+	for name, written := range files {
+		if written {
+			names = append(names, name)
+		}
+	}
+	return saveStateFiles(key, names)
+}
+
+// removeStateKey removes the state key and the list of signed state files, for when the state files they cover are
+// removed: the list would report them as removed, and the key would be shared by the hosts the state is copied to.
+// The next write generates a new key.
+func removeStateKey() error {
+	path := viper.GetString("state-key-file")
+	if path == "" {
+		return nil
+	}
+
+	stateKeyMutex.Lock()
+	defer stateKeyMutex.Unlock()
+	stateFilesMutex.Lock()
+	defer stateFilesMutex.Unlock()
+
+	// The list first, as signed state files that remain are listed again from the key
+	for _, file := range []string{stateFilesPath(), path} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove %s", file)
+		}
+	}
+	return nil
+}
+
+// writeStateFile atomically writes data to the state file at path, signed if state files are signed.
+func writeStateFile(path string, data []byte) error {
+	key, err := stateKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return writeFileAtomic(path, data, 0600)
+	}
+
+	// Listed once written, so that a crash in between can't make it look removed
+	if err := writeFileAtomic(path, signState(key, data), 0600); err != nil {
+		return err
+	}
+	return updateStateFiles(key, path, true)
+}
+
+// readStateFile reads the state file at path like ioutil.ReadFile, verifying its signature if state files are
+// signed. A file that fails verification, or was removed after it was written, is reported and moved aside, and read
+// as if it was missing: what it says can't be trusted, and runs can't be held up by whoever changed it.
+func readStateFile(path string) ([]byte, error) {
+	key, err := stateKey()
+	if err != nil {
+		return nil, err
+	}
+	signed, err := ioutil.ReadFile(path)
+	if key == nil {
+		// Signed before signing was turned off
+		if _, data, ok := splitSignedState(signed); ok {
+			return data, nil
+		}
+		return signed, err
+	}
+
+	if os.IsNotExist(err) {
+		stateFilesMutex.Lock()
+		removed := loadStateFiles(key)[filepath.Base(path)]
+		stateFilesMutex.Unlock()
+		if removed {
+			stateTampered(path, "the file was removed")
+			if err := updateStateFiles(key, path, false); err != nil {
+				logrus.Warnln("Unable to update the list of signed state files: ", err)
+			}
+		}
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, reason := verifyState(key, signed)
+	if reason != "" {
+		stateTampered(path, reason)
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// stateTampered alerts that the state file at path failed verification for reason, and moves it aside, so that it
+// can be inspected and the next write starts over.
+func stateTampered(path, reason string) {
+	file := filepath.Base(path)
+	logrus.Errorf("State file %s was changed outside of the puller, ignoring it: %s", path, reason)
+	promStateTampered.WithLabelValues(file).Inc()
+	emitEvent(eventStateTampered, stateTamperedEvent{File: file, Reason: reason})
+	notify(notification{Event: notifyStateTampered, File: file, Reason: reason})
+
+	if err := os.Rename(path, path+stateTamperedSuffix); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Unable to move %s aside: %v", path, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys", "state.key")
+	withSettings(t, map[string]interface{}{
+		"state-dir":      filepath.Join(dir, "state"),
+		"state-key-file": "",
+	})
+	signed := func() bool {
+		data, err := ioutil.ReadFile(stateFilePath())
+		assert.Nil(t, err)
+		_, _, ok := splitSignedState(data)
+		return ok
+	}
+
+	// Written before there was a key, signed once it is generated
+	assert.Nil(t, updateState(func(state *PullerState) { state.PinnedVersion = testMD5 }))
+	assert.False(t, signed())
+	withSettings(t, map[string]interface{}{"state-key-file": keyFile})
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, testMD5, state.PinnedVersion)
+	assert.True(t, signed())
+	assert.FileExists(t, keyFile+stateFilesSuffix)
+
+	assert.Nil(t, updateState(func(state *PullerState) { state.Disabled = true }))
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.Disabled)
+
+	// Changed behind the puller's back: ignored and moved aside
+	data, err := ioutil.ReadFile(stateFilePath())
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(stateFilePath(), append(data, ' '), 0600))
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, PullerState{}, state)
+	assert.NoFileExists(t, stateFilePath())
+	assert.FileExists(t, stateFilePath()+stateTamperedSuffix)
+
+	// Written again with a signature
+	assert.Nil(t, updateState(func(state *PullerState) { state.Disabled = true }))
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.Disabled)
+
+	// Removed after it was written, reported once
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+	assert.Nil(t, os.Remove(stateFilePath()))
+	_, err = readStateFile(stateFilePath())
+	assert.True(t, os.IsNotExist(err))
+	_, err = readStateFile(stateFilePath())
+	assert.True(t, os.IsNotExist(err))
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "the file was removed", received[0]["reason"])
+
+	// Written without a signature
+	assert.Nil(t, ioutil.WriteFile(stateFilePath(), []byte(`{"disabled": true}`), 0600))
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.False(t, state.Disabled)
+
+	// Read as it is once signing is turned off
+	assert.Nil(t, updateState(func(state *PullerState) { state.Disabled = true }))
+	withSettings(t, map[string]interface{}{"state-key-file": ""})
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.Disabled)
+}
+
+func TestStateIntegrityConcurrentReads(t *testing.T) {
+	dir := t.TempDir()
+	withSettings(t, map[string]interface{}{
+		"state-dir":      filepath.Join(dir, "state"),
+		"state-key-file": filepath.Join(dir, "state.key"),
+	})
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+
+	// Readers never see a file without its signature
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, updateState(func(state *PullerState) { state.ConsecutiveFailures++ }))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := loadState()
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, 80, state.ConsecutiveFailures)
+	assert.Empty(t, server.received())
+}
+
+func TestStateKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "state.key")
+	withSettings(t, map[string]interface{}{
+		"state-dir":      filepath.Join(dir, "state"),
+		"state-key-file": "",
+	})
+
+	key, err := stateKey()
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+
+	withSettings(t, map[string]interface{}{"state-key-file": keyFile})
+	key, err = stateKey()
+	assert.Nil(t, err)
+	assert.Len(t, key, stateKeySize)
+	again, err := stateKey()
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+
+	// Generated once by concurrent first uses
+	assert.Nil(t, os.Remove(keyFile))
+	keys := make(chan []byte, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			key, err := stateKey()
+			assert.Nil(t, err)
+			keys <- key
+		}()
+	}
+	key = <-keys
+	for i := 1; i < 4; i++ {
+		assert.Equal(t, key, <-keys)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("short"), 0600))
+	_, err = stateKey()
+	assert.EqualError(t, err, "state key "+keyFile+" is shorter than 32 bytes")
+}
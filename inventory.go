@@ -0,0 +1,129 @@
+// Inventory of only the local host, generated for every run instead of finding the host in ansible-inventory
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Name of the generated inventory in the run directory. The yaml inventory plugin reads JSON as well.
+const generatedInventoryFileName = "ansible-puller-inventory.json"
+
+// Host var the cloud metadata of the host is injected as
+const cloudMetadataVar = "cloud_metadata"
+
+var inventoryHostTemplate *template.Template
+
+// inventoryHostNames are the names of the host ansible-inventory-host can refer to.
+type inventoryHostNames struct {
+	Hostname      string // As reported by the kernel
+	ShortHostname string // Hostname up to the first dot
+	FQDN          string // Canonical name of the hostname, the hostname if it doesn't resolve
+}
+
+// setupInventoryGeneration validates the options of the generated inventory.
+func setupInventoryGeneration() error {
+	hostTemplate, err := template.New("ansible-inventory-host").Option("missingkey=error").Parse(viper.GetString("ansible-inventory-host"))
+	if err != nil {
+		return errors.Wrap(err, "invalid ansible-inventory-host")
+	}
+	inventoryHostTemplate = hostTemplate
+
+	if !viper.GetBool("ansible-inventory-generate") {
+		return nil
+	}
+	if controllerMode() {
+		return errors.New("ansible-inventory-generate can't be combined with ansible-controller, the controller needs the inventory of its hosts")
+	}
+	return checkCloudProvider("ansible-inventory-cloud-metadata")
+}
+
+// generateInventory reports whether the run of spec uses a generated inventory. Playbooks with their own inventory
+// keep finding the host in it.
+func generateInventory(spec runSpec) bool {
+	return viper.GetBool("ansible-inventory-generate") && !controllerMode() && len(spec.Inventory) == 0
+}
+
+// localFQDN returns the canonical name of the hostname, or the hostname if it doesn't resolve.
+func localFQDN() string {
+	cname, err := net.LookupCNAME(hostname)
+	if err != nil || cname == "" {
+		return hostname
+	}
+	return strings.TrimSuffix(cname, ".")
+}
+
+// inventoryHost returns the name of the local host in the generated inventory.
+func inventoryHost() (string, error) {
+	names := inventoryHostNames{
+		Hostname:      hostname,
+		ShortHostname: strings.SplitN(hostname, ".", 2)[0],
+		FQDN:          localFQDN(),
+	}
+
+	var host strings.Builder
+	if err := inventoryHostTemplate.Execute(&host, names); err != nil {
+		return "", errors.Wrap(err, "unable to render ansible-inventory-host")
+	}
+	name := strings.TrimSpace(host.String())
+	if name == "" {
+		return "", errors.New("ansible-inventory-host rendered an empty host name")
+	}
+
+	return name, nil
+}
+
+// localInventory returns the inventory of only host, with vars and in groups.
+func localInventory(host string, vars map[string]interface{}, groups []string) map[string]interface{} {
+	all := map[string]interface{}{
+		"hosts": map[string]interface{}{host: vars},
+	}
+	if len(groups) > 0 {
+		children := map[string]interface{}{}
+		for _, group := range groups {
+			children[group] = map[string]interface{}{
+				"hosts": map[string]interface{}{host: map[string]interface{}{}},
+			}
+		}
+		all["children"] = children
+	}
+
+	return map[string]interface{}{"all": all}
+}
+
+// writeLocalInventory writes the inventory of the local host into dir, returning its path and the name of the host
+// in it. The host is also in the groups of its labels.
+func writeLocalInventory(dir string, labels map[string]string) (string, string, error) {
+	host, err := inventoryHost()
+	if err != nil {
+		return "", "", err
+	}
+
+	vars := map[string]interface{}{}
+	for name, value := range viper.GetStringMapString("ansible-inventory-vars") {
+		vars[name] = value
+	}
+	if metadata := cloudMetadata(viper.GetString("ansible-inventory-cloud-metadata")); metadata != nil {
+		vars[cloudMetadataVar] = metadata
+	}
+
+	groups := append(append([]string{}, viper.GetStringSlice("ansible-inventory-groups")...), labelGroups(labels)...)
+	data, err := json.MarshalIndent(localInventory(host, vars, groups), "", "  ")
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to encode the generated inventory")
+	}
+	inventory := filepath.Join(dir, generatedInventoryFileName)
+	if err := ioutil.WriteFile(inventory, data, 0600); err != nil {
+		return "", "", errors.Wrap(err, "unable to write the generated inventory")
+	}
+
+	return inventory, host, nil
+}
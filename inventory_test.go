@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withInventoryOptions sets up the generated inventory with the given options, resetting them afterwards.
+func withInventoryOptions(t *testing.T, options map[string]interface{}) error {
+	originals := map[string]interface{}{}
+	for key, value := range options {
+		originals[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	t.Cleanup(func() {
+		for key, value := range originals {
+			viper.Set(key, value)
+		}
+		assert.Nil(t, setupInventoryGeneration())
+	})
+	return setupInventoryGeneration()
+}
+
+func TestSetupInventoryGenerationValidation(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"ansible-inventory-host": "{{.Hostname"},
+		{"ansible-inventory-generate": true, "ansible-controller": true},
+		{"ansible-inventory-generate": true, "ansible-inventory-cloud-metadata": "openstack"},
+	} {
+		t.Run("", func(t *testing.T) {
+			assert.NotNil(t, withInventoryOptions(t, options), options)
+		})
+	}
+}
+
+func TestWriteLocalInventory(t *testing.T) {
+	originalHostname := hostname
+	hostname = "web1.example.com"
+	defer func() { hostname = originalHostname }()
+	assert.Nil(t, withInventoryOptions(t, map[string]interface{}{
+		"ansible-inventory-generate": true,
+		"ansible-inventory-host":     "{{.ShortHostname}}",
+		"ansible-inventory-groups":   []string{"web", "production"},
+		"ansible-inventory-vars":     map[string]string{"role": "frontend"},
+	}))
+
+	dir := t.TempDir()
+	inventory, host, err := writeLocalInventory(dir, map[string]string{"tier": "edge"})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, generatedInventoryFileName), inventory)
+	assert.Equal(t, "web1", host)
+
+	data, err := ioutil.ReadFile(inventory)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"all": {
+		"hosts": {"web1": {"role": "frontend"}},
+		"children": {
+			"web": {"hosts": {"web1": {}}},
+			"production": {"hosts": {"web1": {}}},
+			"tier_edge": {"hosts": {"web1": {}}}
+		}
+	}}`, string(data))
+}
+
+func TestInventoryHostEmpty(t *testing.T) {
+	assert.Nil(t, withInventoryOptions(t, map[string]interface{}{"ansible-inventory-host": " "}))
+	_, err := inventoryHost()
+	assert.NotNil(t, err)
+}
+
+func TestGenerateInventory(t *testing.T) {
+	assert.False(t, generateInventory(runSpec{}))
+	assert.Nil(t, withInventoryOptions(t, map[string]interface{}{"ansible-inventory-generate": true}))
+	assert.True(t, generateInventory(runSpec{}))
+	assert.False(t, generateInventory(runSpec{Inventory: []string{"inventories/certs"}}))
+}
@@ -0,0 +1,79 @@
+// Labels of the host in a local file, so that provisioning can classify hosts without editing the config or an
+// inventory
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Characters not allowed in the names of the groups labels put the host in
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// hostLabels reads the labels in labels-file, read again for every run so that changes apply without a restart.
+// A missing file has no labels. Keys are lowercased, like those of the config.
+func hostLabels() (map[string]string, error) {
+	path := viper.GetString("labels-file")
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return nil, fatalError{errors.Wrapf(err, "unable to read labels-file %s", path)}
+	}
+
+	labels := map[string]string{}
+	for key, value := range file.AllSettings() {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fatalError{errors.Errorf("label %s in labels-file %s must be a single value", key, path)}
+		}
+		labels[key] = fmt.Sprint(value)
+	}
+	return labels, nil
+}
+
+// policyHostLabels returns the labels of the host passed to the policy, those of policy-host-labels over those of
+// labels-file.
+func policyHostLabels(labels map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range viper.GetStringMapString("policy-host-labels") {
+		merged[key] = value
+	}
+	return merged
+}
+
+// labelTags returns the values of the labels-tags labels, run as tags by runs without tags of their own.
+func labelTags(labels map[string]string) []string {
+	tags := []string{}
+	for _, key := range viper.GetStringSlice("labels-tags") {
+		if value := labels[key]; value != "" {
+			tags = append(tags, value)
+		}
+	}
+	return tags
+}
+
+// labelGroups returns the groups labels put the host in, named <key>_<value> like those of the group_by module.
+func labelGroups(labels map[string]string) []string {
+	groups := []string{}
+	for key, value := range labels {
+		groups = append(groups, invalidGroupChars.ReplaceAllString(key+"_"+value, "_"))
+	}
+	sort.Strings(groups)
+	return groups
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withLabelsFile points labels-file to a file with content, restoring the configuration after the test.
+func withLabelsFile(t *testing.T, content string) {
+	original := viper.Get("labels-file")
+	t.Cleanup(func() { viper.Set("labels-file", original) })
+
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	viper.Set("labels-file", path)
+}
+
+func TestHostLabels(t *testing.T) {
+	withLabelsFile(t, "role: db\nRack: 12\nprimary: true\n")
+	labels, err := hostLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"role": "db", "rack": "12", "primary": "true"}, labels)
+
+	viper.Set("labels-file", filepath.Join(t.TempDir(), "labels.yaml"))
+	labels, err = hostLabels()
+	assert.Nil(t, err)
+	assert.Empty(t, labels)
+}
+
+func TestHostLabelsInvalid(t *testing.T) {
+	withLabelsFile(t, "roles:\n  - db\n  - web\n")
+	_, err := hostLabels()
+	assert.Contains(t, err.Error(), "label roles in labels-file")
+	assert.Equal(t, errorClassFatal, errorClass(err))
+
+	withLabelsFile(t, "role: [db")
+	_, err = hostLabels()
+	assert.Equal(t, errorClassFatal, errorClass(err))
+}
+
+func TestPolicyHostLabels(t *testing.T) {
+	original := viper.Get("policy-host-labels")
+	t.Cleanup(func() { viper.Set("policy-host-labels", original) })
+	viper.Set("policy-host-labels", map[string]string{"env": "prod"})
+
+	assert.Equal(t, map[string]string{"env": "prod", "role": "db"},
+		policyHostLabels(map[string]string{"env": "staging", "role": "db"}))
+}
+
+func TestLabelTagsAndGroups(t *testing.T) {
+	original := viper.Get("labels-tags")
+	t.Cleanup(func() { viper.Set("labels-tags", original) })
+	viper.Set("labels-tags", []string{"role", "site"})
+
+	labels := map[string]string{"role": "db", "env": "prod", "app-tier": "back end"}
+	assert.Equal(t, []string{"db"}, labelTags(labels))
+	assert.Equal(t, []string{"app_tier_back_end", "env_prod", "role_db"}, labelGroups(labels))
+}
@@ -0,0 +1,147 @@
+// Run lock making sure only one run executes at a time, across goroutines and puller processes
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Lock file in the state directory, holding the PID and run ID of the holder
+const runLockFileName = "run.lock"
+
+// runLockStatus is the state of the run lock, as returned by the status endpoint.
+type runLockStatus struct {
+	Held    bool        `json:"held"`
+	RunID   string      `json:"run_id"`
+	Since   interface{} `json:"since"`
+	Waiting int         `json:"waiting"` // Runs of this process waiting for the lock
+}
+
+// runLock serializes runs: the mutex between the API, the scheduler and other callers in this process, the lock
+// file between processes sharing the state directory.
+type runLock struct {
+	mutex sync.Mutex
+
+	stateMutex sync.Mutex // Protects the fields below
+	file       *os.File
+	runID      string
+	since      time.Time
+	waiting    int
+}
+
+var runsLock = &runLock{}
+
+func runLockPath() string {
+	return filepath.Join(stateDir(), runLockFileName)
+}
+
+// acquire blocks until the run identified by runID holds the lock, returning the function that releases it.
+func (l *runLock) acquire(runID string) (release func(), err error) {
+	start := time.Now()
+	l.setWaiting(1)
+	l.mutex.Lock()
+	l.setWaiting(-1)
+
+	file, err := l.lockFile(runID)
+	if err != nil {
+		l.mutex.Unlock()
+		return nil, err
+	}
+	promLockWait.Observe(time.Since(start).Seconds())
+
+	l.stateMutex.Lock()
+	l.file = file
+	l.runID = runID
+	l.since = time.Now()
+	l.stateMutex.Unlock()
+
+	return func() {
+		l.stateMutex.Lock()
+		l.file = nil
+		l.runID = ""
+		l.since = time.Time{}
+		l.stateMutex.Unlock()
+
+		if err := unlockFile(file); err != nil {
+			logrus.Warnln("Unable to unlock the run lock file: ", err)
+		}
+		file.Close()
+		l.mutex.Unlock()
+	}, nil
+}
+
+// pause blocks until no run of this process executes, and keeps runs from starting until the returned function is
+// called. Unlike acquire, it doesn't take the lock file, runs of other processes go on.
+func (l *runLock) pause() (resume func()) {
+	l.mutex.Lock()
+	return l.mutex.Unlock
+}
+
+// lockFile takes the lock file, waiting for another process holding it, and records runID as its holder.
+func (l *runLock) lockFile(runID string) (*os.File, error) {
+	if err := ensureStateDir(); err != nil {
+		return nil, err
+	}
+
+	path := runLockPath()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open the run lock file")
+	}
+
+	locked, err := tryLockFile(file)
+	if err == nil && !locked {
+		logrus.Infof("Waiting for %s, which is held by %s", path, describeRunLockHolder(path))
+		err = lockFile(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "unable to lock the run lock file")
+	}
+
+	// The holder is informational, the lock itself is what matters
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d %s\n", os.Getpid(), runID)
+	}
+
+	return file, nil
+}
+
+func (l *runLock) setWaiting(delta int) {
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+
+	l.waiting += delta
+}
+
+func (l *runLock) status() runLockStatus {
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+
+	return runLockStatus{
+		Held:    l.file != nil,
+		RunID:   l.runID,
+		Since:   statusTime(l.since),
+		Waiting: l.waiting,
+	}
+}
+
+// describeRunLockHolder returns who holds the lock file at path, as far as it can be read.
+func describeRunLockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	fields := strings.Fields(string(data))
+	if err != nil || len(fields) != 2 {
+		return "an unknown process"
+	}
+
+	return fmt.Sprintf("run %s of PID %s", fields[1], fields[0])
+}
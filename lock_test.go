@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func withLockStateDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ansible_puller_lock")
+	assert.Nil(t, err)
+
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", dir)
+	return func() {
+		viper.Set("state-dir", originalStateDir)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunLockStatus(t *testing.T) {
+	defer withLockStateDir(t)()
+	lock := &runLock{}
+
+	release, err := lock.acquire("first")
+	assert.Nil(t, err)
+	status := lock.status()
+	assert.True(t, status.Held)
+	assert.Equal(t, "first", status.RunID)
+	assert.NotNil(t, status.Since)
+	assert.Regexp(t, `^run first of PID \d+$`, describeRunLockHolder(runLockPath()))
+
+	release()
+	assert.Equal(t, runLockStatus{}, lock.status())
+}
+
+func TestRunLockSerializesRuns(t *testing.T) {
+	defer withLockStateDir(t)()
+	lock := &runLock{}
+
+	release, err := lock.acquire("first")
+	assert.Nil(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		secondRelease, err := lock.acquire("second")
+		assert.Nil(t, err)
+		close(acquired)
+		secondRelease()
+	}()
+
+	assert.Eventually(t, func() bool { return lock.status().Waiting == 1 }, time.Second, 10*time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("second run acquired the lock while the first held it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second run did not acquire the lock after it was released")
+	}
+}
+
+func TestRunLockWaitsForOtherProcess(t *testing.T) {
+	defer withLockStateDir(t)()
+	lock := &runLock{}
+	assert.Nil(t, ensureStateDir())
+
+	// A separately opened file contends for the lock like another process would
+	other, err := os.OpenFile(runLockPath(), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer other.Close()
+	locked, err := tryLockFile(other)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := lock.acquire("waiting")
+		assert.Nil(t, err)
+		close(acquired)
+		release()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("run acquired the lock held by another process")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Nil(t, unlockFile(other))
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("run did not acquire the lock after the other process released it")
+	}
+}
@@ -0,0 +1,157 @@
+// Selection of where and how the puller logs
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Components of the puller, as logged in the component field
+const (
+	componentRun        = "run"
+	componentDownloader = "downloader"
+	componentVenv       = "venv"
+	componentAnsible    = "ansible"
+	componentHTTP       = "http"
+)
+
+// Loggers of the components
+var (
+	downloaderLog = logrus.WithField("component", componentDownloader)
+	venvLog       = logrus.WithField("component", componentVenv)
+	ansibleLog    = logrus.WithField("component", componentAnsible)
+	httpLog       = logrus.WithField("component", componentHTTP)
+)
+
+var (
+	logRunIDMutex sync.Mutex
+	logRunID      string // ID of the run in progress, logged with the entries of its components
+)
+
+// daemonizedEnv is set in the environment of the detached child started by daemonize.
+const daemonizedEnv = "ANSIBLE_PULLER_DAEMONIZED"
+
+// runningDetached reports whether this process is, or is about to become, a detached daemon.
+func runningDetached() bool {
+	return !viper.GetBool("foreground") || os.Getenv(daemonizedEnv) != ""
+}
+
+// logTarget resolves the "auto" log target: stdout in the foreground, the log file once detached.
+// Subcommands log to stderr so that their own output on stdout can be piped.
+func logTarget() string {
+	target := viper.GetString("log-target")
+	if target != "auto" {
+		return target
+	}
+
+	if pflag.NArg() > 0 {
+		return "stderr"
+	}
+
+	if runningDetached() {
+		return "file"
+	}
+
+	return "stdout"
+}
+
+// setupLogging points logrus at the configured log target.
+func setupLogging() error {
+	var output io.Writer
+
+	switch target := logTarget(); target {
+	case "stdout":
+		output = os.Stdout
+	case "stderr":
+		output = os.Stderr
+	case "file":
+		path := filepath.Join(viper.GetString("log-dir"), appName+".log")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return errors.Wrap(err, "unable to open log file")
+		}
+		output = file
+	case "syslog":
+		if err := addSyslogHook(); err != nil {
+			return err
+		}
+		output = io.Discard
+	default:
+		return errors.Errorf("unknown log-target %q, must be one of auto, stdout, stderr, file or syslog", target)
+	}
+
+	logrus.SetOutput(output)
+	return nil
+}
+
+// setupLogLevel logs debug entries as well in debug mode.
+func setupLogLevel() {
+	if viper.GetBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+		promDebug.Set(1)
+		return
+	}
+	logrus.SetLevel(logrus.InfoLevel)
+	promDebug.Set(0)
+}
+
+// setupLogFormat selects the "log-format": JSON lines or text. auto logs JSON lines unless debugging.
+func setupLogFormat() error {
+	format := viper.GetString("log-format")
+	if format == "auto" {
+		format = "json"
+		if viper.GetBool("debug") {
+			format = "text"
+		}
+	}
+
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return errors.Errorf("unknown log-format %q, must be one of auto, json or text", format)
+	}
+	return nil
+}
+
+// setLogRunID logs the entries of the components with runID until it is cleared with "".
+func setLogRunID(runID string) {
+	logRunIDMutex.Lock()
+	defer logRunIDMutex.Unlock()
+	logRunID = runID
+}
+
+// logContextHook adds the host to every entry, and the ID of the run in progress to the entries of everything but
+// the API, so that a run can be followed across components in aggregated logs.
+type logContextHook struct{}
+
+func (logContextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (logContextHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data["host"]; !ok && hostname != "" {
+		entry.Data["host"] = hostname
+	}
+	if _, ok := entry.Data["run_id"]; ok || entry.Data["component"] == componentHTTP {
+		return nil
+	}
+
+	logRunIDMutex.Lock()
+	runID := logRunID
+	logRunIDMutex.Unlock()
+	if runID != "" {
+		entry.Data["run_id"] = runID
+	}
+	return nil
+}
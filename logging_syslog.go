@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/syslog"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+func addSyslogHook() error {
+	hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, appName)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to syslog")
+	}
+
+	logrus.AddHook(hook)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// logEntries logs with log, a function of a logger with the log context hook writing JSON lines, and returns the
+// entries.
+func logEntries(t *testing.T, log func(logger *logrus.Logger)) []map[string]interface{} {
+	var buffer bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buffer)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(logContextHook{})
+	log(logger)
+
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(&buffer)
+	for decoder.More() {
+		var entry map[string]interface{}
+		assert.Nil(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogContextHook(t *testing.T) {
+	originalHostname := hostname
+	hostname = "web-1"
+	defer func() {
+		hostname = originalHostname
+		setLogRunID("")
+	}()
+
+	entries := logEntries(t, func(logger *logrus.Logger) {
+		logger.Infoln("Idle")
+		setLogRunID("run-1")
+		logger.WithField("component", componentVenv).Infoln("Updating virtualenv")
+		logger.WithField("component", componentHTTP).Infoln("Status requested")
+		logger.WithField("run_id", "run-0").Infoln("Earlier run")
+		setLogRunID("")
+		logger.WithField("component", componentDownloader).Infoln("Prefetching")
+	})
+
+	assert.Len(t, entries, 5)
+	for _, entry := range entries {
+		assert.Equal(t, "web-1", entry["host"])
+	}
+	assert.Nil(t, entries[0]["run_id"])
+	assert.Equal(t, "run-1", entries[1]["run_id"])
+	assert.Equal(t, componentVenv, entries[1]["component"])
+	assert.Nil(t, entries[2]["run_id"])
+	assert.Equal(t, "run-0", entries[3]["run_id"])
+	assert.Nil(t, entries[4]["run_id"])
+}
+
+func TestSetupLogFormat(t *testing.T) {
+	original := logrus.StandardLogger().Formatter
+	defer func() {
+		viper.Set("log-format", "auto")
+		viper.Set("debug", false)
+		logrus.SetFormatter(original)
+	}()
+
+	viper.Set("log-format", "auto")
+	assert.Nil(t, setupLogFormat())
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+
+	viper.Set("debug", true)
+	assert.Nil(t, setupLogFormat())
+	assert.IsType(t, &logrus.TextFormatter{}, logrus.StandardLogger().Formatter)
+
+	viper.Set("log-format", "json")
+	assert.Nil(t, setupLogFormat())
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+
+	viper.Set("log-format", "xml")
+	assert.NotNil(t, setupLogFormat())
+}
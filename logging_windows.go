@@ -0,0 +1,7 @@
+package main
+
+import "github.com/pkg/errors"
+
+func addSyslogHook() error {
+	return errors.New("syslog is not available on Windows")
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -21,92 +22,220 @@ var (
 	hostname              = ""
 	ansibleDisabled       = false
 	ansibleRunning        = false
+	runOutputBuffer       *lineRingBuffer
+	nextRunTime           time.Time // Guarded by playbookMutex, read with earliestNextRun
+	lastRunUsage          processUsage
+	venvRebuilt           = false // Whether force-venv-rebuild has been applied by a run already
 	ansibleLastRunSuccess = true
+	localCacheFile        = fmt.Sprintf("/tmp/%s.tgz", appName)
 	Version               string
-
-	// Prometheus Metrics
-	promAnsibleIsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_running",
-		Help: "Whether or not Ansible-Pull is currently running",
-	})
-	promAnsibleRuns = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "ansible_puller_runs",
-		Help: "Number of Ansible-Pull runs",
-	})
-	promAnsibleRunTime = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_run_time_seconds",
-		Help: "Time it took ansible to run",
-	})
-	promAnsibleIsDisabled = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_disabled",
-		Help: "Whether or not Ansible-Pull is currently locked/disabled",
-	})
-	promAnsibleLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_last_success",
-		Help: "UTC Epoch timestamp of last Successful Ansible run",
-	})
-	promAnsibleSummary = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ansible_puller_play_summary",
-		Help: "Play status for Ansible run",
-	},
-		[]string{"status"},
-	)
-	promVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ansible_puller_version",
-		Help: "Current running version of Ansible Puller",
-	},
-		[]string{"version"},
-	)
-	promDebug = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_debug",
-		Help: "Whether or not Ansible Puller is running in debug mode",
-	})
-	promAnsibleLastExitCode = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ansible_puller_last_exit_code",
-		Help: "Return code from the last ansible execution",
-	})
 )
 
 func init() {
-	prometheus.MustRegister(promAnsibleIsRunning)
-	prometheus.MustRegister(promAnsibleIsDisabled)
-	prometheus.MustRegister(promAnsibleRuns)
-	prometheus.MustRegister(promAnsibleRunTime)
-	prometheus.MustRegister(promAnsibleLastSuccess)
-	prometheus.MustRegister(promAnsibleLastExitCode)
-	prometheus.MustRegister(promAnsibleSummary)
-	prometheus.MustRegister(promVersion)
-	prometheus.MustRegister(promDebug)
-
 	viper.SetConfigName(appName)
 	viper.AddConfigPath(fmt.Sprintf("/etc/%s/", appName))
 	viper.AddConfigPath(fmt.Sprintf("$HOME/.%s", appName))
 	viper.AddConfigPath(".")
 
-	pflag.String("http-listen-string", "0.0.0.0:31836", "IP:Port combination the server should listen on")
+	pflag.String("http-listen-string", "0.0.0.0:31836", "IP:Port combination the server should listen on. Empty to only serve on http-socket")
+	pflag.String("http-socket", "", "Unix socket to also serve the API on, without TLS or authentication as access is up to its permissions")
+	pflag.String("http-socket-mode", "0660", "Permissions of http-socket, in octal")
+	pflag.String("http-socket-group", "", "Group owning http-socket, to give its members access. The group of the puller when empty")
 	pflag.String("http-proto", "https", "Set to 'http' if necessary")
 	pflag.String("http-user", "", "HTTP username for pulling the remote file")
 	pflag.String("http-pass", "", "HTTP password for pulling the remote file")
 
+	pflag.String("http-tls-cert", "", "Certificate to serve the API over HTTPS with, PEM encoded. Served over plain HTTP when empty")
+	pflag.String("http-tls-key", "", "Private key of http-tls-cert, PEM encoded")
+	pflag.String("http-tls-client-ca", "", "CA certificates, PEM encoded, to verify client certificates of API requests against")
+	pflag.String("http-client-cert", "", "Client certificate, PEM encoded, the status and venv subcommands present to the daemon")
+	pflag.String("http-client-key", "", "Private key of http-client-cert, PEM encoded")
+	pflag.String("http-auth-token-file", "", "File containing the token API requests authenticate with, as a bearer token or an HMAC-SHA256 signature")
+	pflag.StringToString("http-auth", map[string]string{}, "Authentication required by API endpoints: none, token, cert or any, by path or read (GET), sensitive (GET /drift) and control (others), e.g. read=token,/metrics=none. Defaults to any with a token or client CA")
+	pflag.Int("health-lock-timeout", 0, "Minutes a run may hold the run lock before /readyz fails and the systemd watchdog isn't pinged. 0 for twice ansible-timeout")
+
 	pflag.String("http-url", "", "Remote endpoint to retrieve the file from")
 	pflag.String("s3-arn", "", "Remote object ARN in S3 to retrieve")
 	pflag.String("s3-conn-region", "", "AWS service endpoint region for S3")
 
+	pflag.Int("download-timeout", 15, "Number of minutes after which an artifact download is aborted")
+	pflag.String("artifact-cache-dir", "", "Directory recently used artifacts are kept in, so going back to one does not download it again. Defaults to artifacts in state-dir")
+	pflag.Int("artifact-cache-versions", 3, "Number of recently used artifacts to keep in artifact-cache-dir. 0 to disable the cache")
+	pflag.Int("artifact-cache-size", 1024, "Megabytes the artifacts in artifact-cache-dir may take up in total. 0 for no limit")
+	pflag.Int("disk-quota", 0, "Megabytes the state, caches, virtualenv and logs of the puller may take up in total, evicting caches and logs beyond it. 0 for no limit")
+	pflag.Int("min-free-disk", 0, "Megabytes that must be free in the temporary directory and artifact-cache-dir for a run to start. 0 to not check")
+	pflag.Int("min-available-memory", 0, "Megabytes of memory that must be available for a run to start, Linux only. 0 to not check")
+	pflag.Int("defer-on-battery", 0, "Battery percentage below which scheduled runs are deferred while on battery power. 0 to not defer")
+	pflag.Bool("defer-on-metered", false, "Defer scheduled runs while the network connection is metered, Linux with NetworkManager only")
+	pflag.Int("max-deferral", 1440, "Minutes since the first deferred run after which deferred runs proceed anyway")
+	pflag.Int("retry-max-attempts", 3, "Number of attempts of downloads, virtualenv updates and galaxy installs failing with network or server errors, and of runs that could not reach the host. 1 to not retry")
+	pflag.Int("retry-backoff", 10, "Seconds to wait before the first retry, doubled for every further one")
+	pflag.Int("retry-max-backoff", 300, "Maximum number of seconds to wait between retries")
+	pflag.Int("run-retry-backoff", 5, "Minutes after which a scheduled run that failed with a retryable error, e.g. of the network, is run again, doubled while it keeps failing. 0 to wait for the next scheduled run")
+	pflag.Int("package-lock-wait", 10, "Minutes to wait for package manager locks held by another process, e.g. unattended-upgrades, before running ansible. 0 to not check")
+	pflag.StringSlice("package-lock-files", defaultPackageLockFiles, "Lock files of the package managers, fcntl locks or PID files ending in .pid")
+	pflag.Int("package-lock-retries", 1, "Number of times a run failing on a package manager lock is run again once the lock is released")
+	pflag.String("ansible-url", "", "URL of the Ansible tarball: http(s)://, s3://bucket/key, gs://bucket/object or azblob://account/container/blob")
+	pflag.String("git-url", "", "Git repository to build the Ansible tarball from, over HTTPS or SSH")
+	pflag.String("git-ref", "", "Branch, tag or commit SHA to pull from git-url. Defaults to the remote HEAD")
+	pflag.String("git-ssh-key", "", "Path to an SSH deploy key for git-url")
+	pflag.Int("git-depth", 1, "Number of commits to fetch from git-url, 0 for the full history")
+	pflag.String("git-cache-dir", "", "Local repository to fetch git-url into, so later pulls only fetch changes. Defaults to git in state-dir")
+	pflag.String("git-status-provider", "", "Report the result of runs as commit statuses of the pulled git-url commit: github or gitlab")
+	pflag.String("git-status-api-url", "", "API base URL for commit statuses, e.g. for GitHub Enterprise or an aggregating proxy. Defaults to the public API of the provider")
+	pflag.String("git-status-repo", "", "Repository to report commit statuses on, owner/repo or the GitLab project path. Derived from git-url by default")
+	pflag.String("git-status-token-file", "", "File containing the API token used to report commit statuses")
+	pflag.String("git-status-context", "", "Name of the reported commit status. Defaults to ansible-puller/<hostname>")
+
+	pflag.String("change-provider", "", "Record runs on change tickets: jira or servicenow")
+	pflag.String("change-api-url", "", "Base URL of the Jira or ServiceNow instance, e.g. https://example.service-now.com")
+	pflag.String("change-ticket", "", "Jira issue key or ServiceNow change number to attach the results of runs to")
+	pflag.Bool("change-create", false, "Create a ticket for every run when change-ticket is not set")
+	pflag.String("change-jira-project", "", "Jira project key to create tickets in with change-create")
+	pflag.Bool("change-require-window", false, "Only run while change-ticket is approved and within its planned window. ServiceNow only")
+	pflag.String("change-user", "", "User for basic authentication with the change API. A bearer token is sent when empty")
+	pflag.String("change-token-file", "", "File containing the API token or password for the change API")
+
 	pflag.String("log-dir", "/var/log/"+appName, "Logging directory")
+	pflag.String("log-target", "auto", "Where to log: auto, stdout, stderr, file (ansible-puller.log in log-dir) or syslog. auto logs to stdout in the foreground and to file otherwise")
+	pflag.String("log-format", "auto", "Format of log entries: json lines, text, or auto for json unless debugging")
+	pflag.Bool("foreground", true, "Stay in the foreground. Set to false to detach from the terminal and run in the background")
+	pflag.String("state-dir", "/var/lib/"+appName, "Directory to keep persistent state in, such as the last run results")
+	pflag.String("state-key-file", "", "Key to sign the state files with and detect changes made to them outside of the puller, generated if missing. Empty to not sign them")
 	pflag.StringSlice("ansible-inventory", []string{}, "List of ansible inventories to look in, comma-separated, relative to ansible-dir")
 	pflag.String("ansible-playbook", "site.yml", "Path in the pulled tarball to the playbook to run, relative to ansible-dir")
 	pflag.String("ansible-dir", "", "Path in the pulled tarball to cd into before ansible commands - usually dir where ansible.cfg is")
+	pflag.Int("ansible-timeout", 120, "Number of minutes after which the ansible-playbook run is killed")
+	pflag.String("galaxy-requirements-file", "requirements.yml", "Galaxy requirements file installed with ansible-galaxy before each run if the artifact has it - relative to ansible-dir")
+	pflag.String("galaxy-cache-dir", "", "Directory galaxy collections and roles are installed into and kept in. Defaults to galaxy in state-dir")
+	pflag.Bool("galaxy-offline", false, "Only install galaxy requirements from galaxy-cache-dir, failing runs if any are missing")
+	pflag.Bool("offline", false, "Air-gapped mode: install python requirements only from the wheels in the artifact and skip galaxy installs, using the collections vendored in it")
+	pflag.String("offline-wheels-dir", "wheels", "Wheels the requirements are installed from in offline mode - relative to the pulled tarball")
+	pflag.String("offline-collections-dir", "collections", "Collections searched first in offline mode - relative to ansible-dir")
+	pflag.Bool("ansible-preflight", true, "Ping the host with ansible before each run, failing it with a specific error if the host is unreachable")
+	pflag.Int("ansible-task-timeout", 0, "Seconds after which a single task is terminated and fails, so a hung task can't take up the whole run. 0 for no timeout")
+	pflag.Int("ansible-heartbeat", 0, "Seconds between log lines naming the running task while ansible-playbook prints nothing. 0 to disable")
+	pflag.Int("ansible-output-timeout", 0, "Number of minutes without any output after which the ansible-playbook run is killed as hung. 0 for no limit")
+	pflag.Bool("run-scope", false, "Start ansible-playbook in a transient systemd scope of its own with systemd-run, for its own cgroup, accounting and limits")
+	pflag.String("run-scope-slice", "", "Slice the scopes of runs are placed in, e.g. ansible-puller.slice. Defaults to that of systemd-run")
+	pflag.StringSlice("run-scope-properties", []string{}, "Properties of the scopes of runs, e.g. MemoryMax=2G,CPUQuota=50%")
+	pflag.Int("shutdown-drain-timeout", 5, "Number of minutes to wait for the in-flight run on SIGTERM or SIGINT before cancelling it. 0 to cancel it right away")
+	pflag.Bool("ansible-controller", false, "Run the playbook against all the hosts it targets, over the connections of the first ansible-inventory, instead of only this host over a local connection")
+	pflag.String("ansible-controller-group", "", "Inventory group or pattern the controller runs the playbook against. Defaults to all hosts the playbook targets")
+	pflag.StringSlice("ansible-controller-ssh-key", []string{}, "SSH keys the controller connects with, held by an ssh-agent for the run: files, aws-sm://<secret> or vault://<mount>/<path>#<field>. Defaults to the SSH configuration")
+	pflag.String("ansible-controller-ssh-user", "", "User the controller connects as. Defaults to that of the inventory")
+	pflag.String("ansible-controller-known-hosts", "", "known_hosts file to check the host keys of the controller's hosts against")
+	pflag.Int("ansible-max-fail-percentage", 100, "Percentage of hosts that may fail before a play is aborted, passed to playbooks as ansible_puller.max_fail_percentage")
+	pflag.Bool("ansible-inventory-generate", false, "Generate an inventory of only this host for every run instead of finding the host in ansible-inventory")
+	pflag.String("ansible-inventory-host", "{{.Hostname}}", "Go template of the name of this host in the generated inventory, with .Hostname, .ShortHostname and .FQDN")
+	pflag.StringSlice("ansible-inventory-groups", []string{}, "Groups this host is in in the generated inventory, comma-separated")
+	pflag.StringToString("ansible-inventory-vars", map[string]string{}, "Host vars of this host in the generated inventory, e.g. role=web")
+	pflag.String("ansible-inventory-cloud-metadata", "", "Cloud provider whose instance metadata is injected into the generated inventory as the cloud_metadata host var: aws, gcp or azure")
+	pflag.String("cloud-metadata", "", "Cloud provider whose instance metadata is passed to playbooks as ansible_puller.cloud: aws, gcp or azure")
+	pflag.StringSlice("cloud-metadata-vars", defaultCloudMetadataVars, "Instance metadata passed to playbooks with cloud-metadata, comma-separated")
+	pflag.String("cloud-metadata-gcp-prefix", "ansible-", "Prefix of the custom metadata attributes of GCE instances passed as their tags, without it. Empty to pass none")
+	pflag.String("ansible-home", "", "HOME directory for ansible commands. Defaults to a fresh directory for every run")
+
+	pflag.String("executor", executorVenv, "Where Ansible runs: venv to install it into a virtualenv from the requirements of the artifact, container to run it in container-image, or runner to run playbooks with ansible-runner in the virtualenv")
+	pflag.String("container-runtime", "docker", "Container runtime of the container executor, e.g. docker or podman")
+	pflag.String("container-image", "", "Image with Ansible installed that the container executor runs it in")
+	pflag.String("container-pull", containerPullMissing, "When the container executor pulls container-image: always before a run, missing or never")
+	pflag.StringSlice("container-volumes", []string{}, "Further mounts of the containers of the container executor, as host-path:container-path[:options]")
+	pflag.StringSlice("container-run-args", []string{}, "Further arguments of the run command of the container runtime, e.g. --network=host")
+	pflag.String("container-connection", "", "Connection plugin Ansible in the container reaches this host with outside of controller mode, e.g. ssh. Required unless ansible-controller is set")
+	pflag.String("runner-package", "ansible-runner", "Requirement specifier of ansible-runner, installed into the virtualenv by the runner executor unless the requirements have it")
+	pflag.String("runner-data-dir", "", "Private data directory of ansible-runner, where it keeps the artifacts of runs. Defaults to runner in state-dir")
+	pflag.Int("runner-rotate-artifacts", 20, "Number of artifact directories ansible-runner keeps, 0 to keep all")
 
 	pflag.String("venv-python", "/usr/bin/python3", "Path to the Python executable to be used for building the virtual environment")
 	pflag.String("venv-path", "/root/.virtualenvs/ansible_puller", "Path to house the virtual environment")
 	pflag.String("venv-requirements-file", "requirements.txt", "Relative path in the pulled tarball of the requirements file to populate the virtual environment")
+	pflag.Int("venv-pip-timeout", 30, "Number of minutes after which pip commands updating the virtual environment are killed")
+	pflag.Bool("venv-ephemeral", false, "Build a fresh virtual environment for every run and remove it afterwards, instead of updating venv-path")
+	pflag.Bool("venv-standby", false, "Build a changed virtual environment next to the current one and switch venv-path to it once Ansible works in it, keeping the current one if it doesn't")
+	pflag.Bool("force-venv-rebuild", false, "Recreate the virtual environment on the first run, even if it is up to date")
+	pflag.Bool("venv-clean-env", false, "Run commands in the virtual environment with only HOME, USER, LOGNAME, TMPDIR and TZ of the puller's environment and a fixed PATH, for reproducible runs")
+	pflag.String("venv-pip-index-url", "", "Index pip installs the requirements from instead of PyPI, e.g. an internal mirror of the audited packages")
+	pflag.StringSlice("venv-pip-extra-index-urls", []string{}, "Indexes pip installs the requirements from besides venv-pip-index-url")
+	pflag.String("venv-constraints-file", "", "Pip constraints file the requirements are resolved within - relative to the pulled tarball unless absolute")
+	pflag.Bool("venv-require-hashes", false, "Refuse to install requirements that are not pinned to a version with their hashes, with pip --require-hashes")
+	pflag.String("venv-pip-cache-dir", "", "Directory pip caches downloads and built wheels in, instead of the pip cache in the home directory")
+	pflag.String("venv-wheelhouse", "", "Directory to cache wheels of the requirements in, so they are not downloaded or built again for every virtual environment")
+
+	pflag.String("decommission-playbook", "", "Playbook to run when decommissioning the host, relative to ansible-dir. Defaults to ansible-playbook")
+	pflag.StringSlice("decommission-tags", []string{}, "Tags to limit the decommission run to, comma-separated")
+	pflag.Bool("decommission-purge-state", false, "Empty the state directory after a successful decommission, keeping the decommissioned flag")
+	pflag.String("bake-playbook", "", "Playbook to run when baking a machine image, relative to ansible-dir. Defaults to ansible-playbook")
+	pflag.StringSlice("bake-tags", []string{}, "Tags to limit the bake run to, comma-separated")
+	pflag.StringSlice("bake-skip-tags", []string{}, "Tags to skip in the bake run, comma-separated")
+	pflag.StringToString("bake-extra-vars", map[string]string{}, "Extra vars of the bake run, e.g. image_build=true")
+	pflag.StringSlice("bake-scrub-paths", []string{}, "Host-specific files removed after a successful bake run besides the puller's state, as globs, e.g. /etc/ssh/ssh_host_*")
+
+	pflag.Int("run-history-size", defaultRunHistorySize, "Number of runs to keep in the run history in state-dir")
+	pflag.Int("run-history-log-lines", 100, "Number of output lines to keep in the run history for each run")
+	pflag.Bool("run-history-environment", true, "Keep the command line, environment, package hash and Ansible config of each run in the run history")
+	pflag.Int("run-tail-lines", 1000, "Number of output lines of the current or most recent run to keep in memory for the tail endpoint")
+	pflag.Int("output-max-line-size", 1024, "Kilobytes of a line of command output read at once when streaming it in debug mode. Longer lines are split rather than lost")
+	pflag.String("child-locale", "C.UTF-8", "Locale of the commands the puller runs, so their output is UTF-8 and in English. Inherited when empty")
+	pflag.StringSlice("redact-patterns", defaultRedactPatterns, "Regular expressions of secrets masked in command output and logs. Only the first group is masked if the expression has one")
+	pflag.StringSlice("redact-env", []string{}, "Environment variables whose values are masked in command output and logs, besides those named like secrets")
+	pflag.String("umask", "", "Umask for the puller and the processes it starts, e.g. 0027. Inherited when empty")
+	pflag.String("work-dir-mode", "0700", "Permissions of the run directory and of directories extracted from the artifact")
+	pflag.Bool("verify-sha256", false, "Verify the artifact against the .sha256 checksum published next to it before extracting it")
+	pflag.Bool("verify-signature", false, "Verify the detached .asc signature published next to the artifact with gpg before extracting it")
+	pflag.String("verify-keyring", "", "File with the public keys that may sign the artifact, armored or binary")
+	pflag.String("rollout-file", "", "Rollout definition published next to the artifact, e.g. rollout.json, that decides when this host adopts a new version")
+	pflag.Bool("rollout-adopt-without-file", false, "Adopt new versions when the source has no rollout-file, rather than keeping the applied artifact")
+	pflag.String("rollout-ring", "", "Ring of the rollout this host is in, instead of the one its hostname falls into")
+	pflag.String("pin-version", "", "MD5 of the artifact to keep applying whatever version is published, e.g. while the host is investigated")
+	pflag.String("policy-file", "", "Rego file or OPA bundle directory to evaluate with the opa CLI before applying a new artifact version")
+	pflag.String("policy-url", "", "OPA data API URL of the decision to evaluate before applying a new artifact version, e.g. http://localhost:8181/v1/data/ansible_puller/allow")
+	pflag.String("policy-query", defaultPolicyQuery, "Query to evaluate against policy-file")
+	pflag.String("labels-file", "/etc/"+appName+"/labels.yaml", "YAML or JSON file with labels of this host, passed to playbooks and the policy and put into groups of the generated inventory")
+	pflag.StringSlice("labels-tags", []string{}, "Labels whose values are run as tags by runs without tags of their own, e.g. role")
+	pflag.StringToString("policy-host-labels", map[string]string{}, "Labels of this host passed to the policy, e.g. env=prod,role=db")
+	pflag.StringToString("run-quotas", map[string]string{}, "Maximum number of runs per source and period, e.g. api=10/1h,compare=2/1h. Sources: schedule, api, compare and upgrade")
+	pflag.Bool("prefetch", false, "Download the next artifact in the background while Ansible runs, so the next run can start from it")
+
+	pflag.String("vault-addr", "", "Address of the Vault server for vault:// secrets. Defaults to VAULT_ADDR")
+	pflag.String("vault-token-file", "", "File containing the Vault token for vault:// secrets. Defaults to VAULT_TOKEN")
+
+	pflag.String("timezone", "Local", "Time zone for schedules and displayed timestamps: Local, UTC or an IANA name such as America/Los_Angeles")
+
+	pflag.String("metrics-namespace", "ansible_puller", "Prefix for the names of all exported Prometheus metrics")
+	pflag.StringToString("metrics-labels", map[string]string{}, "Constant labels added to all exported Prometheus metrics, e.g. env=prod,team=infra")
+
+	pflag.StringSlice("events-webhook-urls", []string{}, "URLs to POST run lifecycle events to as CloudEvents, comma-separated")
+	pflag.String("events-webhook-mode", "binary", "CloudEvents HTTP content mode for events-webhook-urls: binary or structured")
+	pflag.String("events-sns-topic-arn", "", "ARN of an SNS topic to publish run lifecycle events to")
+	pflag.String("events-eventbridge-bus", "", "Name or ARN of an EventBridge bus to put run lifecycle events on")
+	pflag.String("events-aws-region", "", "AWS region for events-sns-topic-arn and events-eventbridge-bus. Defaults to the topic's region or the AWS default")
+	pflag.StringToString("notify-webhooks", map[string]string{}, "Named webhooks to POST JSON notifications of run failures, recoveries, drift and disabling to, e.g. oncall=https://...")
+	pflag.StringToString("notify-slack-webhooks", map[string]string{}, "Named Slack incoming webhooks to post notification messages to")
+	pflag.StringToString("notify-routes", map[string]string{}, "Space-separated destinations per event, e.g. run_failed=\"oncall team\". Events: run_failed, run_recovered, drift_detected and disabled. Every event goes everywhere when empty")
+	pflag.Int("notify-retryable-after", 3, "Consecutive failed runs before failures with retryable errors, e.g. of the network, are notified. Other failures are notified right away")
+	pflag.StringToString("notify-templates", map[string]string{}, "Go templates of the notification messages per event, replacing the defaults")
+
+	pflag.String("tracing-otlp-endpoint", "", "OTLP/HTTP endpoint to export traces of runs to, e.g. http://localhost:4318. Tracing is disabled when empty")
+	pflag.Float64("tracing-sample-ratio", 1, "Fraction of runs to trace, between 0 and 1")
+	pflag.StringToString("tracing-headers", map[string]string{}, "Headers sent with exported traces, e.g. for authentication")
 
 	pflag.Int("sleep", 30, "Number of minutes to sleep between runs")
+	pflag.Int("sleep-splay", 0, "Number of minutes to spread runs of different hosts over. Runs are aligned to the sleep period or schedule-cron and offset by a stable, per-host amount within the splay")
+	pflag.String("schedule-cron", "", "Cron expression in the configured timezone to run at instead of every sleep period, e.g. \"30 2 * * *\" or @daily")
+	pflag.StringArray("blackout-windows", []string{}, "Windows in the configured timezone during which Ansible is not run, e.g. \"Mon-Fri 09:00-17:00\". Repeat for several windows")
+	pflag.String("blackout-mode", blackoutModeQueue, "What happens to runs requested during a blackout window: queue them until it ends, or reject them")
+	pflag.StringArray("freeze-dates", []string{}, "Change freeze dates in the configured timezone during which scheduled runs are skipped, e.g. 2026-12-24 or 12-20..01-02 every year. Repeat for several freezes")
+	pflag.String("freeze-calendar", "", "iCalendar file or http(s) URL whose events are change freezes during which scheduled runs are skipped")
+	pflag.Int("freeze-calendar-refresh", 60, "Number of minutes after which freeze-calendar is fetched again")
 	pflag.Int("sleep-jitter", 0, "Number of maxium minutes to jitter between runs. When set, the actual sleep time between each run will be uniformly distributed between [sleep-jitter, sleep+jitter)")
+	pflag.Bool("noop", false, "Only run ansible-playbook with --check --diff, reporting what it would change as drift instead of applying it")
 	pflag.Bool("start-disabled", false, "Whether or not to start the server disabled")
 	pflag.Bool("debug", false, "Start the server in debug mode")
+	pflag.Float64("time-warp", 1, "Debugging: run schedules, blackout windows, change freezes and retries this many times as fast as the wall clock, e.g. 60 for an hour a minute")
 	pflag.Bool("once", false, "Run Ansible Puller just once, then exit")
 	pflag.Bool("version", false, "Print the build version, then exit")
+	pflag.Bool("validate", false, "Check the configuration, that the artifact can be resolved and venv-python runs, then exit without running Ansible")
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -118,15 +247,67 @@ func init() {
 		logrus.Fatal("unable to bind configuration")
 	}
 
+	// Stop at the first positional argument so subcommands can parse their own flags
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
 
-	logrus.SetOutput(os.Stdout)
-	if viper.GetBool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
-		promDebug.Set(1)
-	} else {
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+	if err := setupLogging(); err != nil {
+		setupFailed(errors.Wrap(err, "unable to set up logging"))
+	}
+	if err := setupTimezone(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupTimeWarp(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupFileModes(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupRunQuotas(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupSchedule(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupPlaybooks(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupInventoryGeneration(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupCloudMetadata(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupRollout(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupPin(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupBlackoutWindows(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupFreezes(); err != nil {
+		setupFailed(err)
 	}
+	if err := setupRedaction(); err != nil {
+		setupFailed(err)
+	}
+	logrus.AddHook(redactHook{})
+	logrus.AddHook(logContextHook{})
+	for _, timeout := range []string{"download-timeout", "venv-pip-timeout", "ansible-timeout"} {
+		if viper.GetInt(timeout) <= 0 {
+			setupFailed(errors.Errorf("%s must be a positive number of minutes", timeout))
+		}
+	}
+
+	registerMetrics()
+	setupLogLevel()
+	if err := setupLogFormat(); err != nil {
+		setupFailed(err)
+	}
+
+	runOutputBuffer = newLineRingBuffer(viper.GetInt("run-tail-lines"))
 
 	if viper.GetBool("start-disabled") {
 		ansibleDisable()
@@ -137,6 +318,67 @@ func init() {
 		logrus.Fatal("Unable to detect hostname")
 	}
 
+	if err := setupEvents(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupNotifications(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupCommitStatus(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupChangeManagement(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupHTTPAuth(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupRunHistory(); err != nil {
+		setupFailed(err)
+	}
+	setupConfigHash()
+	if err := setupConfigReloads(); err != nil {
+		setupFailed(err)
+	}
+	if err := setupTracing(); err != nil {
+		setupFailed(err)
+	}
+
+	// Validating must leave the host as it is
+	if !viper.GetBool("validate") {
+		restoreState()
+	}
+}
+
+// restoreState loads the run history, the failure table and the state of the puller, and restores the disabling,
+// pin and metrics they record. Unlike the rest of the setup it writes to the host, e.g. creating the state directory
+// and the state key on first use.
+func restoreState() {
+	if err := runs.load(); err != nil {
+		logrus.Warnln("Starting with an empty run history: ", err)
+	}
+	setupFailureTable()
+
+	state, err := loadState()
+	if err != nil {
+		logrus.Warnln("Unable to load persisted state: ", err)
+	} else {
+		if !state.LastRunTime.IsZero() {
+			ansibleLastRunSuccess = state.LastRunSuccess
+		}
+		if lastSuccess := state.lastSuccess(); !lastSuccess.IsZero() {
+			// Keep staleness alerts quiet across restarts, whether or not the last run succeeded
+			promAnsibleLastSuccess.Set(float64(lastSuccess.Unix()))
+		}
+		if state.Decommissioned {
+			disableReason = "host decommissioned"
+			ansibleDisable()
+			promDecommissioned.Set(1)
+		} else {
+			restoreDisabled(state)
+		}
+	}
+	restorePin()
 }
 
 func ansibleDisable() {
@@ -151,60 +393,313 @@ func ansibleEnable() {
 	logrus.Infoln("Enabled Ansible-Puller")
 }
 
-func getAnsibleRepository(runDir string) error {
+// gitCacheDir returns the local repository git-url is fetched into.
+func gitCacheDir() string {
+	if dir := viper.GetString("git-cache-dir"); dir != "" {
+		return dir
+	}
+
+	return filepath.Join(stateDir(), "git")
+}
+
+// artifactDownloader returns the downloader for the configured remote artifact and the path to pass to it.
+func artifactDownloader() (downloader, string, error) {
 	httpURL := viper.GetString("http-url")
 	s3Obj := viper.GetString("s3-arn")
 	s3ConnectionRegion := viper.GetString("s3-conn-region")
-	localCacheFile := fmt.Sprintf("/tmp/%s.tgz", appName)
-	var err error
+	gitURL := viper.GetString("git-url")
+	ansibleURL := viper.GetString("ansible-url")
 
 	// Exactly one variable is defined
-	if (httpURL == "") == (s3Obj == "") {
-		return errors.New("exactly one remote resource must be specified. Choose one 'http-url' or 's3-arn'")
+	sources := 0
+	for _, source := range []string{httpURL, s3Obj, gitURL, ansibleURL} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, "", errors.New("exactly one remote resource must be specified. Choose one 'http-url', 's3-arn', 'git-url' or 'ansible-url'")
+	} else if ansibleURL != "" {
+		return urlDownloader(ansibleURL, s3ConnectionRegion)
+	} else if gitURL != "" {
+		downloader := gitDownloader{
+			cacheDir: gitCacheDir(),
+			ref:      viper.GetString("git-ref"),
+			sshKey:   viper.GetString("git-ssh-key"),
+			depth:    viper.GetInt("git-depth"),
+		}
+		return downloader, gitURL, nil
 	} else if httpURL != "" {
 		remoteHttpURL := fmt.Sprintf("%s://%s", viper.GetString("http-proto"), httpURL)
 		downloader := httpDownloader{
 			username: viper.GetString("http-user"),
 			password: viper.GetString("http-pass"),
 		}
-		err = idempotentFileDownload(downloader, remoteHttpURL, localCacheFile)
-	} else if s3Obj != "" {
-		downloader, createError := createS3Downloader(s3ConnectionRegion)
-		if createError != nil {
-			return errors.Wrap(err, "unable to pull Ansible repo")
+		return downloader, remoteHttpURL, nil
+	}
+
+	downloader, err := createS3Downloader(s3ConnectionRegion)
+	if err != nil {
+		return nil, "", err
+	}
+	return downloader, s3Obj, nil
+}
+
+// urlDownloader returns the downloader for the scheme of an ansible-url.
+func urlDownloader(remoteURL, s3ConnectionRegion string) (downloader, string, error) {
+	scheme := strings.SplitN(remoteURL, "://", 2)[0]
+	switch scheme {
+	case "http", "https":
+		downloader := httpDownloader{
+			username: viper.GetString("http-user"),
+			password: viper.GetString("http-pass"),
+		}
+		return downloader, remoteURL, nil
+	case "s3":
+		downloader, err := createS3Downloader(s3ConnectionRegion)
+		if err != nil {
+			return nil, "", err
+		}
+		return downloader, remoteURL, nil
+	case "gs":
+		return newGCSDownloader(), remoteURL, nil
+	case "azblob":
+		return newAzureBlobDownloader(), remoteURL, nil
+	}
+
+	return nil, "", errors.Errorf("unsupported ansible-url scheme %q, expected http, https, s3, gs or azblob", scheme)
+}
+
+func getAnsibleRepository(runDir string, runSpan *span) error {
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return errors.Wrap(err, "unable to pull Ansible repo")
+	}
+
+	if pin := currentPin(); pin != nil {
+		logrus.Infof("Pinned to artifact %s, not checking for newer versions", pin.Version)
+		if err = usePinnedArtifact(pin.Version); err != nil {
+			return err
 		}
-		err = idempotentFileDownload(downloader, s3Obj, localCacheFile)
+		return extractCachedArtifact(runDir, runSpan)
+	}
+
+	if err = promoteStagedArtifact(stagedArtifactFile(), localCacheFile); err != nil {
+		logrus.Warnln("Unable to use the prefetched artifact: ", err)
 	}
+
+	downloadSpan := runSpan.child("download")
+	downloadSpan.setAttribute("artifact.source", remotePath)
+	err = retryPolicyFromConfig().do(retryOperationDownload, func() error {
+		return idempotentFileDownload(downloader, remotePath, localCacheFile)
+	})
+	downloadSpan.end(err)
 	if err != nil {
 		return errors.Wrap(err, "unable to pull Ansible repo")
 	}
 
-	err = extractTgz(localCacheFile, runDir)
+	if err = verifyArtifact(downloader, remotePath, localCacheFile); err != nil {
+		return err
+	}
+	if err = gateRollout(downloader, remotePath); err != nil {
+		return err
+	}
+
+	return extractCachedArtifact(runDir, runSpan)
+}
+
+// extractCachedArtifact extracts the local copy of the artifact into runDir.
+func extractCachedArtifact(runDir string, runSpan *span) error {
+	extractSpan := runSpan.child("extract")
+	err := extractTgz(localCacheFile, runDir)
+	extractSpan.end(err)
 	if err != nil {
+		// The cached artifact may be what is broken, so make sure the next cycle downloads it again
+		os.Remove(localCacheFile)
 		return errors.Wrap(err, "unable to extract tgz")
 	}
 
+	if err := artifacts.store(localCacheFile); err != nil {
+		logrus.Warnln("Unable to cache the artifact: ", err)
+	}
 	return nil
 }
 
-// Core run logic
-func ansibleRun() error {
+// runSpec describes what a single run of the puller should execute.
+type runSpec struct {
+	ID        string   // Identifies the run in logs, events and the API. Generated if empty
+	Name      string   // Name of the configured playbook run, if any
+	Playbook  string   // Path to the playbook to run, relative to ansible-dir
+	Inventory []string // Inventories to find the host in instead of ansible-inventory
+	Tags      []string // Only run plays and tasks tagged with these values
+	SkipTags  []string // Skip plays and tasks tagged with these values
+	Limit     string   // Host pattern the run is further limited to
+	CheckMode bool     // Only report what would change, without changing anything
+	Noop      bool     // Check run of noop mode, run with --diff and recorded as the drift of the host
+	Trigger   string   // What started the run, one of the runTrigger constants
+	Schedule  string   // Name of the schedule that started the run, if any
+	Artifact  string   // Local artifact to run instead of pulling the configured one
+	Fetched   bool     // Run the artifact downloaded by POST /fetch instead of pulling the configured one
+
+	// Passed to the playbook with --extra-vars, besides the run context
+	ExtraVars map[string]string
+
+	// Set for replays of a past run, whose artifact is copied to Artifact
+	Replays       string          // ID of the replayed run
+	ReplayContext *runContextVars // Run context of the replayed run, passed to the playbook again
+
+	// Labels of the host from labels-file, read when the run starts
+	Labels map[string]string
+
+	// Set for the check runs of an ansible-core upgrade
+	VenvPath       string // Virtualenv to run in instead of the current one
+	AnsibleVersion string // ansible-core version to install into it
+
+	// Only run for the hosts that failed the last run, in controller mode
+	RetryFailed bool
+
+	// Don't notify the outcome, post commit statuses or record the run on a change ticket, as for bake runs, which
+	// converge a machine image rather than a host of the fleet
+	NoReport bool
+}
+
+// reported returns whether the outcome of the run is notified, posted as a commit status and recorded on a change
+// ticket. Check runs change nothing, so they are not reported either.
+func (s runSpec) reported() bool {
+	return !s.CheckMode && !s.NoReport
+}
+
+// artifactFile returns the path of the artifact the run extracts.
+func (s runSpec) artifactFile() string {
+	if s.Artifact != "" {
+		return s.Artifact
+	}
+
+	return localCacheFile
+}
+
+// What can start a run
+const (
+	runTriggerStartup      = "startup"
+	runTriggerSchedule     = "schedule"
+	runTriggerAdhoc        = "adhoc"
+	runTriggerAPI          = "api"
+	runTriggerOnce         = "once"
+	runTriggerDecommission = "decommission"
+	runTriggerBake         = "bake"
+	runTriggerUpgrade      = "upgrade"
+	runTriggerCompare      = "compare"
+	runTriggerApply        = "apply"
+	runTriggerRetry        = "retry"
+	runTriggerReplay       = "replay"
+)
+
+// Name of the schedule set up by sleep and sleep-jitter
+const defaultScheduleName = "default"
+
+// errRunSkipped is returned by ansibleRun for a run that was skipped before it started, which says nothing about the
+// host
+var errRunSkipped = errors.New("the run was skipped")
+
+// runSkipped reports whether a run that returned err was skipped rather than run.
+func runSkipped(err error) bool {
+	var skipped interface{ Skipped() bool }
+	return err == errRunSkipped || err == errShuttingDown || errors.As(err, &skipped) && skipped.Skipped()
+}
+
+// Core run logic, running playbook. Returns errRunSkipped if the run was skipped.
+func ansibleRun(trigger string, playbook playbookConfig) error {
+	if shuttingDown() {
+		logrus.Infoln("Tried to run Ansible, but the puller is shutting down. Skipping.")
+		promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+		return errRunSkipped
+	}
 	if ansibleDisabled {
 		logrus.Infoln("Tried to run Ansible, but currently disabled. Skipping.")
-		return nil
+		promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+		return errRunSkipped
+	}
+	var lowResource lowResourceError
+	if err := checkResources(); errors.As(err, &lowResource) {
+		logrus.Warnln("Tried to run Ansible, but the host is low on resources. Skipping: ", err)
+		skipForResources(trigger, lowResource)
+		return errRunSkipped
+	}
+	scheduled := trigger == runTriggerStartup || trigger == runTriggerSchedule || trigger == runTriggerRetry
+	// Runs of --once are usually scheduled by a timer
+	if scheduled || trigger == runTriggerOnce {
+		if err := checkFreeze(); err != nil {
+			logrus.Infoln("Tried to run Ansible, but in a change freeze. Skipping: ", err)
+			promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+			promFrozenRuns.Inc()
+			return errRunSkipped
+		}
+	}
+	if scheduled {
+		if reason := deferRun(); reason != "" {
+			logrus.Infof("Tried to run Ansible, but deferred on %s. Skipping.", reason)
+			promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+			promDeferredRuns.WithLabelValues(reason).Inc()
+			return errRunSkipped
+		}
+	}
+	if err := runQuotas.allow(runSource(trigger)); err != nil {
+		logrus.Warnln("Tried to run Ansible, but over quota. Skipping: ", err)
+		promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+		return errRunSkipped
 	}
 
-	ansibleRunning = true
-	promAnsibleIsRunning.Set(1)
+	spec := playbook.spec(trigger)
+	if viper.GetBool("noop") {
+		spec.CheckMode, spec.Noop = true, true
+	}
 
-	defer func() {
-		ansibleRunning = false
-		promAnsibleIsRunning.Set(0)
-		promAnsibleRuns.Inc()
-	}()
+	_, err := executeRun(spec)
+	return err
+}
 
-	runID := uuid.NewV4().String()
-	runLogger := logrus.WithFields(logrus.Fields{"run_id": runID})
+// executeRun pulls the repository, prepares the virtualenv and runs the playbook described by spec, returning the
+// report of the playbook run if it got as far as running Ansible.
+//
+// Only one run may execute at a time, also across puller processes; callers block until any in-flight run has
+// finished.
+func executeRun(spec runSpec) (*RunReport, error) {
+	if spec.ID == "" {
+		spec.ID = uuid.NewV4().String()
+	}
+
+	run := &PipelineRun{
+		Spec:     spec,
+		Logger:   logrus.WithFields(logrus.Fields{"run_id": spec.ID, "component": componentRun}),
+		ExitCode: -1,
+	}
+	err := runPipeline()(run)
+	return run.Report, err
+}
+
+// executePlaybook is the innermost step of the run pipeline, running the playbook of run from pulling the
+// repository on.
+func executePlaybook(run *PipelineRun) (err error) {
+	spec := run.Spec
+	runID := spec.ID
+	runLogger := run.Logger
+	runSpan := run.Span
+
+	// Evicted within the run lock, so that nothing is removed from under a run
+	enforceDiskQuota()
+	if err = checkResources(); err != nil {
+		runLogger.Errorln("Not starting the run: ", err)
+		return err
+	}
+	if spec.ReplayContext != nil {
+		spec.Labels = spec.ReplayContext.Labels
+	} else if spec.Labels, err = hostLabels(); err != nil {
+		runLogger.Errorln("Not starting the run: ", err)
+		return err
+	}
+	if len(spec.Tags) == 0 {
+		spec.Tags = labelTags(spec.Labels)
+	}
 
 	runLogger.Infoln("Creating tmpdir for execution")
 	runDir, err := ioutil.TempDir("", appName)
@@ -214,62 +709,284 @@ func ansibleRun() error {
 	if !viper.GetBool("debug") {
 		defer os.RemoveAll(runDir)
 	}
+	if err = os.Chmod(runDir, workDirMode); err != nil {
+		return errors.Wrap(err, "unable to set run directory permissions")
+	}
+
+	if spec.Artifact != "" {
+		runLogger.Infoln("Extracting ", spec.Artifact)
+		extractSpan := runSpan.child("extract")
+		err = extractTgz(spec.Artifact, runDir)
+		extractSpan.end(err)
+		if err != nil {
+			return inRunStage(runStageDownload, errors.Wrap(err, "unable to extract tgz"))
+		}
+	} else if spec.Fetched {
+		runLogger.Infoln("Applying the fetched artifact")
+		if err = applyFetchedArtifact(runDir, runSpan); err != nil {
+			runLogger.Errorln("Unable to apply the fetched artifact: ", err)
+			return inRunStage(runStageDownload, err)
+		}
+	} else {
+		runLogger.Infoln("Pulling remote repository")
+		if err = getAnsibleRepository(runDir, runSpan); err != nil {
+			runLogger.Errorln("Unable to pull ansible repository: ", err)
+			return inRunStage(runStageDownload, err)
+		}
+	}
 
-	runLogger.Infoln("Pulling remote repository")
-	if err = getAnsibleRepository(runDir); err != nil {
-		runLogger.Errorln("Unable to pull ansible repository: ", err)
+	manifest, err := checkArtifactPolicy(spec, runDir)
+	if err != nil {
+		runLogger.Errorln("Not applying the artifact: ", err)
 		return err
 	}
 
-	vCfg := VenvConfig{
-		Path:   viper.GetString("venv-path"),
-		Python: viper.GetString("venv-python"),
+	reportRunResult := reportRunCommitStatus(spec)
+	defer func() { reportRunResult(err) }()
+
+	if viper.GetBool("prefetch") {
+		go func() {
+			if err := prefetchArtifact(); err != nil {
+				runLogger.Warnln("Unable to prefetch the next artifact: ", err)
+			}
+		}()
+	}
+
+	venvPath, ansibleVersion := venvForRun(spec)
+	vCfg := configuredVenv(venvPath)
+	vCfg.Constraints = venvConstraintsFile(runDir)
+	vCfg.OfflineWheels = offlineWheelsDir(runDir)
+	vCfg.ForceRebuild = viper.GetBool("force-venv-rebuild") && !venvRebuilt
+	if path := ephemeralVenv(spec, runDir); path != "" {
+		// Removed even when the run directory is kept for debugging
+		vCfg.Path = path
+		defer os.RemoveAll(vCfg.Path)
 	}
 
-	runLogger.Infoln("Ensuring virtualenv exists")
-	if err = vCfg.Ensure(); err != nil {
+	executor, err := runExecutor(spec, vCfg, ansibleVersion)
+	if err != nil {
 		return err
 	}
-	runLogger.Infoln("Updating virtualenv")
-	if err = vCfg.Update(filepath.Join(runDir, viper.GetString("venv-requirements-file"))); err != nil {
-		return err
+	if err = executor.Prepare(runDir, runSpan); err != nil {
+		return inRunStage(runStageVenv, err)
+	}
+
+	homeDir := viper.GetString("ansible-home")
+	if homeDir == "" {
+		homeDir = filepath.Join(runDir, ".home")
+	}
+	if err = os.MkdirAll(filepath.Join(homeDir, ".ansible", "tmp"), 0700); err != nil {
+		return errors.Wrap(err, "unable to create ansible home directory")
 	}
 
 	aCfg := AnsibleConfig{
 		VenvConfig:    vCfg,
 		Cwd:           filepath.Join(runDir, viper.GetString("ansible-dir")),
 		InventoryList: viper.GetStringSlice("ansible-inventory"),
+		HomeDir:       homeDir,
+		Executor:      executor,
+	}
+	if len(spec.Inventory) > 0 {
+		aCfg.InventoryList = spec.Inventory
 	}
 
-	runLogger.Infoln("Finding inventory for the current host")
-	inventory, target, err := aCfg.FindInventoryForHost()
-	if err != nil {
-		// Using exit code 6 (ENXIO: No such device or address) to inform that host was not found in the inventory
-		promAnsibleLastExitCode.Set(6)
-		return err
+	galaxyRequirements := filepath.Join(aCfg.Cwd, viper.GetString("galaxy-requirements-file"))
+	if viper.GetBool("offline") {
+		// Nothing is installed, the collections come with the artifact or were installed beforehand
+		aCfg.VendoredCollections = filepath.Join(aCfg.Cwd, viper.GetString("offline-collections-dir"))
+		aCfg.GalaxyDir = galaxyCacheDir()
+	} else if _, err := os.Stat(galaxyRequirements); err == nil {
+		// Before anything else runs ansible, as inventory plugins may come from collections
+		runLogger.Infoln("Installing galaxy requirements")
+		aCfg.GalaxyDir = galaxyCacheDir()
+		galaxySpan := runSpan.child("galaxy")
+		err = retryPolicyFromConfig().do(retryOperationGalaxy, func() error {
+			return aCfg.InstallGalaxyRequirements(galaxyRequirements, viper.GetBool("galaxy-offline"))
+		})
+		galaxySpan.end(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	var inventory, target string
+	var agent *sshAgent
+	if controllerMode() {
+		inventory, err = aCfg.controllerInventory()
+		if err != nil {
+			return err
+		}
+		agent, err = startControllerSSHAgent()
+		if err != nil {
+			return err
+		}
+		if agent != nil {
+			defer agent.stop()
+		}
+	} else if generateInventory(spec) {
+		runLogger.Infoln("Generating the inventory of the current host")
+		inventory, target, err = writeLocalInventory(runDir, spec.Labels)
+		if err != nil {
+			return err
+		}
+	} else {
+		runLogger.Infoln("Finding inventory for the current host")
+		inventory, target, err = aCfg.FindInventoryForHost(spec.Playbook)
+		if err != nil {
+			// Using exit code 6 (ENXIO: No such device or address) to inform that host was not found in the inventory
+			promAnsibleLastExitCode.Set(6)
+			run.ExitCode = 6
+			return err
+		}
+	}
+	limit := runLimit(target, spec)
+
+	// The controller connects to its hosts as the inventory says, they are not pinged beforehand
+	if viper.GetBool("ansible-preflight") && !controllerMode() {
+		runLogger.Infoln("Checking that ansible can reach the host")
+		preflightSpan := runSpan.child("preflight")
+		err = aCfg.Preflight(inventory, target)
+		preflightSpan.end(err)
+		setConnectivityError(err)
+		if err != nil {
+			promAnsibleLastExitCode.Set(unreachableExitCode)
+			run.ExitCode = unreachableExitCode
+			return err
+		}
 	}
 
+	runVars := runContext(spec)
+	run.Context = &runVars
 	ansibleRunner := AnsiblePlaybookRunner{
 		AnsibleConfig:   aCfg,
-		PlaybookPath:    viper.GetString("ansible-playbook"),
+		PlaybookPath:    spec.Playbook,
 		InventoryPath:   inventory,
-		LimitExpr:       target,
-		LocalConnection: true,
+		Tags:            spec.Tags,
+		SkipTags:        spec.SkipTags,
+		CheckMode:       spec.CheckMode,
+		Diff:            spec.Noop,
+		TaskTimeout:     viper.GetInt("ansible-task-timeout"),
+		Timeout:         time.Duration(viper.GetInt("ansible-timeout")) * time.Minute,
+		ExtraVars:       runExtraVars(spec, runVars),
+		Output:          runOutputBuffer,
+		Heartbeat:       time.Duration(viper.GetInt("ansible-heartbeat")) * time.Second,
+		OutputTimeout:   time.Duration(viper.GetInt("ansible-output-timeout")) * time.Minute,
+		LimitExpr:       limit,
+		LocalConnection: !controllerMode(),
+		Connection:      hostConnection(),
+		Scope:           runScope(runID),
+	}
+	if controllerMode() {
+		if agent != nil {
+			ansibleRunner.Env = append(ansibleRunner.Env, agent.env())
+		}
+		ansibleRunner.RemoteUser = viper.GetString("ansible-controller-ssh-user")
+		if knownHosts := viper.GetString("ansible-controller-known-hosts"); knownHosts != "" {
+			ansibleRunner.SSHCommonArgs = "-o UserKnownHostsFile=" + knownHosts
+		}
+	}
+
+	if packageLockAware() {
+		if err = waitForPackageLocks(runLogger); err != nil {
+			return err
+		}
 	}
 
 	runLogger.Infoln("Starting Ansible run")
 
-	runOutput, ansibleRunErr := ansibleRunner.Run()
-	if ansibleRunErr == nil {
-		promAnsibleLastSuccess.Set(float64(time.Now().Unix()))
+	ansibleSpan := runSpan.child("ansible-playbook")
+	if traceparent := ansibleSpan.traceparent(); traceparent != "" {
+		// Picked up by the opentelemetry callback plugin, so the tasks show up in the same trace
+		ansibleRunner.Env = append(ansibleRunner.Env, "TRACEPARENT="+traceparent)
+	}
+	if viper.GetBool("run-history-environment") {
+		run.Environment = captureRunEnvironment(ansibleRunner, spec.artifactFile())
+	}
+
+	var runOutput AnsibleRunOutput
+	var ansibleRunErr error
+	// The error of the last attempt is kept in ansibleRunErr
+	retryPolicyFromConfig().do(retryOperationPlaybook, func() error {
+		runOutput, ansibleRunErr = ansibleRunner.Run()
+		return playbookRetryError(runOutput, ansibleRunErr)
+	})
+	for attempt := 1; ansibleRunErr != nil && packageLockAware() && attempt <= viper.GetInt("package-lock-retries") &&
+		failedOnPackageLock(newRunReport(runOutput)); attempt++ {
+		// Playbooks are idempotent, running again only finishes what the lock interrupted
+		runLogger.Warnln("Run failed on a package manager lock, running again once it is released")
+		promRetries.WithLabelValues(retryOperationPackageLock).Inc()
+		packageLockSleep(retryPolicyFromConfig().backoff(attempt))
+		if err := waitForPackageLocks(runLogger); err != nil {
+			runLogger.Warnln("Not running again: ", err)
+			break
+		}
+		runOutput, ansibleRunErr = ansibleRunner.Run()
+	}
+	// Check runs don't apply anything, the host is still as the last applying run left it
+	if ansibleRunErr == nil && !spec.CheckMode {
+		succeeded := time.Now()
+		promAnsibleLastSuccess.Set(float64(succeeded.Unix()))
+		if err := updateState(func(state *PullerState) { state.LastSuccessTime = succeeded }); err != nil {
+			runLogger.Warnln("Unable to persist the time of the last success: ", err)
+		}
+		if manifest != nil {
+			if err := saveAppliedManifest(*manifest); err != nil {
+				runLogger.Warnln("Unable to record the applied artifact: ", err)
+			}
+		}
+		if err := saveAppliedArtifact(spec.artifactFile()); err != nil {
+			runLogger.Warnln("Unable to keep the applied artifact for comparisons: ", err)
+		}
 	}
 
 	promAnsibleLastExitCode.Set(float64(runOutput.CommandOutput.Exitcode))
-	promAnsibleSummary.WithLabelValues("ok").Set(float64(runOutput.Stats[target].Ok))
-	promAnsibleSummary.WithLabelValues("skipped").Set(float64(runOutput.Stats[target].Skipped))
-	promAnsibleSummary.WithLabelValues("changed").Set(float64(runOutput.Stats[target].Changed))
-	promAnsibleSummary.WithLabelValues("failures").Set(float64(runOutput.Stats[target].Failures))
-	promAnsibleSummary.WithLabelValues("unreachable").Set(float64(runOutput.Stats[target].Unreachable))
+	promAnsibleRunCPUTime.Set(runOutput.CommandOutput.Usage.CPUTime.Seconds())
+	promAnsibleRunPeakRSS.Set(float64(runOutput.CommandOutput.Usage.PeakRSSBytes))
+	lastRunUsage = runOutput.CommandOutput.Usage
+
+	report := newRunReport(runOutput)
+	report.RunID = runID
+	report.Playbook = spec.Playbook
+	report.Success = ansibleRunErr == nil
+	setLastRunReport(report)
+	run.Report = &report
+
+	summary := report.Hosts[target]
+	if controllerMode() {
+		summary = report.totals()
+		failedHosts := report.failedHosts()
+		promFailedHosts.Set(float64(len(failedHosts)))
+		if len(failedHosts) > 0 {
+			runLogger.Warnf("%d of %d hosts failed: %s", len(failedHosts), len(report.Hosts), strings.Join(failedHosts, ", "))
+		}
+		if err := saveFailedHosts(report); err != nil {
+			runLogger.Warnln("Unable to record the failed hosts for retries: ", err)
+		}
+	}
+	ansibleSpan.setAttribute("ansible.exit_code", report.ExitCode)
+	ansibleSpan.setAttribute("ansible.hosts", len(report.Hosts))
+	ansibleSpan.setAttribute("ansible.tasks.ok", summary.Ok)
+	ansibleSpan.setAttribute("ansible.tasks.changed", summary.Changed)
+	ansibleSpan.setAttribute("ansible.tasks.failed", summary.Failures)
+	ansibleSpan.setAttribute("ansible.tasks.skipped", summary.Skipped)
+	ansibleSpan.setAttribute("ansible.tasks.unreachable", summary.Unreachable)
+	ansibleSpan.end(ansibleRunErr)
+	promAnsibleSummary.WithLabelValues("ok").Set(float64(summary.Ok))
+	promAnsibleSummary.WithLabelValues("skipped").Set(float64(summary.Skipped))
+	promAnsibleSummary.WithLabelValues("changed").Set(float64(summary.Changed))
+	promAnsibleSummary.WithLabelValues("failures").Set(float64(summary.Failures))
+	promAnsibleSummary.WithLabelValues("unreachable").Set(float64(summary.Unreachable))
+	promAnsibleFailedTasks.Set(float64(report.failedTasks()))
+	if timedOut := report.timedOutTasks(); len(timedOut) > 0 {
+		runLogger.Warnln("Tasks exceeded the task timeout: ", strings.Join(timedOut, ", "))
+	}
+	promChangedTasks.Set(float64(report.changedTasks()))
+	if spec.Noop {
+		recordDrift(report)
+	}
+
+	run.ExitCode = report.ExitCode
+	run.Summary = &summary
 
 	runLogger.Infoln("Writing ansible output to logfile")
 
@@ -284,7 +1001,10 @@ func ansibleRun() error {
 	}
 
 	runLogger.Infoln("All done, going to sleep")
-	return ansibleRunErr
+	if ansibleRunErr != nil {
+		return runStageError{stage: runStagePlaybook, exitCode: report.ExitCode, err: ansibleRunErr}
+	}
+	return nil
 }
 
 func main() {
@@ -293,68 +1013,205 @@ func main() {
 		return
 	}
 
+	if pflag.NArg() > 0 {
+		if err := runSubcommand(pflag.Args()); err != nil {
+			logrus.Fatalln(err)
+		}
+
+		return
+	}
+
+	if viper.GetBool("validate") {
+		logrus.Exit(validate())
+	}
+	if problems := validateConfig(); len(problems) > 0 {
+		for _, problem := range problems {
+			logrus.Errorln("Invalid configuration: ", problem)
+		}
+		logrus.Exit(exitRunFailed)
+	}
+
+	if !viper.GetBool("once") && runningDetached() && os.Getenv(daemonizedEnv) == "" {
+		if err := daemonize(); err != nil {
+			logrus.Fatalln(err)
+		}
+
+		return
+	}
+
+	if err := acquirePidFile(); err != nil {
+		logrus.Fatalln(err)
+	}
+	defer releasePidFile()
+	logrus.RegisterExitHandler(releasePidFile)
+
+	// Only safe while holding the PID file, another instance could be extracting or running commands otherwise
+	cleanupInterruptedExtractions(os.TempDir())
+	reapOrphanedProcesses()
+
 	if viper.GetBool("once") {
-		if err := ansibleRun(); err != nil {
-			logrus.Fatalln("Ansible run failed due to: " + err.Error())
+		// The run is cancelled or finishes, and the remaining playbooks are skipped
+		watchShutdownSignals(nil)
+		if ansibleDisabled {
+			logrus.Errorln("Not running Ansible, the puller is disabled")
+			logrus.Exit(exitPullerDisabled)
+		}
+
+		// Every playbook runs, the exit code is that of the first one failing
+		var firstErr error
+		for _, playbook := range currentPlaybooks() {
+			err := ansibleRun(runTriggerOnce, playbook)
+			if runSkipped(err) {
+				continue
+			}
+			recordRunState(playbook.Name, err)
+			if err != nil {
+				logrus.Errorf("Ansible run of playbook %s failed due to: %v", playbook.Name, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
 		}
+		flushEvents()
+		if firstErr != nil {
+			logrus.Exit(onceExitCode(firstErr))
+		}
+
+		return
+	}
 
+	if runningAsService() {
+		runService()
 		return
 	}
 
+	watchShutdownSignals(func() {
+		flushEvents()
+		logrus.Exit(0)
+	})
+	runDaemon()
+}
+
+// runDaemon schedules runs and serves the web interface. It only returns if the server fails.
+func runDaemon() {
 	promVersion.WithLabelValues(Version).Set(1)
+	watchReloadSignal()
 
-	period := time.Duration(viper.GetInt("sleep")) * time.Minute
 	jitter := time.Duration(viper.GetInt("sleep-jitter")) * time.Minute
-
-	if jitter >= period {
-		logrus.Fatalf("sleep-jitter is too large, it must be less than the 'sleep' period %d", viper.GetInt("sleep"))
+	splay := time.Duration(viper.GetInt("sleep-splay")) * time.Minute
+	if err := validateSchedules(currentPlaybooks(), jitter, splay); err != nil {
+		logrus.Fatalln(err)
 	}
 
-  // TODO(Tosh):  Replace these logic with scheduler
-	runChan := make(chan bool)
-	runOnce := func() {
-		// Non-blocking send to the run channel. If it's already running, this will be a no-op.
-		select {
-		case runChan <- true:
-		default:
-		}
+	// Runs of all playbooks are queued here and executed one after the other
+	queue := newRunQueue()
+
+	schedules := newPlaybookSchedules(queue, jitter, splay)
+	schedules.mutex.Lock()
+	for _, playbook := range currentPlaybooks() {
+		schedules.start(playbook, true)
 	}
+	schedules.mutex.Unlock()
+	daemonSchedules = schedules
 
 	go func() {
-		runChan <- true // block until the first run is triggered
-		if jitter == 0 {
-			for range time.Tick(period) {
-				runOnce()
+		for _, playbook := range currentPlaybooks() {
+			if playbook.cron != nil {
+				logrus.Infof("Launching Ansible Runner. Runs %s at %q (with %d minutes jitter).", playbook.Name, playbook.cron, viper.GetInt("sleep-jitter"))
+			} else {
+				logrus.Infoln(fmt.Sprintf("Launching Ansible Runner. Runs %s %d minutes (with %d mintues jitter) apart.", playbook.Name, playbook.Interval, viper.GetInt("sleep-jitter")))
 			}
-			return
 		}
-		rng := rand.New(rand.NewSource(time.Now().Unix()))
-		for {
-			// Sleep for a random duration in [period - jitter, period + jitter).
-			time.Sleep(period - jitter + time.Duration(rng.Int63n(2*int64(jitter))))
-			runOnce()
+		if viper.GetBool("noop") {
+			logrus.Infoln("Noop mode: runs only check for drift, nothing is applied")
 		}
-	}()
-
-	go func() {
-		logrus.Infoln(fmt.Sprintf("Launching Ansible Runner. Runs %d minutes (with %d mintues jitter) apart.", viper.GetInt("sleep"), viper.GetInt("sleep-jitter")))
-		for range runChan {
+		retries := newRunRetries()
+		for {
+			run, done := queue.next()
+			playbook, ok := findPlaybook(run.playbook)
+			if !ok {
+				logrus.Infof("Not running playbook %s, it was removed by a reload", run.playbook)
+				done()
+				continue
+			}
+			recordingRuns.RLock()
 			start := time.Now()
-			err := ansibleRun()
+			err := ansibleRun(run.trigger, playbook)
+			done()
+			if runSkipped(err) {
+				recordingRuns.RUnlock()
+				continue
+			}
 			elapsed := time.Since(start)
 
 			promAnsibleRunTime.Set(elapsed.Seconds())
 
-			if err != nil {
+			if errorClass(err) == errorClassFatal {
+				logrus.Errorln("Ansible run failed with an error that persists until the configuration or artifact changes: " + err.Error())
+			} else if err != nil {
 				logrus.Errorln("Ansible run failed due to: " + err.Error())
-				ansibleLastRunSuccess = false
-			} else {
-				ansibleLastRunSuccess = true
 			}
+			recordRunState(playbook.Name, err)
+
+			if wait, ok := retries.after(playbook.Name, err, time.Duration(playbook.Interval)*time.Minute); ok {
+				logrus.Infof("Running playbook %s again in %s after a retryable error", playbook.Name, wait)
+				name := playbook.Name
+				go func() {
+					sleep(schedulerClock, wait)
+					queue.push(runTriggerRetry, name)
+				}()
+			}
+			recordingRuns.RUnlock()
 		}
 	}()
 
-	srv := NewServer(runOnce)
-	logrus.Infoln("Starting server on " + viper.GetString("http-listen-string"))
-	logrus.Fatal(srv.ListenAndServe())
+	srv := NewServer(func() {
+		for _, playbook := range currentPlaybooks() {
+			queue.push(runTriggerAdhoc, playbook.Name)
+		}
+	})
+	socketPath := viper.GetString("http-socket")
+	if srv.Addr == "" && socketPath == "" {
+		logrus.Fatal("http-listen-string and http-socket are both empty, the API must be served on at least one")
+	}
+
+	var listener, socketListener net.Listener
+	var err error
+	if srv.Addr != "" {
+		logrus.Infoln("Starting server on " + srv.Addr)
+		if listener, err = net.Listen("tcp", srv.Addr); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if socketPath != "" {
+		logrus.Infoln("Starting server on unix socket " + socketPath)
+		if socketListener, err = listenSocket(socketPath); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		logrus.Warnln("Unable to notify systemd of readiness: ", err)
+	}
+	go sdWatchdog()
+
+	serveErr := make(chan error, 2)
+	if socketListener != nil {
+		socketSrv := &http.Server{
+			Handler:      socketHandler(srv.Handler),
+			WriteTimeout: srv.WriteTimeout,
+			ReadTimeout:  srv.ReadTimeout,
+		}
+		go func() { serveErr <- socketSrv.Serve(socketListener) }()
+	}
+	if listener != nil {
+		go func() {
+			if srv.TLSConfig != nil {
+				serveErr <- srv.ServeTLS(listener, "", "")
+				return
+			}
+			serveErr <- srv.Serve(listener)
+		}()
+	}
+	logrus.Fatal(<-serveErr)
 }
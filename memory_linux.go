@@ -0,0 +1,13 @@
+package main
+
+import "io/ioutil"
+
+// availableMemory returns the bytes of memory available for starting new processes without swapping.
+func availableMemory() (uint64, error) {
+	meminfo, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	return parseMemAvailable(meminfo)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// availableMemory is only supported on Linux.
+func availableMemory() (uint64, error) {
+	return 0, errMemoryUnsupported
+}
@@ -0,0 +1,407 @@
+// Prometheus metrics exported by the puller
+
+package main
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+var (
+	promAnsibleIsRunning     prometheus.Gauge
+	promAnsibleRuns          prometheus.Counter
+	promAnsibleRunTime       prometheus.Gauge
+	promAnsibleIsDisabled    prometheus.Gauge
+	promDisabledUntil        prometheus.Gauge
+	promAnsibleLastSuccess   prometheus.Gauge
+	promAnsibleSummary       *prometheus.GaugeVec
+	promVersion              *prometheus.GaugeVec
+	promDebug                prometheus.Gauge
+	promAnsibleLastExitCode  prometheus.Gauge
+	promDecommissioned       prometheus.Gauge
+	promAnsibleRunCPUTime    prometheus.Gauge
+	promAnsibleRunPeakRSS    prometheus.Gauge
+	promVerificationFailures prometheus.Counter
+	promAnsibleFailedTasks   prometheus.Gauge
+	promPolicyDenials        prometheus.Counter
+	promRunDuration          prometheus.Histogram
+	promDownloadDuration     prometheus.Histogram
+	promRunOutcomes          *prometheus.CounterVec
+	promChangedTasks         prometheus.Gauge
+	promLockWait             prometheus.Histogram
+	promRunsBySource         *prometheus.CounterVec
+	promThrottledRuns        *prometheus.CounterVec
+	promLowResourceSkips     *prometheus.CounterVec
+	promDeferredRuns         *prometheus.CounterVec
+	promFrozenRuns           prometheus.Counter
+	promVenvPendingChanges   prometheus.Gauge
+	promRetries              *prometheus.CounterVec
+	promPackageLockWaits     prometheus.Counter
+	promOutputSilence        prometheus.Gauge
+	promHungRuns             prometheus.Counter
+	promArtifactCacheHits    prometheus.Counter
+	promArtifactCacheMisses  prometheus.Counter
+	promArtifactCacheBytes   prometheus.Gauge
+	promDiskUsage            *prometheus.GaugeVec
+	promRolloutHeldBack      prometheus.Gauge
+	promRolloutFileMissing   prometheus.Counter
+	promPinned               prometheus.Gauge
+	promConfigInfo           *prometheus.GaugeVec
+	promConfigFileChanged    prometheus.Gauge
+	promConfigReloads        *prometheus.CounterVec
+	promOrphanGroups         prometheus.Counter
+	promRunFailures          *prometheus.CounterVec
+	promDrifted              prometheus.Gauge
+	promDriftedTasks         prometheus.Gauge
+	promFailedHosts          prometheus.Gauge
+	promAuthFailures         prometheus.Counter
+	promPlaybookRuns         *prometheus.CounterVec
+	promPlaybookLastSuccess  *prometheus.GaugeVec
+	promRunErrorClasses      *prometheus.CounterVec
+	promStateTampered        *prometheus.CounterVec
+)
+
+// Outcomes of runs, as counted by promRunOutcomes
+const (
+	runOutcomeSuccess     = "success"
+	runOutcomeFailed      = "failed"
+	runOutcomeTimeout     = "timeout"
+	runOutcomeSkipped     = "skipped"
+	runOutcomeUnreachable = "unreachable"
+	runOutcomeTransient   = "transient"   // Failed by an error that may go away by itself, after any retries
+	runOutcomeInterrupted = "interrupted" // Cancelled by the shutdown of the puller
+	runOutcomeNoop        = "noop"        // Check run of noop mode that succeeded, which applied nothing
+)
+
+var (
+	// From a no-op run on a small host to the command timeout
+	runDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+	downloadDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+	// Mostly uncontended, otherwise up to the duration of the run holding the lock
+	lockWaitBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 600, 1800, 3600, 7200}
+)
+
+// metricOpts returns the options shared by all metrics: the configured namespace and constant labels.
+func metricOpts(name, help string) prometheus.Opts {
+	return prometheus.Opts{
+		Namespace:   viper.GetString("metrics-namespace"),
+		Name:        name,
+		Help:        help,
+		ConstLabels: viper.GetStringMapString("metrics-labels"),
+	}
+}
+
+// histogramOpts returns the options of a histogram, sharing namespace and labels with all other metrics.
+func histogramOpts(name, help string, buckets []float64) prometheus.HistogramOpts {
+	opts := metricOpts(name, help)
+	return prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        opts.Name,
+		Help:        opts.Help,
+		ConstLabels: opts.ConstLabels,
+		Buckets:     buckets,
+	}
+}
+
+// runOutcomeOf returns the outcome of a run that returned err.
+func runOutcomeOf(err error) string {
+	var timeout interface{ Timeout() bool }
+	var unreachable interface{ Unreachable() bool }
+	var interrupted interface{ Interrupted() bool }
+	switch {
+	case err == nil:
+		return runOutcomeSuccess
+	case isTransient(err):
+		return runOutcomeTransient
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return runOutcomeTimeout
+	case errors.As(err, &unreachable) && unreachable.Unreachable():
+		return runOutcomeUnreachable
+	case errors.As(err, &interrupted) && interrupted.Interrupted():
+		return runOutcomeInterrupted
+	}
+
+	return runOutcomeFailed
+}
+
+// noopOutcome returns the outcome of a run that returned err, noop rather than success if it was a check run of noop
+// mode.
+func noopOutcome(noop bool, err error) string {
+	if outcome := runOutcomeOf(err); outcome != runOutcomeSuccess || !noop {
+		return outcome
+	}
+	return runOutcomeNoop
+}
+
+// registerMetrics creates all metrics from the configuration and registers them with Prometheus.
+//
+// This needs to happen after the configuration is read, and before any metric is used.
+func registerMetrics() {
+	promAnsibleIsRunning = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("running", "Whether or not Ansible-Pull is currently running"),
+	))
+	promAnsibleRuns = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("runs", "Number of Ansible-Pull runs"),
+	))
+	promAnsibleRunTime = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("run_time_seconds", "Time it took ansible to run"),
+	))
+	promAnsibleIsDisabled = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("disabled", "Whether or not Ansible-Pull is currently locked/disabled"),
+	))
+	promDisabledUntil = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("disabled_until_timestamp", "Unix timestamp at which the disabled puller enables itself again, 0 if not set"),
+	))
+	promAnsibleLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("last_success", "UTC Epoch timestamp of last Successful Ansible run"),
+	))
+	promAnsibleSummary = prometheus.NewGaugeVec(prometheus.GaugeOpts(
+		metricOpts("play_summary", "Play status for Ansible run"),
+	),
+		[]string{"status"},
+	)
+	promVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts(
+		metricOpts("version", "Current running version of Ansible Puller"),
+	),
+		[]string{"version"},
+	)
+	promDebug = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("debug", "Whether or not Ansible Puller is running in debug mode"),
+	))
+	promAnsibleLastExitCode = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("last_exit_code", "Return code from the last ansible execution"),
+	))
+	promDecommissioned = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("decommissioned", "1 if the host was decommissioned successfully, -1 if the decommission run failed"),
+	))
+	promAnsibleRunCPUTime = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("run_cpu_seconds", "User and system CPU time used by the last ansible execution"),
+	))
+	promAnsibleRunPeakRSS = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("run_peak_rss_bytes", "Peak resident set size of the largest process of the last ansible execution"),
+	))
+	promVerificationFailures = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("verification_failures", "Number of downloaded artifacts that failed checksum or signature verification"),
+	))
+	promAnsibleFailedTasks = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("failed_tasks", "Number of tasks of the last ansible execution that failed or were unreachable on any host"),
+	))
+	promPolicyDenials = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("policy_denials", "Number of new artifact versions that the policy refused to apply"),
+	))
+	promRunDuration = prometheus.NewHistogram(histogramOpts(
+		"run_duration_seconds", "Duration of runs, from pulling the artifact until Ansible finished", runDurationBuckets,
+	))
+	promDownloadDuration = prometheus.NewHistogram(histogramOpts(
+		"download_duration_seconds", "Duration of artifact downloads, not counting skipped downloads of unchanged artifacts", downloadDurationBuckets,
+	))
+	promRunOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("runs_by_outcome", "Number of runs by outcome: success, noop, failed, transient, timeout, unreachable or skipped"),
+	),
+		[]string{"outcome"},
+	)
+	for _, outcome := range []string{runOutcomeSuccess, runOutcomeFailed, runOutcomeTimeout, runOutcomeSkipped, runOutcomeUnreachable, runOutcomeTransient, runOutcomeInterrupted, runOutcomeNoop} {
+		// Export every outcome from the start, so rates over them don't miss the first occurrence
+		promRunOutcomes.WithLabelValues(outcome)
+	}
+	promChangedTasks = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("changed_tasks", "Number of tasks of the last ansible execution that changed any host"),
+	))
+	promLockWait = prometheus.NewHistogram(histogramOpts(
+		"lock_wait_seconds", "Time runs waited for the run lock, held by another run of this or another process", lockWaitBuckets,
+	))
+	promRunsBySource = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("runs_by_source", "Number of runs by what started them, e.g. schedule or api"),
+	),
+		[]string{"source"},
+	)
+	promThrottledRuns = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("throttled_runs", "Number of runs refused because their source exceeded its run quota"),
+	),
+		[]string{"source"},
+	)
+	promLowResourceSkips = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("low_resource_skips", "Number of runs skipped or refused because the host was low on a resource: disk, memory or disk_quota"),
+	),
+		[]string{"resource"},
+	)
+	for _, resource := range []string{resourceDisk, resourceMemory, resourceDiskQuota} {
+		promLowResourceSkips.WithLabelValues(resource)
+	}
+	promDeferredRuns = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("deferred_runs", "Number of scheduled runs deferred on battery or a metered connection"),
+	),
+		[]string{"reason"},
+	)
+	for _, reason := range []string{deferralBattery, deferralMetered} {
+		promDeferredRuns.WithLabelValues(reason)
+	}
+	promFrozenRuns = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("frozen_runs", "Number of scheduled runs skipped during a change freeze"),
+	))
+	promVenvPendingChanges = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("venv_pending_changes", "Number of packages the last pip dry run would install, upgrade or downgrade"),
+	))
+	promRetries = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("retries", "Number of retries of operations that failed transiently, by operation"),
+	),
+		[]string{"operation"},
+	)
+	promPackageLockWaits = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("package_lock_waits", "Number of times a run waited for a package manager lock held by another process"),
+	))
+	promOutputSilence = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("output_silence_seconds", "Seconds since the running ansible-playbook last printed anything, 0 when not watched"),
+	))
+	promHungRuns = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("hung_runs", "Number of runs killed after printing nothing for ansible-output-timeout"),
+	))
+	promArtifactCacheHits = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("artifact_cache_hits", "Number of artifact pulls that found the artifact current or in the cache, without downloading it"),
+	))
+	promArtifactCacheMisses = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("artifact_cache_misses", "Number of artifact pulls that had to download the artifact"),
+	))
+	promArtifactCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("artifact_cache_bytes", "Size of the artifacts in the artifact cache"),
+	))
+	promDiskUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts(
+		metricOpts("disk_usage_bytes", "Disk space taken by the puller, by area: state, artifacts, galaxy, wheelhouse, venv or logs"),
+	),
+		[]string{"area"},
+	)
+	for _, area := range diskAreas {
+		promDiskUsage.WithLabelValues(area)
+	}
+	promRolloutHeldBack = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("rollout_held_back", "1 if the last pull kept the applied artifact as the rollout doesn't include this host yet, 0 if not"),
+	))
+	promRolloutFileMissing = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("rollout_file_missing", "Number of new artifact versions pulled while no rollout file was published"),
+	))
+	promPinned = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("pinned", "1 if the puller is pinned to an artifact version, 0 if not"),
+	))
+	promConfigInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts(
+		metricOpts("config_info", "Always 1, labelled with the SHA-256 of the effective configuration of the puller"),
+	),
+		[]string{"config_hash"},
+	)
+	promConfigFileChanged = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("config_file_changed", "1 if the config file changed since the puller read it, until it is reloaded"),
+	))
+	promConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("config_reloads", "Number of reloads of the config file by outcome: success or failure"),
+	),
+		[]string{"outcome"},
+	)
+	for _, outcome := range []string{reloadOutcomeSuccess, reloadOutcomeFailure} {
+		promConfigReloads.WithLabelValues(outcome)
+	}
+	promOrphanGroups = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("orphaned_process_groups", "Number of orphaned process groups stopped at startup"),
+	))
+	promRunFailures = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("failures_by_fingerprint", "Number of failed runs by the fingerprint of their failure, up to 50 fingerprints, then other"),
+	),
+		[]string{"fingerprint"},
+	)
+	promDrifted = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("drifted", "1 if the last check run of noop mode found changes to make, 0 if not"),
+	))
+	promDriftedTasks = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("drifted_tasks", "Tasks the last check run of noop mode would have changed the host with"),
+	))
+	promFailedHosts = prometheus.NewGauge(prometheus.GaugeOpts(
+		metricOpts("failed_hosts", "Hosts that failed or were unreachable in the last run of controller mode"),
+	))
+	promAuthFailures = prometheus.NewCounter(prometheus.CounterOpts(
+		metricOpts("http_auth_failures", "API requests refused for lacking the authentication their endpoint requires"),
+	))
+	promPlaybookRuns = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("playbook_runs", "Number of runs of the configured playbooks, by playbook and outcome"),
+	),
+		[]string{"playbook", "outcome"},
+	)
+	promPlaybookLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts(
+		metricOpts("playbook_last_success_timestamp", "Unix time of the last successful run of a configured playbook"),
+	),
+		[]string{"playbook"},
+	)
+	promRunErrorClasses = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("run_errors_by_class", "Number of failed runs by the class of their error: retryable, fatal or failed"),
+	),
+		[]string{"class"},
+	)
+	promStateTampered = prometheus.NewCounterVec(prometheus.CounterOpts(
+		metricOpts("state_tampered", "Number of state files that failed verification against their signature, by file"),
+	),
+		[]string{"file"},
+	)
+	for _, class := range errorClasses {
+		promRunErrorClasses.WithLabelValues(class)
+	}
+	for _, operation := range retryOperations {
+		promRetries.WithLabelValues(operation)
+	}
+	for _, source := range quotaRunSources {
+		promRunsBySource.WithLabelValues(source)
+		promThrottledRuns.WithLabelValues(source)
+	}
+
+	prometheus.MustRegister(promAnsibleIsRunning)
+	prometheus.MustRegister(promAnsibleIsDisabled)
+	prometheus.MustRegister(promDisabledUntil)
+	prometheus.MustRegister(promAnsibleRuns)
+	prometheus.MustRegister(promAnsibleRunTime)
+	prometheus.MustRegister(promAnsibleLastSuccess)
+	prometheus.MustRegister(promAnsibleLastExitCode)
+	prometheus.MustRegister(promAnsibleSummary)
+	prometheus.MustRegister(promVersion)
+	prometheus.MustRegister(promDebug)
+	prometheus.MustRegister(promDecommissioned)
+	prometheus.MustRegister(promAnsibleRunCPUTime)
+	prometheus.MustRegister(promAnsibleRunPeakRSS)
+	prometheus.MustRegister(promVerificationFailures)
+	prometheus.MustRegister(promAnsibleFailedTasks)
+	prometheus.MustRegister(promPolicyDenials)
+	prometheus.MustRegister(promRunDuration)
+	prometheus.MustRegister(promDownloadDuration)
+	prometheus.MustRegister(promRunOutcomes)
+	prometheus.MustRegister(promChangedTasks)
+	prometheus.MustRegister(promLockWait)
+	prometheus.MustRegister(promRunsBySource)
+	prometheus.MustRegister(promThrottledRuns)
+	prometheus.MustRegister(promLowResourceSkips)
+	prometheus.MustRegister(promDeferredRuns)
+	prometheus.MustRegister(promFrozenRuns)
+	prometheus.MustRegister(promVenvPendingChanges)
+	prometheus.MustRegister(promRetries)
+	prometheus.MustRegister(promPackageLockWaits)
+	prometheus.MustRegister(promOutputSilence)
+	prometheus.MustRegister(promHungRuns)
+	prometheus.MustRegister(promArtifactCacheHits)
+	prometheus.MustRegister(promArtifactCacheMisses)
+	prometheus.MustRegister(promArtifactCacheBytes)
+	prometheus.MustRegister(promDiskUsage)
+	prometheus.MustRegister(promRolloutHeldBack)
+	prometheus.MustRegister(promRolloutFileMissing)
+	prometheus.MustRegister(promPinned)
+	prometheus.MustRegister(promConfigInfo)
+	prometheus.MustRegister(promConfigFileChanged)
+	prometheus.MustRegister(promConfigReloads)
+	prometheus.MustRegister(promOrphanGroups)
+	prometheus.MustRegister(promRunFailures)
+	prometheus.MustRegister(promDrifted)
+	prometheus.MustRegister(promDriftedTasks)
+	prometheus.MustRegister(promFailedHosts)
+	prometheus.MustRegister(promAuthFailures)
+	prometheus.MustRegister(promPlaybookRuns)
+	prometheus.MustRegister(promPlaybookLastSuccess)
+	prometheus.MustRegister(promRunErrorClasses)
+	prometheus.MustRegister(promStateTampered)
+}
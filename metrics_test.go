@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricOpts(t *testing.T) {
+	originalNamespace := viper.Get("metrics-namespace")
+	originalLabels := viper.Get("metrics-labels")
+	defer func() {
+		viper.Set("metrics-namespace", originalNamespace)
+		viper.Set("metrics-labels", originalLabels)
+	}()
+
+	viper.Set("metrics-namespace", "puller_prod")
+	viper.Set("metrics-labels", map[string]string{"env": "prod", "dc": "us-west"})
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts(metricOpts("running", "help")))
+	desc := gauge.Desc().String()
+	assert.Contains(t, desc, `fqName: "puller_prod_running"`)
+	assert.Contains(t, desc, `dc="us-west"`)
+	assert.Contains(t, desc, `env="prod"`)
+}
+
+func TestDefaultMetricNames(t *testing.T) {
+	assert.Contains(t, promAnsibleIsRunning.Desc().String(), `fqName: "ansible_puller_running"`)
+	assert.Contains(t, promAnsibleLastExitCode.Desc().String(), `fqName: "ansible_puller_last_exit_code"`)
+}
+
+func TestRunOutcomeOf(t *testing.T) {
+	assert.Equal(t, runOutcomeSuccess, runOutcomeOf(nil))
+	assert.Equal(t, runOutcomeFailed, runOutcomeOf(errors.New("exit status 2")))
+
+	timedOut := timeoutError{errors.Wrap(errors.New("signal: killed"), "Execution timed out")}
+	assert.Equal(t, runOutcomeTimeout, runOutcomeOf(errors.Wrap(timedOut, "ansible run failed")))
+}
+
+func TestHistogramNames(t *testing.T) {
+	assert.Contains(t, promRunDuration.Desc().String(), `fqName: "ansible_puller_run_duration_seconds"`)
+	assert.Contains(t, promDownloadDuration.Desc().String(), `fqName: "ansible_puller_download_duration_seconds"`)
+	assert.Contains(t, promLockWait.Desc().String(), `fqName: "ansible_puller_lock_wait_seconds"`)
+}
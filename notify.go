@@ -0,0 +1,237 @@
+// Notifications of run outcomes and puller state changes to webhooks and Slack, routed by event so that on-call
+// only hears about what concerns them
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Events notified about
+const (
+	notifyRunFailed      = "run_failed"
+	notifyRunRecovered   = "run_recovered"
+	notifyDriftDetected  = "drift_detected"
+	notifyDisabled       = "disabled"
+	notifyStateTampered  = "state_tampered"
+	notifyDecommissioned = "decommissioned"
+)
+
+var notifyEvents = []string{notifyRunFailed, notifyRunRecovered, notifyDriftDetected, notifyDisabled, notifyStateTampered,
+	notifyDecommissioned}
+
+// Messages of the events unless notify-templates overrides them, executed with a notification
+var defaultNotifyTemplates = map[string]string{
+	notifyRunFailed:      `Ansible run {{.RunID}} failed on {{.Host}} ({{.ConsecutiveFailures}} in a row{{if eq .ErrorClass "fatal"}}, fatal{{end}}): {{.Error}}`,
+	notifyRunRecovered:   `Ansible runs on {{.Host}} succeed again after {{.ConsecutiveFailures}} failures`,
+	notifyDriftDetected:  `{{.Host}} drifted: {{.DriftedTasks}} tasks would change the host`,
+	notifyDisabled:       `ansible-puller on {{.Host}} was disabled{{if .Reason}}: {{.Reason}}{{end}}{{if .Until}} until {{.Until.Format "2006-01-02 15:04 MST"}}{{end}}`,
+	notifyStateTampered:  `State file {{.File}} of ansible-puller on {{.Host}} was changed outside of it: {{.Reason}}`,
+	notifyDecommissioned: `{{.Host}} was decommissioned, ansible-puller runs no more playbooks on it`,
+}
+
+// notification is the JSON payload posted to notify-webhooks.
+type notification struct {
+	Event               string     `json:"event"`
+	Host                string     `json:"host"`
+	Time                time.Time  `json:"time"`
+	Message             string     `json:"message"`
+	RunID               string     `json:"run_id,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	ErrorClass          string     `json:"error_class,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+	DriftedTasks        int        `json:"drifted_tasks,omitempty"`
+	Reason              string     `json:"reason,omitempty"`
+	Until               *time.Time `json:"until,omitempty"`
+	File                string     `json:"file,omitempty"`
+}
+
+// notifyDestination is a webhook notifications are posted to.
+type notifyDestination struct {
+	url   string
+	slack bool // Post Slack messages rather than notification payloads
+}
+
+var (
+	notifyDestinations map[string]notifyDestination
+	notifyRoutes       map[string][]string // Names of the destinations of an event, all of them if there are no routes
+	notifyTemplates    map[string]*template.Template
+	notifyClient       = &http.Client{Timeout: 10 * time.Second}
+)
+
+// setupNotifications reads the destinations, routes and templates of notifications.
+func setupNotifications() error {
+	destinations := map[string]notifyDestination{}
+	for name, url := range viper.GetStringMapString("notify-webhooks") {
+		destinations[name] = notifyDestination{url: url}
+	}
+	for name, url := range viper.GetStringMapString("notify-slack-webhooks") {
+		if _, ok := destinations[name]; ok {
+			return errors.Errorf("notification destination %q is both a webhook and a Slack webhook", name)
+		}
+		destinations[name] = notifyDestination{url: url, slack: true}
+	}
+
+	var routes map[string][]string
+	for event, names := range viper.GetStringMapString("notify-routes") {
+		if !knownNotifyEvent(event) {
+			return errors.Errorf("invalid notify-routes event %q, expected one of %s", event, strings.Join(notifyEvents, ", "))
+		}
+		if routes == nil {
+			routes = map[string][]string{}
+		}
+		for _, name := range strings.Fields(names) {
+			if _, ok := destinations[name]; !ok {
+				return errors.Errorf("notify-routes sends %s to unknown destination %q", event, name)
+			}
+			routes[event] = append(routes[event], name)
+		}
+	}
+
+	templates := map[string]*template.Template{}
+	for event, text := range defaultNotifyTemplates {
+		templates[event] = template.Must(template.New(event).Parse(text))
+	}
+	for event, text := range viper.GetStringMapString("notify-templates") {
+		if !knownNotifyEvent(event) {
+			return errors.Errorf("invalid notify-templates event %q, expected one of %s", event, strings.Join(notifyEvents, ", "))
+		}
+		parsed, err := template.New(event).Parse(text)
+		if err != nil {
+			return errors.Wrapf(err, "invalid notify-templates template for %s", event)
+		}
+		templates[event] = parsed
+	}
+
+	notifyDestinations, notifyRoutes, notifyTemplates = destinations, routes, templates
+	return nil
+}
+
+func knownNotifyEvent(event string) bool {
+	for _, known := range notifyEvents {
+		if known == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyDestinationsOf returns the names of the destinations of event, sorted.
+func notifyDestinationsOf(event string) []string {
+	var names []string
+	if notifyRoutes == nil {
+		for name := range notifyDestinations {
+			names = append(names, name)
+		}
+	} else {
+		names = append(names, notifyRoutes[event]...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notify sends n to the destinations of its event in the background. Failures are logged and otherwise ignored.
+func notify(n notification) {
+	destinations := notifyDestinationsOf(n.Event)
+	if len(destinations) == 0 {
+		return
+	}
+
+	n.Host = hostname
+	if n.Time.IsZero() {
+		n.Time = time.Now().UTC()
+	}
+	var message strings.Builder
+	if err := notifyTemplates[n.Event].Execute(&message, n); err != nil {
+		logrus.Warnf("Unable to render the %s notification: %v", n.Event, err)
+		message.Reset()
+		message.WriteString(n.Event + " on " + n.Host)
+	}
+	n.Message = message.String()
+
+	for _, name := range destinations {
+		eventsGroup.Add(1)
+		go func(name string, destination notifyDestination) {
+			defer eventsGroup.Done()
+			if err := destination.send(n); err != nil {
+				logrus.Warnf("Unable to send the %s notification to %s: %v", n.Event, name, err)
+			}
+		}(name, notifyDestinations[name])
+	}
+}
+
+func (d notifyDestination) send(n notification) error {
+	var body interface{} = n
+	if d.slack {
+		body = map[string]string{"text": n.Message}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode notification")
+	}
+
+	resp, err := notifyClient.Post(d.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// notifyRunOutcome notifies about a failed run of playbook, or a successful run after failed ones of the same
+// playbook. Called before the outcome is recorded in the state.
+//
+// Failures with retryable errors are only notified once notify-retryable-after runs failed in a row, and so is the
+// recovery from them, as they usually go away by themselves.
+func notifyRunOutcome(runID, playbook string, err error, failure *runFailure) {
+	if len(notifyDestinations) == 0 {
+		return
+	}
+
+	puller, stateErr := loadState()
+	if stateErr != nil {
+		logrus.Warnln("Unable to read the previous failures for notifications: ", stateErr)
+	}
+	state := puller.playbook(playbook)
+
+	retryableAfter := viper.GetInt("notify-retryable-after")
+	if err != nil {
+		class := errorClass(err)
+		if class == errorClassRetryable && state.ConsecutiveFailures+1 < retryableAfter {
+			return
+		}
+		message := err.Error()
+		if failure != nil {
+			message = failure.Message
+		}
+		notify(notification{
+			Event:               notifyRunFailed,
+			RunID:               runID,
+			Error:               message,
+			ErrorClass:          class,
+			ConsecutiveFailures: state.ConsecutiveFailures + 1,
+		})
+	} else if state.ConsecutiveFailures >= retryableAfter ||
+		state.ConsecutiveFailures > 0 && state.LastRunOutcome != runOutcomeTransient {
+		notify(notification{
+			Event:               notifyRunRecovered,
+			RunID:               runID,
+			ConsecutiveFailures: state.ConsecutiveFailures,
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// notifyServer records the bodies of the notifications posted to it.
+type notifyServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func newNotifyServer(t *testing.T) *notifyServer {
+	server := &notifyServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&body))
+		server.mutex.Lock()
+		server.bodies = append(server.bodies, body)
+		server.mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *notifyServer) received() []map[string]interface{} {
+	eventsGroup.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bodies := s.bodies
+	s.bodies = nil
+	return bodies
+}
+
+// withNotifications sets up notifications with the given options, resetting them afterwards.
+func withNotifications(t *testing.T, options map[string]map[string]string) {
+	keys := []string{"notify-webhooks", "notify-slack-webhooks", "notify-routes", "notify-templates"}
+	for _, key := range keys {
+		viper.Set(key, options[key])
+	}
+	t.Cleanup(func() {
+		for _, key := range keys {
+			viper.Set(key, map[string]string{})
+		}
+		assert.Nil(t, setupNotifications())
+	})
+	assert.Nil(t, setupNotifications())
+}
+
+func TestSetupNotificationsValidation(t *testing.T) {
+	withNotifications(t, nil)
+
+	for _, options := range []map[string]map[string]string{
+		{"notify-webhooks": {"a": "http://a"}, "notify-slack-webhooks": {"a": "http://b"}},
+		{"notify-webhooks": {"a": "http://a"}, "notify-routes": {"run_exploded": "a"}},
+		{"notify-webhooks": {"a": "http://a"}, "notify-routes": {"run_failed": "a b"}},
+		{"notify-templates": {"run_failed": "{{.Host"}},
+	} {
+		for key, value := range options {
+			viper.Set(key, value)
+		}
+		assert.NotNil(t, setupNotifications(), options)
+		for key := range options {
+			viper.Set(key, map[string]string{})
+		}
+	}
+}
+
+func TestNotifyRouting(t *testing.T) {
+	oncall := newNotifyServer(t)
+	slack := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{
+		"notify-webhooks":       {"oncall": oncall.URL},
+		"notify-slack-webhooks": {"team": slack.URL},
+		"notify-routes":         {"run_failed": "oncall team", "drift_detected": "team"},
+		"notify-templates":      {"drift_detected": "{{.Host}}: {{.DriftedTasks}} drifted"},
+	})
+	originalHostname := hostname
+	hostname = "web-1"
+	defer func() { hostname = originalHostname }()
+
+	notify(notification{Event: notifyRunFailed, RunID: "run-1", Error: "task failed", ConsecutiveFailures: 2})
+	received := oncall.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "run_failed", received[0]["event"])
+	assert.Equal(t, "web-1", received[0]["host"])
+	assert.Equal(t, "run-1", received[0]["run_id"])
+	assert.Equal(t, "Ansible run run-1 failed on web-1 (2 in a row): task failed", received[0]["message"])
+	assert.Equal(t, []map[string]interface{}{{"text": "Ansible run run-1 failed on web-1 (2 in a row): task failed"}},
+		slack.received())
+
+	notify(notification{Event: notifyDriftDetected, DriftedTasks: 3})
+	assert.Empty(t, oncall.received())
+	assert.Equal(t, []map[string]interface{}{{"text": "web-1: 3 drifted"}}, slack.received())
+
+	// Not routed anywhere
+	notify(notification{Event: notifyDisabled, Reason: "maintenance"})
+	assert.Empty(t, oncall.received())
+	assert.Empty(t, slack.received())
+}
+
+func TestNotifyWithoutRoutes(t *testing.T) {
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+
+	until := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	notify(notification{Event: notifyDisabled, Reason: "maintenance", Until: &until})
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Contains(t, received[0]["message"], "disabled: maintenance until 2020-01-01 12:00 UTC")
+	assert.Equal(t, "2020-01-01T12:00:00Z", received[0]["until"])
+}
+
+func TestNotifyRunOutcome(t *testing.T) {
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", t.TempDir())
+	defer viper.Set("state-dir", originalStateDir)
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+
+	notifyRunOutcome("run-1", "", nil, nil)
+	assert.Empty(t, server.received())
+
+	notifyRunOutcome("run-2", "", errors.New("exit status 2"), &runFailure{Message: "install nginx: No package matching"})
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "run_failed", received[0]["event"])
+	assert.Equal(t, "install nginx: No package matching", received[0]["error"])
+	assert.Equal(t, float64(1), received[0]["consecutive_failures"])
+
+	assert.Nil(t, updateState(func(state *PullerState) { state.ConsecutiveFailures = 3 }))
+	notifyRunOutcome("run-3", "", nil, nil)
+	received = server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "run_recovered", received[0]["event"])
+	assert.Equal(t, "Ansible runs on "+hostname+" succeed again after 3 failures", received[0]["message"])
+}
+
+func TestNotifyRetryableRunOutcome(t *testing.T) {
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", t.TempDir())
+	defer viper.Set("state-dir", originalStateDir)
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+
+	retryable := transientError{errors.New("connection refused")}
+	for failures := 0; failures < 2; failures++ {
+		notifyRunOutcome("run-1", "", retryable, nil)
+		assert.Nil(t, updateState(func(state *PullerState) {
+			state.ConsecutiveFailures++
+			state.LastRunOutcome = runOutcomeTransient
+		}))
+	}
+	assert.Empty(t, server.received())
+
+	// The recovery from failures that weren't notified isn't notified either
+	notifyRunOutcome("run-2", "", nil, nil)
+	assert.Empty(t, server.received())
+
+	notifyRunOutcome("run-3", "", retryable, nil)
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "retryable", received[0]["error_class"])
+	assert.Equal(t, float64(3), received[0]["consecutive_failures"])
+
+	notifyRunOutcome("run-4", "", fatalError{errors.New("artifact denied by policy")}, nil)
+	received = server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "fatal", received[0]["error_class"])
+	assert.Contains(t, received[0]["message"], "in a row, fatal)")
+}
@@ -0,0 +1,161 @@
+// Stopping the processes that commands left behind when the puller crashed during a run
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// File in the state directory listing the process groups of the commands running
+const processGroupsFileName = "process-groups.json"
+
+// spawnedGroup is the process group of a command started by a puller. The boot and the start time of its leader tell
+// it apart from a process group that got the same ID once it was gone.
+type spawnedGroup struct {
+	PGID      int    `json:"pgid"`
+	PullerPID int    `json:"puller_pid"` // Of the puller that started the command
+	BootID    string `json:"boot_id"`
+	StartTime uint64 `json:"start_time"` // Of the leader, in clock ticks since boot
+}
+
+// Protects the process groups file
+var processGroupsMutex sync.Mutex
+
+func processGroupsPath() string {
+	return filepath.Join(stateDir(), processGroupsFileName)
+}
+
+func loadProcessGroups() ([]spawnedGroup, error) {
+	data, err := ioutil.ReadFile(processGroupsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var groups []spawnedGroup
+	err = json.Unmarshal(data, &groups)
+	return groups, err
+}
+
+func saveProcessGroups(groups []spawnedGroup) error {
+	data, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(processGroupsPath(), data, 0600)
+}
+
+// updateProcessGroups changes the recorded process groups with fn.
+func updateProcessGroups(fn func(groups []spawnedGroup) []spawnedGroup) error {
+	processGroupsMutex.Lock()
+	defer processGroupsMutex.Unlock()
+
+	groups, err := loadProcessGroups()
+	if err != nil {
+		return err
+	}
+	return saveProcessGroups(fn(groups))
+}
+
+// trackProcessGroup records the process group led by pid, which a command of this puller was just started in, so
+// that it is stopped on the next start if the puller crashes while the command runs. The returned function removes
+// it once the command exited. Only the process groups the puller started itself are ever stopped: what playbooks
+// start in process groups or sessions of their own, e.g. services, is left alone.
+func trackProcessGroup(pid int) (untrack func()) {
+	bootID, startTime, err := processStart(pid)
+	if err != nil {
+		venvLog.Debugln("Not tracking the process group of the command: ", err)
+		return func() {}
+	}
+
+	group := spawnedGroup{PGID: pid, PullerPID: os.Getpid(), BootID: bootID, StartTime: startTime}
+	if err := updateProcessGroups(func(groups []spawnedGroup) []spawnedGroup {
+		return append(groups, group)
+	}); err != nil {
+		venvLog.Debugln("Unable to record the process group of the command: ", err)
+		return func() {}
+	}
+
+	return func() {
+		err := updateProcessGroups(func(groups []spawnedGroup) []spawnedGroup {
+			var kept []spawnedGroup
+			for _, recorded := range groups {
+				if recorded != group {
+					kept = append(kept, recorded)
+				}
+			}
+			return kept
+		})
+		if err != nil {
+			venvLog.Debugln("Unable to remove the process group of the command: ", err)
+		}
+	}
+}
+
+// orphaned reports whether the recorded process group is still running, rather than gone or replaced by one that got
+// its ID since.
+func (g spawnedGroup) orphaned() bool {
+	bootID, err := currentBootID()
+	if err != nil || bootID != g.BootID || !processGroupAlive(g.PGID) {
+		return false
+	}
+
+	// The leader may be gone while processes of its group remain, whose ID isn't given to another group meanwhile
+	if _, startTime, err := processStart(g.PGID); err == nil && startTime != g.StartTime {
+		return false
+	}
+	return true
+}
+
+// reapOrphanedProcesses stops the process groups left behind by commands of a puller that crashed, e.g. the forks
+// of ansible-playbook and their ssh connections after the puller crashed in the middle of a run. Only safe while
+// holding the PID file, the processes of another instance would be stopped otherwise.
+func reapOrphanedProcesses() {
+	processGroupsMutex.Lock()
+	defer processGroupsMutex.Unlock()
+
+	groups, err := loadProcessGroups()
+	if err != nil {
+		logrus.Warnln("Unable to look for processes left behind by a previous run: ", err)
+		return
+	}
+
+	var kept, orphans []spawnedGroup
+	for _, group := range groups {
+		if group.PullerPID == os.Getpid() {
+			kept = append(kept, group)
+		} else if group.orphaned() {
+			orphans = append(orphans, group)
+		}
+	}
+	for _, group := range orphans {
+		logrus.Warnf("Stopping process group %d left behind by puller %d, which is no longer running", group.PGID, group.PullerPID)
+		if err := stopProcessGroup(group.PGID, false); err != nil {
+			logrus.Debugln("Unable to stop the process group: ", err)
+		}
+		promOrphanGroups.Inc()
+	}
+
+	deadline := time.Now().Add(processStopGrace)
+	for _, group := range orphans {
+		for processGroupAlive(group.PGID) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if processGroupAlive(group.PGID) {
+			logrus.Warnf("Process group %d did not exit within %s of being stopped, killing it", group.PGID, processStopGrace)
+			stopProcessGroup(group.PGID, true)
+		}
+	}
+
+	if err := saveProcessGroups(kept); err != nil {
+		logrus.Warnln("Unable to record the stopped process groups: ", err)
+	}
+}
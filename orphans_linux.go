@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// currentBootID returns the ID of the current boot.
+func currentBootID() (string, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(data)), err
+}
+
+// processStart returns the ID of the boot and when the process pid started, in clock ticks since boot.
+func processStart(pid int) (bootID string, startTime uint64, err error) {
+	bootID, err = currentBootID()
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The start time follows the command name, which may contain spaces and parentheses
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 20 {
+		return "", 0, errors.Errorf("unexpected stat of process %d", pid)
+	}
+	startTime, err = strconv.ParseUint(fields[19], 10, 64)
+	return bootID, startTime, err
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+var errProcessStartUnsupported = errors.New("process start times are only read on Linux")
+
+// currentBootID is only known on Linux.
+func currentBootID() (string, error) {
+	return "", errProcessStartUnsupported
+}
+
+// processStart is only known on Linux, so process groups aren't tracked elsewhere.
+func processStart(pid int) (string, uint64, error) {
+	return "", 0, errProcessStartUnsupported
+}
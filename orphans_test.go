@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVenvCommandTracksProcessGroups(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process groups are only tracked on Linux")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	venv := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(venv, "bin"), 0755))
+	// Recorded once started
+	script := "#!/bin/sh\necho $$\nfor i in 1 2 3 4 5 6 7 8 9 10; do grep -q '\"pgid\":'$$ " + processGroupsPath() +
+		" && break; sleep 0.1; done\ncat " + processGroupsPath() + "\necho\nenv\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "groups"), []byte(script), 0755))
+
+	output := VenvCommand{Config: VenvConfig{Path: venv}, Binary: "groups"}.Run()
+	assert.Nil(t, output.Error)
+	lines := strings.SplitN(output.Stdout, "\n", 3)
+	pgid, err := strconv.Atoi(lines[0])
+	assert.Nil(t, err)
+	var groups []spawnedGroup
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &groups))
+	tracked := func(groups []spawnedGroup) bool {
+		for _, group := range groups {
+			if group.PGID == pgid && group.PullerPID == os.Getpid() {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, tracked(groups))
+	// Nothing the playbook starts can be taken for the puller's
+	assert.NotContains(t, lines[2], "ANSIBLE_PULLER")
+
+	groups, err = loadProcessGroups()
+	assert.Nil(t, err)
+	assert.False(t, tracked(groups))
+}
+
+// startGroup starts sleep in a process group of its own. The returned channel is closed once it exited.
+func startGroup(t *testing.T) (*exec.Cmd, chan struct{}) {
+	cmd := exec.Command("sleep", "60")
+	setProcessGroup(cmd)
+	assert.Nil(t, cmd.Start())
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() { stopProcessGroup(cmd.Process.Pid, true) })
+	return cmd, exited
+}
+
+func TestReapOrphanedProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process groups are only tracked on Linux")
+	}
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+
+	// A puller that is no longer running
+	crashed := exec.Command("true")
+	assert.Nil(t, crashed.Run())
+
+	orphan, orphanExited := startGroup(t)
+	untracked, untrackedExited := startGroup(t)
+	reused, reusedExited := startGroup(t)
+	bootID, startTime, err := processStart(orphan.Process.Pid)
+	assert.Nil(t, err)
+	_, reusedStart, err := processStart(reused.Process.Pid)
+	assert.Nil(t, err)
+	assert.Nil(t, saveProcessGroups([]spawnedGroup{
+		{PGID: orphan.Process.Pid, PullerPID: crashed.Process.Pid, BootID: bootID, StartTime: startTime},
+		// Got the ID of a process group of the crashed puller once it was gone
+		{PGID: reused.Process.Pid, PullerPID: crashed.Process.Pid, BootID: bootID, StartTime: reusedStart + 1},
+		// Started before the last boot
+		{PGID: untracked.Process.Pid, PullerPID: crashed.Process.Pid, BootID: "other", StartTime: startTime},
+	}))
+
+	reapOrphanedProcesses()
+	select {
+	case <-orphanExited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process left behind by the crashed puller is still running")
+	}
+	for _, exited := range []chan struct{}{untrackedExited, reusedExited} {
+		select {
+		case <-exited:
+			t.Fatal("a process that the crashed puller didn't start was stopped")
+		default:
+		}
+	}
+	groups, err := loadProcessGroups()
+	assert.Nil(t, err)
+	assert.Empty(t, groups)
+}
+
+func TestStopWhenDoneLeavesDetachedProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no shell on windows")
+	}
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+
+	// Started by the playbook and left running, e.g. with nohup
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	cmd := exec.Command("sh", "-c", "sleep 60 >/dev/null 2>&1 & echo $! >"+pidFile)
+	setProcessGroup(cmd)
+	assert.Nil(t, cmd.Start())
+	exited := stopWhenDone(runsContext(), cmd)
+	assert.Nil(t, cmd.Wait())
+	exited()
+
+	data, err := ioutil.ReadFile(pidFile)
+	assert.Nil(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.Nil(t, err)
+	defer stopProcessGroup(cmd.Process.Pid, true)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, processAlive(pid))
+}
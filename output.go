@@ -0,0 +1,139 @@
+// Making the output of commands safe to log, keep and serve: in a known locale, valid UTF-8 and with secrets masked
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// localeEnv returns the variables setting the "child-locale" for a command, none to inherit the puller's locale.
+func localeEnv() []string {
+	locale := viper.GetString("child-locale")
+	if locale == "" {
+		return nil
+	}
+	return []string{"LANG=" + locale, "LC_ALL=" + locale}
+}
+
+// commandEnv returns the environment of the puller for a command, in the child-locale, followed by extra.
+func commandEnv(extra ...string) []string {
+	return append(append(os.Environ(), localeEnv()...), extra...)
+}
+
+// toValidUTF8 returns s with the bytes that are not valid UTF-8 decoded as Latin-1, the likeliest encoding of
+// output that isn't UTF-8.
+func toValidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	var valid strings.Builder
+	valid.Grow(len(s) + len(s)/4)
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size <= 1 {
+			r = rune(s[0])
+		}
+		valid.WriteRune(r)
+		s = s[size:]
+	}
+	return valid.String()
+}
+
+// cleanOutput returns output of a command as valid UTF-8 and with secrets masked.
+func cleanOutput(output string) string {
+	return redact(toValidUTF8(output))
+}
+
+// outputWriter cleans what is written to it before passing it on, line by line so that neither secrets nor
+// multi-byte characters are split across writes.
+type outputWriter struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	partial bytes.Buffer // Data following the last newline
+}
+
+func newOutputWriter(w io.Writer) *outputWriter {
+	return &outputWriter{w: w}
+}
+
+func (o *outputWriter) Write(data []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.partial.Write(data)
+	for {
+		line, err := o.partial.ReadString('\n')
+		if err != nil {
+			// Kept until the rest of the line arrives
+			o.partial.WriteString(line)
+			break
+		}
+		if _, err := io.WriteString(o.w, cleanOutput(line)); err != nil {
+			return len(data), err
+		}
+	}
+
+	return len(data), nil
+}
+
+// Flush writes what follows the last newline.
+func (o *outputWriter) Flush() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.partial.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(o.w, cleanOutput(o.partial.String()))
+	o.partial.Reset()
+	return err
+}
+
+// scanOutputLines calls emit with every line read from r, without its line ending, until r is exhausted. Lines
+// longer than maxLine bytes are emitted in chunks of about maxLine bytes rather than lost, split between characters.
+func scanOutputLines(r io.Reader, maxLine int, emit func(line string)) error {
+	reader := bufio.NewReaderSize(r, maxLine)
+	var carry []byte // Start of a character cut off at the end of the last chunk
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			if len(carry) > 0 {
+				emit(string(carry))
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		chunk := append(carry, line...)
+		carry = nil
+		if isPrefix {
+			cut := len(chunk) - incompleteRuneSuffix(chunk)
+			carry = append([]byte(nil), chunk[cut:]...)
+			chunk = chunk[:cut]
+		}
+		emit(string(chunk))
+	}
+}
+
+// incompleteRuneSuffix returns the number of bytes at the end of b that start a UTF-8 character without finishing it.
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
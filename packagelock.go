@@ -0,0 +1,125 @@
+// Awareness of the locks of the host's package managers, so runs colliding with e.g. unattended-upgrades wait for
+// them rather than fail
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Locks of apt, dpkg, rpm, dnf, yum and zypper. Files ending in .pid hold the PID of the holder, the others are
+// held with fcntl locks.
+var defaultPackageLockFiles = []string{
+	"/var/lib/dpkg/lock-frontend",
+	"/var/lib/dpkg/lock",
+	"/var/lib/apt/lists/lock",
+	"/var/cache/apt/archives/lock",
+	"/var/lib/rpm/.rpm.lock",
+	"/var/lib/dnf/rpmdb_lock.pid",
+	"/var/cache/dnf/metadata_lock.pid",
+	"/var/run/yum.pid",
+	"/run/zypp.pid",
+}
+
+// Messages of tasks that failed because another process held a package manager lock
+var packageLockMessagePattern = regexp.MustCompile(`(?i)(Could not get lock|Unable to (acquire|lock) the ` +
+	`(dpkg frontend|administration directory)|Failed to lock (apt|directory)|is another process using it|` +
+	`holding the (yum|dnf) lock|Waited too long for the (dnf|yum) lock|Failed to obtain (the )?(dnf|yum) lock|` +
+	`System management is locked by the application with pid|can't create transaction lock)`)
+
+// How often a held lock is checked again, doubling up to the maximum
+const (
+	packageLockPollInterval    = 5 * time.Second
+	packageLockMaxPollInterval = time.Minute
+)
+
+// Replaced in tests
+var (
+	packageLockHeldFunc = packageLockHeld
+	packageLockSleep    = time.Sleep
+)
+
+// packageLockHeld returns whether another process holds the lock file at path.
+func packageLockHeld(path string) bool {
+	if strings.HasSuffix(path, ".pid") {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil && pid > 0 && pid != os.Getpid() && processAlive(pid)
+	}
+
+	held, err := fcntlLockHeld(path)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("Unable to check package manager lock %s: %s", path, err)
+	}
+	return held
+}
+
+// heldPackageLock returns the first of package-lock-files held by another process, or "" if none is.
+func heldPackageLock() string {
+	for _, path := range viper.GetStringSlice("package-lock-files") {
+		if packageLockHeldFunc(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// packageLockAware returns whether runs wait for the package manager locks of this host. The controller's own locks
+// are of no concern to the hosts it runs against.
+func packageLockAware() bool {
+	return viper.GetInt("package-lock-wait") > 0 && !controllerMode()
+}
+
+// waitForPackageLocks waits for package-lock-wait at most until no package manager lock is held, checking again
+// with increasing intervals.
+func waitForPackageLocks(logger logrus.FieldLogger) error {
+	held := heldPackageLock()
+	if held == "" {
+		return nil
+	}
+
+	promPackageLockWaits.Inc()
+	wait := time.Duration(viper.GetInt("package-lock-wait")) * time.Minute
+	logger.Warnf("Package manager lock %s is held, waiting up to %s for it", held, wait)
+
+	var waited time.Duration
+	interval := packageLockPollInterval
+	for held != "" {
+		if waited >= wait {
+			return transientError{errors.Errorf("package manager lock %s still held after %s", held, wait)}
+		}
+		packageLockSleep(interval)
+		waited += interval
+		if interval *= 2; interval > packageLockMaxPollInterval {
+			interval = packageLockMaxPollInterval
+		}
+		held = heldPackageLock()
+	}
+
+	logger.Infoln("Package manager locks released")
+	return nil
+}
+
+// failedOnPackageLock returns whether a task of report failed because a package manager lock was held.
+func failedOnPackageLock(report RunReport) bool {
+	for _, task := range report.Tasks {
+		for _, message := range task.Messages {
+			if packageLockMessagePattern.MatchString(message) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withPackageLocks makes the lock files of package-lock-files held for the next checks given by held, restoring the
+// configuration afterwards. Sleeps are recorded in slept rather than waited for.
+func withPackageLocks(held []bool, slept *[]time.Duration) func() {
+	originalFiles, originalWait := viper.Get("package-lock-files"), viper.Get("package-lock-wait")
+	originalHeld, originalSleep := packageLockHeldFunc, packageLockSleep
+
+	viper.Set("package-lock-files", []string{"/var/lib/dpkg/lock-frontend"})
+	viper.Set("package-lock-wait", 1)
+	packageLockHeldFunc = func(string) bool {
+		if len(held) == 0 {
+			return false
+		}
+		next := held[0]
+		held = held[1:]
+		return next
+	}
+	packageLockSleep = func(d time.Duration) { *slept = append(*slept, d) }
+
+	return func() {
+		viper.Set("package-lock-files", originalFiles)
+		viper.Set("package-lock-wait", originalWait)
+		packageLockHeldFunc, packageLockSleep = originalHeld, originalSleep
+	}
+}
+
+func TestWaitForPackageLocks(t *testing.T) {
+	var slept []time.Duration
+	defer withPackageLocks([]bool{true, true, false}, &slept)()
+
+	assert.Nil(t, waitForPackageLocks(logrus.StandardLogger()))
+	assert.Equal(t, []time.Duration{5 * time.Second, 10 * time.Second}, slept)
+
+	// Not held, no waiting
+	slept = nil
+	assert.Nil(t, waitForPackageLocks(logrus.StandardLogger()))
+	assert.Empty(t, slept)
+}
+
+func TestWaitForPackageLocksTimeout(t *testing.T) {
+	var slept []time.Duration
+	defer withPackageLocks([]bool{true, true, true, true, true, true}, &slept)()
+
+	err := waitForPackageLocks(logrus.StandardLogger())
+	assert.EqualError(t, err, "package manager lock /var/lib/dpkg/lock-frontend still held after 1m0s")
+	assert.Equal(t, []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}, slept)
+}
+
+func TestPackageLockHeldPIDFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no package manager PID files on Windows")
+	}
+	dir := t.TempDir()
+
+	running := filepath.Join(dir, "dnf.pid")
+	assert.Nil(t, ioutil.WriteFile(running, []byte("1\n"), 0600))
+	assert.True(t, packageLockHeld(running))
+
+	stale := filepath.Join(dir, "yum.pid")
+	assert.Nil(t, ioutil.WriteFile(stale, []byte("999999999\n"), 0600))
+	assert.False(t, packageLockHeld(stale))
+
+	assert.False(t, packageLockHeld(filepath.Join(dir, "missing.pid")))
+
+	// An fcntl lock file nobody holds
+	unlocked := filepath.Join(dir, "lock-frontend")
+	assert.Nil(t, ioutil.WriteFile(unlocked, nil, 0600))
+	assert.False(t, packageLockHeld(unlocked))
+}
+
+func TestFailedOnPackageLock(t *testing.T) {
+	report := RunReport{Tasks: []TaskReport{{Name: "Install nginx", Messages: map[string]string{"localhost": "Failed " +
+		"to lock apt for exclusive operation: Failed to lock directory /var/lib/apt/lists/: E:Could not get lock " +
+		"/var/lib/apt/lists/lock. It is held by process 1234 (apt-get)"}}}}
+	assert.True(t, failedOnPackageLock(report))
+
+	report.Tasks[0].Messages["localhost"] = "No package matching 'ngnix' is available"
+	assert.False(t, failedOnPackageLock(report))
+	assert.False(t, failedOnPackageLock(RunReport{}))
+}
@@ -0,0 +1,6 @@
+package main
+
+// fcntlLockHeld returns false, Windows has no package managers holding fcntl locks.
+func fcntlLockHeld(path string) (bool, error) {
+	return false, nil
+}
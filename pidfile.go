@@ -0,0 +1,112 @@
+// PID file handling to make sure only one instance runs against a state directory
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const pidFileName = "ansible-puller.pid"
+
+func pidFilePath() string {
+	return filepath.Join(stateDir(), pidFileName)
+}
+
+// PID file of this process, locked for as long as the process runs
+var pidFile *os.File
+
+// acquirePidFile writes the current PID to the state directory, failing if another live instance owns it.
+//
+// The PID file is locked while its instance runs, so two instances starting together can't both take it. A PID file
+// that isn't locked was left behind by a process that no longer exists and is taken over, unless the PID in it is
+// that of a live process, e.g. an older version of the puller that didn't lock it.
+func acquirePidFile() error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	path := pidFilePath()
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return errors.Wrap(err, "unable to open pid file")
+		}
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return errors.Wrap(err, "unable to lock pid file")
+		}
+		if !locked {
+			file.Close()
+			pid, _ := readPidFile(path)
+			return fmt.Errorf("another instance of %s is already running with PID %d (pid file %s)", appName, pid, path)
+		}
+
+		// The instance that held it removed it on its way out, after it was opened here
+		opened, err := file.Stat()
+		current, currentErr := os.Stat(path)
+		if err != nil || currentErr != nil || !os.SameFile(opened, current) {
+			unlockFile(file)
+			file.Close()
+			continue
+		}
+
+		if pid, err := readPidFile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+			unlockFile(file)
+			file.Close()
+			return fmt.Errorf("another instance of %s is already running with PID %d (pid file %s)", appName, pid, path)
+		}
+
+		if err := writePid(file); err != nil {
+			unlockFile(file)
+			file.Close()
+			return errors.Wrap(err, "unable to write pid file")
+		}
+		pidFile = file
+		return nil
+	}
+}
+
+// writePid replaces the content of file with the PID of this process.
+func writePid(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	return err
+}
+
+func readPidFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// releasePidFile removes the PID file if this process acquired it.
+func releasePidFile() {
+	if pidFile == nil {
+		return
+	}
+
+	// Removed while still locked, so that no other instance takes it on the way out. Where open files can't be
+	// removed, it is emptied instead, which the next instance takes over.
+	if err := os.Remove(pidFilePath()); err != nil {
+		if err := pidFile.Truncate(0); err != nil {
+			logrus.Warnln("Unable to remove pid file: ", err)
+		}
+	}
+	unlockFile(pidFile)
+	pidFile.Close()
+	pidFile = nil
+}
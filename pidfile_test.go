@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestPidFileTestSuite(t *testing.T) {
+	suite.Run(t, new(PidFileTestSuite))
+}
+
+type PidFileTestSuite struct {
+	suite.Suite
+	tmpDir           string
+	originalStateDir string
+}
+
+func (s *PidFileTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller_pid")
+	assert.Nil(s.T(), err)
+
+	s.originalStateDir = viper.GetString("state-dir")
+	viper.Set("state-dir", s.tmpDir)
+}
+
+func (s *PidFileTestSuite) TearDownTest() {
+	releasePidFile()
+	viper.Set("state-dir", s.originalStateDir)
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *PidFileTestSuite) TestAcquireAndRelease() {
+	assert.Nil(s.T(), acquirePidFile())
+
+	pid, err := readPidFile(pidFilePath())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.Getpid(), pid)
+
+	releasePidFile()
+	_, err = os.Stat(pidFilePath())
+	assert.True(s.T(), os.IsNotExist(err), "pid file should be removed")
+}
+
+func (s *PidFileTestSuite) TestRefuseWhenOtherInstanceRuns() {
+	otherPid := os.Getppid()
+	assert.Nil(s.T(), ioutil.WriteFile(pidFilePath(), []byte(fmt.Sprintf("%d\n", otherPid)), 0644))
+
+	err := acquirePidFile()
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), fmt.Sprintf("PID %d", otherPid))
+
+	// The other instance's pid file must be left alone
+	releasePidFile()
+	pid, err := readPidFile(pidFilePath())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), otherPid, pid)
+}
+
+func (s *PidFileTestSuite) TestReplaceStalePidFile() {
+	assert.Nil(s.T(), ioutil.WriteFile(pidFilePath(), []byte("not a pid\n"), 0644))
+
+	assert.Nil(s.T(), acquirePidFile())
+
+	pid, err := readPidFile(pidFilePath())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.Getpid(), pid)
+}
+
+func (s *PidFileTestSuite) TestRefuseWhileLocked() {
+	assert.Nil(s.T(), acquirePidFile())
+	held := pidFile
+	defer func() { pidFile = held }()
+
+	// Another instance starting meanwhile finds the PID file locked, whatever PID it reads
+	pidFile = nil
+	err := acquirePidFile()
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "already running")
+	assert.Nil(s.T(), pidFile)
+}
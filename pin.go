@@ -0,0 +1,177 @@
+// Pinning the puller to an artifact version, so that it keeps applying it whatever is published until unpinned
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Where a pin comes from
+const (
+	pinSourceAPI    = "api"    // POST /pin, kept in the state
+	pinSourceConfig = "config" // pin-version
+)
+
+var md5Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// artifactPin is the version the puller is pinned to, as returned by the API.
+type artifactPin struct {
+	Version string `json:"version"` // MD5 of the artifact
+	Reason  string `json:"reason,omitempty"`
+	Source  string `json:"source"`
+}
+
+// pinRequest is the body of POST /pin.
+type pinRequest struct {
+	Version string `json:"version"` // Defaults to the applied version
+	Reason  string `json:"reason"`
+}
+
+// currentPin returns the version the puller is pinned to, nil if it isn't. A pin from the API takes precedence over
+// pin-version.
+func currentPin() *artifactPin {
+	state, err := loadState()
+	if err != nil {
+		logrus.Warnln("Unable to load the pinned version from the state: ", err)
+	}
+	if state.PinnedVersion != "" {
+		return &artifactPin{Version: state.PinnedVersion, Reason: state.PinReason, Source: pinSourceAPI}
+	}
+	if version := viper.GetString("pin-version"); version != "" {
+		return &artifactPin{Version: version, Source: pinSourceConfig}
+	}
+	return nil
+}
+
+// setupPin validates pin-version.
+func setupPin() error {
+	if version := viper.GetString("pin-version"); version != "" && !md5Pattern.MatchString(version) {
+		return errors.Errorf("invalid pin-version %q, expected the MD5 of an artifact", version)
+	}
+	return nil
+}
+
+// restorePin logs the pin the puller starts with.
+func restorePin() {
+	if pin := currentPin(); pin != nil {
+		promPinned.Set(1)
+		logrus.Infof("Pinned to artifact %s (%s), not checking for newer versions until unpinned", pin.Version, pin.Source)
+	}
+}
+
+// pinnedArtifactAvailable reports whether the artifact with the given MD5 is at hand without downloading it: the
+// local copy of the artifact, the applied artifact or one in the artifact cache.
+func pinnedArtifactAvailable(version string) bool {
+	for _, path := range []string{localCacheFile, appliedArtifactPath()} {
+		if sum, err := md5sum(path); err == nil && sum == version {
+			return true
+		}
+	}
+	if !artifacts.enabled() {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(artifactCacheDir(), version+artifactCacheExt))
+	return err == nil
+}
+
+// usePinnedArtifact makes the artifact with the given MD5 the local copy of the artifact, without contacting the
+// artifact source.
+func usePinnedArtifact(version string) error {
+	if sum, err := md5sum(localCacheFile); err == nil && sum == version {
+		return nil
+	}
+
+	// Versioned sources must compare the remote version against the pinned artifact once unpinned
+	os.Remove(versionFile(localCacheFile))
+	if artifacts.restore(version, localCacheFile) {
+		return nil
+	}
+	if sum, err := md5sum(appliedArtifactPath()); err == nil && sum == version {
+		return errors.Wrap(copyFileAtomic(appliedArtifactPath(), localCacheFile), "unable to restore the pinned artifact")
+	}
+
+	return fatalError{errors.Errorf("pinned version %s is not available locally, pin another version or unpin", version)}
+}
+
+func writePin(w http.ResponseWriter) {
+	data, err := json.Marshal(map[string]interface{}{"pin": currentPin()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerPin pins the puller to the version in the request, or to the applied version, until HandlerUnpin is called.
+// Only versions available locally can be pinned.
+func HandlerPin(w http.ResponseWriter, r *http.Request) {
+	var request pinRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid pin request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Version == "" {
+		version, err := md5sum(appliedArtifactPath())
+		if os.IsNotExist(err) {
+			http.Error(w, "no artifact was applied yet, give the version to pin", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		request.Version = version
+	}
+	if !md5Pattern.MatchString(request.Version) {
+		http.Error(w, "version must be the MD5 of an artifact", http.StatusBadRequest)
+		return
+	}
+	if !pinnedArtifactAvailable(request.Version) {
+		http.Error(w, "version "+request.Version+" is not available locally", http.StatusConflict)
+		return
+	}
+
+	if err := updateState(func(state *PullerState) {
+		state.PinnedVersion = request.Version
+		state.PinReason = request.Reason
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	promPinned.Set(1)
+	logrus.Infof("Pinned to artifact %s: %s", request.Version, request.Reason)
+	writePin(w)
+}
+
+// HandlerUnpin removes the pin set by HandlerPin. A pin-version of the config stays in effect.
+func HandlerUnpin(w http.ResponseWriter, r *http.Request) {
+	if err := updateState(func(state *PullerState) {
+		state.PinnedVersion = ""
+		state.PinReason = ""
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pin := currentPin()
+	if pin == nil {
+		promPinned.Set(0)
+		logrus.Infoln("Unpinned, following the published artifact again")
+	} else {
+		logrus.Infof("Unpinned, pin-version %s of the config stays in effect", pin.Version)
+	}
+	writePin(w)
+}
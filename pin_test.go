@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withPinState sets a new state directory and local copy of the artifact, restoring them after the test.
+func withPinState(t *testing.T) {
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(t.TempDir(), "artifact.tgz")
+	t.Cleanup(func() { localCacheFile = originalCacheFile })
+	for _, key := range []string{"pin-version", "state-dir"} {
+		key, original := key, viper.Get(key)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+	viper.Set("pin-version", "")
+	viper.Set("state-dir", t.TempDir())
+}
+
+func pinRequestRecorder(method, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, httpPathPin, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	if method == "DELETE" {
+		HandlerUnpin(rr, req)
+	} else {
+		HandlerPin(rr, req)
+	}
+	return rr
+}
+
+func TestHandlerPin(t *testing.T) {
+	withPinState(t)
+
+	// Without an applied artifact there is no version to default to
+	assert.Equal(t, http.StatusConflict, pinRequestRecorder("POST", "").Code)
+	assert.Equal(t, http.StatusBadRequest, pinRequestRecorder("POST", `{"version": "latest"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, pinRequestRecorder("POST", `{"ref": "main"}`).Code)
+	assert.Equal(t, http.StatusConflict, pinRequestRecorder("POST", `{"version": "0123456789abcdef0123456789abcdef"}`).Code)
+
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("applied"), 0644))
+	assert.Nil(t, saveAppliedArtifact(localCacheFile))
+	version, err := md5sum(localCacheFile)
+	assert.Nil(t, err)
+
+	rr := pinRequestRecorder("POST", `{"reason": "investigating"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response struct{ Pin artifactPin }
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, artifactPin{Version: version, Reason: "investigating", Source: pinSourceAPI}, response.Pin)
+	state, err := loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, version, state.PinnedVersion)
+
+	// The pin of the config applies once the API one is removed
+	viper.Set("pin-version", "0123456789abcdef0123456789abcdef")
+	assert.Equal(t, pinSourceAPI, currentPin().Source)
+	rr = pinRequestRecorder("DELETE", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, pinSourceConfig, currentPin().Source)
+
+	viper.Set("pin-version", "")
+	assert.Nil(t, currentPin())
+	assert.JSONEq(t, `{"pin": {"version": "0123456789abcdef0123456789abcdef", "source": "config"}}`, rr.Body.String())
+}
+
+func TestUsePinnedArtifact(t *testing.T) {
+	withPinState(t)
+	defer withArtifactCache(t, 3, 0)()
+
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("pinned"), 0644))
+	pinned, err := md5sum(localCacheFile)
+	assert.Nil(t, err)
+	assert.Nil(t, artifacts.store(localCacheFile))
+
+	// A newer download is replaced by the pinned artifact from the cache
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("newer"), 0644))
+	assert.Nil(t, ioutil.WriteFile(versionFile(localCacheFile), []byte("etag"), 0644))
+	assert.Nil(t, usePinnedArtifact(pinned))
+	content, err := ioutil.ReadFile(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "pinned", string(content))
+	assert.NoFileExists(t, versionFile(localCacheFile))
+
+	err = usePinnedArtifact("0123456789abcdef0123456789abcdef")
+	assert.Contains(t, err.Error(), "not available locally")
+	assert.Equal(t, errorClassFatal, errorClass(err))
+}
+
+func TestSetupPin(t *testing.T) {
+	withPinState(t)
+	assert.Nil(t, setupPin())
+	viper.Set("pin-version", "0123456789ABCDEF")
+	assert.NotNil(t, setupPin())
+}
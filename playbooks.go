@@ -0,0 +1,379 @@
+// Several playbooks run by one puller, each on its own schedule, sharing the artifact and the virtualenv
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// playbookConfig is one of the "playbooks" option, or the playbook of ansible-playbook without it.
+type playbookConfig struct {
+	Name      string   `mapstructure:"name"`      // Identifies the playbook in the API, metrics and run context
+	Playbook  string   `mapstructure:"playbook"`  // Path to the playbook, relative to ansible-dir
+	Interval  int      `mapstructure:"interval"`  // Minutes between runs. Defaults to sleep
+	Cron      string   `mapstructure:"cron"`      // Cron expression replacing interval
+	Tags      []string `mapstructure:"tags"`      // Only run plays and tasks tagged with these values
+	SkipTags  []string `mapstructure:"skip-tags"` // Skip plays and tasks tagged with these values
+	Inventory []string `mapstructure:"inventory"` // Inventories to find the host in. Defaults to ansible-inventory
+
+	cron *cronSchedule
+}
+
+// Playbooks the puller runs, the first one by default. Guarded by playbookMutex as a reload replaces them.
+var playbooks []playbookConfig
+
+// setupPlaybooks reads the "playbooks" option, falling back to ansible-playbook on the schedule of sleep or
+// schedule-cron. Called after setupSchedule.
+func setupPlaybooks() error {
+	var configured []playbookConfig
+	if err := viper.UnmarshalKey("playbooks", &configured); err != nil {
+		return errors.Wrap(err, "invalid playbooks")
+	}
+	if len(configured) == 0 {
+		setPlaybooks([]playbookConfig{{
+			Name:     defaultScheduleName,
+			Playbook: viper.GetString("ansible-playbook"),
+			Interval: viper.GetInt("sleep"),
+			cron:     runCron,
+		}})
+		return nil
+	}
+
+	names := map[string]bool{}
+	for i := range configured {
+		playbook := &configured[i]
+		if playbook.Name == "" || playbook.Playbook == "" {
+			return errors.Errorf("playbooks[%d] needs a name and a playbook", i)
+		}
+		if names[playbook.Name] {
+			return errors.Errorf("playbook name %q is used more than once", playbook.Name)
+		}
+		names[playbook.Name] = true
+
+		if playbook.Cron != "" {
+			schedule, err := parseCron(playbook.Cron)
+			if err != nil {
+				return errors.Wrapf(err, "invalid cron of playbook %s", playbook.Name)
+			}
+			if schedule.next(time.Now()).IsZero() {
+				return errors.Errorf("cron expression %q of playbook %s never matches", playbook.Cron, playbook.Name)
+			}
+			playbook.cron = schedule
+		}
+		if playbook.Interval == 0 {
+			playbook.Interval = viper.GetInt("sleep")
+		}
+		if playbook.Interval < 0 {
+			return errors.Errorf("interval of playbook %s must be a positive number of minutes", playbook.Name)
+		}
+	}
+
+	setPlaybooks(configured)
+	return nil
+}
+
+func setPlaybooks(configured []playbookConfig) {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	playbooks = configured
+}
+
+// currentPlaybooks returns the playbooks the puller runs.
+func currentPlaybooks() []playbookConfig {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	return playbooks
+}
+
+// findPlaybook returns the playbook called name, or the first one if name is empty.
+func findPlaybook(name string) (playbookConfig, bool) {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	if name == "" && len(playbooks) > 0 {
+		return playbooks[0], true
+	}
+	for _, playbook := range playbooks {
+		if playbook.Name == name {
+			return playbook, true
+		}
+	}
+	return playbookConfig{}, false
+}
+
+// spec returns the spec of a run of the playbook started by trigger.
+func (p playbookConfig) spec(trigger string) runSpec {
+	spec := runSpec{
+		Name:      p.Name,
+		Playbook:  p.Playbook,
+		Tags:      p.Tags,
+		SkipTags:  p.SkipTags,
+		Inventory: p.Inventory,
+		Trigger:   trigger,
+	}
+	if trigger == runTriggerStartup || trigger == runTriggerSchedule || trigger == runTriggerRetry {
+		spec.Schedule = p.Name
+	}
+	return spec
+}
+
+// queuedRun is a run of a playbook waiting for the run in progress.
+type queuedRun struct {
+	trigger  string
+	playbook string
+}
+
+// runQueue serializes the runs started by the schedules of the playbooks. A playbook is queued at most once, and
+// not at all while it runs, so a schedule that comes due during a long run of its playbook doesn't run it again
+// right after.
+type runQueue struct {
+	mutex   sync.Mutex
+	pending []queuedRun
+	running string
+	ready   chan struct{}
+}
+
+func newRunQueue() *runQueue {
+	return &runQueue{ready: make(chan struct{}, 1)}
+}
+
+// push queues a run of playbook started by trigger, unless it is already queued or running.
+func (q *runQueue) push(trigger, playbook string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.running == playbook {
+		return
+	}
+	for _, run := range q.pending {
+		if run.playbook == playbook {
+			return
+		}
+	}
+	q.pending = append(q.pending, queuedRun{trigger: trigger, playbook: playbook})
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for a queued run and returns it, marking its playbook as running until done is called.
+func (q *runQueue) next() (run queuedRun, done func()) {
+	for {
+		q.mutex.Lock()
+		if len(q.pending) > 0 {
+			run = q.pending[0]
+			q.pending = q.pending[1:]
+			q.running = run.playbook
+			q.mutex.Unlock()
+			return run, func() {
+				q.mutex.Lock()
+				q.running = ""
+				q.mutex.Unlock()
+			}
+		}
+		q.mutex.Unlock()
+		<-q.ready
+	}
+}
+
+// playbookStatus is how a playbook fared, as returned by the status endpoint.
+type playbookStatus struct {
+	Name           string      `json:"name"`
+	Playbook       string      `json:"playbook"`
+	NextRunTime    interface{} `json:"next_run_time"`
+	LastRunTime    interface{} `json:"last_run_time"`
+	LastRunOutcome string      `json:"last_run_outcome,omitempty"`
+}
+
+var (
+	playbookMutex    sync.Mutex
+	playbookNextRuns = map[string]time.Time{}
+	playbookLastRuns = map[string]playbookLastRun{}
+)
+
+// playbookLastRun is the last run of a playbook since the puller started.
+type playbookLastRun struct {
+	time    time.Time
+	outcome string
+}
+
+// setPlaybookNextRun records when the schedule of playbook runs it next, keeping nextRunTime at the earliest run.
+func setPlaybookNextRun(playbook string, t time.Time) {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	playbookNextRuns[playbook] = t
+	updateNextRunTime()
+}
+
+// forgetPlaybookNextRun drops the next run of a playbook that is no longer scheduled.
+func forgetPlaybookNextRun(playbook string) {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	delete(playbookNextRuns, playbook)
+	updateNextRunTime()
+}
+
+// updateNextRunTime sets nextRunTime to the earliest next run of the playbooks. Called with playbookMutex held.
+func updateNextRunTime() {
+	var earliest time.Time
+	for _, next := range playbookNextRuns {
+		if earliest.IsZero() || next.Before(earliest) {
+			earliest = next
+		}
+	}
+	nextRunTime = earliest
+}
+
+// earliestNextRun returns when the next run of any playbook is due, zero if none is scheduled.
+func earliestNextRun() time.Time {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	return nextRunTime
+}
+
+// recordPlaybookRun records the outcome of a run of playbook.
+func recordPlaybookRun(playbook, outcome string) {
+	promPlaybookRuns.WithLabelValues(playbook, outcome).Inc()
+	if outcome == runOutcomeSuccess {
+		promPlaybookLastSuccess.WithLabelValues(playbook).Set(float64(time.Now().Unix()))
+	}
+
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+	playbookLastRuns[playbook] = playbookLastRun{time: time.Now(), outcome: outcome}
+}
+
+// playbookStatuses returns the status of every playbook, in the order they are configured.
+func playbookStatuses() []playbookStatus {
+	playbookMutex.Lock()
+	defer playbookMutex.Unlock()
+
+	statuses := make([]playbookStatus, 0, len(playbooks))
+	for _, playbook := range playbooks {
+		last := playbookLastRuns[playbook.Name]
+		statuses = append(statuses, playbookStatus{
+			Name:           playbook.Name,
+			Playbook:       playbook.Playbook,
+			NextRunTime:    statusTime(playbookNextRuns[playbook.Name]),
+			LastRunTime:    statusTime(last.time),
+			LastRunOutcome: last.outcome,
+		})
+	}
+	return statuses
+}
+
+// validateSchedules checks that jitter and splay fit the periods of the configured playbooks.
+func validateSchedules(configured []playbookConfig, jitter, splay time.Duration) error {
+	for _, playbook := range configured {
+		period := time.Duration(playbook.Interval) * time.Minute
+		if period <= 0 && playbook.cron == nil {
+			return errors.Errorf("the period of playbook %s must be a positive number of minutes", playbook.Name)
+		}
+		if jitter >= period && playbook.cron == nil {
+			return errors.Errorf("sleep-jitter is too large, it must be less than the period %d of playbook %s", playbook.Interval, playbook.Name)
+		}
+		if splay < 0 || splay > period && playbook.cron == nil {
+			return errors.Errorf("sleep-splay must be between 0 and the period %d of playbook %s", playbook.Interval, playbook.Name)
+		}
+	}
+	return nil
+}
+
+// playbookSchedules are the schedulers of the playbooks run by the daemon, which follow reloads of the configuration.
+type playbookSchedules struct {
+	mutex      sync.Mutex
+	queue      *runQueue
+	jitter     time.Duration
+	splay      time.Duration // Only changes once the puller restarts, hosts would bunch up otherwise
+	schedulers map[string]*scheduler
+	scheduled  map[string]playbookConfig // Configuration each scheduler was set up with
+}
+
+// Schedules of the daemon, nil in other modes
+var daemonSchedules *playbookSchedules
+
+func newPlaybookSchedules(queue *runQueue, jitter, splay time.Duration) *playbookSchedules {
+	return &playbookSchedules{
+		queue:      queue,
+		jitter:     jitter,
+		splay:      splay,
+		schedulers: map[string]*scheduler{},
+		scheduled:  map[string]playbookConfig{},
+	}
+}
+
+// start schedules runs of playbook. Playbooks the daemon starts with run once the splay offset of the host has
+// passed, those added by a reload only on their schedule.
+func (p *playbookSchedules) start(playbook playbookConfig, startup bool) {
+	name := playbook.Name
+	scheduler := newScheduler(time.Duration(playbook.Interval)*time.Minute, p.jitter, func() { p.queue.push(runTriggerSchedule, name) })
+	scheduler.name = name
+	scheduler.cron = playbook.cron
+	scheduler.setSplay(hostname, p.splay)
+	p.schedulers[name] = scheduler
+	p.scheduled[name] = playbook
+
+	go func() {
+		if startup {
+			if p.splay > 0 {
+				logrus.Infof("Runs of playbook %s on this host are offset by %s within the %s splay", name, scheduler.offset.Round(time.Second), p.splay)
+			}
+
+			// Hosts restarted together, e.g. by a package upgrade, start their first runs spread out as well
+			setPlaybookNextRun(name, scheduler.clock.Now().Add(scheduler.offset))
+			sleep(scheduler.clock, scheduler.offset)
+			p.queue.push(runTriggerStartup, name)
+		}
+		scheduler.run()
+	}()
+}
+
+// update applies reloaded playbooks and jitter. Schedules that changed are planned anew from now, playbooks that
+// were removed are no longer run and those that were added run on their schedule.
+func (p *playbookSchedules) update(configured []playbookConfig, jitter time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	jitterChanged := jitter != p.jitter
+	p.jitter = jitter
+	names := map[string]bool{}
+	for _, playbook := range configured {
+		names[playbook.Name] = true
+		scheduler, ok := p.schedulers[playbook.Name]
+		if !ok {
+			logrus.Infof("Scheduling playbook %s added by the reload", playbook.Name)
+			p.start(playbook, false)
+			continue
+		}
+
+		previous := p.scheduled[playbook.Name]
+		if jitterChanged || previous.Interval != playbook.Interval || previous.cron.String() != playbook.cron.String() {
+			logrus.Infof("Rescheduling playbook %s after the reload", playbook.Name)
+			scheduler.reschedule(time.Duration(playbook.Interval)*time.Minute, jitter, playbook.cron)
+		}
+		p.scheduled[playbook.Name] = playbook
+	}
+
+	for name, scheduler := range p.schedulers {
+		if names[name] {
+			continue
+		}
+		logrus.Infof("No longer scheduling playbook %s removed by the reload", name)
+		scheduler.stop()
+		delete(p.schedulers, name)
+		delete(p.scheduled, name)
+		forgetPlaybookNextRun(name)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withPlaybooks sets up the playbooks option, resetting it afterwards.
+func withPlaybooks(t *testing.T, configured interface{}) error {
+	viper.Set("playbooks", configured)
+	t.Cleanup(func() {
+		viper.Set("playbooks", nil)
+		assert.Nil(t, setupPlaybooks())
+	})
+	return setupPlaybooks()
+}
+
+func TestSetupPlaybooksDefault(t *testing.T) {
+	assert.Nil(t, withPlaybooks(t, nil))
+	assert.Len(t, playbooks, 1)
+	assert.Equal(t, defaultScheduleName, playbooks[0].Name)
+	assert.Equal(t, viper.GetString("ansible-playbook"), playbooks[0].Playbook)
+	assert.Equal(t, viper.GetInt("sleep"), playbooks[0].Interval)
+}
+
+func TestSetupPlaybooks(t *testing.T) {
+	assert.Nil(t, withPlaybooks(t, []map[string]interface{}{
+		{"name": "base", "playbook": "base.yml", "interval": 60, "tags": []string{"packages"}},
+		{"name": "certs", "playbook": "certs.yml", "cron": "0 3 * * *", "inventory": []string{"inventories/certs"}},
+	}))
+	assert.Len(t, playbooks, 2)
+
+	base, ok := findPlaybook("")
+	assert.True(t, ok)
+	assert.Equal(t, "base", base.Name)
+	assert.Equal(t, 60, base.Interval)
+	assert.Equal(t, []string{"packages"}, base.Tags)
+	assert.Nil(t, base.cron)
+
+	certs, ok := findPlaybook("certs")
+	assert.True(t, ok)
+	assert.Equal(t, viper.GetInt("sleep"), certs.Interval)
+	assert.NotNil(t, certs.cron)
+
+	spec := certs.spec(runTriggerSchedule)
+	assert.Equal(t, "certs", spec.Name)
+	assert.Equal(t, "certs.yml", spec.Playbook)
+	assert.Equal(t, "certs", spec.Schedule)
+	assert.Equal(t, []string{"inventories/certs"}, spec.Inventory)
+	assert.Empty(t, certs.spec(runTriggerAPI).Schedule)
+
+	_, ok = findPlaybook("unknown")
+	assert.False(t, ok)
+}
+
+func TestSetupPlaybooksValidation(t *testing.T) {
+	for _, configured := range [][]map[string]interface{}{
+		{{"name": "base"}},
+		{{"playbook": "base.yml"}},
+		{{"name": "base", "playbook": "base.yml"}, {"name": "base", "playbook": "other.yml"}},
+		{{"name": "base", "playbook": "base.yml", "cron": "not a cron"}},
+		{{"name": "base", "playbook": "base.yml", "interval": -5}},
+	} {
+		assert.NotNil(t, withPlaybooks(t, configured), configured)
+	}
+}
+
+func TestRunQueue(t *testing.T) {
+	queue := newRunQueue()
+	queue.push(runTriggerStartup, "base")
+	queue.push(runTriggerStartup, "certs")
+	queue.push(runTriggerSchedule, "base") // Already queued
+
+	run, done := queue.next()
+	assert.Equal(t, queuedRun{trigger: runTriggerStartup, playbook: "base"}, run)
+	queue.push(runTriggerSchedule, "base") // Running
+	done()
+
+	run, done = queue.next()
+	assert.Equal(t, queuedRun{trigger: runTriggerStartup, playbook: "certs"}, run)
+	done()
+
+	next := make(chan queuedRun)
+	go func() {
+		run, done := queue.next()
+		done()
+		next <- run
+	}()
+	select {
+	case run := <-next:
+		t.Fatalf("unexpected run %v", run)
+	case <-time.After(10 * time.Millisecond):
+	}
+	queue.push(runTriggerAdhoc, "base")
+	assert.Equal(t, queuedRun{trigger: runTriggerAdhoc, playbook: "base"}, <-next)
+}
+
+func TestSetPlaybookNextRun(t *testing.T) {
+	originalNextRunTime := nextRunTime
+	defer func() {
+		nextRunTime = originalNextRunTime
+		delete(playbookNextRuns, "base")
+		delete(playbookNextRuns, "certs")
+	}()
+
+	now := time.Now()
+	setPlaybookNextRun("base", now.Add(time.Hour))
+	setPlaybookNextRun("certs", now.Add(time.Minute))
+	assert.Equal(t, now.Add(time.Minute), earliestNextRun())
+
+	// Read by the status endpoints while the schedules update it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			setPlaybookNextRun("base", now.Add(time.Duration(i)*time.Second))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		earliestNextRun()
+	}
+	<-done
+	assert.Equal(t, now.Add(time.Minute), earliestNextRun())
+}
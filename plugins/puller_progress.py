@@ -0,0 +1,50 @@
+# Callback plugin written out by ansible-puller, reporting the progress of a run on stderr while the json stdout
+# callback holds back all output until the run ends.
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+import sys
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'aggregate'
+    CALLBACK_NAME = 'puller_progress'
+    CALLBACK_NEEDS_ENABLED = False
+    CALLBACK_NEEDS_WHITELIST = False
+
+    def _line(self, line):
+        sys.stderr.write(line + '\n')
+        sys.stderr.flush()
+
+    def _result(self, status, result):
+        self._line('%s: [%s]' % (status, result._host.get_name()))
+
+    def v2_playbook_on_play_start(self, play):
+        self._line('PLAY [%s]' % play.get_name().strip())
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._line('TASK [%s]' % task.get_name().strip())
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._line('RUNNING HANDLER [%s]' % task.get_name().strip())
+
+    def v2_runner_on_ok(self, result):
+        self._result('changed' if result._result.get('changed') else 'ok', result)
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._result('failed', result)
+
+    def v2_runner_on_skipped(self, result):
+        self._result('skipping', result)
+
+    def v2_runner_on_unreachable(self, result):
+        self._result('unreachable', result)
+
+    def v2_runner_item_on_ok(self, result):
+        self._result('item', result)
+
+    def v2_runner_item_on_failed(self, result):
+        self._result('item failed', result)
@@ -0,0 +1,341 @@
+// Evaluation of OPA policies before a new artifact version is applied
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	appliedManifestFileName = "applied-manifest.json"
+	defaultPolicyQuery      = "data.ansible_puller.allow"
+
+	// Paths listed per kind of change in the policy input, the counts are always complete
+	policyDiffMaxFiles = 100
+)
+
+// artifactManifest identifies the contents of an artifact, so the changes between two versions can be summarized.
+type artifactManifest struct {
+	Version string            `json:"version"` // MD5 of the artifact
+	Files   map[string]string `json:"files"`   // MD5 of every file, by slash separated path in the artifact
+}
+
+// policyDiff summarizes the files changed by a new artifact version.
+type policyDiff struct {
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	Modified     []string `json:"modified"`
+	FilesChanged int      `json:"files_changed"`
+	Truncated    bool     `json:"truncated"` // Whether some paths were left out of the lists
+}
+
+// policyInput is the document policies are evaluated against, as input.
+type policyInput struct {
+	Time string `json:"time"`
+	Host struct {
+		Hostname string            `json:"hostname"`
+		Labels   map[string]string `json:"labels"`
+	} `json:"host"`
+	Run struct {
+		ID        string   `json:"id"`
+		Playbook  string   `json:"playbook"`
+		Tags      []string `json:"tags"`
+		SkipTags  []string `json:"skip_tags"`
+		Limit     string   `json:"limit"`
+		CheckMode bool     `json:"check_mode"`
+	} `json:"run"`
+	Artifact struct {
+		Version         string `json:"version"`
+		PreviousVersion string `json:"previous_version"` // "" if no artifact was applied under the policy yet
+	} `json:"artifact"`
+	Diff policyDiff `json:"diff"`
+}
+
+// policyDecision is the outcome of a policy evaluation.
+type policyDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+// policyEvaluator evaluates the configured policy, returning its raw result or nil if it is undefined.
+type policyEvaluator interface {
+	evaluate(input policyInput) (json.RawMessage, error)
+}
+
+// localPolicy evaluates a Rego file or bundle on disk with the opa CLI.
+type localPolicy struct {
+	path  string
+	query string
+}
+
+func (p localPolicy) evaluate(input policyInput) (json.RawMessage, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	source := "--data"
+	if info, err := os.Stat(p.path); err != nil {
+		return nil, errors.Wrap(err, "unable to find policy")
+	} else if info.IsDir() {
+		source = "--bundle"
+	}
+
+	cmd := exec.Command("opa", "eval", "--format", "json", "--stdin-input", source, p.path, p.query)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "opa eval failed: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, errors.Wrap(err, "unable to parse opa output")
+	}
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return nil, nil
+	}
+
+	return result.Result[0].Expressions[0].Value, nil
+}
+
+// remotePolicy evaluates a policy with the data API of an OPA server.
+type remotePolicy struct {
+	url    string // Data API URL of the decision, e.g. http://opa:8181/v1/data/ansible_puller/allow
+	client *http.Client
+}
+
+func (p remotePolicy) evaluate(input policyInput) (json.RawMessage, error) {
+	data, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "unable to parse OPA response")
+	}
+
+	return result.Result, nil
+}
+
+// parsePolicyResult interprets the result of a policy, which is either a boolean or an object with an allow
+// boolean and optional reasons. Undefined results deny.
+func parsePolicyResult(raw json.RawMessage) (policyDecision, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return policyDecision{Reasons: []string{"policy result is undefined"}}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(raw, &allow); err == nil {
+		return policyDecision{Allow: allow}, nil
+	}
+
+	var decision policyDecision
+	if err := json.Unmarshal(raw, &decision); err != nil {
+		return decision, errors.Errorf("unexpected policy result %s, expected a boolean or an object with allow", raw)
+	}
+
+	return decision, nil
+}
+
+// policyFromConfig returns the configured policy, or nil if no policy is configured.
+func policyFromConfig() (policyEvaluator, error) {
+	file, url := viper.GetString("policy-file"), viper.GetString("policy-url")
+
+	switch {
+	case file != "" && url != "":
+		return nil, errors.New("only one of policy-file and policy-url may be set")
+	case file != "":
+		query := viper.GetString("policy-query")
+		if query == "" {
+			query = defaultPolicyQuery
+		}
+		return localPolicy{path: file, query: query}, nil
+	case url != "":
+		return remotePolicy{url: url, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+
+	return nil, nil
+}
+
+// buildArtifactManifest checksums the files of the artifact extracted into dir.
+func buildArtifactManifest(version, dir string) (artifactManifest, error) {
+	manifest := artifactManifest{Version: version, Files: map[string]string{}}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := md5sum(path)
+		if err != nil {
+			return err
+		}
+
+		manifest.Files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+
+	return manifest, errors.Wrap(err, "unable to checksum artifact contents")
+}
+
+func appliedManifestPath() string {
+	return filepath.Join(stateDir(), appliedManifestFileName)
+}
+
+// loadAppliedManifest returns the manifest of the last artifact applied under the policy, which is empty if none was.
+func loadAppliedManifest() (artifactManifest, error) {
+	var manifest artifactManifest
+
+	data, err := readStateFile(appliedManifestPath())
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, errors.Wrap(err, "unable to read applied manifest")
+	}
+
+	return manifest, errors.Wrap(json.Unmarshal(data, &manifest), "unable to parse applied manifest")
+}
+
+func saveAppliedManifest(manifest artifactManifest) error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize applied manifest")
+	}
+
+	return errors.Wrap(writeStateFile(appliedManifestPath(), data), "unable to write applied manifest")
+}
+
+// diffManifests summarizes the changes from previous to next.
+func diffManifests(previous, next artifactManifest) policyDiff {
+	diff := policyDiff{Added: []string{}, Removed: []string{}, Modified: []string{}}
+
+	for path, sum := range next.Files {
+		if previousSum, ok := previous.Files[path]; !ok {
+			diff.Added = append(diff.Added, path)
+		} else if previousSum != sum {
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+	for path := range previous.Files {
+		if _, ok := next.Files[path]; !ok {
+			diff.Removed = append(diff.Removed, path)
+		}
+	}
+
+	diff.FilesChanged = len(diff.Added) + len(diff.Removed) + len(diff.Modified)
+	for _, list := range []*[]string{&diff.Added, &diff.Removed, &diff.Modified} {
+		sort.Strings(*list)
+		if len(*list) > policyDiffMaxFiles {
+			*list = (*list)[:policyDiffMaxFiles]
+			diff.Truncated = true
+		}
+	}
+
+	return diff
+}
+
+// checkArtifactPolicy evaluates the configured policy before a new version of the artifact extracted into runDir
+// is applied, returning an error if the policy denies it or cannot be evaluated.
+//
+// The returned manifest is to be saved with saveAppliedManifest once the artifact is applied. It is nil if no policy
+// is configured, or for check mode runs as they apply nothing.
+func checkArtifactPolicy(spec runSpec, runDir string) (*artifactManifest, error) {
+	policy, err := policyFromConfig()
+	if err != nil || policy == nil || spec.CheckMode {
+		return nil, err
+	}
+
+	version, err := md5sum(localCacheFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to checksum the artifact")
+	}
+
+	previous, err := loadAppliedManifest()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := buildArtifactManifest(version, runDir)
+	if err != nil {
+		return nil, err
+	}
+	if previous.Version == version {
+		// Already allowed and applied, runs that keep the host converged are not subject to the policy
+		return &manifest, nil
+	}
+
+	var input policyInput
+	input.Time = pullerTime(time.Now()).Format(time.RFC3339)
+	input.Host.Hostname = hostname
+	input.Host.Labels = policyHostLabels(spec.Labels)
+	input.Run.ID = spec.ID
+	input.Run.Playbook = spec.Playbook
+	input.Run.Tags = spec.Tags
+	input.Run.SkipTags = spec.SkipTags
+	input.Run.Limit = spec.Limit
+	input.Artifact.Version = version
+	input.Artifact.PreviousVersion = previous.Version
+	input.Diff = diffManifests(previous, manifest)
+
+	raw, err := policy.evaluate(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to evaluate policy")
+	}
+	decision, err := parsePolicyResult(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if !decision.Allow {
+		promPolicyDenials.Inc()
+		reason := "no reason given"
+		if len(decision.Reasons) > 0 {
+			reason = strings.Join(decision.Reasons, "; ")
+		}
+		return nil, fatalError{errors.Errorf("artifact %s denied by policy: %s", version, reason)}
+	}
+
+	logrus.Infof("Artifact %s allowed by policy, %d files changed", version, input.Diff.FilesChanged)
+	return &manifest, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicyResult(t *testing.T) {
+	decision, err := parsePolicyResult(json.RawMessage(`true`))
+	assert.Nil(t, err)
+	assert.True(t, decision.Allow)
+
+	decision, err = parsePolicyResult(json.RawMessage(`{"allow": false, "reasons": ["frozen"]}`))
+	assert.Nil(t, err)
+	assert.False(t, decision.Allow)
+	assert.Equal(t, []string{"frozen"}, decision.Reasons)
+
+	decision, err = parsePolicyResult(nil)
+	assert.Nil(t, err)
+	assert.False(t, decision.Allow)
+
+	_, err = parsePolicyResult(json.RawMessage(`"yes"`))
+	assert.NotNil(t, err)
+}
+
+func TestDiffManifests(t *testing.T) {
+	previous := artifactManifest{Files: map[string]string{"site.yml": "a", "roles/old.yml": "b", "hosts": "c"}}
+	next := artifactManifest{Files: map[string]string{"site.yml": "a2", "roles/new.yml": "d", "hosts": "c"}}
+
+	diff := diffManifests(previous, next)
+	assert.Equal(t, []string{"roles/new.yml"}, diff.Added)
+	assert.Equal(t, []string{"roles/old.yml"}, diff.Removed)
+	assert.Equal(t, []string{"site.yml"}, diff.Modified)
+	assert.Equal(t, 3, diff.FilesChanged)
+	assert.False(t, diff.Truncated)
+}
+
+func TestDiffManifestsTruncated(t *testing.T) {
+	next := artifactManifest{Files: map[string]string{}}
+	for i := 0; i < policyDiffMaxFiles+5; i++ {
+		next.Files[filepath.Join("files", string(rune('a'+i%26)), string(rune('a'+i/26)))] = "x"
+	}
+
+	diff := diffManifests(artifactManifest{}, next)
+	assert.Len(t, diff.Added, policyDiffMaxFiles)
+	assert.Equal(t, policyDiffMaxFiles+5, diff.FilesChanged)
+	assert.True(t, diff.Truncated)
+}
+
+func TestCheckArtifactPolicy(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "ansible_puller_policy_state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+	runDir, err := ioutil.TempDir("", "ansible_puller_policy_run")
+	assert.Nil(t, err)
+	defer os.RemoveAll(runDir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(runDir, "site.yml"), []byte("- hosts: all\n"), 0600))
+
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(stateDir, "artifact.tgz")
+	defer func() { localCacheFile = originalCacheFile }()
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("artifact"), 0600))
+
+	var inputs []policyInput
+	allow := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input policyInput `json:"input"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		inputs = append(inputs, body.Input)
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"result": policyDecision{Allow: allow, Reasons: []string{"change freeze"}},
+		})
+	}))
+	defer server.Close()
+
+	originalStateDir := viper.GetString("state-dir")
+	viper.Set("state-dir", stateDir)
+	viper.Set("policy-url", server.URL+"/v1/data/ansible_puller/decision")
+	viper.Set("policy-host-labels", map[string]string{"env": "prod"})
+	defer func() {
+		viper.Set("state-dir", originalStateDir)
+		viper.Set("policy-url", "")
+		viper.Set("policy-host-labels", map[string]string{})
+	}()
+
+	_, err = checkArtifactPolicy(runSpec{ID: "1", Playbook: "site.yml"}, runDir)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "change freeze")
+	assert.Equal(t, errorClassFatal, errorClass(err))
+	assert.Len(t, inputs, 1)
+	assert.Equal(t, map[string]string{"env": "prod"}, inputs[0].Host.Labels)
+	assert.Equal(t, []string{"site.yml"}, inputs[0].Diff.Added)
+	assert.Equal(t, "", inputs[0].Artifact.PreviousVersion)
+
+	allow = true
+	manifest, err := checkArtifactPolicy(runSpec{ID: "2", Playbook: "site.yml"}, runDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, manifest)
+	assert.Nil(t, saveAppliedManifest(*manifest))
+
+	// The applied version is not evaluated again
+	allow = false
+	_, err = checkArtifactPolicy(runSpec{ID: "3", Playbook: "site.yml"}, runDir)
+	assert.Nil(t, err)
+	assert.Len(t, inputs, 2)
+}
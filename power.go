@@ -0,0 +1,162 @@
+// Deferring scheduled runs on laptops and other endpoints while they run on a low battery or a metered connection
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Reasons runs are deferred for, as labelled in promDeferredRuns
+const (
+	deferralBattery = "battery"
+	deferralMetered = "metered"
+)
+
+// powerState is how the host is powered and connected.
+type powerState struct {
+	OnBattery      bool // Running on battery rather than mains power
+	BatteryPercent int  // Charge of the batteries, -1 if the host has none
+	Metered        bool // Whether the network connection is metered
+}
+
+// Replaced in tests
+var currentPowerState = readPowerState
+
+// deferRun returns why a scheduled run is deferred, or "" if it can start. When runs started to be deferred is kept
+// in the state, so that max-deferral also holds across restarts.
+func deferRun() string {
+	state, err := loadState()
+	if err != nil {
+		logrus.Warnln("Unable to read when runs started to be deferred, deferring from now: ", err)
+	}
+	reason, since := runDeferral(state.FirstDeferralTime, time.Now())
+	if !since.Equal(state.FirstDeferralTime) {
+		if err := updateState(func(state *PullerState) { state.FirstDeferralTime = since }); err != nil {
+			logrus.Warnln("Unable to record when runs started to be deferred: ", err)
+		}
+	}
+	return reason
+}
+
+// runDeferral returns why a scheduled run should wait for mains power or another connection, or "" if it can
+// start, and since when runs are deferred given that they were since firstDeferral, zero once they aren't. Runs are
+// not deferred for longer than max-deferral since the first deferred one.
+func runDeferral(firstDeferral, now time.Time) (string, time.Time) {
+	minBattery := viper.GetInt("defer-on-battery")
+	onMetered := viper.GetBool("defer-on-metered")
+	if minBattery <= 0 && !onMetered {
+		return "", time.Time{}
+	}
+
+	state, err := currentPowerState()
+	if err != nil {
+		logrus.Debugln("Unable to check the power state, not deferring the run: ", err)
+		return "", time.Time{}
+	}
+
+	reason := ""
+	switch {
+	case minBattery > 0 && state.OnBattery && state.BatteryPercent >= 0 && state.BatteryPercent < minBattery:
+		reason = deferralBattery
+	case onMetered && state.Metered:
+		reason = deferralMetered
+	}
+	if reason == "" {
+		return "", time.Time{}
+	}
+
+	if firstDeferral.IsZero() {
+		firstDeferral = now
+	}
+	if maxDeferral := time.Duration(viper.GetInt("max-deferral")) * time.Minute; now.Sub(firstDeferral) >= maxDeferral {
+		logrus.Warnf("Running on %s anyway, runs have been deferred for longer than max-deferral", reason)
+		return "", time.Time{}
+	}
+
+	return reason, firstDeferral
+}
+
+// parsePowerSupplies returns the power state described by the power supplies in dir, the layout of
+// /sys/class/power_supply.
+func parsePowerSupplies(dir string) (powerState, error) {
+	state := powerState{BatteryPercent: -1}
+
+	supplies, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return state, err
+	}
+
+	onMains := false
+	var batteries, totalPercent int
+	discharging := false
+	for _, supply := range supplies {
+		attribute := func(name string) string {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, supply.Name(), name))
+			return strings.TrimSpace(string(data))
+		}
+
+		switch attribute("type") {
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if attribute("online") == "1" {
+				onMains = true
+			}
+		case "Battery":
+			// Batteries of peripherals, e.g. mice, are not what the host runs on
+			if attribute("scope") == "Device" {
+				continue
+			}
+			percent, err := strconv.Atoi(attribute("capacity"))
+			if err != nil {
+				continue
+			}
+			batteries++
+			totalPercent += percent
+			if attribute("status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+
+	if batteries > 0 {
+		state.BatteryPercent = totalPercent / batteries
+		state.OnBattery = !onMains && discharging
+	}
+	return state, nil
+}
+
+var (
+	pmsetSourcePattern  = regexp.MustCompile(`Now drawing from '([^']+)'`)
+	pmsetPercentPattern = regexp.MustCompile(`(\d+)%`)
+)
+
+// parsePmset returns the power state in the output of `pmset -g batt` on macOS.
+func parsePmset(output string) powerState {
+	state := powerState{BatteryPercent: -1}
+
+	if match := pmsetSourcePattern.FindStringSubmatch(output); match != nil {
+		state.OnBattery = match[1] == "Battery Power"
+	}
+	if match := pmsetPercentPattern.FindStringSubmatch(output); match != nil {
+		state.BatteryPercent, _ = strconv.Atoi(match[1])
+	}
+	return state
+}
+
+// parseNetworkManagerMetered returns whether the Metered property of NetworkManager, as printed by busctl, says the
+// connection is metered: yes or guessed yes.
+func parseNetworkManagerMetered(output string) bool {
+	fields := strings.Fields(output)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false
+	}
+	// NMMetered: 0 unknown, 1 yes, 2 no, 3 guess yes, 4 guess no
+	return fields[1] == "1" || fields[1] == "3"
+}
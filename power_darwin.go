@@ -0,0 +1,13 @@
+package main
+
+import "os/exec"
+
+// readPowerState reads the power source and battery charge from pmset. Metered connections are not detected.
+func readPowerState() (powerState, error) {
+	output, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return powerState{BatteryPercent: -1}, err
+	}
+
+	return parsePmset(string(output)), nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import "os/exec"
+
+// readPowerState reads the power supplies from sysfs and whether the connection is metered from NetworkManager, if
+// it is running.
+func readPowerState() (powerState, error) {
+	state, err := parsePowerSupplies("/sys/class/power_supply")
+	if err != nil {
+		return state, err
+	}
+
+	output, err := exec.Command("busctl", "get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered").Output()
+	if err == nil {
+		state.Metered = parseNetworkManagerMetered(string(output))
+	}
+	return state, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+// readPowerState is not supported on this platform, runs are never deferred.
+func readPowerState() (powerState, error) {
+	return powerState{BatteryPercent: -1}, errors.New("power state is not supported on this platform")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePowerSupply writes the sysfs attributes of a power supply under dir.
+func writePowerSupply(t *testing.T, dir, name string, attributes map[string]string) {
+	supply := filepath.Join(dir, name)
+	assert.Nil(t, os.MkdirAll(supply, 0755))
+	for attribute, value := range attributes {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(supply, attribute), []byte(value+"\n"), 0644))
+	}
+}
+
+func TestParsePowerSupplies(t *testing.T) {
+	dir := t.TempDir()
+	state, err := parsePowerSupplies(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, powerState{BatteryPercent: -1}, state)
+
+	writePowerSupply(t, dir, "AC", map[string]string{"type": "Mains", "online": "0"})
+	writePowerSupply(t, dir, "BAT0", map[string]string{"type": "Battery", "capacity": "40", "status": "Discharging"})
+	writePowerSupply(t, dir, "BAT1", map[string]string{"type": "Battery", "capacity": "20", "status": "Discharging"})
+	writePowerSupply(t, dir, "hidpp_battery_0", map[string]string{"type": "Battery", "scope": "Device", "capacity": "100"})
+	state, err = parsePowerSupplies(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, powerState{OnBattery: true, BatteryPercent: 30}, state)
+
+	writePowerSupply(t, dir, "AC", map[string]string{"online": "1"})
+	state, err = parsePowerSupplies(dir)
+	assert.Nil(t, err)
+	assert.False(t, state.OnBattery)
+
+	_, err = parsePowerSupplies(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestParsePmset(t *testing.T) {
+	assert.Equal(t, powerState{OnBattery: true, BatteryPercent: 17}, parsePmset("Now drawing from 'Battery Power'\n"+
+		" -InternalBattery-0 (id=4653155)\t17%; discharging; 0:52 remaining present: true\n"))
+	assert.Equal(t, powerState{BatteryPercent: 100}, parsePmset("Now drawing from 'AC Power'\n"+
+		" -InternalBattery-0 (id=4653155)\t100%; charged; 0:00 remaining present: true\n"))
+	assert.Equal(t, powerState{BatteryPercent: -1}, parsePmset("Now drawing from 'AC Power'\n"))
+}
+
+func TestParseNetworkManagerMetered(t *testing.T) {
+	assert.True(t, parseNetworkManagerMetered("u 1\n"))
+	assert.True(t, parseNetworkManagerMetered("u 3\n"))
+	assert.False(t, parseNetworkManagerMetered("u 4\n"))
+	assert.False(t, parseNetworkManagerMetered("u 0\n"))
+	assert.False(t, parseNetworkManagerMetered(""))
+}
+
+func TestRunDeferral(t *testing.T) {
+	original := currentPowerState
+	defer func() {
+		currentPowerState = original
+		viper.Set("defer-on-battery", 0)
+		viper.Set("defer-on-metered", false)
+		viper.Set("max-deferral", 1440)
+	}()
+
+	state := powerState{OnBattery: true, BatteryPercent: 15, Metered: true}
+	currentPowerState = func() (powerState, error) { return state, nil }
+	now := time.Now()
+
+	viper.Set("max-deferral", 120)
+	reason, since := runDeferral(time.Time{}, now)
+	assert.Equal(t, "", reason)
+	assert.True(t, since.IsZero())
+
+	viper.Set("defer-on-battery", 20)
+	reason, since = runDeferral(time.Time{}, now)
+	assert.Equal(t, deferralBattery, reason)
+	assert.Equal(t, now, since)
+	state.BatteryPercent = 25
+	reason, since = runDeferral(now, now)
+	assert.Equal(t, "", reason)
+	assert.True(t, since.IsZero())
+
+	// Consecutive deferred ticks count from the first one, however long ago the last run was
+	viper.Set("defer-on-metered", true)
+	var first time.Time
+	for _, tick := range []time.Duration{0, time.Hour, 90 * time.Minute} {
+		reason, first = runDeferral(first, now.Add(tick))
+		assert.Equal(t, deferralMetered, reason)
+		assert.Equal(t, now, first)
+	}
+	// Past max-deferral, the run proceeds anyway, and the next one is deferred again
+	reason, first = runDeferral(first, now.Add(2*time.Hour))
+	assert.Equal(t, "", reason)
+	assert.True(t, first.IsZero())
+	reason, first = runDeferral(first, now.Add(3*time.Hour))
+	assert.Equal(t, deferralMetered, reason)
+	assert.Equal(t, now.Add(3*time.Hour), first)
+
+	// Not deferring when the power state is unknown
+	currentPowerState = func() (powerState, error) { return state, errors.New("unsupported") }
+	reason, _ = runDeferral(now, now)
+	assert.Equal(t, "", reason)
+}
+
+func TestDeferRunKeepsFirstDeferral(t *testing.T) {
+	original := currentPowerState
+	defer func() { currentPowerState = original }()
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir(), "defer-on-metered": true, "max-deferral": 120})
+
+	metered := true
+	currentPowerState = func() (powerState, error) { return powerState{BatteryPercent: -1, Metered: metered}, nil }
+	assert.Equal(t, deferralMetered, deferRun())
+	state, err := loadState()
+	assert.Nil(t, err)
+	first := state.FirstDeferralTime
+	assert.False(t, first.IsZero())
+
+	// Kept by later deferred ticks, e.g. after a restart
+	assert.Equal(t, deferralMetered, deferRun())
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.True(t, first.Equal(state.FirstDeferralTime))
+
+	metered = false
+	assert.Equal(t, "", deferRun())
+	state, err = loadState()
+	assert.Nil(t, err)
+	assert.True(t, state.FirstDeferralTime.IsZero())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetSystemPowerStatus = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is SYSTEM_POWER_STATUS.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// readPowerState reads the power source and battery charge from GetSystemPowerStatus. Metered connections are not
+// detected.
+func readPowerState() (powerState, error) {
+	state := powerState{BatteryPercent: -1}
+
+	var status systemPowerStatus
+	if ok, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return state, err
+	}
+
+	// 128 is no battery, 255 unknown
+	if status.BatteryFlag&128 == 0 && status.BatteryLifePercent != 255 {
+		state.BatteryPercent = int(status.BatteryLifePercent)
+		state.OnBattery = status.ACLineStatus == 0
+	}
+	return state, nil
+}
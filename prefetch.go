@@ -0,0 +1,80 @@
+// Prefetching of the next artifact while a run is in progress
+
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Held while an artifact is being staged, so a run waits for an in-flight prefetch instead of downloading again
+var prefetchMutex sync.Mutex
+
+// stagedArtifactFile is where a prefetched artifact waits until the next run picks it up.
+func stagedArtifactFile() string {
+	return localCacheFile + ".next"
+}
+
+// prefetchArtifact stages the configured remote artifact for the next run.
+func prefetchArtifact() error {
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return err
+	}
+
+	return stageArtifact(downloader, remotePath, localCacheFile, stagedArtifactFile())
+}
+
+// stageArtifact downloads the remote artifact to stagedPath if it differs from the one at currentPath.
+//
+// Only artifacts with a remote checksum are staged, since without one every run downloads the artifact anyway
+// and a staged copy could not be validated. A failed download removes the staged file.
+func stageArtifact(downloader downloader, remotePath, currentPath, stagedPath string) error {
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	remoteChecksum, err := downloader.RemoteChecksum(remotePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to download md5sum")
+	}
+	if remoteChecksum == "" {
+		logrus.Debug("No remote checksum available, skipping prefetch")
+		return nil
+	}
+
+	currentChecksum, err := md5sum(currentPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to calc local md5sum")
+	}
+	if currentChecksum == remoteChecksum {
+		logrus.Debug("Current artifact is up to date, skipping prefetch")
+		return os.RemoveAll(stagedPath)
+	}
+
+	logrus.Infof("Prefetching artifact: %s", remotePath)
+	if err = idempotentFileDownload(downloader, remotePath, stagedPath); err != nil {
+		os.Remove(stagedPath)
+		return err
+	}
+
+	return nil
+}
+
+// promoteStagedArtifact replaces the artifact at currentPath with a staged one, if there is one.
+//
+// A prefetch that is still in progress is waited for.
+func promoteStagedArtifact(stagedPath, currentPath string) error {
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	if _, err := os.Stat(stagedPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	logrus.Infoln("Using the prefetched artifact")
+	os.Remove(versionFile(currentPath))
+	return os.Rename(stagedPath, currentPath)
+}
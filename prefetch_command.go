@@ -0,0 +1,114 @@
+// The prefetch command, which readies a machine image for the first run of the hosts started from it
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// prefetchForImage downloads the artifact, builds the virtualenv, or pulls the image of the container executor, and
+// installs the galaxy requirements where runs find them, printing what it prepared. The first run on a host started
+// from an image built with it then only checks that all of them are current, instead of building everything from
+// scratch.
+func prefetchForImage() error {
+	// Not to build the virtualenv while a puller on the same host runs in it
+	release, err := runsLock.acquire("prefetch")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return errors.Wrap(err, "unable to prefetch the artifact")
+	}
+	version, err := fetchArtifactTo(downloader, remotePath, localCacheFile)
+	if err != nil {
+		return err
+	}
+	if err := artifacts.store(localCacheFile); err != nil {
+		logrus.Warnln("Unable to cache the artifact: ", err)
+	}
+	fmt.Println("Artifact:", version)
+
+	dir, err := ioutil.TempDir("", appName+"-prefetch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractTgz(localCacheFile, dir); err != nil {
+		return errors.Wrap(err, "unable to extract tgz")
+	}
+
+	aCfg := AnsibleConfig{Cwd: filepath.Join(dir, viper.GetString("ansible-dir")), GalaxyDir: galaxyCacheDir()}
+	if viper.GetString("executor") == executorContainer {
+		executor := newContainerExecutor()
+		if err := executor.Prepare(dir, nil); err != nil {
+			return err
+		}
+		fmt.Println("Image:", executor.Image)
+		aCfg.Executor = executor
+	} else if aCfg.VenvConfig, err = prefetchVenv(dir); err != nil {
+		return err
+	}
+	galaxyRequirements := filepath.Join(aCfg.Cwd, viper.GetString("galaxy-requirements-file"))
+	// Offline, runs use the collections vendored in the artifact
+	if _, err := os.Stat(galaxyRequirements); err == nil && !viper.GetBool("offline") {
+		logrus.Infoln("Installing galaxy requirements into ", aCfg.GalaxyDir)
+		// Filling the cache is the point, even if runs only use it with galaxy-offline
+		if err := aCfg.InstallGalaxyRequirements(galaxyRequirements, false); err != nil {
+			return err
+		}
+		fmt.Println("Collections and roles:", aCfg.GalaxyDir)
+	}
+
+	return nil
+}
+
+// prefetchVenv builds the virtualenv runs use from the requirements in the artifact extracted to dir. Runs with
+// venv-ephemeral build their own, so the virtualenv is built in dir to install the galaxy requirements with, and only
+// the wheels built into venv-wheelhouse along the way are kept for them.
+func prefetchVenv(dir string) (VenvConfig, error) {
+	venvPath, ansibleVersion := venvForRun(runSpec{})
+	ephemeral := viper.GetBool("venv-ephemeral")
+	if ephemeral {
+		venvPath = filepath.Join(dir, ".venv")
+	}
+	vCfg := configuredVenv(venvPath)
+
+	logrus.Infoln("Building the virtualenv in ", venvPath)
+	var executor Executor = venvExecutor{Config: vCfg, AnsibleVersion: ansibleVersion}
+	if viper.GetString("executor") == executorRunner {
+		executor = newRunnerExecutor(executor.(venvExecutor), "")
+	}
+	if err := executor.Prepare(dir, nil); err != nil {
+		return vCfg, err
+	}
+
+	if !ephemeral {
+		fmt.Println("Virtualenv:", venvPath)
+	} else if vCfg.Wheelhouse != "" {
+		fmt.Println("Wheels:", vCfg.Wheelhouse)
+	}
+	return vCfg, nil
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "prefetch",
+		Description: "Download the artifact, build the virtualenv and install galaxy requirements, e.g. when building an image",
+		Run: func(args []string) error {
+			if len(args) > 0 {
+				return errors.New("prefetch takes no arguments")
+			}
+			return prefetchForImage()
+		},
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchForImage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src")
+	assert.Nil(t, os.Mkdir(src, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "requirements.txt"), []byte("ansible-core\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "requirements.yml"), []byte("collections: []\n"), 0644))
+	artifact := filepath.Join(dir, "artifact.tgz")
+	assert.Nil(t, createTgz(src, artifact))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/artifact.tgz" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, artifact)
+	}))
+	defer server.Close()
+
+	// A virtualenv whose commands record how they were called
+	venv := filepath.Join(dir, "venv")
+	calls := filepath.Join(dir, "calls")
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "python"), nil, 0755))
+	for _, binary := range []string{"pip", "ansible-galaxy"} {
+		script := "#!/bin/sh\necho " + binary + " $1 $2 >> " + calls + "\n"
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", binary), []byte(script), 0755))
+	}
+	python := filepath.Join(dir, "python3")
+	assert.Nil(t, ioutil.WriteFile(python, []byte("#!/bin/sh\necho Python 3.10.12\n"), 0755))
+
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(dir, "cached.tgz")
+	defer func() { localCacheFile = originalCacheFile }()
+	defer withArtifactCache(t, 3, 0)()
+	withSettings(t, map[string]interface{}{
+		"state-dir":        filepath.Join(dir, "state"),
+		"ansible-url":      server.URL + "/artifact.tgz",
+		"venv-path":        venv,
+		"venv-python":      python,
+		"venv-ephemeral":   false,
+		"venv-wheelhouse":  "",
+		"galaxy-cache-dir": filepath.Join(dir, "galaxy"),
+	})
+
+	assert.Nil(t, prefetchForImage())
+	assert.FileExists(t, localCacheFile)
+	// Marked as up to date, so the first run doesn't rebuild it
+	assert.FileExists(t, filepath.Join(venv, venvMarkerFileName))
+	assert.FileExists(t, filepath.Join(dir, "galaxy", galaxyMarkerFileName))
+
+	called, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, "pip install -r\nansible-galaxy collection install\nansible-galaxy role install\n", string(called))
+}
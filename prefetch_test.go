@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticDownloader serves testText with the given checksum and counts downloads.
+type staticDownloader struct {
+	checksum  string
+	downloads int
+}
+
+func (d *staticDownloader) Download(remotePath, outputPath string) error {
+	d.downloads++
+	return ioutil.WriteFile(outputPath, testText, 0644)
+}
+
+func (d *staticDownloader) RemoteChecksum(remotePath string) (string, error) {
+	return d.checksum, nil
+}
+
+func TestStageAndPromoteArtifact(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current.tgz")
+	staged := filepath.Join(dir, "current.tgz.next")
+	d := &staticDownloader{checksum: testMD5}
+
+	assert.Nil(t, ioutil.WriteFile(current, []byte("old"), 0644))
+	assert.Nil(t, stageArtifact(d, "remote", current, staged))
+	assert.Equal(t, 1, d.downloads)
+	assert.FileExists(t, staged)
+
+	assert.Nil(t, promoteStagedArtifact(staged, current))
+	assert.NoFileExists(t, staged)
+	content, err := ioutil.ReadFile(current)
+	assert.Nil(t, err)
+	assert.Equal(t, testText, content)
+
+	// The next run finds the artifact current, so nothing is downloaded again
+	assert.Nil(t, idempotentFileDownload(d, "remote", current))
+	assert.Equal(t, 1, d.downloads)
+}
+
+func TestStageArtifactSkipsCurrentArtifact(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current.tgz")
+	staged := filepath.Join(dir, "current.tgz.next")
+	d := &staticDownloader{checksum: testMD5}
+
+	assert.Nil(t, ioutil.WriteFile(current, testText, 0644))
+	assert.Nil(t, stageArtifact(d, "remote", current, staged))
+	assert.Equal(t, 0, d.downloads)
+	assert.NoFileExists(t, staged)
+}
+
+func TestStageArtifactRemovesInvalidDownload(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current.tgz")
+	staged := filepath.Join(dir, "current.tgz.next")
+	d := &staticDownloader{checksum: "0123456789abcdef0123456789abcdef"}
+
+	assert.NotNil(t, stageArtifact(d, "remote", current, staged))
+	_, err := os.Stat(staged)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStageArtifactWithoutChecksum(t *testing.T) {
+	dir := t.TempDir()
+	d := &staticDownloader{}
+
+	assert.Nil(t, stageArtifact(d, "remote", filepath.Join(dir, "current.tgz"), filepath.Join(dir, "next")))
+	assert.Equal(t, 0, d.downloads)
+}
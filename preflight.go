@@ -0,0 +1,126 @@
+// Preflight check that Ansible can reach the host before a playbook is run
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Exit code of runs that fail the preflight, which is what ansible-playbook exits with for unreachable hosts
+const unreachableExitCode = 4
+
+var (
+	connectivityMutex sync.Mutex
+	connectivityError string // Why the last preflight failed, empty if it succeeded
+)
+
+func setConnectivityError(err error) {
+	connectivityMutex.Lock()
+	defer connectivityMutex.Unlock()
+
+	connectivityError = ""
+	if err != nil {
+		connectivityError = err.Error()
+	}
+}
+
+func lastConnectivityError() string {
+	connectivityMutex.Lock()
+	defer connectivityMutex.Unlock()
+
+	return connectivityError
+}
+
+// unreachableError is returned when the host cannot be reached by Ansible, usually because the inventory
+// overrides the local connection the puller relies on.
+type unreachableError struct {
+	cause string // What went wrong, as far as it could be recognized
+	hint  string // What to change to fix it
+}
+
+func (e unreachableError) Error() string {
+	return fmt.Sprintf("host is unreachable by ansible: %s. %s", e.cause, e.hint)
+}
+
+func (e unreachableError) Unreachable() bool {
+	return true
+}
+
+// Known preflight failures, matched in order against the output of the ping
+var preflightFailures = []struct {
+	pattern *regexp.Regexp
+	cause   string
+	hint    string
+}{
+	{
+		regexp.MustCompile(`(?i)connection plugin '?([\w.]+)'? was not found|invalid connection plugin`),
+		"the configured connection plugin does not exist",
+		"Check ansible_connection in the inventory and the connection setting of ansible.cfg",
+	},
+	{
+		regexp.MustCompile(`(?i)failed to connect to the host via ssh|ssh: connect to host|permission denied \(publickey|could not resolve hostname|host key verification failed`),
+		"an SSH connection was attempted instead of a local one",
+		"The inventory sets ansible_connection or ansible_host for this host, set ansible_connection=local for it",
+	},
+	{
+		regexp.MustCompile(`(?i)set the interpreter|interpreter[^\n]*not found|/usr/bin/python[\d.]*: (not found|no such file)`),
+		"the python interpreter was not found",
+		"Set ansible_python_interpreter for this host to a python that exists on it",
+	},
+	{
+		regexp.MustCompile(`(?i)no hosts matched|could not match supplied host pattern`),
+		"no host matched the limit",
+		"Check that the limit intersects with the host's entry in the inventory",
+	},
+	{
+		regexp.MustCompile(`(?i)authentication or permission failure|become.*(password|failed)`),
+		"authentication or privilege escalation failed",
+		"Check ansible_user and the become settings for this host",
+	},
+}
+
+// classifyPreflightFailure turns the output of a failed ping into an unreachableError.
+func classifyPreflightFailure(output string) unreachableError {
+	for _, failure := range preflightFailures {
+		if failure.pattern.MatchString(output) {
+			return unreachableError{cause: failure.cause, hint: failure.hint}
+		}
+	}
+
+	return unreachableError{
+		cause: "the ping module failed",
+		hint:  "Run 'ansible -m ping' against the host with the inventory to see the full error",
+	}
+}
+
+// Preflight pings target with the same inventory and connection as the playbook run, returning an unreachableError
+// if Ansible cannot run modules on it.
+func (a AnsibleConfig) Preflight(inventory, target string) error {
+	vCmd := VenvCommand{
+		Config:   a.VenvConfig,
+		Binary:   "ansible",
+		Args:     []string{target, "-i", inventory, "-m", "ping", "-c", hostConnection(), "--one-line"},
+		Cwd:      a.Cwd,
+		Env:      append(a.env(), "ANSIBLE_NOCOLOR=1"),
+		Executor: a.Executor,
+	}
+
+	output := vCmd.Run()
+	combined := output.Stdout + "\n" + output.Stderr
+	if output.Error == nil && strings.Contains(output.Stdout, "SUCCESS") {
+		return nil
+	}
+
+	ansibleLog.Debugln("Ansible ping output:", combined)
+	var timeout interface{ Timeout() bool }
+	if errors.As(output.Error, &timeout) && timeout.Timeout() {
+		return output.Error
+	}
+
+	return classifyPreflightFailure(combined)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyPreflightFailure(t *testing.T) {
+	cases := map[string]string{
+		`host01 | UNREACHABLE! => {"changed": false, "msg": "Failed to connect to the host via ssh: ssh: connect to host 10.0.0.1 port 22: Connection refused", "unreachable": true}`: "an SSH connection was attempted instead of a local one",
+		`ERROR! the connection plugin 'paramiko_ssh' was not found`: "the configured connection plugin does not exist",
+		`host01 | FAILED! => {"changed": false, "module_stderr": "/bin/sh: 1: /usr/bin/python: not found\n", "msg": "The module failed to execute correctly, you probably need to set the interpreter."}`: "the python interpreter was not found",
+		`[WARNING]: Could not match supplied host pattern, ignoring: host01`: "no host matched the limit",
+		`something else entirely`: "the ping module failed",
+	}
+
+	for output, cause := range cases {
+		err := classifyPreflightFailure(output)
+		assert.Equal(t, cause, err.cause, output)
+		assert.NotEmpty(t, err.hint)
+	}
+}
+
+func TestUnreachableOutcome(t *testing.T) {
+	err := errors.Wrap(classifyPreflightFailure("ssh: connect to host"), "run failed")
+	assert.Equal(t, runOutcomeUnreachable, runOutcomeOf(err))
+	assert.Contains(t, err.Error(), "set ansible_connection=local")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/windows"
+)
+
+// STILL_ACTIVE is the exit code reported for processes that have not exited yet
+const stillActive = 259
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+
+	return exitCode == stillActive
+}
+
+// setProcessGroup does nothing, Windows has no process groups to stop.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// stopProcessGroup kills the process pid, which can't be asked to terminate on Windows.
+func stopProcessGroup(pid int, kill bool) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// processGroupAlive reports false, Windows has no process groups that outlive the process starting them.
+func processGroupAlive(pgid int) bool {
+	return false
+}
@@ -0,0 +1,200 @@
+// Progress of ansible-playbook runs: heartbeats while a task is quiet, and a watchdog killing runs that hang
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Name of the callback plugin, which prints the start and results of every task to stderr
+	progressPluginName = "puller_progress"
+
+	// Default callback plugin path of Ansible, used when the effective one can't be read
+	defaultCallbackPluginPath = "~/.ansible/plugins/callback:/usr/share/ansible/plugins/callback"
+)
+
+var (
+	//go:embed plugins/puller_progress.py
+	progressPlugin string
+
+	// Lines starting a task, as printed by the progress plugin and the default stdout callback
+	taskLinePattern = regexp.MustCompile(`^(TASK|RUNNING HANDLER) \[(.*)\]`)
+
+	// Callback plugin path in the output of ansible-config dump, e.g. DEFAULT_CALLBACK_PLUGIN_PATH(default) = ['a', 'b']
+	callbackPathPattern = regexp.MustCompile(`(?m)^DEFAULT_CALLBACK_PLUGIN_PATH\([^)]*\) = \[(.*)\]\s*$`)
+
+	// How often a running playbook is checked for heartbeats and hangs
+	progressCheckInterval = 5 * time.Second
+)
+
+// runProgress is an io.Writer following the output of a run: the task it is at and when it last printed anything.
+type runProgress struct {
+	mutex      sync.Mutex
+	partial    bytes.Buffer // Data following the last newline
+	task       string       // Empty until the first task started
+	taskStart  time.Time
+	lastOutput time.Time
+	now        func() time.Time
+}
+
+func newRunProgress(now func() time.Time) *runProgress {
+	start := now()
+	return &runProgress{taskStart: start, lastOutput: start, now: now}
+}
+
+func (p *runProgress) Write(data []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.lastOutput = p.now()
+	p.partial.Write(data)
+	for {
+		line, err := p.partial.ReadString('\n')
+		if err != nil {
+			// Kept until the rest of the line arrives
+			p.partial.WriteString(line)
+			break
+		}
+		if match := taskLinePattern.FindStringSubmatch(line); match != nil {
+			p.task, p.taskStart = match[2], p.lastOutput
+		}
+	}
+
+	return len(data), nil
+}
+
+// state returns the current task, how long it has been running and how long the run has been quiet.
+func (p *runProgress) state() (task string, elapsed, quiet time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.now()
+	return p.task, now.Sub(p.taskStart), now.Sub(p.lastOutput)
+}
+
+// describeTask names what the run is doing for log messages.
+func describeTask(task string) string {
+	if task == "" {
+		return "ansible-playbook"
+	}
+	return "task " + task
+}
+
+// watchProgress checks on progress until the returned stop function is called. While the run is quiet, it logs a
+// heartbeat every heartbeat, and once it has been quiet for outputTimeout it calls kill. Either is disabled if 0.
+//
+// stop returns the error describing the hang if the run was killed, nil otherwise.
+func watchProgress(progress *runProgress, heartbeat, outputTimeout time.Duration, kill func()) (stop func() error) {
+	done := make(chan struct{})
+	result := make(chan error, 1)
+
+	go func() {
+		var hung error
+		defer func() {
+			promOutputSilence.Set(0)
+			result <- hung
+		}()
+
+		ticker := time.NewTicker(progressCheckInterval)
+		defer ticker.Stop()
+		var lastHeartbeat time.Duration // Quiet time at the last heartbeat
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			task, elapsed, quiet := progress.state()
+			promOutputSilence.Set(quiet.Seconds())
+			if outputTimeout > 0 && quiet >= outputTimeout {
+				hung = timeoutError{errors.Errorf("no output for %s while running %s, killed as hung", outputTimeout, describeTask(task))}
+				ansibleLog.Errorln(hung.Error())
+				promHungRuns.Inc()
+				kill()
+				return
+			}
+
+			if quiet < lastHeartbeat {
+				lastHeartbeat = 0
+			}
+			if heartbeat > 0 && quiet-lastHeartbeat >= heartbeat {
+				ansibleLog.Infof("Still running %s (%ds elapsed)", describeTask(task), int(elapsed.Seconds()))
+				lastHeartbeat = quiet
+			}
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
+// writeProgressPlugin writes the progress callback plugin into a new directory, which the caller removes.
+func writeProgressPlugin() (string, error) {
+	dir, err := ioutil.TempDir("", appName+"-callbacks")
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create callback plugin directory")
+	}
+
+	path := filepath.Join(dir, progressPluginName+".py")
+	if err := ioutil.WriteFile(path, []byte(progressPlugin), 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", errors.Wrap(err, "unable to write progress callback plugin")
+	}
+
+	return dir, nil
+}
+
+// callbackPluginPath returns the callback plugin path that applies to the run, as set in ansible.cfg or
+// ANSIBLE_CALLBACK_PLUGINS, so that the directory of the progress plugin can be added to it rather than replace it.
+func callbackPluginPath(runner AnsiblePlaybookRunner) string {
+	output := VenvCommand{
+		Config:   runner.AnsibleConfig.VenvConfig,
+		Binary:   "ansible-config",
+		Args:     []string{"dump"},
+		Cwd:      runner.AnsibleConfig.Cwd,
+		Env:      runner.env(),
+		Executor: runner.AnsibleConfig.Executor,
+	}.Run()
+	if output.Error != nil {
+		logrus.Debugln("Unable to read the callback plugin path, using the default: ", output.Error)
+		return defaultCallbackPluginPath
+	}
+
+	path, ok := parseCallbackPluginPath(output.Stdout)
+	if !ok {
+		logrus.Debugln("No callback plugin path in the Ansible config, using the default")
+		return defaultCallbackPluginPath
+	}
+	return path
+}
+
+// parseCallbackPluginPath returns the callback plugin path in the output of ansible-config dump, joined with colons.
+func parseCallbackPluginPath(dump string) (string, bool) {
+	match := callbackPathPattern.FindStringSubmatch(dump)
+	if match == nil {
+		return "", false
+	}
+
+	var dirs []string
+	for _, dir := range strings.Split(match[1], ",") {
+		if dir = strings.Trim(strings.TrimSpace(dir), `'"`); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return strings.Join(dirs, ":"), true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProgress(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	progress := newRunProgress(func() time.Time { return now })
+
+	task, elapsed, quiet := progress.state()
+	assert.Equal(t, "", task)
+	assert.Equal(t, time.Duration(0), elapsed)
+	assert.Equal(t, time.Duration(0), quiet)
+
+	// Lines may arrive in pieces
+	now = now.Add(time.Minute)
+	progress.Write([]byte("PLAY [webservers]\nTASK [Install"))
+	task, _, _ = progress.state()
+	assert.Equal(t, "", task)
+	progress.Write([]byte(" nginx] ****\n"))
+
+	now = now.Add(3 * time.Minute)
+	task, elapsed, quiet = progress.state()
+	assert.Equal(t, "Install nginx", task)
+	assert.Equal(t, 3*time.Minute, elapsed)
+	assert.Equal(t, 3*time.Minute, quiet)
+
+	// Results are output, but don't start a task
+	progress.Write([]byte("changed: [web1]\nRUNNING HANDLER [restart nginx]\n"))
+	now = now.Add(time.Minute)
+	task, elapsed, quiet = progress.state()
+	assert.Equal(t, "restart nginx", task)
+	assert.Equal(t, time.Minute, elapsed)
+	assert.Equal(t, time.Minute, quiet)
+}
+
+func TestWatchProgressKillsQuietRun(t *testing.T) {
+	originalInterval := progressCheckInterval
+	progressCheckInterval = 10 * time.Millisecond
+	defer func() { progressCheckInterval = originalInterval }()
+
+	progress := newRunProgress(time.Now)
+	progress.Write([]byte("TASK [hang]\n"))
+	killed := make(chan struct{})
+	stop := watchProgress(progress, 0, 50*time.Millisecond, func() { close(killed) })
+
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the quiet run was not killed")
+	}
+	err := stop()
+	assert.Equal(t, runOutcomeTimeout, runOutcomeOf(err))
+	assert.Contains(t, err.Error(), "while running task hang")
+}
+
+func TestWatchProgressKeepsRunWithOutput(t *testing.T) {
+	originalInterval := progressCheckInterval
+	progressCheckInterval = 10 * time.Millisecond
+	defer func() { progressCheckInterval = originalInterval }()
+
+	progress := newRunProgress(time.Now)
+	stop := watchProgress(progress, 20*time.Millisecond, 100*time.Millisecond, func() { t.Error("the run was killed") })
+	for i := 0; i < 20; i++ {
+		progress.Write([]byte("ok: [localhost]\n"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Nil(t, stop())
+}
+
+func TestAnsiblePlaybookRunnerOutputTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	originalInterval := progressCheckInterval
+	progressCheckInterval = 10 * time.Millisecond
+	defer func() { progressCheckInterval = originalInterval }()
+
+	dir, err := ioutil.TempDir("", "ansible_puller_progress")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	venv := filepath.Join(dir, "venv")
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	env := filepath.Join(dir, "env")
+	script := "#!/bin/sh\necho \"$ANSIBLE_CALLBACK_PLUGINS\" > " + env + "\necho 'TASK [hang]' >&2\nexec sleep 10\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "ansible-playbook"), []byte(script), 0755))
+	// Callback plugins configured for the host
+	dump := "#!/bin/sh\necho \"DEFAULT_CALLBACK_PLUGIN_PATH(env: ANSIBLE_CALLBACK_PLUGINS) = ['/opt/callbacks']\"\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "ansible-config"), []byte(dump), 0755))
+
+	runner := AnsiblePlaybookRunner{
+		AnsibleConfig: AnsibleConfig{VenvConfig: VenvConfig{Path: venv}, Cwd: dir},
+		PlaybookPath:  "site.yml",
+		InventoryPath: "hosts",
+		OutputTimeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+	output, err := runner.Run()
+	assert.True(t, time.Since(start) < 5*time.Second, "the run was not killed")
+	assert.Equal(t, runOutcomeTimeout, runOutcomeOf(err))
+	assert.Equal(t, timeoutExitCode, output.CommandOutput.Exitcode)
+
+	data, err := ioutil.ReadFile(env)
+	assert.Nil(t, err)
+	pluginPath := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	pluginDir := pluginPath[0]
+	assert.Contains(t, pluginDir, appName+"-callbacks")
+	assert.Equal(t, "/opt/callbacks", pluginPath[1])
+	_, err = os.Stat(pluginDir)
+	assert.True(t, os.IsNotExist(err), "the plugin directory is removed after the run")
+}
+
+func TestParseCallbackPluginPath(t *testing.T) {
+	dump := "DEFAULT_BECOME(default) = False\n" +
+		"DEFAULT_CALLBACK_PLUGIN_PATH(/etc/ansible/ansible.cfg) = ['/etc/ansible/callbacks', '/usr/share/ansible/plugins/callback']\n" +
+		"DEFAULT_CONNECTION_PLUGIN_PATH(default) = ['/root/.ansible/plugins/connection']\n"
+	path, ok := parseCallbackPluginPath(dump)
+	assert.True(t, ok)
+	assert.Equal(t, "/etc/ansible/callbacks:/usr/share/ansible/plugins/callback", path)
+
+	path, ok = parseCallbackPluginPath("DEFAULT_CALLBACK_PLUGIN_PATH(default) = []\n")
+	assert.True(t, ok)
+	assert.Equal(t, "", path)
+
+	_, ok = parseCallbackPluginPath("ERROR! unable to load the config\n")
+	assert.False(t, ok)
+}
@@ -0,0 +1,160 @@
+// Limits on the number of runs each source of runs may start
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Sources runs are counted and limited by
+const (
+	runSourceSchedule = "schedule" // Startup and scheduled runs
+	runSourceAPI      = "api"      // POST /run, POST /apply and the ad-hoc run button
+	runSourceCompare  = "compare"
+	runSourceUpgrade  = "upgrade"
+)
+
+// Sources a quota can be configured for
+var quotaRunSources = []string{runSourceSchedule, runSourceAPI, runSourceCompare, runSourceUpgrade}
+
+// runSource returns the source a run started by trigger is counted against.
+func runSource(trigger string) string {
+	switch trigger {
+	case runTriggerStartup, runTriggerRetry:
+		return runSourceSchedule
+	case runTriggerAdhoc, runTriggerApply, runTriggerReplay:
+		return runSourceAPI
+	}
+
+	return trigger
+}
+
+// runQuota allows Limit runs in any Period.
+type runQuota struct {
+	Limit  int
+	Period time.Duration
+}
+
+func (q runQuota) String() string {
+	return fmt.Sprintf("%d/%s", q.Limit, q.Period)
+}
+
+// parseRunQuota parses a quota like "10/1h".
+func parseRunQuota(value string) (runQuota, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return runQuota{}, errors.Errorf("invalid run quota %q, expected <runs>/<period> like 10/1h", value)
+	}
+
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit < 0 {
+		return runQuota{}, errors.Errorf("invalid number of runs in run quota %q", value)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return runQuota{}, errors.Errorf("invalid period in run quota %q", value)
+	}
+
+	return runQuota{Limit: limit, Period: period}, nil
+}
+
+// quotaExceededError is returned for runs refused by a quota.
+type quotaExceededError struct {
+	source     string
+	quota      runQuota
+	retryAfter time.Duration // Until the oldest counted run leaves the period
+}
+
+func (e quotaExceededError) Error() string {
+	return fmt.Sprintf("run quota of %s runs exceeded for source %s, next run allowed in %s",
+		e.quota, e.source, e.retryAfter.Round(time.Second))
+}
+
+// runQuotaTracker counts the runs started by each source over a sliding window, refusing runs over the quota.
+type runQuotaTracker struct {
+	mutex   sync.Mutex
+	quotas  map[string]runQuota
+	started map[string][]time.Time // Start times within the period of the quota, oldest first
+	now     func() time.Time
+}
+
+func newRunQuotaTracker(quotas map[string]runQuota) *runQuotaTracker {
+	return &runQuotaTracker{
+		quotas:  quotas,
+		started: map[string][]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// Quotas from the "run-quotas" option, none until setupRunQuotas is called
+var runQuotas = newRunQuotaTracker(nil)
+
+// setupRunQuotas parses the "run-quotas" option, e.g. api=10/1h,compare=2/1h.
+func setupRunQuotas() error {
+	quotas := map[string]runQuota{}
+	for source, value := range viper.GetStringMapString("run-quotas") {
+		known := false
+		for _, quotaSource := range quotaRunSources {
+			known = known || quotaSource == source
+		}
+		if !known {
+			return errors.Errorf("invalid run-quotas source %q, expected one of %s", source, strings.Join(quotaRunSources, ", "))
+		}
+		quota, err := parseRunQuota(value)
+		if err != nil {
+			return err
+		}
+		quotas[source] = quota
+	}
+
+	runQuotas = newRunQuotaTracker(quotas)
+	return nil
+}
+
+// allow counts a run of source, returning a quotaExceededError instead if that would exceed its quota.
+func (t *runQuotaTracker) allow(source string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	quota, ok := t.quotas[source]
+	if !ok {
+		return nil
+	}
+
+	now := t.now()
+	started := t.started[source]
+	for len(started) > 0 && !started[0].After(now.Add(-quota.Period)) {
+		started = started[1:]
+	}
+	t.started[source] = started
+
+	if len(started) >= quota.Limit {
+		promThrottledRuns.WithLabelValues(source).Inc()
+		retryAfter := quota.Period
+		if len(started) > 0 {
+			retryAfter = started[0].Add(quota.Period).Sub(now)
+		}
+		return quotaExceededError{source: source, quota: quota, retryAfter: retryAfter}
+	}
+
+	t.started[source] = append(started, now)
+	return nil
+}
+
+// httpQuotaExceeded responds to an API request refused by a run quota, telling clients when to retry.
+func httpQuotaExceeded(w http.ResponseWriter, err error) {
+	var exceeded quotaExceededError
+	if errors.As(err, &exceeded) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(exceeded.retryAfter.Seconds()))))
+	}
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
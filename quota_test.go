@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRunQuota(t *testing.T) {
+	quota, err := parseRunQuota("10/1h")
+	assert.Nil(t, err)
+	assert.Equal(t, runQuota{Limit: 10, Period: time.Hour}, quota)
+
+	quota, err = parseRunQuota("0/30m")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, quota.Limit)
+
+	for _, value := range []string{"10", "ten/1h", "-1/1h", "10/hour", "10/0s"} {
+		_, err := parseRunQuota(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestSetupRunQuotas(t *testing.T) {
+	original := viper.Get("run-quotas")
+	defer func() {
+		viper.Set("run-quotas", original)
+		runQuotas = newRunQuotaTracker(nil)
+	}()
+
+	viper.Set("run-quotas", map[string]string{"api": "2/1h"})
+	assert.Nil(t, setupRunQuotas())
+	assert.Equal(t, map[string]runQuota{runSourceAPI: {Limit: 2, Period: time.Hour}}, runQuotas.quotas)
+
+	viper.Set("run-quotas", map[string]string{"webhook": "2/1h"})
+	assert.NotNil(t, setupRunQuotas())
+}
+
+func TestRunQuotaSlidingWindow(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newRunQuotaTracker(map[string]runQuota{runSourceAPI: {Limit: 2, Period: time.Hour}})
+	tracker.now = func() time.Time { return now }
+
+	assert.Nil(t, tracker.allow(runSourceAPI))
+	now = now.Add(20 * time.Minute)
+	assert.Nil(t, tracker.allow(runSourceAPI))
+
+	now = now.Add(20 * time.Minute)
+	err := tracker.allow(runSourceAPI)
+	assert.IsType(t, quotaExceededError{}, err)
+	assert.Equal(t, 20*time.Minute, err.(quotaExceededError).retryAfter)
+
+	// Sources are limited independently, and those without a quota not at all
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, tracker.allow(runSourceSchedule))
+	}
+
+	now = now.Add(20 * time.Minute)
+	assert.Nil(t, tracker.allow(runSourceAPI), "the first run left the period")
+	assert.NotNil(t, tracker.allow(runSourceAPI))
+}
+
+func TestRunSource(t *testing.T) {
+	assert.Equal(t, runSourceSchedule, runSource(runTriggerStartup))
+	assert.Equal(t, runSourceSchedule, runSource(runTriggerSchedule))
+	assert.Equal(t, runSourceAPI, runSource(runTriggerAdhoc))
+	assert.Equal(t, runSourceAPI, runSource(runTriggerAPI))
+	assert.Equal(t, runSourceCompare, runSource(runTriggerCompare))
+}
+
+func TestRunEndpointOverQuota(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	runQuotas = newRunQuotaTracker(map[string]runQuota{runSourceAPI: {Limit: 0, Period: time.Minute}})
+	defer func() { runQuotas = newRunQuotaTracker(nil) }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandlerRun).ServeHTTP(rr, httptest.NewRequest("POST", "/run", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+}
@@ -0,0 +1,165 @@
+// Masking secrets in the output of commands before it is logged, kept in the run history or written to disk
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// What secrets are replaced with
+const redactedText = "[REDACTED]"
+
+// Credentials in URLs and authorization headers. The first group of a pattern is masked, or the whole match if it
+// has none.
+var defaultRedactPatterns = []string{
+	`[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*:([^/\s@]+)@`,
+	`(?i)authorization:\s*(?:basic|bearer|token)\s+([^\s"']+)`,
+}
+
+// Names of environment variables holding secrets, whose values are masked
+var secretEnvNamePattern = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIALS?|PRIVATE_KEY|API_KEY)`)
+
+// Values shorter than this are not masked, they would mask unrelated output
+const minRedactedValueLength = 4
+
+var (
+	redactMutex    sync.RWMutex
+	redactPatterns []*regexp.Regexp
+	redactValues   []string // Longest first, so that values containing others are masked whole
+)
+
+// setupRedaction compiles the "redact-patterns" option and collects the values of secret environment variables of
+// the puller.
+func setupRedaction() error {
+	var patterns []*regexp.Regexp
+	for _, pattern := range viper.GetStringSlice("redact-patterns") {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid redact-patterns %q", pattern)
+		}
+		patterns = append(patterns, compiled)
+	}
+
+	redactMutex.Lock()
+	redactPatterns = patterns
+	redactValues = nil
+	redactMutex.Unlock()
+
+	addRedactedEnv(os.Environ())
+	return nil
+}
+
+// secretEnvName reports whether the environment variable name holds a secret, by its name or because it is listed
+// in "redact-env".
+func secretEnvName(name string) bool {
+	for _, listed := range viper.GetStringSlice("redact-env") {
+		if listed == name {
+			return true
+		}
+	}
+	return secretEnvNamePattern.MatchString(name)
+}
+
+// addRedactedEnv masks the values of the variables in env, as NAME=value, that hold secrets.
+func addRedactedEnv(env []string) {
+	for _, variable := range env {
+		name, value, ok := strings.Cut(variable, "=")
+		if ok && secretEnvName(name) {
+			addRedactedValue(value)
+		}
+	}
+}
+
+// redactEnv returns env, as NAME=value, with the values of the variables holding secrets and other secrets masked.
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		if secretEnvName(name) {
+			value = redactedText
+		}
+		redacted = append(redacted, name+"="+redact(value))
+	}
+	return redacted
+}
+
+// addRedactedValue masks value, e.g. a secret the puller resolved, from now on.
+func addRedactedValue(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minRedactedValueLength {
+		return
+	}
+
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	for _, known := range redactValues {
+		if known == value {
+			return
+		}
+	}
+	redactValues = append(redactValues, value)
+	sort.SliceStable(redactValues, func(i, j int) bool { return len(redactValues[i]) > len(redactValues[j]) })
+}
+
+// redact returns s with the known secret values and the matches of redact-patterns masked.
+func redact(s string) string {
+	redactMutex.RLock()
+	defer redactMutex.RUnlock()
+
+	for _, value := range redactValues {
+		s = strings.ReplaceAll(s, value, redactedText)
+	}
+	for _, pattern := range redactPatterns {
+		s = redactPattern(pattern, s)
+	}
+	return s
+}
+
+func redactPattern(pattern *regexp.Regexp, s string) string {
+	matches := pattern.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+
+	var redacted strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) >= 4 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		redacted.WriteString(s[last:start])
+		redacted.WriteString(redactedText)
+		last = end
+	}
+	redacted.WriteString(s[last:])
+	return redacted.String()
+}
+
+// redactHook masks secrets in every log message and string field.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact(entry.Message)
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			entry.Data[key] = redact(value)
+		case error:
+			entry.Data[key] = redact(value.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+// Reloading the config file on SIGHUP or POST /reload, without restarting the daemon or interrupting a run
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Outcomes of reloads
+const (
+	reloadOutcomeSuccess = "success"
+	reloadOutcomeFailure = "failure"
+)
+
+// Settings a reload applies. Runs read them when they start, so a run in progress finishes with the settings it
+// started with. All other settings only apply once the puller restarts.
+var reloadableSettings = map[string]bool{
+	"sleep":         true,
+	"sleep-jitter":  true,
+	"schedule-cron": true,
+	"playbooks":     true,
+	"http-url":      true,
+	"s3-arn":        true,
+	"git-url":       true,
+	"ansible-url":   true,
+	"labels-tags":   true,
+	"debug":         true,
+	"log-format":    true,
+}
+
+// configReload is the outcome of the reloads of the config file, as returned by the status endpoint.
+type configReload struct {
+	LastReloadTime interface{} `json:"last_reload_time"`          // Of the last reload that applied the config file
+	Error          string      `json:"error,omitempty"`           // Why the last reload was rejected
+	Applied        []string    `json:"applied,omitempty"`         // Settings the last successful reload changed
+	PendingRestart []string    `json:"pending_restart,omitempty"` // Changed settings that only apply on a restart
+}
+
+var configReloads = struct {
+	sync.Mutex
+	status *configReload // nil until the first reload
+	file   *viper.Viper  // Settings of the config file as last read, nil without one
+}{}
+
+// readConfigFile reads the config file the puller uses into a separate viper instance, so that it can be read while
+// the settings are in use. Flags keep precedence over the config file, as they do in the settings.
+func readConfigFile() (*viper.Viper, error) {
+	file := viper.New()
+	file.SetConfigFile(viper.ConfigFileUsed())
+	if err := file.BindPFlags(pflag.CommandLine); err != nil {
+		return nil, err
+	}
+	if err := file.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", viper.ConfigFileUsed())
+	}
+	return file, nil
+}
+
+// setupConfigReloads keeps the settings of the config file the puller started with, which reloads compare the config
+// file against.
+func setupConfigReloads() error {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+
+	configReloads.file = nil
+	if viper.ConfigFileUsed() == "" {
+		return nil
+	}
+	file, err := readConfigFile()
+	configReloads.file = file
+	return err
+}
+
+// reloadStatus returns the outcome of the reloads, nil if the config file was not reloaded yet.
+func reloadStatus() *configReload {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+
+	if configReloads.status == nil {
+		return nil
+	}
+	status := *configReloads.status
+	return &status
+}
+
+// sameSetting reports whether two values of a setting are equal, whether they were read from the config file or
+// flags.
+func sameSetting(a, b interface{}) bool {
+	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
+
+// applyReloadable sets up what depends on the reloadable settings.
+func applyReloadable() error {
+	if err := setupSchedule(); err != nil {
+		return err
+	}
+	if err := setupPlaybooks(); err != nil {
+		return err
+	}
+	jitter := time.Duration(viper.GetInt("sleep-jitter")) * time.Minute
+	if err := validateSchedules(currentPlaybooks(), jitter, time.Duration(viper.GetInt("sleep-splay"))*time.Minute); err != nil {
+		return err
+	}
+	if err := setupLogFormat(); err != nil {
+		return err
+	}
+	setupLogLevel()
+
+	if daemonSchedules != nil {
+		daemonSchedules.update(currentPlaybooks(), jitter)
+	}
+	return nil
+}
+
+// reloadConfig reads the config file again and applies the reloadable settings. Other settings that changed keep
+// the values the puller started with, and are returned as pending a restart. If the config file can't be read or
+// the reloadable settings are invalid, nothing changes.
+//
+// viper isn't safe for concurrent use, so the config file is read into a separate instance, and only the changed
+// reloadable settings are set while no run executes: runs read the settings throughout, and wait for the reload to
+// finish before they start.
+func reloadConfig() (applied, pendingRestart []string, err error) {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+
+	defer func() {
+		now := time.Now()
+		if configReloads.status == nil {
+			configReloads.status = &configReload{LastReloadTime: statusTime(time.Time{})}
+		}
+		configReloads.status.Error = ""
+		if err != nil {
+			promConfigReloads.WithLabelValues(reloadOutcomeFailure).Inc()
+			configReloads.status.Error = err.Error()
+			return
+		}
+		promConfigReloads.WithLabelValues(reloadOutcomeSuccess).Inc()
+		configReloads.status.LastReloadTime = statusTime(now)
+		configReloads.status.Applied = applied
+		configReloads.status.PendingRestart = pendingRestart
+	}()
+
+	if viper.ConfigFileUsed() == "" || configReloads.file == nil {
+		return nil, nil, errors.New("the puller was started without a config file")
+	}
+
+	reloaded, err := readConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Settings removed from the config file are compared as well
+	unique := map[string]bool{}
+	for _, key := range append(reloaded.AllKeys(), configReloads.file.AllKeys()...) {
+		unique[key] = true
+	}
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if sameSetting(reloaded.Get(key), configReloads.file.Get(key)) {
+			continue
+		}
+		if reloadableSettings[key] {
+			applied = append(applied, key)
+			continue
+		}
+		pendingRestart = append(pendingRestart, key)
+	}
+
+	if len(applied) > 0 {
+		resume := runsLock.pause()
+		defer resume()
+
+		previous := map[string]interface{}{}
+		for _, key := range applied {
+			previous[key] = viper.Get(key)
+			viper.Set(key, reloaded.Get(key))
+		}
+		if err := applyReloadable(); err != nil {
+			// Back to the settings the puller ran with, until the config file is fixed
+			for _, key := range applied {
+				viper.Set(key, previous[key])
+			}
+			if err := applyReloadable(); err != nil {
+				logrus.Errorln("Unable to restore the settings before the reload: ", err)
+			}
+			return nil, nil, errors.Wrap(err, "invalid configuration")
+		}
+	}
+	// Settings pending a restart are still compared against the values the puller started with
+	for _, key := range applied {
+		configReloads.file.Set(key, reloaded.Get(key))
+	}
+	configFileReloaded()
+
+	return applied, pendingRestart, nil
+}
+
+// reload reloads the config file, logging the outcome.
+func reload() error {
+	if err := sdNotify("RELOADING=1"); err != nil {
+		logrus.Debugln("Unable to notify systemd of the reload: ", err)
+	}
+	defer sdNotify("READY=1")
+
+	applied, pendingRestart, err := reloadConfig()
+	if err != nil {
+		logrus.Errorln("Config file not reloaded: ", err)
+		return err
+	}
+
+	if len(applied) == 0 {
+		logrus.Infof("Reloaded %s, no reloadable settings changed", viper.ConfigFileUsed())
+	} else {
+		logrus.Infof("Reloaded %s, applied changes to %v", viper.ConfigFileUsed(), applied)
+	}
+	if len(pendingRestart) > 0 {
+		logrus.Warnf("Changes to %v only apply once the puller restarts", pendingRestart)
+	}
+	return nil
+}
+
+// watchReloadSignal reloads the config file on SIGHUP.
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			logrus.Infoln("Received SIGHUP, reloading the config file")
+			reload()
+		}
+	}()
+}
+
+// HandlerReload reloads the config file, responding with the outcome.
+func HandlerReload(w http.ResponseWriter, r *http.Request) {
+	if err := reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"config_reload": reloadStatus()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withReloadableConfig starts from a config file with the given content, restoring the config file and the settings
+// after the test. It returns the path of the config file to write changes to.
+func withReloadableConfig(t *testing.T, content string) string {
+	originalFile := viper.ConfigFileUsed()
+	for _, key := range []string{"sleep", "sleep-jitter", "schedule-cron", "playbooks", "debug", "http-listen-string"} {
+		key, original := key, viper.Get(key)
+		viper.Set(key, nil)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+	t.Cleanup(func() {
+		viper.SetConfigFile(originalFile)
+		assert.Nil(t, viper.ReadInConfig())
+		configReloads.status = nil
+		daemonSchedules = nil
+		assert.Nil(t, applyReloadable())
+		assert.Nil(t, setupConfigReloads())
+		setupConfigHash()
+	})
+
+	configFile := filepath.Join(t.TempDir(), "ansible-puller.json")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(content), 0600))
+	viper.SetConfigFile(configFile)
+	assert.Nil(t, viper.ReadInConfig())
+	assert.Nil(t, applyReloadable())
+	assert.Nil(t, setupConfigReloads())
+	setupConfigHash()
+	return configFile
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile := withReloadableConfig(t, `{"sleep": 30, "http-listen-string": "127.0.0.1:31836"}`)
+	schedules := newPlaybookSchedules(newRunQueue(), 0, 0)
+	schedules.start(playbooks[0], false)
+	daemonSchedules = schedules
+	t.Cleanup(func() { schedules.update(nil, 0) })
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45, "debug": true, "http-listen-string": "127.0.0.1:31999"}`), 0600))
+	applied, pendingRestart, err := reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"debug", "sleep"}, applied)
+	assert.Equal(t, []string{"http-listen-string"}, pendingRestart)
+
+	assert.Equal(t, 45, viper.GetInt("sleep"))
+	assert.Equal(t, 45, playbooks[0].Interval)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	assert.Equal(t, "127.0.0.1:31836", viper.GetString("http-listen-string"))
+	scheduler := schedules.schedulers[defaultScheduleName]
+	scheduler.mutex.Lock()
+	assert.Equal(t, 45*time.Minute, scheduler.period)
+	scheduler.mutex.Unlock()
+	assert.Empty(t, configHashes.fileStale)
+
+	status := reloadStatus()
+	assert.NotNil(t, status.LastReloadTime)
+	assert.Empty(t, status.Error)
+	assert.Equal(t, []string{"http-listen-string"}, status.PendingRestart)
+
+	// Playbooks replace the default schedule
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45, "playbooks": [{"name": "base", "playbook": "base.yml"}]}`), 0600))
+	applied, pendingRestart, err = reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"debug", "playbooks"}, applied)
+	assert.Equal(t, []string{"http-listen-string"}, pendingRestart)
+	assert.Equal(t, logrus.InfoLevel, logrus.GetLevel())
+	assert.Contains(t, schedules.schedulers, "base")
+	assert.NotContains(t, schedules.schedulers, defaultScheduleName)
+}
+
+func TestReloadConfigInvalid(t *testing.T) {
+	configFile := withReloadableConfig(t, `{"sleep": 30}`)
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45, "schedule-cron": "61 * * * *"}`), 0600))
+	_, _, err := reloadConfig()
+	assert.Contains(t, err.Error(), "invalid configuration")
+	assert.Equal(t, 30, viper.GetInt("sleep"))
+	assert.Equal(t, 30, playbooks[0].Interval)
+	assert.Empty(t, viper.GetString("schedule-cron"))
+	assert.Nil(t, reloadStatus().LastReloadTime)
+	assert.Equal(t, err.Error(), reloadStatus().Error)
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": `), 0600))
+	_, _, err = reloadConfig()
+	assert.Contains(t, err.Error(), "unable to read")
+
+	// Once the config file is fixed, the settings that were rejected apply
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45, "schedule-cron": "@daily"}`), 0600))
+	applied, _, err := reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"schedule-cron", "sleep"}, applied)
+	assert.Equal(t, "@daily", playbooks[0].cron.String())
+	assert.Empty(t, reloadStatus().Error)
+}
+
+func TestHandlerReload(t *testing.T) {
+	configFile := withReloadableConfig(t, `{"sleep": 30}`)
+
+	req, _ := http.NewRequest("POST", httpPathReload, strings.NewReader(""))
+	rr := httptest.NewRecorder()
+	HandlerReload(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"last_reload_time":"`)
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": -5}`), 0600))
+	rr = httptest.NewRecorder()
+	HandlerReload(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestReloadConfigWaitsForRuns(t *testing.T) {
+	configFile := withReloadableConfig(t, `{"sleep": 30}`)
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`{"sleep": 45}`), 0600))
+
+	resume := runsLock.pause()
+	reloaded := make(chan error)
+	go func() {
+		_, _, err := reloadConfig()
+		reloaded <- err
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded while a run executes")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 30, viper.GetInt("sleep"))
+
+	resume()
+	assert.Nil(t, <-reloaded)
+	assert.Equal(t, 45, viper.GetInt("sleep"))
+}
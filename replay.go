@@ -0,0 +1,166 @@
+// Replaying a past run with the artifact version, tags and run context it had, to debug regressions
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// replayRequest holds the optional overrides accepted by HandlerReplay.
+type replayRequest struct {
+	CheckMode *bool `json:"check_mode"` // Defaults to the check mode of the replayed run
+}
+
+// artifactUnavailableError is returned when the artifact of a replayed run is neither kept locally nor can be
+// retrieved again.
+type artifactUnavailableError struct {
+	error
+}
+
+// replayArtifact copies the artifact with the given MD5 to a new temporary file, from the local copy of the
+// artifact, the applied or fetched artifact or the artifact cache. Failing that, an artifact pulled from git-url
+// is archived again from the commit it was built from.
+func replayArtifact(version, commit string) (string, error) {
+	file, err := ioutil.TempFile("", appName+"-replay")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	path := file.Name()
+
+	if err := copyReplayArtifact(version, commit, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+func copyReplayArtifact(version, commit, path string) error {
+	for _, kept := range []string{localCacheFile, appliedArtifactPath(), fetchedArtifactFile()} {
+		if sum, err := md5sum(kept); err == nil && sum == version {
+			return errors.Wrap(copyFileAtomic(kept, path), "unable to copy the artifact")
+		}
+	}
+	if artifacts.restore(version, path) {
+		return nil
+	}
+
+	downloader, remotePath, err := artifactDownloader()
+	git, ok := downloader.(gitDownloader)
+	if err != nil || !ok || commit == "" {
+		return artifactUnavailableError{errors.Errorf("artifact %s is no longer kept locally", version)}
+	}
+	logrus.Infof("Artifact %s is no longer kept locally, archiving commit %s again", version, commit)
+	git.ref = commit
+	if err := git.Download(remotePath, path); err != nil {
+		return errors.Wrapf(err, "unable to retrieve commit %s", commit)
+	}
+	if sum, err := md5sum(path); err == nil && sum != version {
+		logrus.Warnf("Artifact archived again from commit %s is %s rather than %s, its content is the same", commit, sum, version)
+	}
+	return nil
+}
+
+// HandlerReplay queues a run that executes a past run again: with the same artifact version, playbook, inventory,
+// tags, limit and check mode, and the run context it passed to the playbook. Only runs that got as far as running
+// Ansible can be replayed.
+//
+// It responds like HandlerRun, with the version of the artifact that is replayed.
+func HandlerReplay(w http.ResponseWriter, r *http.Request) {
+	if ansibleDisabled {
+		http.Error(w, "ansible puller is disabled", http.StatusConflict)
+		return
+	}
+	if err := checkChangeWindow(); err != nil {
+		http.Error(w, "refused by change management: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err := checkBlackout(); err != nil {
+		http.Error(w, "refused: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	var request replayRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	record := runs.get(mux.Vars(r)["id"])
+	if record == nil {
+		http.Error(w, "unknown run", http.StatusNotFound)
+		return
+	}
+	if record.Context == nil {
+		http.Error(w, fmt.Sprintf("run %s did not get as far as running Ansible, there is nothing to replay", record.ID), http.StatusConflict)
+		return
+	}
+	checkMode := record.CheckMode
+	if request.CheckMode != nil {
+		checkMode = *request.CheckMode
+	}
+	version := record.Context.ArtifactVersion
+	if pin := currentPin(); pin != nil && pin.Version != version && !checkMode {
+		http.Error(w, "pinned to artifact "+pin.Version+", unpin first or replay in check mode", http.StatusConflict)
+		return
+	}
+	if err := runQuotas.allow(runSourceAPI); err != nil {
+		httpQuotaExceeded(w, err)
+		return
+	}
+
+	artifact, err := replayArtifact(version, record.Context.ArtifactCommit)
+	if _, ok := err.(artifactUnavailableError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	spec := runSpec{
+		ID:            uuid.NewV4().String(),
+		Name:          record.Name,
+		Playbook:      record.Playbook,
+		Inventory:     record.Inventory,
+		Tags:          record.Tags,
+		SkipTags:      record.SkipTags,
+		Limit:         record.Limit,
+		CheckMode:     checkMode,
+		Trigger:       runTriggerReplay,
+		Artifact:      artifact,
+		Replays:       record.ID,
+		ReplayContext: record.Context,
+	}
+	logrus.Infof("Replaying run %s of artifact %s as run %s", record.ID, version, spec.ID)
+	startRun(spec)
+
+	data, err := json.Marshal(map[string]string{
+		"run_id":     spec.ID,
+		"status":     runStatusQueued,
+		"status_url": strings.Replace(httpPathRunStatus, "{id}", spec.ID, 1),
+		"version":    version,
+		"replay_of":  record.ID,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayArtifact(t *testing.T) {
+	withPinState(t)
+	defer withArtifactCache(t, 3, 0)()
+
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("replayed"), 0644))
+	version, err := md5sum(localCacheFile)
+	assert.Nil(t, err)
+	assert.Nil(t, artifacts.store(localCacheFile))
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("newer"), 0644))
+
+	path, err := replayArtifact(version, "")
+	assert.Nil(t, err)
+	defer os.Remove(path)
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "replayed", string(content))
+
+	_, err = replayArtifact("0123456789abcdef0123456789abcdef", "")
+	assert.IsType(t, artifactUnavailableError{}, err)
+}
+
+func TestRunContextReplay(t *testing.T) {
+	replayed := runContextVars{
+		RunID:             "replayed",
+		Trigger:           runTriggerSchedule,
+		Schedule:          defaultScheduleName,
+		ArtifactCommit:    "0123456789abcdef0123456789abcdef01234567",
+		Cloud:             map[string]interface{}{"region": "eu-west-1"},
+		Labels:            map[string]string{"role": "web"},
+		MaxFailPercentage: 20,
+	}
+
+	context := runContext(runSpec{ID: "replay", Trigger: runTriggerReplay, ReplayContext: &replayed, Labels: replayed.Labels})
+	assert.Equal(t, "replay", context.RunID)
+	assert.Equal(t, runTriggerReplay, context.Trigger)
+	assert.Equal(t, defaultScheduleName, context.Schedule)
+	assert.Equal(t, replayed.ArtifactCommit, context.ArtifactCommit)
+	assert.Equal(t, replayed.Cloud, context.Cloud)
+	assert.Equal(t, replayed.Labels, context.Labels)
+	assert.Equal(t, 20, context.MaxFailPercentage)
+}
+
+func TestHandlerReplay(t *testing.T) {
+	withPinState(t)
+	defer withArtifactCache(t, 3, 0)()
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+	originalRuns := runs
+	runs = newRunRegistry(10)
+	defer func() { runs = originalRuns }()
+
+	router := mux.NewRouter()
+	router.HandleFunc(httpPathRunReplay, HandlerReplay).Methods("POST")
+	replay := func(id, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", strings.Replace(httpPathRunReplay, "{id}", id, 1), strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusNotFound, replay("unknown", "").Code)
+
+	runs.queued(runSpec{ID: "failed-early"})
+	runs.finished("failed-early", runOutcome{ExitCode: -1})
+	rr := replay("failed-early", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "nothing to replay")
+
+	runs.queued(runSpec{ID: "evicted"})
+	runs.finished("evicted", runOutcome{Context: &runContextVars{ArtifactVersion: "0123456789abcdef0123456789abcdef"}})
+	rr = replay("evicted", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "no longer kept locally")
+
+	assert.Equal(t, http.StatusBadRequest, replay("evicted", `{"tags": ["web"]}`).Code)
+}
@@ -0,0 +1,264 @@
+// Typed reports of ansible-playbook runs, built from the output of the json stdout callback
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ansibleJSONPlay is a play in the output of Ansible's json stdout callback.
+type ansibleJSONPlay struct {
+	Play struct {
+		Name     string              `json:"name"`
+		Duration ansibleJSONDuration `json:"duration"`
+	} `json:"play"`
+	Tasks []struct {
+		Task struct {
+			Name     string              `json:"name"`
+			Duration ansibleJSONDuration `json:"duration"`
+		} `json:"task"`
+		Hosts map[string]ansibleJSONHostResult `json:"hosts"`
+	} `json:"tasks"`
+}
+
+// ansibleJSONDuration holds the timestamps of a play or task, kept as strings so a format change cannot
+// break parsing of the whole output.
+type ansibleJSONDuration struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (d ansibleJSONDuration) times() (time.Time, time.Time) {
+	start, _ := time.Parse(time.RFC3339Nano, d.Start)
+	end, _ := time.Parse(time.RFC3339Nano, d.End)
+	return start, end
+}
+
+type ansibleJSONHostResult struct {
+	Changed     bool            `json:"changed"`
+	Failed      bool            `json:"failed"`
+	Skipped     bool            `json:"skipped"`
+	Unreachable bool            `json:"unreachable"`
+	Action      string          `json:"action"` // Module of the task, e.g. ansible.builtin.apt
+	Msg         json.RawMessage `json:"msg"`    // Usually a string, but modules may return anything
+	TimedOut    json.RawMessage `json:"timedout"`
+	Diff        json.RawMessage `json:"diff"` // Set with --diff, a before and after or a list of them
+}
+
+// timedOut reports whether the task was terminated for exceeding its timeout. Ansible sets timedout since 2.14,
+// older versions only say so in the message.
+func (r ansibleJSONHostResult) timedOut() bool {
+	if len(r.TimedOut) > 0 && string(r.TimedOut) != "null" && string(r.TimedOut) != "false" {
+		return true
+	}
+
+	return r.Failed && strings.Contains(r.message(), "failed to execute in the expected time frame")
+}
+
+func (r ansibleJSONHostResult) status() string {
+	switch {
+	case r.Unreachable:
+		return "unreachable"
+	case r.Failed:
+		return "failed"
+	case r.Skipped:
+		return "skipped"
+	case r.Changed:
+		return "changed"
+	}
+	return "ok"
+}
+
+// hasDiff reports whether the result holds a diff, which Ansible leaves out or empty for tasks without one.
+func (r ansibleJSONHostResult) hasDiff() bool {
+	switch strings.TrimSpace(string(r.Diff)) {
+	case "", "null", "{}", "[]":
+		return false
+	}
+	return true
+}
+
+func (r ansibleJSONHostResult) message() string {
+	var msg string
+	if json.Unmarshal(r.Msg, &msg) == nil {
+		return msg
+	}
+	return string(r.Msg)
+}
+
+// RunReport is the typed result of an ansible-playbook run.
+type RunReport struct {
+	RunID     string                       `json:"run_id"`
+	Playbook  string                       `json:"playbook"`
+	Success   bool                         `json:"success"`
+	ExitCode  int                          `json:"exit_code"`
+	StartTime time.Time                    `json:"start_time"`
+	EndTime   time.Time                    `json:"end_time"`
+	Hosts     map[string]AnsibleNodeStatus `json:"hosts"` // Play recap per host
+	Tasks     []TaskReport                 `json:"tasks"`
+}
+
+// TaskReport is the result of one task of a run.
+type TaskReport struct {
+	Play            string            `json:"play"`
+	Name            string            `json:"name"`
+	Module          string            `json:"module,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Hosts           map[string]string `json:"hosts"`              // ok, changed, failed, skipped or unreachable per host
+	Messages        map[string]string `json:"messages,omitempty"` // Messages of the hosts the task failed on
+	TimedOut        bool              `json:"timed_out"`          // Whether the task exceeded its timeout on any host
+
+	// Diffs of the hosts the task changed, for runs with --diff
+	Diffs map[string]json.RawMessage `json:"diffs,omitempty"`
+}
+
+// newRunReport builds the report of a finished run from its parsed output.
+func newRunReport(output AnsibleRunOutput) RunReport {
+	report := RunReport{
+		ExitCode: output.CommandOutput.Exitcode,
+		Hosts:    output.Stats,
+		Tasks:    []TaskReport{},
+	}
+	if report.Hosts == nil {
+		report.Hosts = map[string]AnsibleNodeStatus{}
+	}
+
+	for _, play := range output.Plays {
+		start, end := play.Play.Duration.times()
+		if report.StartTime.IsZero() || (!start.IsZero() && start.Before(report.StartTime)) {
+			report.StartTime = start
+		}
+		if end.After(report.EndTime) {
+			report.EndTime = end
+		}
+
+		for _, task := range play.Tasks {
+			taskReport := TaskReport{
+				Play:  play.Play.Name,
+				Name:  task.Task.Name,
+				Hosts: map[string]string{},
+			}
+			if start, end := task.Task.Duration.times(); !start.IsZero() && !end.IsZero() {
+				taskReport.DurationSeconds = end.Sub(start).Seconds()
+			}
+
+			for host, result := range task.Hosts {
+				if taskReport.Module == "" {
+					taskReport.Module = result.Action
+				}
+				status := result.status()
+				taskReport.Hosts[host] = status
+				if status == "failed" || status == "unreachable" {
+					if taskReport.Messages == nil {
+						taskReport.Messages = map[string]string{}
+					}
+					taskReport.Messages[host] = result.message()
+				}
+				if result.timedOut() {
+					taskReport.TimedOut = true
+				}
+				if status == "changed" && result.hasDiff() {
+					if taskReport.Diffs == nil {
+						taskReport.Diffs = map[string]json.RawMessage{}
+					}
+					taskReport.Diffs[host] = result.Diff
+				}
+			}
+
+			report.Tasks = append(report.Tasks, taskReport)
+		}
+	}
+
+	return report
+}
+
+// failedTasks returns the number of tasks that failed or were unreachable on any host.
+func (r RunReport) failedTasks() int {
+	return r.countTasks("failed", "unreachable")
+}
+
+// timedOutTasks returns the names of the tasks that exceeded their timeout on any host.
+func (r RunReport) timedOutTasks() []string {
+	var names []string
+	for _, task := range r.Tasks {
+		if task.TimedOut {
+			names = append(names, task.Name)
+		}
+	}
+
+	return names
+}
+
+// failedHosts returns the hosts of the play recap that failed or were unreachable, sorted.
+func (r RunReport) failedHosts() []string {
+	hosts := []string{}
+	for host, status := range r.Hosts {
+		if status.Failures > 0 || status.Unreachable > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+// totals returns the play recap summed over all hosts.
+func (r RunReport) totals() AnsibleNodeStatus {
+	var totals AnsibleNodeStatus
+	for _, status := range r.Hosts {
+		totals.Changed += status.Changed
+		totals.Failures += status.Failures
+		totals.Ok += status.Ok
+		totals.Skipped += status.Skipped
+		totals.Unreachable += status.Unreachable
+	}
+
+	return totals
+}
+
+// changedTasks returns the number of tasks that changed any host.
+func (r RunReport) changedTasks() int {
+	return r.countTasks("changed")
+}
+
+// countTasks returns the number of tasks with any of statuses on any host.
+func (r RunReport) countTasks(statuses ...string) int {
+	count := 0
+	for _, task := range r.Tasks {
+	hosts:
+		for _, status := range task.Hosts {
+			for _, s := range statuses {
+				if status == s {
+					count++
+					break hosts
+				}
+			}
+		}
+	}
+
+	return count
+}
+
+var (
+	runReportMutex sync.Mutex
+	lastRunReport  *RunReport
+)
+
+func setLastRunReport(report RunReport) {
+	runReportMutex.Lock()
+	defer runReportMutex.Unlock()
+
+	lastRunReport = &report
+}
+
+// getLastRunReport returns the report of the last run that got as far as running Ansible, if any.
+func getLastRunReport() *RunReport {
+	runReportMutex.Lock()
+	defer runReportMutex.Unlock()
+
+	return lastRunReport
+}
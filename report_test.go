@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestRunOutput(t *testing.T) AnsibleRunOutput {
+	content, err := ioutil.ReadFile("testdata/ansible-json-output.json")
+	assert.Nil(t, err)
+
+	var output AnsibleRunOutput
+	assert.Nil(t, json.Unmarshal(content, &output))
+	output.CommandOutput.Exitcode = 2
+
+	return output
+}
+
+func TestNewRunReport(t *testing.T) {
+	report := newRunReport(loadTestRunOutput(t))
+
+	assert.Equal(t, 2, report.ExitCode)
+	assert.Equal(t, AnsibleNodeStatus{Changed: 1, Failures: 1, Ok: 2}, report.Hosts["localhost"])
+	assert.Equal(t, time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC), report.StartTime)
+	assert.Equal(t, time.Date(2021, 3, 4, 10, 0, 12, 500000000, time.UTC), report.EndTime)
+
+	assert.Len(t, report.Tasks, 3)
+	assert.Equal(t, "Configure hosts", report.Tasks[1].Play)
+	assert.Equal(t, "Install packages", report.Tasks[1].Name)
+	assert.Equal(t, 8.0, report.Tasks[1].DurationSeconds)
+	assert.Equal(t, map[string]string{"localhost": "changed"}, report.Tasks[1].Hosts)
+	assert.Nil(t, report.Tasks[1].Messages)
+
+	assert.Equal(t, "apt", report.Tasks[1].Module)
+
+	assert.Equal(t, map[string]string{"localhost": "failed"}, report.Tasks[2].Hosts)
+	assert.Equal(t, "Could not find the requested service puller: host", report.Tasks[2].Messages["localhost"])
+	assert.Equal(t, 1, report.failedTasks())
+}
+
+func TestNewRunReportWithoutOutput(t *testing.T) {
+	report := newRunReport(AnsibleRunOutput{})
+
+	assert.NotNil(t, report.Hosts)
+	assert.Empty(t, report.Tasks)
+	assert.Equal(t, 0, report.failedTasks())
+}
+
+func TestRunReportTimedOutTasks(t *testing.T) {
+	var output AnsibleRunOutput
+	assert.Nil(t, json.Unmarshal([]byte(`{"plays": [{"play": {"name": "Configure hosts"}, "tasks": [
+		{"task": {"name": "Update cache"}, "hosts": {"localhost": {"failed": true, "timedout": {"frame": "...", "period": 60},
+			"msg": "The apt action failed to execute in the expected time frame (60) and was terminated"}}},
+		{"task": {"name": "Install packages"}, "hosts": {"localhost": {"failed": true,
+			"msg": "The apt action failed to execute in the expected time frame (60) and was terminated"}}},
+		{"task": {"name": "Start service"}, "hosts": {"localhost": {"failed": true, "msg": "Could not find the requested service"}}}
+	]}]}`), &output))
+
+	report := newRunReport(output)
+	assert.Equal(t, []string{"Update cache", "Install packages"}, report.timedOutTasks())
+	assert.Equal(t, 3, report.failedTasks())
+}
@@ -0,0 +1,105 @@
+// Guardrails skipping runs while the host is low on disk space or memory, rather than starting runs that would fail
+// midway and make matters worse
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Resources runs are skipped for, as labelled in promLowResourceSkips
+const (
+	resourceDisk   = "disk"
+	resourceMemory = "memory"
+)
+
+// lowResourceError is the reason a run is not started: the host is short of resource.
+type lowResourceError struct {
+	resource string
+	err      error
+}
+
+func (e lowResourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e lowResourceError) Unwrap() error {
+	return e.err
+}
+
+// runSkippedEvent is the data of a run.skipped event.
+type runSkippedEvent struct {
+	Trigger  string `json:"trigger"`
+	Resource string `json:"resource"`
+	Reason   string `json:"reason"`
+}
+
+// checkResources returns a lowResourceError if less disk space than min-free-disk or less memory than
+// min-available-memory is available, or the puller takes more than disk-quota, or another error if any of them
+// can't be checked.
+func checkResources() error {
+	if err := checkFreeDisk(); err != nil {
+		return err
+	}
+	if err := checkDiskQuota(); err != nil {
+		return err
+	}
+	return checkAvailableMemory()
+}
+
+// checkAvailableMemory returns a lowResourceError if less than min-available-memory megabytes of memory are
+// available.
+func checkAvailableMemory() error {
+	minAvailable := uint64(viper.GetInt("min-available-memory")) * 1024 * 1024
+	if minAvailable == 0 {
+		return nil
+	}
+
+	available, err := availableMemory()
+	if err == errMemoryUnsupported {
+		logrus.Debugln("Available memory can't be checked on this platform, ignoring min-available-memory")
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to check the available memory")
+	}
+	if available < minAvailable {
+		return lowResourceError{resourceMemory, errors.Errorf("only %d MB of memory available, below "+
+			"min-available-memory of %d MB", available/1024/1024, minAvailable/1024/1024)}
+	}
+
+	return nil
+}
+
+var errMemoryUnsupported = errors.New("available memory is not supported on this platform")
+
+// parseMemAvailable returns the bytes of MemAvailable in the contents of /proc/meminfo.
+func parseMemAvailable(meminfo []byte) (uint64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(meminfo))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kB, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid MemAvailable")
+		}
+		return kB * 1024, nil
+	}
+
+	return 0, errors.New("no MemAvailable in /proc/meminfo")
+}
+
+// skipForResources records a run of trigger skipped because of err.
+func skipForResources(trigger string, err lowResourceError) {
+	promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+	promLowResourceSkips.WithLabelValues(err.resource).Inc()
+	emitEvent(eventRunSkipped, runSkippedEvent{Trigger: trigger, Resource: err.resource, Reason: err.Error()})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemAvailable(t *testing.T) {
+	available, err := parseMemAvailable([]byte("MemTotal:       16318884 kB\nMemFree:          512000 kB\n" +
+		"MemAvailable:    2048000 kB\nBuffers:          102400 kB\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2048000*1024), available)
+
+	_, err = parseMemAvailable([]byte("MemTotal:       16318884 kB\n"))
+	assert.NotNil(t, err)
+}
+
+func TestCheckAvailableMemory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("available memory is only checked on Linux")
+	}
+	original := viper.Get("min-available-memory")
+	defer viper.Set("min-available-memory", original)
+
+	viper.Set("min-available-memory", 1)
+	assert.Nil(t, checkResources())
+
+	// More than any host has
+	viper.Set("min-available-memory", 1<<40)
+	var lowResource lowResourceError
+	err := checkResources()
+	assert.True(t, errors.As(err, &lowResource))
+	assert.Equal(t, resourceMemory, lowResource.resource)
+	assert.Contains(t, err.Error(), "below min-available-memory")
+}
+
+func TestRunRefusedLowOnDisk(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	original, originalDisabled := viper.Get("min-free-disk"), ansibleDisabled
+	defer func() {
+		viper.Set("min-free-disk", original)
+		ansibleDisabled = originalDisabled
+	}()
+	ansibleDisabled = false
+
+	viper.Set("min-free-disk", 1<<40)
+	var lowResource lowResourceError
+	assert.True(t, errors.As(checkResources(), &lowResource))
+	assert.Equal(t, resourceDisk, lowResource.resource)
+
+	rr := serveAPI("POST", httpPathRun, "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "below min-free-disk")
+}
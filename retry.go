@@ -0,0 +1,186 @@
+// Retries of operations that fail transiently, e.g. downloads interrupted by a network blip
+
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Operations that are retried, as labelled in promRetries
+const (
+	retryOperationDownload   = "download"
+	retryOperationVenvUpdate = "venv_update"
+	retryOperationGalaxy     = "galaxy"
+	retryOperationPlaybook   = "playbook"
+
+	// Runs that failed on a package manager lock, retried once it is released
+	retryOperationPackageLock = "package_lock"
+)
+
+var retryOperations = []string{retryOperationDownload, retryOperationVenvUpdate, retryOperationGalaxy,
+	retryOperationPlaybook, retryOperationPackageLock}
+
+// Output of pip and ansible-galaxy showing that the package index or galaxy server could not be reached
+var transientOutputPattern = regexp.MustCompile(`(?i)(ReadTimeoutError|ConnectTimeoutError|NewConnectionError|` +
+	`Max retries exceeded|Connection (reset|refused|aborted)|Temporary failure in name resolution|` +
+	`(Read|Connection) timed out|HTTP Error (429|5\d\d)|5\d\d Server Error|Service Unavailable|` +
+	`Bad Gateway|Gateway Time-?out|Too Many Requests)`)
+
+// retryPolicy is how often and how far apart an operation is attempted.
+type retryPolicy struct {
+	MaxAttempts int           // Including the first attempt
+	Backoff     time.Duration // Before the second attempt, doubled for each further one
+	MaxBackoff  time.Duration
+
+	sleep func(time.Duration) // Replaced in tests
+	rng   *rand.Rand
+}
+
+// retryPolicyFromConfig returns the policy set by the "retry-*" options.
+func retryPolicyFromConfig() retryPolicy {
+	return retryPolicy{
+		MaxAttempts: viper.GetInt("retry-max-attempts"),
+		Backoff:     time.Duration(viper.GetInt("retry-backoff")) * time.Second,
+		MaxBackoff:  time.Duration(viper.GetInt("retry-max-backoff")) * time.Second,
+		sleep:       time.Sleep,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// transientError marks an error as worth retrying.
+type transientError struct {
+	error
+}
+
+func (transientError) Transient() bool {
+	return true
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// commandFailure returns the error of a failed command, marked as transient if its output shows a network failure.
+func commandFailure(output VenvCommandRunOutput) error {
+	var timeout timeoutError
+	if output.Error == nil || errors.As(output.Error, &timeout) {
+		return output.Error
+	}
+	if transientOutputPattern.MatchString(output.Stderr) || transientOutputPattern.MatchString(output.Stdout) {
+		return transientError{output.Error}
+	}
+
+	return output.Error
+}
+
+// isTransient returns whether err may go away by itself: timeouts and failures to connect, server errors, rate
+// limits, connections dropped halfway through a download, and commands that failed because of them.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var marked interface{ Transient() bool }
+	if errors.As(err, &marked) {
+		return marked.Transient()
+	}
+	// Commands are killed after their timeout, which would only be waited for again
+	var commandTimeout timeoutError
+	if errors.As(err, &commandTimeout) {
+		return false
+	}
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		code := status.HTTPStatusCode()
+		return code >= 500 || code == 429 || code == 408
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// Names that don't exist and e.g. refused TLS handshakes stay that way
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	// Servers closing the connection before the response
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && errors.Is(urlErr, io.EOF) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Errors of network calls that fail while the network or the server is briefly gone
+var transientErrnos = []error{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.ENETUNREACH,
+	syscall.EHOSTUNREACH, syscall.ETIMEDOUT, syscall.EPIPE}
+
+// playbookRetryError returns the error of an ansible-playbook run to retry it on, marked as transient, or nil if
+// it isn't retried. Runs are retried when the host couldn't be reached, except in controller mode, where one host
+// being down would run the playbook against all of them again.
+func playbookRetryError(output AnsibleRunOutput, err error) error {
+	if err == nil || output.CommandOutput.Exitcode != unreachableExitCode || controllerMode() {
+		return nil
+	}
+	return transientError{err}
+}
+
+// backoff returns how long to wait after the given failed attempt: the backoff doubled for each earlier attempt, up
+// to the maximum, of which a random half is taken off so hosts failing together do not retry together.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 || p.rng == nil {
+		return wait
+	}
+
+	return wait/2 + time.Duration(p.rng.Int63n(int64(wait/2)+1))
+}
+
+// do runs fn until it succeeds, fails with an error that is not transient, or the attempts are used up.
+func (p retryPolicy) do(operation string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			if attempt > 1 {
+				logrus.Warnf("%s failed permanently after %d attempts, not retrying", operation, attempt)
+			}
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return errors.Wrapf(err, "%s failed transiently %d times", operation, attempt)
+		}
+
+		wait := p.backoff(attempt)
+		logrus.Warnf("%s failed transiently (attempt %d of %d), retrying in %s: %v", operation, attempt, p.MaxAttempts, wait, err)
+		promRetries.WithLabelValues(operation).Inc()
+		p.sleep(wait)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRetryPolicy(maxAttempts int, sleeps *[]time.Duration) retryPolicy {
+	return retryPolicy{
+		MaxAttempts: maxAttempts,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+		sleep:       func(d time.Duration) { *sleeps = append(*sleeps, d) },
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, err := range []error{
+		statusCodeError{503},
+		statusCodeError{429},
+		errors.Wrap(statusCodeError{502}, "unable to pull Ansible repo"),
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		&net.DNSError{Err: "server misbehaving", Name: "artifacts.example.com", IsTemporary: true},
+		&url.Error{Op: "Get", URL: "https://artifacts.example.com/site.tgz", Err: io.EOF},
+		io.ErrUnexpectedEOF,
+		commandFailure(VenvCommandRunOutput{Error: errors.New("exit status 1"), Stderr: "ReadTimeoutError: HTTPSConnectionPool(host='pypi.org', port=443): Read timed out."}),
+		commandFailure(VenvCommandRunOutput{Error: errors.New("exit status 1"), Stderr: "ERROR! Unexpected HTTP Error 503 Service Unavailable"}),
+	} {
+		assert.True(t, isTransient(err), err.Error())
+	}
+
+	for _, err := range []error{
+		nil,
+		errors.New("no such file or directory"),
+		&net.DNSError{Err: "no such host", Name: "artifacts.example.com", IsNotFound: true},
+		&net.OpError{Op: "remote error", Net: "tcp", Err: errors.New("tls: bad certificate")},
+		errors.Wrap(io.EOF, "unable to parse the manifest"),
+		&exec.Error{Name: "ansible-galaxy", Err: exec.ErrNotFound},
+		statusCodeError{404},
+		statusCodeError{403},
+		timeoutError{errors.New("signal: killed")},
+		commandFailure(VenvCommandRunOutput{Error: errors.New("exit status 1"), Stderr: "ERROR: No matching distribution found for ansible-core==9.99"}),
+		commandFailure(VenvCommandRunOutput{Error: timeoutError{errors.New("signal: killed")}, Stderr: "Read timed out."}),
+		commandFailure(VenvCommandRunOutput{Error: errors.New("exit status 2"), Stderr: "fatal: [localhost]: FAILED! => {\"msg\": \"Timeout when waiting for the lock, timed out\"}"}),
+	} {
+		assert.False(t, isTransient(err), "%v", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+	assert.Equal(t, 10*time.Second, policy.backoff(1))
+	assert.Equal(t, 20*time.Second, policy.backoff(2))
+	assert.Equal(t, 40*time.Second, policy.backoff(3))
+	assert.Equal(t, time.Minute, policy.backoff(4))
+	assert.Equal(t, time.Minute, policy.backoff(100))
+
+	policy = retryPolicyFromConfig()
+	policy.Backoff, policy.MaxBackoff = 10*time.Second, time.Minute
+	for i := 0; i < 100; i++ {
+		wait := policy.backoff(2)
+		assert.True(t, wait >= 10*time.Second && wait <= 20*time.Second, wait.String())
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var sleeps []time.Duration
+	attempts := 0
+	err := testRetryPolicy(3, &sleeps).do(retryOperationDownload, func() error {
+		attempts++
+		if attempts < 3 {
+			return statusCodeError{503}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+
+	// Permanent failures are not retried
+	sleeps, attempts = nil, 0
+	err = testRetryPolicy(3, &sleeps).do(retryOperationDownload, func() error {
+		attempts++
+		return statusCodeError{404}
+	})
+	assert.Equal(t, statusCodeError{404}, err)
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, sleeps)
+
+	// Once the attempts are used up, the failure is still reported as transient
+	sleeps, attempts = nil, 0
+	err = testRetryPolicy(2, &sleeps).do(retryOperationDownload, func() error {
+		attempts++
+		return statusCodeError{503}
+	})
+	assert.Equal(t, 2, attempts)
+	assert.Contains(t, err.Error(), "download failed transiently 2 times")
+	assert.Equal(t, runOutcomeTransient, runOutcomeOf(err))
+
+	// A single attempt disables retries
+	sleeps, attempts = nil, 0
+	err = testRetryPolicy(1, &sleeps).do(retryOperationDownload, func() error {
+		attempts++
+		return statusCodeError{503}
+	})
+	assert.Equal(t, statusCodeError{503}, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryDownloadAfterServerError(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("artifact"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "artifact.tgz")
+	var sleeps []time.Duration
+	err := testRetryPolicy(3, &sleeps).do(retryOperationDownload, func() error {
+		return httpDownloader{}.Download(server.URL+"/artifact.tgz", path)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "artifact", string(data))
+}
+
+func TestPlaybookRetryError(t *testing.T) {
+	withSettings(t, map[string]interface{}{"ansible-controller": false})
+	failed := errors.New("ansible run failed: exit status 4")
+	unreachable := AnsibleRunOutput{CommandOutput: VenvCommandRunOutput{Exitcode: unreachableExitCode}}
+
+	// Runs that couldn't reach the host are retried until they reach it
+	var sleeps []time.Duration
+	attempts := 0
+	var runErr error
+	testRetryPolicy(3, &sleeps).do(retryOperationPlaybook, func() error {
+		attempts++
+		output, err := unreachable, failed
+		if attempts == 2 {
+			output, err = AnsibleRunOutput{}, nil
+		}
+		runErr = err
+		return playbookRetryError(output, err)
+	})
+	assert.Nil(t, runErr)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []time.Duration{time.Second}, sleeps)
+
+	// Failed tasks aren't
+	assert.Nil(t, playbookRetryError(AnsibleRunOutput{CommandOutput: VenvCommandRunOutput{Exitcode: 2}}, failed))
+	assert.True(t, isTransient(playbookRetryError(unreachable, failed)))
+
+	// Nor are the runs of controllers, which would run against all their hosts again
+	viper.Set("ansible-controller", true)
+	assert.Nil(t, playbookRetryError(unreachable, failed))
+}
@@ -0,0 +1,97 @@
+// Fixed size buffer that keeps the most recent lines written to it
+
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// lineRingBuffer is an io.Writer that keeps the last capacity complete lines written to it.
+type lineRingBuffer struct {
+	mutex    sync.Mutex
+	lines    []string
+	next     int          // Index the next line will be stored at
+	full     bool         // Whether the buffer has wrapped around
+	partial  bytes.Buffer // Data following the last newline
+	capacity int
+}
+
+func newLineRingBuffer(capacity int) *lineRingBuffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &lineRingBuffer{
+		lines:    make([]string, capacity),
+		capacity: capacity,
+	}
+}
+
+func (b *lineRingBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	data := p
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			b.partial.Write(data)
+			break
+		}
+
+		b.partial.Write(data[:i])
+		b.push(b.partial.String())
+		b.partial.Reset()
+		data = data[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (b *lineRingBuffer) push(line string) {
+	b.lines[b.next] = toValidUTF8(line)
+	b.next = (b.next + 1) % b.capacity
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Tail returns up to n of the most recent lines, oldest first, including any unterminated last line.
+func (b *lineRingBuffer) Tail(n int) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	count := b.next
+	if b.full {
+		count = b.capacity
+	}
+
+	lines := make([]string, 0, count+1)
+	for i := count; i > 0; i-- {
+		lines = append(lines, b.lines[(b.next-i+b.capacity)%b.capacity])
+	}
+	if b.partial.Len() > 0 {
+		lines = append(lines, toValidUTF8(b.partial.String()))
+	}
+
+	if n < 0 {
+		n = 0
+	}
+	if n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+
+	return lines
+}
+
+// Reset discards all buffered lines.
+func (b *lineRingBuffer) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lines = make([]string, b.capacity)
+	b.next = 0
+	b.full = false
+	b.partial.Reset()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineRingBufferTail(t *testing.T) {
+	buffer := newLineRingBuffer(3)
+
+	_, err := io.WriteString(buffer, "one\ntwo\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two"}, buffer.Tail(10))
+	assert.Equal(t, []string{"two"}, buffer.Tail(1))
+	assert.Empty(t, buffer.Tail(0))
+}
+
+func TestLineRingBufferWrapsAround(t *testing.T) {
+	buffer := newLineRingBuffer(3)
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := io.WriteString(buffer, line)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, []string{"three", "four", "five"}, buffer.Tail(200))
+}
+
+func TestLineRingBufferPartialLines(t *testing.T) {
+	buffer := newLineRingBuffer(3)
+
+	_, _ = io.WriteString(buffer, "first li")
+	_, _ = io.WriteString(buffer, "ne\nsecond")
+	assert.Equal(t, []string{"first line", "second"}, buffer.Tail(5))
+
+	buffer.Reset()
+	assert.Empty(t, buffer.Tail(5))
+}
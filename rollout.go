@@ -0,0 +1,263 @@
+// Staged rollouts of new artifact versions across a fleet, gated by a rollout definition published next to the
+// artifact
+
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// rolloutRing is a stage of a rollout. A host is in the first ring that lists it or whose percentage is above its
+// bucket, so percentages grow from ring to ring.
+type rolloutRing struct {
+	Name       string   `json:"name"`
+	Percentage float64  `json:"percentage"` // Hosts with a bucket below this are in the ring, unless in an earlier one
+	Hosts      []string `json:"hosts"`      // Hosts in the ring whatever their bucket
+}
+
+// rolloutDefinition is the rollout file published next to the artifact.
+type rolloutDefinition struct {
+	Version    string        `json:"version"`     // MD5 of the artifact the rollout is for, any artifact if empty
+	Percentage *float64      `json:"percentage"`  // Share of hosts that adopt the artifact, unless rolled out in rings
+	Rings      []rolloutRing `json:"rings"`       // Stages of the rollout, in order
+	ActiveRing string        `json:"active_ring"` // Last ring that adopts the artifact, none if empty
+}
+
+// rolloutStatus is the last decision on adopting a new artifact version, as returned by the status endpoint.
+type rolloutStatus struct {
+	Version  string    `json:"version"`        // MD5 of the pulled artifact
+	Ring     string    `json:"ring,omitempty"` // Ring of this host, if rolled out in rings
+	Bucket   float64   `json:"bucket"`         // Position of this host in the fleet, from 0 to 100
+	Adopted  bool      `json:"adopted"`        // Whether the version is applied, or the applied version is kept
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+	heldBack bool
+}
+
+var (
+	rolloutMutex sync.Mutex
+	lastRollout  *rolloutStatus
+)
+
+// setupRollout validates the options of rollouts.
+func setupRollout() error {
+	if viper.GetString("rollout-file") != "" && viper.GetString("git-url") != "" {
+		return errors.New("rollout-file is not supported for git-url")
+	}
+	return nil
+}
+
+// getRollout returns a copy of the last rollout decision, nil if there was none.
+func getRollout() *rolloutStatus {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	if lastRollout == nil {
+		return nil
+	}
+	status := *lastRollout
+	return &status
+}
+
+func setRollout(status rolloutStatus) {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	status.Time = time.Now()
+	lastRollout = &status
+	if status.heldBack {
+		promRolloutHeldBack.Set(1)
+	} else {
+		promRolloutHeldBack.Set(0)
+	}
+}
+
+// rolloutBucket places host in the fleet, from 0 to 100 in steps of 0.01. It only depends on the host name, so the
+// same hosts go first in every rollout.
+func rolloutBucket(host string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	return float64(hash.Sum32()%10000) / 100
+}
+
+// ring returns the index of the ring of host with the given bucket, or len(d.Rings) if it is in none of them.
+// ringName, if not empty, places the host in the ring of that name instead.
+func (d rolloutDefinition) ring(host string, bucket float64, ringName string) int {
+	if ringName != "" {
+		for i, ring := range d.Rings {
+			if ring.Name == ringName {
+				return i
+			}
+		}
+	}
+	for i, ring := range d.Rings {
+		for _, ringHost := range ring.Hosts {
+			if ringHost == host {
+				return i
+			}
+		}
+	}
+	for i, ring := range d.Rings {
+		if bucket < ring.Percentage {
+			return i
+		}
+	}
+
+	return len(d.Rings)
+}
+
+// decide returns the status of adopting the artifact version on host. Hosts in no ring adopt it with the last ring.
+func (d rolloutDefinition) decide(version, host, ringName string) rolloutStatus {
+	status := rolloutStatus{Version: version, Bucket: rolloutBucket(host)}
+	if d.Version != "" && d.Version != version {
+		status.Reason = "the rollout is for version " + d.Version
+		return status
+	}
+
+	if len(d.Rings) == 0 {
+		if d.Percentage == nil {
+			status.Reason = "the rollout has neither a percentage nor rings"
+			return status
+		}
+		status.Adopted = status.Bucket < *d.Percentage
+		status.Reason = "bucket is not below the rollout percentage"
+		if status.Adopted {
+			status.Reason = "bucket is below the rollout percentage"
+		}
+		return status
+	}
+
+	active := -1
+	for i, ring := range d.Rings {
+		if ring.Name == d.ActiveRing {
+			active = i
+		}
+	}
+	ring := d.ring(host, status.Bucket, ringName)
+	if ring < len(d.Rings) {
+		status.Ring = d.Rings[ring].Name
+	} else {
+		ring = len(d.Rings) - 1
+	}
+	status.Adopted = ring <= active
+	status.Reason = "ring is not active yet"
+	if status.Adopted {
+		status.Reason = "ring is active"
+	}
+	return status
+}
+
+// rolloutRemotePath returns the remote path of the rollout file called name next to the artifact at remotePath.
+func rolloutRemotePath(remotePath, name string) string {
+	return remotePath[:strings.LastIndex(remotePath, "/")+1] + name
+}
+
+// fetchRolloutDefinition downloads and parses the rollout file published next to the artifact at remotePath.
+func fetchRolloutDefinition(downloader downloader, remotePath string) (rolloutDefinition, error) {
+	var definition rolloutDefinition
+
+	dir, err := ioutil.TempDir("", appName+"-rollout")
+	if err != nil {
+		return definition, errors.Wrap(err, "unable to create rollout directory")
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rollout.json")
+	err = retryPolicyFromConfig().do(retryOperationDownload, func() error {
+		return downloader.Download(rolloutRemotePath(remotePath, viper.GetString("rollout-file")), path)
+	})
+	if err != nil {
+		return definition, errors.Wrap(err, "unable to download the rollout file")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return definition, errors.Wrap(err, "unable to read the rollout file")
+	}
+	if err := json.Unmarshal(data, &definition); err != nil {
+		return definition, errors.Wrap(err, "unable to parse the rollout file")
+	}
+
+	return definition, nil
+}
+
+// rolloutFileMissing returns whether err is the source answering that there is no rollout file.
+func rolloutFileMissing(err error) bool {
+	var status interface{ HTTPStatusCode() int }
+	return errors.As(err, &status) && status.HTTPStatusCode() == http.StatusNotFound
+}
+
+// gateRollout decides whether the artifact just pulled to localCacheFile is adopted, as rollout-file defines. A
+// version the rollout doesn't include this host in yet is kept in the artifact cache and the applied artifact is
+// put back in its place, so that the run keeps the host on the applied version.
+//
+// Without an applied artifact there is nothing to keep, and the pulled artifact is adopted. Without a rollout file
+// the applied artifact is kept too, unless rollout-adopt-without-file is set: a deleted or misnamed rollout file must
+// not roll the new version out to every host at once.
+func gateRollout(downloader downloader, remotePath string) error {
+	if viper.GetString("rollout-file") == "" {
+		return nil
+	}
+
+	version, err := md5sum(localCacheFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to checksum the artifact")
+	}
+	applied, err := md5sum(appliedArtifactPath())
+	if os.IsNotExist(err) {
+		setRollout(rolloutStatus{Version: version, Bucket: rolloutBucket(hostname), Adopted: true,
+			Reason: "no artifact was applied yet"})
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to checksum the applied artifact")
+	}
+	if applied == version {
+		setRollout(rolloutStatus{Version: version, Bucket: rolloutBucket(hostname), Adopted: true,
+			Reason: "the version is applied already"})
+		return nil
+	}
+
+	definition, err := fetchRolloutDefinition(downloader, remotePath)
+	status := rolloutStatus{Version: version, Bucket: rolloutBucket(hostname)}
+	if rolloutFileMissing(err) {
+		promRolloutFileMissing.Inc()
+		status.Adopted = viper.GetBool("rollout-adopt-without-file")
+		status.Reason = "no rollout file is published"
+		if !status.Adopted {
+			downloaderLog.Warnf("No rollout file is published for %s, keeping the applied artifact", remotePath)
+		}
+	} else if err != nil {
+		status.Reason = err.Error()
+	} else {
+		status = definition.decide(version, hostname, viper.GetString("rollout-ring"))
+	}
+	if status.Adopted {
+		downloaderLog.Infof("Adopting artifact %s, %s", version, status.Reason)
+		setRollout(status)
+		return nil
+	}
+
+	downloaderLog.Infof("Keeping the applied artifact %s instead of %s, %s", applied, version, status.Reason)
+	if err := artifacts.store(localCacheFile); err != nil {
+		downloaderLog.Warnln("Unable to cache the held back artifact: ", err)
+	}
+	if err := copyFileAtomic(appliedArtifactPath(), localCacheFile); err != nil {
+		return errors.Wrap(err, "unable to restore the applied artifact")
+	}
+	// Versioned sources must compare the remote version against the held back artifact again
+	os.Remove(versionFile(localCacheFile))
+
+	status.heldBack = true
+	setRollout(status)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolloutBucket(t *testing.T) {
+	bucket := rolloutBucket("web-1.example.com")
+	assert.Equal(t, bucket, rolloutBucket("web-1.example.com"))
+	assert.True(t, bucket >= 0 && bucket < 100)
+	assert.NotEqual(t, bucket, rolloutBucket("web-2.example.com"))
+}
+
+func TestRolloutDecidePercentage(t *testing.T) {
+	bucket := rolloutBucket("web-1")
+	below, above := bucket+0.01, bucket
+
+	assert.True(t, rolloutDefinition{Percentage: &below}.decide("abc", "web-1", "").Adopted)
+	assert.False(t, rolloutDefinition{Percentage: &above}.decide("abc", "web-1", "").Adopted)
+	assert.False(t, rolloutDefinition{}.decide("abc", "web-1", "").Adopted)
+
+	// A rollout for another version holds back whatever its percentage
+	all := 100.0
+	status := rolloutDefinition{Version: "def", Percentage: &all}.decide("abc", "web-1", "")
+	assert.False(t, status.Adopted)
+	assert.Equal(t, "the rollout is for version def", status.Reason)
+}
+
+func TestRolloutDecideRings(t *testing.T) {
+	bucket := rolloutBucket("web-1")
+	definition := rolloutDefinition{
+		Rings: []rolloutRing{
+			{Name: "canary", Percentage: 0, Hosts: []string{"canary-1"}},
+			{Name: "early", Percentage: bucket + 0.01},
+			{Name: "late", Percentage: 100},
+		},
+		ActiveRing: "canary",
+	}
+
+	status := definition.decide("abc", "canary-1", "")
+	assert.True(t, status.Adopted)
+	assert.Equal(t, "canary", status.Ring)
+
+	status = definition.decide("abc", "web-1", "")
+	assert.False(t, status.Adopted)
+	assert.Equal(t, "early", status.Ring)
+	assert.Equal(t, "ring is not active yet", status.Reason)
+
+	// rollout-ring places the host in another ring than its bucket
+	assert.True(t, definition.decide("abc", "web-1", "canary").Adopted)
+
+	definition.ActiveRing = "early"
+	assert.True(t, definition.decide("abc", "web-1", "").Adopted)
+
+	// Hosts in no ring go with the last one
+	definition.Rings = definition.Rings[:2]
+	definition.Rings[1].Percentage = 0
+	status = definition.decide("abc", "web-1", "")
+	assert.True(t, status.Adopted)
+	assert.Equal(t, "", status.Ring)
+	definition.ActiveRing = "canary"
+	assert.False(t, definition.decide("abc", "web-1", "").Adopted)
+}
+
+func TestRolloutRemotePath(t *testing.T) {
+	assert.Equal(t, "https://example.com/infra/rollout.json", rolloutRemotePath("https://example.com/infra/infra.tgz", "rollout.json"))
+	assert.Equal(t, "s3://bucket/rollout.json", rolloutRemotePath("s3://bucket/infra.tgz", "rollout.json"))
+	assert.Equal(t, "rollout.json", rolloutRemotePath("infra.tgz", "rollout.json"))
+}
+
+func TestGateRollout(t *testing.T) {
+	remote, state := t.TempDir(), t.TempDir()
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(t.TempDir(), "artifact.tgz")
+	t.Cleanup(func() {
+		localCacheFile = originalCacheFile
+		lastRollout = nil
+	})
+	for _, key := range []string{"rollout-file", "state-dir"} {
+		key, original := key, viper.Get(key)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+	viper.Set("rollout-file", "rollout.json")
+	viper.Set("state-dir", state)
+	defer withArtifactCache(t, 3, 0)()
+	downloader := fileDownloader{remote}
+
+	// Without an applied artifact there is nothing to hold back to
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("applied"), 0644))
+	assert.Nil(t, gateRollout(downloader, "infra.tgz"))
+	assert.True(t, getRollout().Adopted)
+	assert.Equal(t, "no artifact was applied yet", getRollout().Reason)
+	assert.Nil(t, saveAppliedArtifact(localCacheFile))
+
+	// A new version outside the rollout is cached, and the applied artifact is put back
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("new"), 0644))
+	version, err := md5sum(localCacheFile)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "rollout.json"), []byte(`{"percentage": 0}`), 0644))
+	assert.Nil(t, gateRollout(downloader, "infra.tgz"))
+	content, err := ioutil.ReadFile(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "applied", string(content))
+	assert.Contains(t, cachedVersions(t), version)
+	assert.False(t, getRollout().Adopted)
+	assert.Equal(t, version, getRollout().Version)
+
+	// Once the rollout includes this host the new version is adopted
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("new"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "rollout.json"), []byte(`{"percentage": 100}`), 0644))
+	assert.Nil(t, gateRollout(downloader, "infra.tgz"))
+	content, err = ioutil.ReadFile(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+	assert.True(t, getRollout().Adopted)
+
+	// A rollout file that can't be fetched holds back
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "rollout.json"), []byte(`{`), 0644))
+	assert.Nil(t, gateRollout(downloader, "infra.tgz"))
+	assert.False(t, getRollout().Adopted)
+	assert.Contains(t, getRollout().Reason, "unable to parse the rollout file")
+
+	// A source without a rollout file holds back too, as the file may have been deleted or misnamed
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("new"), 0644))
+	assert.Nil(t, gateRollout(httpDownloader{}, server.URL+"/infra.tgz"))
+	content, err = ioutil.ReadFile(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "applied", string(content))
+	assert.False(t, getRollout().Adopted)
+	assert.Equal(t, "no rollout file is published", getRollout().Reason)
+
+	// Unless new versions are adopted without one
+	withSettings(t, map[string]interface{}{"rollout-adopt-without-file": true})
+	assert.Nil(t, ioutil.WriteFile(localCacheFile, []byte("new"), 0644))
+	assert.Nil(t, gateRollout(httpDownloader{}, server.URL+"/infra.tgz"))
+	content, err = ioutil.ReadFile(localCacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+	assert.True(t, getRollout().Adopted)
+	assert.Equal(t, "no rollout file is published", getRollout().Reason)
+}
+
+func TestRolloutFileMissing(t *testing.T) {
+	assert.True(t, rolloutFileMissing(errors.Wrap(statusCodeError{404}, "unable to download the rollout file")))
+	assert.False(t, rolloutFileMissing(statusCodeError{403}))
+	assert.False(t, rolloutFileMissing(errors.New("unexpected EOF")))
+	assert.False(t, rolloutFileMissing(nil))
+}
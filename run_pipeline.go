@@ -0,0 +1,225 @@
+// Middlewares around the run pipeline, through which built-in features and embedders of the puller hook into runs
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PipelineRun is a run going through the pipeline: what to run, and what is learned about it on the way.
+type PipelineRun struct {
+	Spec        runSpec
+	Logger      *logrus.Entry
+	Start       time.Time          // Once the run holds the run lock
+	ConfigHash  string             // SHA-256 of the effective configuration the run started with
+	Span        *span              // Of the whole run, nil unless tracing
+	ExitCode    int                // Of ansible-playbook, -1 until it ran
+	Summary     *AnsibleNodeStatus // Play recap, nil until ansible-playbook ran
+	Report      *RunReport         // Of ansible-playbook, nil until it ran
+	Failure     *runFailure        // Why the run failed, nil if it succeeded
+	Environment *runEnvironment    // Captured with run-history-environment
+	Context     *runContextVars    // Passed to the playbook
+}
+
+// RunFunc executes a run, or a step of the pipeline around it.
+type RunFunc func(run *PipelineRun) error
+
+// RunMiddleware wraps next, doing its work before and after calling it. Not calling next skips the rest of the
+// pipeline, with the error returned as the error of the run.
+type RunMiddleware func(next RunFunc) RunFunc
+
+// Middlewares added with UseRunMiddleware
+var extraRunMiddlewares []RunMiddleware
+
+// UseRunMiddleware adds middleware to the pipeline of runs, which must happen before the first run. Added middlewares
+// wrap the run inside the built-in ones, in the order they were added, so they hold the run lock and their errors
+// are recorded and notified like those of the run.
+func UseRunMiddleware(middleware RunMiddleware) {
+	extraRunMiddlewares = append(extraRunMiddlewares, middleware)
+}
+
+// chainRun returns run wrapped by middlewares, the first one outermost.
+func chainRun(run RunFunc, middlewares ...RunMiddleware) RunFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		run = middlewares[i](run)
+	}
+	return run
+}
+
+// runPipeline returns the pipeline runs go through: the built-in middlewares, those added with UseRunMiddleware and
+// the run of the playbook itself.
+func runPipeline() RunFunc {
+	middlewares := []RunMiddleware{lockRun, measureRun, recordRun, traceRun, notifyRun, recordFailure, trackReadiness}
+	return chainRun(executePlaybook, append(middlewares, extraRunMiddlewares...)...)
+}
+
+// lockRun holds the run lock while the run executes, so only one run executes at a time, also across puller
+// processes. Runs of every trigger wait for blackout windows to end, and are skipped outside of the change window, as
+// even check runs update the virtualenv and the collections of the host.
+func lockRun(next RunFunc) RunFunc {
+	return func(run *PipelineRun) error {
+		var release func()
+		for {
+			// Waited for without the lock, which other runs would wait for meanwhile
+			if err := awaitBlackout(); err != nil {
+				return skipRun(run, err)
+			}
+			var err error
+			if release, err = runsLock.acquire(run.Spec.ID); err != nil {
+				return err
+			}
+			// Unless a window started while the run waited for the lock
+			if _, active := blackoutUntil(schedulerClock.Now()); !active || shuttingDown() {
+				break
+			}
+			release()
+		}
+		defer release()
+		// Runs waiting for the lock while the puller started shutting down
+		if shuttingDown() {
+			runs.finished(run.Spec.ID, runOutcome{Err: errShuttingDown, ExitCode: -1})
+			return errShuttingDown
+		}
+		// Checked within the lock, as the window may close while the run waits for it
+		if err := checkChangeWindow(); err != nil {
+			return skipRun(run, changeWindowError{errors.Wrap(err, "refused by change management")})
+		}
+		// Still within the run lock once everything else is done, accounting for what the run left behind
+		defer enforceDiskQuota()
+
+		// Not before, as the configuration may be reloaded while the run waits for the lock
+		run.Start = time.Now()
+		run.ConfigHash = currentConfigHash()
+		return next(run)
+	}
+}
+
+// skipRun records that run was skipped before it started because of err, and returns err.
+func skipRun(run *PipelineRun, err error) error {
+	run.Logger.Infoln("Not running Ansible: ", err)
+	promRunOutcomes.WithLabelValues(runOutcomeSkipped).Inc()
+	runs.finished(run.Spec.ID, runOutcome{Err: err, ExitCode: -1})
+	return err
+}
+
+// measureRun exports the metrics of the run.
+func measureRun(next RunFunc) RunFunc {
+	return func(run *PipelineRun) (err error) {
+		ansibleRunning = true
+		promAnsibleIsRunning.Set(1)
+
+		defer func() {
+			ansibleRunning = false
+			promAnsibleIsRunning.Set(0)
+			promAnsibleRuns.Inc()
+			outcome := noopOutcome(run.Spec.Noop, err)
+			promRunOutcomes.WithLabelValues(outcome).Inc()
+			if err != nil {
+				promRunErrorClasses.WithLabelValues(errorClass(err)).Inc()
+			}
+			promRunsBySource.WithLabelValues(runSource(run.Spec.Trigger)).Inc()
+			promRunDuration.Observe(time.Since(run.Start).Seconds())
+			if run.Spec.Name != "" {
+				recordPlaybookRun(run.Spec.Name, outcome)
+			}
+		}()
+		return next(run)
+	}
+}
+
+// recordRun keeps the run in the run history, and logs the entries of the puller while it executes with its ID.
+func recordRun(next RunFunc) RunFunc {
+	return func(run *PipelineRun) (err error) {
+		runOutputBuffer.Reset()
+		lastRunUsage = processUsage{}
+
+		runs.started(run.Spec)
+		setLogRunID(run.Spec.ID)
+		defer setLogRunID("")
+
+		defer func() {
+			runs.finished(run.Spec.ID, runOutcome{
+				Err:         err,
+				ExitCode:    run.ExitCode,
+				Report:      run.Report,
+				Failure:     run.Failure,
+				Log:         runOutputBuffer.Tail(viper.GetInt("run-history-log-lines")),
+				ConfigHash:  run.ConfigHash,
+				Environment: run.Environment,
+				Context:     run.Context,
+			})
+		}()
+		return next(run)
+	}
+}
+
+// traceRun traces the run, the steps of the pipeline add their spans as children of run.Span.
+func traceRun(next RunFunc) RunFunc {
+	return func(run *PipelineRun) (err error) {
+		run.Span = runTracer.startTrace("run")
+		run.Span.setAttribute("run.id", run.Spec.ID)
+		run.Span.setAttribute("run.trigger", run.Spec.Trigger)
+		run.Span.setAttribute("run.check_mode", run.Spec.CheckMode)
+		run.Span.setAttribute("ansible.playbook", run.Spec.Playbook)
+		defer func() {
+			run.Span.end(err)
+		}()
+		return next(run)
+	}
+}
+
+// notifyRun emits the events of the run, notifies of its outcome and attaches it to a change ticket.
+func notifyRun(next RunFunc) RunFunc {
+	return func(run *PipelineRun) (err error) {
+		emitEvent(eventRunStarted, runStartedEvent{RunID: run.Spec.ID, Playbook: run.Spec.Playbook})
+		// Check runs change nothing: their failures don't mean the host is broken, nor their successes that it
+		// recovered, and there is no change to record. Neither is there for the runs of image builds.
+		var changeTicket string
+		if run.Spec.reported() {
+			changeTicket = openChangeTicket(run.Spec.ID, run.Spec.Playbook)
+		}
+
+		defer func() {
+			finished := runFinishedEvent{
+				RunID:           run.Spec.ID,
+				Playbook:        run.Spec.Playbook,
+				Success:         err == nil,
+				ExitCode:        run.ExitCode,
+				DurationSeconds: time.Since(run.Start).Seconds(),
+				Summary:         run.Summary,
+				Failure:         run.Failure,
+				ConfigHash:      run.ConfigHash,
+			}
+			if err != nil {
+				finished.Error = err.Error()
+				finished.ErrorClass = errorClass(err)
+			}
+			emitEvent(eventRunFinished, finished)
+			if run.Spec.reported() {
+				notifyRunOutcome(run.Spec.ID, run.Spec.Name, err, run.Failure)
+				attachRunToChangeTicket(changeTicket, finished)
+			}
+		}()
+		return next(run)
+	}
+}
+
+// recordFailure works out why the run failed, for the failure table and what is told about the run.
+func recordFailure(next RunFunc) RunFunc {
+	return func(run *PipelineRun) (err error) {
+		defer func() {
+			if err == nil {
+				return
+			}
+			run.Failure = newRunFailure(err, run.Report)
+			failures.record(run.Spec.ID, run.Failure, time.Now())
+			promRunFailures.WithLabelValues(failureLabel(run.Failure.Fingerprint)).Inc()
+			run.Logger.WithField("failure_fingerprint", run.Failure.Fingerprint).Infoln("Run failed: ", run.Failure.Message)
+		}()
+		return next(run)
+	}
+}
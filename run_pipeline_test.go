@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainRun(t *testing.T) {
+	var calls []string
+	step := func(name string) RunMiddleware {
+		return func(next RunFunc) RunFunc {
+			return func(run *PipelineRun) error {
+				calls = append(calls, name+" before")
+				err := next(run)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	run := chainRun(func(run *PipelineRun) error {
+		calls = append(calls, "run")
+		return nil
+	}, step("outer"), step("inner"))
+
+	assert.Nil(t, run(&PipelineRun{}))
+	assert.Equal(t, []string{"outer before", "inner before", "run", "inner after", "outer after"}, calls)
+}
+
+func TestUseRunMiddleware(t *testing.T) {
+	withShutdownState(t)
+	original := extraRunMiddlewares
+	defer func() { extraRunMiddlewares = original }()
+
+	// Skips the run without calling next
+	maintenance := errors.New("host is in maintenance")
+	var seen *PipelineRun
+	UseRunMiddleware(func(next RunFunc) RunFunc {
+		return func(run *PipelineRun) error {
+			seen = run
+			return maintenance
+		}
+	})
+
+	report, err := executeRun(runSpec{ID: "middleware-run", Playbook: "site.yml"})
+	assert.Nil(t, report)
+	assert.Equal(t, maintenance, err)
+
+	// Within the built-in middlewares, the run holds the lock and is recorded like any other
+	assert.Equal(t, "middleware-run", seen.Spec.ID)
+	assert.False(t, seen.Start.IsZero())
+	assert.Equal(t, "host is in maintenance", seen.Failure.Message)
+	record := runs.get("middleware-run")
+	assert.NotNil(t, record)
+	assert.Equal(t, runStatusFailed, record.Status)
+	assert.Equal(t, "host is in maintenance", record.Error)
+}
+
+func TestNotifyRunCheckMode(t *testing.T) {
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	server := newNotifyServer(t)
+	withNotifications(t, map[string]map[string]string{"notify-webhooks": {"all": server.URL}})
+	failed := notifyRun(func(*PipelineRun) error { return errors.New("exit status 2") })
+
+	// A failed dry run doesn't mean the host is broken
+	assert.NotNil(t, failed(&PipelineRun{Spec: runSpec{ID: "check", CheckMode: true}}))
+	assert.Empty(t, server.received())
+	// Nor does that of an image build
+	assert.NotNil(t, failed(&PipelineRun{Spec: runSpec{ID: "bake", Trigger: runTriggerBake, NoReport: true}}))
+	assert.Empty(t, server.received())
+
+	assert.NotNil(t, failed(&PipelineRun{Spec: runSpec{ID: "apply"}}))
+	received := server.received()
+	assert.Len(t, received, 1)
+	assert.Equal(t, "run_failed", received[0]["event"])
+}
+
+func TestLockRunChangeWindow(t *testing.T) {
+	withShutdownState(t)
+	server := serviceNowTestServer(t, serviceNowChange{
+		SysID:     "abc",
+		Number:    "CHG0001",
+		Approval:  "approved",
+		StartDate: "2024-05-01 20:00:00",
+		EndDate:   "2024-05-01 22:00:00",
+	}, nil)
+	defer server.Close()
+	original := changeManagement
+	changeManagement = &changeManager{provider: "servicenow", apiURL: server.URL, ticket: "CHG0001", requireWindow: true,
+		user: "puller", token: "secret", client: server.Client()}
+	defer func() { changeManagement = original }()
+
+	// The window closed while the run waited for the lock, e.g. a decommission queued behind a scheduled run
+	ran := false
+	run := lockRun(func(*PipelineRun) error {
+		ran = true
+		return nil
+	})
+	err := run(&PipelineRun{Spec: runSpec{ID: "decommission", Trigger: runTriggerDecommission}, Logger: logrus.NewEntry(logrus.New())})
+	assert.False(t, ran)
+	assert.Contains(t, err.Error(), "refused by change management")
+	assert.True(t, runSkipped(err))
+
+	changeManagement = nil
+	assert.Nil(t, run(&PipelineRun{Spec: runSpec{ID: "schedule"}, Logger: logrus.NewEntry(logrus.New())}))
+	assert.True(t, ran)
+}
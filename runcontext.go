@@ -0,0 +1,72 @@
+// Context of a run passed to playbooks as extra vars
+
+package main
+
+import "github.com/spf13/viper"
+
+// Extra var holding the run context. Reserved for the puller, playbooks can't override it.
+const runContextVar = "ansible_puller"
+
+// runContextVars describe the provenance of a run, so playbooks and templates can reference it, e.g. as
+// {{ ansible_puller.artifact_version }}.
+type runContextVars struct {
+	RunID           string `json:"run_id"`
+	Trigger         string `json:"trigger"`
+	Schedule        string `json:"schedule"`
+	Playbook        string `json:"playbook"`
+	CheckMode       bool   `json:"check_mode"`
+	ArtifactVersion string `json:"artifact_version"` // MD5 of the artifact
+	ArtifactCommit  string `json:"artifact_commit"`  // Commit the artifact was built from, when pulling from git-url
+	PullerVersion   string `json:"puller_version"`
+	Hostname        string `json:"hostname"`
+
+	// Selected metadata of the cloud instance, with cloud-metadata
+	Cloud map[string]interface{} `json:"cloud,omitempty"`
+
+	// Labels of the host from labels-file
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Set as max_fail_percentage of plays, so a play stops when too many hosts failed
+	MaxFailPercentage int `json:"max_fail_percentage"`
+}
+
+// runContext returns the context of the run described by spec, once its artifact was pulled.
+func runContext(spec runSpec) runContextVars {
+	version, _ := md5sum(spec.artifactFile())
+
+	context := runContextVars{
+		RunID:           spec.ID,
+		Trigger:         spec.Trigger,
+		Schedule:        spec.Schedule,
+		Playbook:        spec.Playbook,
+		CheckMode:       spec.CheckMode,
+		ArtifactVersion: version,
+		ArtifactCommit:  appliedGitCommit(),
+		PullerVersion:   Version,
+		Hostname:        hostname,
+		Cloud:           runCloudMetadata(),
+		Labels:          spec.Labels,
+
+		MaxFailPercentage: viper.GetInt("ansible-max-fail-percentage"),
+	}
+	if replayed := spec.ReplayContext; replayed != nil {
+		// As the replayed run had it, rather than as it is now
+		context.Schedule = replayed.Schedule
+		context.ArtifactCommit = replayed.ArtifactCommit
+		context.Cloud = replayed.Cloud
+		context.MaxFailPercentage = replayed.MaxFailPercentage
+	}
+
+	return context
+}
+
+// runExtraVars returns the extra vars of the run described by spec, with its context under runContextVar.
+func runExtraVars(spec runSpec, context runContextVars) map[string]interface{} {
+	extraVars := make(map[string]interface{}, len(spec.ExtraVars)+1)
+	for name, value := range spec.ExtraVars {
+		extraVars[name] = value
+	}
+	extraVars[runContextVar] = context
+
+	return extraVars
+}
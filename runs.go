@@ -0,0 +1,316 @@
+// Tracking of queued, running and recently finished runs, persisted so they survive a restart
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Run states
+const (
+	runStatusQueued    = "queued"
+	runStatusRunning   = "running"
+	runStatusSucceeded = "succeeded"
+	runStatusFailed    = "failed"
+
+	// The puller stopped before the run finished
+	runStatusInterrupted = "interrupted"
+)
+
+const (
+	runHistoryFileName = "runs.json"
+
+	// Number of runs kept when the run history is not set up, e.g. in subcommands
+	defaultRunHistorySize = 100
+)
+
+// runRecord is the status of a single run, as returned by the API.
+type runRecord struct {
+	ID         string     `json:"run_id"`
+	Status     string     `json:"status"`
+	Playbook   string     `json:"playbook"`
+	Name       string     `json:"playbook_name,omitempty"` // Name of the configured playbook run, if any
+	Inventory  []string   `json:"inventory,omitempty"`     // Inventories of the playbook instead of ansible-inventory
+	Tags       []string   `json:"tags,omitempty"`
+	SkipTags   []string   `json:"skip_tags,omitempty"`
+	Limit      string     `json:"limit,omitempty"`
+	CheckMode  bool       `json:"check_mode"`
+	Trigger    string     `json:"trigger"`
+	ReplayOf   string     `json:"replay_of,omitempty"` // ID of the run this one replays
+	QueuedTime time.Time  `json:"queued_time"`
+	StartTime  *time.Time `json:"start_time"`
+	EndTime    *time.Time `json:"end_time"`
+	Error      string     `json:"error,omitempty"`
+	ErrorClass string     `json:"error_class,omitempty"` // retryable, fatal or failed
+
+	// Set once the run finished
+	ExitCode     *int                         `json:"exit_code"`
+	ChangedTasks int                          `json:"changed_tasks"`
+	FailedTasks  int                          `json:"failed_tasks"`
+	TimedOut     []string                     `json:"timed_out_tasks,omitempty"` // Names of the tasks that exceeded the task timeout
+	FailedHosts  []string                     `json:"failed_hosts,omitempty"`    // Hosts that failed or were unreachable
+	Hosts        map[string]AnsibleNodeStatus `json:"hosts,omitempty"`           // Play recap per host, several in controller mode
+	Failure      *runFailure                  `json:"failure,omitempty"`         // Cause and fingerprint of the failure of a failed run
+	Log          []string                     `json:"log,omitempty"`             // Last lines of output
+	ConfigHash   string                       `json:"config_hash,omitempty"`     // SHA-256 of the effective configuration of the puller
+	Environment  *runEnvironment              `json:"environment,omitempty"`     // What ansible-playbook ran with
+	Context      *runContextVars              `json:"context,omitempty"`         // Run context passed to the playbook
+}
+
+// runOutcome is what is recorded about a run once it finished.
+type runOutcome struct {
+	Err         error
+	ExitCode    int
+	Report      *RunReport // nil if the run failed before Ansible ran
+	Failure     *runFailure
+	Log         []string
+	ConfigHash  string
+	Environment *runEnvironment
+	Context     *runContextVars // nil if the run failed before Ansible ran
+}
+
+// runRegistry keeps the records of the most recent runs.
+type runRegistry struct {
+	mutex   sync.Mutex
+	size    int
+	path    string   // File the records are persisted to, not persisted if empty
+	order   []string // IDs from oldest to newest
+	records map[string]*runRecord
+}
+
+func newRunRegistry(size int) *runRegistry {
+	return &runRegistry{
+		size:    size,
+		records: map[string]*runRecord{},
+	}
+}
+
+var runs = newRunRegistry(defaultRunHistorySize)
+
+// setupRunHistory sets up the run history, persisted in the state directory. It is loaded by restoreState.
+func setupRunHistory() error {
+	if viper.GetInt("run-history-size") < 1 {
+		return errors.New("run-history-size must be at least 1")
+	}
+
+	registry := newRunRegistry(viper.GetInt("run-history-size"))
+	registry.path = filepath.Join(stateDir(), runHistoryFileName)
+	runs = registry
+	return nil
+}
+
+// load reads the persisted records. Runs that were still queued or running were interrupted by a stop of the puller.
+func (r *runRegistry) load() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data, err := readStateFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to read run history")
+	}
+
+	var records []*runRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrap(err, "unable to parse run history")
+	}
+
+	for _, record := range records {
+		if record.Status == runStatusQueued || record.Status == runStatusRunning {
+			record.Status = runStatusInterrupted
+		}
+		r.records[record.ID] = record
+		r.order = append(r.order, record.ID)
+	}
+	r.evict()
+
+	return nil
+}
+
+// save persists the records, oldest first. The caller must hold the mutex.
+func (r *runRegistry) save() {
+	if r.path == "" {
+		return
+	}
+
+	records := make([]*runRecord, 0, len(r.order))
+	for _, id := range r.order {
+		records = append(records, r.records[id])
+	}
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.path), 0700)
+	}
+	if err == nil {
+		err = writeStateFile(r.path, data)
+	}
+	if err != nil {
+		logrus.Warnln("Unable to persist run history: ", err)
+	}
+}
+
+// evict drops the oldest records beyond the size of the registry. The caller must hold the mutex.
+func (r *runRegistry) evict() {
+	for len(r.order) > r.size {
+		delete(r.records, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// queued records a run that is waiting for the run lock, unless it is already known.
+func (r *runRegistry) queued(spec runSpec) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.records[spec.ID]; ok {
+		return
+	}
+
+	r.records[spec.ID] = &runRecord{
+		ID:         spec.ID,
+		Status:     runStatusQueued,
+		Playbook:   spec.Playbook,
+		Name:       spec.Name,
+		Inventory:  spec.Inventory,
+		Tags:       spec.Tags,
+		SkipTags:   spec.SkipTags,
+		Limit:      spec.Limit,
+		CheckMode:  spec.CheckMode,
+		Trigger:    spec.Trigger,
+		ReplayOf:   spec.Replays,
+		QueuedTime: time.Now(),
+	}
+	r.order = append(r.order, spec.ID)
+	r.evict()
+	r.save()
+}
+
+func (r *runRegistry) started(spec runSpec) {
+	r.queued(spec)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if record, ok := r.records[spec.ID]; ok {
+		now := time.Now()
+		record.Status = runStatusRunning
+		record.StartTime = &now
+	}
+	r.save()
+}
+
+func (r *runRegistry) finished(id string, outcome runOutcome) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	record.EndTime = &now
+	record.Status = runStatusSucceeded
+	if outcome.Err != nil {
+		record.Status = runStatusFailed
+		record.Error = outcome.Err.Error()
+		record.ErrorClass = errorClass(outcome.Err)
+	}
+	record.ExitCode = &outcome.ExitCode
+	if outcome.Report != nil {
+		record.ChangedTasks = outcome.Report.changedTasks()
+		record.FailedTasks = outcome.Report.failedTasks()
+		record.TimedOut = outcome.Report.timedOutTasks()
+		if failed := outcome.Report.failedHosts(); len(failed) > 0 {
+			record.FailedHosts = failed
+		}
+		record.Hosts = outcome.Report.Hosts
+	}
+	record.Failure = outcome.Failure
+	record.Log = outcome.Log
+	record.ConfigHash = outcome.ConfigHash
+	record.Environment = outcome.Environment
+	record.Context = outcome.Context
+
+	r.save()
+}
+
+// dropLogs drops the output lines of all records but the newest one.
+func (r *runRegistry) dropLogs() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := 0; i < len(r.order)-1; i++ {
+		r.records[r.order[i]].Log = nil
+	}
+	r.save()
+}
+
+// get returns a copy of the record of a run, or nil if it is unknown or was evicted.
+func (r *runRegistry) get(id string) *runRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return nil
+	}
+
+	copied := *record
+	return &copied
+}
+
+// list returns copies of all records without their logs, environments and run contexts, newest first.
+func (r *runRegistry) list() []runRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	records := make([]runRecord, 0, len(r.order))
+	for i := len(r.order) - 1; i >= 0; i-- {
+		record := *r.records[r.order[i]]
+		record.Log = nil
+		record.Environment = nil
+		record.Context = nil
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// startRun queues a run in the background. It starts as soon as any blackout window has ended and the run lock is
+// free, which the run pipeline waits for.
+func startRun(spec runSpec) {
+	runs.queued(spec)
+
+	go func() {
+		recordingRuns.RLock()
+		defer recordingRuns.RUnlock()
+		if spec.Replays != "" {
+			// The copy of the artifact of the replayed run is only needed by this run
+			defer os.Remove(spec.Artifact)
+		}
+		_, err := executeRun(spec)
+		if runSkipped(err) {
+			logrus.Infoln("Ansible run skipped: " + err.Error())
+			return
+		} else if err != nil {
+			logrus.Errorln("Ansible run failed due to: " + err.Error())
+		}
+
+		// A check mode run does not change the host, so it says nothing about the state of the host
+		if spec.CheckMode {
+			return
+		}
+		recordRunState(spec.Name, err)
+	}()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRegistryLifecycle(t *testing.T) {
+	registry := newRunRegistry(10)
+
+	registry.queued(runSpec{ID: "a", Playbook: "site.yml"})
+	assert.Equal(t, runStatusQueued, registry.get("a").Status)
+
+	registry.started(runSpec{ID: "a", Playbook: "site.yml"})
+	assert.Equal(t, runStatusRunning, registry.get("a").Status)
+	assert.NotNil(t, registry.get("a").StartTime)
+
+	report := RunReport{Tasks: []TaskReport{
+		{Name: "install", Hosts: map[string]string{"localhost": "changed"}},
+		{Name: "start", Hosts: map[string]string{"localhost": "failed"}},
+		{Name: "check", Hosts: map[string]string{"localhost": "ok"}},
+	}, Hosts: map[string]AnsibleNodeStatus{"localhost": {Ok: 1, Changed: 1, Failures: 1}}}
+	registry.finished("a", runOutcome{Err: errors.New("boom"), ExitCode: 2, Report: &report, Log: []string{"TASK [start]"},
+		Environment: &runEnvironment{Dir: "/srv/ansible"}})
+	record := registry.get("a")
+	assert.Equal(t, runStatusFailed, record.Status)
+	assert.Equal(t, "boom", record.Error)
+	assert.NotNil(t, record.EndTime)
+	assert.Equal(t, 2, *record.ExitCode)
+	assert.Equal(t, 1, record.ChangedTasks)
+	assert.Equal(t, 1, record.FailedTasks)
+	assert.Equal(t, []string{"localhost"}, record.FailedHosts)
+	assert.Equal(t, AnsibleNodeStatus{Ok: 1, Changed: 1, Failures: 1}, record.Hosts["localhost"])
+	assert.Equal(t, []string{"TASK [start]"}, record.Log)
+	assert.Equal(t, "/srv/ansible", record.Environment.Dir)
+
+	// Runs started by the scheduler are never queued through the API
+	registry.started(runSpec{ID: "b"})
+	registry.finished("b", runOutcome{})
+	assert.Equal(t, runStatusSucceeded, registry.get("b").Status)
+
+	list := registry.list()
+	assert.Len(t, list, 2)
+	assert.Equal(t, "b", list[0].ID)
+	assert.Nil(t, list[1].Log)
+	assert.Nil(t, list[1].Environment)
+}
+
+func TestRunRegistryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ansible_puller_runs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry := newRunRegistry(2)
+	registry.path = filepath.Join(dir, runHistoryFileName)
+	registry.started(runSpec{ID: "a"})
+	registry.finished("a", runOutcome{})
+	registry.started(runSpec{ID: "b"})
+	registry.started(runSpec{ID: "c"})
+
+	// The puller stops while c is running
+	loaded := newRunRegistry(2)
+	loaded.path = registry.path
+	assert.Nil(t, loaded.load())
+
+	assert.Nil(t, loaded.get("a"))
+	assert.Equal(t, runStatusInterrupted, loaded.get("b").Status)
+	assert.Equal(t, runStatusInterrupted, loaded.get("c").Status)
+
+	loaded.queued(runSpec{ID: "d"})
+	assert.Nil(t, loaded.get("b"))
+	assert.Equal(t, []string{"c", "d"}, loaded.order)
+}
+
+func TestRunRegistryEviction(t *testing.T) {
+	registry := newRunRegistry(2)
+
+	registry.queued(runSpec{ID: "a"})
+	registry.queued(runSpec{ID: "b"})
+	registry.queued(runSpec{ID: "c"})
+
+	assert.Nil(t, registry.get("a"))
+	assert.NotNil(t, registry.get("b"))
+	assert.NotNil(t, registry.get("c"))
+}
+
+func TestSetupRunHistoryLeavesStateAlone(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	keyFile := filepath.Join(dir, "state.key")
+	withSettings(t, map[string]interface{}{"state-dir": dir, "state-key-file": keyFile, "run-history-size": 10})
+	originalRuns := runs
+	defer func() { runs = originalRuns }()
+
+	// As --validate does, which must not change the host
+	assert.Nil(t, setupRunHistory())
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// Loading it, as restoreState does, generates the state key
+	assert.Nil(t, runs.load())
+	_, err = os.Stat(keyFile)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageOf(t *testing.T) {
+	assert.Equal(t, processUsage{}, usageOf(nil))
+
+	if runtime.GOOS == "windows" {
+		t.Skip("peak RSS is not reported on windows")
+	}
+
+	cmd := exec.Command("sh", "-c", "true")
+	assert.Nil(t, cmd.Run())
+
+	usage := usageOf(cmd.ProcessState)
+	assert.NotZero(t, usage.PeakRSSBytes)
+	assert.GreaterOrEqual(t, int64(usage.CPUTime), int64(0))
+}
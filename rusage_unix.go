@@ -0,0 +1,18 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// processPeakRSS returns the peak resident set size in bytes of an exited process and the children it waited for.
+func processPeakRSS(state *os.ProcessState) uint64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// ru_maxrss is in kilobytes
+	return uint64(usage.Maxrss) * 1024
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// processPeakRSS is not available on Windows, the process handle is gone once it has been waited for.
+func processPeakRSS(state *os.ProcessState) uint64 {
+	return 0
+}
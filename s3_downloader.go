@@ -6,18 +6,19 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"path/filepath"
 )
 
 type s3Downloader struct {
 	downloader
+	client  *s3.Client
 	manager *manager.Downloader
 }
 
@@ -40,6 +41,32 @@ func parseS3ResourceFromARN(resource string) (*s3BucketObject, error) {
 	return nil, errors.New(fmt.Sprintf("Not a valid S3 ARN: %s", resource))
 }
 
+// parseS3Resource accepts both object ARNs and s3://bucket/key URIs.
+func parseS3Resource(resource string) (*s3BucketObject, error) {
+	if strings.HasPrefix(resource, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(resource, "s3://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Not a valid S3 URI: %s", resource))
+		}
+
+		return &s3BucketObject{
+			Bucket: parts[0],
+			File:   parts[1],
+		}, nil
+	}
+
+	return parseS3ResourceFromARN(resource)
+}
+
+// loadAWSConfig loads the default AWS configuration, which includes instance role credentials.
+func loadAWSConfig(ctx context.Context, regionOverride string) (aws.Config, error) {
+	if regionOverride != "" {
+		return config.LoadDefaultConfig(ctx, config.WithRegion(regionOverride))
+	}
+
+	return config.LoadDefaultConfig(ctx)
+}
+
 func createS3Downloader(regionOverride string) (*s3Downloader, error) {
 	ctx := context.TODO()
 	// A default connection region should be selected based on the EC2
@@ -47,15 +74,9 @@ func createS3Downloader(regionOverride string) (*s3Downloader, error) {
 	// only accessing S3 which is globally namespaced but we have to
 	// consider connections orignating from China.
 	// https://github.com/aws/aws-sdk-go-v2/pull/523
-	var awsConfig aws.Config
-	var err error
-	if regionOverride != "" {
-		awsConfig, err = config.LoadDefaultConfig(ctx, config.WithRegion(regionOverride))
-	} else {
-		awsConfig, err = config.LoadDefaultConfig(ctx)
-	}
+	awsConfig, err := loadAWSConfig(ctx, regionOverride)
 	if err != nil {
-		logrus.Warn("Error loading AWS config")
+		downloaderLog.Warn("Error loading AWS config")
 		return nil, err
 	}
 
@@ -68,20 +89,22 @@ func createS3Downloader(regionOverride string) (*s3Downloader, error) {
 	manager := manager.NewDownloader(client)
 
 	return &s3Downloader{
+		client:  client,
 		manager: manager,
 	}, nil
 }
 
 func (downloader s3Downloader) Download(remotePath, outputPath string) (err error) {
-	ctx := context.TODO()
-	bucketObject, err := parseS3ResourceFromARN(remotePath)
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout())
+	defer cancel()
+	bucketObject, err := parseS3Resource(remotePath)
 	if err != nil {
 		return
 	}
 
 	file, err := os.Create(outputPath)
 	if err != nil {
-		logrus.Warnf("Could not create file '%s' for writing", outputPath)
+		downloaderLog.Warnf("Could not create file '%s' for writing", outputPath)
 		return
 	}
 	defer func() {
@@ -97,10 +120,10 @@ func (downloader s3Downloader) Download(remotePath, outputPath string) (err erro
 	}
 	numBytes, err := downloader.manager.Download(ctx, file, parameters)
 	if err != nil {
-		logrus.Warnf("Could not download file '%s' from S3 bucket '%s': %v", bucketObject.File, bucketObject.Bucket, err)
+		downloaderLog.Warnf("Could not download file '%s' from S3 bucket '%s': %v", bucketObject.File, bucketObject.Bucket, err)
 		return
 	}
-	logrus.Debugf("Downloaded %d bytes from S3", numBytes)
+	downloaderLog.Debugf("Downloaded %d bytes from S3", numBytes)
 
 	return
 }
@@ -110,7 +133,7 @@ func (downloader s3Downloader) RemoteChecksum(remotePath string) (string, error)
 
 	dir, err := ioutil.TempDir("", "*")
 	if err != nil {
-		logrus.Error("Cannot create temporary file to store remote checksum")
+		downloaderLog.Error("Cannot create temporary file to store remote checksum")
 		return "", err
 	}
 	defer os.RemoveAll(dir)
@@ -118,17 +141,35 @@ func (downloader s3Downloader) RemoteChecksum(remotePath string) (string, error)
 
 	err = downloader.Download(hashRemotePath, hashFile)
 	if err != nil {
-		logrus.Infof("MD5 sum not reachable. %v", err)
+		downloaderLog.Infof("MD5 sum not reachable. %v", err)
 		return "", nil
 	}
 
-	logrus.Infof("Found MD5 sum at: %s", hashRemotePath)
+	downloaderLog.Infof("Found MD5 sum at: %s", hashRemotePath)
 
 	content, err := ioutil.ReadFile(hashFile)
 	if err != nil {
-		logrus.Warn("Error reading remote checksum")
+		downloaderLog.Warn("Error reading remote checksum")
 		return "", err
 	}
 
 	return string(content), nil
 }
+
+// RemoteVersion returns the ETag of the object, which changes whenever the object is replaced.
+func (downloader s3Downloader) RemoteVersion(remotePath string) (string, error) {
+	bucketObject, err := parseS3Resource(remotePath)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := downloader.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Key:    aws.String(bucketObject.File),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(aws.ToString(output.ETag), `"`), nil
+}
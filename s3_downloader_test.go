@@ -38,3 +38,18 @@ func (s *S3DownloaderTestSuite) TestParseS3ResourceBadARN() {
 	assert.Nil(s.T(), bucketObject)
 	assert.NotNil(s.T(), err)
 }
+
+func (s *S3DownloaderTestSuite) TestParseS3ResourceURI() {
+	bucketObject, err := parseS3Resource("s3://test_bucket/some/file_name")
+
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "test_bucket", bucketObject.Bucket)
+	assert.Equal(s.T(), "some/file_name", bucketObject.File)
+
+	bucketObject, err = parseS3Resource(testS3GoodARN)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "test_bucket", bucketObject.Bucket)
+
+	_, err = parseS3Resource("s3://test_bucket")
+	assert.NotNil(s.T(), err)
+}
@@ -0,0 +1,174 @@
+// Scheduling of periodic runs
+
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// How often the scheduler compares the wall clock against the planned run time
+	schedulerCheckInterval = 30 * time.Second
+
+	// Differences between wall clock and monotonic time above this are treated as clock jumps
+	clockJumpThreshold = time.Minute
+)
+
+// scheduler triggers a run every period, randomized by up to jitter in either direction.
+//
+// Rather than sleeping for a whole period, it wakes up every schedulerCheckInterval and compares the
+// wall clock against the planned run time. The monotonic clock that timers use stops while a host is
+// suspended, so a plain sleep would wait for the full period again after a resume. Steps of the wall
+// clock are detected by comparing wall clock and monotonic elapsed time between checks:
+//   - Backward steps (NTP corrections) move the planned run by the same amount, so the remaining wait is unchanged.
+//   - Forward jumps (resume from suspend or pause) may leave the planned run in the past, in which case a single
+//     run is triggered and the next one planned from now, rather than catching up on every missed run.
+//
+// With a cron schedule, runs are planned at the times it matches instead, delayed by up to jitter.
+//
+// With a splay, runs are aligned to multiples of the period, or to the cron schedule, and delayed by an offset
+// within the splay that is stable for the host, so hosts spread out but each runs at a predictable time.
+type scheduler struct {
+	mutex   sync.Mutex // Guards the schedule, which a reload of the configuration can change while it runs
+	name    string     // Of the playbook the scheduler runs
+	period  time.Duration
+	jitter  time.Duration
+	cron    *cronSchedule // Replaces period if set
+	splay   time.Duration
+	offset  time.Duration // Offset of this host within the splay
+	trigger func()
+	clock   clock
+	rng     *rand.Rand
+	nextRun time.Time // Wall clock time of the next run
+	stopped chan struct{}
+}
+
+func newScheduler(period, jitter time.Duration, trigger func()) *scheduler {
+	return &scheduler{
+		name:    defaultScheduleName,
+		period:  period,
+		jitter:  jitter,
+		trigger: trigger,
+		clock:   schedulerClock,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		stopped: make(chan struct{}),
+	}
+}
+
+// splayOffset returns the offset within splay of the host with the given name, which is the same on every call.
+func splayOffset(host string, splay time.Duration) time.Duration {
+	if splay <= 0 {
+		return 0
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(host))
+	return time.Duration(hash.Sum64() % uint64(splay))
+}
+
+// setSplay spreads the runs of host over splay.
+func (s *scheduler) setSplay(host string, splay time.Duration) {
+	s.splay = splay
+	s.offset = splayOffset(host, splay)
+}
+
+// plan sets the next run one period, randomized by the jitter, after from.
+func (s *scheduler) plan(from time.Time) {
+	if s.cron != nil {
+		// Shifted back by the offset, so a run at the current match plus the offset is not skipped
+		next := s.cron.next(from.Add(-s.offset)).Add(s.offset)
+		if s.jitter > 0 {
+			next = next.Add(time.Duration(s.rng.Int63n(int64(s.jitter))))
+		}
+		s.setNextRun(next)
+		return
+	}
+
+	if s.splay > 0 {
+		next := from.Truncate(s.period).Add(s.offset)
+		if s.jitter > 0 {
+			next = next.Add(-s.jitter + time.Duration(s.rng.Int63n(2*int64(s.jitter))))
+		}
+		for !next.After(from) {
+			next = next.Add(s.period)
+		}
+		s.setNextRun(next)
+		return
+	}
+
+	delay := s.period
+	if s.jitter > 0 {
+		// Random duration in [period - jitter, period + jitter)
+		delay = s.period - s.jitter + time.Duration(s.rng.Int63n(2*int64(s.jitter)))
+	}
+
+	s.setNextRun(from.Add(delay))
+}
+
+func (s *scheduler) setNextRun(t time.Time) {
+	s.nextRun = t.Round(0) // Strip the monotonic reading, the plan is in wall clock time
+	setPlaybookNextRun(s.name, s.nextRun)
+}
+
+// check is called periodically with the current time and the wall clock and monotonic time elapsed since the last check.
+func (s *scheduler) check(now time.Time, wallElapsed, monotonicElapsed time.Duration) {
+	now = now.Round(0)
+
+	jump := wallElapsed - monotonicElapsed
+	if jump < -clockJumpThreshold && s.cron != nil {
+		logrus.Warnf("Wall clock stepped back by %s, keeping the next run at %s as scheduled", -jump, s.nextRun)
+	} else if jump < -clockJumpThreshold {
+		logrus.Warnf("Wall clock stepped back by %s, moving the next run to keep the remaining wait", -jump)
+		s.setNextRun(s.nextRun.Add(jump))
+	} else if jump > clockJumpThreshold {
+		logrus.Infof("Wall clock jumped forward by %s, probably after a suspend or clock correction", jump)
+	}
+
+	if !now.Before(s.nextRun) {
+		s.trigger()
+		s.plan(now)
+	}
+}
+
+// reschedule replaces the period, jitter and cron schedule, planning the next run from now.
+func (s *scheduler) reschedule(period, jitter time.Duration, cron *cronSchedule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.period = period
+	s.jitter = jitter
+	s.cron = cron
+	s.plan(s.clock.Now())
+}
+
+// stop makes run return.
+func (s *scheduler) stop() {
+	close(s.stopped)
+}
+
+// run triggers runs until stopped, the first one a period from now or at the next time the cron schedule matches.
+func (s *scheduler) run() {
+	last := s.clock.Now()
+	s.mutex.Lock()
+	s.plan(last)
+	s.mutex.Unlock()
+
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-s.clock.After(schedulerCheckInterval):
+		}
+
+		now := s.clock.Now()
+		s.mutex.Lock()
+		s.check(now, now.Round(0).Sub(last.Round(0)), now.Sub(last))
+		s.mutex.Unlock()
+		last = now
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestScheduler(runs *int) (*scheduler, time.Time) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newScheduler(time.Hour, 0, func() { *runs++ })
+	s.plan(start)
+
+	return s, start
+}
+
+func TestSchedulerRunsWhenDue(t *testing.T) {
+	runs := 0
+	s, start := newTestScheduler(&runs)
+
+	s.check(start.Add(30*time.Minute), 30*time.Minute, 30*time.Minute)
+	assert.Equal(t, 0, runs)
+
+	now := start.Add(time.Hour)
+	s.check(now, 30*time.Minute, 30*time.Minute)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, now.Add(time.Hour), s.nextRun)
+}
+
+func TestSchedulerForwardJumpRunsOnce(t *testing.T) {
+	runs := 0
+	s, start := newTestScheduler(&runs)
+
+	// Resumed after ten hours of suspend, while only 30 seconds passed on the monotonic clock
+	now := start.Add(10 * time.Hour)
+	s.check(now, 10*time.Hour, 30*time.Second)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, now.Add(time.Hour), s.nextRun)
+
+	s.check(now.Add(30*time.Second), 30*time.Second, 30*time.Second)
+	assert.Equal(t, 1, runs)
+}
+
+func TestSchedulerBackwardStepKeepsRemainingWait(t *testing.T) {
+	runs := 0
+	s, start := newTestScheduler(&runs)
+
+	// The wall clock is stepped back by two hours, 30 minutes after planning
+	now := start.Add(30*time.Minute - 2*time.Hour)
+	s.check(now, 30*time.Minute-2*time.Hour, 30*time.Minute)
+	assert.Equal(t, 0, runs)
+	assert.Equal(t, now.Add(30*time.Minute), s.nextRun)
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	s := newScheduler(time.Hour, 10*time.Minute, func() {})
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 100; i++ {
+		s.plan(start)
+		assert.False(t, s.nextRun.Before(start.Add(50*time.Minute)))
+		assert.True(t, s.nextRun.Before(start.Add(70*time.Minute)))
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	defer withPullerLocation(time.UTC)()
+	schedule, err := parseCron("0 2 * * *")
+	assert.Nil(t, err)
+
+	runs := 0
+	s := newScheduler(time.Hour, 0, func() { runs++ })
+	s.cron = schedule
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.plan(start)
+	assert.Equal(t, time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC), s.nextRun)
+
+	// A backward step of the wall clock keeps the scheduled time
+	s.check(start.Add(-2*time.Hour), -2*time.Hour, 30*time.Second)
+	assert.Equal(t, time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC), s.nextRun)
+
+	now := time.Date(2020, 1, 2, 2, 0, 10, 0, time.UTC)
+	s.check(now, 30*time.Second, 30*time.Second)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, time.Date(2020, 1, 3, 2, 0, 0, 0, time.UTC), s.nextRun)
+}
+
+func TestSplayOffset(t *testing.T) {
+	assert.Equal(t, time.Duration(0), splayOffset("host-1", 0))
+
+	offset := splayOffset("host-1", 10*time.Minute)
+	assert.Equal(t, offset, splayOffset("host-1", 10*time.Minute), "the offset is stable for a host")
+	assert.True(t, offset >= 0 && offset < 10*time.Minute)
+
+	distinct := map[time.Duration]bool{}
+	for _, host := range []string{"host-1", "host-2", "host-3", "host-4"} {
+		distinct[splayOffset(host, 10*time.Minute)] = true
+	}
+	assert.True(t, len(distinct) > 1, "hosts are spread over the splay")
+}
+
+func TestSchedulerSplay(t *testing.T) {
+	s := newScheduler(30*time.Minute, 0, func() {})
+	s.splay = 10 * time.Minute
+	s.offset = 4 * time.Minute
+
+	s.plan(time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 1, 1, 12, 4, 0, 0, time.UTC), s.nextRun)
+
+	// Planned after the run, the next slot is a period later
+	s.plan(time.Date(2020, 1, 1, 12, 4, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 1, 1, 12, 34, 0, 0, time.UTC), s.nextRun)
+}
+
+func TestSchedulerCronSplay(t *testing.T) {
+	defer withPullerLocation(time.UTC)()
+	schedule, err := parseCron("0 2 * * *")
+	assert.Nil(t, err)
+
+	s := newScheduler(time.Hour, 0, func() {})
+	s.cron = schedule
+	s.offset = 5 * time.Minute
+
+	s.plan(time.Date(2020, 1, 2, 2, 1, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 1, 2, 2, 5, 0, 0, time.UTC), s.nextRun)
+}
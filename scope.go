@@ -0,0 +1,74 @@
+// Transient systemd scopes that runs of ansible-playbook are started in, for their own unit, cgroup and limits
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Prefix of the units of run scopes, followed by the run ID and the number of the command
+var runScopePrefix = appName + "-run-"
+
+// Number of commands started in run scopes, which tells apart the scopes of the commands of a run
+var runScopeInvocations uint64
+
+// Properties of every run scope, so that systemd accounts for the resources runs use
+var runScopeAccounting = []string{"CPUAccounting=yes", "MemoryAccounting=yes", "TasksAccounting=yes", "IOAccounting=yes"}
+
+// Characters that aren't kept in the names of run scopes
+var runScopeNamePattern = regexp.MustCompile(`[^A-Za-z0-9:_.-]+`)
+
+// runScope returns the prefix of the units of the scopes the commands of the run with the ID runID are started in,
+// or "" if runs aren't started in scopes.
+func runScope(runID string) string {
+	if !viper.GetBool("run-scope") || runID == "" {
+		return ""
+	}
+	return runScopePrefix + runScopeNamePattern.ReplaceAllString(runID, "_")
+}
+
+// scopeInvocation returns the unit of the scope of a command started in the scopes with the prefix scope. Every
+// command gets a unit of its own, so a scope that could not be stopped doesn't keep the next command of the run from
+// starting.
+func scopeInvocation(scope string) string {
+	return fmt.Sprintf("%s-%d.scope", scope, atomic.AddUint64(&runScopeInvocations, 1))
+}
+
+// inScope changes cmd to run in the transient scope unit with systemd-run. systemd-run sets the scope up and then
+// executes the command itself, so the process, its output and its exit code stay those of the command.
+func inScope(cmd *exec.Cmd, unit string) error {
+	systemdRun, err := exec.LookPath("systemd-run")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"systemd-run", "--scope", "--quiet", "--collect", "--unit", unit, "--description", "Ansible run of " + appName}
+	if slice := viper.GetString("run-scope-slice"); slice != "" {
+		args = append(args, "--slice", slice)
+	}
+	for _, property := range append(runScopeAccounting, viper.GetStringSlice("run-scope-properties")...) {
+		args = append(args, "--property", property)
+	}
+	cmd.Args = append(append(args, "--"), append([]string{cmd.Path}, cmd.Args[1:]...)...)
+	cmd.Path = systemdRun
+	return nil
+}
+
+// stopScope stops the scope unit if processes of the command it was started for are left in it, e.g. because they
+// detached from it or the command failed before stopping them.
+func stopScope(unit string) {
+	if exec.Command("systemctl", "is-active", "--quiet", unit).Run() != nil {
+		return
+	}
+
+	logrus.Warnf("Stopping %s, the run left processes behind in it", unit)
+	if output, err := exec.Command("systemctl", "stop", unit).CombinedOutput(); err != nil {
+		logrus.Warnf("Unable to stop %s: %v: %s", unit, err, output)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunScope(t *testing.T) {
+	withSettings(t, map[string]interface{}{"run-scope": false})
+	assert.Equal(t, "", runScope("1234"))
+
+	withSettings(t, map[string]interface{}{"run-scope": true})
+	assert.Equal(t, "ansible-puller-run-1234", runScope("1234"))
+	assert.Equal(t, "ansible-puller-run-nightly_1", runScope("nightly/1"))
+	assert.Equal(t, "", runScope(""))
+
+	// Every command of a run gets a scope of its own
+	first, second := scopeInvocation(runScope("1234")), scopeInvocation(runScope("1234"))
+	assert.Regexp(t, `^ansible-puller-run-1234-[0-9]+\.scope$`, first)
+	assert.NotEqual(t, first, second)
+}
+
+func TestRunInScope(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake systemd commands are shell scripts")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	bin := filepath.Join(dir, "bin")
+	assert.Nil(t, os.Mkdir(bin, 0755))
+	// Records its arguments and runs the command after --, like systemd-run --scope
+	systemdRun := "#!/bin/sh\necho systemd-run \"$@\" >> " + calls + "\nwhile [ \"$1\" != -- ]; do shift; done\nshift\nexec \"$@\"\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(bin, "systemd-run"), []byte(systemdRun), 0755))
+	// Only the scope of the run that left processes behind is active
+	systemctl := "#!/bin/sh\necho systemctl \"$@\" >> " + calls + "\n[ \"$1\" != is-active ] || [ \"$3\" = leftover-2.scope ]\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(bin, "systemctl"), []byte(systemctl), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	venv := filepath.Join(dir, "venv")
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "ansible-playbook"), []byte("#!/bin/sh\necho ran \"$@\"\nexit 2\n"), 0755))
+	withSettings(t, map[string]interface{}{"run-scope-slice": "ansible-puller.slice", "run-scope-properties": []string{"MemoryMax=2G"}})
+
+	original := runScopeInvocations
+	runScopeInvocations = 0
+	defer func() { runScopeInvocations = original }()
+
+	cmd := VenvCommand{Config: VenvConfig{Path: venv}, Binary: "ansible-playbook", Args: []string{"site.yml"}, Scope: "run-1"}
+	output := cmd.Run()
+	assert.Equal(t, "ran site.yml\n", output.Stdout)
+	assert.Equal(t, 2, output.Exitcode)
+	called, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, "systemd-run --scope --quiet --collect --unit run-1-1.scope --description Ansible run of ansible-puller"+
+		" --slice ansible-puller.slice --property CPUAccounting=yes --property MemoryAccounting=yes"+
+		" --property TasksAccounting=yes --property IOAccounting=yes --property MemoryMax=2G"+
+		" -- "+filepath.Join(venv, "bin", "ansible-playbook")+" site.yml\n"+
+		"systemctl is-active --quiet run-1-1.scope\n", string(called))
+
+	assert.Nil(t, ioutil.WriteFile(calls, nil, 0644))
+	cmd.Scope = "leftover"
+	cmd.Run()
+	called, err = ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Contains(t, string(called), "systemctl stop leftover-2.scope\n")
+}
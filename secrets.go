@@ -0,0 +1,152 @@
+// Secrets the puller needs at run time, from files, AWS Secrets Manager or HashiCorp Vault
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Prefixes of secret references, anything else is a file path
+const (
+	secretSchemeFile           = "file://"
+	secretSchemeSecretsManager = "aws-sm://" // aws-sm://<secret name or ARN>
+	secretSchemeVault          = "vault://"  // vault://<mount>/<path>#<field>, from a KV version 2 engine
+)
+
+// resolveSecret returns the secret ref refers to, masking it in command output and logs from then on.
+func resolveSecret(ref string) ([]byte, error) {
+	secret, err := readSecret(ref)
+	if err == nil {
+		addRedactedValue(string(secret))
+	}
+	return secret, err
+}
+
+func readSecret(ref string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, secretSchemeSecretsManager):
+		return secretsManagerSecret(strings.TrimPrefix(ref, secretSchemeSecretsManager))
+	case strings.HasPrefix(ref, secretSchemeVault):
+		return vaultSecret(strings.TrimPrefix(ref, secretSchemeVault))
+	}
+
+	secret, err := ioutil.ReadFile(strings.TrimPrefix(ref, secretSchemeFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read secret")
+	}
+	return secret, nil
+}
+
+// secretsManagerSecret returns the string, or else binary, value of a secret in AWS Secrets Manager, with
+// credentials from the default chain.
+func secretsManagerSecret(id string) ([]byte, error) {
+	awsConfig, err := loadAWSConfig(context.TODO(), regionFromARN(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load AWS configuration")
+	}
+
+	request, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"X-Amz-Target": "secretsmanager.GetSecretValue"}
+	response, err := newAWSAPIClient(awsConfig, "secretsmanager").post("application/x-amz-json-1.1", headers, request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get secret %s", id)
+	}
+
+	return parseSecretValue(response)
+}
+
+// parseSecretValue returns the secret of a GetSecretValue response.
+func parseSecretValue(response []byte) ([]byte, error) {
+	var value struct {
+		SecretString *string
+		SecretBinary *string // Base64 encoded
+	}
+	if err := json.Unmarshal(response, &value); err != nil {
+		return nil, errors.Wrap(err, "unable to parse secret")
+	}
+
+	switch {
+	case value.SecretString != nil:
+		return []byte(*value.SecretString), nil
+	case value.SecretBinary != nil:
+		return base64.StdEncoding.DecodeString(*value.SecretBinary)
+	}
+	return nil, errors.New("secret has no value")
+}
+
+// vaultSecret returns a field of a secret in a KV version 2 engine of Vault, authenticating with the token of
+// vault-token-file or VAULT_TOKEN.
+func vaultSecret(ref string) ([]byte, error) {
+	path, field := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		path, field = ref[:i], ref[i+1:]
+	}
+	mount, secretPath := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		mount, secretPath = path[:i], path[i+1:]
+	}
+	if field == "" || secretPath == "" {
+		return nil, errors.Errorf("invalid vault secret %q, expected vault://<mount>/<path>#<field>", ref)
+	}
+
+	addr := viper.GetString("vault-addr")
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, errors.New("vault secrets require vault-addr or VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if tokenFile := viper.GetString("vault-token-file"); tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read vault-token-file")
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(addr, "/"), mount, secretPath), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to reach vault")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unable to get vault secret %s: %s", path, resp.Status)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, errors.Wrap(err, "unable to parse vault secret")
+	}
+	value, ok := secret.Data.Data[field].(string)
+	if !ok {
+		return nil, errors.Errorf("vault secret %s has no field %s", path, field)
+	}
+
+	return []byte(value), nil
+}
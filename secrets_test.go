@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("key"), 0600))
+
+	for _, ref := range []string{path, "file://" + path} {
+		secret, err := resolveSecret(ref)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key"), secret)
+	}
+
+	_, err := resolveSecret(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestParseSecretValue(t *testing.T) {
+	secret, err := parseSecretValue([]byte(`{"Name": "edge-ssh", "SecretString": "key"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key"), secret)
+
+	secret, err = parseSecretValue([]byte(`{"SecretBinary": "` + base64.StdEncoding.EncodeToString([]byte("binary")) + `"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("binary"), secret)
+
+	_, err = parseSecretValue([]byte(`{"Name": "edge-ssh"}`))
+	assert.NotNil(t, err)
+}
+
+func TestResolveSecretVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/secret/data/edge/site1", r.URL.Path)
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"private_key": "key"}, "metadata": {"version": 3}}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("vault-token\n"), 0600))
+	originalAddr, originalToken := viper.Get("vault-addr"), viper.Get("vault-token-file")
+	defer func() {
+		viper.Set("vault-addr", originalAddr)
+		viper.Set("vault-token-file", originalToken)
+	}()
+	viper.Set("vault-addr", server.URL)
+	viper.Set("vault-token-file", tokenFile)
+
+	secret, err := resolveSecret("vault://secret/edge/site1#private_key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key"), secret)
+
+	_, err = resolveSecret("vault://secret/edge/site1#password")
+	assert.Contains(t, err.Error(), "has no field password")
+
+	_, err = resolveSecret("vault://secret/edge/site1")
+	assert.Contains(t, err.Error(), "invalid vault secret")
+
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("wrong"), 0600))
+	_, err = resolveSecret("vault://secret/edge/site1#private_key")
+	assert.Contains(t, err.Error(), "403")
+}
@@ -0,0 +1,65 @@
+// Registration of the daemon with the host's service manager
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const serviceDescription = "Runs Ansible in pull mode from a tarball on HTTP, S3, GCS or Azure Blob storage, or from a Git repository"
+
+// serviceExecutable returns the absolute path of the running binary, which is what the service manager will launch.
+func serviceExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find the path of the running executable")
+	}
+
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to resolve the path of the running executable")
+	}
+
+	return exe, nil
+}
+
+func runServiceCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s service install|uninstall|start|stop", appName)
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService()
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = startService()
+	case "stop":
+		err = stopService()
+	default:
+		return fmt.Errorf("unknown service operation: %s", args[0])
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to %s service", args[0])
+	}
+
+	logrus.Infof("Service %s succeeded", args[0])
+	return nil
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "service",
+		Usage:       "install|uninstall|start|stop",
+		Description: "Manage the Windows service or launchd daemon",
+		Operations:  []string{"install", "uninstall", "start", "stop"},
+		Run:         runServiceCommand,
+	})
+}
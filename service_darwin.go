@@ -0,0 +1,109 @@
+// launchd integration for macOS hosts
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const launchdLabel = "com.teslamotors.ansible-puller"
+
+var launchdPlistTemplate = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{{.Label}}</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>{{.Executable}}</string>
+    </array>
+    <key>WorkingDirectory</key>
+    <string>/</string>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <true/>
+    <key>ThrottleInterval</key>
+    <integer>5</integer>
+    <key>StandardOutPath</key>
+    <string>{{.LogFile}}</string>
+    <key>StandardErrorPath</key>
+    <string>{{.LogFile}}</string>
+</dict>
+</plist>
+`))
+
+func launchdPlistPath() string {
+	return filepath.Join("/Library/LaunchDaemons", launchdLabel+".plist")
+}
+
+func launchctl(args ...string) error {
+	cmd := exec.Command("launchctl", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "launchctl %v failed: %s", args, output)
+	}
+
+	return nil
+}
+
+// installService writes a launchd daemon definition and loads it, which also starts the daemon.
+func installService() error {
+	exe, err := serviceExecutable()
+	if err != nil {
+		return err
+	}
+
+	plist, err := os.OpenFile(launchdPlistPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to create launchd plist")
+	}
+	defer plist.Close()
+
+	err = launchdPlistTemplate.Execute(plist, struct {
+		Label      string
+		Executable string
+		LogFile    string
+	}{
+		launchdLabel,
+		exe,
+		filepath.Join(viper.GetString("log-dir"), appName+".log"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to write launchd plist")
+	}
+	if err := plist.Close(); err != nil {
+		return err
+	}
+
+	return startService()
+}
+
+func uninstallService() error {
+	if err := stopService(); err != nil {
+		return err
+	}
+
+	return os.Remove(launchdPlistPath())
+}
+
+// As the daemon is kept alive by launchd, starting and stopping it is done by (un)loading the definition.
+func startService() error {
+	return launchctl("load", "-w", launchdPlistPath())
+}
+
+func stopService() error {
+	return launchctl("unload", "-w", launchdPlistPath())
+}
+
+func runningAsService() bool {
+	return false
+}
+
+func runService() {}
@@ -0,0 +1,29 @@
+//go:build !darwin && !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+var errServiceUnsupported = errors.New("not supported on this platform, use the packaged systemd unit instead")
+
+func installService() error {
+	return errServiceUnsupported
+}
+
+func uninstallService() error {
+	return errServiceUnsupported
+}
+
+func startService() error {
+	return errServiceUnsupported
+}
+
+func stopService() error {
+	return errServiceUnsupported
+}
+
+func runningAsService() bool {
+	return false
+}
+
+func runService() {}
@@ -0,0 +1,127 @@
+// Windows service integration
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const windowsServiceName = "ansible-puller"
+
+// windowsService adapts the daemon to the service control manager's protocol.
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go runDaemon()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			logrus.Infoln("Received stop request from the service control manager")
+			wait := drainTimeout() + 2*processStopGrace
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(wait / time.Millisecond)}
+			stopPuller()
+			flushEvents()
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		logrus.Warnln("Unable to detect whether running as a Windows service: ", err)
+		return false
+	}
+
+	return isService
+}
+
+func runService() {
+	if err := svc.Run(windowsServiceName, windowsService{}); err != nil {
+		logrus.Fatalln("Windows service failed: ", err)
+	}
+}
+
+// withService connects to the service control manager and opens the puller's service.
+func withService(fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to the service control manager")
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return errors.Wrap(err, "unable to open service")
+	}
+	defer s.Close()
+
+	return fn(s)
+}
+
+// installService registers an automatically started service that is restarted if it dies.
+func installService() error {
+	exe, err := serviceExecutable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to the service control manager")
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(windowsServiceName, exe, mgr.Config{
+		DisplayName: "Ansible Puller",
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to create service")
+	}
+	defer s.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return errors.Wrap(err, "unable to configure service recovery")
+	}
+
+	return s.Start()
+}
+
+func uninstallService() error {
+	return withService(func(s *mgr.Service) error {
+		if _, err := s.Control(svc.Stop); err != nil {
+			logrus.Debugln("Unable to stop service before removal: ", err)
+		}
+
+		return s.Delete()
+	})
+}
+
+func startService() error {
+	return withService(func(s *mgr.Service) error {
+		return s.Start()
+	})
+}
+
+func stopService() error {
+	return withService(func(s *mgr.Service) error {
+		_, err := s.Control(svc.Stop)
+		return err
+	})
+}
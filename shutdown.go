@@ -0,0 +1,166 @@
+// Graceful shutdown on SIGTERM and SIGINT, so that a restart doesn't leave a run half-applied without a trace
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// How long a cancelled command has to exit before its process group is killed
+const processStopGrace = 10 * time.Second
+
+// Holder of the run lock while the puller shuts down
+const shutdownRunID = "shutdown"
+
+var errShuttingDown = errors.New("the puller is shutting down")
+
+// shutdownError is returned by commands that were cancelled by a shutdown of the puller.
+type shutdownError struct {
+	error
+}
+
+func (shutdownError) Interrupted() bool {
+	return true
+}
+
+// Read-held by the daemon loop and by runs started through the API from before they run until their state is
+// recorded, so that the puller doesn't exit in between
+var recordingRuns sync.RWMutex
+
+var shutdown = struct {
+	sync.Mutex
+	started bool
+	ctx     context.Context // Cancelled once the drain timeout expires, stopping the commands still running
+	cancel  context.CancelFunc
+}{}
+
+// runsContext returns the context of the commands of runs, cancelled when the puller shuts down without waiting for
+// them any longer.
+func runsContext() context.Context {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+
+	if shutdown.ctx == nil {
+		shutdown.ctx, shutdown.cancel = context.WithCancel(context.Background())
+	}
+	return shutdown.ctx
+}
+
+func cancelRuns() {
+	runsContext()
+	shutdown.cancel()
+}
+
+// shuttingDown reports whether the puller is shutting down, in which case no new runs start.
+func shuttingDown() bool {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+
+	return shutdown.started
+}
+
+// interruptedByShutdown returns the error of a command that failed with err once ctx was done, if it was the
+// shutdown of the puller that stopped it.
+func interruptedByShutdown(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || runsContext().Err() == nil {
+		return nil
+	}
+	return shutdownError{errors.Wrap(err, "cancelled by the shutdown of the puller")}
+}
+
+func drainTimeout() time.Duration {
+	return time.Duration(viper.GetInt("shutdown-drain-timeout")) * time.Minute
+}
+
+// watchShutdownSignals shuts the puller down on SIGTERM or SIGINT, then calls stopped if it isn't nil, once the
+// state of the in-flight run is recorded. A second signal cancels the in-flight run without waiting for the drain
+// timeout.
+func watchShutdownSignals(stopped func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %s, shutting down", sig)
+		go func() {
+			sig := <-signals
+			logrus.Warnf("Received %s again, cancelling the in-flight run", sig)
+			cancelRuns()
+		}()
+
+		if stopped != nil {
+			stopPuller()
+			stopped()
+		} else {
+			// The runs of --once record their state before the puller exits
+			shutdownPuller(drainTimeout())()
+		}
+	}()
+}
+
+// stopPuller shuts the puller down, and returns once the state of the run that was in flight is recorded and the run
+// lock is released, after which no run starts any longer.
+func stopPuller() {
+	// Given back to the run that waits for it, which is skipped as the puller is shutting down
+	shutdownPuller(drainTimeout())()
+	recordingRuns.Lock()
+}
+
+// shutdownPuller stops runs from starting, and waits up to timeout for the in-flight run to finish before cancelling
+// it. It returns once no run is executing any longer, holding the run lock until the returned function is called.
+func shutdownPuller(timeout time.Duration) func() {
+	shutdown.Lock()
+	shutdown.started = true
+	shutdown.Unlock()
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logrus.Debugln("Unable to notify systemd of the shutdown: ", err)
+	}
+
+	inFlight := runsLock.status()
+	acquired := make(chan func(), 1)
+	go func() {
+		release, err := runsLock.acquire(shutdownRunID)
+		if err != nil {
+			logrus.Warnln("Unable to take the run lock while shutting down: ", err)
+			release = func() {}
+		}
+		acquired <- release
+	}()
+
+	if inFlight.Held {
+		logrus.Infof("Waiting up to %s for run %s to finish", timeout, inFlight.RunID)
+	}
+	select {
+	case release := <-acquired:
+		if inFlight.Held {
+			logrus.Infof("Run %s finished, shutting down", inFlight.RunID)
+		}
+		return release
+	case <-time.After(timeout):
+	}
+	if !inFlight.Held {
+		logrus.Warnf("The run lock is still held by another process after %s, shutting down anyway", timeout)
+		return func() {}
+	}
+
+	logrus.Warnf("Run %s did not finish within %s, cancelling it", inFlight.RunID, timeout)
+	cancelRuns()
+	select {
+	case release := <-acquired:
+		logrus.Warnf("Run %s was cancelled by the shutdown, the host may be partially configured", inFlight.RunID)
+		return release
+	case <-time.After(2 * processStopGrace):
+		logrus.Errorf("Run %s did not stop after being cancelled, shutting down anyway", inFlight.RunID)
+		return func() {}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withShutdownState sets a new state directory for the run lock, and undoes the shutdown after the test.
+func withShutdownState(t *testing.T) {
+	original := viper.Get("state-dir")
+	viper.Set("state-dir", t.TempDir())
+	t.Cleanup(func() {
+		shutdown.Lock()
+		shutdown.started, shutdown.ctx, shutdown.cancel = false, nil, nil
+		shutdown.Unlock()
+		viper.Set("state-dir", original)
+	})
+}
+
+func TestShutdownWaitsForRun(t *testing.T) {
+	withShutdownState(t)
+
+	release, err := runsLock.acquire("run-1")
+	assert.Nil(t, err)
+	time.AfterFunc(100*time.Millisecond, release)
+
+	start := time.Now()
+	shutdownPuller(time.Minute)()
+	assert.True(t, shuttingDown())
+	assert.Less(t, int64(time.Since(start)), int64(time.Minute))
+	assert.Nil(t, runsContext().Err())
+
+	// Later runs are skipped, without being recorded as failed
+	assert.Equal(t, errRunSkipped, ansibleRun(runTriggerSchedule, playbooks[0]))
+	_, err = executeRun(runSpec{})
+	assert.Equal(t, errShuttingDown, err)
+}
+
+func TestShutdownCancelsRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	withShutdownState(t)
+
+	venv := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(venv, "bin"), 0755))
+	assert.Nil(t, os.Symlink(sleep, filepath.Join(venv, "bin", "sleep")))
+
+	release, err := runsLock.acquire("run-1")
+	assert.Nil(t, err)
+	outputs := make(chan VenvCommandRunOutput, 1)
+	go func() {
+		defer release()
+		outputs <- VenvCommand{Config: VenvConfig{Path: venv}, Binary: "sleep", Args: []string{"30"}}.Run()
+	}()
+
+	start := time.Now()
+	shutdownPuller(100 * time.Millisecond)()
+	assert.Less(t, int64(time.Since(start)), int64(processStopGrace))
+
+	output := <-outputs
+	assert.Contains(t, output.Error.Error(), "cancelled by the shutdown of the puller")
+	assert.Equal(t, runOutcomeInterrupted, runOutcomeOf(output.Error))
+	assert.Equal(t, exitRunInterrupted, onceExitCode(output.Error))
+}
+
+func TestStopPullerWaitsForRunState(t *testing.T) {
+	withShutdownState(t)
+
+	// A run of the daemon loop, which records its state once it gave the run lock back
+	recorded := make(chan struct{})
+	recordingRuns.RLock()
+	release, err := runsLock.acquire("run-1")
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		release()
+		time.Sleep(100 * time.Millisecond)
+		close(recorded)
+		recordingRuns.RUnlock()
+	}()
+
+	stopPuller()
+	defer recordingRuns.Unlock()
+	select {
+	case <-recorded:
+	default:
+		t.Fatal("stopped before the state of the run was recorded")
+	}
+	assert.False(t, runsLock.status().Held)
+}
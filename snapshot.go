@@ -0,0 +1,99 @@
+// Snapshot of the environment of each run, kept in the run history so that a failing run can be reproduced later
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runEnvironment is what ansible-playbook ran with.
+type runEnvironment struct {
+	Command       []string `json:"command"`                  // Path of ansible-playbook and its arguments
+	Dir           string   `json:"dir"`                      // Working directory
+	Env           []string `json:"env"`                      // As NAME=value, with secrets redacted
+	Artifact      string   `json:"artifact,omitempty"`       // MD5 of the artifact
+	PackagesHash  string   `json:"packages_hash,omitempty"`  // SHA-256 of the sorted pip freeze of the virtualenv
+	AnsibleConfig string   `json:"ansible_config,omitempty"` // Output of ansible-config dump --only-changed
+}
+
+// venvPackages returns the packages installed in the virtualenv as listed by pip freeze, sorted.
+func venvPackages(cfg VenvConfig) ([]string, error) {
+	output := cfg.pip("freeze", "--all", "--disable-pip-version-check").Run()
+	if output.Error != nil {
+		return nil, errors.Wrap(output.Error, "unable to list the packages of the virtualenv")
+	}
+
+	packages := []string{}
+	if freeze := strings.TrimSpace(output.Stdout); freeze != "" {
+		packages = strings.Split(freeze, "\n")
+	}
+	sort.Strings(packages)
+	return packages, nil
+}
+
+// venvPackagesHash returns the SHA-256 of the packages installed in the virtualenv, as listed by pip freeze.
+func venvPackagesHash(cfg VenvConfig) (string, error) {
+	packages, err := venvPackages(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(packages, "\n") + "\n"))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ansibleConfigDump returns the settings of Ansible that differ from its defaults, as they apply to the run.
+func ansibleConfigDump(runner AnsiblePlaybookRunner) (string, error) {
+	output := VenvCommand{
+		Config:   runner.AnsibleConfig.VenvConfig,
+		Binary:   "ansible-config",
+		Args:     []string{"dump", "--only-changed"},
+		Cwd:      runner.AnsibleConfig.Cwd,
+		Env:      runner.env(),
+		Executor: runner.AnsibleConfig.Executor,
+	}.Run()
+	if output.Error != nil {
+		return "", errors.Wrap(output.Error, "unable to dump the Ansible config")
+	}
+	return redact(output.Stdout), nil
+}
+
+// captureRunEnvironment returns the environment the runner is about to run ansible-playbook with. What can't be
+// captured is left out, logging a warning, rather than failing the run.
+func captureRunEnvironment(runner AnsiblePlaybookRunner, artifactFile string) *runEnvironment {
+	cmd, err := runner.command()
+	if err != nil {
+		logrus.Warnln("Unable to capture the environment of the run: ", err)
+		return nil
+	}
+	process, err := cmd.process()
+	if err != nil {
+		logrus.Warnln("Unable to capture the environment of the run: ", err)
+		return nil
+	}
+
+	environment := &runEnvironment{Dir: cmd.Cwd, Env: redactEnv(process.Env)}
+	for _, arg := range process.Args {
+		environment.Command = append(environment.Command, redact(arg))
+	}
+	if environment.Artifact, err = md5sum(artifactFile); err != nil {
+		logrus.Warnln("Unable to hash the artifact of the run: ", err)
+	}
+	// The packages of images are identified by the image
+	if _, ok := cmd.Executor.(containerExecutor); !ok {
+		if environment.PackagesHash, err = venvPackagesHash(cmd.Config); err != nil {
+			logrus.Warnln(err)
+		}
+	}
+	if environment.AnsibleConfig, err = ansibleConfigDump(runner); err != nil {
+		logrus.Warnln(err)
+	}
+
+	return environment
+}
@@ -0,0 +1,75 @@
+// Unix domain socket serving the API to local tooling, access to which is controlled by file permissions
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+type socketRequestKey struct{}
+
+// listenSocket creates the unix socket at path, replacing a stale one, with the permissions of http-socket-mode and
+// the group of http-socket-group.
+func listenSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("%s is in use by another puller", path)
+		}
+		// Left behind by a puller that did not stop cleanly
+		os.Remove(path)
+	}
+
+	mode, err := strconv.ParseUint(viper.GetString("http-socket-mode"), 8, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid http-socket-mode")
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen on http-socket")
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "unable to set the permissions of http-socket")
+	}
+	if groupName := viper.GetString("http-socket-group"); groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "unable to find http-socket-group")
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(path, -1, gid); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "unable to set the group of http-socket")
+		}
+	}
+
+	return listener, nil
+}
+
+// socketHandler marks requests to next as received on the socket, where the file permissions are the
+// authentication.
+func socketHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), socketRequestKey{}, true)))
+	})
+}
+
+// isSocketRequest returns whether r was received on the socket.
+func isSocketRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(socketRequestKey{}).(bool)
+	return local
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func withSocketConfig(mode string) func() {
+	originalMode, originalGroup := viper.Get("http-socket-mode"), viper.Get("http-socket-group")
+	viper.Set("http-socket-mode", mode)
+	viper.Set("http-socket-group", "")
+	return func() {
+		viper.Set("http-socket-mode", originalMode)
+		viper.Set("http-socket-group", originalGroup)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	defer withSocketConfig("0660")()
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	listener, err := listenSocket(path)
+	assert.Nil(t, err)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	// A live socket belongs to another puller
+	_, err = listenSocket(path)
+	assert.NotNil(t, err)
+	listener.Close()
+
+	// One left behind is replaced
+	stale, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listenSocket(path)
+	assert.Nil(t, err)
+	listener.Close()
+}
+
+func TestListenSocketRefusesOtherFiles(t *testing.T) {
+	defer withSocketConfig("0660")()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0600))
+
+	_, err := listenSocket(path)
+	assert.NotNil(t, err)
+
+	viper.Set("http-socket-mode", "rw")
+	_, err = listenSocket(filepath.Join(t.TempDir(), "api.sock"))
+	assert.NotNil(t, err)
+}
+
+func TestSocketSkipsAuthentication(t *testing.T) {
+	defer withArtifactCache(t, 3, 0)()
+	defer withSocketConfig("0600")()
+	restore, err := withHTTPAuth(t, testAuthToken, map[string]string{"read": "token"})
+	defer restore()
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := listenSocket(path)
+	assert.Nil(t, err)
+	srv := &http.Server{Handler: socketHandler(NewServer(func() {}).Handler)}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	// Over TCP the token is required, on the socket it is not
+	assert.Equal(t, http.StatusUnauthorized, serveAPI("GET", httpPathStatus, "", nil).Code)
+
+	client := newDaemonClient(unixURLScheme + path)
+	_, _, err = client.status()
+	assert.Nil(t, err)
+	_, err = client.post(httpPathCachePurge, nil)
+	assert.Nil(t, err)
+}
+
+func TestDefaultDaemonURLSocket(t *testing.T) {
+	original := viper.Get("http-socket")
+	defer viper.Set("http-socket", original)
+
+	viper.Set("http-socket", "/run/ansible-puller.sock")
+	assert.Equal(t, "unix:///run/ansible-puller.sock", defaultDaemonURL())
+}
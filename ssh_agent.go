@@ -0,0 +1,127 @@
+// SSH agent holding the keys of controller mode for the duration of a run, so they never touch the disk
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// How long to wait for a started ssh-agent to listen on its socket
+const sshAgentStartTimeout = 5 * time.Second
+
+// sshAgent is an ssh-agent started for a run, listening on a socket in a directory only the puller can access.
+type sshAgent struct {
+	cmd    *exec.Cmd
+	dir    string
+	socket string
+}
+
+// startSSHAgent starts an ssh-agent and adds keys to it, each a private key as ssh-add reads it. The keys are
+// dropped by the agent after lifetime, or when it is stopped, whichever comes first.
+func startSSHAgent(keys [][]byte, lifetime time.Duration) (*sshAgent, error) {
+	dir, err := ioutil.TempDir("", appName+"-agent-")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create ssh-agent directory")
+	}
+	agent := &sshAgent{dir: dir, socket: filepath.Join(dir, "agent.sock")}
+
+	// -D keeps the agent in the foreground, as a child that can be stopped
+	agent.cmd = exec.Command("ssh-agent", "-D", "-a", agent.socket)
+	if err := agent.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "unable to start ssh-agent")
+	}
+
+	if err := agent.waitForSocket(); err != nil {
+		agent.stop()
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := agent.add(key, lifetime); err != nil {
+			agent.stop()
+			return nil, errors.Wrapf(err, "unable to add key %d to ssh-agent", i+1)
+		}
+	}
+
+	return agent, nil
+}
+
+func (a *sshAgent) waitForSocket() error {
+	deadline := time.Now().Add(sshAgentStartTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(a.socket); err == nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("ssh-agent did not start listening in time")
+}
+
+// add adds key to the agent, passing it to ssh-add on stdin.
+func (a *sshAgent) add(key []byte, lifetime time.Duration) error {
+	if !bytes.HasSuffix(key, []byte("\n")) {
+		// ssh refuses keys without the final newline
+		key = append(key, '\n')
+	}
+
+	args := []string{"-q"}
+	if lifetime > 0 {
+		args = append(args, "-t", fmt.Sprintf("%d", int(lifetime.Seconds())))
+	}
+	cmd := exec.Command("ssh-add", append(args, "-")...)
+	cmd.Env = append(os.Environ(), a.env())
+	cmd.Stdin = bytes.NewReader(key)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// env returns the environment variable pointing ssh at the agent.
+func (a *sshAgent) env() string {
+	return "SSH_AUTH_SOCK=" + a.socket
+}
+
+// stop kills the agent, and with it the keys it holds, and removes its socket.
+func (a *sshAgent) stop() {
+	if a.cmd.Process != nil {
+		if err := a.cmd.Process.Kill(); err != nil {
+			logrus.Warnln("Unable to stop ssh-agent: ", err)
+		}
+		a.cmd.Wait()
+	}
+	os.RemoveAll(a.dir)
+}
+
+// startControllerSSHAgent starts an agent with the keys of ansible-controller-ssh-key, or returns nil if none are
+// configured. The caller stops it after the run.
+func startControllerSSHAgent() (*sshAgent, error) {
+	refs := viper.GetStringSlice("ansible-controller-ssh-key")
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, ref := range refs {
+		key, err := resolveSecret(ref)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to get ansible-controller-ssh-key")
+		}
+		keys = append(keys, key)
+	}
+
+	// Keys outliving a run killed along with the puller are dropped by the agent all the same
+	return startSSHAgent(keys, time.Duration(viper.GetInt("ansible-timeout"))*time.Minute+time.Minute)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSSHKey generates a private key with ssh-keygen, skipping the test without OpenSSH.
+func testSSHKey(t *testing.T) string {
+	for _, tool := range []string{"ssh-agent", "ssh-add", "ssh-keygen"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not found")
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "puller-test", "-f", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen failed: %s: %s", err, output)
+	}
+	return path
+}
+
+func TestControllerSSHAgent(t *testing.T) {
+	keyFile := testSSHKey(t)
+	original := viper.Get("ansible-controller-ssh-key")
+	defer viper.Set("ansible-controller-ssh-key", original)
+
+	viper.Set("ansible-controller-ssh-key", []string{})
+	agent, err := startControllerSSHAgent()
+	assert.Nil(t, err)
+	assert.Nil(t, agent)
+
+	// Without the final newline, as secret backends tend to return keys
+	key, err := ioutil.ReadFile(keyFile)
+	assert.Nil(t, err)
+	secret := filepath.Join(t.TempDir(), "key")
+	assert.Nil(t, ioutil.WriteFile(secret, []byte(strings.TrimSpace(string(key))), 0600))
+	viper.Set("ansible-controller-ssh-key", []string{"file://" + secret})
+
+	agent, err = startControllerSSHAgent()
+	assert.Nil(t, err)
+	if agent == nil {
+		return
+	}
+
+	list := exec.Command("ssh-add", "-l")
+	list.Env = append(os.Environ(), agent.env())
+	output, err := list.CombinedOutput()
+	assert.Nil(t, err, string(output))
+	assert.Contains(t, string(output), "puller-test")
+
+	agent.stop()
+	_, err = os.Stat(agent.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSSHAgentInvalidKey(t *testing.T) {
+	testSSHKey(t)
+
+	_, err := startSSHAgent([][]byte{[]byte("not a key")}, time.Minute)
+	assert.NotNil(t, err)
+}
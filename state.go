@@ -0,0 +1,335 @@
+// Persistent local state of the puller, kept under the state directory
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const stateFileName = "state.json"
+
+var stateMutex sync.Mutex
+
+// PullerState is the information that has to survive a restart or re-image of the host.
+type PullerState struct {
+	LastArtifactChecksum string    `json:"last_artifact_checksum"`    // MD5 of the last artifact that was run
+	LastRunTime          time.Time `json:"last_run_time"`             // When the last run finished
+	LastRunSuccess       bool      `json:"last_run_success"`          // Whether the last run succeeded
+	LastRunOutcome       string    `json:"last_run_outcome"`          // success, noop, failed, timeout or unreachable
+	LastSuccessTime      time.Time `json:"last_success_time"`         // When the last run applying the playbook succeeded
+	ConsecutiveFailures  int       `json:"consecutive_failures"`      // Number of failed runs since the last success
+	LastRunCPUSeconds    float64   `json:"last_run_cpu_seconds"`      // CPU time used by the last ansible execution
+	LastRunPeakRSSBytes  uint64    `json:"last_run_peak_rss_bytes"`   // Peak RSS of the last ansible execution
+	Decommissioned       bool      `json:"decommissioned"`            // Whether the host has been decommissioned
+	Disabled             bool      `json:"disabled"`                  // Whether the puller was disabled on request
+	DisableReason        string    `json:"disable_reason,omitempty"`  // Why it was disabled
+	DisabledUntil        time.Time `json:"disabled_until"`            // When it enables itself again, zero if never
+	VenvPath             string    `json:"venv_path,omitempty"`       // Virtualenv switched to by an upgrade, venv-path if empty
+	AnsibleVersion       string    `json:"ansible_version,omitempty"` // ansible-core version pinned by an upgrade
+	PinnedVersion        string    `json:"pinned_version,omitempty"`  // MD5 of the artifact pinned on request
+	PinReason            string    `json:"pin_reason,omitempty"`      // Why it was pinned
+	FreezeOverrideUntil  time.Time `json:"freeze_override_until"`     // Until when change freezes don't skip runs
+	FreezeOverrideReason string    `json:"freeze_override_reason,omitempty"`
+	FirstDeferralTime    time.Time `json:"first_deferral_time"` // When scheduled runs started to be deferred, zero if they aren't
+
+	// Last runs of each configured playbook by name, so that the runs of one don't hide the failures of another
+	Playbooks map[string]playbookRunState `json:"playbooks,omitempty"`
+}
+
+// playbookRunState is how the last runs of a playbook went.
+type playbookRunState struct {
+	LastRunTime         time.Time `json:"last_run_time"`
+	LastRunSuccess      bool      `json:"last_run_success"`
+	LastRunOutcome      string    `json:"last_run_outcome"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// playbookStateName returns the name the state of the runs of playbook is kept under. Runs of ansible-playbook
+// outside of the configured playbooks count as the default one.
+func playbookStateName(playbook string) string {
+	if playbook == "" {
+		return defaultScheduleName
+	}
+	return playbook
+}
+
+// playbook returns how the last runs of the playbook called name went.
+func (s PullerState) playbook(name string) playbookRunState {
+	if s.Playbooks == nil {
+		// Written before the state was kept per playbook, when the runs of all playbooks counted as one
+		return playbookRunState{
+			LastRunTime:         s.LastRunTime,
+			LastRunSuccess:      s.LastRunSuccess,
+			LastRunOutcome:      s.LastRunOutcome,
+			ConsecutiveFailures: s.ConsecutiveFailures,
+		}
+	}
+	return s.Playbooks[playbookStateName(name)]
+}
+
+// lastSuccess returns when the last run applying the playbook succeeded, zero if none did.
+func (s PullerState) lastSuccess() time.Time {
+	if s.LastSuccessTime.IsZero() && s.LastRunSuccess {
+		// Written before the time of the last success was kept
+		return s.LastRunTime
+	}
+	return s.LastSuccessTime
+}
+
+func stateDir() string {
+	return viper.GetString("state-dir")
+}
+
+func stateFilePath() string {
+	return filepath.Join(stateDir(), stateFileName)
+}
+
+func ensureStateDir() error {
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return errors.Wrap(err, "unable to create state directory")
+	}
+
+	return nil
+}
+
+// loadState reads the state file, returning an empty state if none has been written yet.
+func loadState() (PullerState, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	return readState()
+}
+
+// readState reads the state file. The caller must hold stateMutex.
+func readState() (PullerState, error) {
+	var state PullerState
+
+	data, err := readStateFile(stateFilePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, errors.Wrap(err, "unable to read state file")
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Wrap(err, "unable to parse state file")
+	}
+
+	return state, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place,
+// so that a crash never leaves a half-written file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile := path + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, path)
+}
+
+func saveState(state PullerState) error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize state")
+	}
+
+	if err := writeStateFile(stateFilePath(), data); err != nil {
+		return errors.Wrap(err, "unable to write state file")
+	}
+
+	return nil
+}
+
+// updateState applies fn to the persisted state and writes the result back.
+func updateState(fn func(*PullerState)) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state, err := readState()
+	if err != nil {
+		return err
+	}
+
+	fn(&state)
+
+	return saveState(state)
+}
+
+// exportedStateFiles returns the names of the files in the state directory that make up the state of the host, as
+// exported: the results of its runs and what they applied. Caches, the PID file and the run lock belong to the host
+// and its processes.
+func exportedStateFiles() []string {
+	return []string{
+		stateFileName,
+		runHistoryFileName,
+		failureTableFileName,
+		appliedManifestFileName,
+		failedHostsFileName,
+		appliedArtifactFileName,
+	}
+}
+
+// exportState bundles the state files of the state directory into a single tarball.
+func exportState(dest string) error {
+	if _, err := os.Stat(stateDir()); err != nil {
+		return errors.Wrap(err, "unable to find state directory")
+	}
+
+	exported := map[string]bool{}
+	for _, name := range exportedStateFiles() {
+		exported[name] = true
+	}
+	return createTgzOf(stateDir(), dest, func(relPath string) bool {
+		return exported[relPath]
+	})
+}
+
+// importState replaces the state files of the state directory with those of a tarball created by exportState. It
+// fails while the daemon runs, which would overwrite them.
+//
+// The tarball is expanded next to the state directory first so that a bad file leaves the current state intact. The
+// state files are signed again with the key of this host, as they were signed with the key of the exporting one.
+func importState(src string) error {
+	if err := acquirePidFile(); err != nil {
+		return errors.Wrap(err, "unable to import state while the daemon runs")
+	}
+	defer releasePidFile()
+
+	dir := filepath.Clean(stateDir())
+	incoming := dir + ".import"
+	os.RemoveAll(incoming)
+	defer os.RemoveAll(incoming)
+
+	if err := extractTgz(src, incoming); err != nil {
+		return errors.Wrap(err, "unable to expand state snapshot")
+	}
+
+	// Only the state files, snapshots of older versions hold the whole directory
+	for _, name := range exportedStateFiles() {
+		path := filepath.Join(dir, name)
+		if err := os.Rename(filepath.Join(incoming, name), path); os.IsNotExist(err) {
+			// Not written on the exporting host
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "unable to remove %s", path)
+			}
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to import %s", name)
+		}
+	}
+
+	return errors.Wrap(resignStateFiles(), "unable to sign imported state")
+}
+
+func runStateCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s state export|import <file>", appName)
+	}
+
+	switch args[0] {
+	case "export":
+		if err := exportState(args[1]); err != nil {
+			return err
+		}
+		logrus.Infof("Exported state from %s to %s", stateDir(), args[1])
+	case "import":
+		if err := importState(args[1]); err != nil {
+			return err
+		}
+		logrus.Infof("Imported state from %s into %s", args[1], stateDir())
+	default:
+		return fmt.Errorf("unknown state operation: %s", args[0])
+	}
+
+	return nil
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "state",
+		Usage:       "export|import <file>",
+		Description: "Snapshot or restore the puller's local state",
+		Operations:  []string{"export", "import"},
+		Run:         runStateCommand,
+	})
+}
+
+// recordRunState persists the outcome of a run of playbook that returned err, along with the artifact it ran. The
+// last run succeeded, as far as the host is concerned, once the last runs of all the configured playbooks did.
+func recordRunState(playbook string, err error) {
+	if runSkipped(err) {
+		// Nothing ran
+		return
+	}
+	success := err == nil
+	// The runs of noop mode are check runs, which don't apply anything
+	outcome := noopOutcome(viper.GetBool("noop"), err)
+
+	checksum, sumErr := md5sum(localCacheFile)
+	if sumErr != nil {
+		logrus.Debugln("Unable to checksum the local artifact: ", sumErr)
+	}
+
+	name := playbookStateName(playbook)
+	configured := map[string]bool{name: true}
+	for _, playbook := range currentPlaybooks() {
+		configured[playbook.Name] = true
+	}
+	allSucceeded := success
+	err = updateState(func(state *PullerState) {
+		last := state.playbook(name)
+		last.LastRunTime = time.Now()
+		last.LastRunSuccess = success
+		last.LastRunOutcome = outcome
+		if success {
+			last.ConsecutiveFailures = 0
+		} else {
+			last.ConsecutiveFailures++
+		}
+		if state.Playbooks == nil {
+			state.Playbooks = map[string]playbookRunState{}
+		}
+		state.Playbooks[name] = last
+
+		if checksum != "" {
+			state.LastArtifactChecksum = checksum
+		}
+		state.LastRunTime = last.LastRunTime
+		state.LastRunOutcome = outcome
+		state.LastRunCPUSeconds = lastRunUsage.CPUTime.Seconds()
+		state.LastRunPeakRSSBytes = lastRunUsage.PeakRSSBytes
+		state.LastRunSuccess = true
+		state.ConsecutiveFailures = 0
+		for playbook, last := range state.Playbooks {
+			if !configured[playbook] {
+				// Removed by a reload
+				delete(state.Playbooks, playbook)
+				continue
+			}
+			state.LastRunSuccess = state.LastRunSuccess && last.LastRunSuccess
+			if last.ConsecutiveFailures > state.ConsecutiveFailures {
+				state.ConsecutiveFailures = last.ConsecutiveFailures
+			}
+		}
+		allSucceeded = state.LastRunSuccess
+	})
+	if err != nil {
+		logrus.Errorln("Unable to persist run state: ", err)
+	}
+	ansibleLastRunSuccess = allSucceeded
+}
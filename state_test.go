@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestStateTestSuite(t *testing.T) {
+	suite.Run(t, new(StateTestSuite))
+}
+
+type StateTestSuite struct {
+	suite.Suite
+	tmpDir           string
+	originalStateDir string
+	originalSuccess  bool
+}
+
+func (s *StateTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller_state")
+	assert.Nil(s.T(), err)
+
+	s.originalStateDir = viper.GetString("state-dir")
+	viper.Set("state-dir", filepath.Join(s.tmpDir, "state"))
+	s.originalSuccess = ansibleLastRunSuccess
+}
+
+func (s *StateTestSuite) TearDownTest() {
+	viper.Set("state-dir", s.originalStateDir)
+	ansibleLastRunSuccess = s.originalSuccess
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *StateTestSuite) TestLoadWithoutStateFile() {
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), PullerState{}, state)
+}
+
+func (s *StateTestSuite) TestUpdateState() {
+	now := time.Now().UTC().Truncate(time.Second)
+	err := updateState(func(state *PullerState) {
+		state.LastArtifactChecksum = testMD5
+		state.LastRunTime = now
+		state.LastRunSuccess = true
+	})
+	assert.Nil(s.T(), err)
+
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testMD5, state.LastArtifactChecksum)
+	assert.True(s.T(), now.Equal(state.LastRunTime))
+	assert.True(s.T(), state.LastRunSuccess)
+}
+
+func (s *StateTestSuite) TestRecordRunStateOutcome() {
+	recordRunState("", timeoutError{errors.New("Execution timed out after 2h0m0s")})
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), state.LastRunSuccess)
+	assert.Equal(s.T(), runOutcomeTimeout, state.LastRunOutcome)
+	assert.Equal(s.T(), 1, state.ConsecutiveFailures)
+
+	recordRunState("", nil)
+	state, err = loadState()
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), state.LastRunSuccess)
+	assert.Equal(s.T(), runOutcomeSuccess, state.LastRunOutcome)
+	assert.Equal(s.T(), 0, state.ConsecutiveFailures)
+
+	// Skipped runs, e.g. while disabled, leave the outcome of the last run alone
+	recordRunState("", timeoutError{errors.New("Execution timed out after 2h0m0s")})
+	before, err := loadState()
+	assert.Nil(s.T(), err)
+	recordRunState("", errRunSkipped)
+	recordRunState("", errShuttingDown)
+	state, err = loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), before, state)
+}
+
+func (s *StateTestSuite) TestRecordRunStatePerPlaybook() {
+	original := currentPlaybooks()
+	setPlaybooks([]playbookConfig{{Name: "base"}, {Name: "app"}})
+	defer setPlaybooks(original)
+
+	recordRunState("base", errors.New("exit status 2"))
+	recordRunState("app", nil)
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	// A success of another playbook neither resets the failures of base nor makes the host succeed again
+	assert.Equal(s.T(), 1, state.playbook("base").ConsecutiveFailures)
+	assert.True(s.T(), state.playbook("app").LastRunSuccess)
+	assert.False(s.T(), state.LastRunSuccess)
+	assert.Equal(s.T(), 1, state.ConsecutiveFailures)
+	assert.False(s.T(), ansibleLastRunSuccess)
+
+	recordRunState("base", nil)
+	state, err = loadState()
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), state.LastRunSuccess)
+	assert.Equal(s.T(), 0, state.ConsecutiveFailures)
+	assert.True(s.T(), ansibleLastRunSuccess)
+
+	// Playbooks removed by a reload no longer count
+	recordRunState("app", errors.New("exit status 2"))
+	setPlaybooks([]playbookConfig{{Name: "base"}})
+	recordRunState("base", nil)
+	state, err = loadState()
+	assert.Nil(s.T(), err)
+	assert.NotContains(s.T(), state.Playbooks, "app")
+	assert.True(s.T(), state.LastRunSuccess)
+}
+
+func (s *StateTestSuite) TestPlaybookStateBeforePlaybooks() {
+	state := PullerState{LastRunOutcome: runOutcomeFailed, ConsecutiveFailures: 2}
+	assert.Equal(s.T(), playbookRunState{LastRunOutcome: runOutcomeFailed, ConsecutiveFailures: 2}, state.playbook("app"))
+
+	state.Playbooks = map[string]playbookRunState{defaultScheduleName: {LastRunSuccess: true}}
+	assert.True(s.T(), state.playbook("").LastRunSuccess)
+	assert.Equal(s.T(), playbookRunState{}, state.playbook("app"))
+}
+
+func (s *StateTestSuite) TestRecordRunStateNoop() {
+	withSettings(s.T(), map[string]interface{}{"noop": true})
+
+	// Nothing was applied
+	recordRunState("", nil)
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), runOutcomeNoop, state.LastRunOutcome)
+	assert.Equal(s.T(), runOutcomeFailed, noopOutcome(true, errors.New("exit status 2")))
+	assert.Equal(s.T(), runOutcomeSuccess, noopOutcome(false, nil))
+}
+
+func (s *StateTestSuite) TestAnsibleRunSkipped() {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = true
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	assert.Equal(s.T(), errRunSkipped, ansibleRun(runTriggerSchedule, playbooks[0]))
+	assert.True(s.T(), runSkipped(errRunSkipped))
+	assert.False(s.T(), runSkipped(nil))
+}
+
+func (s *StateTestSuite) TestExportImportRoundTrip() {
+	err := updateState(func(state *PullerState) {
+		state.LastArtifactChecksum = testMD5
+	})
+	assert.Nil(s.T(), err)
+
+	snapshot := filepath.Join(s.tmpDir, "snapshot.tgz")
+	assert.Nil(s.T(), exportState(snapshot))
+
+	// Simulate a re-imaged host
+	assert.Nil(s.T(), os.RemoveAll(stateDir()))
+
+	assert.Nil(s.T(), importState(snapshot))
+
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testMD5, state.LastArtifactChecksum)
+}
+
+func (s *StateTestSuite) TestImportSignsWithLocalKey() {
+	withSettings(s.T(), map[string]interface{}{"state-key-file": filepath.Join(s.tmpDir, "old.key")})
+	assert.Nil(s.T(), updateState(func(state *PullerState) { state.LastArtifactChecksum = testMD5 }))
+	runsFile := filepath.Join(stateDir(), runHistoryFileName)
+	assert.Nil(s.T(), writeStateFile(runsFile, []byte("[]")))
+	snapshot := filepath.Join(s.tmpDir, "snapshot.tgz")
+	assert.Nil(s.T(), exportState(snapshot))
+
+	// Reinstalled host that started once, generating a key of its own, before the import
+	assert.Nil(s.T(), os.RemoveAll(stateDir()))
+	withSettings(s.T(), map[string]interface{}{"state-key-file": filepath.Join(s.tmpDir, "new.key")})
+	_, err := loadState()
+	assert.Nil(s.T(), err)
+
+	assert.Nil(s.T(), importState(snapshot))
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testMD5, state.LastArtifactChecksum)
+	data, err := readStateFile(runsFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "[]", string(data))
+	assert.NoFileExists(s.T(), stateFilePath()+stateTamperedSuffix)
+}
+
+func (s *StateTestSuite) TestExportOnlyStateFiles() {
+	assert.Nil(s.T(), updateState(func(state *PullerState) { state.LastArtifactChecksum = testMD5 }))
+	assert.Nil(s.T(), ioutil.WriteFile(pidFilePath(), []byte("1\n"), 0644))
+	assert.Nil(s.T(), ioutil.WriteFile(runLockPath(), nil, 0600))
+	assert.Nil(s.T(), os.MkdirAll(filepath.Join(stateDir(), "artifacts"), 0700))
+	snapshot := filepath.Join(s.tmpDir, "snapshot.tgz")
+	assert.Nil(s.T(), exportState(snapshot))
+
+	expanded := filepath.Join(s.tmpDir, "expanded")
+	assert.Nil(s.T(), extractTgz(snapshot, expanded))
+	entries, err := ioutil.ReadDir(expanded)
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 1)
+	assert.Equal(s.T(), stateFileName, entries[0].Name())
+}
+
+func (s *StateTestSuite) TestImportKeepsHostFiles() {
+	// Snapshot of an older version, with the whole directory of a host whose PID is alive here
+	exported := filepath.Join(s.tmpDir, "exported")
+	assert.Nil(s.T(), os.MkdirAll(exported, 0700))
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(exported, stateFileName), []byte(`{"last_artifact_checksum": "abc"}`), 0600))
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(exported, pidFileName), []byte(fmt.Sprintf("%d\n", os.Getppid())), 0644))
+	snapshot := filepath.Join(s.tmpDir, "snapshot.tgz")
+	assert.Nil(s.T(), createTgz(exported, snapshot))
+
+	assert.Nil(s.T(), updateState(func(state *PullerState) { state.LastArtifactChecksum = testMD5 }))
+	assert.Nil(s.T(), ioutil.WriteFile(runLockPath(), nil, 0600))
+	assert.Nil(s.T(), ioutil.WriteFile(failedHostsPath(), []byte("web1\n"), 0600))
+
+	assert.Nil(s.T(), importState(snapshot))
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "abc", state.LastArtifactChecksum)
+	assert.FileExists(s.T(), runLockPath())
+	assert.NoFileExists(s.T(), failedHostsPath())
+
+	// The daemon starts afterwards
+	assert.Nil(s.T(), acquirePidFile())
+	releasePidFile()
+}
+
+func (s *StateTestSuite) TestImportRefusedWhileDaemonRuns() {
+	assert.Nil(s.T(), updateState(func(state *PullerState) { state.LastArtifactChecksum = testMD5 }))
+	snapshot := filepath.Join(s.tmpDir, "snapshot.tgz")
+	assert.Nil(s.T(), exportState(snapshot))
+
+	daemon, err := os.OpenFile(pidFilePath(), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(s.T(), err)
+	defer daemon.Close()
+	locked, err := tryLockFile(daemon)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), locked)
+	defer unlockFile(daemon)
+
+	err = importState(snapshot)
+	assert.Error(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "unable to import state while the daemon runs")
+}
+
+func (s *StateTestSuite) TestImportCorruptSnapshotKeepsState() {
+	err := updateState(func(state *PullerState) {
+		state.LastArtifactChecksum = testMD5
+	})
+	assert.Nil(s.T(), err)
+
+	err = importState("testdata/corrupt.tgz")
+	assert.NotNil(s.T(), err)
+
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testMD5, state.LastArtifactChecksum)
+}
+
+func (s *StateTestSuite) TestLastSuccess() {
+	succeeded := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	assert.Nil(s.T(), updateState(func(state *PullerState) { state.LastSuccessTime = succeeded }))
+
+	// Still known after a failed run
+	recordRunState("", errors.New("exit status 2"))
+	state, err := loadState()
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), state.LastRunSuccess)
+	assert.Equal(s.T(), succeeded, state.lastSuccess())
+
+	// State files of earlier versions only tell when the last run succeeded
+	assert.Equal(s.T(), succeeded, PullerState{LastRunTime: succeeded, LastRunSuccess: true}.lastSuccess())
+	assert.True(s.T(), PullerState{LastRunTime: succeeded}.lastSuccess().IsZero())
+}
@@ -0,0 +1,238 @@
+// systemd integration: unit file generation and the sd_notify protocol
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// The sandboxing below is limited to directives that do not stop Ansible from managing the host,
+// as the playbooks run by the daemon usually need to write anywhere on the filesystem.
+var systemdServiceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=Ansible puller
+Documentation=https://github.com/teslamotors/ansible_puller
+After=network-online.target
+Wants=network-online.target
+StartLimitIntervalSec=0
+
+[Service]
+Type=notify
+ExecStart={{.Executable}}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+RestartSec=5
+WatchdogSec={{.WatchdogSec}}
+KillMode=mixed
+TimeoutStopSec={{.StopTimeoutMinutes}}min
+LockPersonality=yes
+RestrictRealtime=yes
+KeyringMode=private
+PrivateTmp=yes
+UMask={{.UMask}}
+LogsDirectory={{.LogsDirectory}}
+StateDirectory={{.StateDirectory}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var systemdOnceServiceTemplate = template.Must(template.New("once").Parse(`[Unit]
+Description=Ansible puller single run
+Documentation=https://github.com/teslamotors/ansible_puller
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart={{.Executable}} --once
+TimeoutStopSec={{.StopTimeoutMinutes}}min
+LockPersonality=yes
+RestrictRealtime=yes
+KeyringMode=private
+PrivateTmp=yes
+UMask={{.UMask}}
+LogsDirectory={{.LogsDirectory}}
+StateDirectory={{.StateDirectory}}
+`))
+
+var systemdTimerTemplate = template.Must(template.New("timer").Parse(`[Unit]
+Description=Periodic Ansible puller runs
+
+[Timer]
+OnBootSec=5min
+OnUnitActiveSec={{.SleepMinutes}}min
+RandomizedDelaySec={{.JitterMinutes}}min
+
+[Install]
+WantedBy=timers.target
+`))
+
+// systemdUnitConfig holds the values used to render the unit files from the current configuration.
+type systemdUnitConfig struct {
+	Executable     string
+	WatchdogSec    int
+	LogsDirectory  string // log-dir, relative to /var/log as required by systemd
+	StateDirectory string // state-dir, relative to /var/lib as required by systemd
+	SleepMinutes   int
+	JitterMinutes  int
+	UMask          string // umask, or the systemd default if it is not configured
+
+	// Time systemd gives the puller to stop before killing it, covering the drain of the in-flight run
+	StopTimeoutMinutes int
+}
+
+// systemdManagedDir returns dir relative to base if it lies inside of it, as systemd can only create
+// LogsDirectory and StateDirectory there. Directories elsewhere are left to the administrator.
+func systemdManagedDir(base, dir string) string {
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+
+	return rel
+}
+
+func newSystemdUnitConfig(executable string, watchdogSec int) systemdUnitConfig {
+	umask := viper.GetString("umask")
+	if umask == "" {
+		umask = "0022"
+	}
+
+	return systemdUnitConfig{
+		Executable:     executable,
+		WatchdogSec:    watchdogSec,
+		LogsDirectory:  systemdManagedDir("/var/log", viper.GetString("log-dir")),
+		StateDirectory: systemdManagedDir("/var/lib", viper.GetString("state-dir")),
+		SleepMinutes:   viper.GetInt("sleep"),
+		JitterMinutes:  viper.GetInt("sleep-jitter"),
+		UMask:          umask,
+
+		StopTimeoutMinutes: viper.GetInt("shutdown-drain-timeout") + 5,
+	}
+}
+
+func writeSystemdUnit(dir, name string, tmpl *template.Template, cfg systemdUnitConfig) error {
+	path := filepath.Join(dir, name)
+	unit, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", path)
+	}
+	defer unit.Close()
+
+	if err := tmpl.Execute(unit, cfg); err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+
+	logrus.Infoln("Wrote ", path)
+	return unit.Close()
+}
+
+var (
+	installSystemdFlags       = pflag.NewFlagSet("install-systemd", pflag.ContinueOnError)
+	installSystemdDir         = installSystemdFlags.String("dir", "/etc/systemd/system", "Directory to write the unit files to")
+	installSystemdTimer       = installSystemdFlags.Bool("timer", false, "Also write a oneshot service and timer that run the puller in run-once mode")
+	installSystemdWatchdogSec = installSystemdFlags.Int("watchdog-sec", 300, "Seconds without a watchdog ping before systemd restarts the daemon, 0 to disable")
+)
+
+func runInstallSystemdCommand(args []string) error {
+	exe, err := serviceExecutable()
+	if err != nil {
+		return err
+	}
+
+	cfg := newSystemdUnitConfig(exe, *installSystemdWatchdogSec)
+	if err := writeSystemdUnit(*installSystemdDir, appName+".service", systemdServiceTemplate, cfg); err != nil {
+		return err
+	}
+
+	if *installSystemdTimer {
+		if err := writeSystemdUnit(*installSystemdDir, appName+"-once.service", systemdOnceServiceTemplate, cfg); err != nil {
+			return err
+		}
+		if err := writeSystemdUnit(*installSystemdDir, appName+"-once.timer", systemdTimerTemplate, cfg); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infoln("Run 'systemctl daemon-reload' and enable either the service or the timer")
+	return nil
+}
+
+// sdNotify sends a state update to systemd if the daemon was started by a Type=notify unit.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are given with a leading '@'
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to the systemd notify socket")
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, state)
+	return err
+}
+
+// sdWatchdogInterval returns how often the watchdog should be pinged, or 0 if it is not enabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	// Ping twice per timeout so a single late ping doesn't cause a restart
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog keeps pinging the systemd watchdog for as long as the process is alive and the run lock isn't wedged,
+// so that systemd restarts a puller whose run hangs.
+func sdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	logrus.Debugln("Pinging the systemd watchdog every ", interval)
+	for range time.Tick(interval) {
+		if wedged := runLockWedged(); wedged != nil {
+			logrus.Errorln("Not pinging the systemd watchdog: ", wedged)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logrus.Warnln("Unable to ping the systemd watchdog: ", err)
+		}
+	}
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "install-systemd",
+		Usage:       "[--dir DIR] [--timer] [--watchdog-sec N]",
+		Description: "Write hardened systemd units for the current configuration",
+		Flags:       installSystemdFlags,
+		Run:         runInstallSystemdCommand,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdManagedDir(t *testing.T) {
+	assert.Equal(t, "ansible-puller", systemdManagedDir("/var/log", "/var/log/ansible-puller"))
+	assert.Equal(t, "puller/logs", systemdManagedDir("/var/log", "/var/log/puller/logs"))
+	assert.Equal(t, "", systemdManagedDir("/var/log", "/var/log"))
+	assert.Equal(t, "", systemdManagedDir("/var/log", "/opt/puller/logs"))
+}
+
+func TestSystemdServiceTemplate(t *testing.T) {
+	cfg := systemdUnitConfig{
+		Executable:     "/opt/ansible-puller/ansible-puller",
+		WatchdogSec:    300,
+		LogsDirectory:  "ansible-puller",
+		StateDirectory: "ansible-puller",
+		UMask:          "0027",
+
+		StopTimeoutMinutes: 10,
+	}
+
+	var unit bytes.Buffer
+	assert.Nil(t, systemdServiceTemplate.Execute(&unit, cfg))
+	assert.Contains(t, unit.String(), "ExecStart=/opt/ansible-puller/ansible-puller\n")
+	assert.Contains(t, unit.String(), "ExecReload=/bin/kill -HUP $MAINPID\n")
+	assert.Contains(t, unit.String(), "Type=notify\n")
+	assert.Contains(t, unit.String(), "WatchdogSec=300\n")
+	assert.Contains(t, unit.String(), "TimeoutStopSec=10min\n")
+	assert.Contains(t, unit.String(), "StateDirectory=ansible-puller\n")
+	assert.Contains(t, unit.String(), "UMask=0027\n")
+}
+
+func TestSystemdTimerTemplate(t *testing.T) {
+	cfg := systemdUnitConfig{
+		SleepMinutes:  30,
+		JitterMinutes: 5,
+	}
+
+	var timer bytes.Buffer
+	assert.Nil(t, systemdTimerTemplate.Execute(&timer, cfg))
+	assert.Contains(t, timer.String(), "OnUnitActiveSec=30min\n")
+	assert.Contains(t, timer.String(), "RandomizedDelaySec=5min\n")
+}
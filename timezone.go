@@ -0,0 +1,49 @@
+// Timezone used for schedules and displayed timestamps
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	pullerLocation    = time.Local // Set from the "timezone" option
+	timezoneHookSetup sync.Once
+)
+
+// timezoneHook shows log timestamps in the configured time zone.
+type timezoneHook struct{}
+
+func (timezoneHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (timezoneHook) Fire(entry *logrus.Entry) error {
+	entry.Time = entry.Time.In(pullerLocation)
+	return nil
+}
+
+// setupTimezone loads the configured time zone, which is either "Local", "UTC" or an IANA name like "Europe/Berlin".
+func setupTimezone() error {
+	location, err := time.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		return errors.Wrap(err, "unable to load timezone")
+	}
+
+	pullerLocation = location
+	timezoneHookSetup.Do(func() {
+		logrus.AddHook(timezoneHook{})
+	})
+
+	return nil
+}
+
+// pullerTime converts t to the configured time zone.
+func pullerTime(t time.Time) time.Time {
+	return t.In(pullerLocation)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupTimezone(t *testing.T) {
+	original := viper.GetString("timezone")
+	defer func() {
+		viper.Set("timezone", original)
+		assert.Nil(t, setupTimezone())
+	}()
+
+	viper.Set("timezone", "UTC")
+	assert.Nil(t, setupTimezone())
+	assert.Equal(t, "UTC", pullerTime(time.Unix(0, 0)).Location().String())
+
+	viper.Set("timezone", "Asia/Tokyo")
+	assert.Nil(t, setupTimezone())
+	assert.Equal(t, "1970-01-01T09:00:00+09:00", pullerTime(time.Unix(0, 0)).Format(time.RFC3339))
+
+	viper.Set("timezone", "Not/AZone")
+	assert.NotNil(t, setupTimezone())
+}
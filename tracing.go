@@ -0,0 +1,279 @@
+// OpenTelemetry tracing of runs, exported with OTLP over HTTP in its JSON encoding
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// OTLP span kind and status codes
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+// Tracer for runs, nil if tracing is not configured
+var runTracer *tracer
+
+// tracer exports the spans of sampled traces to an OTLP/HTTP endpoint.
+type tracer struct {
+	endpoint    string // Full URL of the traces endpoint, e.g. http://localhost:4318/v1/traces
+	headers     map[string]string
+	sampleRatio float64
+	client      *http.Client
+}
+
+// OTLP JSON types, see opentelemetry-proto. IDs are hex encoded and 64 bit integers are strings.
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// otlpAttribute converts a Go value into an OTLP attribute, using its string representation for unknown types.
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+// setupTracing creates the run tracer from the configuration.
+func setupTracing() error {
+	endpoint := viper.GetString("tracing-otlp-endpoint")
+	if endpoint == "" {
+		return nil
+	}
+
+	ratio := viper.GetFloat64("tracing-sample-ratio")
+	if ratio < 0 || ratio > 1 {
+		return errors.New("tracing-sample-ratio must be between 0 and 1")
+	}
+
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+
+	runTracer = &tracer{
+		endpoint:    endpoint,
+		headers:     viper.GetStringMapString("tracing-headers"),
+		sampleRatio: ratio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	return nil
+}
+
+// trace collects the spans of a trace until its root span ends.
+type trace struct {
+	tracer  *tracer
+	id      [16]byte
+	sampled bool
+
+	mutex sync.Mutex
+	spans []otlpSpan
+}
+
+// span is a unit of work in a trace. All methods can be called on a nil span, which records nothing.
+type span struct {
+	trace    *trace
+	id       [8]byte
+	parentID string
+	name     string
+	start    time.Time
+	attrs    []otlpKeyValue
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		logrus.Warnln("Unable to generate a trace ID: ", err)
+	}
+}
+
+// sampled implements the TraceIdRatioBased sampler, so the decision is consistent with other services.
+func (t *tracer) sampled(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+
+	bound := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// startTrace starts the root span of a new trace. It returns nil if tracing is disabled or the trace isn't sampled.
+func (t *tracer) startTrace(name string) *span {
+	if t == nil {
+		return nil
+	}
+
+	tr := &trace{tracer: t}
+	randomID(tr.id[:])
+	if tr.sampled = t.sampled(tr.id); !tr.sampled {
+		return nil
+	}
+
+	s := &span{trace: tr, name: name, start: time.Now()}
+	randomID(s.id[:])
+	return s
+}
+
+// child starts a span for a part of the work of s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+
+	child := &span{trace: s.trace, parentID: hex.EncodeToString(s.id[:]), name: name, start: time.Now()}
+	randomID(child.id[:])
+	return child
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.attrs = append(s.attrs, otlpAttribute(key, value))
+}
+
+// traceparent returns the W3C trace context header value of s, or "" for a nil span.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.trace.id[:]), hex.EncodeToString(s.id[:]))
+}
+
+// end finishes s with the status given by err. Ending the root span exports the whole trace.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	status := otlpStatus{Code: otlpStatusOk}
+	if err != nil {
+		status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+
+	s.trace.mutex.Lock()
+	s.trace.spans = append(s.trace.spans, otlpSpan{
+		TraceID:           hex.EncodeToString(s.trace.id[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+		Status:            status,
+	})
+	spans := s.trace.spans
+	s.trace.mutex.Unlock()
+
+	if s.parentID != "" {
+		return
+	}
+	if err := s.trace.tracer.export(spans); err != nil {
+		logrus.Warnln("Unable to export trace: ", err)
+	}
+}
+
+// export sends spans to the OTLP endpoint.
+func (t *tracer) export(spans []otlpSpan) error {
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{
+					otlpAttribute("service.name", appName),
+					otlpAttribute("service.version", Version),
+					otlpAttribute("host.name", hostname),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": appName},
+				"spans": spans,
+			}},
+		}},
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	logrus.Debugf("Exported %d spans", len(spans))
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceExport(t *testing.T) {
+	var received struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	var path, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		auth = req.Header.Get("Authorization")
+		json.NewDecoder(req.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	tracer := &tracer{
+		endpoint:    server.URL + "/v1/traces",
+		headers:     map[string]string{"Authorization": "Bearer secret"},
+		sampleRatio: 1,
+		client:      server.Client(),
+	}
+
+	root := tracer.startTrace("run")
+	root.setAttribute("run.id", "1234")
+	child := root.child("ansible-playbook")
+	child.setAttribute("ansible.exit_code", 2)
+	child.end(errors.New("exit status 2"))
+	assert.Empty(t, path, "nothing is exported before the root span ends")
+	root.end(nil)
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "Bearer secret", auth)
+
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "ansible-playbook", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, otlpStatusError, spans[0].Status.Code)
+	assert.Equal(t, "2", *spans[0].Attributes[0].Value.IntValue)
+	assert.Equal(t, "run", spans[1].Name)
+	assert.Empty(t, spans[1].ParentSpanID)
+	assert.Equal(t, otlpStatusOk, spans[1].Status.Code)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{32}$`), spans[1].TraceID)
+}
+
+func TestTraceSampling(t *testing.T) {
+	var disabled *tracer
+	assert.Nil(t, disabled.startTrace("run"))
+
+	never := &tracer{sampleRatio: 0}
+	assert.Nil(t, never.startTrace("run"))
+
+	half := &tracer{sampleRatio: 0.5}
+	assert.True(t, half.sampled([16]byte{8: 0x00, 15: 0x01}))
+	assert.False(t, half.sampled([16]byte{8: 0xff, 15: 0xff}))
+
+	// Nil spans record nothing
+	var s *span
+	s.setAttribute("key", "value")
+	assert.Nil(t, s.child("child"))
+	assert.Equal(t, "", s.traceparent())
+	s.end(nil)
+}
+
+func TestTraceparent(t *testing.T) {
+	root := (&tracer{sampleRatio: 1}).startTrace("run")
+	assert.Regexp(t, regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`), root.traceparent())
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,7 +31,19 @@ func ensureGzip(file io.Reader) error {
 	return nil
 }
 
+// Marker file that exists in a destination directory for as long as a tarball is being extracted into it
+const extractionMarker = ".ansible-puller-extracting"
+
+// extractionIncomplete reports whether dir holds a tree whose extraction was interrupted.
+func extractionIncomplete(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, extractionMarker))
+	return err == nil
+}
+
 // Extract a tarball from the src into dest
+//
+// The extraction marker is only removed once the whole tarball has been extracted, so a tree torn by a
+// failure or a crash can be told apart from a complete one.
 func extractTgz(src, dest string) error {
 	logrus.Debugf("Expanding %s to %s", src, dest)
 	tgzFile, err := os.Open(src)
@@ -47,24 +60,29 @@ func extractTgz(src, dest string) error {
 
 	uncompressedStream, err := gzip.NewReader(tgzFile)
 	if err != nil {
-		errors.Wrap(err, "unable to make gzip reader")
+		return errors.Wrap(err, "unable to make gzip reader")
 	}
 	defer uncompressedStream.Close()
 
 	tarReader := tar.NewReader(uncompressedStream)
 
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		if err := os.Mkdir(dest, 0755); err != nil {
+		if err := os.Mkdir(dest, workDirMode); err != nil {
 			return errors.Wrap(err, "unable to create target directory")
 		}
 	}
 
+	marker := filepath.Join(dest, extractionMarker)
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		return errors.Wrap(err, "unable to create extraction marker")
+	}
+
 	for {
 		header, err := tarReader.Next()
 
 		switch {
 		case err == io.EOF:
-			return nil
+			return errors.Wrap(os.Remove(marker), "unable to remove extraction marker")
 		case err != nil:
 			return errors.Wrap(err, "unable to extract gzipped tarfile")
 		case header == nil:
@@ -81,13 +99,13 @@ func extractTgz(src, dest string) error {
 
 		case tar.TypeDir:
 			if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-				if err := os.Mkdir(targetPath, 0755); err != nil {
+				if err := os.Mkdir(targetPath, workDirMode); err != nil {
 					return errors.Wrap(err, "unable to create dir from tar")
 				}
 			}
 
 		case tar.TypeReg:
-			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return errors.Wrap(err, "unable to create file from tar")
 			}
@@ -100,3 +118,23 @@ func extractTgz(src, dest string) error {
 		}
 	}
 }
+
+// cleanupInterruptedExtractions removes run directories in parent that were left behind by an extraction
+// that never completed, e.g. because the puller crashed or the host lost power.
+func cleanupInterruptedExtractions(parent string) {
+	dirs, err := filepath.Glob(filepath.Join(parent, appName+"*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if !extractionIncomplete(dir) {
+			continue
+		}
+
+		logrus.Warnln("Removing partially extracted directory: ", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorln("Unable to remove partially extracted directory: ", err)
+		}
+	}
+}
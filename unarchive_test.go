@@ -39,6 +39,8 @@ func (s *UnarchiveTestSuite) TestTarballExists() {
 	stats, err = os.Stat(s.tmpDir + "/bar.txt")
 	assert.Nil(s.T(), err)
 	assert.True(s.T(), stats.Mode().IsRegular(), "should create a regular bar file")
+
+	assert.False(s.T(), extractionIncomplete(s.tmpDir), "should remove the extraction marker")
 }
 
 func (s *UnarchiveTestSuite) TestTarballDoesNotExist() {
@@ -54,4 +56,20 @@ func (s *UnarchiveTestSuite) TestTarballIsCorrupted() {
 func (s *UnarchiveTestSuite) TestTarballHasInvalidBody() {
 	err := extractTgz("testdata/half.tgz", s.tmpDir)
 	assert.NotNil(s.T(), err)
+	assert.True(s.T(), extractionIncomplete(s.tmpDir), "should leave the extraction marker in a torn tree")
+}
+
+func (s *UnarchiveTestSuite) TestCleanupInterruptedExtractions() {
+	torn, err := ioutil.TempDir(s.tmpDir, "ansible-puller")
+	assert.Nil(s.T(), err)
+	assert.NotNil(s.T(), extractTgz("testdata/half.tgz", torn))
+
+	complete, err := ioutil.TempDir(s.tmpDir, "ansible-puller")
+	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), extractTgz("testdata/good.tgz", complete))
+
+	cleanupInterruptedExtractions(s.tmpDir)
+
+	assert.NoDirExists(s.T(), torn)
+	assert.DirExists(s.T(), complete)
 }
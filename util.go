@@ -1,19 +1,30 @@
 package main
 
 import (
-	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"fmt"
+	"io"
 	"os/exec"
 	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
-// failedCommandLogger will print a bunch of context to the terminal when in debug mode
+// failedCommandLogger will print a bunch of context to the terminal when in debug mode, with secrets masked
 func failedCommandLogger(cmd *exec.Cmd) {
 	if viper.GetBool("debug") {
-		logrus.Debug("failed command: ", cmd.Args)
-		logrus.Debug("stdout: ", cmd.Stdout)
-		logrus.Debug("stderr: ", cmd.Stderr)
+		logrus.Debug("failed command: ", redact(strings.Join(cmd.Args, " ")))
+		logrus.Debug("stdout: ", redact(commandOutputString(cmd.Stdout)))
+		logrus.Debug("stderr: ", redact(commandOutputString(cmd.Stderr)))
+	}
+}
+
+// commandOutputString returns what a command wrote to w, if it was captured in a buffer.
+func commandOutputString(w io.Writer) string {
+	if s, ok := w.(fmt.Stringer); ok {
+		return s.String()
 	}
+	return ""
 }
 
 // trimWhiteSpace trims all the leading and trailing whitespace of a multi-line string
@@ -0,0 +1,303 @@
+// Validating the configuration at startup, and the --validate mode that checks it without running Ansible
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Problems found while setting up with --validate, which reports them all rather than exiting at the first one
+var setupProblems []error
+
+// setupFailed exits with a problem found while setting up, or collects it with --validate.
+func setupFailed(err error) {
+	if viper.GetBool("validate") {
+		setupProblems = append(setupProblems, err)
+		return
+	}
+	logrus.Fatalln(err)
+}
+
+// validateConfig checks the configuration for problems that setting up doesn't catch, without reaching out to the
+// network: required settings, the format of URLs, that paths exist or can be created and that intervals make sense.
+func validateConfig() []error {
+	var problems []error
+	problem := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, key := range []string{"ansible-playbook", "venv-python", "venv-path"} {
+		if viper.GetString(key) == "" {
+			problem(errors.Errorf("%s is required", key))
+		}
+	}
+	switch executor := viper.GetString("executor"); executor {
+	case executorVenv:
+	case executorRunner:
+		problem(checkCreatableDir("runner-data-dir", runnerDataDir()))
+		if viper.GetInt("runner-rotate-artifacts") < 0 {
+			problem(errors.New("runner-rotate-artifacts must not be negative"))
+		}
+	case executorContainer:
+		if viper.GetString("container-image") == "" {
+			problem(errors.New("container-image is required with the container executor"))
+		}
+		switch pull := viper.GetString("container-pull"); pull {
+		case containerPullAlways, containerPullMissing, containerPullNever:
+		default:
+			problem(errors.Errorf("invalid container-pull %q, expected always, missing or never", pull))
+		}
+		// A local connection configures the container, and the run succeeds without touching the host
+		if connection := viper.GetString("container-connection"); !controllerMode() && (connection == "" || connection == "local") {
+			problem(errors.New("the container executor requires ansible-controller or a container-connection other than local"))
+		}
+	default:
+		problem(errors.Errorf("invalid executor %q, expected venv, container or runner", executor))
+	}
+
+	// Sources
+	if _, _, err := artifactDownloader(); err != nil {
+		problem(err)
+	} else if ansibleURL := viper.GetString("ansible-url"); ansibleURL != "" {
+		problem(checkURL("ansible-url", ansibleURL, "http", "https", "s3", "gs", "azblob"))
+	} else if httpURL := viper.GetString("http-url"); httpURL != "" && strings.Contains(httpURL, "://") {
+		problem(errors.New("http-url must not have a scheme, it is set by http-proto"))
+	} else if gitURL := viper.GetString("git-url"); gitURL != "" {
+		problem(checkGitURL(gitURL))
+	}
+	if proto := viper.GetString("http-proto"); proto != "http" && proto != "https" {
+		problem(errors.Errorf("invalid http-proto %q, expected http or https", proto))
+	}
+
+	// URLs of the services the puller talks to
+	for _, key := range []string{"change-api-url", "git-status-api-url", "policy-url", "tracing-otlp-endpoint", "vault-addr", "venv-pip-index-url"} {
+		if value := viper.GetString(key); value != "" {
+			problem(checkURL(key, value, "http", "https"))
+		}
+	}
+	for i, value := range viper.GetStringSlice("events-webhook-urls") {
+		problem(checkURL(fmt.Sprintf("events-webhook-urls entry %d", i+1), value, "http", "https"))
+	}
+	for i, value := range viper.GetStringSlice("venv-pip-extra-index-urls") {
+		problem(checkURL(fmt.Sprintf("venv-pip-extra-index-urls entry %d", i+1), value, "http", "https"))
+	}
+	for _, key := range []string{"notify-webhooks", "notify-slack-webhooks"} {
+		webhooks := viper.GetStringMapString(key)
+		names := make([]string, 0, len(webhooks))
+		for name := range webhooks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			problem(checkURL(key+" of "+name, webhooks[name], "http", "https"))
+		}
+	}
+
+	if viper.GetString("http-listen-string") == "" && viper.GetString("http-socket") == "" {
+		problem(errors.New("http-listen-string and http-socket are both empty, the API must be served on at least one"))
+	}
+
+	// Directories the puller creates as needed
+	problem(checkCreatableDir("state-dir", stateDir()))
+	problem(checkCreatableDir("artifact-cache-dir", artifactCacheDir()))
+	problem(checkCreatableDir("galaxy-cache-dir", galaxyCacheDir()))
+	if dir := viper.GetString("git-cache-dir"); dir != "" {
+		problem(checkCreatableDir("git-cache-dir", dir))
+	}
+	if venvPath := viper.GetString("venv-path"); venvPath != "" {
+		problem(checkCreatableDir("venv-path", venvPath))
+	}
+	// Generated if missing
+	if keyFile := viper.GetString("state-key-file"); keyFile != "" {
+		problem(checkCreatableDir("state-key-file", filepath.Dir(keyFile)))
+	}
+
+	// Files that must exist
+	for _, key := range []string{"git-ssh-key", "policy-file", "vault-token-file"} {
+		if path := viper.GetString(key); path != "" {
+			problem(checkExists(key, path))
+		}
+	}
+	// Others are looked up in the artifact, once pulled
+	if constraints := viper.GetString("venv-constraints-file"); filepath.IsAbs(constraints) {
+		problem(checkExists("venv-constraints-file", constraints))
+	}
+	for _, ref := range viper.GetStringSlice("ansible-controller-ssh-key") {
+		if !strings.Contains(ref, "://") {
+			problem(checkExists("ansible-controller-ssh-key", ref))
+		}
+	}
+
+	if viper.GetBool("run-scope") {
+		if _, err := exec.LookPath("systemd-run"); err != nil {
+			problem(errors.New("run-scope requires systemd-run in $PATH"))
+		}
+	}
+
+	// Intervals
+	if viper.GetInt("sleep-jitter") < 0 {
+		problem(errors.New("sleep-jitter must not be negative"))
+	}
+	if viper.GetInt("health-lock-timeout") < 0 {
+		problem(errors.New("health-lock-timeout must not be negative"))
+	}
+	jitter := time.Duration(viper.GetInt("sleep-jitter")) * time.Minute
+	problem(validateSchedules(currentPlaybooks(), jitter, time.Duration(viper.GetInt("sleep-splay"))*time.Minute))
+
+	return problems
+}
+
+// checkURL returns why value of key is not an absolute URL with one of the schemes. The value is left out of the
+// problem, webhook URLs in particular are secrets.
+func checkURL(key, value string, schemes ...string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return errors.Errorf("%s is not a valid URL", key)
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			if parsed.Host == "" {
+				return errors.Errorf("%s has no host", key)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("%s must be a URL with one of the schemes %s", key, strings.Join(schemes, ", "))
+}
+
+// checkGitURL returns why gitURL is not a repository git can fetch from: a URL, an SCP-like user@host:path or a
+// local repository.
+func checkGitURL(gitURL string) error {
+	if strings.Contains(gitURL, "://") {
+		return checkURL("git-url", gitURL, "https", "http", "ssh", "git", "file")
+	}
+	if colon := strings.Index(gitURL, ":"); colon > 0 && !strings.Contains(gitURL[:colon], "/") {
+		return nil
+	}
+	if _, err := os.Stat(gitURL); err != nil {
+		return errors.New("git-url must be an https:// or ssh:// URL, user@host:path or a local repository")
+	}
+	return nil
+}
+
+// checkExists returns why path, set by key, doesn't exist.
+func checkExists(key, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "invalid %s", key)
+	}
+	return nil
+}
+
+// checkCreatableDir returns why dir, set by key, is neither a directory nor can be created, as its closest existing
+// parent isn't a directory the puller can write to.
+func checkCreatableDir(key, dir string) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return errors.Errorf("invalid %s, %s is not a directory", key, dir)
+		}
+		return nil
+	}
+
+	parent := filepath.Dir(filepath.Clean(dir))
+	for {
+		info, err := os.Stat(parent)
+		if err == nil {
+			if !info.IsDir() {
+				return errors.Errorf("invalid %s, %s is not a directory", key, parent)
+			}
+			break
+		}
+		if next := filepath.Dir(parent); next != parent {
+			parent = next
+			continue
+		}
+		return errors.Wrapf(err, "invalid %s", key)
+	}
+
+	probe, err := ioutil.TempDir(parent, "."+appName+"-validate")
+	if err != nil {
+		return errors.Errorf("invalid %s, %s can't be created in %s", key, dir, parent)
+	}
+	os.Remove(probe)
+	return nil
+}
+
+// resolveArtifact reaches out to the source of the artifact, returning the MD5 published next to it or, for
+// git-url, the commit git-ref points to.
+func resolveArtifact() (string, error) {
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return "", err
+	}
+	if git, ok := downloader.(gitDownloader); ok {
+		return git.resolve(remotePath)
+	}
+
+	checksum, err := downloader.RemoteChecksum(remotePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve %s", redact(remotePath))
+	}
+	return checksum, nil
+}
+
+// checkPython returns the version of the venv-python interpreter, checking that it can build the virtualenv.
+func checkPython(python string) (string, error) {
+	output, err := exec.Command(python, "--version").CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to run venv-python %s", python)
+	}
+	version := strings.TrimSpace(string(output))
+
+	if err := exec.Command(python, "-c", "import venv").Run(); err != nil {
+		if _, err := exec.LookPath("virtualenv"); err != nil {
+			return version, errors.Errorf("venv-python %s has no venv module and virtualenv is not installed", python)
+		}
+	}
+	return version, nil
+}
+
+// validate checks the configuration, resolves the artifact and checks the Python interpreter, printing what it
+// finds. It returns the exit code of --validate, which doesn't run Ansible.
+func validate() int {
+	problems := append(setupProblems, validateConfig()...)
+
+	if _, _, err := artifactDownloader(); err == nil {
+		if resolved, err := resolveArtifact(); err != nil {
+			problems = append(problems, err)
+		} else if resolved == "" {
+			fmt.Println("Artifact: reachable, no MD5 published")
+		} else {
+			fmt.Println("Artifact:", resolved)
+		}
+	}
+	if python := viper.GetString("venv-python"); python != "" {
+		if version, err := checkPython(python); err != nil {
+			problems = append(problems, err)
+		} else {
+			fmt.Println("Python:", version)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", problem)
+		}
+		return exitRunFailed
+	}
+	fmt.Println("Configuration is valid")
+	return exitRunSucceeded
+}
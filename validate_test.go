@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// withSettings sets the given settings for the test, restoring them after the test.
+func withSettings(t *testing.T, settings map[string]interface{}) {
+	for key, value := range settings {
+		key := key
+		original := viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, original) })
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	withSettings(t, map[string]interface{}{
+		"state-dir":           filepath.Join(dir, "state", "nested"),
+		"venv-path":           filepath.Join(dir, "venv"),
+		"artifact-cache-dir":  "",
+		"galaxy-cache-dir":    "",
+		"ansible-url":         "https://example.com/ansible.tgz",
+		"events-webhook-urls": []string{"https://example.com/events"},
+		"git-ssh-key":         "",
+	})
+	assert.Empty(t, validateConfig())
+
+	withSettings(t, map[string]interface{}{
+		"ansible-url":         "",
+		"events-webhook-urls": []string{"ftp://example.com/events"},
+		"notify-webhooks":     map[string]string{"oncall": "https:///missing-host"},
+		"git-ssh-key":         filepath.Join(dir, "missing"),
+		"sleep-jitter":        -1,
+	})
+	var problems []string
+	for _, problem := range validateConfig() {
+		problems = append(problems, problem.Error())
+	}
+	assert.Contains(t, problems[0], "exactly one remote resource must be specified")
+	assert.Equal(t, "events-webhook-urls entry 1 must be a URL with one of the schemes http, https", problems[1])
+	assert.Equal(t, "notify-webhooks of oncall has no host", problems[2])
+	assert.Contains(t, problems[3], "invalid git-ssh-key")
+	assert.Equal(t, "sleep-jitter must not be negative", problems[4])
+	assert.Len(t, problems, 5)
+}
+
+func TestCheckCreatableDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0644))
+
+	assert.Nil(t, checkCreatableDir("state-dir", dir))
+	assert.Nil(t, checkCreatableDir("state-dir", filepath.Join(dir, "a", "b")))
+	assert.EqualError(t, checkCreatableDir("state-dir", file), "invalid state-dir, "+file+" is not a directory")
+	assert.EqualError(t, checkCreatableDir("state-dir", filepath.Join(file, "a")), "invalid state-dir, "+file+" is not a directory")
+
+	// Nothing is left behind by checking
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCheckGitURL(t *testing.T) {
+	for _, gitURL := range []string{"https://github.com/org/repo.git", "ssh://git@github.com/org/repo.git", "git@github.com:org/repo.git", t.TempDir()} {
+		assert.Nil(t, checkGitURL(gitURL), gitURL)
+	}
+	for _, gitURL := range []string{"ftp://github.com/org/repo.git", "https:///org/repo.git", "./missing/repo"} {
+		assert.NotNil(t, checkGitURL(gitURL), gitURL)
+	}
+}
+
+func TestCheckPython(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake interpreter is a shell script")
+	}
+
+	dir := t.TempDir()
+	python := filepath.Join(dir, "python3")
+	assert.Nil(t, ioutil.WriteFile(python, []byte("#!/bin/sh\necho Python 3.10.12\n"), 0755))
+	version, err := checkPython(python)
+	assert.Nil(t, err)
+	assert.Equal(t, "Python 3.10.12", version)
+
+	_, err = checkPython(filepath.Join(dir, "missing"))
+	assert.Contains(t, err.Error(), "unable to run venv-python")
+
+	// Without the venv module the legacy virtualenv command is needed
+	assert.Nil(t, ioutil.WriteFile(python, []byte("#!/bin/sh\n[ \"$1\" = -c ] && exit 1\necho Python 3.10.12\n"), 0755))
+	t.Setenv("PATH", dir)
+	_, err = checkPython(python)
+	assert.Contains(t, err.Error(), "has no venv module and virtualenv is not installed")
+}
@@ -3,31 +3,60 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
   "regexp"
   "strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 var (
-	venvCommandTimeout = 2 * time.Hour // 2 hours timeout
+	venvCommandTimeout = 2 * time.Hour // Default timeout of commands without their own
 )
 
+// Conventional exit code of commands that were killed for exceeding their timeout, as used by timeout(1)
+const timeoutExitCode = 124
+
+// File in the virtualenv recording what it was built from
+const venvMarkerFileName = ".ansible-puller-venv.json"
+
 // VenvConfig defines a Python Virtual Environment.
 type VenvConfig struct {
-	Path   string // path to the virtualenv root
-	Python string // path to the desired Python installation
+	Path         string        // path to the virtualenv root
+	Python       string        // path to the desired Python installation
+	Wheelhouse   string        // optional directory that caches wheels of the requirements
+	PipTimeout   time.Duration // timeout of pip commands (default: venvCommandTimeout)
+	ForceRebuild bool          // recreate the virtualenv even if it is up to date
+	CleanEnv     bool          // run commands with only a few variables of the puller's environment
+	Standby      bool          // build a virtualenv to recreate next to the current one, see EnsureStandby
+
+	IndexURL       string   // optional pip index to install from instead of PyPI
+	ExtraIndexURLs []string // optional pip indexes to install from as well
+	Constraints    string   // optional pip constraints file the requirements are resolved within
+	RequireHashes  bool     // refuse to install requirements that are not pinned with their hashes
+	PipCacheDir    string   // optional pip cache directory instead of the one in $HOME
+	OfflineWheels  string   // optional directory of wheels to install from without contacting any index
+}
+
+// venvFingerprint identifies what a virtualenv was built from, so that stale virtualenvs can be recreated.
+type venvFingerprint struct {
+	Requirements  string `json:"requirements_sha256"` // SHA-256 of the requirements file
+	Python        string `json:"python"`              // Path to the interpreter
+	PythonVersion string `json:"python_version"`      // Output of python --version
 }
 
 func getPythonVersion(interpreter string) (int, int, error) {
@@ -75,7 +104,7 @@ func makeVenv(cfg VenvConfig) error {
 }
 
 func makeVenvViaModule(cfg VenvConfig) error {
-  logrus.Debugln("Creating virtualenv via python module venv.")
+  venvLog.Debugln("Creating virtualenv via python module venv.")
   cmd := exec.Command(cfg.Python, "-m", "venv", cfg.Path)
   err := cmd.Run()
 	if err != nil {
@@ -102,42 +131,219 @@ func makeVenvLegacy(cfg VenvConfig) error {
   return nil
 }
 
-// Ensure ensures that a virtual environment exists, if not, it attempts to create it
-func (c VenvConfig) Ensure() error {
-	_, err := os.Stat(c.Path)
+// fingerprint returns the fingerprint of a virtualenv built from requirementsFile with the configured interpreter.
+func (c VenvConfig) fingerprint(requirementsFile string) (venvFingerprint, error) {
+	var fingerprint venvFingerprint
+
+	content, err := ioutil.ReadFile(requirementsFile)
+	if err != nil {
+		return fingerprint, errors.Wrap(err, "unable to read requirements file")
+	}
+	sum := sha256.Sum256(content)
+
+	version, err := exec.Command(c.Python, "--version").CombinedOutput()
+	if err != nil {
+		return fingerprint, errors.Wrap(err, "unable to determine python version")
+	}
+
+	fingerprint.Requirements = hex.EncodeToString(sum[:])
+	fingerprint.Python = c.Python
+	fingerprint.PythonVersion = strings.TrimSpace(string(version))
+	return fingerprint, nil
+}
+
+// staleReason returns why the existing virtualenv has to be recreated for requirementsFile, or "" if it is up to date.
+//
+// Virtualenvs without a marker were created before fingerprints were recorded, they are kept and marked by Update.
+func (c VenvConfig) staleReason(requirementsFile string) (string, error) {
+	if c.ForceRebuild {
+		return "rebuild forced", nil
+	}
+	if _, err := os.Stat(filepath.Join(c.Path, "bin", "python")); err != nil {
+		return "its python is missing", nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, venvMarkerFileName))
 	if os.IsNotExist(err) {
-		err := makeVenv(c)
-		if err != nil {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to read virtualenv marker")
+	}
+	var built venvFingerprint
+	if err := json.Unmarshal(data, &built); err != nil {
+		return "its marker is corrupt", nil
+	}
+
+	wanted, err := c.fingerprint(requirementsFile)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case built.Python != wanted.Python:
+		return fmt.Sprintf("the interpreter changed from %s to %s", built.Python, wanted.Python), nil
+	case built.PythonVersion != wanted.PythonVersion:
+		return fmt.Sprintf("python changed from %s to %s", built.PythonVersion, wanted.PythonVersion), nil
+	case built.Requirements != wanted.Requirements:
+		return "the requirements changed", nil
+	}
+
+	return "", nil
+}
+
+// Ensure ensures that an up to date virtual environment exists for requirementsFile. It is created if it is missing,
+// and recreated if it is broken, was built from other requirements or another interpreter, or ForceRebuild is set.
+func (c VenvConfig) Ensure(requirementsFile string) error {
+	_, err := os.Stat(c.Path)
+	if err == nil {
+		reason, err := c.staleReason(requirementsFile)
+		if err != nil || reason == "" {
 			return err
 		}
+
+		venvLog.Infof("Recreating virtualenv %s as %s", c.Path, reason)
+		if err := os.RemoveAll(c.Path); err != nil {
+			return errors.Wrap(err, "unable to remove stale virtualenv")
+		}
+	} else if !os.IsNotExist(err) {
+		return err
 	}
 
-	return nil
+	return makeVenv(c)
 }
 
 // Update updates the virtualenv for the given config with the specified requirements file
+//
+// With a wheelhouse, missing wheels are built into it first and the requirements are installed from it. With offline
+// wheels, the requirements are installed from them alone.
 func (c VenvConfig) Update(requirementsFile string) error {
-	vCmd := VenvCommand{
-		Config: c,
-		Binary: "pip",
-		Args:   []string{"install", "-r", requirementsFile},
+	args := append([]string{"install"}, c.requirementArgs(requirementsFile)...)
+	if c.OfflineWheels != "" {
+		if _, err := os.Stat(c.OfflineWheels); err != nil {
+			return errors.Wrap(err, "no wheels to install offline from")
+		}
+
+		args = append([]string{"install", "--no-index", "--find-links", c.OfflineWheels}, c.requirementArgs(requirementsFile)...)
+	} else if c.Wheelhouse != "" {
+		if err := os.MkdirAll(c.Wheelhouse, 0755); err != nil {
+			return errors.Wrap(err, "unable to create wheelhouse")
+		}
+
+		wheelArgs := append([]string{"wheel", "--wheel-dir", c.Wheelhouse, "--find-links", c.Wheelhouse}, c.requirementArgs(requirementsFile)...)
+		if output := c.pip(wheelArgs...).Run(); output.Error != nil {
+			return errors.Wrap(commandFailure(output), "unable to populate wheelhouse")
+		}
+
+		args = append([]string{"install", "--no-index", "--find-links", c.Wheelhouse}, c.requirementArgs(requirementsFile)...)
 	}
-	venvCommandOutput := vCmd.Run()
+
+	venvCommandOutput := c.pip(args...).Run()
 	if venvCommandOutput.Error != nil {
-		return errors.Wrap(venvCommandOutput.Error, "unable to update virtualenv")
+		return errors.Wrap(commandFailure(venvCommandOutput), "unable to update virtualenv")
+	}
+
+	// Only marked once it is complete, so an interrupted update is repaired by the next one
+	fingerprint, err := c.fingerprint(requirementsFile)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(writeFileAtomic(filepath.Join(c.Path, venvMarkerFileName), data, 0644), "unable to write virtualenv marker")
+}
+
+// Install installs requirement specifiers into the virtualenv, e.g. to pin a package after Update.
+//
+// With a wheelhouse, its wheels are preferred but the index is still used for versions missing from it. With offline
+// wheels, only they are installed from. When hashes are required, each requirement must be a line of a requirements
+// file pinning it with its hashes, e.g. "ansible-runner==2.3.4 --hash=sha256:...", as they can't be passed otherwise.
+func (c VenvConfig) Install(requirements ...string) error {
+	args := []string{"install"}
+	if c.OfflineWheels != "" {
+		args = append(args, "--no-index", "--find-links", c.OfflineWheels)
+	} else if c.Wheelhouse != "" {
+		args = append(args, "--find-links", c.Wheelhouse)
+	}
+
+	if c.RequireHashes {
+		for _, requirement := range requirements {
+			if !strings.Contains(requirement, "--hash=") {
+				return errors.Errorf("refusing to install %s, which is not pinned with its hashes as venv-require-hashes requires", requirement)
+			}
+		}
+		file, err := ioutil.TempFile("", appName+"-requirements")
+		if err != nil {
+			return errors.Wrap(err, "unable to create requirements file")
+		}
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(strings.Join(requirements, "\n") + "\n")
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to write requirements file")
+		}
+		args = append(args, c.requirementArgs(file.Name())...)
+	} else {
+		if c.Constraints != "" {
+			args = append(args, "--constraint", c.Constraints)
+		}
+		args = append(args, requirements...)
+	}
+
+	if output := c.pip(args...).Run(); output.Error != nil {
+		return errors.Wrapf(commandFailure(output), "unable to install %s", strings.Join(requirements, " "))
 	}
 
 	return nil
 }
 
+// pip returns the pip command of the virtualenv with args, installing from the configured indexes.
+//
+// The indexes are passed in the environment rather than as arguments, as their URLs may hold credentials.
+func (c VenvConfig) pip(args ...string) VenvCommand {
+	var env []string
+	if c.IndexURL != "" {
+		env = append(env, "PIP_INDEX_URL="+c.IndexURL)
+	}
+	if len(c.ExtraIndexURLs) > 0 {
+		env = append(env, "PIP_EXTRA_INDEX_URL="+strings.Join(c.ExtraIndexURLs, " "))
+	}
+	if c.PipCacheDir != "" {
+		env = append(env, "PIP_CACHE_DIR="+c.PipCacheDir)
+	}
+
+	return VenvCommand{Config: c, Binary: "pip", Args: args, Timeout: c.PipTimeout, Env: env}
+}
+
+// requirementArgs returns the pip arguments installing the requirements in requirementsFile, within the constraints
+// and with the hashes checked as configured.
+func (c VenvConfig) requirementArgs(requirementsFile string) []string {
+	args := []string{"-r", requirementsFile}
+	if c.Constraints != "" {
+		args = append(args, "--constraint", c.Constraints)
+	}
+	if c.RequireHashes {
+		args = append(args, "--require-hashes")
+	}
+	return args
+}
+
 // VenvCommand enables you to run a system command in a virtualenv.
 type VenvCommand struct {
 	Config       VenvConfig
-	Binary       string   // path to the binary under $venv/bin
-	Args         []string // args to pass to the command that is called
-	Cwd          string   // Directory to change to, if needed
-	Env          []string // Additions to the runtime environment
-	StreamOutput bool     // Whether or not the application should stream output stdout/stderr
+	Binary       string          // path to the binary under $venv/bin
+	Args         []string        // args to pass to the command that is called
+	Cwd          string          // Directory to change to, if needed
+	Env          []string        // Additions to the runtime environment
+	StreamOutput bool            // Whether to also print stdout/stderr to the console, line by line as they come
+	Output       io.Writer       // Optional writer that receives stdout/stderr while the command runs
+	Timeout      time.Duration   // Kill the command after this long (default: venvCommandTimeout)
+	Context      context.Context // Optional context whose cancellation kills the command
+	Executor     Executor        // Runs the command instead of the virtualenv of Config (default: the virtualenv)
+	Scope        string          // Prefix of the transient systemd scope unit to run the command in (default: none)
 }
 
 type VenvCommandRunOutput struct {
@@ -145,13 +351,161 @@ type VenvCommandRunOutput struct {
 	Stderr   string
 	Error    error
 	Exitcode int
+	Usage    processUsage // Resources used by the command and the children it waited for
+}
+
+// processUsage is the resource usage of an exited process tree.
+type processUsage struct {
+	CPUTime      time.Duration // User and system CPU time
+	PeakRSSBytes uint64        // Largest resident set size, 0 if the platform does not report it
+}
+
+func usageOf(state *os.ProcessState) processUsage {
+	if state == nil {
+		return processUsage{}
+	}
+
+	return processUsage{
+		CPUTime:      state.UserTime() + state.SystemTime(),
+		PeakRSSBytes: processPeakRSS(state),
+	}
+}
+
+// timeoutError is returned by commands that were killed for exceeding their timeout.
+type timeoutError struct {
+	error
+}
+
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+// stopWhenDone stops the process group of the started cmd once ctx is done, asking it to terminate first and
+// killing what is left of it after processStopGrace. exited must be called once cmd has exited. What cmd started and
+// left running when it exited by itself keeps running, e.g. services started by a playbook.
+func stopWhenDone(ctx context.Context, cmd *exec.Cmd) (exited func()) {
+	untrack := trackProcessGroup(cmd.Process.Pid)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			select {
+			case <-done:
+				// Exited before, ctx is just cleaned up
+				return
+			default:
+			}
+		}
+
+		if err := stopProcessGroup(cmd.Process.Pid, false); err != nil {
+			venvLog.Debugln("Unable to stop the command: ", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(processStopGrace):
+			venvLog.Warnf("%s did not exit within %s of being stopped, killing it", cmd.Path, processStopGrace)
+		}
+		// Also kills what the command started and left behind
+		stopProcessGroup(cmd.Process.Pid, true)
+	}()
+
+	return func() {
+		close(done)
+		untrack()
+	}
+}
+
+// path returns the path of the binary of the command.
+func (c VenvCommand) path() string {
+	return filepath.Join(c.Config.Path, "bin", c.Binary)
+}
+
+// Variables of the puller that commands in a clean environment keep
+var cleanEnvVars = []string{"HOME", "USER", "LOGNAME", "TMPDIR", "TZ"}
+
+// Search path of commands in a clean environment, after the bin directory of the venv
+const cleanEnvPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// environ returns the environment the command runs in, with the venv activated as its activate script would: the
+// bin directory first in $PATH, $VIRTUAL_ENV set and $PYTHONHOME unset. Only the command's environment is changed,
+// never the puller's, so commands in different venvs can run at the same time.
+func (c VenvCommand) environ() ([]string, error) {
+	var env []string
+	path := cleanEnvPath
+	if c.Config.CleanEnv {
+		for _, name := range cleanEnvVars {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	} else {
+		var ok bool
+		if path, ok = os.LookupEnv("PATH"); !ok {
+			return nil, errors.New("Unable to lookup the $PATH env variable")
+		}
+		for _, variable := range os.Environ() {
+			name := strings.SplitN(variable, "=", 2)[0]
+			if name != "PATH" && name != "VIRTUAL_ENV" && name != "PYTHONHOME" {
+				env = append(env, variable)
+			}
+		}
+	}
+
+	// The venv path may change between runs
+	venvPath := filepath.Join(c.Config.Path, "bin")
+	inPath := false
+	for _, dir := range filepath.SplitList(path) {
+		inPath = inPath || dir == venvPath
+	}
+	if !inPath {
+		path = venvPath + string(os.PathListSeparator) + path
+		venvLog.Debugln("PATH: ", path)
+	}
+
+	env = append(env, localeEnv()...)
+	env = append(env, "PATH="+path, "VIRTUAL_ENV="+c.Config.Path)
+	return append(env, c.Env...), nil
+}
+
+// process returns the process running the command, from its executor.
+func (c VenvCommand) process() (*exec.Cmd, error) {
+	executor := c.Executor
+	if executor == nil {
+		executor = venvExecutor{Config: c.Config}
+	}
+	cmd, err := executor.Command(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Scope != "" {
+		if err := inScope(cmd, c.Scope); err != nil {
+			return nil, errors.Wrap(err, "unable to start the command in a systemd scope")
+		}
+	}
+	// Stopped with the processes it starts, e.g. the forks of ansible-playbook
+	setProcessGroup(cmd)
+	if c.Cwd != "" {
+		cmd.Dir = c.Cwd
+	}
+	return cmd, nil
 }
 
 // Run will execute the command described in VenvCommand.
 //
 // The strings returned are Stdout/Stderr.
 func (c VenvCommand) Run() VenvCommandRunOutput {
-	ctx, cancel := context.WithTimeout(context.Background(), venvCommandTimeout)
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = venvCommandTimeout
+	}
+	parent := c.Context
+	if parent == nil {
+		parent = runsContext()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	CommandOutput := VenvCommandRunOutput{
 		Stdout:   "",
 		Stderr:   "",
@@ -161,31 +515,18 @@ func (c VenvCommand) Run() VenvCommandRunOutput {
 
 	defer cancel() // The cancel should be deferred so resources are cleaned up
 
-	path, ok := os.LookupEnv("PATH")
-	if !ok {
-		CommandOutput.Error = errors.New("Unable to lookup the $PATH env variable")
-		return CommandOutput
+	if c.Scope != "" {
+		c.Scope = scopeInvocation(c.Scope)
 	}
-
-	// Updating $PATH variable to include the venv path
-	venvPath := filepath.Join(c.Config.Path, "bin")
-	if !strings.Contains(path, venvPath) {
-		newVenvPath := fmt.Sprintf("%s:%s", filepath.Join(c.Config.Path, "bin"), path)
-		logrus.Debugln("PATH: ", newVenvPath)
-		os.Setenv("PATH", newVenvPath)
+	cmd, err := c.process()
+	if err != nil {
+		CommandOutput.Error = err
+		return CommandOutput
 	}
-
-	cmd := exec.CommandContext(
-		ctx,
-		filepath.Join(c.Config.Path, "bin", c.Binary),
-		c.Args...,
-	)
-
-	if c.Cwd != "" {
-		cmd.Dir = c.Cwd
+	if c.Scope != "" {
+		defer stopScope(c.Scope)
 	}
-
-	cmd.Env = append(os.Environ(), c.Env...)
+	addRedactedEnv(c.Env)
 
 	if c.StreamOutput {
 		stdout, _ := cmd.StdoutPipe()
@@ -194,22 +535,60 @@ func (c VenvCommand) Run() VenvCommandRunOutput {
 			CommandOutput.Error = errors.Wrap(err, "unable to start command")
 			return CommandOutput
 		}
+		exited := stopWhenDone(ctx, cmd)
+
+		// Lines go to the console stream they came from and to c.Output, whole. The buffers get the output as is,
+		// as when it isn't streamed.
+		var stdoutBuffer, stderrBuffer bytes.Buffer
+		var writeMutex sync.Mutex
+		streams := []struct {
+			pipe    io.Reader
+			console io.Writer
+		}{
+			{io.TeeReader(stdout, &stdoutBuffer), os.Stdout},
+			{io.TeeReader(stderr, &stderrBuffer), os.Stderr},
+		}
 
-		for _, stream := range []io.ReadCloser{stdout, stderr} {
-			go func(s io.ReadCloser) {
-				scanner := bufio.NewScanner(s)
-				scanner.Split(bufio.ScanLines)
-				for scanner.Scan() {
-					m := scanner.Text()
-					fmt.Println(m)
+		// Wait closes the pipes, so all output must have been read before
+		var streaming sync.WaitGroup
+		maxLine := viper.GetInt("output-max-line-size") * 1024
+		for _, stream := range streams {
+			streaming.Add(1)
+			go func(pipe io.Reader, console io.Writer) {
+				defer streaming.Done()
+				err := scanOutputLines(pipe, maxLine, func(line string) {
+					m := cleanOutput(line)
+					writeMutex.Lock()
+					defer writeMutex.Unlock()
+					fmt.Fprintln(console, m)
+					if c.Output != nil {
+						fmt.Fprintln(c.Output, m)
+					}
+				})
+				if err != nil {
+					venvLog.Warnln("Unable to read command output: ", err)
 				}
-			}(stream)
+			}(stream.pipe, stream.console)
 		}
-
-		if err := cmd.Wait(); err != nil {
-			exitError, _ := err.(*exec.ExitError)
+		streaming.Wait()
+
+		err := cmd.Wait()
+		exited()
+		CommandOutput.Usage = usageOf(cmd.ProcessState)
+		CommandOutput.Stdout = cleanOutput(stdoutBuffer.String())
+		CommandOutput.Stderr = cleanOutput(stderrBuffer.String())
+		if ctx.Err() == context.DeadlineExceeded {
+			CommandOutput.Error = timeoutError{errors.Wrapf(err, "Execution timed out after %s", timeout)}
+			CommandOutput.Exitcode = timeoutExitCode
+			return CommandOutput
+		} else if interrupted := interruptedByShutdown(ctx, err); interrupted != nil {
+			CommandOutput.Error = interrupted
+			return CommandOutput
+		} else if err != nil {
+			if exitError, ok := err.(*exec.ExitError); ok {
+				CommandOutput.Exitcode = exitError.ExitCode()
+			}
 			CommandOutput.Error = errors.Wrap(err, "unable to complete command")
-			CommandOutput.Exitcode = exitError.ExitCode()
 			return CommandOutput
 		}
 
@@ -221,15 +600,31 @@ func (c VenvCommand) Run() VenvCommandRunOutput {
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	if c.Output != nil {
+		output := newOutputWriter(c.Output)
+		defer output.Flush()
+		cmd.Stdout = io.MultiWriter(&stdout, output)
+		cmd.Stderr = io.MultiWriter(&stderr, output)
+	}
 
-	logrus.Debugln("Running venv command: ", cmd.Args)
-	err := cmd.Run()
+	venvLog.Debugln("Running venv command: ", cmd.Args)
+	err = cmd.Start()
+	if err == nil {
+		exited := stopWhenDone(ctx, cmd)
+		err = cmd.Wait()
+		exited()
+	}
 
-	CommandOutput.Stderr = stderr.String()
-	CommandOutput.Stdout = stdout.String()
+	CommandOutput.Usage = usageOf(cmd.ProcessState)
+	CommandOutput.Stderr = cleanOutput(stderr.String())
+	CommandOutput.Stdout = cleanOutput(stdout.String())
 
 	if ctx.Err() == context.DeadlineExceeded {
-		CommandOutput.Error = errors.Wrap(err, "Execution timed out")
+		CommandOutput.Error = timeoutError{errors.Wrapf(err, "Execution timed out after %s", timeout)}
+		CommandOutput.Exitcode = timeoutExitCode
+		return CommandOutput
+	} else if interrupted := interruptedByShutdown(ctx, err); interrupted != nil {
+		CommandOutput.Error = interrupted
 		return CommandOutput
 	} else if err != nil {
 		failedCommandLogger(cmd)
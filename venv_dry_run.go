@@ -0,0 +1,331 @@
+// Dry runs of pip against the requirements of the remote artifact, to review dependency changes before the
+// virtualenv is updated
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Dry run states
+const (
+	venvDryRunRunning   = "running"
+	venvDryRunCompleted = "completed"
+	venvDryRunFailed    = "failed"
+)
+
+// Kinds of package changes
+const (
+	packageInstall   = "install"
+	packageUpgrade   = "upgrade"
+	packageDowngrade = "downgrade"
+	packageReinstall = "reinstall" // Same version, e.g. from another source
+)
+
+// packageChange is a package pip would install into the virtualenv.
+type packageChange struct {
+	Name      string `json:"name"`
+	Change    string `json:"change"`
+	From      string `json:"from,omitempty"` // Installed version, empty for new packages
+	To        string `json:"to"`
+	Requested bool   `json:"requested"` // Listed in the requirements, rather than a dependency
+}
+
+// venvDryRun is the progress and result of a dry run, as returned by the API.
+type venvDryRun struct {
+	Status           string          `json:"status"`
+	VenvPath         string          `json:"venv_path"`
+	ArtifactVersion  string          `json:"artifact_version"` // MD5 of the artifact the requirements were taken from
+	RequirementsFile string          `json:"requirements_file"`
+	Changes          []packageChange `json:"changes"`
+	StartTime        time.Time       `json:"start_time"`
+	EndTime          *time.Time      `json:"end_time"`
+	Error            string          `json:"error,omitempty"`
+}
+
+// pipReport holds the fields used from the installation report of pip, see
+// https://pip.pypa.io/en/stable/reference/installation-report/
+type pipReport struct {
+	Install []struct {
+		Requested bool `json:"requested"`
+		Metadata  struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"metadata"`
+	} `json:"install"`
+}
+
+var (
+	venvDryRunMutex sync.Mutex
+	lastVenvDryRun  *venvDryRun // The running or last finished dry run
+)
+
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizePackageName returns the normalized form of a Python package name, as defined by PEP 503.
+func normalizePackageName(name string) string {
+	return pythonNameSeparators.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// DryRun returns the changes pip would make to the virtualenv to satisfy requirementsFile, without making them.
+//
+// Requires pip 22.2 or newer in the virtualenv.
+func (c VenvConfig) DryRun(requirementsFile string) ([]packageChange, error) {
+	listOutput := c.pip("list", "--format", "json", "--disable-pip-version-check").Run()
+	if listOutput.Error != nil {
+		return nil, errors.Wrap(listOutput.Error, "unable to list installed packages")
+	}
+	var installed []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(listOutput.Stdout), &installed); err != nil {
+		return nil, errors.Wrap(err, "unable to parse installed packages")
+	}
+	versions := map[string]string{}
+	for _, pkg := range installed {
+		versions[normalizePackageName(pkg.Name)] = pkg.Version
+	}
+
+	reportDir, err := ioutil.TempDir("", appName+"-pip-report")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(reportDir)
+	reportFile := filepath.Join(reportDir, "report.json")
+
+	args := append([]string{"install", "--dry-run", "--quiet", "--disable-pip-version-check", "--report", reportFile}, c.requirementArgs(requirementsFile)...)
+	if c.OfflineWheels != "" {
+		args = append(args, "--no-index", "--find-links", c.OfflineWheels)
+	} else if c.Wheelhouse != "" {
+		args = append(args, "--find-links", c.Wheelhouse)
+	}
+	output := c.pip(args...).Run()
+	if output.Error != nil {
+		return nil, errors.Wrapf(output.Error, "pip dry run failed: %s", strings.TrimSpace(output.Stderr))
+	}
+
+	data, err := ioutil.ReadFile(reportFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "pip did not write a report, it may be older than 22.2")
+	}
+	return parsePipReport(data, versions)
+}
+
+// parsePipReport lists the packages of a pip installation report, compared against the installed versions keyed
+// by normalized name.
+func parsePipReport(data []byte, installed map[string]string) ([]packageChange, error) {
+	var report pipReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the pip report")
+	}
+
+	changes := []packageChange{}
+	for _, item := range report.Install {
+		change := packageChange{
+			Name:      item.Metadata.Name,
+			Change:    packageInstall,
+			To:        item.Metadata.Version,
+			Requested: item.Requested,
+		}
+		if from, ok := installed[normalizePackageName(item.Metadata.Name)]; ok {
+			change.From = from
+			switch compareVersions(from, change.To) {
+			case -1:
+				change.Change = packageUpgrade
+			case 1:
+				change.Change = packageDowngrade
+			default:
+				change.Change = packageReinstall
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return normalizePackageName(changes[i].Name) < normalizePackageName(changes[j].Name)
+	})
+	return changes, nil
+}
+
+// compareVersions compares two version strings by their dot-separated parts, numerically where both parts are
+// numbers. It returns -1, 0 or 1. Pre-release suffixes are compared as strings, which covers the common cases.
+func compareVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart == bPart {
+			continue
+		}
+
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		if aErr == nil && bErr == nil && aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+		if aPart < bPart {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// getVenvDryRun returns a copy of the running or last finished dry run, nil if there was none.
+func getVenvDryRun() *venvDryRun {
+	venvDryRunMutex.Lock()
+	defer venvDryRunMutex.Unlock()
+
+	if lastVenvDryRun == nil {
+		return nil
+	}
+	dryRun := *lastVenvDryRun
+	return &dryRun
+}
+
+// updateVenvDryRun applies fn to the running dry run.
+func updateVenvDryRun(fn func(dryRun *venvDryRun)) {
+	venvDryRunMutex.Lock()
+	defer venvDryRunMutex.Unlock()
+
+	fn(lastVenvDryRun)
+}
+
+// startVenvDryRun starts a dry run in the background, failing if one is running.
+func startVenvDryRun() (*venvDryRun, error) {
+	venvDryRunMutex.Lock()
+	defer venvDryRunMutex.Unlock()
+
+	if lastVenvDryRun != nil && lastVenvDryRun.Status == venvDryRunRunning {
+		return nil, errors.New("a dry run is already running")
+	}
+
+	venvPath, _ := venvForRun(runSpec{})
+	lastVenvDryRun = &venvDryRun{
+		Status:           venvDryRunRunning,
+		VenvPath:         venvPath,
+		RequirementsFile: viper.GetString("venv-requirements-file"),
+		Changes:          []packageChange{},
+		StartTime:        time.Now(),
+	}
+	dryRun := *lastVenvDryRun
+
+	go runVenvDryRun(venvPath)
+	return &dryRun, nil
+}
+
+func runVenvDryRun(venvPath string) {
+	changes, err := dryRunVenv(venvPath)
+	updateVenvDryRun(func(dryRun *venvDryRun) {
+		now := time.Now()
+		dryRun.EndTime = &now
+		dryRun.Status = venvDryRunCompleted
+		if err != nil {
+			dryRun.Status = venvDryRunFailed
+			dryRun.Error = err.Error()
+			return
+		}
+		dryRun.Changes = changes
+	})
+	if err != nil {
+		venvLog.Errorln("Virtualenv dry run failed: ", err)
+		return
+	}
+
+	promVenvPendingChanges.Set(float64(len(changes)))
+	venvLog.Infof("Updating the virtualenv would change %d packages", len(changes))
+}
+
+// dryRunVenv pulls the remote artifact and dry runs pip in the virtualenv at venvPath with its requirements.
+func dryRunVenv(venvPath string) ([]packageChange, error) {
+	vCfg := configuredVenv(venvPath)
+	if _, err := os.Stat(filepath.Join(venvPath, "bin", "python")); err != nil {
+		return nil, errors.Errorf("virtualenv %s does not exist yet, it is created by the next run", venvPath)
+	}
+
+	dir, err := ioutil.TempDir("", appName+"-dry-run")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	downloader, remotePath, err := artifactDownloader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to pull the artifact")
+	}
+	version, err := fetchArtifactTo(downloader, remotePath, filepath.Join(dir, "artifact.tgz"))
+	if err != nil {
+		return nil, err
+	}
+	updateVenvDryRun(func(dryRun *venvDryRun) { dryRun.ArtifactVersion = version })
+
+	artifactDir := filepath.Join(dir, "artifact")
+	if err := extractTgz(filepath.Join(dir, "artifact.tgz"), artifactDir); err != nil {
+		return nil, errors.Wrap(err, "unable to extract tgz")
+	}
+
+	vCfg.Constraints = venvConstraintsFile(artifactDir)
+	vCfg.OfflineWheels = offlineWheelsDir(artifactDir)
+	return vCfg.DryRun(filepath.Join(artifactDir, viper.GetString("venv-requirements-file")))
+}
+
+// HandlerVenvDryRun starts a dry run of pip with the requirements of the remote artifact. Its result can be polled
+// with HandlerVenvDryRunStatus.
+func HandlerVenvDryRun(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := startVenvDryRun()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	data, err := json.Marshal(dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandlerVenvDryRunStatus returns the running or last finished dry run.
+func HandlerVenvDryRunStatus(w http.ResponseWriter, r *http.Request) {
+	dryRun := getVenvDryRun()
+	if dryRun == nil {
+		http.Error(w, "no dry run since the puller started", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPipReport = `{
+	"version": "1",
+	"install": [
+		{"requested": true, "metadata": {"name": "ansible-core", "version": "2.15.1"}},
+		{"requested": false, "metadata": {"name": "Jinja2", "version": "3.0.3"}},
+		{"requested": false, "metadata": {"name": "resolvelib", "version": "1.0.1"}},
+		{"requested": true, "metadata": {"name": "ruamel.yaml", "version": "0.17.21"}}
+	]
+}`
+
+func TestParsePipReport(t *testing.T) {
+	installed := map[string]string{"ansible-core": "2.14.6", "jinja2": "3.1.2", "ruamel-yaml": "0.17.21"}
+
+	changes, err := parsePipReport([]byte(testPipReport), installed)
+	assert.Nil(t, err)
+	assert.Equal(t, []packageChange{
+		{Name: "ansible-core", Change: packageUpgrade, From: "2.14.6", To: "2.15.1", Requested: true},
+		{Name: "Jinja2", Change: packageDowngrade, From: "3.1.2", To: "3.0.3"},
+		{Name: "resolvelib", Change: packageInstall, To: "1.0.1"},
+		{Name: "ruamel.yaml", Change: packageReinstall, From: "0.17.21", To: "0.17.21", Requested: true},
+	}, changes)
+
+	_, err = parsePipReport([]byte("not json"), installed)
+	assert.NotNil(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("1.2.0", "1.2"))
+	assert.Equal(t, -1, compareVersions("1.9", "1.10"))
+	assert.Equal(t, 1, compareVersions("2.0.1", "2.0.0"))
+	assert.Equal(t, -1, compareVersions("2.15.0b1", "2.15.0rc1"))
+}
+
+func TestNormalizePackageName(t *testing.T) {
+	assert.Equal(t, "ruamel-yaml", normalizePackageName("ruamel.yaml"))
+	assert.Equal(t, "zope-interface", normalizePackageName("Zope__Interface"))
+}
+
+func TestVenvDryRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir := t.TempDir()
+	venv := filepath.Join(dir, "venv")
+	assert.Nil(t, os.MkdirAll(filepath.Join(venv, "bin"), 0755))
+	report := filepath.Join(dir, "report.json")
+	assert.Nil(t, ioutil.WriteFile(report, []byte(testPipReport), 0644))
+
+	// Lists ansible-core as installed and copies the report to the path following --report
+	script := `#!/bin/sh
+if [ "$1" = list ]; then
+	echo '[{"name": "ansible-core", "version": "2.14.6"}]'
+	exit 0
+fi
+while [ $# -gt 0 ]; do
+	if [ "$1" = --dry-run ]; then dry=1; fi
+	if [ "$1" = --report ]; then shift; [ -n "$dry" ] && cp ` + report + ` "$1"; fi
+	shift
+done
+`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(venv, "bin", "pip"), []byte(script), 0755))
+
+	changes, err := VenvConfig{Path: venv}.DryRun(filepath.Join(dir, "requirements.txt"))
+	assert.Nil(t, err)
+	assert.Len(t, changes, 4)
+	assert.Equal(t, packageChange{Name: "ansible-core", Change: packageUpgrade, From: "2.14.6", To: "2.15.1", Requested: true}, changes[0])
+	assert.Equal(t, packageInstall, changes[1].Change)
+}
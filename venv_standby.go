@@ -0,0 +1,117 @@
+// Standby virtualenvs, built next to the current one and only switched to once they work
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Suffix of the standby virtualenvs built for venv-path, which is a symlink to the current one
+var standbySuffixPattern = regexp.MustCompile(`^\.standby-\d+$`)
+
+// EnsureStandby is Ensure, except that a virtualenv that has to be (re)created is built and updated next to the
+// current one, checked with validate, and only then switched to by replacing the symlink at Path. When building or
+// validating it fails, the current virtualenv stays in place and working.
+//
+// Path is turned into the symlink the first time, when it is a directory from before: the virtualenvs can't be
+// moved, as their scripts refer to them by path.
+func (c VenvConfig) EnsureStandby(requirementsFile string, validate func(standby VenvConfig) error) error {
+	reason := "it is missing"
+	if _, err := os.Stat(c.Path); err == nil {
+		if reason, err = c.staleReason(requirementsFile); err != nil || reason == "" {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	c.removeStandbys("")
+
+	standby := c
+	standby.Path = fmt.Sprintf("%s.standby-%d", c.Path, time.Now().UnixNano())
+	standby.ForceRebuild = false
+	venvLog.Infof("Building a standby virtualenv %s as %s", standby.Path, reason)
+	err := makeVenv(standby)
+	if err == nil {
+		err = standby.Update(requirementsFile)
+	}
+	if err == nil {
+		err = validate(standby)
+	}
+	if err != nil {
+		os.RemoveAll(standby.Path)
+		return errors.Wrap(err, "standby virtualenv failed, keeping the current one")
+	}
+
+	if err := c.switchTo(standby.Path); err != nil {
+		return err
+	}
+	venvLog.Infoln("Switched to the virtualenv ", standby.Path)
+	c.removeStandbys(standby.Path)
+	return nil
+}
+
+// switchTo atomically points the symlink at Path to dir, replacing it. A directory at Path is moved aside first and
+// removed afterwards.
+func (c VenvConfig) switchTo(dir string) error {
+	link := c.Path + ".switch"
+	os.Remove(link)
+	// Relative, as the virtualenvs are next to each other
+	if err := os.Symlink(filepath.Base(dir), link); err != nil {
+		return errors.Wrap(err, "unable to link the standby virtualenv")
+	}
+
+	var previous string
+	if info, err := os.Lstat(c.Path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		previous = c.Path + ".previous"
+		os.RemoveAll(previous)
+		if err := os.Rename(c.Path, previous); err != nil {
+			os.Remove(link)
+			return errors.Wrap(err, "unable to move the current virtualenv aside")
+		}
+	}
+	if err := os.Rename(link, c.Path); err != nil {
+		os.Remove(link)
+		return errors.Wrap(err, "unable to switch to the standby virtualenv")
+	}
+	if previous != "" {
+		os.RemoveAll(previous)
+	}
+
+	return nil
+}
+
+// removeStandbys removes the standby virtualenvs of Path but current, those that were replaced or left behind by
+// an interrupted build.
+func (c VenvConfig) removeStandbys(current string) {
+	paths, _ := filepath.Glob(c.Path + ".*")
+	for _, path := range paths {
+		if path == current || !standbySuffixPattern.MatchString(strings.TrimPrefix(path, c.Path)) {
+			continue
+		}
+		if path == venvDir(c.Path) {
+			continue
+		}
+		venvLog.Debugln("Removing the standby virtualenv ", path)
+		os.RemoveAll(path)
+	}
+}
+
+// venvDir returns the directory of the virtualenv at path, which is the current standby when path is the symlink
+// to it.
+func venvDir(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return path
+	}
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(filepath.Dir(path), target)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVenvEnsureStandby(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir := t.TempDir()
+	// Creates virtualenvs with a pip that does nothing
+	python := filepath.Join(dir, "python3")
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && echo Python 3.10.12 && exit\n" +
+		"mkdir -p \"$3/bin\" && touch \"$3/bin/python\" && printf '#!/bin/sh\\n' > \"$3/bin/pip\" && chmod +x \"$3/bin/pip\"\n"
+	assert.Nil(t, ioutil.WriteFile(python, []byte(script), 0755))
+	requirements := filepath.Join(dir, "requirements.txt")
+	assert.Nil(t, ioutil.WriteFile(requirements, []byte("ansible-core==2.15.0\n"), 0644))
+
+	cfg := VenvConfig{Path: filepath.Join(dir, "venv"), Python: python, Standby: true}
+	var validated []string
+	validate := func(standby VenvConfig) error {
+		validated = append(validated, standby.Path)
+		return nil
+	}
+	current := func() string {
+		target, err := os.Readlink(cfg.Path)
+		assert.Nil(t, err)
+		return filepath.Join(dir, target)
+	}
+	standbys := func() []string {
+		paths, _ := filepath.Glob(cfg.Path + ".standby-*")
+		return paths
+	}
+
+	// A virtualenv from before standbys is replaced by a symlink
+	assert.Nil(t, os.MkdirAll(filepath.Join(cfg.Path, "bin"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(cfg.Path, venvMarkerFileName), []byte(`{"requirements":"other"}`), 0644))
+	assert.Nil(t, cfg.EnsureStandby(requirements, validate))
+	assert.Equal(t, []string{current()}, validated)
+	assert.FileExists(t, filepath.Join(cfg.Path, venvMarkerFileName))
+	assert.NoDirExists(t, cfg.Path+".previous")
+
+	// Up to date
+	assert.Nil(t, cfg.EnsureStandby(requirements, validate))
+	assert.Len(t, validated, 1)
+
+	// A standby that doesn't work is dropped, the current virtualenv stays
+	working := current()
+	assert.Nil(t, ioutil.WriteFile(requirements, []byte("ansible-core==2.16.0\n"), 0644))
+	err := cfg.EnsureStandby(requirements, func(VenvConfig) error { return errors.New("ansible --version failed") })
+	assert.EqualError(t, err, "standby virtualenv failed, keeping the current one: ansible --version failed")
+	assert.Equal(t, working, current())
+	assert.Equal(t, []string{working}, standbys())
+
+	// One that works replaces it
+	assert.Nil(t, cfg.EnsureStandby(requirements, validate))
+	assert.NotEqual(t, working, current())
+	assert.Equal(t, []string{current()}, standbys())
+	assert.Equal(t, current(), venvDir(cfg.Path))
+	reason, err := cfg.staleReason(requirements)
+	assert.Nil(t, err)
+	assert.Equal(t, "", reason)
+}
@@ -0,0 +1,518 @@
+// Upgrades of ansible-core that are checked against the current version before the puller switches to them
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Package that is pinned to the requested version
+const ansibleCorePackage = "ansible-core"
+
+// Upgrade states
+const (
+	venvUpgradeRunning     = "running"
+	venvUpgradeSwitched    = "switched"
+	venvUpgradeDifferences = "differences" // The check runs differed, the puller kept the current virtualenv
+	venvUpgradeFailed      = "failed"
+)
+
+// Versions accepted by pip, without anything that could be taken for another requirement or option
+var ansibleVersionPattern = regexp.MustCompile(`^[0-9][0-9A-Za-z.+!-]*$`)
+
+// venvUpgrade is the progress and result of an upgrade, as returned by the API.
+type venvUpgrade struct {
+	AnsibleVersion    string           `json:"ansible_version"`
+	VenvPath          string           `json:"venv_path"` // Virtualenv built for the requested version
+	Status            string           `json:"status"`
+	Force             bool             `json:"force"` // Switch even if the check runs differ
+	BaselineRunID     string           `json:"baseline_run_id,omitempty"`
+	CandidateRunID    string           `json:"candidate_run_id,omitempty"`
+	BaselineExitCode  *int             `json:"baseline_exit_code"`
+	CandidateExitCode *int             `json:"candidate_exit_code"`
+	Differences       []taskDifference `json:"differences"`
+	StartTime         time.Time        `json:"start_time"`
+	EndTime           *time.Time       `json:"end_time"`
+	Error             string           `json:"error,omitempty"`
+}
+
+// taskDifference is a task whose result differs between the check runs with the current and the requested version.
+type taskDifference struct {
+	Play      string `json:"play"`
+	Task      string `json:"task"`
+	Host      string `json:"host"`
+	Baseline  string `json:"baseline"`  // Status with the current version, empty if the task did not run
+	Candidate string `json:"candidate"` // Status with the requested version, empty if the task did not run
+}
+
+var (
+	venvUpgradeMutex sync.Mutex
+	lastVenvUpgrade  *venvUpgrade // The running or last finished upgrade
+)
+
+// getVenvUpgrade returns a copy of the running or last finished upgrade, nil if there was none.
+func getVenvUpgrade() *venvUpgrade {
+	venvUpgradeMutex.Lock()
+	defer venvUpgradeMutex.Unlock()
+
+	if lastVenvUpgrade == nil {
+		return nil
+	}
+	upgrade := *lastVenvUpgrade
+	return &upgrade
+}
+
+// updateVenvUpgrade applies fn to the running upgrade.
+func updateVenvUpgrade(fn func(upgrade *venvUpgrade)) {
+	venvUpgradeMutex.Lock()
+	defer venvUpgradeMutex.Unlock()
+
+	fn(lastVenvUpgrade)
+}
+
+// venvForRun returns the virtualenv and the pinned ansible-core version of a run: the candidate of an upgrade for
+// its check run, or the virtualenv the last upgrade switched to, or venv-path.
+func venvForRun(spec runSpec) (string, string) {
+	if spec.VenvPath != "" {
+		return spec.VenvPath, spec.AnsibleVersion
+	}
+
+	state, err := loadState()
+	if err != nil {
+		venvLog.Warnln("Unable to load the upgraded virtualenv from state: ", err)
+	}
+	if state.VenvPath == "" {
+		return viper.GetString("venv-path"), state.AnsibleVersion
+	}
+
+	return state.VenvPath, state.AnsibleVersion
+}
+
+// ephemeralVenv returns the fresh virtualenv a run in runDir builds for itself with venv-ephemeral, or "" if it
+// uses a kept one. The check runs of upgrades keep using the candidate virtualenv.
+func ephemeralVenv(spec runSpec, runDir string) string {
+	if !viper.GetBool("venv-ephemeral") || spec.VenvPath != "" {
+		return ""
+	}
+	return filepath.Join(runDir, ".venv")
+}
+
+// configuredVenv returns the virtualenv at path, built as configured by the "venv-*" options.
+func configuredVenv(path string) VenvConfig {
+	return VenvConfig{
+		Path:       path,
+		Python:     viper.GetString("venv-python"),
+		Wheelhouse: viper.GetString("venv-wheelhouse"),
+		PipTimeout: time.Duration(viper.GetInt("venv-pip-timeout")) * time.Minute,
+		CleanEnv:   viper.GetBool("venv-clean-env"),
+		// Ephemeral virtualenvs are never used by more than one run
+		Standby: viper.GetBool("venv-standby") && !viper.GetBool("venv-ephemeral"),
+
+		IndexURL:       viper.GetString("venv-pip-index-url"),
+		ExtraIndexURLs: viper.GetStringSlice("venv-pip-extra-index-urls"),
+		RequireHashes:  viper.GetBool("venv-require-hashes"),
+		PipCacheDir:    viper.GetString("venv-pip-cache-dir"),
+	}
+}
+
+// offlineWheelsDir returns the directory of the wheels bundled in the artifact extracted to artifactDir, which the
+// requirements are installed from in offline mode. It is empty if not offline.
+func offlineWheelsDir(artifactDir string) string {
+	if !viper.GetBool("offline") {
+		return ""
+	}
+	return filepath.Join(artifactDir, viper.GetString("offline-wheels-dir"))
+}
+
+// venvConstraintsFile returns the pip constraints file set by venv-constraints-file in the artifact extracted to
+// artifactDir, or itself if it is an absolute path. It is empty if none is set.
+func venvConstraintsFile(artifactDir string) string {
+	constraints := viper.GetString("venv-constraints-file")
+	if constraints == "" || filepath.IsAbs(constraints) {
+		return constraints
+	}
+	return filepath.Join(artifactDir, constraints)
+}
+
+// upgradeVenvPath returns where the virtualenv for an ansible-core version is built, next to venv-path.
+func upgradeVenvPath(version string) string {
+	return fmt.Sprintf("%s-ansible-%s", viper.GetString("venv-path"), version)
+}
+
+// diffRunReports lists the results that differ between two runs of the same playbook. Tasks are matched by play,
+// name and occurrence, so repeated tasks are compared in order.
+func diffRunReports(baseline, candidate RunReport) []taskDifference {
+	type taskKey struct {
+		play, name string
+		occurrence int
+	}
+	index := func(report RunReport) ([]taskKey, map[taskKey]TaskReport) {
+		keys := []taskKey{}
+		tasks := map[taskKey]TaskReport{}
+		seen := map[[2]string]int{}
+		for _, task := range report.Tasks {
+			key := taskKey{task.Play, task.Name, seen[[2]string{task.Play, task.Name}]}
+			seen[[2]string{task.Play, task.Name}]++
+			keys = append(keys, key)
+			tasks[key] = task
+		}
+		return keys, tasks
+	}
+
+	baselineKeys, baselineTasks := index(baseline)
+	candidateKeys, candidateTasks := index(candidate)
+
+	differences := []taskDifference{}
+	compare := func(key taskKey) {
+		var hosts []string
+		for host := range baselineTasks[key].Hosts {
+			hosts = append(hosts, host)
+		}
+		for host := range candidateTasks[key].Hosts {
+			if _, ok := baselineTasks[key].Hosts[host]; !ok {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			before, after := baselineTasks[key].Hosts[host], candidateTasks[key].Hosts[host]
+			if before != after {
+				differences = append(differences, taskDifference{
+					Play: key.play, Task: key.name, Host: host, Baseline: before, Candidate: after,
+				})
+			}
+		}
+	}
+
+	for _, key := range baselineKeys {
+		compare(key)
+	}
+	for _, key := range candidateKeys {
+		if _, ok := baselineTasks[key]; !ok {
+			compare(key)
+		}
+	}
+
+	return differences
+}
+
+// startVenvUpgrade starts an upgrade to an ansible-core version in the background, failing if one is running.
+func startVenvUpgrade(version string, force bool) (*venvUpgrade, error) {
+	if !ansibleVersionPattern.MatchString(version) {
+		return nil, errors.Errorf("invalid ansible-core version %q", version)
+	}
+	// Only a version is pinned, whose hashes aren't known
+	if viper.GetBool("venv-require-hashes") {
+		return nil, errors.New("ansible-core can't be upgraded with venv-require-hashes, pin it with its hashes in the requirements instead")
+	}
+
+	venvUpgradeMutex.Lock()
+	defer venvUpgradeMutex.Unlock()
+
+	if lastVenvUpgrade != nil && lastVenvUpgrade.Status == venvUpgradeRunning {
+		return nil, errors.Errorf("an upgrade to ansible-core %s is already running", lastVenvUpgrade.AnsibleVersion)
+	}
+
+	lastVenvUpgrade = &venvUpgrade{
+		AnsibleVersion: version,
+		VenvPath:       upgradeVenvPath(version),
+		Status:         venvUpgradeRunning,
+		Force:          force,
+		Differences:    []taskDifference{},
+		StartTime:      time.Now(),
+	}
+	upgrade := *lastVenvUpgrade
+
+	go runVenvUpgrade(upgrade)
+	return &upgrade, nil
+}
+
+// runVenvUpgrade runs the playbook in check mode with the current virtualenv and a new one with the requested
+// version, and switches to the new one if both runs had the same results.
+func runVenvUpgrade(upgrade venvUpgrade) {
+	logger := logrus.WithFields(logrus.Fields{"ansible_version": upgrade.AnsibleVersion})
+
+	status, err := checkVenvUpgrade(upgrade, logger)
+	updateVenvUpgrade(func(upgrade *venvUpgrade) {
+		now := time.Now()
+		upgrade.EndTime = &now
+		upgrade.Status = status
+		if err != nil {
+			upgrade.Status = venvUpgradeFailed
+			upgrade.Error = err.Error()
+		}
+	})
+	if err != nil {
+		logger.Errorln("Upgrade of ansible-core failed: ", err)
+	}
+}
+
+// checkVenvUpgrade does the work of runVenvUpgrade, returning the final status of the upgrade.
+func checkVenvUpgrade(upgrade venvUpgrade, logger *logrus.Entry) (string, error) {
+	playbook := viper.GetString("ansible-playbook")
+
+	logger.Infoln("Checking the playbook with the current virtualenv")
+	baselineID := uuid.NewV4().String()
+	updateVenvUpgrade(func(upgrade *venvUpgrade) { upgrade.BaselineRunID = baselineID })
+	baseline, err := executeRun(runSpec{ID: baselineID, Playbook: playbook, CheckMode: true, Trigger: runTriggerUpgrade})
+	if baseline == nil {
+		return "", errors.Wrap(err, "check run with the current virtualenv failed")
+	}
+
+	// The candidate runs the artifact the baseline pulled, so that only the virtualenv differs between the two
+	artifact, err := baselineArtifact(baselineID)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(artifact)
+
+	logger.Infoln("Checking the playbook with a virtualenv at ", upgrade.VenvPath)
+	candidateID := uuid.NewV4().String()
+	updateVenvUpgrade(func(upgrade *venvUpgrade) { upgrade.CandidateRunID = candidateID })
+	candidate, err := executeRun(runSpec{
+		ID:             candidateID,
+		Playbook:       playbook,
+		CheckMode:      true,
+		Trigger:        runTriggerUpgrade,
+		Artifact:       artifact,
+		VenvPath:       upgrade.VenvPath,
+		AnsibleVersion: upgrade.AnsibleVersion,
+	})
+	if candidate == nil {
+		return "", errors.Wrapf(err, "check run with ansible-core %s failed", upgrade.AnsibleVersion)
+	}
+
+	differences := diffRunReports(*baseline, *candidate)
+	same := len(differences) == 0 && baseline.ExitCode == candidate.ExitCode
+	updateVenvUpgrade(func(upgrade *venvUpgrade) {
+		upgrade.BaselineExitCode = &baseline.ExitCode
+		upgrade.CandidateExitCode = &candidate.ExitCode
+		upgrade.Differences = differences
+	})
+	if !same && !upgrade.Force {
+		logger.Warnf("Check runs differ in %d task results and exit code %d against %d, keeping the current virtualenv",
+			len(differences), baseline.ExitCode, candidate.ExitCode)
+		return venvUpgradeDifferences, nil
+	}
+
+	err = updateState(func(state *PullerState) {
+		state.VenvPath = upgrade.VenvPath
+		state.AnsibleVersion = upgrade.AnsibleVersion
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to switch virtualenv")
+	}
+
+	logger.Infoln("Switched to the virtualenv at ", upgrade.VenvPath)
+	return venvUpgradeSwitched, nil
+}
+
+// baselineArtifact copies the artifact the baseline run of an upgrade ran to a new temporary file.
+func baselineArtifact(runID string) (string, error) {
+	record := runs.get(runID)
+	if record == nil || record.Context == nil {
+		return "", errors.Errorf("check run %s with the current virtualenv did not record its artifact", runID)
+	}
+
+	artifact, err := replayArtifact(record.Context.ArtifactVersion, record.Context.ArtifactCommit)
+	return artifact, errors.Wrap(err, "unable to keep the artifact of the check run with the current virtualenv")
+}
+
+// resetVenv switches back to venv-path and the ansible-core version of the requirements file.
+func resetVenv() error {
+	return updateState(func(state *PullerState) {
+		state.VenvPath = ""
+		state.AnsibleVersion = ""
+	})
+}
+
+// venvUpgradeRequest is the body accepted by HandlerVenvUpgrade.
+type venvUpgradeRequest struct {
+	Ansible string `json:"ansible"` // ansible-core version to upgrade to
+	Force   bool   `json:"force"`
+}
+
+// HandlerVenvUpgrade starts an upgrade of ansible-core. Its progress can be polled with HandlerVenvUpgradeStatus.
+func HandlerVenvUpgrade(w http.ResponseWriter, r *http.Request) {
+	if ansibleDisabled {
+		http.Error(w, "ansible puller is disabled", http.StatusConflict)
+		return
+	}
+
+	var request venvUpgradeRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid upgrade request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ansibleVersionPattern.MatchString(request.Ansible) {
+		http.Error(w, fmt.Sprintf("invalid ansible-core version %q", request.Ansible), http.StatusBadRequest)
+		return
+	}
+	if err := runQuotas.allow(runSourceUpgrade); err != nil {
+		httpQuotaExceeded(w, err)
+		return
+	}
+
+	upgrade, err := startVenvUpgrade(request.Ansible, request.Force)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	data, err := json.Marshal(upgrade)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandlerVenvUpgradeStatus returns the running or last finished upgrade.
+func HandlerVenvUpgradeStatus(w http.ResponseWriter, r *http.Request) {
+	upgrade := getVenvUpgrade()
+	if upgrade == nil {
+		http.Error(w, "no upgrade since the puller started", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(upgrade)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerVenvReset switches back to venv-path, undoing upgrades.
+func HandlerVenvReset(w http.ResponseWriter, r *http.Request) {
+	if upgrade := getVenvUpgrade(); upgrade != nil && upgrade.Status == venvUpgradeRunning {
+		http.Error(w, "an upgrade is running", http.StatusConflict)
+		return
+	}
+
+	if err := resetVenv(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// How often the CLI polls the progress of an upgrade
+var venvUpgradePollInterval = 5 * time.Second
+
+var (
+	venvFlags   = pflag.NewFlagSet("venv", pflag.ContinueOnError)
+	venvAnsible = venvFlags.String("ansible", "", "ansible-core version to upgrade to")
+	venvForce   = venvFlags.Bool("force", false, "Switch to the new version even if the check runs differ")
+	venvURL     = venvFlags.String("url", "", "URL of the daemon. Derived from http-socket or http-listen-string by default")
+)
+
+// writeVenvUpgrade prints the result of an upgrade.
+func writeVenvUpgrade(w io.Writer, upgrade venvUpgrade) {
+	fmt.Fprintf(w, "Upgrade to ansible-core %s: %s\n", upgrade.AnsibleVersion, upgrade.Status)
+	if upgrade.Error != "" {
+		fmt.Fprintf(w, "  Error:      %s\n", upgrade.Error)
+	}
+	if upgrade.BaselineExitCode != nil && upgrade.CandidateExitCode != nil {
+		fmt.Fprintf(w, "  Exit codes: %d current, %d new\n", *upgrade.BaselineExitCode, *upgrade.CandidateExitCode)
+	}
+	for _, difference := range upgrade.Differences {
+		fmt.Fprintf(w, "  %s / %s on %s: %s -> %s\n", difference.Play, difference.Task, difference.Host,
+			orNone(difference.Baseline), orNone(difference.Candidate))
+	}
+}
+
+func orNone(status string) string {
+	if status == "" {
+		return "not run"
+	}
+	return status
+}
+
+func runVenvCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s venv upgrade --ansible VERSION [--force] | reset", appName)
+	}
+
+	url := *venvURL
+	if url == "" {
+		url = defaultDaemonURL()
+	}
+	client := newDaemonClient(url)
+
+	switch args[0] {
+	case "reset":
+		if _, err := client.post(httpPathVenvReset, nil); err != nil {
+			return err
+		}
+		venvLog.Infoln("Switched back to ", viper.GetString("venv-path"))
+		return nil
+	case "upgrade":
+	default:
+		return fmt.Errorf("unknown venv operation: %s", args[0])
+	}
+
+	if *venvAnsible == "" {
+		return errors.New("--ansible is required")
+	}
+	if _, err := client.post(httpPathVenvUpgrade, venvUpgradeRequest{Ansible: *venvAnsible, Force: *venvForce}); err != nil {
+		return err
+	}
+
+	venvLog.Infoln("Checking the playbook with ansible-core ", *venvAnsible, ", this may take a while")
+	for {
+		time.Sleep(venvUpgradePollInterval)
+
+		body, err := client.get(httpPathVenvUpgrade)
+		if err != nil {
+			return err
+		}
+		var upgrade venvUpgrade
+		if err := json.Unmarshal(body, &upgrade); err != nil {
+			return errors.Wrap(err, "unable to parse upgrade status")
+		}
+		if upgrade.Status == venvUpgradeRunning {
+			continue
+		}
+
+		writeVenvUpgrade(os.Stdout, upgrade)
+		if upgrade.Status != venvUpgradeSwitched {
+			return fmt.Errorf("ansible-core %s was not switched to", upgrade.AnsibleVersion)
+		}
+		return nil
+	}
+}
+
+func init() {
+	registerSubcommand(subcommand{
+		Name:        "venv",
+		Usage:       "upgrade --ansible VERSION [--force] | reset",
+		Description: "Upgrade ansible-core after checking the playbook with it, or undo upgrades",
+		Flags:       venvFlags,
+		Operations:  []string{"upgrade", "reset"},
+		Run:         runVenvCommand,
+	})
+}
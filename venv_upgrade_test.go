@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffRunReports(t *testing.T) {
+	baseline := RunReport{Tasks: []TaskReport{
+		{Play: "base", Name: "Install packages", Hosts: map[string]string{"host01": "ok"}},
+		{Play: "base", Name: "Restart", Hosts: map[string]string{"host01": "skipped"}},
+		{Play: "base", Name: "Restart", Hosts: map[string]string{"host01": "ok"}},
+		{Play: "base", Name: "Removed", Hosts: map[string]string{"host01": "ok"}},
+	}}
+	candidate := RunReport{Tasks: []TaskReport{
+		{Play: "base", Name: "Install packages", Hosts: map[string]string{"host01": "ok"}},
+		{Play: "base", Name: "Restart", Hosts: map[string]string{"host01": "skipped"}},
+		{Play: "base", Name: "Restart", Hosts: map[string]string{"host01": "failed"}},
+		{Play: "base", Name: "Added", Hosts: map[string]string{"host01": "changed"}},
+	}}
+
+	assert.Equal(t, []taskDifference{
+		{Play: "base", Task: "Restart", Host: "host01", Baseline: "ok", Candidate: "failed"},
+		{Play: "base", Task: "Removed", Host: "host01", Baseline: "ok", Candidate: ""},
+		{Play: "base", Task: "Added", Host: "host01", Baseline: "", Candidate: "changed"},
+	}, diffRunReports(baseline, candidate))
+	assert.Empty(t, diffRunReports(baseline, baseline))
+}
+
+func TestVenvForRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ansible_puller_venv_upgrade")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	originalStateDir := viper.GetString("state-dir")
+	originalVenvPath := viper.GetString("venv-path")
+	viper.Set("state-dir", dir)
+	viper.Set("venv-path", "/opt/venv")
+	defer func() {
+		viper.Set("state-dir", originalStateDir)
+		viper.Set("venv-path", originalVenvPath)
+	}()
+
+	path, version := venvForRun(runSpec{})
+	assert.Equal(t, "/opt/venv", path)
+	assert.Equal(t, "", version)
+
+	assert.Nil(t, updateState(func(state *PullerState) {
+		state.VenvPath = upgradeVenvPath("2.16.3")
+		state.AnsibleVersion = "2.16.3"
+	}))
+	path, version = venvForRun(runSpec{})
+	assert.Equal(t, "/opt/venv-ansible-2.16.3", path)
+	assert.Equal(t, "2.16.3", version)
+
+	path, version = venvForRun(runSpec{VenvPath: "/opt/venv-ansible-2.17.0", AnsibleVersion: "2.17.0"})
+	assert.Equal(t, "/opt/venv-ansible-2.17.0", path)
+	assert.Equal(t, "2.17.0", version)
+
+	assert.Nil(t, resetVenv())
+	path, version = venvForRun(runSpec{})
+	assert.Equal(t, "/opt/venv", path)
+	assert.Equal(t, "", version)
+}
+
+func TestVenvUpgradeEndpointValidation(t *testing.T) {
+	originalDisabled := ansibleDisabled
+	ansibleDisabled = false
+	defer func() { ansibleDisabled = originalDisabled }()
+
+	for _, body := range []string{`{"ansible": "2.16.3 --index-url http://evil"}`, `{"ansible": ""}`, `{"version": "2.16.3"}`} {
+		req, err := http.NewRequest("POST", httpPathVenvUpgrade, bytes.NewBufferString(body))
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(HandlerVenvUpgrade).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestVenvUpgradeRequireHashes(t *testing.T) {
+	withSettings(t, map[string]interface{}{"venv-require-hashes": true})
+
+	// Only a version would be pinned, without its hashes
+	_, err := startVenvUpgrade("2.16.3", false)
+	assert.EqualError(t, err, "ansible-core can't be upgraded with venv-require-hashes, pin it with its hashes in the requirements instead")
+}
+
+func TestEphemeralVenv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("venvs have no bin directory on windows")
+	}
+
+	withSettings(t, map[string]interface{}{"state-dir": t.TempDir()})
+	dir := t.TempDir()
+	wheelhouse := filepath.Join(dir, "wheelhouse")
+	withSettings(t, map[string]interface{}{"venv-ephemeral": false, "venv-standby": true, "venv-wheelhouse": wheelhouse})
+	runDir := filepath.Join(dir, "run")
+	assert.Equal(t, "", ephemeralVenv(runSpec{}, runDir))
+
+	viper.Set("venv-ephemeral", true)
+	path := ephemeralVenv(runSpec{}, runDir)
+	assert.Equal(t, filepath.Join(runDir, ".venv"), path)
+	// The candidate of an upgrade is what its check run is about
+	assert.Equal(t, "", ephemeralVenv(runSpec{VenvPath: "/opt/venv-ansible-2.17.0"}, runDir))
+
+	// Built from scratch in the run directory, with the wheels of the wheelhouse
+	calls := filepath.Join(dir, "calls")
+	pip := filepath.Join(dir, "pip")
+	assert.Nil(t, ioutil.WriteFile(pip, []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755))
+	python := filepath.Join(dir, "python3")
+	script := "#!/bin/sh\nif [ \"$1\" = -m ]; then mkdir -p \"$3/bin\" && cp " + pip + " \"$3/bin/pip\"; else echo Python 3.10.12; fi\n"
+	assert.Nil(t, ioutil.WriteFile(python, []byte(script), 0755))
+	requirements := filepath.Join(dir, "requirements.txt")
+	assert.Nil(t, ioutil.WriteFile(requirements, []byte("ansible-core==2.15.0\n"), 0644))
+
+	cfg := configuredVenv(path)
+	cfg.Python = python
+	assert.False(t, cfg.Standby)
+	assert.Nil(t, cfg.Ensure(requirements))
+	assert.Nil(t, cfg.Update(requirements))
+	assert.FileExists(t, filepath.Join(path, "bin", "pip"))
+	called, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Contains(t, string(called), "install --no-index --find-links "+wheelhouse+" -r "+requirements+"\n")
+}
+
+func TestBaselineArtifact(t *testing.T) {
+	originalRuns := runs
+	runs = newRunRegistry(10)
+	defer func() { runs = originalRuns }()
+	originalCacheFile := localCacheFile
+	localCacheFile = filepath.Join(t.TempDir(), "artifact.tgz")
+	defer func() { localCacheFile = originalCacheFile }()
+
+	_, err := baselineArtifact("unknown")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(localCacheFile, []byte("pulled by the baseline"), 0600))
+	version, err := md5sum(localCacheFile)
+	assert.NoError(t, err)
+	runs.started(runSpec{ID: "baseline", CheckMode: true, Trigger: runTriggerUpgrade})
+	runs.finished("baseline", runOutcome{Context: &runContextVars{ArtifactVersion: version}})
+
+	artifact, err := baselineArtifact("baseline")
+	assert.NoError(t, err)
+	defer os.Remove(artifact)
+	// A copy, which a run pulling a newer version meanwhile doesn't replace
+	assert.NotEqual(t, localCacheFile, artifact)
+	data, err := ioutil.ReadFile(artifact)
+	assert.NoError(t, err)
+	assert.Equal(t, "pulled by the baseline", string(data))
+}
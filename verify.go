@@ -0,0 +1,179 @@
+// Verification of downloaded artifacts before they are extracted
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	verificationMutex sync.Mutex
+	verificationError string // Why the last verification failed, empty if it succeeded
+)
+
+func setVerificationError(err error) {
+	verificationMutex.Lock()
+	defer verificationMutex.Unlock()
+
+	verificationError = ""
+	if err != nil {
+		verificationError = err.Error()
+	}
+}
+
+func lastVerificationError() string {
+	verificationMutex.Lock()
+	defer verificationMutex.Unlock()
+
+	return verificationError
+}
+
+// verifyArtifact checks the artifact at localPath against the .sha256 checksum and/or the detached .asc
+// signature published next to remotePath, as configured.
+//
+// A failed verification removes the artifact, so that it is downloaded again in the next cycle.
+func verifyArtifact(downloader downloader, remotePath, localPath string) error {
+	checkSHA256 := viper.GetBool("verify-sha256")
+	checkSignature := viper.GetBool("verify-signature")
+	if !checkSHA256 && !checkSignature {
+		return nil
+	}
+
+	err := verifyArtifactWith(downloader, remotePath, localPath, checkSHA256, checkSignature, viper.GetString("verify-keyring"))
+	setVerificationError(err)
+	if err != nil {
+		promVerificationFailures.Inc()
+		os.Remove(localPath)
+		if isTransient(err) {
+			return errors.Wrap(err, "artifact verification failed")
+		}
+		// The artifact is bad or unsigned, which downloading it again won't change
+		return fatalError{errors.Wrap(err, "artifact verification failed")}
+	}
+
+	return nil
+}
+
+func verifyArtifactWith(downloader downloader, remotePath, localPath string, checkSHA256, checkSignature bool, keyring string) error {
+	if _, ok := downloader.(gitDownloader); ok {
+		return errors.New("verification is not supported for git-url")
+	}
+
+	dir, err := ioutil.TempDir("", appName+"-verify")
+	if err != nil {
+		return errors.Wrap(err, "unable to create verification directory")
+	}
+	defer os.RemoveAll(dir)
+
+	if checkSHA256 {
+		checksumFile := filepath.Join(dir, "artifact.sha256")
+		if err := downloader.Download(remotePath+".sha256", checksumFile); err != nil {
+			return errors.Wrap(err, "unable to download .sha256 checksum")
+		}
+		if err := verifySHA256(localPath, checksumFile); err != nil {
+			return err
+		}
+		logrus.Infof("Verified SHA-256 checksum of %s", remotePath)
+	}
+
+	if checkSignature {
+		signatureFile := filepath.Join(dir, "artifact.asc")
+		if err := downloader.Download(remotePath+".asc", signatureFile); err != nil {
+			return errors.Wrap(err, "unable to download .asc signature")
+		}
+		if err := verifySignature(localPath, signatureFile, keyring, filepath.Join(dir, "gnupg")); err != nil {
+			return err
+		}
+		logrus.Infof("Verified signature of %s", remotePath)
+	}
+
+	return nil
+}
+
+// verifySHA256 compares the SHA-256 of path with the one in checksumFile, in the format of sha256sum or a bare digest.
+func verifySHA256(path, checksumFile string) error {
+	content, err := ioutil.ReadFile(checksumFile)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return errors.New("empty .sha256 checksum")
+	}
+	expected := strings.ToLower(fields[0])
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		logrus.Debugf("SHA-256 checksums do not match: '%s' != '%s'", actual, expected)
+		return errors.New("SHA-256 checksum does not match")
+	}
+
+	return nil
+}
+
+// verifySignature checks the detached signature of path with gpg against the public keys in keyring only,
+// using a throwaway home directory so that keys on the host are not trusted.
+func verifySignature(path, signatureFile, keyring, home string) error {
+	if keyring == "" {
+		return errors.New("verify-keyring is required to verify signatures")
+	}
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return errors.Wrap(err, "unable to create gpg home directory")
+	}
+
+	gpg := func(args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--no-tty"}, args...)...)
+		cmd.Env = commandEnv()
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			logrus.Debugln("gpg output: ", stderr.String())
+		}
+		return stdout.String(), err
+	}
+
+	if _, err := gpg("--import", keyring); err != nil {
+		return errors.Wrap(err, "unable to import verify-keyring")
+	}
+
+	status, err := gpg("--status-fd", "1", "--verify", signatureFile, path)
+	if err != nil {
+		return errors.Wrap(err, "signature verification failed")
+	}
+
+	// Signatures by expired or revoked keys are reported as EXPKEYSIG or REVKEYSIG instead of GOODSIG
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "[GNUPG:] GOODSIG ") {
+			return nil
+		}
+	}
+
+	return errors.New("no valid signature from a key in verify-keyring")
+}
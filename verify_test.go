@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fileDownloader serves remote paths from a local directory.
+type fileDownloader struct {
+	dir string
+}
+
+func (d fileDownloader) Download(remotePath, outputPath string) error {
+	content, err := ioutil.ReadFile(filepath.Join(d.dir, remotePath))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath, content, 0644)
+}
+
+func (d fileDownloader) RemoteChecksum(remotePath string) (string, error) {
+	return "", nil
+}
+
+func TestVerifySHA256(t *testing.T) {
+	remote := t.TempDir()
+	local := filepath.Join(t.TempDir(), "infra.tgz")
+	assert.Nil(t, ioutil.WriteFile(local, testText, 0644))
+
+	sum := sha256.Sum256(testText)
+	digest := hex.EncodeToString(sum[:])
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "infra.tgz.sha256"), []byte(digest+"  infra.tgz\n"), 0644))
+	assert.Nil(t, verifyArtifactWith(fileDownloader{remote}, "infra.tgz", local, true, false, ""))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(remote, "infra.tgz.sha256"), []byte(strings.Repeat("0", 64)), 0644))
+	assert.NotNil(t, verifyArtifactWith(fileDownloader{remote}, "infra.tgz", local, true, false, ""))
+
+	// A missing checksum fails the verification
+	assert.NotNil(t, verifyArtifactWith(fileDownloader{remote}, "other.tgz", local, true, false, ""))
+}
+
+func TestVerifySignature(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	// Sign with a throwaway key in its own home directory
+	signer := t.TempDir()
+	gpg := func(args ...string) {
+		output, err := exec.Command("gpg", append([]string{"--homedir", signer, "--batch", "--passphrase", ""}, args...)...).CombinedOutput()
+		assert.Nil(t, err, string(output))
+	}
+	gpg("--quick-gen-key", "--pinentry-mode", "loopback", "Test Signer <signer@example.com>", "ed25519", "sign", "never")
+
+	remote := t.TempDir()
+	artifact := filepath.Join(remote, "infra.tgz")
+	assert.Nil(t, ioutil.WriteFile(artifact, testText, 0644))
+	gpg("--pinentry-mode", "loopback", "--armor", "--detach-sign", "--output", artifact+".asc", artifact)
+
+	keyring := filepath.Join(t.TempDir(), "keys.asc")
+	gpg("--armor", "--export", "--output", keyring)
+
+	local := filepath.Join(t.TempDir(), "infra.tgz")
+	assert.Nil(t, ioutil.WriteFile(local, testText, 0644))
+	assert.Nil(t, verifyArtifactWith(fileDownloader{remote}, "infra.tgz", local, false, true, keyring))
+
+	// A tampered artifact or a keyring without the signing key is refused
+	assert.Nil(t, ioutil.WriteFile(local, testHashlessText, 0644))
+	assert.NotNil(t, verifyArtifactWith(fileDownloader{remote}, "infra.tgz", local, false, true, keyring))
+
+	assert.Nil(t, ioutil.WriteFile(local, testText, 0644))
+	emptyKeyring := filepath.Join(t.TempDir(), "empty.asc")
+	assert.Nil(t, ioutil.WriteFile(emptyKeyring, nil, 0644))
+	assert.NotNil(t, verifyArtifactWith(fileDownloader{remote}, "infra.tgz", local, false, true, emptyKeyring))
+}